@@ -0,0 +1,240 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Read requests with cfg.DeviceReaders goroutines, each with its own clone of
+// the fuse device, if we're talking to the device directly. Failing to clone
+// it is only logged, since fewer readers still work.
+func (c *Connection) startDeviceReaders() {
+	dev, ok := c.transport.(*deviceTransport)
+	if !ok || c.cfg.DeviceReaders <= 1 {
+		return
+	}
+
+	devs := []*deviceTransport{dev}
+	for len(devs) < c.cfg.DeviceReaders {
+		clone, err := cloneDevice(dev)
+		if err != nil {
+			if c.errorLogger != nil {
+				c.errorLogger.Printf("Reading requests with %d goroutines: %v", len(devs), err)
+			}
+
+			break
+		}
+
+		devs = append(devs, clone)
+	}
+
+	if len(devs) == 1 {
+		return
+	}
+
+	c.transport = newClonedTransport(devs)
+	c.multipleReaders = true
+}
+
+// Open another fd for the connection of the supplied device.
+func cloneDevice(dev *deviceTransport) (*deviceTransport, error) {
+	// Blocking mode, as for directmount.
+	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Open: %v", err)
+	}
+
+	old := uint32(dev.f.Fd())
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		uintptr(fd),
+		fusekernel.DevIocClone,
+		uintptr(unsafe.Pointer(&old)))
+
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("FUSE_DEV_IOC_CLONE: %v", errno)
+	}
+
+	return &deviceTransport{f: os.NewFile(uintptr(fd), "/dev/fuse")}, nil
+}
+
+// Return the fuse device that c talks to, if any.
+func (c *Connection) fuseDevice() (*deviceTransport, bool) {
+	switch t := c.transport.(type) {
+	case *deviceTransport:
+		return t, true
+
+	case *clonedTransport:
+		return t.devs[0], true
+
+	case *uringTransport:
+		return t.dev, true
+	}
+
+	return nil, false
+}
+
+// A Transport that reads requests from several clones of the fuse device at
+// once, with a goroutine for each, and sends each reply to the clone that its
+// request came from, as the kernel requires.
+type clonedTransport struct {
+	devs []*deviceTransport
+
+	// Messages read from the devices.
+	reads chan clonedRead
+
+	// Closed by Close.
+	done chan struct{}
+
+	mu sync.Mutex
+
+	// The device from which each request returned by Read was read, by unique
+	// ID, until it is replied to.
+	//
+	// GUARDED_BY(mu)
+	pending map[uint64]*deviceTransport
+}
+
+type clonedRead struct {
+	dev *deviceTransport
+	m   *buffer.InMessage
+	err error
+}
+
+func newClonedTransport(devs []*deviceTransport) *clonedTransport {
+	t := &clonedTransport{
+		devs:    devs,
+		reads:   make(chan clonedRead),
+		done:    make(chan struct{}),
+		pending: make(map[uint64]*deviceTransport),
+	}
+
+	for _, dev := range devs {
+		go t.readDevice(dev)
+	}
+
+	return t
+}
+
+// Read requests from dev until it fails or the transport is closed, each into
+// a message of its own from the pool, which ReadMessage hands on as it is.
+func (t *clonedTransport) readDevice(dev *deviceTransport) {
+	for {
+		m := buffer.GetInMessage()
+		err := m.Init(dev)
+		for {
+			pe, ok := err.(*os.PathError)
+			if !ok || pe.Err != syscall.EINTR {
+				break
+			}
+
+			err = m.Init(dev)
+		}
+
+		if err != nil {
+			buffer.PutInMessage(m)
+			m = nil
+		}
+
+		select {
+		case t.reads <- clonedRead{dev, m, err}:
+		case <-t.done:
+			if m != nil {
+				buffer.PutInMessage(m)
+			}
+
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ReadMessage returns the next request read from any of the devices, saving
+// Connection.readMessage a copy.
+func (t *clonedTransport) ReadMessage() (*buffer.InMessage, error) {
+	r := <-t.reads
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// Remember where to send the reply, for the requests that get one.
+	h := r.m.Header()
+	switch h.Opcode {
+	case fusekernel.OpForget, fusekernel.OpBatchForget, fusekernel.OpInterrupt:
+	default:
+		t.mu.Lock()
+		t.pending[h.Unique] = r.dev
+		t.mu.Unlock()
+	}
+
+	return r.m, nil
+}
+
+// Read completes the Transport interface; Connection uses ReadMessage
+// instead.
+func (t *clonedTransport) Read(p []byte) (int, error) {
+	m, err := t.ReadMessage()
+	if err != nil {
+		return 0, err
+	}
+
+	defer buffer.PutInMessage(m)
+	return copy(p, m.Bytes()), nil
+}
+
+func (t *clonedTransport) Writev(bufs [][]byte) error {
+	if len(bufs) == 0 || len(bufs[0]) < int(unsafe.Sizeof(fusekernel.OutHeader{})) {
+		return fmt.Errorf("Short reply")
+	}
+
+	unique := (*fusekernel.OutHeader)(unsafe.Pointer(&bufs[0][0])).Unique
+
+	t.mu.Lock()
+	dev := t.pending[unique]
+	delete(t.pending, unique)
+	t.mu.Unlock()
+
+	// Notifications may go to any of the devices.
+	if dev == nil {
+		dev = t.devs[0]
+	}
+
+	return dev.Writev(bufs)
+}
+
+func (t *clonedTransport) Close() error {
+	close(t.done)
+
+	var firstErr error
+	for _, dev := range t.devs {
+		if err := dev.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,115 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Initialize a connection, then have it read from a second fake device too,
+// as if it had been cloned. Return the kernel sides of both.
+func clonedConnection(t *testing.T) (c *Connection, kernels [2]*os.File) {
+	t.Helper()
+
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	c, kernels[0], _ = initConnection(t, MountConfig{}, in, fusekernel.InitInExt{})
+
+	dev, kernel := fakeDevice(t)
+	kernels[1] = kernel
+
+	devs := []*deviceTransport{c.transport.(*deviceTransport), {dev}}
+	t.Cleanup(func() { c.transport.Close() })
+	c.transport = newClonedTransport(devs)
+	c.multipleReaders = true
+
+	return c, kernels
+}
+
+func TestClonedTransport_ReplyRouting(t *testing.T) {
+	c, kernels := clonedConnection(t)
+
+	sendRequest(t, kernels[0], fusekernel.OpLookup, 2, []byte("foo\x00"))
+	sendRequest(t, kernels[1], fusekernel.OpLookup, 3, []byte("bar\x00"))
+	serveOps(t, c, 2, func(op interface{}) error { return syscall.ENOENT })
+
+	// Each reply goes back to the device its request came from.
+	for i, want := range []uint64{2, 3} {
+		hdr, _ := readReply(t, kernels[i])
+		if hdr.Unique != want {
+			t.Errorf("device %d: got reply to %d, want %d", i, hdr.Unique, want)
+		}
+	}
+}
+
+func TestClonedTransport_EarlyInterrupt(t *testing.T) {
+	c, kernels := clonedConnection(t)
+
+	// The interrupt overtakes its op, as it can when they are read from
+	// different clones.
+	interrupt := fusekernel.InterruptIn{Unique: 5}
+	sendRequest(t, kernels[1], fusekernel.OpInterrupt, 4, wire(t, interrupt))
+	sendRequest(t, kernels[1], fusekernel.OpLookup, 5, []byte("foo\x00"))
+
+	ctx, _, err := c.ReadOp()
+	if err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	select {
+	case <-ctx.Done():
+	default:
+		t.Error("op's context not cancelled")
+	}
+
+	c.Reply(ctx, syscall.EINTR)
+	if hdr, _ := readReply(t, kernels[1]); hdr.Unique != 5 {
+		t.Errorf("got reply to %d, want 5", hdr.Unique)
+	}
+}
+
+func TestClonedTransport_Write(t *testing.T) {
+	c, kernels := clonedConnection(t)
+
+	// Write payloads arrive intact from either device.
+	for i, data := range []string{"taco", "burrito"} {
+		in := fusekernel.WriteIn{Size: uint32(len(data))}
+		sendRequest(t, kernels[i], fusekernel.OpWrite, uint64(2+i), wire(t, in), []byte(data))
+	}
+
+	got := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			t.Fatalf("ReadOp: %v", err)
+		}
+
+		w, ok := op.(*fuseops.WriteFileOp)
+		if !ok {
+			t.Fatalf("got op %T", op)
+		}
+
+		got[string(w.Data)] = true
+		c.Reply(ctx, nil)
+	}
+
+	if !got["taco"] || !got["burrito"] {
+		t.Errorf("got writes %v", got)
+	}
+}
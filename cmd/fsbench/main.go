@@ -0,0 +1,136 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// fsbench measures the latency and throughput of file system operations
+// against a directory, normally the mount point of a fuse.Server:
+//
+//	fsbench --dir /mnt/foo
+//	fsbench --dir /mnt/foo --bench stat,randread-4k --n 100000
+//
+// With --memfs it instead mounts an in-memory file system itself and measures
+// that, which shows the overhead of the fuse package and the kernel. See
+// package fsbench for the benchmarks.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fsbench"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+var fDir = flag.String("dir", "", "Directory to run the benchmarks in, normally a mount point.")
+var fMemFS = flag.Bool("memfs", false, "Mount an in-memory file system at a temporary directory and run the benchmarks there, rather than in --dir.")
+var fBench = flag.String("bench", "", "Comma-separated benchmarks to run. Default all.")
+var fN = flag.Int("n", 10000, "Operations to time per benchmark.")
+var fFiles = flag.Int("files", 0, "Files for the stat benchmark. Zero for the default.")
+var fEntries = flag.Int("entries", 0, "Entries in the directory for the readdir benchmark. Zero for the default.")
+var fFileSize = flag.Int64("file_size", 0, "Bytes in the file for the I/O benchmarks. Zero for the default.")
+
+// Mount memfs at a temporary directory, returning the directory and a function
+// that unmounts it.
+func mountMemFS() (string, func(), error) {
+	dir, err := os.MkdirTemp("", "fsbench")
+	if err != nil {
+		return "", nil, fmt.Errorf("MkdirTemp: %v", err)
+	}
+
+	server := memfs.NewMemFS(uint32(os.Getuid()), uint32(os.Getgid()))
+	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{FSName: "fsbench"})
+	if err != nil {
+		os.Remove(dir)
+		return "", nil, fmt.Errorf("Mount: %v", err)
+	}
+
+	unmount := func() {
+		if err := fuse.Unmount(dir); err != nil {
+			log.Printf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			log.Printf("Join: %v", err)
+		}
+
+		os.Remove(dir)
+	}
+
+	return dir, unmount, nil
+}
+
+// Run the benchmarks, returning false if any failed.
+func run() bool {
+	var benchmarks []*fsbench.Benchmark
+	if *fBench == "" {
+		benchmarks = fsbench.Benchmarks
+	} else {
+		for _, name := range strings.Split(*fBench, ",") {
+			b := fsbench.Lookup(name)
+			if b == nil {
+				log.Fatalf("Unknown benchmark: %q", name)
+			}
+
+			benchmarks = append(benchmarks, b)
+		}
+	}
+
+	dir := *fDir
+	switch {
+	case *fMemFS:
+		var unmount func()
+		var err error
+		dir, unmount, err = mountMemFS()
+		if err != nil {
+			log.Fatalf("mountMemFS: %v", err)
+		}
+
+		defer unmount()
+
+	case dir == "":
+		log.Fatalf("You must set --dir or --memfs.")
+	}
+
+	cfg := fsbench.Config{
+		Files:    *fFiles,
+		Entries:  *fEntries,
+		FileSize: *fFileSize,
+	}
+
+	failed := false
+	for _, b := range benchmarks {
+		r, err := fsbench.Run(b, dir, cfg, *fN)
+		if err != nil {
+			log.Print(err)
+			failed = true
+			continue
+		}
+
+		fmt.Println(r)
+	}
+
+	return !failed
+}
+
+func main() {
+	flag.Parse()
+
+	if !run() {
+		os.Exit(1)
+	}
+}
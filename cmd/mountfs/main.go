@@ -0,0 +1,221 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// mountfs mounts any of the sample file systems by name, for trying them out
+// by hand:
+//
+//	mountfs --type memfs --mount_point /mnt/foo
+//	mountfs --type loopbackfs --loopbackfs.path /tmp/bar --mount_point /mnt/foo --debug
+//	mountfs --type hellofs --mount_point /mnt/foo -o allow_other --cpu_profile /tmp/cpu.prof
+//	mountfs --type memfs --virtiofs_socket /tmp/memfs.sock
+//
+// Flags specific to a sample are named after it. It stays in the foreground
+// until the file system is unmounted, which it does itself on SIGINT or
+// SIGTERM, and writes any profiles then. With --daemon it goes into the
+// background instead, once the file system is mounted. Run it with --help for
+// the list of samples.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseaudit"
+	"github.com/jacobsa/fuse/fusedebug"
+	"github.com/jacobsa/fuse/virtiofs"
+)
+
+var fType = flag.String("type", "", "Name of the sample file system to mount.")
+var fMountPoint = flag.String("mount_point", "", "Path to mount point.")
+var fVirtiofsSocket = flag.String("virtiofs_socket", "", "Instead of mounting, serve the file system to a virtual machine as a virtio-fs device, via a vhost-user socket at this path.")
+var fReadOnly = flag.Bool("read_only", false, "Mount in read-only mode.")
+var fFSName = flag.String("fsname", "", "Name of the file system shown by mount(8). Defaults to --type.")
+var fOptions = flag.String("o", "", "Comma-separated mount options to pass to the kernel, each either name or name=value.")
+var fDaemon = flag.Bool("daemon", false, "Run in the background, exiting once the file system is mounted with a status that says whether that succeeded.")
+var fAuditLog = flag.String("audit_log", "", "File to which to append an audit trail of security-relevant ops, rotated every 100 MiB.")
+
+var fDebug = flag.Bool("debug", false, "Enable debug logging.")
+var fPprof = flag.Int("pprof", 0, "Serve pprof profiles on the specified port, along with the fusedebug pages for health, connection parameters and op counts.")
+var fCPUProfile = flag.String("cpu_profile", "", "File to which to write a CPU profile covering the time until unmount.")
+var fMemProfile = flag.String("mem_profile", "", "File to which to write a heap profile after unmount.")
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s --type <sample> --mount_point <dir> [flags]\n\nSamples:\n", os.Args[0])
+	for _, s := range samples {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %-14s%s\n", s.name, s.description)
+	}
+
+	fmt.Fprintf(flag.CommandLine.Output(), "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// Parse the value of -o into mount options.
+func parseOptions(s string) map[string]string {
+	options := make(map[string]string)
+	for _, o := range strings.Split(s, ",") {
+		if o == "" {
+			continue
+		}
+
+		k, v, _ := strings.Cut(o, "=")
+		options[k] = v
+	}
+
+	return options
+}
+
+func writeMemProfile() error {
+	f, err := os.Create(*fMemProfile)
+	if err != nil {
+		return fmt.Errorf("Create: %v", err)
+	}
+
+	defer f.Close()
+
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		return fmt.Errorf("WriteHeapProfile: %v", err)
+	}
+
+	return f.Close()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if *fType == "" {
+		log.Fatalf("You must set --type.")
+	}
+
+	if *fMountPoint == "" && *fVirtiofsSocket == "" {
+		log.Fatalf("You must set --mount_point or --virtiofs_socket.")
+	}
+
+	s := lookUpSample(*fType)
+	if s == nil {
+		log.Fatalf("Unknown --type %q; run with --help for the list.", *fType)
+	}
+
+	if *fDaemon {
+		if *fVirtiofsSocket != "" {
+			log.Fatalf("--daemon can't be used with --virtiofs_socket.")
+		}
+
+		if err := fuse.Daemonize(); err != nil {
+			log.Fatalf("Daemonize: %v", err)
+		}
+	}
+
+	// The kernel has already applied the caller's umask to the modes of new
+	// files, so don't apply ours as well.
+	syscall.Umask(0)
+
+	fsName := *fFSName
+	if fsName == "" {
+		fsName = s.name
+	}
+
+	cfg := &fuse.MountConfig{
+		FSName:      fsName,
+		Subtype:     s.name,
+		ReadOnly:    *fReadOnly,
+		Options:     parseOptions(*fOptions),
+		ErrorLogger: log.New(os.Stderr, "fuse: ", 0),
+	}
+
+	if *fDebug {
+		cfg.DebugLogger = log.New(os.Stdout, "fuse: ", 0)
+	}
+
+	server, err := s.new(cfg)
+	if err != nil {
+		fuse.SignalMountOutcome(fmt.Errorf("%s: %v", s.name, err))
+		log.Fatalf("%s: %v", s.name, err)
+	}
+
+	if *fPprof != 0 {
+		d := fusedebug.New()
+		server = d.Wrap(server)
+		go func() {
+			fmt.Printf("%v", http.ListenAndServe(fmt.Sprintf("localhost:%v", *fPprof), d))
+		}()
+	}
+
+	if *fAuditLog != "" {
+		f, err := fuseaudit.OpenRotatingFile(*fAuditLog, 100<<20, 10)
+		if err != nil {
+			log.Fatalf("OpenRotatingFile: %v", err)
+		}
+
+		defer f.Close()
+		server, _ = fuseaudit.Wrap(server, f)
+	}
+
+	if *fCPUProfile != "" {
+		f, err := os.Create(*fCPUProfile)
+		if err != nil {
+			log.Fatalf("Create: %v", err)
+		}
+
+		if err := pprof.StartCPUProfile(f); err != nil {
+			log.Fatalf("StartCPUProfile: %v", err)
+		}
+
+		defer func() {
+			pprof.StopCPUProfile()
+			if err := f.Close(); err != nil {
+				log.Printf("Close: %v", err)
+			}
+		}()
+	}
+
+	if *fVirtiofsSocket != "" {
+		if err := virtiofs.Serve(*fVirtiofsSocket, server, cfg); err != nil {
+			log.Fatalf("Serve: %v", err)
+		}
+
+		return
+	}
+
+	mfs, err := fuse.Mount(*fMountPoint, server, cfg)
+	fuse.SignalMountOutcome(err)
+	if err != nil {
+		log.Fatalf("Mount: %v", err)
+	}
+
+	// Unmount on interrupt, so that the profiles get written.
+	mfs.UnmountOnSignal(10 * time.Second)
+
+	// Wait for it to be unmounted.
+	if err = mfs.Join(context.Background()); err != nil {
+		log.Fatalf("Join: %v", err)
+	}
+
+	if *fMemProfile != "" {
+		if err := writeMemProfile(); err != nil {
+			log.Fatalf("writeMemProfile: %v", err)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples/archivefs"
+	"github.com/jacobsa/fuse/samples/cachewrap"
+	"github.com/jacobsa/fuse/samples/cryptfs"
+	"github.com/jacobsa/fuse/samples/dynamicfs"
+	"github.com/jacobsa/fuse/samples/hellofs"
+	"github.com/jacobsa/fuse/samples/httpfs"
+	"github.com/jacobsa/fuse/samples/loopbackfs"
+	"github.com/jacobsa/fuse/samples/memfs"
+	"github.com/jacobsa/fuse/samples/readbenchfs"
+	"github.com/jacobsa/fuse/samples/roloopbackfs"
+	"github.com/jacobsa/fuse/samples/unionfs"
+	"github.com/jacobsa/timeutil"
+)
+
+// A file system that can be mounted with --type.
+type sample struct {
+	name        string
+	description string
+
+	// Create the server, adjusting the mount config if the file system needs
+	// particular options. Flags specific to the sample are named after it, for
+	// example --memfs.capacity.
+	new func(cfg *fuse.MountConfig) (fuse.Server, error)
+}
+
+// The samples that can be mounted, sorted by name.
+var samples = []sample{
+	{
+		name:        "archivefs",
+		description: "The contents of a zip or tar archive, read-only.",
+		new:         newArchiveFS,
+	},
+	{
+		name:        "cachewrap",
+		description: "A directory, with the contents of its files cached locally.",
+		new:         newCacheWrap,
+	},
+	{
+		name:        "cryptfs",
+		description: "A directory in which names and contents are stored encrypted.",
+		new:         newCryptFS,
+	},
+	{
+		name:        "dynamicfs",
+		description: "Files whose contents change each time they are read.",
+		new:         newDynamicFS,
+	},
+	{
+		name:        "hellofs",
+		description: "A small fixed tree of files.",
+		new:         newHelloFS,
+	},
+	{
+		name:        "httpfs",
+		description: "The files served by an HTTP or WebDAV server, read-only.",
+		new:         newHTTPFS,
+	},
+	{
+		name:        "loopbackfs",
+		description: "A directory, passed through.",
+		new:         newLoopbackFS,
+	},
+	{
+		name:        "memfs",
+		description: "An in-memory file system.",
+		new:         newMemFS,
+	},
+	{
+		name:        "readbenchfs",
+		description: "Large files of generated contents, for benchmarking reads.",
+		new:         newReadBenchFS,
+	},
+	{
+		name:        "roloopbackfs",
+		description: "A directory, passed through read-only.",
+		new:         newROLoopbackFS,
+	},
+	{
+		name:        "unionfs",
+		description: "A writable directory layered on top of read-only ones.",
+		new:         newUnionFS,
+	},
+}
+
+// Return the sample with the supplied name, or nil if there is none.
+func lookUpSample(name string) *sample {
+	for i := range samples {
+		if samples[i].name == name {
+			return &samples[i]
+		}
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// archivefs
+////////////////////////////////////////////////////////////////////////
+
+var fArchive = flag.String("archivefs.archive", "", "Zip or tar archive to serve.")
+
+func newArchiveFS(cfg *fuse.MountConfig) (fuse.Server, error) {
+	if *fArchive == "" {
+		return nil, fmt.Errorf("You must set --archivefs.archive.")
+	}
+
+	cfg.ReadOnly = true
+	return archivefs.NewArchiveFS(*fArchive)
+}
+
+////////////////////////////////////////////////////////////////////////
+// cachewrap
+////////////////////////////////////////////////////////////////////////
+
+var fCacheOrigin = flag.String("cachewrap.origin", "", "Directory to serve, typically on slow storage.")
+var fCacheDir = flag.String("cachewrap.cache_dir", "", "Directory in which to cache file contents. If unset, they are cached in memory.")
+var fCacheCapacity = flag.Int64("cachewrap.capacity", 0, "Bytes of closed files to keep cached, or zero for no limit.")
+
+func newCacheWrap(cfg *fuse.MountConfig) (fuse.Server, error) {
+	if *fCacheOrigin == "" {
+		return nil, fmt.Errorf("You must set --cachewrap.origin.")
+	}
+
+	origin, err := loopbackfs.NewLoopbackFileSystem(*fCacheOrigin)
+	if err != nil {
+		return nil, fmt.Errorf("NewLoopbackFileSystem: %v", err)
+	}
+
+	fs, err := cachewrap.Wrap(origin, cachewrap.Config{
+		CacheDir: *fCacheDir,
+		Capacity: *fCacheCapacity,
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("Wrap: %v", err)
+	}
+
+	return fuseutil.NewFileSystemServer(fs), nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// cryptfs
+////////////////////////////////////////////////////////////////////////
+
+var fCryptBacking = flag.String("cryptfs.backing", "", "Directory in which to store encrypted files.")
+var fCryptKeyFile = flag.String("cryptfs.key_file", "", "File containing the key, in hex. See mount_cryptfs for generating one.")
+
+func newCryptFS(cfg *fuse.MountConfig) (fuse.Server, error) {
+	if *fCryptBacking == "" {
+		return nil, fmt.Errorf("You must set --cryptfs.backing.")
+	}
+
+	if *fCryptKeyFile == "" {
+		return nil, fmt.Errorf("You must set --cryptfs.key_file.")
+	}
+
+	contents, err := os.ReadFile(*fCryptKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("ReadFile: %v", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, fmt.Errorf("DecodeString: %v", err)
+	}
+
+	return cryptfs.NewCryptFS(*fCryptBacking, key)
+}
+
+////////////////////////////////////////////////////////////////////////
+// dynamicfs and hellofs
+////////////////////////////////////////////////////////////////////////
+
+func newDynamicFS(cfg *fuse.MountConfig) (fuse.Server, error) {
+	return dynamicfs.NewDynamicFS(timeutil.RealClock())
+}
+
+func newHelloFS(cfg *fuse.MountConfig) (fuse.Server, error) {
+	return hellofs.NewHelloFS(timeutil.RealClock())
+}
+
+////////////////////////////////////////////////////////////////////////
+// httpfs
+////////////////////////////////////////////////////////////////////////
+
+var fHTTPURL = flag.String("httpfs.url", "", "URL of the directory to mount.")
+var fHTTPWebDAV = flag.Bool("httpfs.webdav", false, "List directories with WebDAV rather than HTML indexes.")
+var fHTTPDirectIO = flag.Bool("httpfs.direct_io", false, "Send every read to the server, bypassing the page cache.")
+var fHTTPTTL = flag.Duration("httpfs.ttl", time.Minute, "How long to cache attributes and directory listings.")
+
+func newHTTPFS(cfg *fuse.MountConfig) (fuse.Server, error) {
+	if *fHTTPURL == "" {
+		return nil, fmt.Errorf("You must set --httpfs.url.")
+	}
+
+	uid, gid, err := currentUser()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.ReadOnly = true
+	return httpfs.NewHTTPFS(*fHTTPURL, httpfs.Config{
+		WebDAV:       *fHTTPWebDAV,
+		DirectIO:     *fHTTPDirectIO,
+		AttributeTTL: *fHTTPTTL,
+		Uid:          uid,
+		Gid:          gid,
+	})
+}
+
+////////////////////////////////////////////////////////////////////////
+// loopbackfs and roloopbackfs
+////////////////////////////////////////////////////////////////////////
+
+var fLoopbackPath = flag.String("loopbackfs.path", "", "Directory to serve.")
+var fROLoopbackPath = flag.String("roloopbackfs.path", "", "Directory to serve.")
+
+func newLoopbackFS(cfg *fuse.MountConfig) (fuse.Server, error) {
+	if *fLoopbackPath == "" {
+		return nil, fmt.Errorf("You must set --loopbackfs.path.")
+	}
+
+	// It takes its own locks, so lookups needn't wait for each other.
+	cfg.EnableParallelDirOps = true
+	return loopbackfs.NewLoopbackFS(*fLoopbackPath)
+}
+
+func newROLoopbackFS(cfg *fuse.MountConfig) (fuse.Server, error) {
+	if *fROLoopbackPath == "" {
+		return nil, fmt.Errorf("You must set --roloopbackfs.path.")
+	}
+
+	cfg.ReadOnly = true
+	return roloopbackfs.NewReadonlyLoopbackServer(
+		*fROLoopbackPath,
+		log.New(os.Stderr, "roloopbackfs: ", 0))
+}
+
+////////////////////////////////////////////////////////////////////////
+// memfs
+////////////////////////////////////////////////////////////////////////
+
+var fMemNoAtime = flag.Bool("memfs.noatime", false, "Don't update access times.")
+var fMemCapacity = flag.Uint64("memfs.capacity", 0, "Maximum bytes of file contents, or zero for no limit.")
+
+func newMemFS(cfg *fuse.MountConfig) (fuse.Server, error) {
+	uid, gid, err := currentUser()
+	if err != nil {
+		return nil, err
+	}
+
+	// Every op takes the file system's lock, so this is safe.
+	cfg.EnableParallelDirOps = true
+	server := memfs.NewMemFSWithOptions(uid, gid, memfs.Options{
+		NoAtime:  *fMemNoAtime,
+		Capacity: *fMemCapacity,
+	})
+
+	return server, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// readbenchfs
+////////////////////////////////////////////////////////////////////////
+
+var fReadBenchVectored = flag.Bool("readbenchfs.vectored", false, "Use vectored reads.")
+
+func newReadBenchFS(cfg *fuse.MountConfig) (fuse.Server, error) {
+	cfg.ReadOnly = true
+	cfg.UseVectoredRead = *fReadBenchVectored
+	return readbenchfs.NewReadBenchServer(*fReadBenchVectored)
+}
+
+////////////////////////////////////////////////////////////////////////
+// unionfs
+////////////////////////////////////////////////////////////////////////
+
+var fUnionUpper = flag.String("unionfs.upper", "", "Writable directory to layer on top.")
+var fUnionLower = flag.String("unionfs.lower", "", "Colon-separated read-only directories, topmost first.")
+
+func newUnionFS(cfg *fuse.MountConfig) (fuse.Server, error) {
+	if *fUnionUpper == "" {
+		return nil, fmt.Errorf("You must set --unionfs.upper.")
+	}
+
+	if *fUnionLower == "" {
+		return nil, fmt.Errorf("You must set --unionfs.lower.")
+	}
+
+	cfg.EnableRenameFlags = true
+	return unionfs.NewUnionFS(*fUnionUpper, strings.Split(*fUnionLower, ":"))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Return the IDs of the user running the command, to own the files of samples
+// that don't take them from elsewhere.
+func currentUser() (uid, gid uint32, err error) {
+	u, err := user.Current()
+	if err != nil {
+		return 0, 0, fmt.Errorf("Current: %v", err)
+	}
+
+	u64, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("ParseUint: %v", err)
+	}
+
+	g64, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("ParseUint: %v", err)
+	}
+
+	return uint32(u64), uint32(g64), nil
+}
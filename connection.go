@@ -19,15 +19,18 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"os"
 	"path"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+	"unsafe"
 
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/internal/buffer"
-	"github.com/jacobsa/fuse/internal/freelist"
 	"github.com/jacobsa/fuse/internal/fusekernel"
 )
 
@@ -56,6 +59,10 @@ var contextKey interface{} = contextKeyType(0)
 // Reading a page at a time is a drag. Ask for a larger size.
 const maxReadahead = 1 << 20
 
+// The largest request or reply we allow, in pages, which the kernel has let
+// us raise from 32 since Linux 4.20.
+const maxPages = 256
+
 // Connection represents a connection to the fuse kernel process. It is used to
 // receive and reply to requests from the kernel.
 type Connection struct {
@@ -63,22 +70,93 @@ type Connection struct {
 	debugLogger *log.Logger
 	errorLogger *log.Logger
 
-	// The device through which we're talking to the kernel, and the protocol
-	// version that we're using to talk to it.
-	dev      *os.File
-	protocol fusekernel.Protocol
+	// The transport through which we're talking to the kernel, and the
+	// protocol version that we're using to talk to it.
+	transport Transport
+	protocol  fusekernel.Protocol
+
+	// The outcome of Init.
+	initResult fuseops.InitOp
 
 	mu sync.Mutex
 
 	// A map from fuse "unique" request ID (*not* the op ID for logging used
-	// above) to a function that cancel's its associated context.
+	// above) to bookkeeping for the op, including a function that cancels its
+	// associated context.
+	//
+	// GUARDED_BY(mu)
+	inflight map[uint64]*inflightOp
+
+	// Why the kernel hung up, once ReadOp has returned io.EOF. See Err.
+	//
+	// GUARDED_BY(mu)
+	hangup error
+
+	// Set by beginDrain. While draining, newly read ops are failed rather than
+	// returned by ReadOp, and drained is closed once inflight holds nothing
+	// but aborted ops. draining is only written with mu held.
+	draining atomic.Bool
+
+	// GUARDED_BY(mu)
+	drained chan struct{}
+
+	// Set from cfg.ReadOnly and by MountedFileSystem.RemountReadOnly. While
+	// set, ops that would modify the file system are failed with EROFS rather
+	// than returned by ReadOp.
+	readOnly atomic.Bool
+
+	// Installed by Chain before any ops are read, and constant thereafter.
+	interceptors []Interceptor
+
+	// The number of successful ops considered for logging to cfg.Logger, for
+	// sampling.
+	logCount atomic.Uint64
+
+	// Closed by close to stop the stall watchdog, if it is running.
+	stopWatchdog chan struct{}
+
+	// Set if requests are read from several clones of the fuse device (see
+	// cfg.DeviceReaders), in which case an interrupt may be read before the op
+	// it is for. Constant once ops are served.
+	multipleReaders bool
+
+	// With multipleReaders, the IDs of the most recent interrupts for ops that
+	// weren't in flight, which may yet arrive. At most maxEarlyInterrupts.
 	//
 	// GUARDED_BY(mu)
-	cancelFuncs map[uint64]func()
+	earlyInterrupts []uint64
+}
+
+// The number of interrupts for unknown ops remembered with multipleReaders.
+// An interrupt can only overtake its op by the few requests being read at
+// once, so this need not be large.
+const maxEarlyInterrupts = 64
+
+// Bookkeeping for an op that has been read but not yet replied to.
+type inflightOp struct {
+	cancel func()
+
+	// What the op is and when it was read, for DumpInflight.
+	op     interface{}
+	opcode uint32
+	inode  uint64
+	start  time.Time
+
+	// Set once the server has called MarkOpStarted for the op, along with the
+	// ID of the calling goroutine if cfg.TrackOpGoroutines is set (zero if
+	// unknown).
+	started   bool
+	goroutine uint64
+
+	// For a WriteFileOp, the length of the data it carries, for Stats.
+	writeBytes int
 
-	// Freelists, serviced by freelists.go.
-	inMessages  freelist.Freelist // GUARDED_BY(mu)
-	outMessages freelist.Freelist // GUARDED_BY(mu)
+	// Set once the stall watchdog has reported the op.
+	stallReported bool
+
+	// Set if abortInflight has replied to the op on the server's behalf, in
+	// which case the server's own reply must not be sent.
+	aborted bool
 }
 
 // State that is maintained for each in-flight op. This is stuffed into the
@@ -87,9 +165,16 @@ type opState struct {
 	inMsg  *buffer.InMessage
 	outMsg *buffer.OutMessage
 	op     interface{}
+
+	// The number of c.interceptors that let the op through, and that should
+	// therefore see the reply.
+	intercepted int
+
+	// When the op was read.
+	start time.Time
 }
 
-// Create a connection wrapping the supplied file descriptor connected to the
+// Create a connection wrapping the supplied transport connected to the
 // kernel. You must eventually call c.close().
 //
 // The loggers may be nil.
@@ -97,14 +182,15 @@ func newConnection(
 	cfg MountConfig,
 	debugLogger *log.Logger,
 	errorLogger *log.Logger,
-	dev *os.File) (*Connection, error) {
+	t Transport) (*Connection, error) {
 	c := &Connection{
 		cfg:         cfg,
 		debugLogger: debugLogger,
 		errorLogger: errorLogger,
-		dev:         dev,
-		cancelFuncs: make(map[uint64]func()),
+		transport:   t,
+		inflight:    make(map[uint64]*inflightOp),
 	}
+	c.readOnly.Store(cfg.ReadOnly)
 
 	// Initialize.
 	if err := c.Init(); err != nil {
@@ -112,6 +198,17 @@ func newConnection(
 		return nil, fmt.Errorf("Init: %v", err)
 	}
 
+	if c.initResult.IoUring() {
+		c.startIoUring()
+	}
+
+	c.startDeviceReaders()
+
+	if cfg.StallThreshold > 0 {
+		c.stopWatchdog = make(chan struct{})
+		go c.watchStalls(c.stopWatchdog)
+	}
+
 	return c, nil
 }
 
@@ -153,13 +250,32 @@ func (c *Connection) Init() error {
 	cacheSymlinks := initOp.Flags&fusekernel.InitCacheSymlinks > 0
 	noOpenSupport := initOp.Flags&fusekernel.InitNoOpenSupport > 0
 	noOpendirSupport := initOp.Flags&fusekernel.InitNoOpendirSupport > 0
+	parallelDirOps := initOp.Flags&fusekernel.InitParallelDirOps > 0
+	explicitInvalData := initOp.Flags&fusekernel.InitExplicitInvalData > 0
+	handleKillprivV2 := runtime.GOOS == "linux" && initOp.Flags&fusekernel.InitHandleKillprivV2 > 0
+	setxattrExt := runtime.GOOS == "linux" && initOp.Flags&fusekernel.InitSetxattrExt > 0
+	abortError := runtime.GOOS == "linux" && initOp.Flags&fusekernel.InitAbortError > 0
+	initExt := runtime.GOOS == "linux" && initOp.Flags&fusekernel.InitExt > 0
+	securityCtx := initOp.Flags2&fusekernel.InitSecurityCtx > 0
+	passthrough := initOp.Flags2&fusekernel.InitPassthrough > 0
+	ioUring := initOp.Flags2&fusekernel.InitOverIoUring > 0
+	caseInsensitive := runtime.GOOS == "darwin" && initOp.Flags&fusekernel.InitCaseSensitive > 0
+	xtimes := runtime.GOOS == "darwin" && initOp.Flags&fusekernel.InitXtimes > 0
+	exchangeData := runtime.GOOS == "darwin" && initOp.Flags&fusekernel.InitExchangeData > 0
+
+	kernel := initOp.Kernel
+	kernelFlags := initOp.Flags
+	kernelFlags2 := initOp.Flags2
+	kernelReadahead := initOp.MaxReadahead
 
 	// Respond to the init op.
 	initOp.Library = c.protocol
 	initOp.MaxReadahead = maxReadahead
 	initOp.MaxWrite = buffer.MaxWriteSize
+	initOp.TimeGran = timeGran(c.cfg.TimestampGranularity)
 
 	initOp.Flags = 0
+	initOp.Flags2 = 0
 
 	// Tell the kernel not to use pitifully small 4 KiB writes.
 	initOp.Flags |= fusekernel.InitBigWrites
@@ -168,15 +284,20 @@ func (c *Connection) Init() error {
 		initOp.Flags |= fusekernel.InitAsyncRead
 	}
 
-	// kernel 4.20 increases the max from 32 -> 256
 	initOp.Flags |= fusekernel.InitMaxPages
-	initOp.MaxPages = 256
+	initOp.MaxPages = maxPages
 
 	// Enable writeback caching if the user hasn't asked us not to.
 	if !c.cfg.DisableWritebackCaching {
 		initOp.Flags |= fusekernel.InitWritebackCache
 	}
 
+	// Leave invalidating cached file contents to the file system, if it asked
+	// to (Linux >= 5.2).
+	if c.cfg.EnableExplicitInvalData && explicitInvalData {
+		initOp.Flags |= fusekernel.InitExplicitInvalData
+	}
+
 	// Enable caching symlink targets in the kernel page cache if the user opted
 	// into it (might require fixing the size field of inode attributes first):
 	if c.cfg.EnableSymlinkCaching && cacheSymlinks {
@@ -196,17 +317,114 @@ func (c *Connection) Init() error {
 	}
 
 	// Tell the Kernel to allow sending parallel lookup and readdir operations.
-	if c.cfg.EnableParallelDirOps {
+	if c.cfg.EnableParallelDirOps && parallelDirOps {
 		initOp.Flags |= fusekernel.InitParallelDirOps
 	}
 
+	// Have reads fail with ECONNABORTED rather than ENODEV if the connection is
+	// aborted through sysfs, so that Err can tell that apart from unmounting.
+	if abortError {
+		initOp.Flags |= fusekernel.InitAbortError
+	}
+
 	if c.cfg.EnableAtomicTrunc {
 		initOp.Flags |= fusekernel.InitAtomicTrunc
 	}
 
+	// Leave applying the umask to the file system, if it asked to.
+	if c.cfg.EnableDontMask {
+		initOp.Flags |= fusekernel.InitDontMask
+	}
+
+	// Leave clearing setuid and setgid bits on write and truncate to the file
+	// system, which will be told when to (Linux >= 5.11).
+	if c.cfg.EnableHandleKillPrivV2 && handleKillprivV2 {
+		initOp.Flags |= fusekernel.InitHandleKillprivV2
+	}
+
+	// Have the kernel say when setting an ACL must clear the setgid bit
+	// (Linux >= 5.16).
+	if c.cfg.EnableSetxattrExt && setxattrExt {
+		initOp.Flags |= fusekernel.InitSetxattrExt
+	}
+
+	// Ask for security labels to be sent along with create-class ops
+	// (Linux >= 5.17). The kernel only looks at Flags2 if we set InitExt.
+	if c.cfg.EnableSecurityContext && initExt && securityCtx {
+		initOp.Flags |= fusekernel.InitExt
+		initOp.Flags2 |= fusekernel.InitSecurityCtx
+	}
+
+	// Allow passing file IO through to backing files (Linux >= 6.9). Only
+	// regular file systems may provide them, hence a stacking depth of one.
+	if c.cfg.EnablePassthrough && c.cfg.DisableWritebackCaching && initExt && passthrough {
+		initOp.Flags |= fusekernel.InitExt
+		initOp.Flags2 |= fusekernel.InitPassthrough
+		initOp.MaxStackDepth = 1
+	}
+
+	// Serve requests over io_uring once newConnection has registered the
+	// queues, if we're talking to the fuse device (Linux >= 6.14).
+	_, onDevice := c.transport.(*deviceTransport)
+	if c.cfg.EnableIoUring && onDevice && initExt && ioUring {
+		initOp.Flags |= fusekernel.InitExt
+		initOp.Flags2 |= fusekernel.InitOverIoUring
+	}
+
+	// Declare the volume's capabilities on OS X, where the kernel asks for the
+	// OS X-specific ops only if we say we serve them.
+	if c.cfg.CaseInsensitive && caseInsensitive {
+		initOp.Flags |= fusekernel.InitCaseSensitive
+	}
+
+	if c.cfg.EnableXtimes && xtimes {
+		initOp.Flags |= fusekernel.InitXtimes
+	}
+
+	if c.cfg.EnableExchangeData && exchangeData {
+		initOp.Flags |= fusekernel.InitExchangeData
+	}
+
+	// Record the outcome for the server. The kernel caps readahead at what it
+	// offered.
+	c.initResult = fuseops.InitOp{
+		KernelMajor:  kernel.Major,
+		KernelMinor:  kernel.Minor,
+		Major:        c.protocol.Major,
+		Minor:        c.protocol.Minor,
+		KernelFlags:  kernelFlags,
+		KernelFlags2: kernelFlags2,
+		Flags:        initOp.Flags,
+		Flags2:       initOp.Flags2,
+		MaxWrite:     initOp.MaxWrite,
+		MaxReadahead: initOp.MaxReadahead,
+	}
+
+	if kernelReadahead < initOp.MaxReadahead {
+		c.initResult.MaxReadahead = kernelReadahead
+	}
+
 	return c.Reply(ctx, nil)
 }
 
+// Return the timestamp granularity to declare to the kernel, in nanoseconds,
+// which must be between one and a second.
+func timeGran(d time.Duration) uint32 {
+	return uint32(min(max(d, time.Nanosecond), time.Second))
+}
+
+// InitOp returns the protocol version and capabilities negotiated with the
+// kernel when the connection was opened.
+func (c *Connection) InitOp() fuseops.InitOp {
+	return c.initResult
+}
+
+// MountConfig returns the configuration with which the connection was
+// mounted, for use by servers that adjust their behavior accordingly.
+func (c *Connection) MountConfig() MountConfig {
+	return c.cfg
+}
+
 // Log information for an operation with the given ID. calldepth is the depth
 // to use when recovering file:line information with runtime.Caller.
 func (c *Connection) debugLog(
@@ -241,47 +459,88 @@ func (c *Connection) debugLog(
 	c.debugLogger.Println(msg)
 }
 
+// Record an op as in flight, returning false if the connection has begun
+// draining and so the op should not be handed out.
+//
 // LOCKS_EXCLUDED(c.mu)
-func (c *Connection) recordCancelFunc(
+func (c *Connection) recordOp(
 	fuseID uint64,
-	f func()) {
+	op *inflightOp) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if _, ok := c.cancelFuncs[fuseID]; ok {
+	if c.draining.Load() {
+		return false
+	}
+
+	if _, ok := c.inflight[fuseID]; ok {
 		panic(fmt.Sprintf("Already have cancel func for request %v", fuseID))
 	}
 
-	c.cancelFuncs[fuseID] = f
+	c.inflight[fuseID] = op
+
+	// The op may have been interrupted already.
+	for i, id := range c.earlyInterrupts {
+		if id == fuseID {
+			c.earlyInterrupts = append(c.earlyInterrupts[:i], c.earlyInterrupts[i+1:]...)
+			op.cancel()
+			break
+		}
+	}
+
+	return true
 }
 
 // Set up state for an op that is about to be returned to the user, given its
-// underlying fuse opcode and request ID.
+// header, the op itself and the time at which it was read.
 //
-// Return a context that should be used for the op.
+// Return a context that should be used for the op, or false if the op should
+// instead be failed because the connection is draining.
 //
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) beginOp(
-	opCode uint32,
-	fuseID uint64) context.Context {
+	h *fusekernel.InHeader,
+	op interface{},
+	start time.Time) (context.Context, bool) {
 	// Start with the parent context.
 	ctx := c.cfg.OpContext
 
 	// Set up a cancellation function.
 	//
 	// Special case: On Darwin, osxfuse aggressively reuses "unique" request IDs.
-	// This matters for Forget requests, which have no reply associated and
-	// therefore have IDs that are immediately eligible for reuse. For these, we
-	// should not record any state keyed on their ID.
+	// This matters for Forget and BatchForget requests, which have no reply
+	// associated and therefore have IDs that are immediately eligible for
+	// reuse. For these, we should not record any state keyed on their ID, which
+	// also keeps abortInflight from replying to them.
 	//
 	// Cf. https://github.com/osxfuse/osxfuse/issues/208
-	if opCode != fusekernel.OpForget {
+	if !isForget(h.Opcode) {
 		var cancel func()
 		ctx, cancel = context.WithCancel(ctx)
-		c.recordCancelFunc(fuseID, cancel)
+		o := &inflightOp{
+			cancel: cancel,
+			op:     op,
+			opcode: h.Opcode,
+			inode:  h.Nodeid,
+			start:  start,
+		}
+
+		if w, ok := op.(*fuseops.WriteFileOp); ok {
+			o.writeBytes = len(w.Data)
+		}
+
+		if !c.recordOp(h.Unique, o) {
+			cancel()
+			return nil, false
+		}
 	}
 
-	return ctx
+	return ctx, true
+}
+
+// Is the opcode that of a request to which the kernel expects no reply?
+func isForget(opCode uint32) bool {
+	return opCode == fusekernel.OpForget || opCode == fusekernel.OpBatchForget
 }
 
 // Clean up all state associated with an op to which the user has responded,
@@ -289,10 +548,12 @@ func (c *Connection) beginOp(
 // a response is sent to the kernel, to avoid a race where the request's ID
 // might be reused by osxfuse.
 //
+// Returns true if the op has already been replied to by abortInflight.
+//
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) finishOp(
 	opCode uint32,
-	fuseID uint64) {
+	fuseID uint64) (aborted bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -300,16 +561,145 @@ func (c *Connection) finishOp(
 	// for the cancellation function to be invoked. We also must remove it from
 	// our map.
 	//
-	// Special case: we don't do this for Forget requests. See the note in
-	// beginOp above.
-	if opCode != fusekernel.OpForget {
-		cancel, ok := c.cancelFuncs[fuseID]
+	// Special case: we don't do this for Forget and BatchForget requests. See
+	// the note in beginOp above.
+	if !isForget(opCode) {
+		o, ok := c.inflight[fuseID]
 		if !ok {
 			panic(fmt.Sprintf("Unknown request ID in finishOp: %v", fuseID))
 		}
 
-		cancel()
-		delete(c.cancelFuncs, fuseID)
+		o.cancel()
+		delete(c.inflight, fuseID)
+		aborted = o.aborted
+	}
+
+	c.checkDrained()
+	return aborted
+}
+
+// Close c.drained if we're draining and nothing but aborted ops remain.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *Connection) checkDrained() {
+	if !c.draining.Load() || c.drained == nil {
+		return
+	}
+
+	for _, o := range c.inflight {
+		if !o.aborted {
+			return
+		}
+	}
+
+	close(c.drained)
+	c.drained = nil
+}
+
+// Stop handing newly read ops to the server, failing them with EIO instead,
+// and return a channel that is closed once every op already handed out has
+// been replied to.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) beginDrain() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	drained := make(chan struct{})
+	c.draining.Store(true)
+	c.drained = drained
+	c.checkDrained()
+
+	return drained
+}
+
+// Reply to every op still in flight with the supplied error, cancelling their
+// contexts. The server's own replies to them, when they come, are dropped.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) abortInflight(errno syscall.Errno) {
+	var ids []uint64
+
+	c.mu.Lock()
+	for id, o := range c.inflight {
+		if !o.aborted {
+			o.aborted = true
+			o.cancel()
+			ids = append(ids, id)
+		}
+	}
+	c.checkDrained()
+	c.mu.Unlock()
+
+	for _, id := range ids {
+		h := fusekernel.OutHeader{
+			Len:    uint32(buffer.OutMessageHeaderSize),
+			Error:  -int32(errno),
+			Unique: id,
+		}
+
+		msg := (*[buffer.OutMessageHeaderSize]byte)(unsafe.Pointer(&h))[:]
+		if err := c.writeMessage(msg); err != nil && c.errorLogger != nil {
+			c.errorLogger.Printf("Aborting request %v: %v", id, err)
+		}
+	}
+}
+
+// Cancel the contexts of all in-flight ops, without replying to them.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) cancelInflight() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, o := range c.inflight {
+		o.cancel()
+	}
+}
+
+// Record why the kernel hung up, for Err.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) setHangup(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hangup == nil {
+		c.hangup = err
+	}
+}
+
+// Err returns nil until ReadOp has returned io.EOF, and then why the kernel
+// hung up: ErrConnectionAborted if it aborted the connection, or otherwise
+// ErrUnmounted.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hangup
+}
+
+// Reply to an op that won't be handed to the server with the supplied error,
+// and release its messages.
+func (c *Connection) failOp(
+	inMsg *buffer.InMessage,
+	outMsg *buffer.OutMessage,
+	op interface{},
+	errno syscall.Errno) {
+	defer buffer.PutInMessage(inMsg)
+	defer buffer.PutOutMessage(outMsg)
+	if c.cfg.PoolOps {
+		defer releaseOp(op)
+	}
+
+	if c.kernelResponse(outMsg, inMsg.Header().Unique, op, errno) {
+		return
+	}
+
+	if err := c.writeMessage(outMsg.OutHeaderBytes()); err != nil && c.errorLogger != nil {
+		c.errorLogger.Printf("Failing %s: %v", describeOp(op), err)
 	}
 }
 
@@ -332,28 +722,51 @@ func (c *Connection) handleInterrupt(fuseID uint64) {
 	//
 	// Cf. https://github.com/osxfuse/osxfuse/issues/208
 	// Cf. http://comments.gmane.org/gmane.comp.file-systems.fuse.devel/14675
-	cancel, ok := c.cancelFuncs[fuseID]
+	//
+	// Unless requests are read from several clones of the device, when the
+	// interrupt may have overtaken the original request on its way to us. In
+	// that case remember it for recordOp.
+	o, ok := c.inflight[fuseID]
 	if !ok {
+		if c.multipleReaders {
+			if len(c.earlyInterrupts) == maxEarlyInterrupts {
+				c.earlyInterrupts = c.earlyInterrupts[1:]
+			}
+
+			c.earlyInterrupts = append(c.earlyInterrupts, fuseID)
+		}
+
 		return
 	}
 
-	cancel()
+	o.cancel()
 }
 
 // Read the next message from the kernel. The message must later be destroyed
 // using destroyInMessage.
 func (c *Connection) readMessage() (*buffer.InMessage, error) {
-	// Allocate a message.
-	m := c.getInMessage()
+	mr, isMessageReader := c.transport.(messageReader)
+
+	// Allocate a message, unless the transport has its own.
+	var m *buffer.InMessage
+	if !isMessageReader {
+		m = buffer.GetInMessage()
+	}
 
 	// Loop past transient errors.
 	for {
 		// Attempt a read.
-		err := m.Init(c.dev)
+		var err error
+		if isMessageReader {
+			m, err = mr.ReadMessage()
+		} else {
+			err = m.Init(c.transport)
+		}
 
 		// Special cases:
 		//
-		//  *  ENODEV means fuse has hung up.
+		//  *  ENODEV means fuse has hung up, and ECONNABORTED that it has hung
+		//     up because the connection was aborted.
 		//
 		//  *  EINTR means we should try again. (This seems to happen often on
 		//     OS X, cf. http://golang.org/issue/11180)
@@ -363,6 +776,9 @@ func (c *Connection) readMessage() (*buffer.InMessage, error) {
 			case syscall.ENODEV:
 				err = io.EOF
 
+			case syscall.ECONNABORTED:
+				err = ErrConnectionAborted
+
 			case syscall.EINTR:
 				err = nil
 				continue
@@ -370,7 +786,10 @@ func (c *Connection) readMessage() (*buffer.InMessage, error) {
 		}
 
 		if err != nil {
-			c.putInMessage(m)
+			if m != nil {
+				buffer.PutInMessage(m)
+			}
+
 			return nil, err
 		}
 
@@ -380,28 +799,23 @@ func (c *Connection) readMessage() (*buffer.InMessage, error) {
 
 // Write the supplied message to the kernel.
 func (c *Connection) writeMessage(msg []byte) error {
-	// Avoid the retry loop in os.File.Write.
-	n, err := syscall.Write(int(c.dev.Fd()), msg)
-	if err != nil {
-		return err
-	}
-
-	if n != len(msg) {
-		return fmt.Errorf("Wrote %d bytes; expected %d", n, len(msg))
-	}
-
-	return nil
+	return c.transport.Writev([][]byte{msg})
 }
 
 // ReadOp consumes the next op from the kernel process, returning the op and a
 // context that should be used for work related to the op. It returns io.EOF if
-// the kernel has closed the connection.
+// the kernel has closed the connection; Err then says why.
+//
+// The context is derived from MountConfig.OpContext, and is cancelled if the
+// kernel interrupts the op, if the connection is closed by unmounting the
+// file system, or if MountedFileSystem.Shutdown gives up waiting for the op.
 //
 // If err != nil, the user is responsible for later calling c.Reply with the
 // returned context.
 //
 // This function delivers ops in exactly the order they are received from
-// /dev/fuse. It must not be called multiple times concurrently.
+// /dev/fuse, or with MountConfig.DeviceReaders, in the order in which the
+// readers hand them over. It must not be called multiple times concurrently.
 //
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) ReadOp() (_ context.Context, op interface{}, _ error) {
@@ -410,14 +824,28 @@ func (c *Connection) ReadOp() (_ context.Context, op interface{}, _ error) {
 		// Read the next message from the kernel.
 		inMsg, err := c.readMessage()
 		if err != nil {
+			// Once the kernel has hung up, nobody will see the replies to the ops
+			// still in flight, so let them give up. Servers are told only io.EOF;
+			// Err says why.
+			switch err {
+			case io.EOF:
+				c.setHangup(ErrUnmounted)
+				c.cancelInflight()
+
+			case ErrConnectionAborted:
+				c.setHangup(ErrConnectionAborted)
+				c.cancelInflight()
+				err = io.EOF
+			}
+
 			return nil, nil, err
 		}
 
 		// Convert the message to an op.
-		outMsg := c.getOutMessage()
-		op, err = convertInMessage(&c.cfg, inMsg, outMsg, c.protocol)
+		outMsg := buffer.GetOutMessage()
+		op, err = convertInMessage(&c.cfg, inMsg, outMsg, c.protocol, c.initResult.Flags)
 		if err != nil {
-			c.putOutMessage(outMsg)
+			buffer.PutOutMessage(outMsg)
 			return nil, nil, fmt.Errorf("convertInMessage: %v", err)
 		}
 
@@ -426,21 +854,108 @@ func (c *Connection) ReadOp() (_ context.Context, op interface{}, _ error) {
 			c.debugLog(inMsg.Header().Unique, 1, "<- %s", describeRequest(op))
 		}
 
+		c.traceRequest(inMsg, op)
+
 		// Special case: handle interrupt requests inline.
 		if interruptOp, ok := op.(*interruptOp); ok {
 			c.handleInterrupt(interruptOp.FuseID)
 			continue
 		}
 
+		// Refuse changes if the file system has been made read-only.
+		if c.readOnly.Load() && fuseops.Mutates(op) {
+			c.failOp(inMsg, outMsg, op, syscall.EROFS)
+			continue
+		}
+
 		// Set up a context that remembers information about this op.
-		ctx := c.beginOp(inMsg.Header().Opcode, inMsg.Header().Unique)
-		ctx = context.WithValue(ctx, contextKey, opState{inMsg, outMsg, op})
+		start := time.Now()
+		ctx, ok := c.beginOp(inMsg.Header(), op, start)
+
+		// Once shutting down, don't hand out anything new.
+		if !ok {
+			c.failOp(inMsg, outMsg, op, syscall.EIO)
+			continue
+		}
+
+		if c.cfg.OnOpStart != nil {
+			c.cfg.OnOpStart(op, inMsg.Header().Unique)
+		}
+
+		ctx, n, err := c.interceptOp(ctx, op)
+
+		state := opState{
+			inMsg:       inMsg,
+			outMsg:      outMsg,
+			op:          op,
+			intercepted: n,
+			start:       start,
+		}
+
+		ctx = context.WithValue(ctx, contextKey, state)
+
+		// An interceptor may have answered the op itself. Any failure to send
+		// that reply has already been logged by Reply.
+		if err != nil {
+			c.Reply(ctx, err)
+			continue
+		}
 
 		// Return the op to the user.
 		return ctx, op, nil
 	}
 }
 
+// Pass an op through the installed interceptors, returning the resulting
+// context and the number of interceptors that let it through. If that is fewer
+// than all of them, the error is the one to reply with.
+func (c *Connection) interceptOp(
+	ctx context.Context,
+	op interface{}) (context.Context, int, error) {
+	for i, ic := range c.interceptors {
+		next, err := ic.InterceptOp(ctx, op)
+		if err != nil {
+			return ctx, i, err
+		}
+
+		ctx = next
+	}
+
+	return ctx, len(c.interceptors), nil
+}
+
+// MarkOpStarted tells any installed interceptors that implement StartObserver
+// that the server has begun work on the op with the supplied context, as
+// returned by ReadOp, for which Stats counts it as started, and records the
+// calling goroutine as the one serving the op if
+// MountConfig.TrackOpGoroutines is set. Servers that queue ops before
+// handling them should call it; those created by fuseutil.NewFileSystemServer
+// do.
+func (c *Connection) MarkOpStarted(ctx context.Context) {
+	state, ok := ctx.Value(contextKey).(opState)
+	if !ok {
+		panic(fmt.Sprintf("MarkOpStarted called with invalid context: %#v", ctx))
+	}
+
+	var id uint64
+	if c.cfg.TrackOpGoroutines {
+		id = currentGoroutineID()
+	}
+
+	c.mu.Lock()
+	if o, ok := c.inflight[state.inMsg.Header().Unique]; ok {
+		o.started = true
+		o.goroutine = id
+	}
+	c.mu.Unlock()
+
+	for _, ic := range c.interceptors[:state.intercepted] {
+		if so, ok := ic.(StartObserver); ok {
+			so.OpStarted(ctx, state.op)
+		}
+	}
+}
+
 // Skip errors that happen as a matter of course, since they spook users.
 func (c *Connection) shouldLogError(
 	op interface{},
@@ -455,32 +970,93 @@ func (c *Connection) shouldLogError(
 		return false
 	}
 
+	return !c.isRoutineError(op, err)
+}
+
+// Is the supplied error one that the given op returns as a matter of course?
+func (c *Connection) isRoutineError(op interface{}, err error) bool {
+	errno := ErrnoOf(err)
 	switch op.(type) {
 	case *fuseops.LookUpInodeOp:
 		// It is totally normal for the kernel to ask to look up an inode by name
 		// and find the name doesn't exist. For example, this happens when linking
 		// a new file.
-		if err == syscall.ENOENT {
-			return false
+		if errno == syscall.ENOENT {
+			return true
 		}
 	case *fuseops.GetXattrOp, *fuseops.ListXattrOp:
-		if err == syscall.ENOSYS || err == syscall.ENODATA || err == syscall.ERANGE {
-			return false
+		if errno == syscall.ENOSYS || errno == syscall.ENODATA || errno == syscall.ERANGE {
+			return true
+		}
+	case *fuseops.OpenFileOp:
+		// With no-open support, this is how the server declines opens.
+		if errno == syscall.ENOSYS && c.initResult.NoOpen() {
+			return true
+		}
+	case *fuseops.OpenDirOp:
+		if errno == syscall.ENOSYS && c.initResult.NoOpendir() {
+			return true
 		}
 	case *unknownOp:
 		// Don't bother the user with methods we intentionally don't support.
-		if err == syscall.ENOSYS {
-			return false
+		if errno == syscall.ENOSYS {
+			return true
 		}
 	}
 
-	return true
+	return false
+}
+
+// Emit a structured record for an op that is being replied to, if configured
+// to and it isn't sampled out.
+func (c *Connection) logOp(
+	ctx context.Context,
+	state opState,
+	opErr error) {
+	logger := c.cfg.Logger
+	if logger == nil {
+		return
+	}
+
+	level := slog.LevelDebug
+	if opErr != nil && !c.isRoutineError(state.op, opErr) {
+		level = slog.LevelError
+	}
+
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+
+	if n := c.cfg.LogSampleRate; opErr == nil && n > 1 {
+		if c.logCount.Add(1)%uint64(n) != 0 {
+			return
+		}
+	}
+
+	h := state.inMsg.Header()
+	attrs := []slog.Attr{
+		slog.String("op", OpName(state.op)),
+		slog.Uint64("unique", h.Unique),
+		slog.Uint64("inode", h.Nodeid),
+		slog.Uint64("pid", uint64(h.Pid)),
+		slog.Uint64("uid", uint64(h.Uid)),
+		slog.Duration("latency", time.Since(state.start)),
+	}
+
+	if opErr != nil {
+		attrs = append(attrs,
+			slog.String("error", opErr.Error()),
+			slog.Int("errno", int(ErrnoOf(opErr))))
+	}
+
+	logger.LogAttrs(ctx, level, "fuse op", attrs...)
 }
 
 var writeLock sync.Mutex
 
 // Reply replies to an op previously read using ReadOp, with the supplied error
-// (or nil if successful). The context must be the context returned by ReadOp.
+// (or nil if successful), which reaches the kernel as the errno given by
+// ErrnoOf. The context must be the context returned by ReadOp.
 //
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) Reply(ctx context.Context, opErr error) error {
@@ -497,7 +1073,16 @@ func (c *Connection) Reply(ctx context.Context, opErr error) error {
 	outMsg := state.outMsg
 	fuseID := inMsg.Header().Unique
 
+	// Let the interceptors that saw the op have their say, innermost first.
+	for i := state.intercepted - 1; i >= 0; i-- {
+		opErr = c.interceptors[i].InterceptReply(ctx, op, opErr)
+	}
+
 	defer func() {
+		if c.cfg.OnOpEnd != nil {
+			c.cfg.OnOpEnd(op, fuseID, time.Since(state.start), opErr)
+		}
+
 		// Invoke any callbacks set by the FUSE server after the response to the kernel is
 		// complete and before the inMessage and outMessage memory buffers have been freed.
 		callback := c.callbackForOp(op)
@@ -506,12 +1091,16 @@ func (c *Connection) Reply(ctx context.Context, opErr error) error {
 		}
 
 		// Make sure we destroy the messages when we're done.
-		c.putInMessage(inMsg)
-		c.putOutMessage(outMsg)
+		buffer.PutInMessage(inMsg)
+		buffer.PutOutMessage(outMsg)
+
+		if c.cfg.PoolOps {
+			releaseOp(op)
+		}
 	}()
 
 	// Clean up state for this op.
-	c.finishOp(inMsg.Header().Opcode, inMsg.Header().Unique)
+	aborted := c.finishOp(inMsg.Header().Opcode, inMsg.Header().Unique)
 
 	// Debug logging
 	if c.debugLogger != nil {
@@ -524,21 +1113,21 @@ func (c *Connection) Reply(ctx context.Context, opErr error) error {
 
 	// Error logging
 	if c.shouldLogError(op, opErr) {
-		c.errorLogger.Printf("%T error: %v", op, opErr)
+		c.errorLogger.Printf("%s error: %v", describeOp(op), opErr)
 	}
 
-	// Send the reply to the kernel, if one is required.
-	noResponse := c.kernelResponse(outMsg, inMsg.Header().Unique, op, opErr)
+	c.logOp(ctx, state, opErr)
+
+	// Send the reply to the kernel, if one is required and hasn't already been
+	// sent on our behalf.
+	noResponse := aborted || c.kernelResponse(outMsg, inMsg.Header().Unique, op, opErr)
 
 	if !noResponse {
+		c.traceReply(outMsg, op)
+
 		var err error
-		if outMsg.Sglist != nil {
-			if fusekernel.IsPlatformFuseT {
-				// writev is not atomic on macos, restrict to fuse-t platform
-				writeLock.Lock()
-				defer writeLock.Unlock()
-			}
-			_, err = writev(int(c.dev.Fd()), outMsg.Sglist)
+		if len(outMsg.Sglist) > 0 {
+			err = c.transport.Writev(outMsg.Sglist)
 		} else {
 			err = c.writeMessage(outMsg.OutHeaderBytes())
 		}
@@ -549,7 +1138,6 @@ func (c *Connection) Reply(ctx context.Context, opErr error) error {
 			}
 			return fmt.Errorf(writeErrMsg)
 		}
-		outMsg.Sglist = nil
 	}
 
 	return nil
@@ -571,5 +1159,9 @@ func (c *Connection) close() error {
 	// Posix doesn't say that close can be called concurrently with read or
 	// write, but luckily we exclude the possibility of a race by requiring the
 	// user to respond to all ops first.
-	return c.dev.Close()
+	if c.stopWatchdog != nil {
+		close(c.stopWatchdog)
+	}
+
+	return c.transport.Close()
 }
@@ -0,0 +1,1386 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Return a pair of connected sockets that preserve message boundaries, like
+// /dev/fuse does. The first stands in for the device, the second for the
+// kernel.
+func fakeDevice(t *testing.T) (dev *os.File, kernel *os.File) {
+	t.Helper()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	dev = os.NewFile(uintptr(fds[0]), "dev")
+	kernel = os.NewFile(uintptr(fds[1]), "kernel")
+	t.Cleanup(func() {
+		dev.Close()
+		kernel.Close()
+	})
+
+	return dev, kernel
+}
+
+// Write a request with the given opcode and unique ID, whose body is the
+// concatenation of the supplied pieces, to the kernel side of a fake device.
+func sendRequest(
+	t *testing.T,
+	kernel *os.File,
+	opcode uint32,
+	unique uint64,
+	pieces ...[]byte) {
+	t.Helper()
+
+	var body bytes.Buffer
+	for _, p := range pieces {
+		body.Write(p)
+	}
+
+	hdr := fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + body.Len()),
+		Opcode: opcode,
+		Unique: unique,
+		Nodeid: fuseops.RootInodeID,
+	}
+
+	msg := append(wire(t, hdr), body.Bytes()...)
+	if _, err := kernel.Write(msg); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+// Read a reply from the kernel side of a fake device, returning its header and
+// body.
+func readReply(t *testing.T, kernel *os.File) (fusekernel.OutHeader, []byte) {
+	t.Helper()
+
+	buf := make([]byte, 4096)
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	var hdr fusekernel.OutHeader
+	r := bytes.NewReader(buf[:n])
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		t.Fatalf("binary.Read: %v", err)
+	}
+
+	const hdrSize = int(unsafe.Sizeof(fusekernel.OutHeader{}))
+	return hdr, buf[hdrSize:n]
+}
+
+// Play the kernel's side of the init exchange, returning the connection and
+// the reply.
+func initConnection(
+	t *testing.T,
+	cfg MountConfig,
+	in fusekernel.InitIn,
+	ext fusekernel.InitInExt) (*Connection, *os.File, fusekernel.InitOut) {
+	t.Helper()
+
+	dev, kernel := fakeDevice(t)
+	sendRequest(t, kernel, fusekernel.OpInit, 1, wire(t, in), wire(t, ext))
+
+	cfg.OpContext = context.Background()
+	c, err := newConnection(cfg, cfg.DebugLogger, cfg.ErrorLogger, &deviceTransport{dev})
+	if err != nil {
+		t.Fatalf("newConnection: %v", err)
+	}
+
+	_, body := readReply(t, kernel)
+
+	var out fusekernel.InitOut
+	r := bytes.NewReader(body)
+	if err := binary.Read(r, binary.LittleEndian, &out); err != nil {
+		t.Fatalf("binary.Read: %v", err)
+	}
+
+	return c, kernel, out
+}
+
+// Like initConnection, for tests that care only about the reply.
+func runInit(
+	t *testing.T,
+	cfg MountConfig,
+	in fusekernel.InitIn,
+	ext fusekernel.InitInExt) fusekernel.InitOut {
+	t.Helper()
+
+	_, _, out := initConnection(t, cfg, in, ext)
+	return out
+}
+
+func TestConnectionInit_DontMask(t *testing.T) {
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+
+	for _, enable := range []bool{false, true} {
+		cfg := MountConfig{EnableDontMask: enable}
+		out := runInit(t, cfg, in, fusekernel.InitInExt{})
+
+		got := fusekernel.InitFlags(out.Flags)&fusekernel.InitDontMask != 0
+		if got != enable {
+			t.Errorf(
+				"EnableDontMask = %v: got flags %v",
+				enable,
+				fusekernel.InitFlags(out.Flags))
+		}
+	}
+}
+
+func TestConnectionInit_InitOp(t *testing.T) {
+	in := fusekernel.InitIn{
+		Major:        7,
+		Minor:        31,
+		MaxReadahead: 128 << 10,
+		Flags:        uint32(fusekernel.InitAsyncRead | fusekernel.InitDontMask),
+	}
+
+	c, _, out := initConnection(t, MountConfig{}, in, fusekernel.InitInExt{})
+	got := c.InitOp()
+
+	want := fuseops.InitOp{
+		KernelMajor:  7,
+		KernelMinor:  31,
+		Major:        7,
+		Minor:        31,
+		KernelFlags:  fusekernel.InitAsyncRead | fusekernel.InitDontMask,
+		Flags:        fusekernel.InitFlags(out.Flags),
+		MaxWrite:     out.MaxWrite,
+		MaxReadahead: 128 << 10,
+	}
+
+	if got != want {
+		t.Errorf("InitOp() = %+v, want %+v", got, want)
+	}
+
+	if !got.ProtocolAtLeast(7, 31) || got.ProtocolAtLeast(7, 32) {
+		t.Errorf("ProtocolAtLeast disagrees with version %d.%d", got.Major, got.Minor)
+	}
+}
+
+func TestConnectionInit_SecurityContext(t *testing.T) {
+	testCases := []struct {
+		name      string
+		configure bool
+		kernel    bool
+		want      bool
+	}{
+		{"both", true, true, true},
+		{"config only", true, false, false},
+		{"kernel only", false, true, false},
+		{"neither", false, false, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			in := fusekernel.InitIn{Major: 7, Minor: 36}
+			var ext fusekernel.InitInExt
+			if tc.kernel {
+				in.Flags |= uint32(fusekernel.InitExt)
+				ext.Flags2 |= uint32(fusekernel.InitSecurityCtx)
+			}
+
+			cfg := MountConfig{EnableSecurityContext: tc.configure}
+			out := runInit(t, cfg, in, ext)
+
+			gotExt := fusekernel.InitFlags(out.Flags)&fusekernel.InitExt != 0
+			gotCtx := fusekernel.InitFlags2(out.Flags2)&fusekernel.InitSecurityCtx != 0
+			if gotExt != tc.want || gotCtx != tc.want {
+				t.Errorf(
+					"Flags: %v, Flags2: %v; want InitExt and InitSecurityCtx = %v",
+					fusekernel.InitFlags(out.Flags),
+					fusekernel.InitFlags2(out.Flags2),
+					tc.want)
+			}
+		})
+	}
+}
+
+func TestConvertInMessage_InitFlags2(t *testing.T) {
+	in := fusekernel.InitIn{
+		Major: 7,
+		Minor: 36,
+		Flags: uint32(fusekernel.InitExt),
+	}
+	ext := fusekernel.InitInExt{Flags2: uint32(fusekernel.InitSecurityCtx)}
+
+	inMsg := makeInMessage(t, fusekernel.OpInit, wire(t, in), wire(t, ext))
+	op, err := convertInMessage(&MountConfig{}, inMsg, nil, fusekernel.Protocol{}, 0)
+	if err != nil {
+		t.Fatalf("convertInMessage: %v", err)
+	}
+
+	if got := op.(*initOp).Flags2; got != fusekernel.InitSecurityCtx {
+		t.Errorf("Flags2: got %v, want %v", got, fusekernel.InitSecurityCtx)
+	}
+}
+
+// Read n ops from the connection, replying to each with the error returned by
+// the supplied function.
+func serveOps(
+	t *testing.T,
+	c *Connection,
+	n int,
+	reply func(op interface{}) error) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			t.Fatalf("ReadOp: %v", err)
+		}
+
+		if err := c.Reply(ctx, reply(op)); err != nil {
+			t.Fatalf("Reply: %v", err)
+		}
+	}
+}
+
+// Decode the JSON records written by a slog.JSONHandler.
+func decodeRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+
+	var records []map[string]interface{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var r map[string]interface{}
+		if err := dec.Decode(&r); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+
+		records = append(records, r)
+	}
+
+	return records
+}
+
+func TestConnection_Logger(t *testing.T) {
+	testCases := []struct {
+		name    string
+		level   slog.Level
+		wantOps []string
+	}{
+		{"debug", slog.LevelDebug, []string{"init", "LookUpInode", "GetInodeAttributes"}},
+		{"error", slog.LevelError, []string{"GetInodeAttributes"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			opts := &slog.HandlerOptions{Level: tc.level}
+			cfg := MountConfig{Logger: slog.New(slog.NewJSONHandler(&buf, opts))}
+
+			in := fusekernel.InitIn{Major: 7, Minor: 36}
+			c, kernel, _ := initConnection(t, cfg, in, fusekernel.InitInExt{})
+
+			sendRequest(t, kernel, fusekernel.OpLookup, 2, []byte("foo\x00"))
+			sendRequest(t, kernel, fusekernel.OpGetattr, 3, wire(t, fusekernel.GetattrIn{}))
+
+			// Lookups failing with ENOENT are routine; I/O errors are not.
+			serveOps(t, c, 2, func(op interface{}) error {
+				if _, ok := op.(*fuseops.LookUpInodeOp); ok {
+					return syscall.ENOENT
+				}
+
+				return syscall.EIO
+			})
+
+			var gotOps []string
+			for _, r := range decodeRecords(t, &buf) {
+				gotOps = append(gotOps, r["op"].(string))
+
+				if r["uid"] == nil || r["pid"] == nil || r["latency"] == nil {
+					t.Errorf("record missing fields: %v", r)
+				}
+
+				if r["inode"] != float64(fuseops.RootInodeID) {
+					t.Errorf("inode: got %v", r["inode"])
+				}
+			}
+
+			if !reflect.DeepEqual(gotOps, tc.wantOps) {
+				t.Errorf("ops logged: got %q, want %q", gotOps, tc.wantOps)
+			}
+		})
+	}
+}
+
+func TestConnection_LoggerSampling(t *testing.T) {
+	var buf bytes.Buffer
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	cfg := MountConfig{
+		Logger:        slog.New(slog.NewJSONHandler(&buf, opts)),
+		LogSampleRate: 3,
+	}
+
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	c, kernel, _ := initConnection(t, cfg, in, fusekernel.InitInExt{})
+
+	// Five successes and one failure, following the successful init.
+	const total = 6
+	for i := 0; i < total; i++ {
+		sendRequest(t, kernel, fusekernel.OpGetattr, uint64(2+i), wire(t, fusekernel.GetattrIn{}))
+	}
+
+	n := 0
+	serveOps(t, c, total, func(op interface{}) error {
+		n++
+		if n == total {
+			return syscall.EIO
+		}
+
+		return nil
+	})
+
+	// Successes 3 and 6 (counting init) should have been kept.
+
+	records := decodeRecords(t, &buf)
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want 3: %v", len(records), records)
+	}
+
+	if got := records[2]["errno"]; got != float64(syscall.EIO) {
+		t.Errorf("errno: got %v, want %d", got, syscall.EIO)
+	}
+}
+
+func TestConnection_DebugProtocol(t *testing.T) {
+	var buf bytes.Buffer
+	cfg := MountConfig{
+		DebugLogger:   log.New(&buf, "", 0),
+		DebugProtocol: true,
+		DebugHexdump:  true,
+	}
+
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	c, kernel, _ := initConnection(t, cfg, in, fusekernel.InitInExt{})
+	buf.Reset()
+
+	sendRequest(t, kernel, fusekernel.OpLookup, 2, []byte("foo\x00"))
+	sendRequest(t, kernel, fusekernel.OpGetattr, 3, wire(t, fusekernel.GetattrIn{}))
+
+	serveOps(t, c, 2, func(op interface{}) error {
+		if _, ok := op.(*fuseops.LookUpInodeOp); ok {
+			return syscall.ENOENT
+		}
+
+		return nil
+	})
+
+	want := []string{
+		"unique: 2, opcode: LOOKUP (1), nodeid: 1, insize: 44",
+		`LookUpInode (parent 1, name "foo"`,
+		"66 6f 6f 00",
+		"unique: 2, error: -2 (no such file or directory), outsize: 16",
+		"unique: 3, opcode: GETATTR (3)",
+		"unique: 3, success, outsize: 120",
+	}
+
+	out := buf.String()
+	for _, w := range want {
+		if !strings.Contains(out, w) {
+			t.Errorf("output is missing %q:\n%s", w, out)
+		}
+	}
+}
+
+func TestConnection_ErrorErrno(t *testing.T) {
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	c, kernel, _ := initConnection(t, MountConfig{}, in, fusekernel.InitInExt{})
+
+	errs := []error{
+		NewError(syscall.ENOENT, errors.New("taco")),
+		fmt.Errorf("opening: %w", syscall.EACCES),
+		errors.New("burrito"),
+	}
+
+	for i := range errs {
+		sendRequest(t, kernel, fusekernel.OpLookup, uint64(2+i), []byte("foo\x00"))
+	}
+
+	i := 0
+	serveOps(t, c, len(errs), func(op interface{}) error {
+		i++
+		return errs[i-1]
+	})
+
+	want := []syscall.Errno{syscall.ENOENT, syscall.EACCES, syscall.EIO}
+	for i, errno := range want {
+		if hdr, _ := readReply(t, kernel); hdr.Error != -int32(errno) {
+			t.Errorf("reply %d: got error %d, want %d", i, -hdr.Error, errno)
+		}
+	}
+}
+
+func TestConnection_OpHooks(t *testing.T) {
+	type event struct {
+		kind   string
+		op     string
+		unique uint64
+		err    error
+	}
+
+	var events []event
+	cfg := MountConfig{
+		OnOpStart: func(op interface{}, unique uint64) {
+			events = append(events, event{"start", OpName(op), unique, nil})
+		},
+		OnOpEnd: func(op interface{}, unique uint64, d time.Duration, err error) {
+			if d <= 0 {
+				t.Errorf("non-positive duration %v for %s", d, OpName(op))
+			}
+			events = append(events, event{"end", OpName(op), unique, err})
+		},
+	}
+
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	c, kernel, _ := initConnection(t, cfg, in, fusekernel.InitInExt{})
+
+	sendRequest(t, kernel, fusekernel.OpLookup, 2, []byte("foo\x00"))
+	serveOps(t, c, 1, func(op interface{}) error {
+		return syscall.ENOENT
+	})
+
+	want := []event{
+		{"start", "init", 1, nil},
+		{"end", "init", 1, nil},
+		{"start", "LookUpInode", 2, nil},
+		{"end", "LookUpInode", 2, syscall.ENOENT},
+	}
+
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events:\ngot  %v\nwant %v", events, want)
+	}
+}
+
+func TestConnection_Drain(t *testing.T) {
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	c, kernel, _ := initConnection(t, MountConfig{}, in, fusekernel.InitInExt{})
+
+	sendRequest(t, kernel, fusekernel.OpLookup, 2, []byte("foo\x00"))
+	ctx, _, err := c.ReadOp()
+	if err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	drained := c.beginDrain()
+	select {
+	case <-drained:
+		t.Fatal("drained with an op in flight")
+	default:
+	}
+
+	// Once the op is replied to, the connection is drained.
+	if err := c.Reply(ctx, syscall.ENOENT); err != nil {
+		t.Fatalf("Reply: %v", err)
+	}
+
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not drained after reply")
+	}
+
+	if hdr, _ := readReply(t, kernel); hdr.Unique != 2 || hdr.Error != -int32(syscall.ENOENT) {
+		t.Errorf("reply: got %+v", hdr)
+	}
+}
+
+func TestConnection_AbortInflight(t *testing.T) {
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	c, kernel, _ := initConnection(t, MountConfig{}, in, fusekernel.InitInExt{})
+
+	sendRequest(t, kernel, fusekernel.OpLookup, 2, []byte("foo\x00"))
+	ctx, _, err := c.ReadOp()
+	if err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	drained := c.beginDrain()
+
+	// Keep reading in the background, as a server would. Anything that arrives
+	// now should be failed without being returned. The read fails once the
+	// test closes the device.
+	go func() {
+		if _, op, err := c.ReadOp(); err == nil {
+			t.Errorf("ReadOp returned %s while draining", OpName(op))
+		}
+	}()
+
+	sendRequest(t, kernel, fusekernel.OpGetattr, 3, wire(t, fusekernel.GetattrIn{}))
+	if hdr, _ := readReply(t, kernel); hdr.Unique != 3 || hdr.Error != -int32(syscall.EIO) {
+		t.Errorf("reply to new op: got %+v", hdr)
+	}
+
+	// Give up on the lookup.
+	c.abortInflight(syscall.EINTR)
+	if hdr, _ := readReply(t, kernel); hdr.Unique != 2 || hdr.Error != -int32(syscall.EINTR) {
+		t.Errorf("reply to aborted op: got %+v", hdr)
+	}
+
+	select {
+	case <-drained:
+	default:
+		t.Error("not drained after abort")
+	}
+
+	if ctx.Err() == nil {
+		t.Error("aborted op's context not cancelled")
+	}
+
+	// The server's late reply must not reach the kernel. If it did, it would
+	// arrive before the reply to this next request.
+	if err := c.Reply(ctx, nil); err != nil {
+		t.Fatalf("Reply: %v", err)
+	}
+
+	sendRequest(t, kernel, fusekernel.OpGetattr, 4, wire(t, fusekernel.GetattrIn{}))
+	if hdr, _ := readReply(t, kernel); hdr.Unique != 4 {
+		t.Errorf("got reply for request %d, want 4", hdr.Unique)
+	}
+}
+
+func TestConnection_AbortInflightSkipsForgets(t *testing.T) {
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	c, kernel, _ := initConnection(t, MountConfig{}, in, fusekernel.InitInExt{})
+
+	batch := append(
+		wire(t, fusekernel.BatchForgetCountIn{Count: 1}),
+		wire(t, fusekernel.BatchForgetEntryIn{Inode: 2, Nlookup: 1})...)
+	sendRequest(t, kernel, fusekernel.OpBatchForget, 2, batch)
+	sendRequest(t, kernel, fusekernel.OpForget, 3, wire(t, fusekernel.ForgetIn{Nlookup: 1}))
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.ReadOp(); err != nil {
+			t.Fatalf("ReadOp: %v", err)
+		}
+	}
+
+	// The kernel expects no reply to either, so none may be sent. If one were,
+	// it would arrive before the reply to this next request.
+	c.abortInflight(syscall.EINTR)
+
+	sendRequest(t, kernel, fusekernel.OpGetattr, 4, wire(t, fusekernel.GetattrIn{}))
+	ctx, _, err := c.ReadOp()
+	if err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	c.Reply(ctx, syscall.ENOENT)
+	if hdr, _ := readReply(t, kernel); hdr.Unique != 4 {
+		t.Errorf("got reply for request %d, want 4", hdr.Unique)
+	}
+}
+
+func TestMountedFileSystem_ShutdownOnSignal(t *testing.T) {
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	c, kernel, _ := initConnection(t, MountConfig{}, in, fusekernel.InitInExt{})
+	mfs := &MountedFileSystem{dir: "/mnt", conn: c}
+
+	sendRequest(t, kernel, fusekernel.OpLookup, 2, []byte("foo\x00"))
+	if _, _, err := c.ReadOp(); err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	// The lookup is never replied to and the file system stays busy, so the
+	// grace period runs out and the mount is detached lazily.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	f := &fakeUnmount{busy: math.MaxInt}
+	err := mfs.shutdownOnSignal(ctx, f.unmount, f.unmountLazy)
+	if err != context.DeadlineExceeded {
+		t.Errorf("shutdownOnSignal: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if f.calls != 1 || f.lazy != 1 {
+		t.Errorf("got %d unmounts and %d lazy unmounts, want 1 and 1", f.calls, f.lazy)
+	}
+
+	if hdr, _ := readReply(t, kernel); hdr.Unique != 2 || hdr.Error != -int32(syscall.EINTR) {
+		t.Errorf("reply to aborted op: got %+v", hdr)
+	}
+}
+
+func TestConnection_ReadOnlyGuard(t *testing.T) {
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	c, kernel, _ := initConnection(t, MountConfig{}, in, fusekernel.InitInExt{})
+	c.readOnly.Store(true)
+
+	// A mkdir should be refused without reaching the server...
+	sendRequest(
+		t,
+		kernel,
+		fusekernel.OpMkdir,
+		2,
+		wire(t, fusekernel.MkdirIn{Mode: 0755}),
+		[]byte("dir\x00"))
+
+	// ...but a lookup should still get through.
+	sendRequest(t, kernel, fusekernel.OpLookup, 3, []byte("foo\x00"))
+
+	serveOps(t, c, 1, func(op interface{}) error {
+		if _, ok := op.(*fuseops.LookUpInodeOp); !ok {
+			t.Errorf("server got %s", OpName(op))
+		}
+
+		return syscall.ENOENT
+	})
+
+	wantReplies := []struct {
+		unique uint64
+		errno  syscall.Errno
+	}{
+		{2, syscall.EROFS},
+		{3, syscall.ENOENT},
+	}
+
+	for _, w := range wantReplies {
+		hdr, _ := readReply(t, kernel)
+		if hdr.Unique != w.unique || hdr.Error != -int32(w.errno) {
+			t.Errorf("reply: got %+v, want unique %d, errno %v", hdr, w.unique, w.errno)
+		}
+	}
+}
+
+func TestConnection_ReadOnlyConfig(t *testing.T) {
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	cfg := MountConfig{ReadOnly: true}
+	c, kernel, _ := initConnection(t, cfg, in, fusekernel.InitInExt{})
+
+	// Opening for writing should be refused without reaching the server...
+	sendRequest(
+		t,
+		kernel,
+		fusekernel.OpOpen,
+		2,
+		wire(t, fusekernel.OpenIn{Flags: uint32(syscall.O_WRONLY)}))
+
+	// ...but opening for reading should still get through.
+	sendRequest(
+		t,
+		kernel,
+		fusekernel.OpOpen,
+		3,
+		wire(t, fusekernel.OpenIn{Flags: uint32(syscall.O_RDONLY)}))
+
+	serveOps(t, c, 1, func(op interface{}) error {
+		if _, ok := op.(*fuseops.OpenFileOp); !ok {
+			t.Errorf("server got %s", OpName(op))
+		}
+
+		return syscall.ENOENT
+	})
+
+	wantReplies := []struct {
+		unique uint64
+		errno  syscall.Errno
+	}{
+		{2, syscall.EROFS},
+		{3, syscall.ENOENT},
+	}
+
+	for _, w := range wantReplies {
+		hdr, _ := readReply(t, kernel)
+		if hdr.Unique != w.unique || hdr.Error != -int32(w.errno) {
+			t.Errorf("reply: got %+v, want unique %d, errno %v", hdr, w.unique, w.errno)
+		}
+	}
+}
+
+// Block until the channel is closed. Named so that it can be found in a stack
+// dump.
+func blockServingOp(release chan struct{}) {
+	<-release
+}
+
+func TestConnection_DumpInflight(t *testing.T) {
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	cfg := MountConfig{TrackOpGoroutines: true}
+	c, kernel, _ := initConnection(t, cfg, in, fusekernel.InitInExt{})
+
+	sendRequest(t, kernel, fusekernel.OpLookup, 2, []byte("foo\x00"))
+	lookupCtx, _, err := c.ReadOp()
+	if err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	sendRequest(t, kernel, fusekernel.OpGetattr, 3, wire(t, fusekernel.GetattrIn{}))
+	getattrCtx, _, err := c.ReadOp()
+	if err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	// Start work on the lookup only.
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		c.MarkOpStarted(lookupCtx)
+		close(started)
+		blockServingOp(release)
+		c.Reply(lookupCtx, syscall.ENOENT)
+	}()
+
+	<-started
+
+	var buf bytes.Buffer
+	if err := c.dumpInflight(&buf, time.Now()); err != nil {
+		t.Fatalf("dumpInflight: %v", err)
+	}
+
+	dump := buf.String()
+	wants := []string{
+		"2 ops in flight\n",
+		"unique 2: LookUpInode, inode 1, age ",
+		"unique 3: GetInodeAttributes, inode 1, age ",
+		"blockServingOp",
+	}
+
+	for _, want := range wants {
+		if !strings.Contains(dump, want) {
+			t.Errorf("dump is missing %q:\n%s", want, dump)
+		}
+	}
+
+	// The lookup was read first, so is listed first.
+	if strings.Index(dump, "unique 2") > strings.Index(dump, "unique 3") {
+		t.Errorf("ops out of order:\n%s", dump)
+	}
+
+	close(release)
+	c.Reply(getattrCtx, syscall.ENOSYS)
+	readReply(t, kernel)
+	readReply(t, kernel)
+
+	buf.Reset()
+	if err := c.dumpInflight(&buf, time.Now()); err != nil {
+		t.Fatalf("dumpInflight: %v", err)
+	}
+
+	if got, want := buf.String(), "0 ops in flight\n"; got != want {
+		t.Errorf("dump after replies: got %q, want %q", got, want)
+	}
+}
+
+func TestConnection_StallWatchdog(t *testing.T) {
+	stalls := make(chan OpStall, 10)
+	cfg := MountConfig{
+		TrackOpGoroutines: true,
+		StallThreshold:    10 * time.Millisecond,
+		OnOpStall:         func(s OpStall) { stalls <- s },
+	}
+
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	c, kernel, _ := initConnection(t, cfg, in, fusekernel.InitInExt{})
+	defer close(c.stopWatchdog)
+
+	sendRequest(t, kernel, fusekernel.OpLookup, 2, []byte("foo\x00"))
+	ctx, _, err := c.ReadOp()
+	if err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	release := make(chan struct{})
+	go func() {
+		c.MarkOpStarted(ctx)
+		blockServingOp(release)
+		c.Reply(ctx, syscall.ENOENT)
+	}()
+
+	var s OpStall
+	select {
+	case s = <-stalls:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stall reported")
+	}
+
+	if _, ok := s.Op.(*fuseops.LookUpInodeOp); !ok || s.Unique != 2 || s.Inode != 1 {
+		t.Errorf("stall: got %+v", s)
+	}
+
+	if s.Age < cfg.StallThreshold {
+		t.Errorf("age: got %v, want at least %v", s.Age, cfg.StallThreshold)
+	}
+
+	if !strings.Contains(s.Stack, "blockServingOp") {
+		t.Errorf("stack doesn't show the serving goroutine:\n%s", s.Stack)
+	}
+
+	// Each op is reported only once.
+	select {
+	case s := <-stalls:
+		t.Errorf("second report: %+v", s)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	readReply(t, kernel)
+}
+
+func TestConnection_CancelOnHangUp(t *testing.T) {
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	c, kernel, _ := initConnection(t, MountConfig{}, in, fusekernel.InitInExt{})
+
+	sendRequest(t, kernel, fusekernel.OpLookup, 2, []byte("foo\x00"))
+	ctx, _, err := c.ReadOp()
+	if err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	// The kernel hangs up, as it does when the file system is unmounted.
+	kernel.Close()
+	if _, _, err := c.ReadOp(); err != io.EOF {
+		t.Fatalf("ReadOp: got %v, want EOF", err)
+	}
+
+	select {
+	case <-ctx.Done():
+	default:
+		t.Error("in-flight op's context not cancelled")
+	}
+
+	c.Reply(ctx, syscall.ENOENT)
+}
+
+func TestConnection_PoolOps(t *testing.T) {
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	cfg := MountConfig{PoolOps: true}
+	c, kernel, _ := initConnection(t, cfg, in, fusekernel.InitInExt{})
+
+	// Whether or not the second lookup reuses the first's struct, it must not
+	// see anything the server set on the first.
+	for i := 0; i < 2; i++ {
+		unique := uint64(2 + i)
+		sendRequest(t, kernel, fusekernel.OpLookup, unique, []byte("foo\x00"))
+
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			t.Fatalf("ReadOp: %v", err)
+		}
+
+		o := op.(*fuseops.LookUpInodeOp)
+		if o.Name != "foo" || o.Entry.Child != 0 || o.OpContext.FuseID != unique {
+			t.Errorf("lookup %d: got %+v", i, o)
+		}
+
+		o.Entry.Child = 17
+		c.Reply(ctx, nil)
+
+		if hdr, _ := readReply(t, kernel); hdr.Unique != unique || hdr.Error != 0 {
+			t.Errorf("reply: got %+v", hdr)
+		}
+	}
+}
+
+func TestConnection_NoOpenIsRoutine(t *testing.T) {
+	in := fusekernel.InitIn{
+		Major: 7,
+		Minor: 36,
+		Flags: uint32(fusekernel.InitNoOpenSupport | fusekernel.InitNoOpendirSupport),
+	}
+
+	// Without the support negotiated, declining an open is an error...
+	c, _, _ := initConnection(t, MountConfig{}, in, fusekernel.InitInExt{})
+	if c.isRoutineError(&fuseops.OpenFileOp{}, syscall.ENOSYS) {
+		t.Errorf("ENOSYS from OpenFileOp routine without no-open support")
+	}
+
+	// ...but with it, that's how the server asks not to see them.
+	cfg := MountConfig{
+		EnableNoOpenSupport:    true,
+		EnableNoOpendirSupport: true,
+	}
+
+	c, _, _ = initConnection(t, cfg, in, fusekernel.InitInExt{})
+	init := c.InitOp()
+	if !init.NoOpen() || !init.NoOpendir() {
+		t.Fatalf("no-open support not negotiated: %+v", init)
+	}
+
+	if !c.isRoutineError(&fuseops.OpenFileOp{}, syscall.ENOSYS) {
+		t.Errorf("ENOSYS from OpenFileOp not routine")
+	}
+
+	if !c.isRoutineError(&fuseops.OpenDirOp{}, syscall.ENOSYS) {
+		t.Errorf("ENOSYS from OpenDirOp not routine")
+	}
+
+	if c.isRoutineError(&fuseops.OpenFileOp{}, syscall.EIO) {
+		t.Errorf("EIO from OpenFileOp routine")
+	}
+}
+
+func TestConnectionInit_SymlinkCaching(t *testing.T) {
+	offered := fusekernel.InitIn{
+		Major: 7,
+		Minor: 36,
+		Flags: uint32(fusekernel.InitCacheSymlinks),
+	}
+
+	cfg := MountConfig{EnableSymlinkCaching: true}
+
+	testCases := []struct {
+		name string
+		cfg  MountConfig
+		in   fusekernel.InitIn
+		want bool
+	}{
+		{"not enabled", MountConfig{}, offered, false},
+		{"not offered", cfg, fusekernel.InitIn{Major: 7, Minor: 36}, false},
+		{"enabled and offered", cfg, offered, true},
+	}
+
+	for _, tc := range testCases {
+		c, _, _ := initConnection(t, tc.cfg, tc.in, fusekernel.InitInExt{})
+		init := c.InitOp()
+		if got := init.CacheSymlinks(); got != tc.want {
+			t.Errorf("%s: CacheSymlinks() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestConnectionInit_TimeGran(t *testing.T) {
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+
+	testCases := []struct {
+		gran time.Duration
+		want uint32
+	}{
+		{0, 1},
+		{time.Microsecond, 1000},
+		{time.Second, 1e9},
+		{time.Minute, 1e9},
+	}
+
+	for _, tc := range testCases {
+		cfg := MountConfig{TimestampGranularity: tc.gran}
+		out := runInit(t, cfg, in, fusekernel.InitInExt{})
+		if out.TimeGran != tc.want {
+			t.Errorf("%v: got TimeGran %d, want %d", tc.gran, out.TimeGran, tc.want)
+		}
+	}
+}
+
+func TestConnectionInit_ParallelDirOps(t *testing.T) {
+	offered := fusekernel.InitIn{
+		Major: 7,
+		Minor: 36,
+		Flags: uint32(fusekernel.InitParallelDirOps),
+	}
+
+	cfg := MountConfig{EnableParallelDirOps: true}
+
+	testCases := []struct {
+		name string
+		cfg  MountConfig
+		in   fusekernel.InitIn
+		want bool
+	}{
+		{"not enabled", MountConfig{}, offered, false},
+		{"not offered", cfg, fusekernel.InitIn{Major: 7, Minor: 36}, false},
+		{"enabled and offered", cfg, offered, true},
+	}
+
+	for _, tc := range testCases {
+		c, _, out := initConnection(t, tc.cfg, tc.in, fusekernel.InitInExt{})
+		init := c.InitOp()
+		if got := init.ParallelDirOps(); got != tc.want {
+			t.Errorf("%s: ParallelDirOps() = %v, want %v", tc.name, got, tc.want)
+		}
+
+		if got := out.Flags&uint32(fusekernel.InitParallelDirOps) != 0; got != tc.want {
+			t.Errorf("%s: flag in reply = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestConnectionInit_ExplicitInvalData(t *testing.T) {
+	offered := fusekernel.InitIn{
+		Major: 7,
+		Minor: 36,
+		Flags: uint32(fusekernel.InitExplicitInvalData),
+	}
+
+	cfg := MountConfig{EnableExplicitInvalData: true}
+
+	testCases := []struct {
+		name string
+		cfg  MountConfig
+		in   fusekernel.InitIn
+		want bool
+	}{
+		{"not enabled", MountConfig{}, offered, false},
+		{"not offered", cfg, fusekernel.InitIn{Major: 7, Minor: 36}, false},
+		{"enabled and offered", cfg, offered, true},
+	}
+
+	for _, tc := range testCases {
+		c, _, out := initConnection(t, tc.cfg, tc.in, fusekernel.InitInExt{})
+		init := c.InitOp()
+		if got := init.ExplicitInvalData(); got != tc.want {
+			t.Errorf("%s: ExplicitInvalData() = %v, want %v", tc.name, got, tc.want)
+		}
+
+		if got := out.Flags&uint32(fusekernel.InitExplicitInvalData) != 0; got != tc.want {
+			t.Errorf("%s: flag in reply = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestConnectionInit_HandleKillPrivV2(t *testing.T) {
+	offered := fusekernel.InitIn{
+		Major: 7,
+		Minor: 36,
+		Flags: uint32(fusekernel.InitHandleKillprivV2),
+	}
+
+	cfg := MountConfig{EnableHandleKillPrivV2: true}
+
+	testCases := []struct {
+		name string
+		cfg  MountConfig
+		in   fusekernel.InitIn
+		want bool
+	}{
+		{"not enabled", MountConfig{}, offered, false},
+		{"not offered", cfg, fusekernel.InitIn{Major: 7, Minor: 36}, false},
+		{"enabled and offered", cfg, offered, true},
+	}
+
+	for _, tc := range testCases {
+		c, _, out := initConnection(t, tc.cfg, tc.in, fusekernel.InitInExt{})
+		init := c.InitOp()
+		if got := init.HandleKillPrivV2(); got != tc.want {
+			t.Errorf("%s: HandleKillPrivV2() = %v, want %v", tc.name, got, tc.want)
+		}
+
+		if got := out.Flags&uint32(fusekernel.InitHandleKillprivV2) != 0; got != tc.want {
+			t.Errorf("%s: flag in reply = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestConnectionInit_Passthrough(t *testing.T) {
+	offered := fusekernel.InitIn{
+		Major: 7,
+		Minor: 36,
+		Flags: uint32(fusekernel.InitExt),
+	}
+	ext := fusekernel.InitInExt{Flags2: uint32(fusekernel.InitPassthrough)}
+
+	cfg := MountConfig{EnablePassthrough: true, DisableWritebackCaching: true}
+
+	testCases := []struct {
+		name string
+		cfg  MountConfig
+		in   fusekernel.InitIn
+		ext  fusekernel.InitInExt
+		want bool
+	}{
+		{"not enabled", MountConfig{DisableWritebackCaching: true}, offered, ext, false},
+		{"writeback caching", MountConfig{EnablePassthrough: true}, offered, ext, false},
+		{"not offered", cfg, offered, fusekernel.InitInExt{}, false},
+		{"no InitExt", cfg, fusekernel.InitIn{Major: 7, Minor: 36}, ext, false},
+		{"enabled and offered", cfg, offered, ext, true},
+	}
+
+	for _, tc := range testCases {
+		c, _, out := initConnection(t, tc.cfg, tc.in, tc.ext)
+		init := c.InitOp()
+		if got := init.Passthrough(); got != tc.want {
+			t.Errorf("%s: Passthrough() = %v, want %v", tc.name, got, tc.want)
+		}
+
+		if got := out.Flags2&uint32(fusekernel.InitPassthrough) != 0; got != tc.want {
+			t.Errorf("%s: flag in reply = %v, want %v", tc.name, got, tc.want)
+		}
+
+		if got := out.MaxStackDepth != 0; got != tc.want {
+			t.Errorf("%s: MaxStackDepth = %d", tc.name, out.MaxStackDepth)
+		}
+	}
+}
+
+func TestConnectionInit_IoUring(t *testing.T) {
+	offered := fusekernel.InitIn{
+		Major: 7,
+		Minor: 36,
+		Flags: uint32(fusekernel.InitExt),
+	}
+	ext := fusekernel.InitInExt{Flags2: uint32(fusekernel.InitOverIoUring)}
+
+	cfg := MountConfig{EnableIoUring: true, IoUringQueueDepth: 1}
+
+	testCases := []struct {
+		name string
+		cfg  MountConfig
+		in   fusekernel.InitIn
+		ext  fusekernel.InitInExt
+		want bool
+	}{
+		{"not enabled", MountConfig{}, offered, ext, false},
+		{"not offered", cfg, offered, fusekernel.InitInExt{}, false},
+		{"no InitExt", cfg, fusekernel.InitIn{Major: 7, Minor: 36}, ext, false},
+		{"enabled and offered", cfg, offered, ext, true},
+	}
+
+	for _, tc := range testCases {
+		c, kernel, out := initConnection(t, tc.cfg, tc.in, tc.ext)
+		init := c.InitOp()
+		if got := init.IoUring(); got != tc.want {
+			t.Errorf("%s: IoUring() = %v, want %v", tc.name, got, tc.want)
+		}
+
+		if got := out.Flags2&uint32(fusekernel.InitOverIoUring) != 0; got != tc.want {
+			t.Errorf("%s: flag in reply = %v, want %v", tc.name, got, tc.want)
+		}
+
+		// Whether or not the queues could be set up (they can't be registered
+		// on a fake device), requests still arrive on the device.
+		sendRequest(t, kernel, fusekernel.OpStatfs, 2)
+		_, op, err := c.ReadOp()
+		if err != nil {
+			t.Fatalf("%s: ReadOp: %v", tc.name, err)
+		}
+
+		if _, ok := op.(*fuseops.StatFSOp); !ok {
+			t.Errorf("%s: got op %T", tc.name, op)
+		}
+
+		c.close()
+	}
+}
+
+func TestConnection_PassthroughOverIoUring(t *testing.T) {
+	in := fusekernel.InitIn{
+		Major: 7,
+		Minor: 36,
+		Flags: uint32(fusekernel.InitExt),
+	}
+	ext := fusekernel.InitInExt{
+		Flags2: uint32(fusekernel.InitPassthrough | fusekernel.InitOverIoUring),
+	}
+	cfg := MountConfig{
+		EnablePassthrough:       true,
+		DisableWritebackCaching: true,
+		EnableIoUring:           true,
+		IoUringQueueDepth:       1,
+	}
+
+	c, _, _ := initConnection(t, cfg, in, ext)
+	defer c.close()
+
+	init := c.InitOp()
+	if !init.Passthrough() || !init.IoUring() {
+		t.Fatalf("Passthrough() = %v, IoUring() = %v", init.Passthrough(), init.IoUring())
+	}
+
+	// Whether the queues can be set up on a fake device depends on the kernel.
+	// If they couldn't, stand in for a successful start: the connection still
+	// sits on the same device.
+	if dev, ok := c.transport.(*deviceTransport); ok {
+		c.transport = &uringTransport{dev: dev}
+		defer func() { c.transport = dev }()
+	}
+
+	// The fake device is a socket, which rejects the ioctls themselves. What
+	// matters is that they are attempted rather than refused with ENOTSUP.
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := c.OpenBackingFile(f); err == syscall.ENOTSUP {
+		t.Errorf("OpenBackingFile: %v", err)
+	}
+
+	if err := c.CloseBackingFile(1); err == syscall.ENOTSUP {
+		t.Errorf("CloseBackingFile: %v", err)
+	}
+}
+
+func TestConnectionInit_AbortError(t *testing.T) {
+	for _, offered := range []bool{false, true} {
+		in := fusekernel.InitIn{Major: 7, Minor: 36}
+		if offered {
+			in.Flags = uint32(fusekernel.InitAbortError)
+		}
+
+		c, _, out := initConnection(t, MountConfig{}, in, fusekernel.InitInExt{})
+		if got := out.Flags&uint32(fusekernel.InitAbortError) != 0; got != offered {
+			t.Errorf("offered %v: flag in reply = %v", offered, got)
+		}
+
+		c.close()
+	}
+}
+
+// A transport that fails every read with the supplied error.
+type hungUpTransport struct {
+	Transport
+	err error
+}
+
+func (t *hungUpTransport) Read(p []byte) (int, error) {
+	return 0, t.err
+}
+
+func TestConnection_Err(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"EOF", io.EOF, ErrUnmounted},
+		{"ENODEV", &os.PathError{Op: "read", Path: "/dev/fuse", Err: syscall.ENODEV}, ErrUnmounted},
+		{"ECONNABORTED", &os.PathError{Op: "read", Path: "/dev/fuse", Err: syscall.ECONNABORTED}, ErrConnectionAborted},
+	}
+
+	for _, tc := range testCases {
+		in := fusekernel.InitIn{Major: 7, Minor: 36}
+		c, _, _ := initConnection(t, MountConfig{}, in, fusekernel.InitInExt{})
+		c.transport = &hungUpTransport{Transport: c.transport, err: tc.err}
+
+		if err := c.Err(); err != nil {
+			t.Errorf("%s: Err before hanging up: %v", tc.name, err)
+		}
+
+		// Servers see io.EOF whatever the reason.
+		if _, _, err := c.ReadOp(); err != io.EOF {
+			t.Errorf("%s: ReadOp: got %v, want io.EOF", tc.name, err)
+		}
+
+		if err := c.Err(); err != tc.want {
+			t.Errorf("%s: Err: got %v, want %v", tc.name, err, tc.want)
+		}
+
+		c.close()
+	}
+}
+
+func TestMountedFileSystem_OnDisconnect(t *testing.T) {
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	c, _, _ := initConnection(t, MountConfig{}, in, fusekernel.InitInExt{})
+	c.transport = &hungUpTransport{
+		Transport: c.transport,
+		err:       &os.PathError{Op: "read", Path: "/dev/fuse", Err: syscall.ECONNABORTED},
+	}
+
+	mfs := &MountedFileSystem{
+		dir:                 "/mnt",
+		conn:                c,
+		joinStatusAvailable: make(chan struct{}),
+	}
+
+	var calls []string
+	mfs.OnDisconnect(func(reason error) {
+		calls = append(calls, fmt.Sprintf("first: %v", reason))
+	})
+
+	mfs.OnDisconnect(func(reason error) {
+		calls = append(calls, fmt.Sprintf("second: %v", reason))
+	})
+
+	// Play the part of Mount's goroutine.
+	if _, _, err := c.ReadOp(); err != io.EOF {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	mfs.disconnect(c.close())
+
+	if err := mfs.Join(context.Background()); !errors.Is(err, ErrConnectionAborted) {
+		t.Errorf("Join: got %v, want ErrConnectionAborted", err)
+	}
+
+	// Hooks registered late are called at once.
+	mfs.OnDisconnect(func(reason error) {
+		calls = append(calls, fmt.Sprintf("late: %v", reason))
+	})
+
+	want := []string{
+		"first: " + ErrConnectionAborted.Error(),
+		"second: " + ErrConnectionAborted.Error(),
+		"late: " + ErrConnectionAborted.Error(),
+	}
+
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("hooks called as %q, want %q", calls, want)
+	}
+}
+
+func TestConnection_Stats(t *testing.T) {
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	c, kernel, _ := initConnection(t, MountConfig{}, in, fusekernel.InitInExt{})
+	defer c.close()
+
+	sendRequest(t, kernel, fusekernel.OpLookup, 2, []byte("foo\x00"))
+	lookUpCtx, _, err := c.ReadOp()
+	if err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	sendRequest(t, kernel, fusekernel.OpWrite, 3, wire(t, fusekernel.WriteIn{Size: 4}), []byte("taco"))
+	writeCtx, _, err := c.ReadOp()
+	if err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	if got, want := c.Stats(), (Stats{Queued: 2, WriteBytes: 4}); got != want {
+		t.Errorf("before starting: got %+v, want %+v", got, want)
+	}
+
+	c.MarkOpStarted(lookUpCtx)
+	if got, want := c.Stats(), (Stats{Queued: 1, Started: 1, WriteBytes: 4}); got != want {
+		t.Errorf("after starting: got %+v, want %+v", got, want)
+	}
+
+	c.Reply(writeCtx, syscall.EIO)
+	readReply(t, kernel)
+	if got, want := c.Stats(), (Stats{Started: 1}); got != want {
+		t.Errorf("after replying: got %+v, want %+v", got, want)
+	}
+
+	c.Reply(lookUpCtx, ENOENT)
+	readReply(t, kernel)
+	if got := c.Stats(); got != (Stats{}) {
+		t.Errorf("at the end: got %+v", got)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"runtime"
 	"syscall"
 	"time"
 	"unsafe"
@@ -34,14 +35,16 @@ import (
 ////////////////////////////////////////////////////////////////////////
 
 // Convert a kernel message to an appropriate op. If the op is unknown, a
-// special unexported type will be used.
+// special unexported type will be used. flags are the InitFlags agreed with
+// the kernel, some of which change the layout of messages.
 //
 // The caller is responsible for arranging for the message to be destroyed.
 func convertInMessage(
 	config *MountConfig,
 	inMsg *buffer.InMessage,
 	outMsg *buffer.OutMessage,
-	protocol fusekernel.Protocol) (o interface{}, err error) {
+	protocol fusekernel.Protocol,
+	flags fusekernel.InitFlags) (o interface{}, err error) {
 	switch inMsg.Header().Opcode {
 	case fusekernel.OpLookup:
 		buf := inMsg.ConsumeBytes(inMsg.Len())
@@ -50,24 +53,46 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpLookup")
 		}
 
-		o = &fuseops.LookUpInodeOp{
-			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:   string(buf[:n-1]),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+		to := lookUpInodeOps.get(config)
+		*to = fuseops.LookUpInodeOp{
+			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:      string(buf[:n-1]),
+			OpContext: opContext(inMsg),
 		}
+		o = to
 
 	case fusekernel.OpGetattr:
-		o = &fuseops.GetInodeAttributesOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+		to := getInodeAttributesOps.get(config)
+		*to = fuseops.GetInodeAttributesOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			OpContext: opContext(inMsg),
+		}
+		o = to
+
+		// Protocols before 7.9 send no input.
+		type input fusekernel.GetattrIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in != nil && fusekernel.GetattrFlags(in.GetattrFlags)&fusekernel.GetattrFh != 0 {
+			to.Handle = (*fuseops.HandleID)(&in.Fh)
+		}
+
+	case fusekernel.OpStatx:
+		type input fusekernel.StatxIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpStatx")
+		}
+
+		to := getInodeAttributesOps.get(config)
+		*to = fuseops.GetInodeAttributesOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Statx:     true,
+			OpContext: opContext(inMsg),
+		}
+		o = to
+
+		if fusekernel.GetattrFlags(in.GetattrFlags)&fusekernel.GetattrFh != 0 {
+			to.Handle = (*fuseops.HandleID)(&in.Fh)
 		}
 
 	case fusekernel.OpSetattr:
@@ -78,12 +103,8 @@ func convertInMessage(
 		}
 
 		to := &fuseops.SetInodeAttributesOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			OpContext: opContext(inMsg),
 		}
 		o = to
 
@@ -115,11 +136,19 @@ func convertInMessage(
 			to.Mtime = &t
 		}
 
+		if valid&fusekernel.SetattrCtime != 0 {
+			t := time.Unix(int64(in.Ctime), int64(in.CtimeNsec))
+			to.Ctime = &t
+		}
+
 		if valid.Handle() {
 			t := fuseops.HandleID(in.Fh)
 			to.Handle = &t
 		}
 
+		to.KillSuidgid = valid.KillSuidgid()
+		to.Valid = valid
+
 	case fusekernel.OpForget:
 		type input fusekernel.ForgetIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -127,15 +156,13 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpForget")
 		}
 
-		o = &fuseops.ForgetInodeOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			N:     in.Nlookup,
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+		to := forgetInodeOps.get(config)
+		*to = fuseops.ForgetInodeOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			N:         in.Nlookup,
+			OpContext: opContext(inMsg),
 		}
+		o = to
 
 	case fusekernel.OpBatchForget:
 		type input fusekernel.BatchForgetCountIn
@@ -159,12 +186,8 @@ func convertInMessage(
 		}
 
 		o = &fuseops.BatchForgetOp{
-			Entries: entries,
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Entries:   entries,
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpMkdir:
@@ -178,7 +201,12 @@ func convertInMessage(
 		if i < 0 {
 			return nil, errors.New("Corrupt OpMkdir")
 		}
-		name = name[:i]
+		name, ext := name[:i], name[i+1:]
+
+		secctx, err := convertSecurityContexts(config, ext)
+		if err != nil {
+			return nil, fmt.Errorf("Corrupt OpMkdir: %v", err)
+		}
 
 		o = &fuseops.MkDirOp{
 			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
@@ -190,12 +218,10 @@ func convertInMessage(
 			// words, the fact that this is a directory is implicit in the fact that
 			// the opcode is mkdir. But we want the correct mode to go through, so
 			// ensure that os.ModeDir is set.
-			Mode: ConvertFileMode(in.Mode) | os.ModeDir,
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Mode:             ConvertFileMode(in.Mode) | os.ModeDir,
+			Umask:            os.FileMode(in.Umask) & os.ModePerm,
+			SecurityContexts: secctx,
+			OpContext:        opContextWithUmask(inMsg, in.Umask),
 		}
 
 	case fusekernel.OpMknod:
@@ -209,18 +235,22 @@ func convertInMessage(
 		if i < 0 {
 			return nil, errors.New("Corrupt OpMknod")
 		}
-		name = name[:i]
+		name, ext := name[:i], name[i+1:]
+
+		secctx, err := convertSecurityContexts(config, ext)
+		if err != nil {
+			return nil, fmt.Errorf("Corrupt OpMknod: %v", err)
+		}
 
 		o = &fuseops.MkNodeOp{
 			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:   string(name),
 			Mode:   ConvertFileMode(in.Mode),
+			Umask:  os.FileMode(in.Umask) & os.ModePerm,
 			Rdev:   in.Rdev,
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+
+			SecurityContexts: secctx,
+			OpContext:        opContextWithUmask(inMsg, in.Umask),
 		}
 
 	case fusekernel.OpCreate:
@@ -234,40 +264,79 @@ func convertInMessage(
 		if i < 0 {
 			return nil, errors.New("Corrupt OpCreate")
 		}
-		name = name[:i]
+		name, ext := name[:i], name[i+1:]
+
+		secctx, err := convertSecurityContexts(config, ext)
+		if err != nil {
+			return nil, fmt.Errorf("Corrupt OpCreate: %v", err)
+		}
 
 		o = &fuseops.CreateFileOp{
 			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:   string(name),
 			Mode:   ConvertFileMode(in.Mode),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Umask:  os.FileMode(in.Umask) & os.ModePerm,
+
+			SecurityContexts: secctx,
+			OpenFlags:        fusekernel.OpenFlags(in.Flags),
+			KillSuidgid:      in.OpenFlags&fusekernel.OpenInKillSuidgid != 0,
+			OpContext:        opContextWithUmask(inMsg, in.Umask),
+		}
+
+	case fusekernel.OpTmpfile:
+		// As for OpCreate, but the name is a placeholder.
+		in := (*fusekernel.CreateIn)(inMsg.Consume(fusekernel.CreateInSize(protocol)))
+		if in == nil {
+			return nil, errors.New("Corrupt OpTmpfile")
+		}
+
+		name := inMsg.ConsumeBytes(inMsg.Len())
+		i := bytes.IndexByte(name, '\x00')
+		if i < 0 {
+			return nil, errors.New("Corrupt OpTmpfile")
+		}
+
+		secctx, err := convertSecurityContexts(config, name[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("Corrupt OpTmpfile: %v", err)
+		}
+
+		o = &fuseops.CreateTmpFileOp{
+			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
+			Mode:   ConvertFileMode(in.Mode),
+			Umask:  os.FileMode(in.Umask) & os.ModePerm,
+
+			SecurityContexts: secctx,
+			OpenFlags:        fusekernel.OpenFlags(in.Flags),
+			OpContext:        opContextWithUmask(inMsg, in.Umask),
 		}
 
 	case fusekernel.OpSymlink:
-		// The message is "newName\0target\0".
+		// The message is "newName\0target\0", possibly followed by extensions.
 		names := inMsg.ConsumeBytes(inMsg.Len())
-		if len(names) == 0 || names[len(names)-1] != 0 {
-			return nil, errors.New("Corrupt OpSymlink")
-		}
 		i := bytes.IndexByte(names, '\x00')
 		if i < 0 {
 			return nil, errors.New("Corrupt OpSymlink")
 		}
-		newName, target := names[0:i], names[i+1:len(names)-1]
+		j := bytes.IndexByte(names[i+1:], '\x00')
+		if j < 0 {
+			return nil, errors.New("Corrupt OpSymlink")
+		}
+		j += i + 1
+		newName, target, ext := names[0:i], names[i+1:j], names[j+1:]
+
+		secctx, err := convertSecurityContexts(config, ext)
+		if err != nil {
+			return nil, fmt.Errorf("Corrupt OpSymlink: %v", err)
+		}
 
 		o = &fuseops.CreateSymlinkOp{
 			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:   string(newName),
 			Target: string(target),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+
+			SecurityContexts: secctx,
+			OpContext:        opContext(inMsg),
 		}
 
 	case fusekernel.OpRename:
@@ -291,29 +360,47 @@ func convertInMessage(
 			names[4] == 0 && names[5] == 0 && names[6] == 0 && names[7] == 0 {
 			names = names[8:]
 		}
-		// names should be "old\x00new\x00"
-		if len(names) < 4 {
+		oldName, newName, ok := splitRenameNames(names)
+		if !ok {
 			return nil, errors.New("Corrupt OpRename")
 		}
-		if names[len(names)-1] != '\x00' {
-			return nil, errors.New("Corrupt OpRename")
+
+		o = &fuseops.RenameOp{
+			OldParent: fuseops.InodeID(inMsg.Header().Nodeid),
+			OldName:   string(oldName),
+			NewParent: fuseops.InodeID(in.Newdir),
+			NewName:   string(newName),
+			OpContext: opContext(inMsg),
 		}
-		i := bytes.IndexByte(names, '\x00')
-		if i < 0 {
-			return nil, errors.New("Corrupt OpRename")
+
+	case fusekernel.OpRename2:
+		if !config.EnableRenameFlags {
+			// Replying ENOSYS makes the kernel fail renameat2(2) with EINVAL.
+			o = &unknownOp{
+				OpCode: inMsg.Header().Opcode,
+				Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			}
+			break
+		}
+
+		type input fusekernel.Rename2In
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpRename2")
+		}
+
+		oldName, newName, ok := splitRenameNames(inMsg.ConsumeBytes(inMsg.Len()))
+		if !ok {
+			return nil, errors.New("Corrupt OpRename2")
 		}
-		oldName, newName := names[:i], names[i+1:len(names)-1]
 
 		o = &fuseops.RenameOp{
 			OldParent: fuseops.InodeID(inMsg.Header().Nodeid),
 			OldName:   string(oldName),
 			NewParent: fuseops.InodeID(in.Newdir),
 			NewName:   string(newName),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Flags:     in.Flags,
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpUnlink:
@@ -324,13 +411,9 @@ func convertInMessage(
 		}
 
 		o = &fuseops.UnlinkOp{
-			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:   string(buf[:n-1]),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:      string(buf[:n-1]),
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpRmdir:
@@ -341,13 +424,9 @@ func convertInMessage(
 		}
 
 		o = &fuseops.RmDirOp{
-			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:   string(buf[:n-1]),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:      string(buf[:n-1]),
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpOpen:
@@ -357,24 +436,19 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpOpen")
 		}
 
-		o = &fuseops.OpenFileOp{
-			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
-			OpenFlags: fusekernel.OpenFlags(in.Flags),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+		to := openFileOps.get(config)
+		*to = fuseops.OpenFileOp{
+			Inode:       fuseops.InodeID(inMsg.Header().Nodeid),
+			OpenFlags:   fusekernel.OpenFlags(in.Flags),
+			KillSuidgid: in.OpenFlags&fusekernel.OpenInKillSuidgid != 0,
+			OpContext:   opContext(inMsg),
 		}
+		o = to
 
 	case fusekernel.OpOpendir:
 		o = &fuseops.OpenDirOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpRead:
@@ -383,21 +457,24 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpRead")
 		}
 
-		to := &fuseops.ReadFileOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
-			Offset: int64(in.Offset),
-			Size:   int64(in.Size),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+		to := readFileOps.get(config)
+		*to = fuseops.ReadFileOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			Offset:    int64(in.Offset),
+			Size:      int64(in.Size),
+			OpContext: opContext(inMsg),
 		}
 		if !config.UseVectoredRead {
 			// Use part of the incoming message storage as the read buffer
 			// For vectored zero-copy reads, don't allocate any buffers
 			to.Dst = inMsg.GetFree(int(in.Size))
+
+			// If the read is too large for that, which a well-behaved kernel never
+			// asks for, borrow a pooled buffer that lives as long as the reply.
+			if to.Dst == nil && in.Size > 0 {
+				to.Dst = outMsg.Borrow(int(in.Size))
+			}
 		}
 		o = to
 
@@ -408,14 +485,10 @@ func convertInMessage(
 		}
 
 		to := &fuseops.ReadDirOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
-			Offset: fuseops.DirOffset(in.Offset),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			Offset:    fuseops.DirOffset(in.Offset),
+			OpContext: opContext(inMsg),
 		}
 		o = to
 
@@ -437,14 +510,12 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpRelease")
 		}
 
-		o = &fuseops.ReleaseFileHandleOp{
-			Handle: fuseops.HandleID(in.Fh),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+		to := releaseFileHandleOps.get(config)
+		*to = fuseops.ReleaseFileHandleOp{
+			Handle:    fuseops.HandleID(in.Fh),
+			OpContext: opContext(inMsg),
 		}
+		o = to
 
 	case fusekernel.OpReleasedir:
 		type input fusekernel.ReleaseIn
@@ -454,12 +525,8 @@ func convertInMessage(
 		}
 
 		o = &fuseops.ReleaseDirHandleOp{
-			Handle: fuseops.HandleID(in.Fh),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Handle:    fuseops.HandleID(in.Fh),
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpWrite:
@@ -473,17 +540,16 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpWrite")
 		}
 
-		o = &fuseops.WriteFileOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
-			Data:   buf,
-			Offset: int64(in.Offset),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+		to := writeFileOps.get(config)
+		*to = fuseops.WriteFileOp{
+			Inode:       fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:      fuseops.HandleID(in.Fh),
+			Data:        buf[:in.Size:in.Size],
+			Offset:      int64(in.Offset),
+			KillSuidgid: fusekernel.WriteFlags(in.WriteFlags)&fusekernel.WriteKillSuidgid != 0,
+			OpContext:   opContext(inMsg),
 		}
+		o = to
 
 	case fusekernel.OpFsync, fusekernel.OpFsyncdir:
 		type input fusekernel.FsyncIn
@@ -493,13 +559,10 @@ func convertInMessage(
 		}
 
 		o = &fuseops.SyncFileOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			Datasync:  in.FsyncFlags&fusekernel.FsyncFdatasync != 0,
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpSyncFS:
@@ -511,7 +574,7 @@ func convertInMessage(
 
 		o = &fuseops.SyncFSOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpFlush:
@@ -521,28 +584,24 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpFlush")
 		}
 
-		o = &fuseops.FlushFileOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+		to := flushFileOps.get(config)
+		*to = fuseops.FlushFileOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			OpContext: opContext(inMsg),
 		}
+		o = to
 
 	case fusekernel.OpReadlink:
 		o = &fuseops.ReadSymlinkOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpStatfs:
-		o = &fuseops.StatFSOp{}
+		o = &fuseops.StatFSOp{
+			OpContext: opContext(inMsg),
+		}
 
 	case fusekernel.OpInterrupt:
 		type input fusekernel.InterruptIn
@@ -562,12 +621,26 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpInit")
 		}
 
-		o = &initOp{
+		initOp := &initOp{
 			Kernel:       fusekernel.Protocol{in.Major, in.Minor},
 			MaxReadahead: in.MaxReadahead,
 			Flags:        fusekernel.InitFlags(in.Flags),
 		}
 
+		// Linux kernels speaking 7.36 and later send a longer struct containing
+		// the high flag bits. On OS X the same bit means InitVolRename.
+		if runtime.GOOS == "linux" && initOp.Flags&fusekernel.InitExt != 0 {
+			type ext fusekernel.InitInExt
+			e := (*ext)(inMsg.Consume(unsafe.Sizeof(ext{})))
+			if e == nil {
+				return nil, errors.New("Corrupt OpInit")
+			}
+
+			initOp.Flags2 = fusekernel.InitFlags2(e.Flags2)
+		}
+
+		o = initOp
+
 	case fusekernel.OpLink:
 		type input fusekernel.LinkIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -586,14 +659,10 @@ func convertInMessage(
 		}
 
 		o = &fuseops.CreateLinkOp{
-			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:   string(name),
-			Target: fuseops.InodeID(in.Oldnodeid),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:      string(name),
+			Target:    fuseops.InodeID(in.Oldnodeid),
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpRemovexattr:
@@ -604,13 +673,9 @@ func convertInMessage(
 		}
 
 		o = &fuseops.RemoveXattrOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:  string(buf[:n-1]),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:      string(buf[:n-1]),
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpGetxattr:
@@ -628,13 +693,9 @@ func convertInMessage(
 		name = name[:i]
 
 		to := &fuseops.GetXattrOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:  string(name),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:      string(name),
+			OpContext: opContext(inMsg),
 		}
 		o = to
 
@@ -661,12 +722,8 @@ func convertInMessage(
 		}
 
 		to := &fuseops.ListXattrOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			OpContext: opContext(inMsg),
 		}
 		o = to
 
@@ -683,34 +740,41 @@ func convertInMessage(
 		}
 	case fusekernel.OpSetxattr:
 		type input fusekernel.SetxattrIn
-		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
-		if in == nil {
-			return nil, errors.New("Corrupt OpSetxattr")
+		size := unsafe.Sizeof(input{})
+		ext := flags&fusekernel.InitSetxattrExt != 0
+		if ext {
+			size = unsafe.Sizeof(fusekernel.SetxattrExtIn{})
 		}
 
-		payload := inMsg.ConsumeBytes(inMsg.Len())
-		// payload should be "name\x00value"
-		if len(payload) < 3 {
+		p := inMsg.Consume(size)
+		if p == nil {
 			return nil, errors.New("Corrupt OpSetxattr")
 		}
+
+		in := (*input)(p)
+		var setxattrFlags uint32
+		if ext {
+			setxattrFlags = (*fusekernel.SetxattrExtIn)(p).SetxattrFlags
+		}
+
+		payload := inMsg.ConsumeBytes(inMsg.Len())
+		// payload should be "name\x00value", where the value may be empty.
 		i := bytes.IndexByte(payload, '\x00')
-		if i < 0 {
+		if i < 1 || len(payload)-(i+1) < int(in.Size) {
 			return nil, errors.New("Corrupt OpSetxattr")
 		}
 
-		name, value := payload[:i], payload[i+1:len(payload)]
+		name, value := payload[:i], payload[i+1:i+1+int(in.Size)]
 
 		o = &fuseops.SetXattrOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:  string(name),
-			Value: value,
-			Flags: in.Flags,
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:      string(name),
+			Value:     value,
+			Flags:     in.Flags,
+			KillSgid:  setxattrFlags&fusekernel.SetxattrAclKillSgid != 0,
+			OpContext: opContext(inMsg),
 		}
+
 	case fusekernel.OpFallocate:
 		type input fusekernel.FallocateIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -719,28 +783,146 @@ func convertInMessage(
 		}
 
 		o = &fuseops.FallocateOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
-			Offset: in.Offset,
-			Length: in.Length,
-			Mode:   in.Mode,
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			Offset:    in.Offset,
+			Length:    in.Length,
+			Mode:      in.Mode,
+			OpContext: opContext(inMsg),
 		}
 
 	default:
-		o = &unknownOp{
-			OpCode: inMsg.Header().Opcode,
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+		// Ops that only some platforms send.
+		var err error
+		if o, err = convertOSInMessage(inMsg); err != nil {
+			return nil, err
+		}
+
+		if o == nil {
+			o = &unknownOp{
+				OpCode: inMsg.Header().Opcode,
+				Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			}
 		}
 	}
 
 	return o, nil
 }
 
+// Describe the request that a message carries, for an op's OpContext.
+func opContext(inMsg *buffer.InMessage) fuseops.OpContext {
+	h := inMsg.Header()
+	return fuseops.OpContext{
+		FuseID: h.Unique,
+		Inode:  fuseops.InodeID(h.Nodeid),
+		Pid:    h.Pid,
+		Uid:    h.Uid,
+		Gid:    h.Gid,
+	}
+}
+
+// Like opContext, for ops that create an inode and so carry the caller's
+// umask.
+func opContextWithUmask(
+	inMsg *buffer.InMessage,
+	umask uint32) fuseops.OpContext {
+	oc := opContext(inMsg)
+	oc.Umask = os.FileMode(umask) & os.ModePerm
+	return oc
+}
+
+// Split the "old\x00new\x00" names that follow the input of a rename op.
+func splitRenameNames(names []byte) (oldName, newName []byte, ok bool) {
+	if len(names) < 4 || names[len(names)-1] != '\x00' {
+		return
+	}
+
+	i := bytes.IndexByte(names, '\x00')
+	if i < 0 {
+		return
+	}
+
+	return names[:i], names[i+1 : len(names)-1], true
+}
+
+// Parse the request extensions that the kernel appends after the final name
+// of a create-class op, returning the security contexts they contain.
+// Extensions of other types are skipped.
+func convertSecurityContexts(
+	config *MountConfig,
+	ext []byte) ([]fuseops.SecurityContext, error) {
+	if !config.EnableSecurityContext {
+		return nil, nil
+	}
+
+	var result []fuseops.SecurityContext
+	for len(ext) > 0 {
+		hdrSize := int(unsafe.Sizeof(fusekernel.ExtHeader{}))
+		if len(ext) < hdrSize {
+			return nil, errors.New("short extension header")
+		}
+
+		hdr := (*fusekernel.ExtHeader)(unsafe.Pointer(&ext[0]))
+		size := int(hdr.Size)
+		if size < hdrSize || size > len(ext) {
+			return nil, fmt.Errorf("bad extension size %d", hdr.Size)
+		}
+
+		if hdr.Type <= fusekernel.MaxNrSecctx {
+			contexts, err := convertSecctxList(ext[hdrSize:size], int(hdr.Type))
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, contexts...)
+		}
+
+		ext = ext[size:]
+	}
+
+	return result, nil
+}
+
+// Parse n consecutive struct fuse_secctx records, each followed by a
+// null-terminated name and a value.
+func convertSecctxList(
+	buf []byte,
+	n int) ([]fuseops.SecurityContext, error) {
+	result := make([]fuseops.SecurityContext, 0, n)
+	recSize := int(unsafe.Sizeof(fusekernel.Secctx{}))
+	for k := 0; k < n; k++ {
+		if len(buf) < recSize {
+			return nil, errors.New("short security context")
+		}
+
+		rec := (*fusekernel.Secctx)(unsafe.Pointer(&buf[0]))
+		rest := buf[recSize:]
+		i := bytes.IndexByte(rest, '\x00')
+		if i < 0 {
+			return nil, errors.New("unterminated security context name")
+		}
+
+		valueEnd := i + 1 + int(rec.Size)
+		if valueEnd > len(rest) {
+			return nil, errors.New("short security context value")
+		}
+
+		// The message buffer is reused, so copy the value out of it.
+		result = append(result, fuseops.SecurityContext{
+			Name:  string(rest[:i]),
+			Value: append([]byte(nil), rest[i+1:valueEnd]...),
+		})
+
+		// Records are padded to a multiple of eight bytes.
+		total := (recSize + valueEnd + 7) &^ 7
+		if total > len(buf) {
+			total = len(buf)
+		}
+		buf = buf[total:]
+	}
+
+	return result, nil
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Outgoing messages
 ////////////////////////////////////////////////////////////////////////
@@ -768,16 +950,19 @@ func (c *Connection) kernelResponse(
 		return true
 	}
 
+	// A file system that reports an xattr value or list larger than the buffer
+	// the kernel supplied is saying that the buffer is too small.
+	if opErr == nil && xattrOverflows(op) {
+		opErr = syscall.ERANGE
+	}
+
 	// If the user returned the error, fill in the error field of the outgoing
 	// message header.
 	if opErr != nil {
 		handled := false
 
 		if !handled {
-			m.OutHeader().Error = -int32(syscall.EIO)
-			if errno, ok := opErr.(syscall.Errno); ok {
-				m.OutHeader().Error = -int32(errno)
-			}
+			m.OutHeader().Error = -int32(ErrnoOf(opErr))
 
 			// Special case: for some types, convertInMessage grew the message in order
 			// to obtain a destination buffer. Make sure that we shrink back to just
@@ -797,6 +982,20 @@ func (c *Connection) kernelResponse(
 	return false
 }
 
+// Does the op claim to have read more than its non-empty destination buffer
+// holds? An empty buffer means that the caller is probing for the size.
+func xattrOverflows(op interface{}) bool {
+	switch o := op.(type) {
+	case *fuseops.GetXattrOp:
+		return len(o.Dst) != 0 && o.BytesRead > len(o.Dst)
+
+	case *fuseops.ListXattrOp:
+		return len(o.Dst) != 0 && o.BytesRead > len(o.Dst)
+	}
+
+	return false
+}
+
 // Like kernelResponse, but assumes the user replied with a nil error to the
 // op.
 func (c *Connection) kernelResponseForOp(
@@ -810,12 +1009,25 @@ func (c *Connection) kernelResponseForOp(
 		convertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.GetInodeAttributesOp:
+		if o.Statx {
+			out := (*fusekernel.StatxOut)(m.Grow(int(unsafe.Sizeof(fusekernel.StatxOut{}))))
+			out.AttrValid, out.AttrValidNsec = convertExpirationTime(
+				o.AttributesExpiration)
+			convertStatx(o.Inode, &o.Attributes, &out.Stat)
+			break
+		}
+
 		size := int(fusekernel.AttrOutSize(c.protocol))
 		out := (*fusekernel.AttrOut)(m.Grow(size))
 		out.AttrValid, out.AttrValidNsec = convertExpirationTime(
 			o.AttributesExpiration)
 		convertAttributes(o.Inode, &o.Attributes, &out.Attr)
 
+	case *fuseops.GetXTimesOp:
+		out := (*fusekernel.GetxtimesOut)(m.Grow(int(unsafe.Sizeof(fusekernel.GetxtimesOut{}))))
+		out.Bkuptime, out.BkuptimeNsec = convertTime(o.Bkuptime)
+		out.Crtime, out.CrtimeNsec = convertTime(o.Crtime)
+
 	case *fuseops.SetInodeAttributesOp:
 		size := int(fusekernel.AttrOutSize(c.protocol))
 		out := (*fusekernel.AttrOut)(m.Grow(size))
@@ -842,6 +1054,25 @@ func (c *Connection) kernelResponseForOp(
 		oo := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		oo.Fh = uint64(o.Handle)
 
+		if o.BackingID != 0 {
+			oo.OpenFlags |= uint32(fusekernel.OpenPassthrough)
+			oo.BackingID = int32(o.BackingID)
+		}
+
+	case *fuseops.CreateTmpFileOp:
+		eSize := int(fusekernel.EntryOutSize(c.protocol))
+
+		e := (*fusekernel.EntryOut)(m.Grow(eSize))
+		convertChildInodeEntry(&o.Entry, e)
+
+		oo := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
+		oo.Fh = uint64(o.Handle)
+
+		if o.BackingID != 0 {
+			oo.OpenFlags |= uint32(fusekernel.OpenPassthrough)
+			oo.BackingID = int32(o.BackingID)
+		}
+
 	case *fuseops.CreateSymlinkOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
@@ -855,6 +1086,9 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.RenameOp:
 		// Empty response
 
+	case *fuseops.ExchangeDataOp:
+		// Empty response
+
 	case *fuseops.RmDirOp:
 		// Empty response
 
@@ -876,7 +1110,12 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.ReadDirOp:
 		// convertInMessage already set up the destination buffer to be at the end
 		// of the out message. We need only shrink to the right size based on how
-		// much the user read.
+		// much the user read, unless the user supplied their own buffers, in
+		// which case those replace it.
+		if o.Data != nil {
+			m.ShrinkTo(buffer.OutMessageHeaderSize)
+			m.Append(o.Data...)
+		}
 		m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
 
 	case *fuseops.ReleaseDirHandleOp:
@@ -894,11 +1133,16 @@ func (c *Connection) kernelResponseForOp(
 			out.OpenFlags |= uint32(fusekernel.OpenDirectIO)
 		}
 
+		if o.BackingID != 0 {
+			out.OpenFlags |= uint32(fusekernel.OpenPassthrough)
+			out.BackingID = int32(o.BackingID)
+		}
+
 	case *fuseops.ReadFileOp:
-		if o.Dst != nil {
-			m.Append(o.Dst)
-		} else {
+		if o.Data != nil {
 			m.Append(o.Data...)
+		} else {
+			m.Append(o.Dst)
 		}
 		m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
 
@@ -991,12 +1235,14 @@ func (c *Connection) kernelResponseForOp(
 		out.Minor = o.Library.Minor
 		out.MaxReadahead = o.MaxReadahead
 		out.Flags = uint32(o.Flags)
+		out.Flags2 = uint32(o.Flags2)
 		// Default values
 		out.MaxBackground = 12
 		out.CongestionThreshold = 9
 		out.MaxWrite = o.MaxWrite
-		out.TimeGran = 1
+		out.TimeGran = o.TimeGran
 		out.MaxPages = o.MaxPages
+		out.MaxStackDepth = o.MaxStackDepth
 
 	default:
 		panic(fmt.Sprintf("Unexpected op: %#v", op))
@@ -1009,11 +1255,16 @@ func (c *Connection) kernelResponseForOp(
 // General conversions
 ////////////////////////////////////////////////////////////////////////
 
+// Convert a time to the seconds and nanoseconds since the epoch that the
+// kernel expects, keeping the full precision of the time. The kernel treats
+// the seconds as signed, so times before the epoch survive too. The zero
+// time.Time is sent as the epoch.
 func convertTime(t time.Time) (secs uint64, nsec uint32) {
-	totalNano := t.UnixNano()
-	secs = uint64(totalNano / 1e9)
-	nsec = uint32(totalNano % 1e9)
-	return secs, nsec
+	if t.IsZero() {
+		return 0, 0
+	}
+
+	return uint64(t.Unix()), uint32(t.Nanosecond())
 }
 
 func convertAttributes(
@@ -1029,8 +1280,15 @@ func convertAttributes(
 	out.Nlink = in.Nlink
 	out.Uid = in.Uid
 	out.Gid = in.Gid
-	// round up to the nearest 512 boundary
-	out.Blocks = (in.Size + 512 - 1) / 512
+	out.Blksize = in.BlockSize
+
+	// Unless the file system knows better, round up to the nearest 512
+	// boundary.
+	if in.Blocks != nil {
+		out.Blocks = *in.Blocks
+	} else {
+		out.Blocks = (in.Size + 512 - 1) / 512
+	}
 
 	// Set the mode.
 	out.Mode = ConvertGoMode(in.Mode)
@@ -1040,6 +1298,44 @@ func convertAttributes(
 	}
 }
 
+// Like convertAttributes, for the reply to FUSE_STATX, which adds the creation
+// time.
+func convertStatx(
+	inodeID fuseops.InodeID,
+	in *fuseops.InodeAttributes,
+	out *fusekernel.Statx) {
+	var attr fusekernel.Attr
+	convertAttributes(inodeID, in, &attr)
+
+	out.Mask = fusekernel.StatxBasicStats
+	out.Ino = attr.Ino
+	out.Size = attr.Size
+	out.Blocks = attr.Blocks
+	out.Blksize = attr.Blksize
+	out.Mode = uint16(attr.Mode)
+	out.Nlink = attr.Nlink
+	out.Uid = attr.Uid
+	out.Gid = attr.Gid
+
+	// The kernel's new_encode_dev format, with the minor number split around
+	// the major.
+	out.RdevMajor = (attr.Rdev & 0xfff00) >> 8
+	out.RdevMinor = (attr.Rdev & 0xff) | ((attr.Rdev >> 12) & 0xfff00)
+
+	out.Atime = sxTime(attr.Atime, attr.AtimeNsec)
+	out.Mtime = sxTime(attr.Mtime, attr.MtimeNsec)
+	out.Ctime = sxTime(attr.Ctime, attr.CtimeNsec)
+
+	if !in.Crtime.IsZero() {
+		out.Mask |= fusekernel.StatxBtime
+		out.Btime = sxTime(convertTime(in.Crtime))
+	}
+}
+
+func sxTime(secs uint64, nsec uint32) fusekernel.SxTime {
+	return fusekernel.SxTime{Sec: int64(secs), Nsec: nsec}
+}
+
 // Convert an absolute cache expiration time to a relative time from now for
 // consumption by the fuse kernel module.
 func convertExpirationTime(t time.Time) (secs uint64, nsecs uint32) {
@@ -1061,8 +1357,15 @@ func convertChildInodeEntry(
 	in *fuseops.ChildInodeEntry,
 	out *fusekernel.EntryOut) {
 	out.Nodeid = uint64(in.Child)
-	out.Generation = uint64(in.Generation)
 	out.EntryValid, out.EntryValidNsec = convertExpirationTime(in.EntryExpiration)
+
+	// A zero child is a negative entry, for which the kernel wants only the
+	// expiration.
+	if in.Child == 0 {
+		return
+	}
+
+	out.Generation = uint64(in.Generation)
 	out.AttrValid, out.AttrValidNsec = convertExpirationTime(in.AttributesExpiration)
 
 	convertAttributes(in.Child, &in.Attributes, &out.Attr)
@@ -0,0 +1,59 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Convert a message carrying one of the ops that only macFUSE sends, or
+// return nil if the opcode isn't one of them.
+func convertOSInMessage(inMsg *buffer.InMessage) (interface{}, error) {
+	switch inMsg.Header().Opcode {
+	case fusekernel.OpGetxtimes:
+		return &fuseops.GetXTimesOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			OpContext: opContext(inMsg),
+		}, nil
+
+	case fusekernel.OpExchange:
+		type input fusekernel.ExchangeIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpExchange")
+		}
+
+		oldName, newName, ok := splitRenameNames(inMsg.ConsumeBytes(inMsg.Len()))
+		if !ok {
+			return nil, errors.New("Corrupt OpExchange")
+		}
+
+		return &fuseops.ExchangeDataOp{
+			OldParent: fuseops.InodeID(in.Olddir),
+			OldName:   string(oldName),
+			NewParent: fuseops.InodeID(in.Newdir),
+			NewName:   string(newName),
+			Options:   in.Options,
+			OpContext: opContext(inMsg),
+		}, nil
+	}
+
+	return nil, nil
+}
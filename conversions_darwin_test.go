@@ -0,0 +1,54 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestConvertInMessage_Exchange(t *testing.T) {
+	in := fusekernel.ExchangeIn{Olddir: 7, Newdir: 8, Options: 1}
+	inMsg := makeInMessage(t, fusekernel.OpExchange, wire(t, in), []byte("foo\x00bar\x00"))
+	outMsg := buffer.GetOutMessage()
+	defer buffer.PutOutMessage(outMsg)
+
+	op, err := convertInMessage(&MountConfig{}, inMsg, outMsg, fusekernel.Protocol{Major: 7, Minor: 19}, 0)
+	if err != nil {
+		t.Fatalf("convertInMessage: %v", err)
+	}
+
+	got, ok := op.(*fuseops.ExchangeDataOp)
+	if !ok {
+		t.Fatalf("got %T, want *fuseops.ExchangeDataOp", op)
+	}
+
+	want := &fuseops.ExchangeDataOp{
+		OldParent: 7,
+		OldName:   "foo",
+		NewParent: 8,
+		NewName:   "bar",
+		Options:   1,
+		OpContext: got.OpContext,
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
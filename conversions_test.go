@@ -0,0 +1,1087 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Build an InMessage for the given opcode whose body is the concatenation of
+// the supplied pieces.
+func makeInMessage(
+	t *testing.T,
+	opcode uint32,
+	pieces ...[]byte) *buffer.InMessage {
+	t.Helper()
+
+	var body bytes.Buffer
+	for _, p := range pieces {
+		body.Write(p)
+	}
+
+	hdr := fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + body.Len()),
+		Opcode: opcode,
+		Unique: 17,
+		Nodeid: fuseops.RootInodeID,
+		Uid:    1000,
+		Gid:    1001,
+		Pid:    1234,
+	}
+
+	var msg bytes.Buffer
+	if err := binary.Write(&msg, binary.LittleEndian, &hdr); err != nil {
+		t.Fatalf("binary.Write: %v", err)
+	}
+	msg.Write(body.Bytes())
+
+	inMsg := buffer.NewInMessage()
+	if err := inMsg.Init(&msg); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	return inMsg
+}
+
+// Encode a struct in the kernel's (little endian) wire format.
+func wire(t *testing.T, v interface{}) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+		t.Fatalf("binary.Write: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+// Encode a security context extension in the format produced by the kernel's
+// fuse_get_security_context.
+func secctxExtension(t *testing.T, contexts ...fuseops.SecurityContext) []byte {
+	t.Helper()
+
+	var recs bytes.Buffer
+	for _, c := range contexts {
+		var rec bytes.Buffer
+		rec.Write(wire(t, fusekernel.Secctx{Size: uint32(len(c.Value))}))
+		rec.WriteString(c.Name)
+		rec.WriteByte(0)
+		rec.Write(c.Value)
+		for rec.Len()%8 != 0 {
+			rec.WriteByte(0)
+		}
+
+		recs.Write(rec.Bytes())
+	}
+
+	hdr := fusekernel.ExtHeader{
+		Size: uint32(int(unsafe.Sizeof(fusekernel.ExtHeader{})) + recs.Len()),
+		Type: uint32(len(contexts)),
+	}
+
+	return append(wire(t, hdr), recs.Bytes()...)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+// The fields common to create-class ops that are filled in from the request.
+type createFields struct {
+	Umask            os.FileMode
+	SecurityContexts []fuseops.SecurityContext
+}
+
+func TestConvertInMessage_CreateOps(t *testing.T) {
+	label := fuseops.SecurityContext{
+		Name:  "security.selinux",
+		Value: []byte("system_u:object_r:fusefs_t:s0\x00"),
+	}
+
+	protocol := fusekernel.Protocol{Major: 7, Minor: 36}
+	ext := secctxExtension(t, label)
+
+	testCases := []struct {
+		name      string
+		opcode    uint32
+		pieces    [][]byte
+		wantUmask os.FileMode
+		get       func(op interface{}) createFields
+	}{
+		{
+			name:   "mkdir",
+			opcode: fusekernel.OpMkdir,
+			pieces: [][]byte{
+				wire(t, fusekernel.MkdirIn{Mode: 0777, Umask: 022}),
+				[]byte("dir\x00"),
+			},
+			wantUmask: 022,
+			get: func(op interface{}) createFields {
+				o := op.(*fuseops.MkDirOp)
+				return createFields{o.Umask, o.SecurityContexts}
+			},
+		},
+		{
+			name:   "mknod",
+			opcode: fusekernel.OpMknod,
+			pieces: [][]byte{
+				wire(t, fusekernel.MknodIn{Mode: 0666, Umask: 027}),
+				[]byte("node\x00"),
+			},
+			wantUmask: 027,
+			get: func(op interface{}) createFields {
+				o := op.(*fuseops.MkNodeOp)
+				return createFields{o.Umask, o.SecurityContexts}
+			},
+		},
+		{
+			name:   "create",
+			opcode: fusekernel.OpCreate,
+			pieces: [][]byte{
+				wire(t, fusekernel.CreateIn{
+					Flags: uint32(fusekernel.OpenReadWrite | fusekernel.OpenAppend),
+					Mode:  0666,
+					Umask: 077,
+				}),
+				[]byte("file\x00"),
+			},
+			wantUmask: 077,
+			get: func(op interface{}) createFields {
+				o := op.(*fuseops.CreateFileOp)
+				want := fusekernel.OpenReadWrite | fusekernel.OpenAppend
+				if o.OpenFlags != want {
+					t.Errorf("OpenFlags: got %v, want %v", o.OpenFlags, want)
+				}
+				return createFields{o.Umask, o.SecurityContexts}
+			},
+		},
+		{
+			name:   "tmpfile",
+			opcode: fusekernel.OpTmpfile,
+			pieces: [][]byte{
+				wire(t, fusekernel.CreateIn{
+					Flags: uint32(fusekernel.OpenReadWrite),
+					Mode:  syscall.S_IFREG | 0600,
+					Umask: 022,
+				}),
+				[]byte("/\x00"),
+			},
+			wantUmask: 022,
+			get: func(op interface{}) createFields {
+				o := op.(*fuseops.CreateTmpFileOp)
+				if o.Mode != 0600 || o.OpenFlags != fusekernel.OpenReadWrite {
+					t.Errorf("got Mode %v, OpenFlags %v", o.Mode, o.OpenFlags)
+				}
+				return createFields{o.Umask, o.SecurityContexts}
+			},
+		},
+		{
+			name:   "symlink",
+			opcode: fusekernel.OpSymlink,
+			pieces: [][]byte{[]byte("link\x00target\x00")},
+			get: func(op interface{}) createFields {
+				o := op.(*fuseops.CreateSymlinkOp)
+				if o.Target != "target" {
+					t.Errorf("Target: got %q, want %q", o.Target, "target")
+				}
+				return createFields{0, o.SecurityContexts}
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// With the extension enabled, the labels should come through.
+			inMsg := makeInMessage(t, tc.opcode, append(tc.pieces, ext)...)
+			cfg := MountConfig{EnableSecurityContext: true}
+
+			op, err := convertInMessage(&cfg, inMsg, nil, protocol, 0)
+			if err != nil {
+				t.Fatalf("convertInMessage: %v", err)
+			}
+
+			want := createFields{tc.wantUmask, []fuseops.SecurityContext{label}}
+			if got := tc.get(op); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+
+			// Without it, the kernel sends nothing extra and we report nothing.
+			inMsg = makeInMessage(t, tc.opcode, tc.pieces...)
+
+			op, err = convertInMessage(&MountConfig{}, inMsg, nil, protocol, 0)
+			if err != nil {
+				t.Fatalf("convertInMessage: %v", err)
+			}
+
+			want = createFields{tc.wantUmask, nil}
+			if got := tc.get(op); !reflect.DeepEqual(got, want) {
+				t.Errorf("disabled: got %+v, want %+v", got, want)
+			}
+
+			// A truncated extension should be rejected.
+			pieces := append(tc.pieces, ext[:len(ext)-8])
+			inMsg = makeInMessage(t, tc.opcode, pieces...)
+
+			if _, err := convertInMessage(&cfg, inMsg, nil, protocol, 0); err == nil {
+				t.Error("truncated extension: expected an error, got nil")
+			}
+		})
+	}
+}
+
+func TestConvertInMessage_OpContext(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 36}
+	testCases := []struct {
+		name      string
+		opcode    uint32
+		pieces    [][]byte
+		wantUmask os.FileMode
+	}{
+		{"statfs", fusekernel.OpStatfs, nil, 0},
+		{"getattr", fusekernel.OpGetattr, [][]byte{wire(t, fusekernel.GetattrIn{})}, 0},
+		{"lookup", fusekernel.OpLookup, [][]byte{[]byte("foo\x00")}, 0},
+		{
+			"mkdir",
+			fusekernel.OpMkdir,
+			[][]byte{wire(t, fusekernel.MkdirIn{Mode: 0777, Umask: 022}), []byte("dir\x00")},
+			022,
+		},
+		{"syncfs", fusekernel.OpSyncFS, [][]byte{wire(t, fusekernel.SyncFSIn{})}, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			inMsg := makeInMessage(t, tc.opcode, tc.pieces...)
+			op, err := convertInMessage(&MountConfig{}, inMsg, nil, protocol, 0)
+			if err != nil {
+				t.Fatalf("convertInMessage: %v", err)
+			}
+
+			got, ok := fuseops.ContextOf(op)
+			if !ok {
+				t.Fatalf("no OpContext for %T", op)
+			}
+
+			want := fuseops.OpContext{
+				FuseID: 17,
+				Inode:  fuseops.RootInodeID,
+				Pid:    1234,
+				Uid:    1000,
+				Gid:    1001,
+				Umask:  tc.wantUmask,
+			}
+
+			if got != want {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestConvertInMessage_ReadDst(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 36}
+	testCases := []struct {
+		name string
+		size uint32
+	}{
+		{"fits in message", 1 << 16},
+		{"larger than message", 4 << 20},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			in := fusekernel.ReadIn{Size: tc.size}
+			inMsg := makeInMessage(t, fusekernel.OpRead, wire(t, in))
+			outMsg := buffer.GetOutMessage()
+			defer buffer.PutOutMessage(outMsg)
+
+			op, err := convertInMessage(&MountConfig{}, inMsg, outMsg, protocol, 0)
+			if err != nil {
+				t.Fatalf("convertInMessage: %v", err)
+			}
+
+			if got := len(op.(*fuseops.ReadFileOp).Dst); got != int(tc.size) {
+				t.Errorf("len(Dst) = %d, want %d", got, tc.size)
+			}
+		})
+	}
+}
+
+func TestKernelResponse_VectoredData(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 36}
+	c := &Connection{protocol: protocol}
+	data := [][]byte{[]byte("taco"), []byte("burrito")}
+
+	testCases := []struct {
+		name   string
+		opcode uint32
+		set    func(op interface{})
+	}{
+		{
+			"ReadFile",
+			fusekernel.OpRead,
+			func(op interface{}) {
+				o := op.(*fuseops.ReadFileOp)
+				copy(o.Dst, "ignored")
+				o.Data = data
+				o.BytesRead = 9
+			},
+		},
+		{
+			"ReadDir",
+			fusekernel.OpReaddir,
+			func(op interface{}) {
+				o := op.(*fuseops.ReadDirOp)
+				copy(o.Dst, "ignored")
+				o.Data = data
+				o.BytesRead = 9
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			in := fusekernel.ReadIn{Size: 4096}
+			inMsg := makeInMessage(t, tc.opcode, wire(t, in))
+			outMsg := buffer.GetOutMessage()
+			defer buffer.PutOutMessage(outMsg)
+
+			op, err := convertInMessage(&MountConfig{}, inMsg, outMsg, protocol, 0)
+			if err != nil {
+				t.Fatalf("convertInMessage: %v", err)
+			}
+
+			tc.set(op)
+			c.kernelResponse(outMsg, 17, op, nil)
+
+			if got, want := outMsg.Len(), buffer.OutMessageHeaderSize+9; got != want {
+				t.Fatalf("Len() = %d, want %d", got, want)
+			}
+
+			got := bytes.Join(outMsg.Sglist, nil)[buffer.OutMessageHeaderSize:]
+			if string(got) != "tacoburri" {
+				t.Errorf("payload = %q, want %q", got, "tacoburri")
+			}
+
+			// The supplied slices should be sent in place.
+			if &outMsg.Sglist[1][0] != &data[0][0] {
+				t.Errorf("first segment doesn't alias Data[0]")
+			}
+		})
+	}
+}
+
+func TestConvertInMessage_WriteData(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 36}
+	in := fusekernel.WriteIn{Size: 4}
+
+	// The kernel never sends trailing bytes, but they must not leak into Data
+	// if it does.
+	inMsg := makeInMessage(t, fusekernel.OpWrite, wire(t, in), []byte("tacoburrito"))
+	outMsg := buffer.GetOutMessage()
+	defer buffer.PutOutMessage(outMsg)
+
+	op, err := convertInMessage(&MountConfig{}, inMsg, outMsg, protocol, 0)
+	if err != nil {
+		t.Fatalf("convertInMessage: %v", err)
+	}
+
+	o := op.(*fuseops.WriteFileOp)
+	if string(o.Data) != "taco" {
+		t.Fatalf("Data = %q, want %q", o.Data, "taco")
+	}
+
+	if cap(o.Data) != len(o.Data) {
+		t.Errorf("cap(Data) = %d, want %d", cap(o.Data), len(o.Data))
+	}
+
+	// Data should alias the message, and CopyData should not.
+	msg := inMsg.Bytes()
+	if &o.Data[0] != &msg[len(msg)-len("tacoburrito")] {
+		t.Errorf("Data doesn't alias the incoming message")
+	}
+
+	c := o.CopyData()
+	if string(c) != "taco" {
+		t.Errorf("CopyData() = %q, want %q", c, "taco")
+	}
+
+	if &c[0] == &o.Data[0] {
+		t.Errorf("CopyData() aliases Data")
+	}
+}
+
+func TestConvertInMessage_SetXattr(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 36}
+	testCases := []struct {
+		name  string
+		flags uint32
+		value string
+	}{
+		{"create", fuseops.XattrCreate, "taco"},
+		{"replace", fuseops.XattrReplace, "burrito"},
+		{"empty value", 0, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var in fusekernel.SetxattrIn
+			in.Size = uint32(len(tc.value))
+			in.Flags = tc.flags
+
+			// Trailing bytes beyond the value's size must not leak into it.
+			payload := []byte("user.a\x00" + tc.value + "junk")
+			inMsg := makeInMessage(t, fusekernel.OpSetxattr, wire(t, in), payload)
+			outMsg := buffer.GetOutMessage()
+			defer buffer.PutOutMessage(outMsg)
+
+			op, err := convertInMessage(&MountConfig{}, inMsg, outMsg, protocol, 0)
+			if err != nil {
+				t.Fatalf("convertInMessage: %v", err)
+			}
+
+			o := op.(*fuseops.SetXattrOp)
+			if o.Name != "user.a" || string(o.Value) != tc.value || o.Flags != tc.flags {
+				t.Errorf(
+					"got (%q, %q, %#x), want (%q, %q, %#x)",
+					o.Name, o.Value, o.Flags,
+					"user.a", tc.value, tc.flags)
+			}
+		})
+	}
+}
+
+func TestConvertInMessage_GetattrHandle(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 36}
+	handle := fuseops.HandleID(23)
+
+	testCases := []struct {
+		name string
+		in   fusekernel.GetattrIn
+		want *fuseops.HandleID
+	}{
+		{"stat", fusekernel.GetattrIn{Fh: 23}, nil},
+		{"fstat", fusekernel.GetattrIn{GetattrFlags: uint32(fusekernel.GetattrFh), Fh: 23}, &handle},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			inMsg := makeInMessage(t, fusekernel.OpGetattr, wire(t, tc.in))
+			outMsg := buffer.GetOutMessage()
+			defer buffer.PutOutMessage(outMsg)
+
+			op, err := convertInMessage(&MountConfig{}, inMsg, outMsg, protocol, 0)
+			if err != nil {
+				t.Fatalf("convertInMessage: %v", err)
+			}
+
+			got := op.(*fuseops.GetInodeAttributesOp).Handle
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Handle: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestConvertInMessage_Statx(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 36}
+	in := fusekernel.StatxIn{
+		GetattrFlags: uint32(fusekernel.GetattrFh),
+		Fh:           23,
+		SxMask:       fusekernel.StatxBasicStats | fusekernel.StatxBtime,
+	}
+
+	inMsg := makeInMessage(t, fusekernel.OpStatx, wire(t, in))
+	outMsg := buffer.GetOutMessage()
+	defer buffer.PutOutMessage(outMsg)
+
+	op, err := convertInMessage(&MountConfig{}, inMsg, outMsg, protocol, 0)
+	if err != nil {
+		t.Fatalf("convertInMessage: %v", err)
+	}
+
+	got, ok := op.(*fuseops.GetInodeAttributesOp)
+	if !ok {
+		t.Fatalf("got %T, want *fuseops.GetInodeAttributesOp", op)
+	}
+
+	if !got.Statx || got.Handle == nil || *got.Handle != 23 {
+		t.Errorf("got Statx %v, Handle %v", got.Statx, got.Handle)
+	}
+}
+
+func TestConvertInMessage_Rename2(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 36}
+	in := fusekernel.Rename2In{Newdir: 7, Flags: fuseops.RenameNoReplace}
+
+	testCases := []struct {
+		name    string
+		enabled bool
+	}{
+		{"enabled", true},
+		{"disabled", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			inMsg := makeInMessage(t, fusekernel.OpRename2, wire(t, in), []byte("foo\x00bar\x00"))
+			outMsg := buffer.GetOutMessage()
+			defer buffer.PutOutMessage(outMsg)
+
+			config := &MountConfig{EnableRenameFlags: tc.enabled}
+			op, err := convertInMessage(config, inMsg, outMsg, protocol, 0)
+			if err != nil {
+				t.Fatalf("convertInMessage: %v", err)
+			}
+
+			if !tc.enabled {
+				if _, ok := op.(*unknownOp); !ok {
+					t.Fatalf("got %T, want *unknownOp", op)
+				}
+				return
+			}
+
+			got, ok := op.(*fuseops.RenameOp)
+			if !ok {
+				t.Fatalf("got %T, want *fuseops.RenameOp", op)
+			}
+
+			want := &fuseops.RenameOp{
+				OldParent: fuseops.RootInodeID,
+				OldName:   "foo",
+				NewParent: 7,
+				NewName:   "bar",
+				Flags:     fuseops.RenameNoReplace,
+				OpContext: got.OpContext,
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestConvertInMessage_OpenFlags(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 36}
+	flags := fusekernel.OpenWriteOnly | fusekernel.OpenAppend | fusekernel.OpenNoatime
+
+	inMsg := makeInMessage(t, fusekernel.OpOpen, wire(t, fusekernel.OpenIn{Flags: uint32(flags)}))
+	outMsg := buffer.GetOutMessage()
+	defer buffer.PutOutMessage(outMsg)
+
+	op, err := convertInMessage(&MountConfig{}, inMsg, outMsg, protocol, 0)
+	if err != nil {
+		t.Fatalf("convertInMessage: %v", err)
+	}
+
+	got := op.(*fuseops.OpenFileOp).OpenFlags
+	if got != flags {
+		t.Errorf("OpenFlags: got %v, want %v", got, flags)
+	}
+
+	if !got.IsWriteOnly() || !got.Append() || got.Noatime() != (fusekernel.OpenNoatime != 0) {
+		t.Errorf("OpenFlags %v: wrong accessors", got)
+	}
+
+	if got.Exclusive() || got.Truncate() || got.Direct() {
+		t.Errorf("OpenFlags %v: unexpected flags", got)
+	}
+}
+
+func TestConvertInMessage_Truncate(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 36}
+	handle := fuseops.HandleID(23)
+
+	testCases := []struct {
+		name       string
+		valid      fusekernel.SetattrValid
+		wantHandle *fuseops.HandleID
+	}{
+		{"truncate", fusekernel.SetattrSize, nil},
+		{"ftruncate", fusekernel.SetattrSize | fusekernel.SetattrHandle, &handle},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var in fusekernel.SetattrIn
+			in.Valid = uint32(tc.valid)
+			in.Fh = 23
+			in.Size = 100
+
+			inMsg := makeInMessage(t, fusekernel.OpSetattr, wire(t, in))
+			outMsg := buffer.GetOutMessage()
+			defer buffer.PutOutMessage(outMsg)
+
+			op, err := convertInMessage(&MountConfig{}, inMsg, outMsg, protocol, 0)
+			if err != nil {
+				t.Fatalf("convertInMessage: %v", err)
+			}
+
+			got := op.(*fuseops.SetInodeAttributesOp)
+			if !reflect.DeepEqual(got.Handle, tc.wantHandle) {
+				t.Errorf("Handle: got %v, want %v", got.Handle, tc.wantHandle)
+			}
+
+			if got.Size == nil || *got.Size != 100 {
+				t.Errorf("Size: got %v, want 100", got.Size)
+			}
+
+			if got.Valid != tc.valid {
+				t.Errorf("Valid: got %v, want %v", got.Valid, tc.valid)
+			}
+		})
+	}
+}
+
+func TestConvertInMessage_SetattrTimes(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 36}
+
+	var in fusekernel.SetattrIn
+	in.Valid = uint32(fusekernel.SetattrAtime | fusekernel.SetattrMtime | fusekernel.SetattrCtime)
+	in.Atime, in.AtimeNsec = 1700000000, 123456789
+	in.Mtime, in.MtimeNsec = 1700000001, 1
+	in.Ctime, in.CtimeNsec = 1700000002, 999999999
+
+	inMsg := makeInMessage(t, fusekernel.OpSetattr, wire(t, in))
+	outMsg := buffer.GetOutMessage()
+	defer buffer.PutOutMessage(outMsg)
+
+	op, err := convertInMessage(&MountConfig{}, inMsg, outMsg, protocol, 0)
+	if err != nil {
+		t.Fatalf("convertInMessage: %v", err)
+	}
+
+	got := op.(*fuseops.SetInodeAttributesOp)
+	checks := []struct {
+		name string
+		got  *time.Time
+		want time.Time
+	}{
+		{"Atime", got.Atime, time.Unix(1700000000, 123456789)},
+		{"Mtime", got.Mtime, time.Unix(1700000001, 1)},
+		{"Ctime", got.Ctime, time.Unix(1700000002, 999999999)},
+	}
+
+	for _, c := range checks {
+		if c.got == nil || !c.got.Equal(c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, c.got, c.want)
+		}
+	}
+}
+
+func TestConvertInMessage_KillSuidgid(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 36}
+	testCases := []struct {
+		name   string
+		opcode uint32
+		pieces [][]byte
+		get    func(op interface{}) bool
+	}{
+		{
+			name:   "write",
+			opcode: fusekernel.OpWrite,
+			pieces: [][]byte{
+				wire(t, fusekernel.WriteIn{
+					Size:       4,
+					WriteFlags: uint32(fusekernel.WriteKillSuidgid),
+				}),
+				[]byte("taco"),
+			},
+			get: func(op interface{}) bool { return op.(*fuseops.WriteFileOp).KillSuidgid },
+		},
+		{
+			name:   "setattr",
+			opcode: fusekernel.OpSetattr,
+			pieces: func() [][]byte {
+				var in fusekernel.SetattrIn
+				in.Valid = uint32(fusekernel.SetattrSize | fusekernel.SetattrKillSuidgid)
+				return [][]byte{wire(t, in)}
+			}(),
+			get: func(op interface{}) bool { return op.(*fuseops.SetInodeAttributesOp).KillSuidgid },
+		},
+		{
+			name:   "open",
+			opcode: fusekernel.OpOpen,
+			pieces: [][]byte{
+				wire(t, fusekernel.OpenIn{
+					Flags:     uint32(os.O_WRONLY | os.O_TRUNC),
+					OpenFlags: fusekernel.OpenInKillSuidgid,
+				}),
+			},
+			get: func(op interface{}) bool { return op.(*fuseops.OpenFileOp).KillSuidgid },
+		},
+		{
+			name:   "create",
+			opcode: fusekernel.OpCreate,
+			pieces: [][]byte{
+				wire(t, fusekernel.CreateIn{
+					Flags:     uint32(os.O_WRONLY | os.O_TRUNC),
+					Mode:      0644,
+					OpenFlags: fusekernel.OpenInKillSuidgid,
+				}),
+				[]byte("file\x00"),
+			},
+			get: func(op interface{}) bool { return op.(*fuseops.CreateFileOp).KillSuidgid },
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			inMsg := makeInMessage(t, tc.opcode, tc.pieces...)
+			outMsg := buffer.GetOutMessage()
+			defer buffer.PutOutMessage(outMsg)
+
+			op, err := convertInMessage(&MountConfig{}, inMsg, outMsg, protocol, 0)
+			if err != nil {
+				t.Fatalf("convertInMessage: %v", err)
+			}
+
+			if !tc.get(op) {
+				t.Errorf("KillSuidgid = false, want true")
+			}
+		})
+	}
+}
+
+func TestKernelResponse_XattrSize(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 36}
+	c := &Connection{protocol: protocol}
+
+	testCases := []struct {
+		name      string
+		size      uint32
+		bytesRead int
+		wantErr   syscall.Errno
+		wantBody  []byte
+	}{
+		// A zero size asks for the size of the value.
+		{"probe", 0, 7, 0, wire(t, fusekernel.GetxattrOut{Size: 7})},
+		{"fits", 16, 7, 0, make([]byte, 7)},
+		{"too small", 4, 7, syscall.ERANGE, nil},
+	}
+
+	for _, tc := range testCases {
+		for opName, opcode := range map[string]uint32{
+			"getxattr":  fusekernel.OpGetxattr,
+			"listxattr": fusekernel.OpListxattr,
+		} {
+			t.Run(tc.name+"/"+opName, func(t *testing.T) {
+				var pieces [][]byte
+				if opcode == fusekernel.OpGetxattr {
+					var in fusekernel.GetxattrIn
+					in.Size = tc.size
+					pieces = [][]byte{wire(t, in), []byte("user.a\x00")}
+				} else {
+					pieces = [][]byte{wire(t, fusekernel.ListxattrIn{Size: tc.size})}
+				}
+
+				inMsg := makeInMessage(t, opcode, pieces...)
+				outMsg := buffer.GetOutMessage()
+				defer buffer.PutOutMessage(outMsg)
+
+				op, err := convertInMessage(&MountConfig{}, inMsg, outMsg, protocol, 0)
+				if err != nil {
+					t.Fatalf("convertInMessage: %v", err)
+				}
+
+				switch o := op.(type) {
+				case *fuseops.GetXattrOp:
+					o.BytesRead = tc.bytesRead
+				case *fuseops.ListXattrOp:
+					o.BytesRead = tc.bytesRead
+				}
+
+				c.kernelResponse(outMsg, 17, op, nil)
+
+				if got := syscall.Errno(-outMsg.OutHeader().Error); got != tc.wantErr {
+					t.Errorf("error = %v, want %v", got, tc.wantErr)
+				}
+
+				body := bytes.Join(outMsg.Sglist, nil)
+				if len(body) > 0 {
+					body = body[buffer.OutMessageHeaderSize:]
+				}
+
+				if !bytes.Equal(body, tc.wantBody) {
+					t.Errorf("body = %v, want %v", body, tc.wantBody)
+				}
+			})
+		}
+	}
+}
+
+func TestKernelResponse_BackingID(t *testing.T) {
+	c := &Connection{protocol: fusekernel.Protocol{Major: 7, Minor: 36}}
+	testCases := []struct {
+		name string
+		id   fuseops.BackingID
+		want fusekernel.OpenOut
+	}{
+		{"none", 0, fusekernel.OpenOut{Fh: 3}},
+		{
+			"passthrough",
+			5,
+			fusekernel.OpenOut{
+				Fh:        3,
+				OpenFlags: uint32(fusekernel.OpenPassthrough),
+				BackingID: 5,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := buffer.GetOutMessage()
+			defer buffer.PutOutMessage(m)
+
+			c.kernelResponse(m, 17, &fuseops.OpenFileOp{Handle: 3, BackingID: tc.id}, nil)
+
+			body := bytes.Join(m.Sglist, nil)[buffer.OutMessageHeaderSize:]
+			if want := wire(t, tc.want); !bytes.Equal(body, want) {
+				t.Errorf("body = %v, want %v", body, want)
+			}
+		})
+	}
+}
+
+func TestKernelResponse_NegativeEntry(t *testing.T) {
+	c := &Connection{protocol: fusekernel.Protocol{Major: 7, Minor: 36}}
+	m := buffer.GetOutMessage()
+	defer buffer.PutOutMessage(m)
+
+	op := &fuseops.LookUpInodeOp{
+		Entry: fuseops.ChildInodeEntry{
+			EntryExpiration: time.Now().Add(time.Hour),
+
+			// Ignored for a negative entry.
+			Generation:           3,
+			Attributes:           fuseops.InodeAttributes{Size: 17, Mode: 0644},
+			AttributesExpiration: time.Now().Add(time.Hour),
+		},
+	}
+
+	c.kernelResponse(m, 17, op, nil)
+
+	if h := m.OutHeader(); h.Error != 0 {
+		t.Fatalf("Error = %d", h.Error)
+	}
+
+	body := bytes.Join(m.Sglist, nil)[buffer.OutMessageHeaderSize:]
+	out := (*fusekernel.EntryOut)(unsafe.Pointer(&body[0]))
+	if out.Nodeid != 0 || out.EntryValid < 3500 || out.EntryValid > 3600 {
+		t.Errorf("Nodeid %d, EntryValid %d", out.Nodeid, out.EntryValid)
+	}
+
+	if out.Generation != 0 || out.AttrValid != 0 || out.Attr != (fusekernel.Attr{}) {
+		t.Errorf("attributes sent for a negative entry: %+v", out)
+	}
+}
+
+func TestKernelResponse_AttributeTimes(t *testing.T) {
+	c := &Connection{protocol: fusekernel.Protocol{Major: 7, Minor: 36}}
+	m := buffer.GetOutMessage()
+	defer buffer.PutOutMessage(m)
+
+	op := &fuseops.GetInodeAttributesOp{
+		Attributes: fuseops.InodeAttributes{
+			Atime: time.Unix(1700000000, 123456789),
+
+			// Beyond the range of UnixNano.
+			Mtime: time.Date(2500, 1, 1, 0, 0, 0, 7, time.UTC),
+
+			// Before the epoch.
+			Ctime: time.Unix(-1, 500),
+		},
+	}
+
+	c.kernelResponse(m, 17, op, nil)
+
+	body := bytes.Join(m.Sglist, nil)[buffer.OutMessageHeaderSize:]
+	out := (*fusekernel.AttrOut)(unsafe.Pointer(&body[0]))
+
+	checks := []struct {
+		name string
+		secs uint64
+		nsec uint32
+		want time.Time
+	}{
+		{"atime", out.Attr.Atime, out.Attr.AtimeNsec, op.Attributes.Atime},
+		{"mtime", out.Attr.Mtime, out.Attr.MtimeNsec, op.Attributes.Mtime},
+		{"ctime", out.Attr.Ctime, out.Attr.CtimeNsec, op.Attributes.Ctime},
+	}
+
+	for _, c := range checks {
+		if got := time.Unix(int64(c.secs), int64(c.nsec)); !got.Equal(c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestKernelResponse_GetXTimes(t *testing.T) {
+	c := &Connection{protocol: fusekernel.Protocol{Major: 7, Minor: 19}}
+	m := buffer.GetOutMessage()
+	defer buffer.PutOutMessage(m)
+
+	op := &fuseops.GetXTimesOp{Crtime: time.Unix(1600000000, 4)}
+	c.kernelResponse(m, 17, op, nil)
+
+	body := bytes.Join(m.Sglist, nil)[buffer.OutMessageHeaderSize:]
+	if len(body) != int(unsafe.Sizeof(fusekernel.GetxtimesOut{})) {
+		t.Fatalf("got %d bytes", len(body))
+	}
+
+	out := (*fusekernel.GetxtimesOut)(unsafe.Pointer(&body[0]))
+	want := fusekernel.GetxtimesOut{Crtime: 1600000000, CrtimeNsec: 4}
+	if *out != want {
+		t.Errorf("got %+v, want %+v", *out, want)
+	}
+}
+
+func TestKernelResponse_Statx(t *testing.T) {
+	c := &Connection{protocol: fusekernel.Protocol{Major: 7, Minor: 36}}
+
+	attrs := fuseops.InodeAttributes{
+		Size:   17,
+		Nlink:  1,
+		Mode:   0644 | os.ModeDevice,
+		Rdev:   0x12345,
+		Uid:    23,
+		Atime:  time.Unix(1700000000, 1),
+		Mtime:  time.Unix(1700000001, 2),
+		Ctime:  time.Unix(1700000002, 3),
+		Crtime: time.Unix(1600000000, 4),
+	}
+
+	testCases := []struct {
+		name     string
+		crtime   time.Time
+		wantMask uint32
+	}{
+		{"with crtime", attrs.Crtime, fusekernel.StatxBasicStats | fusekernel.StatxBtime},
+		{"without crtime", time.Time{}, fusekernel.StatxBasicStats},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := buffer.GetOutMessage()
+			defer buffer.PutOutMessage(m)
+
+			op := &fuseops.GetInodeAttributesOp{Inode: 7, Statx: true, Attributes: attrs}
+			op.Attributes.Crtime = tc.crtime
+			c.kernelResponse(m, 17, op, nil)
+
+			body := bytes.Join(m.Sglist, nil)[buffer.OutMessageHeaderSize:]
+			if len(body) != int(unsafe.Sizeof(fusekernel.StatxOut{})) {
+				t.Fatalf("got %d bytes, want %d", len(body), unsafe.Sizeof(fusekernel.StatxOut{}))
+			}
+
+			sx := (*fusekernel.StatxOut)(unsafe.Pointer(&body[0])).Stat
+			if sx.Mask != tc.wantMask {
+				t.Errorf("Mask: got %#x, want %#x", sx.Mask, tc.wantMask)
+			}
+
+			if sx.Ino != 7 || sx.Size != 17 || sx.Nlink != 1 || sx.Uid != 23 {
+				t.Errorf("got %+v", sx)
+			}
+
+			if sx.Mode != syscall.S_IFBLK|0644 {
+				t.Errorf("Mode: got %#o", sx.Mode)
+			}
+
+			// 0x12345 is major 0x123 and minor 0x45 in new_encode_dev format.
+			if sx.RdevMajor != 0x123 || sx.RdevMinor != 0x45 {
+				t.Errorf("Rdev: got %#x:%#x", sx.RdevMajor, sx.RdevMinor)
+			}
+
+			if sx.Mtime.Sec != 1700000001 || sx.Mtime.Nsec != 2 {
+				t.Errorf("Mtime: got %+v", sx.Mtime)
+			}
+
+			if tc.wantMask&fusekernel.StatxBtime != 0 && (sx.Btime.Sec != 1600000000 || sx.Btime.Nsec != 4) {
+				t.Errorf("Btime: got %+v", sx.Btime)
+			}
+		})
+	}
+}
+
+func TestKernelResponse_Blocks(t *testing.T) {
+	c := &Connection{protocol: fusekernel.Protocol{Major: 7, Minor: 36}}
+	none := uint64(0)
+
+	testCases := []struct {
+		name       string
+		attrs      fuseops.InodeAttributes
+		wantBlocks uint64
+		wantBlksz  uint32
+	}{
+		{"estimated", fuseops.InodeAttributes{Size: 1000}, 2, 0},
+		{"sparse", fuseops.InodeAttributes{Size: 1 << 30, Blocks: &none, BlockSize: 65536}, 0, 65536},
+	}
+
+	for _, tc := range testCases {
+		m := buffer.GetOutMessage()
+		op := &fuseops.GetInodeAttributesOp{Attributes: tc.attrs}
+		c.kernelResponse(m, 17, op, nil)
+
+		body := bytes.Join(m.Sglist, nil)[buffer.OutMessageHeaderSize:]
+		out := (*fusekernel.AttrOut)(unsafe.Pointer(&body[0]))
+		if out.Attr.Blocks != tc.wantBlocks || out.Attr.Blksize != tc.wantBlksz {
+			t.Errorf("%s: got %d blocks of %d, want %d of %d", tc.name, out.Attr.Blocks, out.Attr.Blksize, tc.wantBlocks, tc.wantBlksz)
+		}
+
+		buffer.PutOutMessage(m)
+	}
+}
+
+func TestConvertInMessage_Fdatasync(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 36}
+
+	for _, flags := range []uint32{0, fusekernel.FsyncFdatasync} {
+		in := fusekernel.FsyncIn{Fh: 23, FsyncFlags: flags}
+		inMsg := makeInMessage(t, fusekernel.OpFsync, wire(t, in))
+		outMsg := buffer.GetOutMessage()
+		defer buffer.PutOutMessage(outMsg)
+
+		op, err := convertInMessage(&MountConfig{}, inMsg, outMsg, protocol, 0)
+		if err != nil {
+			t.Fatalf("convertInMessage: %v", err)
+		}
+
+		got, ok := op.(*fuseops.SyncFileOp)
+		if !ok {
+			t.Fatalf("got %T, want *fuseops.SyncFileOp", op)
+		}
+
+		if want := flags != 0; got.Handle != 23 || got.Datasync != want {
+			t.Errorf("flags %#x: got Handle %d, Datasync %v", flags, got.Handle, got.Datasync)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// The environment variable through which Daemonize tells the child which file
+// descriptor to report the outcome of mounting on.
+const daemonOutcomeEnv = "JACOBSA_FUSE_DAEMON_FD"
+
+var (
+	daemonMu sync.Mutex
+
+	// The pipe to the parent waiting in Daemonize, in the child only. Nil once
+	// the outcome has been reported.
+	//
+	// GUARDED_BY(daemonMu)
+	daemonOutcome *os.File
+)
+
+// Daemonize moves the process into the background in the way that libfuse
+// daemons do, such that the foreground process doesn't exit until the file
+// system has been mounted, and its exit status says whether that succeeded.
+// Init systems and scripts can then rely on the mount being live once the
+// command returns.
+//
+// Go programs can't fork, so Daemonize instead starts a copy of the current
+// executable with the same arguments and environment, in a new session and
+// with its standard input and output streams connected to /dev/null. The
+// copy, on calling Daemonize in turn, sees that it is the child and returns
+// nil at once; it must go on to mount the file system and then call
+// SignalMountOutcome.
+//
+// In the parent Daemonize doesn't return unless the child can't be started.
+// Instead it waits for the child's outcome and exits the process: with status
+// 0 if the mount succeeded, and otherwise with status 1 after writing the
+// child's error to stderr.
+func Daemonize() error {
+	if fd := os.Getenv(daemonOutcomeEnv); fd != "" {
+		return becomeDaemon(fd)
+	}
+
+	path, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("Executable: %v", err)
+	}
+
+	started, err := runDaemon(path, os.Args[1:], os.Environ())
+	if !started {
+		return err
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+	return nil
+}
+
+// SignalMountOutcome reports the result of mounting the file system, nil for
+// success, to the parent waiting in Daemonize. It does nothing if the process
+// wasn't started by Daemonize, so that daemons can call it unconditionally
+// whether or not they were asked to run in the foreground, and only the first
+// call has any effect.
+func SignalMountOutcome(mountErr error) error {
+	daemonMu.Lock()
+	f := daemonOutcome
+	daemonOutcome = nil
+	daemonMu.Unlock()
+
+	if f == nil {
+		return nil
+	}
+
+	defer f.Close()
+
+	msg := "ok\n"
+	if mountErr != nil {
+		msg = fmt.Sprintf("error %s\n", strconv.Quote(mountErr.Error()))
+	}
+
+	if _, err := io.WriteString(f, msg); err != nil {
+		return fmt.Errorf("WriteString: %v", err)
+	}
+
+	return nil
+}
+
+// Pick up the pipe to the parent. Clear the environment variable so that it
+// isn't inherited by any processes that the daemon starts.
+func becomeDaemon(fd string) error {
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return fmt.Errorf("Bad %s %q: %v", daemonOutcomeEnv, fd, err)
+	}
+
+	os.Unsetenv(daemonOutcomeEnv)
+
+	daemonMu.Lock()
+	daemonOutcome = os.NewFile(uintptr(n), "daemon outcome")
+	daemonMu.Unlock()
+
+	return nil
+}
+
+// Start the executable at path as a daemon, and wait for it to report the
+// outcome of mounting. Report whether the daemon was started at all, and
+// return the outcome.
+func runDaemon(path string, args []string, env []string) (started bool, err error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return false, fmt.Errorf("Pipe: %v", err)
+	}
+
+	defer r.Close()
+
+	// The write end is the child's first extra file, fd 3. Leaving the standard
+	// streams nil connects them to /dev/null.
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(env[:len(env):len(env)], daemonOutcomeEnv+"=3")
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	err = cmd.Start()
+
+	// Close our copy of the write end, so that we see EOF if the child exits
+	// without reporting.
+	w.Close()
+	if err != nil {
+		return false, fmt.Errorf("Start: %v", err)
+	}
+
+	// Leave the child to run on its own.
+	defer cmd.Process.Release()
+
+	return true, readDaemonOutcome(r)
+}
+
+func readDaemonOutcome(r io.Reader) error {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if errors.Is(err, io.EOF) {
+		return errors.New("Daemon exited before mounting the file system")
+	}
+
+	if err != nil {
+		return fmt.Errorf("ReadString: %v", err)
+	}
+
+	line = strings.TrimSuffix(line, "\n")
+	if line == "ok" {
+		return nil
+	}
+
+	if quoted, ok := strings.CutPrefix(line, "error "); ok {
+		if msg, err := strconv.Unquote(quoted); err == nil {
+			return errors.New(msg)
+		}
+	}
+
+	return fmt.Errorf("Unexpected outcome from daemon: %q", line)
+}
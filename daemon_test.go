@@ -0,0 +1,84 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Run as the daemon by TestDaemonize, in a copy of the test binary. The
+// environment variable says what to report.
+func TestDaemonizeHelper(t *testing.T) {
+	outcome := os.Getenv("FUSE_TEST_DAEMON_OUTCOME")
+	if outcome == "" {
+		t.Skip("Not started by TestDaemonize")
+	}
+
+	if err := Daemonize(); err != nil {
+		os.Exit(2)
+	}
+
+	switch outcome {
+	case "ok":
+		SignalMountOutcome(nil)
+	case "error":
+		SignalMountOutcome(errors.New("mount: taco"))
+	}
+
+	os.Exit(0)
+}
+
+func TestDaemonize(t *testing.T) {
+	path, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Executable: %v", err)
+	}
+
+	testCases := []struct {
+		outcome string
+		wantErr string
+	}{
+		{"ok", ""},
+		{"error", "mount: taco"},
+		{"exit", "exited before mounting"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.outcome, func(t *testing.T) {
+			env := append(os.Environ(), "FUSE_TEST_DAEMON_OUTCOME="+tc.outcome)
+			started, err := runDaemon(path, []string{"-test.run=^TestDaemonizeHelper$"}, env)
+			if !started {
+				t.Fatalf("runDaemon: %v", err)
+			}
+
+			if tc.wantErr == "" && err != nil {
+				t.Errorf("runDaemon: %v", err)
+			}
+
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Errorf("runDaemon: got %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignalMountOutcome_NotDaemon(t *testing.T) {
+	if err := SignalMountOutcome(nil); err != nil {
+		t.Errorf("SignalMountOutcome: %v", err)
+	}
+}
@@ -15,15 +15,20 @@
 package fuse
 
 import (
+	"encoding/hex"
 	"fmt"
 	"reflect"
 	"strings"
+	"syscall"
 
 	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
 )
 
-// Decide on the name of the given op.
-func opName(op interface{}) string {
+// OpName returns a short name for the given op, such as "LookUpInode" for a
+// *fuseops.LookUpInodeOp, suitable for use in logs and metrics.
+func OpName(op interface{}) string {
 	// We expect all ops to be pointers.
 	t := reflect.TypeOf(op).Elem()
 
@@ -31,102 +36,29 @@ func opName(op interface{}) string {
 	return strings.TrimSuffix(t.Name(), "Op")
 }
 
-func describeRequest(op interface{}) (s string) {
-	v := reflect.ValueOf(op).Elem()
-
-	// We will set up a comma-separated list of components.
-	var components []string
-	addComponent := func(format string, v ...interface{}) {
-		components = append(components, fmt.Sprintf(format, v...))
-	}
-
-	// Include an inode number, if available.
-	if f := v.FieldByName("Inode"); f.IsValid() {
-		addComponent("inode %v", f.Interface())
-	}
-
-	// Include a parent inode number, if available.
-	if f := v.FieldByName("Parent"); f.IsValid() {
-		addComponent("parent %v", f.Interface())
-	}
-
-	// Include a name, if available.
-	if f := v.FieldByName("Name"); f.IsValid() {
-		addComponent("name %q", f.Interface())
-	}
-
-	if f := v.FieldByName("OpContext"); f.IsValid() {
-		if meta, ok := f.Interface().(fuseops.OpContext); ok {
-			addComponent("PID %+v", meta.Pid)
-		}
-	}
-
-	// Handle special cases.
+// Describe an op in full, for the debug log.
+func describeRequest(op interface{}) string {
 	switch typed := op.(type) {
 	case *interruptOp:
-		addComponent("fuseid 0x%08x", typed.FuseID)
+		return fmt.Sprintf("%s (fuseid 0x%08x)", OpName(op), typed.FuseID)
 
 	case *unknownOp:
-		addComponent("opcode %d", typed.OpCode)
-
-	case *fuseops.SetInodeAttributesOp:
-		if typed.Size != nil {
-			addComponent("size %d", *typed.Size)
-		}
-
-		if typed.Mode != nil {
-			addComponent("mode %v", *typed.Mode)
-		}
-
-		if typed.Atime != nil {
-			addComponent("atime %v", *typed.Atime)
-		}
-
-		if typed.Mtime != nil {
-			addComponent("mtime %v", *typed.Mtime)
-		}
-
-	case *fuseops.RenameOp:
-		addComponent("old_parent %v", typed.OldParent)
-		addComponent("old_name %q", typed.OldName)
-		addComponent("new_parent %v", typed.NewParent)
-		addComponent("new_name %q", typed.NewName)
-
-	case *fuseops.ReadFileOp:
-		addComponent("handle %d", typed.Handle)
-		addComponent("offset %d", typed.Offset)
-		addComponent("%d bytes", typed.Size)
-
-	case *fuseops.WriteFileOp:
-		addComponent("handle %d", typed.Handle)
-		addComponent("offset %d", typed.Offset)
-		addComponent("%d bytes", len(typed.Data))
+		return fmt.Sprintf("%s (inode %d, opcode %d)", OpName(op), typed.Inode, typed.OpCode)
 
-	case *fuseops.RemoveXattrOp:
-		addComponent("name %s", typed.Name)
-
-	case *fuseops.GetXattrOp:
-		addComponent("name %s", typed.Name)
-
-	case *fuseops.SetXattrOp:
-		addComponent("name %s", typed.Name)
-
-	case *fuseops.FallocateOp:
-		addComponent("offset %d", typed.Offset)
-		addComponent("length %d", typed.Length)
-		addComponent("mode %d", typed.Mode)
-
-	case *fuseops.ReleaseFileHandleOp:
-		addComponent("handle %d", typed.Handle)
+	case interface{ DebugString() string }:
+		return typed.DebugString()
 	}
 
-	// Use just the name if there is no extra info.
-	if len(components) == 0 {
-		return opName(op)
+	return OpName(op)
+}
+
+// Describe an op concisely, for error messages.
+func describeOp(op interface{}) string {
+	if s, ok := op.(fmt.Stringer); ok {
+		return s.String()
 	}
 
-	// Otherwise, include the extra info.
-	return fmt.Sprintf("%s (%s)", opName(op), strings.Join(components, ", "))
+	return OpName(op)
 }
 
 func describeResponse(op interface{}) string {
@@ -149,5 +81,96 @@ func describeResponse(op interface{}) string {
 		addComponent("handle %d", typed.Handle)
 	}
 
-	return fmt.Sprintf("%s (%s)", opName(op), strings.Join(components, ", "))
+	return fmt.Sprintf("%s (%s)", OpName(op), strings.Join(components, ", "))
+}
+
+// The maximum number of bytes of a message body included in a hex dump.
+const maxHexdump = 512
+
+// Write a hex dump of up to maxHexdump bytes of the concatenation of the
+// supplied segments.
+func writeHexdump(b *strings.Builder, segments ...[]byte) {
+	var data []byte
+	total := 0
+	for _, s := range segments {
+		total += len(s)
+		if room := maxHexdump - len(data); room > 0 {
+			if len(s) > room {
+				s = s[:room]
+			}
+			data = append(data, s...)
+		}
+	}
+
+	if total == 0 {
+		return
+	}
+
+	b.WriteString("\n")
+	b.WriteString(strings.TrimSuffix(hex.Dump(data), "\n"))
+	if total > len(data) {
+		fmt.Fprintf(b, "\n   ... %d more bytes", total-len(data))
+	}
+}
+
+// Log a request read from the kernel, if the config asks for it.
+func (c *Connection) traceRequest(inMsg *buffer.InMessage, op interface{}) {
+	if !c.cfg.DebugProtocol || c.debugLogger == nil {
+		return
+	}
+
+	h := inMsg.Header()
+
+	var b strings.Builder
+	fmt.Fprintf(
+		&b,
+		"unique: %d, opcode: %s (%d), nodeid: %d, insize: %d, pid: %d, uid: %d, gid: %d\n",
+		h.Unique,
+		fusekernel.OpcodeName(h.Opcode),
+		h.Opcode,
+		h.Nodeid,
+		h.Len,
+		h.Pid,
+		h.Uid,
+		h.Gid)
+	fmt.Fprintf(&b, "   %s", describeRequest(op))
+
+	if c.cfg.DebugHexdump {
+		writeHexdump(&b, inMsg.Bytes()[fusekernel.InHeaderSize:])
+	}
+
+	c.debugLogger.Print(b.String())
+}
+
+// Log a reply about to be sent to the kernel, if the config asks for it.
+func (c *Connection) traceReply(outMsg *buffer.OutMessage, op interface{}) {
+	if !c.cfg.DebugProtocol || c.debugLogger == nil {
+		return
+	}
+
+	h := outMsg.OutHeader()
+
+	var b strings.Builder
+	if h.Error == 0 {
+		fmt.Fprintf(
+			&b,
+			"   unique: %d, success, outsize: %d\n   %s",
+			h.Unique,
+			h.Len,
+			describeResponse(op))
+	} else {
+		fmt.Fprintf(
+			&b,
+			"   unique: %d, error: %d (%v), outsize: %d",
+			h.Unique,
+			h.Error,
+			syscall.Errno(-h.Error),
+			h.Len)
+	}
+
+	if c.cfg.DebugHexdump && len(outMsg.Sglist) > 1 {
+		writeHexdump(&b, outMsg.Sglist[1:]...)
+	}
+
+	c.debugLogger.Print(b.String())
 }
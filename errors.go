@@ -14,12 +14,20 @@
 
 package fuse
 
-import "syscall"
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+)
 
 const (
 	// Errors corresponding to kernel error numbers. These may be treated
-	// specially by Connection.Reply.
+	// specially by Connection.Reply. Use errors.Is to test for them, so as to
+	// match an Error that carries one too.
 	EEXIST    = syscall.EEXIST
+	EINTR     = syscall.EINTR
 	EINVAL    = syscall.EINVAL
 	EIO       = syscall.EIO
 	ENOATTR   = syscall.ENODATA
@@ -27,4 +35,131 @@ const (
 	ENOSYS    = syscall.ENOSYS
 	ENOTDIR   = syscall.ENOTDIR
 	ENOTEMPTY = syscall.ENOTEMPTY
+	ERANGE    = syscall.ERANGE
+)
+
+var (
+	// ErrUnmounted is returned by Connection.Err once the kernel has hung up
+	// because the file system was unmounted. A forced unmount (umount -f) looks
+	// no different to us, so is reported this way too.
+	ErrUnmounted = errors.New("file system unmounted")
+
+	// ErrConnectionAborted is returned by Connection.Err, and in the chain of
+	// the error returned by MountedFileSystem.Join, once the kernel has hung up
+	// because the connection was aborted while still mounted, as writing to
+	// /sys/fs/fuse/connections/N/abort does. The mount point is then left
+	// failing with ENOTCONN until it is unmounted. Linux only, on kernels that
+	// support FUSE_ABORT_ERROR.
+	ErrConnectionAborted = errors.New("connection aborted by the kernel")
 )
+
+// Error is an error that reaches the kernel as the errno Errno, and that
+// carries the error that caused it, if any, so that it can be logged. Both are
+// in its chain, so that for example errors.Is(err, fuse.ENOENT) reports
+// whether it reaches the kernel as ENOENT, and errors.As finds the cause.
+//
+// Ops may fail with any error; see ErrnoOf for how it reaches the kernel.
+type Error struct {
+	Errno syscall.Errno
+	Err   error
+}
+
+// NewError returns an Error that reaches the kernel as errno, caused by err,
+// which may be nil.
+func NewError(errno syscall.Errno, err error) error {
+	return &Error{Errno: errno, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Errno.Error()
+	}
+
+	return e.Errno.Error() + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Errno}
+	}
+
+	return []error{e.Errno, e.Err}
+}
+
+// ErrnoOf returns the errno with which an op that failed with the supplied
+// error is replied to: the first syscall.Errno in its chain, as found by
+// errors.As, such as that of an Error, or EIO if there is none. It returns
+// zero for nil. File systems that pass on errors from elsewhere may find
+// ErrnoFromError more useful.
+func ErrnoOf(err error) syscall.Errno {
+	if err == nil {
+		return 0
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+
+	return syscall.EIO
+}
+
+// ErrnoFromError returns the errno that best describes the supplied error, for
+// file systems that pass on errors from their backends. It returns:
+//
+//   - zero for nil;
+//   - the first syscall.Errno in its chain, as found by errors.As, such as that
+//     of an Error or of the *os.PathError from a call to the os package;
+//   - ENOENT, EEXIST, EACCES, EINVAL or EBADF for an error that matches
+//     fs.ErrNotExist, fs.ErrExist, fs.ErrPermission, fs.ErrInvalid or
+//     fs.ErrClosed according to errors.Is;
+//   - ENOTSUP for errors.ErrUnsupported;
+//   - ETIMEDOUT for context.DeadlineExceeded, os.ErrDeadlineExceeded, or any
+//     error in its chain with a Timeout method that returns true, as for a
+//     net.Error;
+//   - EINTR for context.Canceled, as when the kernel interrupts an op; and
+//   - EIO for anything else, including io.EOF and io.ErrUnexpectedEOF from a
+//     backend that came to an end too soon.
+//
+// Return NewError(ErrnoFromError(err), err) to keep err for logging too.
+func ErrnoFromError(err error) syscall.Errno {
+	if err == nil {
+		return 0
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+
+	var timeout interface{ Timeout() bool }
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return syscall.ENOENT
+
+	case errors.Is(err, fs.ErrExist):
+		return syscall.EEXIST
+
+	case errors.Is(err, fs.ErrPermission):
+		return syscall.EACCES
+
+	case errors.Is(err, fs.ErrInvalid):
+		return syscall.EINVAL
+
+	case errors.Is(err, fs.ErrClosed):
+		return syscall.EBADF
+
+	case errors.Is(err, errors.ErrUnsupported):
+		return syscall.ENOTSUP
+
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &timeout) && timeout.Timeout():
+		return syscall.ETIMEDOUT
+
+	case errors.Is(err, context.Canceled):
+		return syscall.EINTR
+	}
+
+	return syscall.EIO
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestError(t *testing.T) {
+	cause := &os.PathError{Op: "open", Path: "/foo", Err: syscall.EACCES}
+	err := fmt.Errorf("looking up: %w", NewError(syscall.ENOENT, cause))
+
+	if !errors.Is(err, ENOENT) {
+		t.Errorf("errors.Is(%v, ENOENT) = false", err)
+	}
+
+	var pe *os.PathError
+	if !errors.As(err, &pe) || pe != cause {
+		t.Errorf("errors.As(%v) didn't find the cause", err)
+	}
+
+	// The errno takes precedence over any in the cause.
+	if got := ErrnoOf(err); got != syscall.ENOENT {
+		t.Errorf("ErrnoOf(%v) = %v, want ENOENT", err, got)
+	}
+
+	if got, want := NewError(syscall.EIO, errors.New("taco")).Error(), "input/output error: taco"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+func TestErrnoOf(t *testing.T) {
+	testCases := []struct {
+		err  error
+		want syscall.Errno
+	}{
+		{nil, 0},
+		{ENOTDIR, syscall.ENOTDIR},
+		{NewError(syscall.EROFS, nil), syscall.EROFS},
+		{&os.PathError{Op: "open", Path: "/foo", Err: syscall.EACCES}, syscall.EACCES},
+		{errors.New("taco"), syscall.EIO},
+	}
+
+	for _, tc := range testCases {
+		if got := ErrnoOf(tc.err); got != tc.want {
+			t.Errorf("ErrnoOf(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+// An error like those from the net package.
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "timed out" }
+func (timeoutError) Timeout() bool { return true }
+
+func TestErrnoFromError(t *testing.T) {
+	testCases := []struct {
+		err  error
+		want syscall.Errno
+	}{
+		{nil, 0},
+		{&os.PathError{Op: "open", Path: "/foo", Err: syscall.ELOOP}, syscall.ELOOP},
+		{NewError(syscall.EROFS, os.ErrNotExist), syscall.EROFS},
+		{fmt.Errorf("fetching: %w", os.ErrNotExist), syscall.ENOENT},
+		{os.ErrExist, syscall.EEXIST},
+		{os.ErrPermission, syscall.EACCES},
+		{os.ErrInvalid, syscall.EINVAL},
+		{os.ErrClosed, syscall.EBADF},
+		{errors.ErrUnsupported, syscall.ENOTSUP},
+		{context.DeadlineExceeded, syscall.ETIMEDOUT},
+		{os.ErrDeadlineExceeded, syscall.ETIMEDOUT},
+		{fmt.Errorf("dialing: %w", timeoutError{}), syscall.ETIMEDOUT},
+		{context.Canceled, syscall.EINTR},
+		{io.EOF, syscall.EIO},
+		{io.ErrUnexpectedEOF, syscall.EIO},
+		{errors.New("taco"), syscall.EIO},
+	}
+
+	for _, tc := range testCases {
+		if got := ErrnoFromError(tc.err); got != tc.want {
+			t.Errorf("ErrnoFromError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fsbench_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// Benchmarks of the library itself, which send ops to memfs over a
+// fusetesting.Conn rather than through the kernel, so they need no mount and
+// aren't affected by kernel caching.
+func BenchmarkConn(b *testing.B) {
+	ctx := context.Background()
+	c, err := fusetesting.NewConn(memfs.NewMemFS(0, 0), nil)
+	if err != nil {
+		b.Fatalf("NewConn: %v", err)
+	}
+
+	defer c.Close()
+
+	do := func(b *testing.B, op interface{}) {
+		if err := c.Do(ctx, op); err != nil {
+			b.Fatalf("Do(%T): %v", op, err)
+		}
+	}
+
+	// A directory of files, and a file of 64 MiB open for reading and writing.
+	mkDir := &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "dir", Mode: 0700 | os.ModeDir}
+	do(b, mkDir)
+
+	const entries = 1000
+	for i := 0; i < entries; i++ {
+		create := &fuseops.CreateFileOp{
+			Parent:    mkDir.Entry.Child,
+			Name:      fmt.Sprintf("%d", i),
+			Mode:      0600,
+			OpenFlags: syscall.O_RDWR,
+		}
+		do(b, create)
+		do(b, &fuseops.ReleaseFileHandleOp{Handle: create.Handle})
+	}
+
+	const fileSize = 64 << 20
+	create := &fuseops.CreateFileOp{
+		Parent:    fuseops.RootInodeID,
+		Name:      "data",
+		Mode:      0600,
+		OpenFlags: syscall.O_RDWR,
+	}
+	do(b, create)
+
+	chunk := make([]byte, 1<<20)
+	for off := int64(0); off < fileSize; off += int64(len(chunk)) {
+		do(b, &fuseops.WriteFileOp{
+			Inode:  create.Entry.Child,
+			Handle: create.Handle,
+			Offset: off,
+			Data:   chunk,
+		})
+	}
+
+	b.Run("GetInodeAttributes", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			do(b, &fuseops.GetInodeAttributesOp{Inode: create.Entry.Child})
+		}
+	})
+
+	b.Run("LookUpInode", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			do(b, &fuseops.LookUpInodeOp{
+				Parent: mkDir.Entry.Child,
+				Name:   fmt.Sprintf("%d", i%entries),
+			})
+		}
+	})
+
+	b.Run("ReadDir", func(b *testing.B) {
+		open := &fuseops.OpenDirOp{Inode: mkDir.Entry.Child}
+		do(b, open)
+
+		dst := make([]byte, 128<<10)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			// List the whole directory.
+			offset := fuseops.DirOffset(0)
+			for {
+				op := &fuseops.ReadDirOp{
+					Inode:  mkDir.Entry.Child,
+					Handle: open.Handle,
+					Offset: offset,
+					Dst:    dst,
+				}
+				do(b, op)
+
+				if op.BytesRead == 0 {
+					break
+				}
+
+				offset = lastOffset(dst[:op.BytesRead])
+			}
+		}
+	})
+
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{"4k", 4 << 10},
+		{"1m", 1 << 20},
+	}
+
+	for _, s := range sizes {
+		size := s.size
+		b.Run("ReadFile-"+s.name, func(b *testing.B) {
+			b.SetBytes(int64(size))
+			dst := make([]byte, size)
+			for i := 0; i < b.N; i++ {
+				do(b, &fuseops.ReadFileOp{
+					Inode:  create.Entry.Child,
+					Handle: create.Handle,
+					Offset: int64(i*size) % fileSize,
+					Dst:    dst,
+				})
+			}
+		})
+
+		b.Run("WriteFile-"+s.name, func(b *testing.B) {
+			b.SetBytes(int64(size))
+			data := chunk[:size]
+			for i := 0; i < b.N; i++ {
+				do(b, &fuseops.WriteFileOp{
+					Inode:  create.Entry.Child,
+					Handle: create.Handle,
+					Offset: int64(i*size) % fileSize,
+					Data:   data,
+				})
+			}
+		})
+	}
+}
+
+// Return the offset of the entry following the last in a buffer of directory
+// entries, as laid out by fuseutil.WriteDirent.
+func lastOffset(b []byte) fuseops.DirOffset {
+	var off fuseops.DirOffset
+	for len(b) >= 24 {
+		off = fuseops.DirOffset(binary.LittleEndian.Uint64(b[8:]))
+		n := int(binary.LittleEndian.Uint32(b[16:]))
+		size := (24 + n + 7) &^ 7
+		if size > len(b) {
+			break
+		}
+
+		b = b[size:]
+	}
+
+	return off
+}
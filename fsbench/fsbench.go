@@ -0,0 +1,408 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fsbench measures the latency and throughput of common file system
+// operations against a directory, which is normally the mount point of a
+// fuse.Server. Run the benchmarks with the fsbench command, or from Go
+// benchmarks with SetUp.
+//
+// Each benchmark times one kind of operation, repeated:
+//
+//	stat          lstat(2) of files in a directory, round robin
+//	readdir       listing a directory of Config.Entries entries
+//	seqread-4k    sequential reads of a file, 4 KiB at a time
+//	seqread-1m    the same, 1 MiB at a time
+//	randread-4k   reads at random aligned offsets, 4 KiB at a time
+//	randread-1m   the same, 1 MiB at a time
+//	seqwrite-4k   sequential writes to a file, 4 KiB at a time
+//	seqwrite-1m   the same, 1 MiB at a time
+//	randwrite-4k  writes at random aligned offsets, 4 KiB at a time
+//	randwrite-1m  the same, 1 MiB at a time
+//
+// The kernel caches file contents and attributes as the file system allows,
+// and the results include the effect of that, as applications see it. To keep
+// the read benchmarks from being served from the page cache entirely, the file
+// is opened again for each pass over it, which drops its cached pages unless
+// the file system asks for them to be kept.
+package fsbench
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// Config sizes the data that the benchmarks work on. Zero fields take the
+// defaults.
+type Config struct {
+	// The number of files statted round robin by the stat benchmark. Default
+	// 1000.
+	Files int
+
+	// The number of entries in the directory listed by the readdir benchmark.
+	// Default 100000.
+	Entries int
+
+	// The size of the file read and written by the I/O benchmarks. Default 64
+	// MiB.
+	FileSize int64
+}
+
+func (cfg Config) withDefaults() Config {
+	if cfg.Files == 0 {
+		cfg.Files = 1000
+	}
+
+	if cfg.Entries == 0 {
+		cfg.Entries = 100000
+	}
+
+	if cfg.FileSize == 0 {
+		cfg.FileSize = 64 << 20
+	}
+
+	return cfg
+}
+
+// Op performs the i'th operation of a benchmark, for i counting up from zero,
+// returning the number of bytes read or written.
+type Op func(i int) (bytes int64, err error)
+
+// A Benchmark times one kind of operation. See the package documentation for
+// the list.
+type Benchmark struct {
+	Name string
+
+	// Prepare beneath the supplied directory, which is empty.
+	setUp func(dir string, cfg Config) (op Op, tearDown func() error, err error)
+}
+
+// Benchmarks lists the benchmarks, in the order in which the fsbench command
+// runs them.
+var Benchmarks = []*Benchmark{
+	{Name: "stat", setUp: setUpStat},
+	{Name: "readdir", setUp: setUpReadDir},
+	{Name: "seqread-4k", setUp: readSetUp(4<<10, false)},
+	{Name: "seqread-1m", setUp: readSetUp(1<<20, false)},
+	{Name: "randread-4k", setUp: readSetUp(4<<10, true)},
+	{Name: "randread-1m", setUp: readSetUp(1<<20, true)},
+	{Name: "seqwrite-4k", setUp: writeSetUp(4<<10, false)},
+	{Name: "seqwrite-1m", setUp: writeSetUp(1<<20, false)},
+	{Name: "randwrite-4k", setUp: writeSetUp(4<<10, true)},
+	{Name: "randwrite-1m", setUp: writeSetUp(1<<20, true)},
+}
+
+// Lookup returns the benchmark with the given name, or nil if there is none.
+func Lookup(name string) *Benchmark {
+	for _, b := range Benchmarks {
+		if b.Name == name {
+			return b
+		}
+	}
+
+	return nil
+}
+
+// SetUp creates a directory for the benchmark beneath dir and the files it
+// works on, returning the operation to time and a function that removes them
+// again.
+func (b *Benchmark) SetUp(dir string, cfg Config) (op Op, tearDown func() error, err error) {
+	benchDir := path.Join(dir, "fsbench-"+b.Name)
+	if err := os.Mkdir(benchDir, 0700); err != nil {
+		return nil, nil, fmt.Errorf("Mkdir: %v", err)
+	}
+
+	op, closeFiles, err := b.setUp(benchDir, cfg.withDefaults())
+	if err != nil {
+		os.RemoveAll(benchDir)
+		return nil, nil, err
+	}
+
+	tearDown = func() error {
+		err := closeFiles()
+		if removeErr := os.RemoveAll(benchDir); err == nil {
+			err = removeErr
+		}
+
+		return err
+	}
+
+	return op, tearDown, nil
+}
+
+// Result summarizes a run of a benchmark.
+type Result struct {
+	Name    string
+	Ops     int
+	Bytes   int64
+	Elapsed time.Duration
+
+	// Percentiles of the latency of the operations.
+	P50, P90, P99, Max time.Duration
+}
+
+func (r Result) String() string {
+	s := fmt.Sprintf(
+		"%-13s %8d ops %10.0f ops/s",
+		r.Name,
+		r.Ops,
+		float64(r.Ops)/r.Elapsed.Seconds())
+
+	if r.Bytes != 0 {
+		s += fmt.Sprintf(" %9.1f MB/s", float64(r.Bytes)/r.Elapsed.Seconds()/1e6)
+	} else {
+		s += fmt.Sprintf(" %14s", "")
+	}
+
+	s += fmt.Sprintf(
+		"   p50 %-9v p90 %-9v p99 %-9v max %v",
+		r.P50.Round(time.Microsecond),
+		r.P90.Round(time.Microsecond),
+		r.P99.Round(time.Microsecond),
+		r.Max.Round(time.Microsecond))
+
+	return s
+}
+
+// Run sets up the benchmark beneath dir, times n operations and tears it
+// down again.
+func Run(b *Benchmark, dir string, cfg Config, n int) (Result, error) {
+	op, tearDown, err := b.SetUp(dir, cfg)
+	if err != nil {
+		return Result{}, fmt.Errorf("%s: %v", b.Name, err)
+	}
+
+	r, err := measure(b.Name, op, n)
+	if tdErr := tearDown(); err == nil && tdErr != nil {
+		err = tdErr
+	}
+
+	if err != nil {
+		return Result{}, fmt.Errorf("%s: %v", b.Name, err)
+	}
+
+	return r, nil
+}
+
+// Time n calls to op.
+func measure(name string, op Op, n int) (Result, error) {
+	r := Result{Name: name, Ops: n}
+	latencies := make([]time.Duration, n)
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		opStart := time.Now()
+		bytes, err := op(i)
+		latencies[i] = time.Since(opStart)
+		if err != nil {
+			return Result{}, err
+		}
+
+		r.Bytes += bytes
+	}
+
+	r.Elapsed = time.Since(start)
+
+	if n > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		percentile := func(p float64) time.Duration {
+			return latencies[int(p*float64(n-1))]
+		}
+
+		r.P50 = percentile(0.5)
+		r.P90 = percentile(0.9)
+		r.P99 = percentile(0.99)
+		r.Max = latencies[n-1]
+	}
+
+	return r, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Benchmarks
+////////////////////////////////////////////////////////////////////////
+
+func setUpStat(dir string, cfg Config) (Op, func() error, error) {
+	names := make([]string, cfg.Files)
+	for i := range names {
+		names[i] = path.Join(dir, fmt.Sprintf("%d", i))
+		if err := os.WriteFile(names[i], nil, 0600); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	op := func(i int) (int64, error) {
+		_, err := os.Lstat(names[i%len(names)])
+		return 0, err
+	}
+
+	return op, func() error { return nil }, nil
+}
+
+func setUpReadDir(dir string, cfg Config) (Op, func() error, error) {
+	for i := 0; i < cfg.Entries; i++ {
+		if err := os.WriteFile(path.Join(dir, fmt.Sprintf("%d", i)), nil, 0600); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	op := func(i int) (int64, error) {
+		f, err := os.Open(dir)
+		if err != nil {
+			return 0, err
+		}
+
+		defer f.Close()
+
+		names, err := f.Readdirnames(-1)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(names) != cfg.Entries {
+			return 0, fmt.Errorf("Listed %d entries, want %d", len(names), cfg.Entries)
+		}
+
+		return 0, nil
+	}
+
+	return op, func() error { return nil }, nil
+}
+
+// Write a file of the configured size, in 1 MiB chunks.
+func writeFile(name string, size int64) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, 1<<20)
+	for off := int64(0); off < size; off += int64(len(chunk)) {
+		n := int64(len(chunk))
+		if size-off < n {
+			n = size - off
+		}
+
+		if _, err := f.Write(chunk[:n]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+// Return a function giving the offset of the i'th block-sized operation on a
+// file of the given size: in order, wrapping around, or at random.
+func offsets(blockSize int, fileSize int64, random bool) (func(i int) int64, error) {
+	blocks := fileSize / int64(blockSize)
+	if blocks == 0 {
+		return nil, fmt.Errorf("File size %d is less than the block size %d", fileSize, blockSize)
+	}
+
+	if !random {
+		return func(i int) int64 { return int64(i) % blocks * int64(blockSize) }, nil
+	}
+
+	// A fixed seed, so that runs are comparable.
+	rnd := rand.New(rand.NewSource(1))
+	return func(i int) int64 { return rnd.Int63n(blocks) * int64(blockSize) }, nil
+}
+
+func readSetUp(blockSize int, random bool) func(string, Config) (Op, func() error, error) {
+	return func(dir string, cfg Config) (Op, func() error, error) {
+		name := path.Join(dir, "data")
+		if err := writeFile(name, cfg.FileSize); err != nil {
+			return nil, nil, err
+		}
+
+		offset, err := offsets(blockSize, cfg.FileSize, random)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		perPass := int(cfg.FileSize / int64(blockSize))
+		buf := make([]byte, blockSize)
+
+		var f *os.File
+		op := func(i int) (int64, error) {
+			// Open the file again for each pass over it.
+			if i%perPass == 0 {
+				if f != nil {
+					f.Close()
+				}
+
+				var err error
+				if f, err = os.Open(name); err != nil {
+					return 0, err
+				}
+			}
+
+			n, err := f.ReadAt(buf, offset(i))
+			if err == io.EOF {
+				err = nil
+			}
+
+			return int64(n), err
+		}
+
+		tearDown := func() error {
+			if f != nil {
+				return f.Close()
+			}
+
+			return nil
+		}
+
+		return op, tearDown, nil
+	}
+}
+
+func writeSetUp(blockSize int, random bool) func(string, Config) (Op, func() error, error) {
+	return func(dir string, cfg Config) (Op, func() error, error) {
+		name := path.Join(dir, "data")
+		if random {
+			// Random writes overwrite an existing file, as databases do.
+			if err := writeFile(name, cfg.FileSize); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		offset, err := offsets(blockSize, cfg.FileSize, random)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		buf := make([]byte, blockSize)
+		for i := range buf {
+			buf[i] = byte(i)
+		}
+
+		op := func(i int) (int64, error) {
+			n, err := f.WriteAt(buf, offset(i))
+			return int64(n), err
+		}
+
+		return op, f.Close, nil
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fsbench_test
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fsbench"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// Small enough to run against a local directory in a moment.
+var smallConfig = fsbench.Config{
+	Files:    10,
+	Entries:  100,
+	FileSize: 4 << 20,
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	for _, b := range fsbench.Benchmarks {
+		r, err := fsbench.Run(b, dir, smallConfig, 20)
+		if err != nil {
+			t.Errorf("Run(%s): %v", b.Name, err)
+			continue
+		}
+
+		if r.Ops != 20 || r.P50 > r.P90 || r.P90 > r.P99 || r.P99 > r.Max {
+			t.Errorf("Run(%s): %+v", b.Name, r)
+		}
+
+		isIO := strings.Contains(b.Name, "read-") || strings.Contains(b.Name, "write-")
+		if isIO != (r.Bytes > 0) {
+			t.Errorf("Run(%s): %d bytes", b.Name, r.Bytes)
+		}
+	}
+
+	// Everything is cleaned up.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("Left behind: %v", entries)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	if b := fsbench.Lookup("randread-4k"); b == nil || b.Name != "randread-4k" {
+		t.Errorf("Lookup: %v", b)
+	}
+
+	if b := fsbench.Lookup("taco"); b != nil {
+		t.Errorf("Lookup: %v", b)
+	}
+}
+
+// Run every benchmark against memfs, mounted at a temporary directory.
+func BenchmarkMemFS(b *testing.B) {
+	dir := b.TempDir()
+	server := memfs.NewMemFS(uint32(os.Getuid()), uint32(os.Getgid()))
+	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{})
+	if err != nil {
+		b.Fatalf("Mount: %v", err)
+	}
+
+	b.Cleanup(func() {
+		if err := fuse.Unmount(dir); err != nil {
+			b.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			b.Errorf("Join: %v", err)
+		}
+	})
+
+	for _, bench := range fsbench.Benchmarks {
+		bench := bench
+		b.Run(bench.Name, func(b *testing.B) {
+			op, tearDown, err := bench.SetUp(dir, fsbench.Config{})
+			if err != nil {
+				b.Fatalf("SetUp: %v", err)
+			}
+
+			defer tearDown()
+
+			var total int64
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				n, err := op(i)
+				if err != nil {
+					b.Fatalf("op: %v", err)
+				}
+
+				total += n
+			}
+
+			b.SetBytes(total / int64(b.N))
+		})
+	}
+}
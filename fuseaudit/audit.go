@@ -0,0 +1,306 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fuseaudit keeps an audit trail of the security-relevant ops served by
+// a file system: opening and creating files, links and directories, unlinking,
+// renaming and exchanging, changing attributes and changing xattrs. Each op is
+// written as an Event, one line of JSON, once the server has replied to it,
+// with the caller's uid, gid and pid and the outcome.
+//
+// Install a Logger with Wrap or fuse.Chain, writing to a RotatingFile for a
+// log that is only ever appended to and that rotates by size:
+//
+//	f, err := fuseaudit.OpenRotatingFile("/var/log/myfs/audit.log", 100<<20, 10)
+//	...
+//	server, audit := fuseaudit.Wrap(server, f)
+//
+// Events identify files by inode and name within the parent directory, as the
+// ops do; the file system's own logs are needed to map inodes to paths.
+package fuseaudit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/sys/unix"
+)
+
+// An Event describes one audited op and its outcome. Fields that don't apply
+// to the op are omitted.
+type Event struct {
+	// When the server replied to the op.
+	Time time.Time `json:"time"`
+
+	// The op, as named by fuse.OpName, such as "Unlink".
+	Op string `json:"op"`
+
+	// The caller.
+	Uid uint32 `json:"uid"`
+	Gid uint32 `json:"gid"`
+	Pid uint32 `json:"pid"`
+
+	// The inode the op was addressed to: the inode of interest, or the parent
+	// directory for ops that act on a name within one.
+	Inode fuseops.InodeID `json:"inode"`
+	Name  string          `json:"name,omitempty"`
+
+	// The destination of a Rename, and the inode that CreateLink links to.
+	NewParent fuseops.InodeID `json:"new_parent,omitempty"`
+	NewName   string          `json:"new_name,omitempty"`
+
+	// The target of a CreateSymlink.
+	Target string `json:"target,omitempty"`
+
+	// The mode of a new inode.
+	Mode os.FileMode `json:"mode,omitempty"`
+
+	// The open flags of OpenFile, CreateFile and CreateTmpFile, or the flags of
+	// Rename and SetXattr.
+	Flags uint32 `json:"flags,omitempty"`
+
+	// The name of the xattr set or removed.
+	Xattr string `json:"xattr,omitempty"`
+
+	// The attributes changed by SetInodeAttributes.
+	Set *Attributes `json:"set,omitempty"`
+
+	// The inode created or linked to, if the op succeeded.
+	Child fuseops.InodeID `json:"child,omitempty"`
+
+	// "ok", or the name of the errno the server replied with, such as
+	// "EACCES", as given by fuse.ErrnoOf.
+	Result string `json:"result"`
+}
+
+// Attributes records the attributes changed by a SetInodeAttributes op.
+type Attributes struct {
+	Size  *uint64      `json:"size,omitempty"`
+	Mode  *os.FileMode `json:"mode,omitempty"`
+	Uid   *uint32      `json:"uid,omitempty"`
+	Gid   *uint32      `json:"gid,omitempty"`
+	Atime *time.Time   `json:"atime,omitempty"`
+	Mtime *time.Time   `json:"mtime,omitempty"`
+}
+
+// Logger is a fuse.Interceptor that writes an Event for each audited op, as a
+// line of JSON, once the server has replied to it. Other ops are passed
+// through unrecorded. Create one with NewLogger.
+type Logger struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	enc *json.Encoder
+
+	// The first error writing an event.
+	//
+	// GUARDED_BY(mu)
+	err error
+}
+
+var _ fuse.Interceptor = &Logger{}
+
+// NewLogger returns a logger that writes to w. Each event is written with a
+// single call to w.Write, so that it is never split across files when w
+// rotates.
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{
+		enc: json.NewEncoder(w),
+	}
+}
+
+// Wrap returns a server that audits the ops served by the supplied one to w,
+// along with the logger.
+func Wrap(server fuse.Server, w io.Writer) (fuse.Server, *Logger) {
+	l := NewLogger(w)
+	return fuse.Chain(server, l), l
+}
+
+// Err returns the first error writing an event, if any. Events that follow it
+// are dropped, so a deployment that must not lose them should check it
+// periodically, and stop serving if it is non-nil.
+//
+// LOCKS_EXCLUDED(l.mu)
+func (l *Logger) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.err
+}
+
+func (l *Logger) InterceptOp(
+	ctx context.Context,
+	op interface{}) (context.Context, error) {
+	return ctx, nil
+}
+
+// LOCKS_EXCLUDED(l.mu)
+func (l *Logger) InterceptReply(
+	ctx context.Context,
+	op interface{},
+	err error) error {
+	e, ok := newEvent(op, err)
+	if !ok {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.err == nil {
+		l.err = l.enc.Encode(e)
+	}
+
+	return err
+}
+
+// Describe an op, if it is one that is audited.
+func newEvent(op interface{}, err error) (*Event, bool) {
+	e := &Event{
+		Time:   time.Now(),
+		Op:     fuse.OpName(op),
+		Result: result(err),
+	}
+
+	var oc fuseops.OpContext
+	switch o := op.(type) {
+	case *fuseops.OpenFileOp:
+		oc = o.OpContext
+		e.Inode = o.Inode
+		e.Flags = uint32(o.OpenFlags)
+
+	case *fuseops.CreateFileOp:
+		oc = o.OpContext
+		e.Inode = o.Parent
+		e.Name = o.Name
+		e.Mode = o.Mode
+		e.Flags = uint32(o.OpenFlags)
+		e.Child = o.Entry.Child
+
+	case *fuseops.CreateTmpFileOp:
+		oc = o.OpContext
+		e.Inode = o.Parent
+		e.Mode = o.Mode
+		e.Flags = uint32(o.OpenFlags)
+		e.Child = o.Entry.Child
+
+	case *fuseops.MkDirOp:
+		oc = o.OpContext
+		e.Inode = o.Parent
+		e.Name = o.Name
+		e.Mode = o.Mode
+		e.Child = o.Entry.Child
+
+	case *fuseops.MkNodeOp:
+		oc = o.OpContext
+		e.Inode = o.Parent
+		e.Name = o.Name
+		e.Mode = o.Mode
+		e.Child = o.Entry.Child
+
+	case *fuseops.CreateSymlinkOp:
+		oc = o.OpContext
+		e.Inode = o.Parent
+		e.Name = o.Name
+		e.Target = o.Target
+		e.Child = o.Entry.Child
+
+	case *fuseops.CreateLinkOp:
+		oc = o.OpContext
+		e.Inode = o.Parent
+		e.Name = o.Name
+		e.NewParent = o.Target
+		e.Child = o.Entry.Child
+
+	case *fuseops.UnlinkOp:
+		oc = o.OpContext
+		e.Inode = o.Parent
+		e.Name = o.Name
+
+	case *fuseops.RmDirOp:
+		oc = o.OpContext
+		e.Inode = o.Parent
+		e.Name = o.Name
+
+	case *fuseops.RenameOp:
+		oc = o.OpContext
+		e.Inode = o.OldParent
+		e.Name = o.OldName
+		e.NewParent = o.NewParent
+		e.NewName = o.NewName
+		e.Flags = o.Flags
+
+	case *fuseops.ExchangeDataOp:
+		oc = o.OpContext
+		e.Inode = o.OldParent
+		e.Name = o.OldName
+		e.NewParent = o.NewParent
+		e.NewName = o.NewName
+
+	case *fuseops.SetInodeAttributesOp:
+		oc = o.OpContext
+		e.Inode = o.Inode
+		e.Set = &Attributes{
+			Size:  o.Size,
+			Mode:  o.Mode,
+			Uid:   o.Uid,
+			Gid:   o.Gid,
+			Atime: o.Atime,
+			Mtime: o.Mtime,
+		}
+
+	case *fuseops.SetXattrOp:
+		oc = o.OpContext
+		e.Inode = o.Inode
+		e.Xattr = o.Name
+		e.Flags = o.Flags
+
+	case *fuseops.RemoveXattrOp:
+		oc = o.OpContext
+		e.Inode = o.Inode
+		e.Xattr = o.Name
+
+	default:
+		return nil, false
+	}
+
+	e.Uid = oc.Uid
+	e.Gid = oc.Gid
+	e.Pid = oc.Pid
+
+	// The inode is only meaningful if the op succeeded.
+	if err != nil {
+		e.Child = 0
+	}
+
+	return e, true
+}
+
+func result(err error) string {
+	if err == nil {
+		return "ok"
+	}
+
+	errno := fuse.ErrnoOf(err)
+	if name := unix.ErrnoName(errno); name != "" {
+		return name
+	}
+
+	return errno.Error()
+}
@@ -0,0 +1,166 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseaudit_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseaudit"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system with canned results for the ops that the tests send.
+type cannedFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *cannedFS) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) error {
+	op.Entry.Child = 7
+	return nil
+}
+
+func (fs *cannedFS) CreateFile(ctx context.Context, op *fuseops.CreateFileOp) error {
+	op.Entry.Child = 7
+	return nil
+}
+
+// The entry is filled in before failing, as a file system may do.
+func (fs *cannedFS) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
+	op.Entry.Child = 7
+	return syscall.EEXIST
+}
+
+func (fs *cannedFS) Unlink(ctx context.Context, op *fuseops.UnlinkOp) error {
+	return syscall.EACCES
+}
+
+func (fs *cannedFS) SetInodeAttributes(ctx context.Context, op *fuseops.SetInodeAttributesOp) error {
+	return nil
+}
+
+func (fs *cannedFS) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp) error {
+	return errors.New("burrito")
+}
+
+// Serve a cannedFS audited to buf, returning a function that sends an op and
+// checks the error it gets back.
+func newConn(t *testing.T, buf *bytes.Buffer) (do func(op interface{}, want error), l *fuseaudit.Logger) {
+	t.Helper()
+
+	server, l := fuseaudit.Wrap(fuseutil.NewFileSystemServer(&cannedFS{}), buf)
+	c, err := fusetesting.NewConn(server, nil)
+	if err != nil {
+		t.Fatalf("NewConn: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	do = func(op interface{}, want error) {
+		t.Helper()
+		if err := c.Do(context.Background(), op); err != want {
+			t.Fatalf("Do(%T): got %v, want %v", op, err, want)
+		}
+	}
+
+	return do, l
+}
+
+func readEvents(t *testing.T, b []byte) []fuseaudit.Event {
+	t.Helper()
+
+	var events []fuseaudit.Event
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		var e fuseaudit.Event
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatalf("Unmarshal(%q): %v", s.Text(), err)
+		}
+
+		events = append(events, e)
+	}
+
+	return events
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	do, l := newConn(t, &buf)
+
+	caller := fuseops.OpContext{Uid: 1000, Gid: 100, Pid: 4321}
+	mode := os.FileMode(0600)
+
+	do(&fuseops.LookUpInodeOp{Parent: 1, Name: "foo", OpContext: caller}, nil)
+	do(&fuseops.CreateFileOp{
+		Parent:    1,
+		Name:      "foo",
+		Mode:      0644,
+		OpenFlags: syscall.O_RDWR,
+		OpContext: caller,
+	}, nil)
+	do(&fuseops.UnlinkOp{Parent: 1, Name: "bar", OpContext: caller}, syscall.EACCES)
+	do(&fuseops.SetInodeAttributesOp{Inode: 7, Mode: &mode, OpContext: caller}, nil)
+	do(&fuseops.RemoveXattrOp{Inode: 7, Name: "user.taco", OpContext: caller}, syscall.EIO)
+
+	events := readEvents(t, buf.Bytes())
+	if len(events) != 4 {
+		t.Fatalf("got %d events, want 4:\n%s", len(events), buf.String())
+	}
+
+	for _, e := range events {
+		if e.Uid != 1000 || e.Gid != 100 || e.Pid != 4321 || e.Time.IsZero() {
+			t.Errorf("%s: got caller %d/%d/%d at %v", e.Op, e.Uid, e.Gid, e.Pid, e.Time)
+		}
+	}
+
+	if e := events[0]; e.Op != "CreateFile" || e.Inode != 1 || e.Name != "foo" || e.Mode != 0644 || e.Child != 7 || e.Result != "ok" {
+		t.Errorf("CreateFile: got %+v", e)
+	}
+
+	if e := events[1]; e.Op != "Unlink" || e.Name != "bar" || e.Result != "EACCES" {
+		t.Errorf("Unlink: got %+v", e)
+	}
+
+	if e := events[2]; e.Op != "SetInodeAttributes" || e.Set == nil || e.Set.Mode == nil || *e.Set.Mode != 0600 || e.Set.Size != nil {
+		t.Errorf("SetInodeAttributes: got %+v", e)
+	}
+
+	if e := events[3]; e.Op != "RemoveXattr" || e.Xattr != "user.taco" || e.Result != "EIO" {
+		t.Errorf("RemoveXattr: got %+v", e)
+	}
+
+	if err := l.Err(); err != nil {
+		t.Errorf("Err: %v", err)
+	}
+}
+
+func TestLogger_FailedCreate(t *testing.T) {
+	var buf bytes.Buffer
+	do, _ := newConn(t, &buf)
+
+	do(&fuseops.MkDirOp{Parent: 1, Name: "foo", Mode: 0755 | os.ModeDir}, syscall.EEXIST)
+
+	events := readEvents(t, buf.Bytes())
+	if len(events) != 1 || events[0].Child != 0 || events[0].Result != "EEXIST" {
+		t.Errorf("got %s", buf.String())
+	}
+}
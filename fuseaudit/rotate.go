@@ -0,0 +1,210 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseaudit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/timeutil"
+)
+
+// The suffix given to rotated files, which sorts in the order of rotation.
+const rotatedTimeFormat = "20060102T150405.000000000Z"
+
+// RotatingFile is a log file that is only ever appended to, and that is
+// rotated once it reaches a given size: renamed to its path with the UTC time
+// of rotation appended, such as audit.log.20240102T150405.000000000Z, and
+// replaced by an empty file. The oldest rotated files are deleted so that at
+// most a given number remain. Create one with OpenRotatingFile.
+//
+// Writes are never split across files, so a file may exceed the size by up to
+// the length of one write.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	clock      timeutil.Clock
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	f    *os.File
+	size int64
+}
+
+// OpenRotatingFile opens the file at path for appending, creating it with
+// permissions 0600 if it doesn't exist. It is rotated before a write that
+// would take it past maxSize bytes, unless it is empty. If maxBackups is
+// positive, only that many rotated files are kept; otherwise all of them are.
+func OpenRotatingFile(
+	path string,
+	maxSize int64,
+	maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		clock:      timeutil.RealClock(),
+	}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// LOCKS_REQUIRED(r.mu)
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("OpenFile: %v", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Stat: %v", err)
+	}
+
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if need be.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// LOCKS_REQUIRED(r.mu)
+func (r *RotatingFile) rotate() error {
+	// Make sure that everything in the old file reaches the disk before it is
+	// set aside.
+	if err := r.f.Sync(); err != nil {
+		return fmt.Errorf("Sync: %v", err)
+	}
+
+	if err := r.f.Close(); err != nil {
+		return fmt.Errorf("Close: %v", err)
+	}
+
+	r.f = nil
+
+	rotated := r.path + "." + r.clock.Now().UTC().Format(rotatedTimeFormat)
+	if err := os.Rename(r.path, rotated); err != nil {
+		return fmt.Errorf("Rename: %v", err)
+	}
+
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	return r.prune()
+}
+
+// Delete the oldest rotated files beyond r.maxBackups.
+//
+// LOCKS_REQUIRED(r.mu)
+func (r *RotatingFile) prune() error {
+	if r.maxBackups <= 0 {
+		return nil
+	}
+
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return fmt.Errorf("Glob: %v", err)
+	}
+
+	// Leave alone any files that we didn't rotate.
+	var rotated []string
+	for _, m := range matches {
+		suffix := strings.TrimPrefix(m, r.path+".")
+		if _, err := time.Parse(rotatedTimeFormat, suffix); err == nil {
+			rotated = append(rotated, m)
+		}
+	}
+
+	if len(rotated) <= r.maxBackups {
+		return nil
+	}
+
+	sort.Strings(rotated)
+	for _, m := range rotated[:len(rotated)-r.maxBackups] {
+		if err := os.Remove(m); err != nil {
+			return fmt.Errorf("Remove: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Sync commits what has been written to the disk.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *RotatingFile) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return os.ErrClosed
+	}
+
+	return r.f.Sync()
+}
+
+// Close syncs and closes the file. Writes fail after it returns.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return os.ErrClosed
+	}
+
+	f := r.f
+	r.f = nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("Sync: %v", err)
+	}
+
+	return f.Close()
+}
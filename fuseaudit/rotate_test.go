@@ -0,0 +1,118 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseaudit
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/timeutil"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+
+	// A file that merely shares the prefix must survive pruning.
+	other := path + ".lock"
+	if err := os.WriteFile(other, nil, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	r, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile: %v", err)
+	}
+
+	clock := &timeutil.SimulatedClock{}
+	clock.SetTime(time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC))
+	r.clock = clock
+
+	// Each line fills a file, so each after the first causes a rotation.
+	lines := []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"}
+	for _, l := range lines {
+		if _, err := r.Write([]byte(l)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		clock.AdvanceTime(time.Second)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if _, err := r.Write([]byte("x")); err == nil {
+		t.Error("Write succeeded after Close")
+	}
+
+	// The current file holds the last line, and the two newest rotated files
+	// the two before it.
+	matches, err := filepath.Glob(path + "*")
+	if err != nil {
+		t.Fatalf("Glob: %v", err)
+	}
+
+	sort.Strings(matches)
+	want := []string{
+		path,
+		path + ".20240102T150407.000000000Z",
+		path + ".20240102T150408.000000000Z",
+		other,
+	}
+
+	if strings.Join(matches, " ") != strings.Join(want, " ") {
+		t.Fatalf("files: got %v, want %v", matches, want)
+	}
+
+	for i, contents := range []string{"dddddddd\n", "bbbbbbbb\n", "cccccccc\n"} {
+		b, err := os.ReadFile(want[i])
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+
+		if string(b) != contents {
+			t.Errorf("%s: got %q, want %q", want[i], b, contents)
+		}
+	}
+}
+
+func TestRotatingFile_Append(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(path, []byte("old\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	r, err := OpenRotatingFile(path, 1<<20, 0)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile: %v", err)
+	}
+
+	if _, err := r.Write([]byte("new\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if b, _ := os.ReadFile(path); string(b) != "old\nnew\n" {
+		t.Errorf("got %q", b)
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fusedebug serves HTTP pages for inspecting a running mount without
+// attaching a debugger:
+//
+//	/healthz        "ok" while the file system is being served, 503 otherwise
+//	/connection     what was negotiated with the kernel, as JSON
+//	/ops            ops replied to and failed by op, and ops in flight and
+//	                where they are waiting (see fuse.Stats), as JSON
+//	/debug/pprof/   the runtime's profiles, as served by net/http/pprof
+//
+// The server is opt-in: wrap the file system's server and serve the pages on
+// an address of your choosing, or on an existing mux under a prefix with
+// http.StripPrefix. For example:
+//
+//	d := fusedebug.New()
+//	mfs, err := fuse.Mount(dir, d.Wrap(server), cfg)
+//	...
+//	go http.ListenAndServe("localhost:6060", d)
+//
+// The pages say a lot about the process and the file system, so don't serve
+// them where untrusted users can reach them.
+package fusedebug
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// Debug records what it needs about the ops served by the server passed to
+// Wrap, and serves the pages described in the package documentation. Create
+// one with New.
+type Debug struct {
+	mux *http.ServeMux
+
+	mu sync.Mutex
+
+	// The connection being served, nil until serving starts. stopped is set
+	// once the server returns.
+	//
+	// GUARDED_BY(mu)
+	conn    *fuse.Connection
+	started time.Time
+	stopped bool
+
+	// Counters for each op name, created on first use.
+	//
+	// GUARDED_BY(mu)
+	ops map[string]*opCounters
+
+	// The number of ops read but not yet replied to.
+	inFlight atomic.Int64
+}
+
+type opCounters struct {
+	ops    uint64
+	errors uint64
+
+	// By errno name, or "other" for errors that aren't errnos.
+	errnos map[string]uint64
+}
+
+var _ fuse.Interceptor = &Debug{}
+var _ http.Handler = &Debug{}
+
+// New returns a Debug with no ops recorded.
+func New() *Debug {
+	d := &Debug{
+		mux: http.NewServeMux(),
+		ops: make(map[string]*opCounters),
+	}
+
+	d.mux.HandleFunc("/healthz", d.serveHealth)
+	d.mux.HandleFunc("/connection", d.serveConnection)
+	d.mux.HandleFunc("/ops", d.serveOps)
+	d.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	d.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	d.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	d.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	d.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return d
+}
+
+// Wrap returns a server that serves ops with the supplied one, recording them
+// for the pages served by d. A Debug may wrap only one server.
+func (d *Debug) Wrap(server fuse.Server) fuse.Server {
+	return fuse.ServerFunc(func(c *fuse.Connection) {
+		d.mu.Lock()
+		d.conn = c
+		d.started = time.Now()
+		d.mu.Unlock()
+
+		defer func() {
+			d.mu.Lock()
+			d.stopped = true
+			d.mu.Unlock()
+		}()
+
+		fuse.Chain(server, d).ServeOps(c)
+	})
+}
+
+// ServeHTTP serves the pages described in the package documentation.
+func (d *Debug) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mux.ServeHTTP(w, r)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Interceptor
+////////////////////////////////////////////////////////////////////////
+
+func (d *Debug) InterceptOp(
+	ctx context.Context,
+	op interface{}) (context.Context, error) {
+	d.inFlight.Add(1)
+	return ctx, nil
+}
+
+func (d *Debug) InterceptReply(
+	ctx context.Context,
+	op interface{},
+	err error) error {
+	d.inFlight.Add(-1)
+
+	name := fuse.OpName(op)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c := d.ops[name]
+	if c == nil {
+		c = &opCounters{errnos: make(map[string]uint64)}
+		d.ops[name] = c
+	}
+
+	c.ops++
+	if err != nil {
+		c.errors++
+		c.errnos[errnoName(err)]++
+	}
+
+	return err
+}
+
+func errnoName(err error) string {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return "other"
+	}
+
+	if name := unix.ErrnoName(errno); name != "" {
+		return name
+	}
+
+	return "other"
+}
+
+////////////////////////////////////////////////////////////////////////
+// Pages
+////////////////////////////////////////////////////////////////////////
+
+func (d *Debug) serveHealth(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	conn, stopped := d.conn, d.stopped
+	d.mu.Unlock()
+
+	switch {
+	case conn == nil:
+		http.Error(w, "not mounted", http.StatusServiceUnavailable)
+	case stopped:
+		http.Error(w, "unmounted", http.StatusServiceUnavailable)
+	default:
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+type connectionPage struct {
+	// Protocol versions, as major.minor.
+	KernelProtocol string `json:"kernel_protocol"`
+	Protocol       string `json:"protocol"`
+
+	KernelFlags  string `json:"kernel_flags"`
+	KernelFlags2 string `json:"kernel_flags2"`
+	Flags        string `json:"flags"`
+	Flags2       string `json:"flags2"`
+
+	MaxWrite     uint32 `json:"max_write"`
+	MaxReadahead uint32 `json:"max_readahead"`
+
+	FSName   string `json:"fsname,omitempty"`
+	Subtype  string `json:"subtype,omitempty"`
+	ReadOnly bool   `json:"read_only"`
+
+	Started time.Time `json:"started"`
+	Stopped bool      `json:"stopped"`
+}
+
+func (d *Debug) serveConnection(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	conn, started, stopped := d.conn, d.started, d.stopped
+	d.mu.Unlock()
+
+	if conn == nil {
+		http.Error(w, "not mounted", http.StatusServiceUnavailable)
+		return
+	}
+
+	init := conn.InitOp()
+	cfg := conn.MountConfig()
+	writeJSON(w, &connectionPage{
+		KernelProtocol: fmt.Sprintf("%d.%d", init.KernelMajor, init.KernelMinor),
+		Protocol:       fmt.Sprintf("%d.%d", init.Major, init.Minor),
+		KernelFlags:    init.KernelFlags.String(),
+		KernelFlags2:   init.KernelFlags2.String(),
+		Flags:          init.Flags.String(),
+		Flags2:         init.Flags2.String(),
+		MaxWrite:       init.MaxWrite,
+		MaxReadahead:   init.MaxReadahead,
+		FSName:         cfg.FSName,
+		Subtype:        cfg.Subtype,
+		ReadOnly:       cfg.ReadOnly,
+		Started:        started,
+		Stopped:        stopped,
+	})
+}
+
+type opsPage struct {
+	InFlight   int64            `json:"in_flight"`
+	Queued     int              `json:"queued"`
+	Started    int              `json:"started"`
+	WriteBytes int64            `json:"write_bytes"`
+	Ops        []opCountersPage `json:"ops"`
+}
+
+type opCountersPage struct {
+	Op     string            `json:"op"`
+	Count  uint64            `json:"count"`
+	Errors uint64            `json:"errors,omitempty"`
+	Errnos map[string]uint64 `json:"errnos,omitempty"`
+}
+
+func (d *Debug) serveOps(w http.ResponseWriter, r *http.Request) {
+	page := &opsPage{
+		InFlight: d.inFlight.Load(),
+		Ops:      []opCountersPage{},
+	}
+
+	d.mu.Lock()
+	if d.conn != nil {
+		s := d.conn.Stats()
+		page.Queued = s.Queued
+		page.Started = s.Started
+		page.WriteBytes = s.WriteBytes
+	}
+
+	for name, c := range d.ops {
+		p := opCountersPage{
+			Op:     name,
+			Count:  c.ops,
+			Errors: c.errors,
+		}
+
+		if len(c.errnos) > 0 {
+			p.Errnos = make(map[string]uint64, len(c.errnos))
+			for e, n := range c.errnos {
+				p.Errnos[e] = n
+			}
+		}
+
+		page.Ops = append(page.Ops, p)
+	}
+	d.mu.Unlock()
+
+	sort.Slice(page.Ops, func(i, j int) bool {
+		return page.Ops[i].Op < page.Ops[j].Op
+	})
+
+	writeJSON(w, page)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
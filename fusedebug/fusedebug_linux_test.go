@@ -0,0 +1,122 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusedebug
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system in which nothing exists.
+type emptyFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *emptyFS) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) error {
+	return syscall.ENOENT
+}
+
+// Fetch the supplied page, returning its status and body.
+func get(t *testing.T, d *Debug, path string) (int, string) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w.Code, w.Body.String()
+}
+
+func TestDebug(t *testing.T) {
+	d := New()
+	if code, _ := get(t, d, "/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("healthz before mounting: got %d", code)
+	}
+
+	server := d.Wrap(fuseutil.NewFileSystemServer(&emptyFS{}))
+	c, err := fusetesting.NewConn(server, &fuse.MountConfig{FSName: "taco"})
+	if err != nil {
+		t.Fatalf("NewConn: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "foo"}
+		if err := c.Do(context.Background(), op); err != syscall.ENOENT {
+			t.Fatalf("LookUpInode: got %v, want ENOENT", err)
+		}
+	}
+
+	if code, body := get(t, d, "/healthz"); code != http.StatusOK || body != "ok\n" {
+		t.Errorf("healthz: got %d %q", code, body)
+	}
+
+	// Connection.
+	var conn connectionPage
+	_, body := get(t, d, "/connection")
+	if err := json.Unmarshal([]byte(body), &conn); err != nil {
+		t.Fatalf("Unmarshal(%q): %v", body, err)
+	}
+
+	if conn.FSName != "taco" || conn.Protocol == "" || conn.MaxWrite == 0 {
+		t.Errorf("connection: got %+v", conn)
+	}
+
+	// Ops.
+	var ops opsPage
+	_, body = get(t, d, "/ops")
+	if err := json.Unmarshal([]byte(body), &ops); err != nil {
+		t.Fatalf("Unmarshal(%q): %v", body, err)
+	}
+
+	var lookUp *opCountersPage
+	for i := range ops.Ops {
+		if ops.Ops[i].Op == "LookUpInode" {
+			lookUp = &ops.Ops[i]
+		}
+	}
+
+	if lookUp == nil || lookUp.Count != 2 || lookUp.Errors != 2 || lookUp.Errnos["ENOENT"] != 2 {
+		t.Errorf("ops: got %s", body)
+	}
+
+	if ops.InFlight != 0 {
+		t.Errorf("in flight: got %d", ops.InFlight)
+	}
+
+	if ops.Queued != 0 || ops.Started != 0 || ops.WriteBytes != 0 {
+		t.Errorf("waiting: got %s", body)
+	}
+
+	// Profiles.
+	if code, body := get(t, d, "/debug/pprof/"); code != http.StatusOK || !strings.Contains(body, "goroutine") {
+		t.Errorf("pprof index: got %d", code)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if code, body := get(t, d, "/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("healthz after unmounting: got %d %q", code, body)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseops
+
+import "github.com/jacobsa/fuse/internal/fusekernel"
+
+// OpClass is a coarse grouping of ops by the kind of work they represent. It
+// lets policies such as worker pools, limits and schedulers be configured
+// without enumerating every op type.
+type OpClass int
+
+const (
+	// Everything not covered below: lookups, attributes, namespace changes,
+	// xattrs, opens and releases, statfs, etc.
+	OpClassMetadata OpClass = iota
+
+	// Listing directory contents (ReadDirOp).
+	OpClassReadDir
+
+	// Reading file data (ReadFileOp).
+	OpClassRead
+
+	// Writing file data and making it durable (WriteFileOp, FallocateOp,
+	// SyncFileOp, FlushFileOp, SyncFSOp).
+	OpClassWrite
+)
+
+// NumOpClasses is the number of distinct OpClass values, for use in sizing
+// arrays indexed by class.
+const NumOpClasses = int(OpClassWrite) + 1
+
+func (c OpClass) String() string {
+	switch c {
+	case OpClassMetadata:
+		return "metadata"
+	case OpClassReadDir:
+		return "readdir"
+	case OpClassRead:
+		return "read"
+	case OpClassWrite:
+		return "write"
+	default:
+		return "unknown"
+	}
+}
+
+// ClassOf returns the class of the supplied op, which should be a pointer to
+// one of the op types in this package. Unknown values are OpClassMetadata.
+func ClassOf(op interface{}) OpClass {
+	switch op.(type) {
+	case *ReadDirOp:
+		return OpClassReadDir
+
+	case *ReadFileOp:
+		return OpClassRead
+
+	case *WriteFileOp, *FallocateOp, *SyncFileOp, *FlushFileOp, *SyncFSOp:
+		return OpClassWrite
+
+	default:
+		return OpClassMetadata
+	}
+}
+
+// Mutates reports whether the supplied op may modify the file system: its
+// namespace, the contents or attributes of an inode, or extended attributes.
+// Opening a file for writing or with O_TRUNC counts, as it does for a
+// read-only mount.
+func Mutates(op interface{}) bool {
+	switch o := op.(type) {
+	case *SetInodeAttributesOp,
+		*MkDirOp,
+		*MkNodeOp,
+		*CreateFileOp,
+		*CreateTmpFileOp,
+		*CreateSymlinkOp,
+		*CreateLinkOp,
+		*RenameOp,
+		*ExchangeDataOp,
+		*RmDirOp,
+		*UnlinkOp,
+		*WriteFileOp,
+		*SetXattrOp,
+		*RemoveXattrOp,
+		*FallocateOp:
+		return true
+
+	case *OpenFileOp:
+		return !o.OpenFlags.IsReadOnly() || o.OpenFlags&fusekernel.OpenTruncate != 0
+
+	default:
+		return false
+	}
+}
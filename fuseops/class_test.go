@@ -0,0 +1,49 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseops
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestMutates(t *testing.T) {
+	testCases := []struct {
+		op   interface{}
+		want bool
+	}{
+		{&LookUpInodeOp{}, false},
+		{&ReadFileOp{}, false},
+		{&ReadDirOp{}, false},
+		{&SyncFileOp{}, false},
+		{&OpenFileOp{OpenFlags: fusekernel.OpenReadOnly}, false},
+		{&OpenFileOp{OpenFlags: fusekernel.OpenReadWrite}, true},
+		{&OpenFileOp{OpenFlags: fusekernel.OpenReadOnly | syscall.O_TRUNC}, true},
+		{&WriteFileOp{}, true},
+		{&SetInodeAttributesOp{}, true},
+		{&RenameOp{}, true},
+		{&ExchangeDataOp{}, true},
+		{&GetXTimesOp{}, false},
+		{&SetXattrOp{}, true},
+	}
+
+	for _, tc := range testCases {
+		if got := Mutates(tc.op); got != tc.want {
+			t.Errorf("Mutates(%T) = %v, want %v", tc.op, got, tc.want)
+		}
+	}
+}
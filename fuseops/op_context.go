@@ -0,0 +1,123 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseops
+
+// ContextOf returns the OpContext of the supplied op, which should be a
+// pointer to one of the op types in this package, or false if it isn't.
+func ContextOf(op interface{}) (OpContext, bool) {
+	switch o := op.(type) {
+	case *StatFSOp:
+		return o.OpContext, true
+
+	case *LookUpInodeOp:
+		return o.OpContext, true
+
+	case *GetInodeAttributesOp:
+		return o.OpContext, true
+
+	case *GetXTimesOp:
+		return o.OpContext, true
+
+	case *SetInodeAttributesOp:
+		return o.OpContext, true
+
+	case *ForgetInodeOp:
+		return o.OpContext, true
+
+	case *BatchForgetOp:
+		return o.OpContext, true
+
+	case *MkDirOp:
+		return o.OpContext, true
+
+	case *MkNodeOp:
+		return o.OpContext, true
+
+	case *CreateFileOp:
+		return o.OpContext, true
+
+	case *CreateTmpFileOp:
+		return o.OpContext, true
+
+	case *CreateSymlinkOp:
+		return o.OpContext, true
+
+	case *CreateLinkOp:
+		return o.OpContext, true
+
+	case *RenameOp:
+		return o.OpContext, true
+
+	case *ExchangeDataOp:
+		return o.OpContext, true
+
+	case *RmDirOp:
+		return o.OpContext, true
+
+	case *UnlinkOp:
+		return o.OpContext, true
+
+	case *OpenDirOp:
+		return o.OpContext, true
+
+	case *ReadDirOp:
+		return o.OpContext, true
+
+	case *ReleaseDirHandleOp:
+		return o.OpContext, true
+
+	case *OpenFileOp:
+		return o.OpContext, true
+
+	case *ReadFileOp:
+		return o.OpContext, true
+
+	case *WriteFileOp:
+		return o.OpContext, true
+
+	case *SyncFileOp:
+		return o.OpContext, true
+
+	case *FlushFileOp:
+		return o.OpContext, true
+
+	case *ReleaseFileHandleOp:
+		return o.OpContext, true
+
+	case *ReadSymlinkOp:
+		return o.OpContext, true
+
+	case *RemoveXattrOp:
+		return o.OpContext, true
+
+	case *GetXattrOp:
+		return o.OpContext, true
+
+	case *ListXattrOp:
+		return o.OpContext, true
+
+	case *SetXattrOp:
+		return o.OpContext, true
+
+	case *FallocateOp:
+		return o.OpContext, true
+
+	case *SyncFSOp:
+		return o.OpContext, true
+
+	default:
+		return OpContext{}, false
+	}
+}
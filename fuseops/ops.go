@@ -16,6 +16,7 @@ package fuseops
 
 import (
 	"os"
+	"runtime"
 	"time"
 
 	"github.com/jacobsa/fuse/internal/fusekernel"
@@ -27,10 +28,19 @@ import (
 
 // OpContext contains extra context that may be needed by some file systems.
 // See https://libfuse.github.io/doxygen/structfuse__context.html as a reference.
+//
+// Every op in this package carries one in its OpContext field, so that logic
+// such as authorization and auditing can be written once for all ops; use
+// ContextOf to obtain it from an op of unknown type.
 type OpContext struct {
 	// FuseID is the Unique identifier for each operation from the kernel.
 	FuseID uint64
 
+	// The inode to which the kernel addressed the op: the inode of interest, or
+	// the parent directory for ops that act on a name within one. Zero for ops
+	// that aren't addressed to an inode, such as BatchForgetOp.
+	Inode InodeID
+
 	// PID of the process that is invoking the operation.
 	// Not filled in case of a writepage operation.
 	Pid uint32
@@ -38,6 +48,118 @@ type OpContext struct {
 	// UID of the process that is invoking the operation.
 	// Not filled in case of a writepage operation.
 	Uid uint32
+
+	// GID of the process that is invoking the operation.
+	// Not filled in case of a writepage operation.
+	Gid uint32
+
+	// For ops that create an inode (MkDirOp, MkNodeOp and CreateFileOp), the
+	// umask of the process, as in the op's Umask field. Zero for other ops.
+	Umask os.FileMode
+}
+
+// The outcome of the INIT exchange with which the kernel opens a connection:
+// the protocol version and capabilities in effect for the mount. Unlike the
+// other ops this is not sent to the file system for a reply; see
+// fuse.Connection.InitOp and fuseutil.FileSystem.Init. Use it to adapt to what
+// the kernel supports.
+type InitOp struct {
+	// The newest protocol version supported by the kernel.
+	KernelMajor uint32
+	KernelMinor uint32
+
+	// The protocol version in use on the connection: the older of the kernel's
+	// and the newest supported by this package.
+	Major uint32
+	Minor uint32
+
+	// The capabilities offered by the kernel, and those enabled for the
+	// connection. These are the FUSE_* INIT flags of the kernel's fuse.h;
+	// KernelFlags2 and Flags2 hold those beyond the first 32, and are always
+	// zero on OS X.
+	KernelFlags  fusekernel.InitFlags
+	KernelFlags2 fusekernel.InitFlags2
+	Flags        fusekernel.InitFlags
+	Flags2       fusekernel.InitFlags2
+
+	// The largest write, in bytes, that the kernel will send in a WriteFileOp,
+	// and the amount of readahead it may do.
+	MaxWrite     uint32
+	MaxReadahead uint32
+}
+
+// ProtocolAtLeast reports whether the protocol version in use is at least
+// major.minor.
+func (o *InitOp) ProtocolAtLeast(major, minor uint32) bool {
+	return o.Major > major || (o.Major == major && o.Minor >= minor)
+}
+
+// CacheSymlinks reports whether the kernel caches the targets of symlinks. See
+// fuse.MountConfig.EnableSymlinkCaching.
+func (o *InitOp) CacheSymlinks() bool {
+	return o.Flags&fusekernel.InitCacheSymlinks != 0
+}
+
+// ExplicitInvalData reports whether the kernel drops cached file contents only
+// when told to. See fuse.MountConfig.EnableExplicitInvalData.
+func (o *InitOp) ExplicitInvalData() bool {
+	return o.Flags&fusekernel.InitExplicitInvalData != 0
+}
+
+// Passthrough reports whether file handles can be passed through to backing
+// files. See fuse.MountConfig.EnablePassthrough.
+func (o *InitOp) Passthrough() bool {
+	return o.Flags2&fusekernel.InitPassthrough != 0
+}
+
+// IoUring reports whether requests may arrive over io_uring. See
+// fuse.MountConfig.EnableIoUring.
+func (o *InitOp) IoUring() bool {
+	return o.Flags2&fusekernel.InitOverIoUring != 0
+}
+
+// ParallelDirOps reports whether the kernel may send lookups and readdirs in
+// the same directory concurrently. See fuse.MountConfig.EnableParallelDirOps.
+func (o *InitOp) ParallelDirOps() bool {
+	return o.Flags&fusekernel.InitParallelDirOps != 0
+}
+
+// NoOpen reports whether the kernel agreed to stop sending OpenFileOp and
+// ReleaseFileHandleOp once the server replies ENOSYS to an OpenFileOp. See
+// fuse.MountConfig.EnableNoOpenSupport.
+func (o *InitOp) NoOpen() bool {
+	return o.Flags&fusekernel.InitNoOpenSupport != 0
+}
+
+// NoOpendir is the analogue of NoOpen for OpenDirOp and ReleaseDirHandleOp.
+// See fuse.MountConfig.EnableNoOpendirSupport.
+func (o *InitOp) NoOpendir() bool {
+	return o.Flags&fusekernel.InitNoOpendirSupport != 0
+}
+
+// HandleKillPrivV2 reports whether the file system is responsible for clearing
+// the setuid and setgid bits where the KillSuidgid fields of ops say so. See
+// fuse.MountConfig.EnableHandleKillPrivV2.
+func (o *InitOp) HandleKillPrivV2() bool {
+	return runtime.GOOS == "linux" && o.Flags&fusekernel.InitHandleKillprivV2 != 0
+}
+
+// SetxattrExt reports whether the kernel sends SetXattrOp.KillSgid. See
+// fuse.MountConfig.EnableSetxattrExt.
+func (o *InitOp) SetxattrExt() bool {
+	return runtime.GOOS == "linux" && o.Flags&fusekernel.InitSetxattrExt != 0
+}
+
+// Xtimes reports whether the kernel sends GetXTimesOp. OS X only; see
+// fuse.MountConfig.EnableXtimes.
+func (o *InitOp) Xtimes() bool {
+	return runtime.GOOS == "darwin" && o.Flags&fusekernel.InitXtimes != 0
+}
+
+// ExchangeData reports whether the kernel sends ExchangeDataOp. OS X only; see
+// fuse.MountConfig.EnableExchangeData.
+func (o *InitOp) ExchangeData() bool {
+	return runtime.GOOS == "darwin" && o.Flags&fusekernel.InitExchangeData != 0
 }
 
 // Return statistics about the file system's capacity and available resources.
@@ -108,6 +230,8 @@ type StatFSOp struct {
 	// The total number of inodes in the file system, and how many remain free.
 	Inodes     uint64
 	InodesFree uint64
+
+	OpContext OpContext
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -135,6 +259,16 @@ type LookUpInodeOp struct {
 	//
 	// The lookup count for the inode is implicitly incremented. See notes on
 	// ForgetInodeOp for more information.
+	//
+	// If the name doesn't exist, the file system may return ENOENT, which the
+	// kernel doesn't remember, so that it asks again the next time the name is
+	// used. Alternatively it may return nil with Entry.Child left zero and
+	// Entry.EntryExpiration set, which the caller sees as ENOENT but which the
+	// kernel caches as a negative entry until it expires, as for the many
+	// probes for files like .git/config that don't exist. The kernel drops the
+	// negative entry itself when it creates the name; a file system whose
+	// names change by other means should invalidate it with
+	// fuse.Connection.InvalidateEntry. No lookup count is taken.
 	Entry     ChildInodeEntry
 	OpContext OpContext
 }
@@ -147,6 +281,18 @@ type GetInodeAttributesOp struct {
 	// The inode of interest.
 	Inode InodeID
 
+	// If set, this is fstat(2) or similar on a file opened with this handle,
+	// otherwise it's stat(2). A file system that keeps state for each handle,
+	// such as writes that it has yet to flush, can use this to report the
+	// size and times that the caller expects.
+	Handle *HandleID
+
+	// Set if this is for a statx(2) call that asked for the creation time,
+	// which Linux (>= 6.6) sends as FUSE_STATX rather than FUSE_GETATTR. The
+	// reply then reports Attributes.Crtime as the birth time, unless it is
+	// zero. File systems need do nothing different.
+	Statx bool
+
 	// Set by the file system: attributes for the inode, and the time at which
 	// they should expire. See notes on ChildInodeEntry.AttributesExpiration for
 	// more.
@@ -155,6 +301,24 @@ type GetInodeAttributesOp struct {
 	OpContext            OpContext
 }
 
+// Get the backup and creation times of an inode. OS X only: macFUSE sends this
+// for getattrlist(2) calls that ask for ATTR_CMN_BKUPTIME or ATTR_CMN_CRTIME,
+// which backup tools and the Finder use. Attributes.Crtime from
+// GetInodeAttributesOp is not consulted for these.
+//
+// If the file system returns ENOSYS, macFUSE stops sending this op and reports
+// both times as zero.
+type GetXTimesOp struct {
+	// The inode of interest.
+	Inode InodeID
+
+	// Set by the file system: the time at which the inode was last backed up,
+	// zero if never, and the time at which it was created.
+	Bkuptime  time.Time
+	Crtime    time.Time
+	OpContext OpContext
+}
+
 // Change attributes for an inode.
 //
 // The kernel sends this for obvious cases like chmod(2), and for less obvious
@@ -163,16 +327,36 @@ type SetInodeAttributesOp struct {
 	// The inode of interest.
 	Inode InodeID
 
-	// If set, this is ftruncate(2), otherwise it's truncate(2)
+	// If set, the change is being made through a file opened with this handle,
+	// as for ftruncate(2), or open(2) with O_TRUNC; otherwise it's being made
+	// by path, as for truncate(2). A file system can use the handle it already
+	// has, rather than opening another, and order the change with writes made
+	// through it.
 	Handle *HandleID
 
 	// The attributes to modify, or nil for attributes that don't need a change.
+	// Times carry the full nanosecond precision sent by the kernel. Ctime is
+	// only sent with writeback caching (see
+	// fuse.MountConfig.DisableWritebackCaching), when the kernel maintains the
+	// ctime of files itself.
 	Uid   *uint32
 	Gid   *uint32
 	Size  *uint64
 	Mode  *os.FileMode
 	Atime *time.Time
 	Mtime *time.Time
+	Ctime *time.Time
+
+	// Set if the file system must clear the setuid and setgid bits as part of
+	// this change. Only ever set when the file system handles this itself; see
+	// fuse.MountConfig.EnableHandleKillPrivV2.
+	KillSuidgid bool
+
+	// The FATTR_* mask sent by the kernel, from which the fields above are
+	// derived. It tells file systems that need it what they can't, for example
+	// Valid.AtimeNow() and Valid.MtimeNow(), which are set when the times are
+	// to be the current time, as for utimensat(2) with UTIME_NOW or touch(1).
+	Valid fusekernel.SetattrValid
 
 	// Set by the file system: the new attributes for the inode, and the time at
 	// which they should expire. See notes on
@@ -224,6 +408,8 @@ type SetInodeAttributesOp struct {
 // remaining inodes when the file system unmounts, including the root inode.
 // Rather they should take fuse.Connection.ReadOp returning io.EOF as
 // implicitly decrementing all lookup counts to zero.
+//
+// fuseutil.NewInodeRegistry keeps these counts on a file system's behalf.
 type ForgetInodeOp struct {
 	// The inode whose reference count should be decremented.
 	Inode InodeID
@@ -283,6 +469,23 @@ type MkDirOp struct {
 	Name string
 	Mode os.FileMode
 
+	// The umask of the process making the request. Unless
+	// MountConfig.EnableDontMask is set, the kernel has already applied it to
+	// Mode and this is informational only. With that option set, Mode is
+	// exactly as the caller requested, and file systems that do their own
+	// permission handling (e.g. inheriting default ACLs) are responsible for
+	// computing the effective mode from the two.
+	Umask os.FileMode
+
+	// Security labels that the kernel wants set as extended attributes on the
+	// new inode (e.g. "security.selinux" on an SELinux-enforcing host). The file
+	// system should apply them as part of creating the inode, so that it is
+	// never visible without them.
+	//
+	// Empty unless MountConfig.EnableSecurityContext is set and the kernel
+	// supports the extension (Linux 5.17+).
+	SecurityContexts []SecurityContext
+
 	// Set by the file system: information about the inode that was created.
 	//
 	// The lookup count for the inode is implicitly incremented. See notes on
@@ -311,9 +514,16 @@ type MkNodeOp struct {
 	Name string
 	Mode os.FileMode
 
+	// The umask of the process making the request. See notes on MkDirOp.Umask.
+	Umask os.FileMode
+
 	// The device number (only valid if created file is a device)
 	Rdev uint32
 
+	// Security labels to apply atomically. See notes on
+	// MkDirOp.SecurityContexts.
+	SecurityContexts []SecurityContext
+
 	// Set by the file system: information about the inode that was created.
 	//
 	// The lookup count for the inode is implicitly incremented. See notes on
@@ -331,7 +541,9 @@ type MkNodeOp struct {
 // names may be created outside of the kernel's control, it doesn't matter what
 // the kernel does anyway.
 //
-// Therefore the file system should return EEXIST if the name already exists.
+// Therefore the file system should check whether the name already exists. If
+// it does, it must return EEXIST if the caller asked for O_EXCL (see
+// OpenFlags), and should otherwise return EEXIST or open the existing file.
 type CreateFileOp struct {
 	// The ID of parent directory inode within which to create the child file.
 	Parent InodeID
@@ -340,6 +552,21 @@ type CreateFileOp struct {
 	Name string
 	Mode os.FileMode
 
+	// The umask of the process making the request. See notes on MkDirOp.Umask.
+	Umask os.FileMode
+
+	// Security labels to apply atomically. See notes on
+	// MkDirOp.SecurityContexts.
+	SecurityContexts []SecurityContext
+
+	// The flags with which the file is being opened, as for
+	// OpenFileOp.OpenFlags, but including O_CREAT, and O_EXCL if the caller
+	// asked for it (OpenFlags.Exclusive).
+	OpenFlags fusekernel.OpenFlags
+
+	// See notes on OpenFileOp.KillSuidgid.
+	KillSuidgid bool
+
 	// Set by the file system: information about the inode that was created.
 	//
 	// The lookup count for the inode is implicitly incremented. See notes on
@@ -354,7 +581,56 @@ type CreateFileOp struct {
 	// The handle may be supplied in future ops like ReadFileOp that contain a
 	// file handle. The file system must ensure this ID remains valid until a
 	// later call to ReleaseFileHandle.
-	Handle    HandleID
+	Handle HandleID
+
+	// Set by the file system: see notes on OpenFileOp.BackingID.
+	BackingID BackingID
+
+	OpContext OpContext
+}
+
+// Create a file inode that has no name, and open it. The kernel sends this for
+// an open(2) with O_TMPFILE, which is used for temporary files that vanish
+// when closed, and for files that are written in full before being made
+// visible with linkat(2), which arrives as a CreateLinkOp with this inode as
+// its Target.
+//
+// The inode's link count should be zero until then, and like an unlinked
+// file it lives until its handles are released and the kernel forgets it.
+//
+// If the file system returns ENOSYS, the kernel stops sending this op and
+// fails later O_TMPFILE opens with EOPNOTSUPP.
+type CreateTmpFileOp struct {
+	// The ID of the directory inode on whose file system to create the file.
+	Parent InodeID
+
+	// The mode with which to create the file.
+	Mode os.FileMode
+
+	// The umask of the process making the request. See notes on MkDirOp.Umask.
+	Umask os.FileMode
+
+	// Security labels to apply atomically. See notes on
+	// MkDirOp.SecurityContexts.
+	SecurityContexts []SecurityContext
+
+	// The flags with which the file is being opened, as for
+	// OpenFileOp.OpenFlags. O_EXCL means the file may never be linked.
+	OpenFlags fusekernel.OpenFlags
+
+	// Set by the file system: information about the inode that was created.
+	//
+	// The lookup count for the inode is implicitly incremented. See notes on
+	// ForgetInodeOp for more information.
+	Entry ChildInodeEntry
+
+	// Set by the file system: the handle for the open file, as for
+	// CreateFileOp.Handle.
+	Handle HandleID
+
+	// Set by the file system: see notes on OpenFileOp.BackingID.
+	BackingID BackingID
+
 	OpContext OpContext
 }
 
@@ -370,6 +646,10 @@ type CreateSymlinkOp struct {
 	// The target of the symlink.
 	Target string
 
+	// Security labels to apply atomically. See notes on
+	// MkDirOp.SecurityContexts.
+	SecurityContexts []SecurityContext
+
 	// Set by the file system: information about the symlink inode that was
 	// created.
 	//
@@ -447,6 +727,44 @@ type RenameOp struct {
 	// overwritten within it.
 	NewParent InodeID
 	NewName   string
+
+	// Flags passed to renameat2(2): some combination of RenameNoReplace,
+	// RenameExchange and RenameWhiteout. Always zero unless
+	// MountConfig.EnableRenameFlags is set. The file system should return
+	// EINVAL for flags that it doesn't support.
+	Flags     uint32
+	OpContext OpContext
+}
+
+// Values for RenameOp.Flags, matching RENAME_NOREPLACE, RENAME_EXCHANGE and
+// RENAME_WHITEOUT from renameat2(2).
+const (
+	RenameNoReplace uint32 = 0x1
+	RenameExchange  uint32 = 0x2
+	RenameWhiteout  uint32 = 0x4
+)
+
+// Atomically swap the contents of two files, for exchangedata(2). OS X only:
+// older Mac apps save documents by writing a temporary file and exchanging it
+// with the original, so that the original keeps its inode, and with it its
+// Finder metadata and any aliases to it.
+//
+// Each name must keep its inode, and each inode must end up with the other's
+// contents, size and modification time. Nothing may observe a state in between.
+// The file system should return EINVAL if either entry is not a regular file,
+// and ENOTSUP if it can't exchange them atomically, in which case apps fall
+// back to renaming.
+type ExchangeDataOp struct {
+	// The directory containing the first file, and its name within it.
+	OldParent InodeID
+	OldName   string
+
+	// The directory containing the second file, and its name within it.
+	NewParent InodeID
+	NewName   string
+
+	// The options passed to exchangedata(2), such as FSOPT_NOFOLLOW.
+	Options   uint64
 	OpContext OpContext
 }
 
@@ -589,14 +907,26 @@ type ReadDirOp struct {
 	// The output data should consist of a sequence of FUSE directory entries in
 	// the format generated by fuse_add_direntry (https://tinyurl.com/3r9t7d2p),
 	// which is consumed by parse_dirfile (https://tinyurl.com/bevwty74). Use
-	// fuseutil.WriteDirent to generate this data.
+	// fuseutil.WriteDirent, fuseutil.DirentBuffer or fuseutil.DirStream to
+	// generate this data.
 	//
 	// Each entry returned exposes a directory offset to the user that may later
 	// show up in ReadDirRequest.Offset. See notes on that field for more
 	// information.
+	//
+	// The buffer is owned by the fuse package and recycled once the response
+	// has been sent; it must not be retained after the op returns.
 	Dst []byte
 
-	// Set by the file system: the number of bytes read into Dst.
+	// Set by the file system: alternatively to filling Dst, a list of slices
+	// whose concatenation is the output data. This suits file systems that
+	// keep listings already encoded in chunks. The slices are written to the
+	// kernel without being copied, so they must remain valid and unmodified
+	// until the op returns. If this is non-nil, Dst is ignored.
+	Data [][]byte
+
+	// Set by the file system: the number of bytes read into Dst (or, if Data is
+	// set, the number of bytes of Data to send).
 	//
 	// It is okay for this to be less than len(Dst) if there are not enough
 	// entries available or the final entry would not fit.
@@ -675,8 +1005,36 @@ type OpenFileOp struct {
 	// advance, for example, because contents are generated on the fly.
 	UseDirectIO bool
 
+	// Set by the file system: if non-zero, a backing file registered with
+	// fuse.Connection.OpenBackingFile, to which the kernel then sends the
+	// reads and writes of this handle (and its mmaps) itself, without
+	// ReadFileOp or WriteFileOp reaching the file system. Other ops, including
+	// FlushFileOp and ReleaseFileHandleOp, still do. The handle keeps the
+	// backing file alive, so the ID may be closed once the op returns.
+	//
+	// The kernel fails the open with EIO if the inode is open in the page
+	// cache through another handle, or passed through to a different backing
+	// file. Only honored when fuse.MountConfig.EnablePassthrough is in effect.
+	BackingID BackingID
+
+	// The O_* flags with which the file is being opened: the access mode (see
+	// OpenFlags.IsReadOnly and so on), and flags such as O_APPEND, O_NOATIME and
+	// O_DIRECT (OpenFlags.Append and so on). Compare with the constants in the
+	// syscall package for others, such as O_NONBLOCK.
+	//
+	// The kernel deals with O_CREAT, O_EXCL and O_NOCTTY itself, and sends
+	// O_TRUNC only if fuse.MountConfig.EnableAtomicTrunc is set; otherwise it
+	// truncates with a SetInodeAttributesOp once the file is open. A file
+	// system that can't support the flags should fail the op, for example with
+	// EINVAL for O_DIRECT, or EROFS for writing.
 	OpenFlags fusekernel.OpenFlags
 
+	// Set if the file is being truncated (O_TRUNC) and the file system must
+	// clear its setuid and setgid bits while doing so. Only ever set when the
+	// file system handles this itself; see
+	// fuse.MountConfig.EnableHandleKillPrivV2.
+	KillSuidgid bool
+
 	OpContext OpContext
 }
 
@@ -697,12 +1055,30 @@ type ReadFileOp struct {
 	// The size of the read.
 	Size int64
 
-	// The destination buffer, whose length gives the size of the read.
-	// For vectored reads, this field is always nil as the buffer is not provided.
+	// The destination buffer, whose length gives the size of the read. Unless
+	// MountConfig.UseVectoredRead is set, it is always provided, so the file
+	// system need not allocate one of its own: read into Dst and set BytesRead,
+	// and the data is sent to the kernel without further copying. For vectored
+	// reads, this field is always nil as the buffer is not provided.
+	//
+	// The buffer is page-aligned and belongs to a pool owned by the fuse
+	// package. It is valid only until the op returns (or, if Callback is set,
+	// until Callback returns); the file system must not retain it.
 	Dst []byte
 
 	// Set by the file system:
 	// A list of slices of data to send back to the client for vectored reads.
+	// It may be used whether or not MountConfig.UseVectoredRead is set, for
+	// instance to return data assembled from several cache chunks without
+	// concatenating them; if it is non-nil, Dst is ignored. The slices are
+	// written to the kernel with a single writev, in order, and their total
+	// length must be at least BytesRead. fuseutil.SetReadData builds the list
+	// from chunks covering the read.
+	//
+	// The fuse package doesn't copy these slices: they must remain valid and
+	// unmodified until the response has been sent. Set Callback to learn when
+	// that has happened, e.g. in order to return the slices to a pool of the
+	// file system's own.
 	Data [][]byte
 
 	// Set by the file system: the number of bytes read.
@@ -782,7 +1158,23 @@ type WriteFileOp struct {
 	// be written, except on error (https://tinyurl.com/yuruk5tx). This appears
 	// to be because it uses file mmapping machinery
 	// (https://tinyurl.com/avxy3dvm) to write a page at a time.
-	Data      []byte
+	//
+	// The slice refers directly to the pooled buffer the request was read
+	// into, so that written data is never copied by the fuse package. It is
+	// valid only until the op returns (or, if Callback is set, until Callback
+	// returns): after that the buffer is reused for another request. File
+	// systems that want to keep the data beyond that point (e.g. in a
+	// write-back cache) must copy it, for instance with CopyData.
+	//
+	// The slice's capacity is its length, so appending to it never writes into
+	// the rest of the buffer.
+	Data []byte
+
+	// Set if the file system must clear the setuid and setgid bits of the file
+	// along with writing the data. Only ever set when the file system handles
+	// this itself; see fuse.MountConfig.EnableHandleKillPrivV2.
+	KillSuidgid bool
+
 	OpContext OpContext
 
 	// If set, this function will be invoked after the operation response has been
@@ -791,6 +1183,12 @@ type WriteFileOp struct {
 	Callback func()
 }
 
+// CopyData returns a copy of o.Data that the file system owns, and so may keep
+// after the op returns.
+func (o *WriteFileOp) CopyData() []byte {
+	return append([]byte(nil), o.Data...)
+}
+
 // Synchronize the current contents of an open file to storage.
 //
 // vfs.txt documents this as being called for by the fsync(2) system call
@@ -809,8 +1207,15 @@ type WriteFileOp struct {
 // file (but which is not used in "real" file systems).
 type SyncFileOp struct {
 	// The file and handle being sync'd.
-	Inode     InodeID
-	Handle    HandleID
+	Inode  InodeID
+	Handle HandleID
+
+	// Set for fdatasync(2), in which case only the file's contents, and the
+	// metadata needed to read them back such as its size, need be made
+	// durable. Other metadata like mtime may be left for later, which can save
+	// a round trip to storage for each sync.
+	Datasync bool
+
 	OpContext OpContext
 }
 
@@ -933,11 +1338,17 @@ type GetXattrOp struct {
 
 	// The destination buffer.  If the size is too small for the
 	// value, the ERANGE error should be sent.
+	//
+	// Dst is empty when the caller is probing for the size of the value (by
+	// passing a zero size to getxattr(2)), in which case the file system should
+	// set BytesRead to that size and return nil.
 	Dst []byte
 
 	// Set by the file system: the number of bytes read into Dst, or
 	// the number of bytes that would have been read into Dst if Dst was
-	// big enough (return ERANGE in this case).
+	// big enough (return ERANGE in this case). If the file system sets this to
+	// more than a non-empty Dst can hold and returns nil, ERANGE is sent on its
+	// behalf.
 	BytesRead int
 	OpContext OpContext
 }
@@ -952,13 +1363,18 @@ type ListXattrOp struct {
 	// The destination buffer.  If the size is too small for the
 	// value, the ERANGE error should be sent.
 	//
+	// As for GetXattrOp, Dst is empty when the caller is probing for the size
+	// of the list.
+	//
 	// The output data should consist of a sequence of NUL-terminated strings,
 	// one for each xattr.
 	Dst []byte
 
 	// Set by the file system: the number of bytes read into Dst, or
 	// the number of bytes that would have been read into Dst if Dst was
-	// big enough (return ERANGE in this case).
+	// big enough (return ERANGE in this case). If the file system sets this to
+	// more than a non-empty Dst can hold and returns nil, ERANGE is sent on its
+	// behalf.
 	BytesRead int
 	OpContext OpContext
 }
@@ -977,14 +1393,30 @@ type SetXattrOp struct {
 	// The value to for the extened attribute.
 	Value []byte
 
-	// If Flags is 0x1, and the attribute exists already, EEXIST should be returned.
-	// If Flags is 0x2, and the attribute does not exist, ENOATTR should be returned.
+	// If Flags is XattrCreate (0x1), and the attribute exists already, EEXIST
+	// should be returned.
+	// If Flags is XattrReplace (0x2), and the attribute does not exist, ENOATTR
+	// should be returned.
 	// If Flags is 0x0, the extended attribute will be created if need be, or will
 	// simply replace the value if the attribute exists.
-	Flags     uint32
+	Flags uint32
+
+	// Set if the attribute is a POSIX access ACL and the file system must clear
+	// the setgid bit of the inode along with setting it, as the caller is
+	// neither in the inode's group nor has CAP_FSETID. Only ever set when
+	// fuse.MountConfig.EnableSetxattrExt is in effect.
+	KillSgid bool
+
 	OpContext OpContext
 }
 
+// Values for SetXattrOp.Flags, matching XATTR_CREATE and XATTR_REPLACE from
+// setxattr(2).
+const (
+	XattrCreate  uint32 = 0x1
+	XattrReplace uint32 = 0x2
+)
+
 type FallocateOp struct {
 	// The inode and handle we are fallocating
 	Inode  InodeID
@@ -1005,7 +1437,20 @@ type FallocateOp struct {
 	OpContext OpContext
 }
 
+// Flush everything the file system has buffered to storage. This is sent
+// for syncfs(2), which is what `sync -f` calls, and for sync(2), which syncs
+// every mounted file system.
+//
+// Note that Linux only passes these on for some kinds of mount, such as
+// virtio-fs, and otherwise returns success to the caller without asking the
+// file system, lest an unresponsive server hang sync(2) for the whole
+// machine. File systems that need their data to be durable at particular
+// points should rely on SyncFileOp and FlushFileOp instead.
+//
+// If the file system returns ENOSYS, the kernel stops sending this op and
+// treats later syncs as successful.
 type SyncFSOp struct {
+	// The inode of the file or directory on which syncfs(2) was called.
 	Inode     InodeID
 	OpContext OpContext
 }
@@ -90,11 +90,22 @@ type InodeAttributes struct {
 	// The device number. Only valid if the file is a device
 	Rdev uint32
 
+	// The number of 512-byte blocks allocated to the file, as reported in
+	// st_blocks and by du(1), for file systems that know it, such as those
+	// backed by sparse or compressed storage. If nil, it is estimated from
+	// Size.
+	Blocks *uint64
+
+	// The preferred size for I/O on the file, as reported in st_blksize and
+	// used by programs such as cp(1) to size their buffers. It should be a
+	// power of two. Zero leaves the kernel's default, the page size.
+	BlockSize uint32
+
 	// Time information. See `man 2 stat` for full details.
 	Atime  time.Time // Time of last access
 	Mtime  time.Time // Time of last modification
 	Ctime  time.Time // Time of last modification to inode
-	Crtime time.Time // Time of creation (OS X only)
+	Crtime time.Time // Time of creation (OS X, and Linux >= 6.6 for statx(2))
 
 	// Ownership information
 	Uid uint32
@@ -134,11 +145,24 @@ type GenerationNumber uint64
 // This corresponds to fuse_file_info::fh.
 type HandleID uint64
 
+// BackingID identifies a file registered with the kernel by
+// fuse.Connection.OpenBackingFile, to which ops on a file handle can be passed
+// through. Zero means none.
+type BackingID int32
+
 // DirOffset is an offset into an open directory handle. This is opaque to
 // FUSE, and can be used for whatever purpose the file system desires. See
 // notes on ReadDirOp.Offset for details.
 type DirOffset uint64
 
+// SecurityContext is a security label that the kernel asks the file system to
+// attach to a new inode at creation time. It corresponds to the extended
+// attribute Name (for example "security.selinux") having the value Value.
+type SecurityContext struct {
+	Name  string
+	Value []byte
+}
+
 // ChildInodeEntry contains information about a child inode within its parent
 // directory. It is shared by LookUpInodeOp, MkDirOp, CreateFileOp, etc, and is
 // consumed by the kernel in order to set up a dcache entry.
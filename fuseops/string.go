@@ -0,0 +1,570 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseops
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Every op has a String method, which describes it concisely by its name and
+// the fields that identify what it acts on, for example:
+//
+//	LookUpInode (parent 1, name "foo")
+//	ReadFile (inode 7, handle 3, offset 4096, 4096 bytes)
+//
+// and a DebugString method, which adds the rest of the fields set by the
+// kernel, and the credentials of the caller from its OpContext. Neither
+// describes the fields set by the file system in response.
+
+// A description of an op, built up of its name and a list of details.
+type description struct {
+	name    string
+	details []string
+}
+
+func describe(name string) *description {
+	return &description{name: name}
+}
+
+func (d *description) add(format string, v ...interface{}) *description {
+	d.details = append(d.details, fmt.Sprintf(format, v...))
+	return d
+}
+
+// Add the details of the caller.
+func (d *description) context(oc OpContext) *description {
+	return d.add("fuseid %#x, uid %d, gid %d, pid %d", oc.FuseID, oc.Uid, oc.Gid, oc.Pid)
+}
+
+// Add the security contexts supplied with a new inode.
+func (d *description) securityContexts(scs []SecurityContext) *description {
+	for _, sc := range scs {
+		d.add("security context %s (%d bytes)", sc.Name, len(sc.Value))
+	}
+
+	return d
+}
+
+func (d *description) String() string {
+	if len(d.details) == 0 {
+		return d.name
+	}
+
+	return fmt.Sprintf("%s (%s)", d.name, strings.Join(d.details, ", "))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Ops
+////////////////////////////////////////////////////////////////////////
+
+func (o *InitOp) describe() *description {
+	return describe("Init").add("kernel %d.%d", o.KernelMajor, o.KernelMinor)
+}
+
+func (o *InitOp) String() string { return o.describe().String() }
+
+func (o *InitOp) DebugString() string {
+	return o.describe().
+		add("flags %v", o.KernelFlags).
+		String()
+}
+
+func (o *StatFSOp) describe() *description {
+	return describe("StatFS")
+}
+
+func (o *StatFSOp) String() string { return o.describe().String() }
+
+func (o *StatFSOp) DebugString() string {
+	return o.describe().context(o.OpContext).String()
+}
+
+func (o *LookUpInodeOp) describe() *description {
+	return describe("LookUpInode").add("parent %d", o.Parent).add("name %q", o.Name)
+}
+
+func (o *LookUpInodeOp) String() string { return o.describe().String() }
+
+func (o *LookUpInodeOp) DebugString() string {
+	return o.describe().context(o.OpContext).String()
+}
+
+func (o *GetInodeAttributesOp) describe() *description {
+	d := describe("GetInodeAttributes").add("inode %d", o.Inode)
+	if o.Handle != nil {
+		d.add("handle %d", *o.Handle)
+	}
+
+	if o.Statx {
+		d.add("statx")
+	}
+
+	return d
+}
+
+func (o *GetInodeAttributesOp) String() string { return o.describe().String() }
+
+func (o *GetInodeAttributesOp) DebugString() string {
+	return o.describe().context(o.OpContext).String()
+}
+
+func (o *GetXTimesOp) describe() *description {
+	return describe("GetXTimes").add("inode %d", o.Inode)
+}
+
+func (o *GetXTimesOp) String() string { return o.describe().String() }
+
+func (o *GetXTimesOp) DebugString() string {
+	return o.describe().context(o.OpContext).String()
+}
+
+func (o *SetInodeAttributesOp) describe() *description {
+	d := describe("SetInodeAttributes").add("inode %d", o.Inode)
+	if o.Handle != nil {
+		d.add("handle %d", *o.Handle)
+	}
+
+	if o.Size != nil {
+		d.add("size %d", *o.Size)
+	}
+
+	if o.Mode != nil {
+		d.add("mode %v", *o.Mode)
+	}
+
+	if o.Uid != nil {
+		d.add("uid %d", *o.Uid)
+	}
+
+	if o.Gid != nil {
+		d.add("gid %d", *o.Gid)
+	}
+
+	return d
+}
+
+func (o *SetInodeAttributesOp) String() string { return o.describe().String() }
+
+func (o *SetInodeAttributesOp) DebugString() string {
+	d := o.describe()
+	if o.Atime != nil {
+		d.add("atime %v", *o.Atime)
+	}
+
+	if o.Mtime != nil {
+		d.add("mtime %v", *o.Mtime)
+	}
+
+	if o.Ctime != nil {
+		d.add("ctime %v", *o.Ctime)
+	}
+
+	if o.KillSuidgid {
+		d.add("kill suidgid")
+	}
+
+	return d.add("valid %v", o.Valid).context(o.OpContext).String()
+}
+
+func (o *ForgetInodeOp) describe() *description {
+	return describe("ForgetInode").add("inode %d", o.Inode).add("n %d", o.N)
+}
+
+func (o *ForgetInodeOp) String() string { return o.describe().String() }
+
+func (o *ForgetInodeOp) DebugString() string {
+	return o.describe().context(o.OpContext).String()
+}
+
+func (o *BatchForgetOp) describe() *description {
+	return describe("BatchForget").add("%d entries", len(o.Entries))
+}
+
+func (o *BatchForgetOp) String() string { return o.describe().String() }
+
+func (o *BatchForgetOp) DebugString() string {
+	d := o.describe()
+	for _, e := range o.Entries {
+		d.add("inode %d n %d", e.Inode, e.N)
+	}
+
+	return d.context(o.OpContext).String()
+}
+
+func (o *MkDirOp) describe() *description {
+	return describe("MkDir").add("parent %d", o.Parent).add("name %q", o.Name)
+}
+
+func (o *MkDirOp) String() string { return o.describe().String() }
+
+func (o *MkDirOp) DebugString() string {
+	return o.describe().
+		add("mode %v", o.Mode).
+		add("umask %#o", uint32(o.Umask)).
+		securityContexts(o.SecurityContexts).
+		context(o.OpContext).
+		String()
+}
+
+func (o *MkNodeOp) describe() *description {
+	return describe("MkNode").add("parent %d", o.Parent).add("name %q", o.Name)
+}
+
+func (o *MkNodeOp) String() string { return o.describe().String() }
+
+func (o *MkNodeOp) DebugString() string {
+	return o.describe().
+		add("mode %v", o.Mode).
+		add("umask %#o", uint32(o.Umask)).
+		add("rdev %#x", o.Rdev).
+		securityContexts(o.SecurityContexts).
+		context(o.OpContext).
+		String()
+}
+
+func (o *CreateFileOp) describe() *description {
+	return describe("CreateFile").add("parent %d", o.Parent).add("name %q", o.Name)
+}
+
+func (o *CreateFileOp) String() string { return o.describe().String() }
+
+func (o *CreateFileOp) DebugString() string {
+	d := o.describe().
+		add("mode %v", o.Mode).
+		add("umask %#o", uint32(o.Umask)).
+		add("flags %v", o.OpenFlags).
+		securityContexts(o.SecurityContexts)
+
+	if o.KillSuidgid {
+		d.add("kill suidgid")
+	}
+
+	return d.context(o.OpContext).String()
+}
+
+func (o *CreateTmpFileOp) describe() *description {
+	return describe("CreateTmpFile").add("parent %d", o.Parent)
+}
+
+func (o *CreateTmpFileOp) String() string { return o.describe().String() }
+
+func (o *CreateTmpFileOp) DebugString() string {
+	return o.describe().
+		add("mode %v", o.Mode).
+		add("umask %#o", uint32(o.Umask)).
+		add("flags %v", o.OpenFlags).
+		securityContexts(o.SecurityContexts).
+		context(o.OpContext).
+		String()
+}
+
+func (o *CreateSymlinkOp) describe() *description {
+	return describe("CreateSymlink").add("parent %d", o.Parent).add("name %q", o.Name)
+}
+
+func (o *CreateSymlinkOp) String() string { return o.describe().String() }
+
+func (o *CreateSymlinkOp) DebugString() string {
+	return o.describe().
+		add("target %q", o.Target).
+		securityContexts(o.SecurityContexts).
+		context(o.OpContext).
+		String()
+}
+
+func (o *CreateLinkOp) describe() *description {
+	return describe("CreateLink").
+		add("parent %d", o.Parent).
+		add("name %q", o.Name).
+		add("target %d", o.Target)
+}
+
+func (o *CreateLinkOp) String() string { return o.describe().String() }
+
+func (o *CreateLinkOp) DebugString() string {
+	return o.describe().context(o.OpContext).String()
+}
+
+func (o *RenameOp) describe() *description {
+	d := describe("Rename").
+		add("old_parent %d", o.OldParent).
+		add("old_name %q", o.OldName).
+		add("new_parent %d", o.NewParent).
+		add("new_name %q", o.NewName)
+
+	if o.Flags != 0 {
+		d.add("flags %#x", o.Flags)
+	}
+
+	return d
+}
+
+func (o *RenameOp) String() string { return o.describe().String() }
+
+func (o *RenameOp) DebugString() string {
+	return o.describe().context(o.OpContext).String()
+}
+
+func (o *ExchangeDataOp) describe() *description {
+	d := describe("ExchangeData").
+		add("old_parent %d", o.OldParent).
+		add("old_name %q", o.OldName).
+		add("new_parent %d", o.NewParent).
+		add("new_name %q", o.NewName)
+
+	if o.Options != 0 {
+		d.add("options %#x", o.Options)
+	}
+
+	return d
+}
+
+func (o *ExchangeDataOp) String() string { return o.describe().String() }
+
+func (o *ExchangeDataOp) DebugString() string {
+	return o.describe().context(o.OpContext).String()
+}
+
+func (o *RmDirOp) describe() *description {
+	return describe("RmDir").add("parent %d", o.Parent).add("name %q", o.Name)
+}
+
+func (o *RmDirOp) String() string { return o.describe().String() }
+
+func (o *RmDirOp) DebugString() string {
+	return o.describe().context(o.OpContext).String()
+}
+
+func (o *UnlinkOp) describe() *description {
+	return describe("Unlink").add("parent %d", o.Parent).add("name %q", o.Name)
+}
+
+func (o *UnlinkOp) String() string { return o.describe().String() }
+
+func (o *UnlinkOp) DebugString() string {
+	return o.describe().context(o.OpContext).String()
+}
+
+func (o *OpenDirOp) describe() *description {
+	return describe("OpenDir").add("inode %d", o.Inode)
+}
+
+func (o *OpenDirOp) String() string { return o.describe().String() }
+
+func (o *OpenDirOp) DebugString() string {
+	return o.describe().context(o.OpContext).String()
+}
+
+func (o *ReadDirOp) describe() *description {
+	return describe("ReadDir").
+		add("inode %d", o.Inode).
+		add("handle %d", o.Handle).
+		add("offset %d", o.Offset)
+}
+
+func (o *ReadDirOp) String() string { return o.describe().String() }
+
+func (o *ReadDirOp) DebugString() string {
+	return o.describe().
+		add("%d bytes", len(o.Dst)).
+		context(o.OpContext).
+		String()
+}
+
+func (o *ReleaseDirHandleOp) describe() *description {
+	return describe("ReleaseDirHandle").add("handle %d", o.Handle)
+}
+
+func (o *ReleaseDirHandleOp) String() string { return o.describe().String() }
+
+func (o *ReleaseDirHandleOp) DebugString() string {
+	return o.describe().context(o.OpContext).String()
+}
+
+func (o *OpenFileOp) describe() *description {
+	return describe("OpenFile").add("inode %d", o.Inode)
+}
+
+func (o *OpenFileOp) String() string { return o.describe().String() }
+
+func (o *OpenFileOp) DebugString() string {
+	d := o.describe().add("flags %v", o.OpenFlags)
+	if o.KillSuidgid {
+		d.add("kill suidgid")
+	}
+
+	return d.context(o.OpContext).String()
+}
+
+func (o *ReadFileOp) describe() *description {
+	return describe("ReadFile").
+		add("inode %d", o.Inode).
+		add("handle %d", o.Handle).
+		add("offset %d", o.Offset).
+		add("%d bytes", o.Size)
+}
+
+func (o *ReadFileOp) String() string { return o.describe().String() }
+
+func (o *ReadFileOp) DebugString() string {
+	return o.describe().context(o.OpContext).String()
+}
+
+func (o *WriteFileOp) describe() *description {
+	return describe("WriteFile").
+		add("inode %d", o.Inode).
+		add("handle %d", o.Handle).
+		add("offset %d", o.Offset).
+		add("%d bytes", len(o.Data))
+}
+
+func (o *WriteFileOp) String() string { return o.describe().String() }
+
+func (o *WriteFileOp) DebugString() string {
+	d := o.describe()
+	if o.KillSuidgid {
+		d.add("kill suidgid")
+	}
+
+	return d.context(o.OpContext).String()
+}
+
+func (o *SyncFileOp) describe() *description {
+	d := describe("SyncFile").add("inode %d", o.Inode).add("handle %d", o.Handle)
+	if o.Datasync {
+		d.add("datasync")
+	}
+
+	return d
+}
+
+func (o *SyncFileOp) String() string { return o.describe().String() }
+
+func (o *SyncFileOp) DebugString() string {
+	return o.describe().context(o.OpContext).String()
+}
+
+func (o *FlushFileOp) describe() *description {
+	return describe("FlushFile").add("inode %d", o.Inode).add("handle %d", o.Handle)
+}
+
+func (o *FlushFileOp) String() string { return o.describe().String() }
+
+func (o *FlushFileOp) DebugString() string {
+	return o.describe().context(o.OpContext).String()
+}
+
+func (o *ReleaseFileHandleOp) describe() *description {
+	return describe("ReleaseFileHandle").add("handle %d", o.Handle)
+}
+
+func (o *ReleaseFileHandleOp) String() string { return o.describe().String() }
+
+func (o *ReleaseFileHandleOp) DebugString() string {
+	return o.describe().context(o.OpContext).String()
+}
+
+func (o *ReadSymlinkOp) describe() *description {
+	return describe("ReadSymlink").add("inode %d", o.Inode)
+}
+
+func (o *ReadSymlinkOp) String() string { return o.describe().String() }
+
+func (o *ReadSymlinkOp) DebugString() string {
+	return o.describe().context(o.OpContext).String()
+}
+
+func (o *RemoveXattrOp) describe() *description {
+	return describe("RemoveXattr").add("inode %d", o.Inode).add("name %q", o.Name)
+}
+
+func (o *RemoveXattrOp) String() string { return o.describe().String() }
+
+func (o *RemoveXattrOp) DebugString() string {
+	return o.describe().context(o.OpContext).String()
+}
+
+func (o *GetXattrOp) describe() *description {
+	return describe("GetXattr").add("inode %d", o.Inode).add("name %q", o.Name)
+}
+
+func (o *GetXattrOp) String() string { return o.describe().String() }
+
+func (o *GetXattrOp) DebugString() string {
+	return o.describe().
+		add("%d bytes", len(o.Dst)).
+		context(o.OpContext).
+		String()
+}
+
+func (o *ListXattrOp) describe() *description {
+	return describe("ListXattr").add("inode %d", o.Inode)
+}
+
+func (o *ListXattrOp) String() string { return o.describe().String() }
+
+func (o *ListXattrOp) DebugString() string {
+	return o.describe().
+		add("%d bytes", len(o.Dst)).
+		context(o.OpContext).
+		String()
+}
+
+func (o *SetXattrOp) describe() *description {
+	return describe("SetXattr").add("inode %d", o.Inode).add("name %q", o.Name)
+}
+
+func (o *SetXattrOp) String() string { return o.describe().String() }
+
+func (o *SetXattrOp) DebugString() string {
+	d := o.describe().add("%d bytes", len(o.Value))
+	if o.Flags != 0 {
+		d.add("flags %#x", o.Flags)
+	}
+
+	if o.KillSgid {
+		d.add("kill sgid")
+	}
+
+	return d.context(o.OpContext).String()
+}
+
+func (o *FallocateOp) describe() *description {
+	return describe("Fallocate").
+		add("inode %d", o.Inode).
+		add("handle %d", o.Handle).
+		add("offset %d", o.Offset).
+		add("length %d", o.Length)
+}
+
+func (o *FallocateOp) String() string { return o.describe().String() }
+
+func (o *FallocateOp) DebugString() string {
+	return o.describe().
+		add("mode %#x", o.Mode).
+		context(o.OpContext).
+		String()
+}
+
+func (o *SyncFSOp) describe() *description {
+	return describe("SyncFS").add("inode %d", o.Inode)
+}
+
+func (o *SyncFSOp) String() string { return o.describe().String() }
+
+func (o *SyncFSOp) DebugString() string {
+	return o.describe().context(o.OpContext).String()
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseops
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	size := uint64(17)
+	testCases := []struct {
+		op   fmt.Stringer
+		want string
+	}{
+		{&StatFSOp{}, "StatFS"},
+		{&LookUpInodeOp{Parent: 1, Name: "foo"}, `LookUpInode (parent 1, name "foo")`},
+		{&SetInodeAttributesOp{Inode: 7, Size: &size}, "SetInodeAttributes (inode 7, size 17)"},
+		{
+			&ReadFileOp{Inode: 7, Handle: 3, Offset: 4096, Size: 8192},
+			"ReadFile (inode 7, handle 3, offset 4096, 8192 bytes)",
+		},
+		{
+			&WriteFileOp{Inode: 7, Handle: 3, Offset: 10, Data: []byte("taco")},
+			"WriteFile (inode 7, handle 3, offset 10, 4 bytes)",
+		},
+		{
+			&RenameOp{OldParent: 1, OldName: "foo", NewParent: 2, NewName: "bar"},
+			`Rename (old_parent 1, old_name "foo", new_parent 2, new_name "bar")`,
+		},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.op.String(); got != tc.want {
+			t.Errorf("Got %q, want %q", got, tc.want)
+		}
+	}
+}
+
+func TestDebugString(t *testing.T) {
+	op := &MkDirOp{
+		Parent:    1,
+		Name:      "foo",
+		Mode:      0755,
+		OpContext: OpContext{FuseID: 0x11, Uid: 501, Gid: 20, Pid: 1234},
+	}
+
+	got := op.DebugString()
+	for _, want := range []string{
+		`MkDir (parent 1, name "foo", `,
+		"mode -rwxr-xr-x",
+		"fuseid 0x11, uid 501, gid 20, pid 1234",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%q doesn't contain %q", got, want)
+		}
+	}
+}
+
+// Every op can be described both ways.
+func TestDescribeAllOps(t *testing.T) {
+	ops := []interface {
+		String() string
+		DebugString() string
+	}{
+		&InitOp{},
+		&StatFSOp{},
+		&LookUpInodeOp{},
+		&GetInodeAttributesOp{},
+		&GetXTimesOp{},
+		&SetInodeAttributesOp{},
+		&ForgetInodeOp{},
+		&BatchForgetOp{},
+		&MkDirOp{},
+		&MkNodeOp{},
+		&CreateFileOp{},
+		&CreateTmpFileOp{},
+		&CreateSymlinkOp{},
+		&CreateLinkOp{},
+		&RenameOp{},
+		&ExchangeDataOp{},
+		&RmDirOp{},
+		&UnlinkOp{},
+		&OpenDirOp{},
+		&ReadDirOp{},
+		&ReleaseDirHandleOp{},
+		&OpenFileOp{},
+		&ReadFileOp{},
+		&WriteFileOp{},
+		&SyncFileOp{},
+		&FlushFileOp{},
+		&ReleaseFileHandleOp{},
+		&ReadSymlinkOp{},
+		&RemoveXattrOp{},
+		&GetXattrOp{},
+		&ListXattrOp{},
+		&SetXattrOp{},
+		&FallocateOp{},
+		&SyncFSOp{},
+	}
+
+	for _, op := range ops {
+		// The name matches the type.
+		name := fmt.Sprintf("%T", op)
+		name = strings.TrimSuffix(strings.TrimPrefix(name, "*fuseops."), "Op")
+		if s := op.String(); !strings.HasPrefix(s, name) {
+			t.Errorf("%T: String() = %q", op, s)
+		}
+
+		if s := op.DebugString(); !strings.HasPrefix(s, name) {
+			t.Errorf("%T: DebugString() = %q", op, s)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fuseproxy splits a fuse file system in two, relaying between them
+// over a stream connection such as TCP or a unix domain socket. Mount mounts
+// the file system and relays the kernel's requests to Serve at the other end,
+// which serves them with any fuse.Server, such as one created with
+// fuseutil.NewFileSystemServer:
+//
+//	// In a privileged helper:
+//	err := fuseproxy.Mount("/mnt/foo", conn, &fuse.MountConfig{FSName: "foo"})
+//
+//	// In the file system's process, perhaps on another machine:
+//	err := fuseproxy.Serve(conn, server, &fuse.MountConfig{})
+//
+// This keeps mounting, which may need privileges, apart from the file system,
+// and lets the file system run wherever its backend is.
+//
+// Messages go over the connection in the kernel's own format, so both ends
+// must run on the same operating system and architecture. The connection is
+// neither authenticated nor encrypted: use a unix domain socket with suitable
+// permissions, or a secure tunnel. Features that need the device itself,
+// such as fuse.Connection.OpenBackingFile, are unavailable to the server.
+package fuseproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Large enough for any request or reply, with room for the headers.
+const maxMessageSize = max(buffer.MaxReadSize, buffer.MaxWriteSize) + 1<<16
+
+// Mount mounts a file system on the given directory, relays the kernel's
+// requests over conn to Serve at the other end, and relays back the replies
+// and notifications from there. It blocks until the file system is unmounted,
+// returning nil, or conn fails, in which case it detaches the file system with
+// fuse.UnmountLazy and returns the error. The config is used as for
+// fuse.MountTransport; options for serving belong with Serve.
+func Mount(dir string, conn net.Conn, config *fuse.MountConfig) error {
+	dev, ready, err := fuse.MountTransport(dir, config)
+	if err != nil {
+		return err
+	}
+
+	requests := make(chan error, 1)
+	replies := make(chan error, 1)
+	go func() { requests <- relayRequests(conn, dev) }()
+	go func() { replies <- relayReplies(dev, conn, config) }()
+
+	// On OS X the mount completes only once the server has answered INIT.
+	if err := <-ready; err != nil {
+		conn.Close()
+		dev.Close()
+		return fmt.Errorf("mount (background): %v", err)
+	}
+
+	select {
+	case err = <-requests:
+		// Unmounted, unless err says otherwise. Hanging up tells the server.
+		conn.Close()
+		<-replies
+
+	case err = <-replies:
+		// The server is gone, so nothing can serve the file system.
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+
+		err = fmt.Errorf("Relaying replies: %v", err)
+		if uerr := fuse.UnmountLazy(dir); uerr != nil && config.ErrorLogger != nil {
+			config.ErrorLogger.Printf("UnmountLazy: %v", uerr)
+		}
+	}
+
+	dev.Close()
+	return err
+}
+
+// Copy requests from the kernel to the server until the file system is
+// unmounted, which is reported as nil.
+func relayRequests(w io.Writer, dev fuse.Transport) error {
+	buf := make([]byte, maxMessageSize)
+	for {
+		var n int
+		var err error
+		if fusekernel.IsPlatformFuseT {
+			// fuse-t's socket is a stream.
+			n, err = readMessage(dev, buf, fusekernel.InHeaderSize)
+		} else {
+			n, err = dev.Read(buf)
+		}
+
+		var pe *os.PathError
+		switch {
+		case err == io.EOF:
+			return nil
+
+		case errors.As(err, &pe) && pe.Err == syscall.ENODEV:
+			return nil
+
+		case errors.As(err, &pe) && pe.Err == syscall.EINTR:
+			continue
+
+		case err != nil:
+			return fmt.Errorf("Read: %v", err)
+		}
+
+		if _, err := w.Write(buf[:n]); err != nil {
+			return fmt.Errorf("Write: %v", err)
+		}
+	}
+}
+
+// Copy replies and notifications from the server to the kernel until the
+// server hangs up, which is reported as nil.
+func relayReplies(dev fuse.Transport, r io.Reader, config *fuse.MountConfig) error {
+	br := bufio.NewReaderSize(r, 1<<16)
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := readMessage(br, buf, int(unsafe.Sizeof(fusekernel.OutHeader{})))
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// The kernel refuses replies to requests that have since been
+		// interrupted, which is no reason to stop.
+		if err := dev.Writev([][]byte{buf[:n]}); err != nil {
+			if err == syscall.ENOENT {
+				continue
+			}
+
+			if config.ErrorLogger != nil {
+				config.ErrorLogger.Printf("Writing to the kernel: %v", err)
+			}
+		}
+	}
+}
+
+// Read a message, which like all fuse messages starts with its length, into
+// buf, returning the length. The message must be at least min bytes long.
+// Returns io.EOF only if there's nothing more at all.
+func readMessage(r io.Reader, buf []byte, min int) (int, error) {
+	if _, err := io.ReadFull(r, buf[:4]); err != nil {
+		return 0, err
+	}
+
+	n := int(*(*uint32)(unsafe.Pointer(&buf[0])))
+	if n < min || n > len(buf) {
+		return 0, fmt.Errorf("Bad message length: %d", n)
+	}
+
+	if _, err := io.ReadFull(r, buf[4:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// Serve serves the file system mounted by Mount at the other end of conn with
+// the supplied server, until it is unmounted or conn fails. The config is used
+// as for fuse.Serve; options for mounting belong with Mount.
+func Serve(conn net.Conn, server fuse.Server, config *fuse.MountConfig) error {
+	return fuse.Serve(NewTransport(conn), server, config)
+}
+
+// NewTransport returns a fuse.Transport carrying the messages relayed over
+// conn by Mount, for use with fuse.Serve. It takes ownership of conn.
+func NewTransport(conn net.Conn) fuse.Transport {
+	return &connTransport{
+		conn: conn,
+		r:    bufio.NewReaderSize(conn, 1<<16),
+	}
+}
+
+type connTransport struct {
+	conn net.Conn
+
+	// Only Read reads.
+	r *bufio.Reader
+
+	// Serializes writes.
+	mu sync.Mutex
+}
+
+func (t *connTransport) Read(p []byte) (int, error) {
+	return readMessage(t.r, p, fusekernel.InHeaderSize)
+}
+
+func (t *connTransport) Writev(bufs [][]byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// WriteTo consumes its receiver, not the caller's slice.
+	nb := net.Buffers(bufs)
+	_, err := nb.WriteTo(t.conn)
+	return err
+}
+
+func (t *connTransport) Close() error {
+	return t.conn.Close()
+}
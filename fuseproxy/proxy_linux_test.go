@@ -0,0 +1,160 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseproxy_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseproxy"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/fuse/samples/hellofs"
+	"github.com/jacobsa/timeutil"
+)
+
+func wire(t *testing.T, v any) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+		t.Fatalf("binary.Write: %v", err)
+	}
+
+	return b.Bytes()
+}
+
+// Play the kernel: send a request and return the reply's header and body.
+func roundTrip(
+	t *testing.T,
+	kernel *os.File,
+	opcode uint32,
+	unique uint64,
+	body []byte) (fusekernel.OutHeader, []byte) {
+	t.Helper()
+
+	hdr := fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + len(body)),
+		Opcode: opcode,
+		Unique: unique,
+		Nodeid: fuseops.RootInodeID,
+	}
+
+	if _, err := kernel.Write(append(wire(t, hdr), body...)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	buf := make([]byte, 1<<16)
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	var out fusekernel.OutHeader
+	r := bytes.NewReader(buf[:n])
+	if err := binary.Read(r, binary.LittleEndian, &out); err != nil {
+		t.Fatalf("binary.Read: %v", err)
+	}
+
+	if out.Unique != unique || int(out.Len) != n {
+		t.Fatalf("Unexpected reply header %+v for %d bytes", out, n)
+	}
+
+	return out, buf[n-r.Len() : n]
+}
+
+func TestMountAndServe(t *testing.T) {
+	// The device is a socket pair, which Mount accepts as /dev/fd/N.
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[1]), "kernel")
+	defer kernel.Close()
+
+	server, err := hellofs.NewHelloFS(timeutil.RealClock())
+	if err != nil {
+		t.Fatalf("NewHelloFS: %v", err)
+	}
+
+	helperConn, serverConn := net.Pipe()
+
+	mounted := make(chan error, 1)
+	go func() {
+		dir := fmt.Sprintf("/dev/fd/%d", fds[0])
+		mounted <- fuseproxy.Mount(dir, helperConn, &fuse.MountConfig{})
+	}()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- fuseproxy.Serve(serverConn, server, &fuse.MountConfig{})
+	}()
+
+	// INIT is answered by the server at the other end.
+	out, body := roundTrip(
+		t,
+		kernel,
+		fusekernel.OpInit,
+		1,
+		wire(t, fusekernel.InitIn{Major: 7, Minor: 31}))
+	if out.Error != 0 {
+		t.Fatalf("INIT failed: %d", out.Error)
+	}
+
+	var initOut fusekernel.InitOut
+	binary.Read(bytes.NewReader(body), binary.LittleEndian, &initOut)
+	if initOut.Major != 7 || initOut.Minor != 31 {
+		t.Errorf("Got protocol %d.%d; expected 7.31", initOut.Major, initOut.Minor)
+	}
+
+	// So is GETATTR.
+	out, body = roundTrip(t, kernel, fusekernel.OpGetattr, 2, wire(t, fusekernel.GetattrIn{}))
+	if out.Error != 0 {
+		t.Fatalf("GETATTR failed: %d", out.Error)
+	}
+
+	if len(body) < int(unsafe.Sizeof(fusekernel.AttrOut{})) {
+		t.Fatalf("Short GETATTR reply: %d bytes", len(body))
+	}
+
+	attrOut := (*fusekernel.AttrOut)(unsafe.Pointer(&body[0]))
+	if attrOut.Attr.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		t.Errorf("Got mode %o; expected a directory", attrOut.Attr.Mode)
+	}
+
+	// Hanging up the device, as on unmount, ends both sides.
+	kernel.Close()
+
+	for name, c := range map[string]chan error{"Mount": mounted, "Serve": served} {
+		select {
+		case err := <-c:
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s didn't return", name)
+		}
+	}
+}
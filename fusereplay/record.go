@@ -0,0 +1,421 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fusereplay captures the ops served by a file system and plays them
+// back against another, so that a real workload, such as a build or a git
+// status, can be recorded once and then used as a repeatable benchmark or
+// regression test.
+//
+// Record ops by installing a Recorder, for example with Wrap, which writes a
+// Record for each op as a line of JSON. Load them again with ReadRecords and
+// play them back with Replay.
+//
+// Records hold the inputs of ops and the sizes of the data involved, but not
+// the data itself, so that recordings stay small and free of the contents of
+// files. Replayed writes and xattrs consist of zeros.
+package fusereplay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A Record describes one op and the server's reply to it. Fields that don't
+// apply to the op are zero.
+type Record struct {
+	// The op, as named by fuse.OpName, such as "LookUpInode".
+	Op string `json:"op"`
+
+	// When the op was read, relative to the start of the recording, and how
+	// long the server took to reply to it.
+	Start    time.Duration `json:"start"`
+	Duration time.Duration `json:"duration"`
+
+	// The errno the server replied with, or zero for success, as given by
+	// fuse.ErrnoOf.
+	Errno syscall.Errno `json:"errno,omitempty"`
+
+	// The caller.
+	Uid uint32 `json:"uid,omitempty"`
+	Gid uint32 `json:"gid,omitempty"`
+
+	// The inode the op was addressed to: the inode of interest, or the parent
+	// directory for ops that act on a name within one.
+	Inode fuseops.InodeID `json:"inode,omitempty"`
+	Name  string          `json:"name,omitempty"`
+
+	// The destination of a Rename, and the inode that CreateLink links to.
+	NewParent fuseops.InodeID `json:"new_parent,omitempty"`
+	NewName   string          `json:"new_name,omitempty"`
+
+	// The target of a CreateSymlink, or the one returned by ReadSymlink.
+	Target string `json:"target,omitempty"`
+
+	// The handle the op was addressed to, or for OpenFile, OpenDir,
+	// CreateFile and CreateTmpFile the one that the server returned. See
+	// SetAttributes for SetInodeAttributes.
+	Handle fuseops.HandleID `json:"handle,omitempty"`
+
+	// The offset of a read, write or fallocate, or for ReadDir the offset
+	// within the directory.
+	Offset int64 `json:"offset,omitempty"`
+
+	// The number of bytes asked for by ReadFile, ReadDir, GetXattr and
+	// ListXattr, passed to WriteFile and SetXattr, or covered by Fallocate.
+	Size int64 `json:"size,omitempty"`
+
+	// The number of bytes read by ReadFile, ReadDir, GetXattr and ListXattr.
+	BytesRead int `json:"bytes_read,omitempty"`
+
+	// The mode and umask of a new inode, and the device of a MkNode.
+	Mode  os.FileMode `json:"mode,omitempty"`
+	Umask os.FileMode `json:"umask,omitempty"`
+	Rdev  uint32      `json:"rdev,omitempty"`
+
+	// The open flags of OpenFile, CreateFile and CreateTmpFile, the flags of
+	// Rename and SetXattr, or the mode of Fallocate.
+	Flags uint32 `json:"flags,omitempty"`
+
+	// Whether SyncFile was for fdatasync(2).
+	Datasync bool `json:"datasync,omitempty"`
+
+	// The attributes changed by SetInodeAttributes.
+	Set *SetAttributes `json:"set,omitempty"`
+
+	// The inode returned by ops that look up or create one.
+	Child fuseops.InodeID `json:"child,omitempty"`
+
+	// The lookup counts dropped by ForgetInode, against Inode, and by
+	// BatchForget.
+	N       uint64                     `json:"n,omitempty"`
+	Entries []fuseops.BatchForgetEntry `json:"entries,omitempty"`
+}
+
+// SetAttributes records the attributes changed by a SetInodeAttributes op.
+type SetAttributes struct {
+	// The handle through which the attributes were set, if any.
+	Handle *fuseops.HandleID `json:"handle,omitempty"`
+
+	Size  *uint64      `json:"size,omitempty"`
+	Mode  *os.FileMode `json:"mode,omitempty"`
+	Atime *time.Time   `json:"atime,omitempty"`
+	Mtime *time.Time   `json:"mtime,omitempty"`
+	Ctime *time.Time   `json:"ctime,omitempty"`
+	Uid   *uint32      `json:"uid,omitempty"`
+	Gid   *uint32      `json:"gid,omitempty"`
+}
+
+// ReadRecords reads records written by a Recorder, in the order written.
+func ReadRecords(r io.Reader) ([]Record, error) {
+	var records []Record
+	d := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var rec Record
+		err := d.Decode(&rec)
+		if err == io.EOF {
+			return records, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, rec)
+	}
+}
+
+// Recorder is a fuse.Interceptor that writes a Record for each op, as a line
+// of JSON, once the server has replied to it. Records appear in the order of
+// the replies. Create one with NewRecorder.
+type Recorder struct {
+	// The time at which recording began.
+	start time.Time
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	enc *json.Encoder
+
+	// The first error writing a record.
+	//
+	// GUARDED_BY(mu)
+	err error
+}
+
+var _ fuse.Interceptor = &Recorder{}
+
+// NewRecorder returns a recorder that writes to w. Writes are unbuffered, so
+// supply a bufio.Writer, and flush it once the file system is unmounted, if
+// that matters.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{
+		start: time.Now(),
+		enc:   json.NewEncoder(w),
+	}
+}
+
+// Wrap returns a server that records every op served by the supplied one to
+// w, along with the recorder.
+func Wrap(server fuse.Server, w io.Writer) (fuse.Server, *Recorder) {
+	r := NewRecorder(w)
+	return fuse.Chain(server, r), r
+}
+
+// Err returns the first error writing a record, if any. Records that follow
+// it are dropped.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err
+}
+
+// The time at which an op was read, stored in its context.
+type startKey struct{}
+
+func (r *Recorder) InterceptOp(
+	ctx context.Context,
+	op interface{}) (context.Context, error) {
+	return context.WithValue(ctx, startKey{}, time.Now()), nil
+}
+
+// LOCKS_EXCLUDED(r.mu)
+func (r *Recorder) InterceptReply(
+	ctx context.Context,
+	op interface{},
+	err error) error {
+	rec := newRecord(op)
+	if start, ok := ctx.Value(startKey{}).(time.Time); ok {
+		rec.Start = start.Sub(r.start)
+		rec.Duration = time.Since(start)
+	}
+
+	rec.Errno = fuse.ErrnoOf(err)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err == nil {
+		r.err = r.enc.Encode(&rec)
+	}
+
+	return err
+}
+
+// Describe an op, including the outputs that the server filled in.
+func newRecord(op interface{}) Record {
+	rec := Record{Op: fuse.OpName(op)}
+	if v := reflect.ValueOf(op).Elem().FieldByName("OpContext"); v.IsValid() {
+		oc := v.Interface().(fuseops.OpContext)
+		rec.Uid = oc.Uid
+		rec.Gid = oc.Gid
+	}
+
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		rec.Inode = o.Parent
+		rec.Name = o.Name
+		rec.Child = o.Entry.Child
+
+	case *fuseops.GetInodeAttributesOp:
+		rec.Inode = o.Inode
+
+	case *fuseops.GetXTimesOp:
+		rec.Inode = o.Inode
+
+	case *fuseops.SetInodeAttributesOp:
+		rec.Inode = o.Inode
+		rec.Set = &SetAttributes{
+			Handle: o.Handle,
+			Size:   o.Size,
+			Mode:   o.Mode,
+			Atime:  o.Atime,
+			Mtime:  o.Mtime,
+			Ctime:  o.Ctime,
+			Uid:    o.Uid,
+			Gid:    o.Gid,
+		}
+
+	case *fuseops.ForgetInodeOp:
+		rec.Inode = o.Inode
+		rec.N = o.N
+
+	case *fuseops.BatchForgetOp:
+		rec.Entries = o.Entries
+
+	case *fuseops.MkDirOp:
+		rec.Inode = o.Parent
+		rec.Name = o.Name
+		rec.Mode = o.Mode
+		rec.Umask = o.Umask
+		rec.Child = o.Entry.Child
+
+	case *fuseops.MkNodeOp:
+		rec.Inode = o.Parent
+		rec.Name = o.Name
+		rec.Mode = o.Mode
+		rec.Umask = o.Umask
+		rec.Rdev = o.Rdev
+		rec.Child = o.Entry.Child
+
+	case *fuseops.CreateFileOp:
+		rec.Inode = o.Parent
+		rec.Name = o.Name
+		rec.Mode = o.Mode
+		rec.Umask = o.Umask
+		rec.Flags = uint32(o.OpenFlags)
+		rec.Child = o.Entry.Child
+		rec.Handle = o.Handle
+
+	case *fuseops.CreateTmpFileOp:
+		rec.Inode = o.Parent
+		rec.Mode = o.Mode
+		rec.Umask = o.Umask
+		rec.Flags = uint32(o.OpenFlags)
+		rec.Child = o.Entry.Child
+		rec.Handle = o.Handle
+
+	case *fuseops.CreateSymlinkOp:
+		rec.Inode = o.Parent
+		rec.Name = o.Name
+		rec.Target = o.Target
+		rec.Child = o.Entry.Child
+
+	case *fuseops.CreateLinkOp:
+		rec.Inode = o.Parent
+		rec.Name = o.Name
+		rec.NewParent = o.Target
+		rec.Child = o.Entry.Child
+
+	case *fuseops.RenameOp:
+		rec.Inode = o.OldParent
+		rec.Name = o.OldName
+		rec.NewParent = o.NewParent
+		rec.NewName = o.NewName
+		rec.Flags = o.Flags
+
+	case *fuseops.ExchangeDataOp:
+		rec.Inode = o.OldParent
+		rec.Name = o.OldName
+		rec.NewParent = o.NewParent
+		rec.NewName = o.NewName
+
+	case *fuseops.RmDirOp:
+		rec.Inode = o.Parent
+		rec.Name = o.Name
+
+	case *fuseops.UnlinkOp:
+		rec.Inode = o.Parent
+		rec.Name = o.Name
+
+	case *fuseops.OpenDirOp:
+		rec.Inode = o.Inode
+		rec.Handle = o.Handle
+
+	case *fuseops.ReadDirOp:
+		rec.Inode = o.Inode
+		rec.Handle = o.Handle
+		rec.Offset = int64(o.Offset)
+		rec.Size = int64(len(o.Dst))
+		rec.BytesRead = o.BytesRead
+
+	case *fuseops.ReleaseDirHandleOp:
+		rec.Handle = o.Handle
+
+	case *fuseops.OpenFileOp:
+		rec.Inode = o.Inode
+		rec.Handle = o.Handle
+		rec.Flags = uint32(o.OpenFlags)
+
+	case *fuseops.ReadFileOp:
+		rec.Inode = o.Inode
+		rec.Handle = o.Handle
+		rec.Offset = o.Offset
+		rec.Size = o.Size
+		if rec.Size == 0 {
+			rec.Size = int64(len(o.Dst))
+		}
+
+		rec.BytesRead = o.BytesRead
+
+	case *fuseops.WriteFileOp:
+		rec.Inode = o.Inode
+		rec.Handle = o.Handle
+		rec.Offset = o.Offset
+		rec.Size = int64(len(o.Data))
+
+	case *fuseops.SyncFileOp:
+		rec.Inode = o.Inode
+		rec.Handle = o.Handle
+		rec.Datasync = o.Datasync
+
+	case *fuseops.FlushFileOp:
+		rec.Inode = o.Inode
+		rec.Handle = o.Handle
+
+	case *fuseops.ReleaseFileHandleOp:
+		rec.Handle = o.Handle
+
+	case *fuseops.ReadSymlinkOp:
+		rec.Inode = o.Inode
+		rec.Target = o.Target
+
+	case *fuseops.StatFSOp:
+
+	case *fuseops.SyncFSOp:
+		rec.Inode = o.Inode
+
+	case *fuseops.FallocateOp:
+		rec.Inode = o.Inode
+		rec.Handle = o.Handle
+		rec.Offset = int64(o.Offset)
+		rec.Size = int64(o.Length)
+		rec.Flags = o.Mode
+
+	case *fuseops.GetXattrOp:
+		rec.Inode = o.Inode
+		rec.Name = o.Name
+		rec.Size = int64(len(o.Dst))
+		rec.BytesRead = o.BytesRead
+
+	case *fuseops.ListXattrOp:
+		rec.Inode = o.Inode
+		rec.Size = int64(len(o.Dst))
+		rec.BytesRead = o.BytesRead
+
+	case *fuseops.SetXattrOp:
+		rec.Inode = o.Inode
+		rec.Name = o.Name
+		rec.Size = int64(len(o.Value))
+		rec.Flags = o.Flags
+
+	case *fuseops.RemoveXattrOp:
+		rec.Inode = o.Inode
+		rec.Name = o.Name
+	}
+
+	return rec
+}
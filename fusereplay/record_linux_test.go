@@ -0,0 +1,142 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusereplay_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusereplay"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system with canned results for the ops that TestRecorder sends.
+type cannedFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *cannedFS) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) error {
+	op.Entry.Child = 23
+	return nil
+}
+
+func (fs *cannedFS) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error {
+	op.BytesRead = 100
+	return nil
+}
+
+func (fs *cannedFS) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) error {
+	return syscall.ENOSPC
+}
+
+func (fs *cannedFS) SetInodeAttributes(ctx context.Context, op *fuseops.SetInodeAttributesOp) error {
+	return nil
+}
+
+func (fs *cannedFS) Unlink(ctx context.Context, op *fuseops.UnlinkOp) error {
+	return errors.New("taco")
+}
+
+func TestRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	server, r := fusereplay.Wrap(fuseutil.NewFileSystemServer(&cannedFS{}), &buf)
+
+	c, err := fusetesting.NewConn(server, nil)
+	if err != nil {
+		t.Fatalf("NewConn: %v", err)
+	}
+	defer c.Close()
+
+	do := func(op interface{}, want error) {
+		t.Helper()
+		if err := c.Do(context.Background(), op); err != want {
+			t.Fatalf("Do(%T): got %v, want %v", op, err, want)
+		}
+	}
+
+	do(&fuseops.LookUpInodeOp{
+		Parent:    fuseops.RootInodeID,
+		Name:      "foo",
+		OpContext: fuseops.OpContext{Uid: 17, Gid: 19},
+	}, nil)
+
+	do(&fuseops.ReadFileOp{
+		Inode:  23,
+		Handle: 7,
+		Offset: 4096,
+		Dst:    make([]byte, 8192),
+	}, nil)
+
+	do(&fuseops.WriteFileOp{Inode: 23, Data: []byte("taco")}, syscall.ENOSPC)
+
+	size := uint64(3)
+	do(&fuseops.SetInodeAttributesOp{Inode: 23, Size: &size}, nil)
+
+	// Errors other than errnos reach the kernel as EIO.
+	do(&fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "foo"}, syscall.EIO)
+
+	if err := r.Err(); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+
+	// The data itself stays out of the recording.
+	if bytes.Contains(buf.Bytes(), []byte("taco")) {
+		t.Errorf("Recording contains written data: %s", buf.String())
+	}
+
+	records, err := fusereplay.ReadRecords(&buf)
+	if err != nil {
+		t.Fatalf("ReadRecords: %v", err)
+	}
+
+	if len(records) != 5 {
+		t.Fatalf("Got %d records, want 5", len(records))
+	}
+
+	if rec := records[0]; rec.Op != "LookUpInode" ||
+		rec.Inode != fuseops.RootInodeID ||
+		rec.Name != "foo" ||
+		rec.Child != 23 ||
+		rec.Uid != 17 ||
+		rec.Gid != 19 {
+		t.Errorf("LookUpInode: %+v", rec)
+	}
+
+	if rec := records[1]; rec.Op != "ReadFile" ||
+		rec.Inode != 23 ||
+		rec.Handle != 7 ||
+		rec.Offset != 4096 ||
+		rec.Size != 8192 ||
+		rec.BytesRead != 100 {
+		t.Errorf("ReadFile: %+v", rec)
+	}
+
+	if rec := records[2]; rec.Op != "WriteFile" || rec.Size != 4 || rec.Errno != syscall.ENOSPC {
+		t.Errorf("WriteFile: %+v", rec)
+	}
+
+	if rec := records[3]; rec.Set == nil || rec.Set.Size == nil || *rec.Set.Size != 3 || rec.Set.Mode != nil {
+		t.Errorf("SetInodeAttributes: %+v", rec)
+	}
+
+	if rec := records[4]; rec.Errno != syscall.EIO {
+		t.Errorf("Unlink: %+v", rec)
+	}
+}
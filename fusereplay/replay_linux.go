@@ -0,0 +1,487 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusereplay
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Stats summarizes a replay.
+type Stats struct {
+	// The number of records played back, and the number skipped because they
+	// refer to inodes or handles that the recording doesn't show being created,
+	// or because their ops can't be replayed.
+	Replayed int
+	Skipped  int
+
+	// The number of ops replayed whose outcome, success or a particular errno,
+	// differed from the recording.
+	Mismatches int
+
+	// The time taken by the whole replay, and by the server for each op, keyed
+	// by op name.
+	Elapsed time.Duration
+	ByOp    map[string]OpStats
+}
+
+// OpStats summarizes the replayed ops of one kind.
+type OpStats struct {
+	Count int
+	Total time.Duration
+}
+
+// Replay plays the recorded ops back against the supplied server, which it
+// serves with a fusetesting.Conn, so nothing is mounted. Ops go one at a time
+// in the order in which they were originally read, each as soon as the reply
+// to the previous one arrives, and the inode and handle IDs in the records are
+// translated to those the server hands out as it goes.
+//
+// The server should start out with the same contents as the recorded one did,
+// and the recording should start with the mount, for otherwise ops refer to
+// inodes that the kernel looked up before recording began and must be skipped.
+//
+// Errors from the server are tallied in the stats. The error returned is for
+// a problem with the connection, or ctx being cancelled.
+func Replay(
+	ctx context.Context,
+	server fuse.Server,
+	records []Record) (stats Stats, err error) {
+	conn, err := fusetesting.NewConn(server, nil)
+	if err != nil {
+		return Stats{}, fmt.Errorf("NewConn: %v", err)
+	}
+
+	defer func() {
+		if closeErr := conn.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("Close: %v", closeErr)
+		}
+	}()
+
+	// Replay in the order that the ops were read. An op that depends on the
+	// outcome of another can't have been read before the reply to it.
+	sorted := make([]Record, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+
+	r := &replayer{
+		inodes:  map[fuseops.InodeID]fuseops.InodeID{fuseops.RootInodeID: fuseops.RootInodeID},
+		handles: make(map[fuseops.HandleID]fuseops.HandleID),
+	}
+
+	stats.ByOp = make(map[string]OpStats)
+	start := time.Now()
+
+	for i := range sorted {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		rec := &sorted[i]
+		op, ok := r.op(rec)
+		if !ok {
+			stats.Skipped++
+			continue
+		}
+
+		opStart := time.Now()
+		doErr := conn.Do(ctx, op)
+		d := time.Since(opStart)
+
+		var errno syscall.Errno
+		if doErr != nil {
+			var isErrno bool
+			if errno, isErrno = doErr.(syscall.Errno); !isErrno {
+				return stats, fmt.Errorf("%s: %v", rec.Op, doErr)
+			}
+		}
+
+		stats.Replayed++
+		s := stats.ByOp[rec.Op]
+		s.Count++
+		s.Total += d
+		stats.ByOp[rec.Op] = s
+
+		if errno != rec.Errno {
+			stats.Mismatches++
+			continue
+		}
+
+		if errno == 0 {
+			r.update(rec, op)
+		}
+	}
+
+	stats.Elapsed = time.Since(start)
+	return stats, nil
+}
+
+// The state of a replay: how to translate the IDs in the records.
+type replayer struct {
+	inodes  map[fuseops.InodeID]fuseops.InodeID
+	handles map[fuseops.HandleID]fuseops.HandleID
+
+	// Reused for the data of reads and writes.
+	buf []byte
+}
+
+// Return a buffer of the given size, whose contents are unspecified.
+func (r *replayer) buffer(size int64) []byte {
+	if int64(cap(r.buf)) < size {
+		r.buf = make([]byte, size)
+	}
+
+	return r.buf[:size]
+}
+
+// Return a buffer of zeros of the given size.
+func (r *replayer) zeros(size int64) []byte {
+	b := r.buffer(size)
+	clear(b)
+	return b
+}
+
+// Return the op to send for a record, or false if it must be skipped.
+func (r *replayer) op(rec *Record) (interface{}, bool) {
+	ok := true
+	inode := func(id fuseops.InodeID) fuseops.InodeID {
+		mapped, found := r.inodes[id]
+		ok = ok && found
+		return mapped
+	}
+
+	handle := func(id fuseops.HandleID) fuseops.HandleID {
+		mapped, found := r.handles[id]
+		ok = ok && found
+		return mapped
+	}
+
+	oc := fuseops.OpContext{Uid: rec.Uid, Gid: rec.Gid}
+
+	var op interface{}
+	switch rec.Op {
+	case "LookUpInode":
+		op = &fuseops.LookUpInodeOp{
+			Parent:    inode(rec.Inode),
+			Name:      rec.Name,
+			OpContext: oc,
+		}
+
+	case "GetInodeAttributes":
+		op = &fuseops.GetInodeAttributesOp{
+			Inode:     inode(rec.Inode),
+			OpContext: oc,
+		}
+
+	case "SetInodeAttributes":
+		o := &fuseops.SetInodeAttributesOp{
+			Inode:     inode(rec.Inode),
+			OpContext: oc,
+		}
+
+		if set := rec.Set; set != nil {
+			if set.Handle != nil {
+				h := handle(*set.Handle)
+				o.Handle = &h
+			}
+
+			o.Size = set.Size
+			o.Mode = set.Mode
+			o.Atime = set.Atime
+			o.Mtime = set.Mtime
+			o.Ctime = set.Ctime
+			o.Uid = set.Uid
+			o.Gid = set.Gid
+		}
+
+		op = o
+
+	case "ForgetInode":
+		op = &fuseops.ForgetInodeOp{
+			Inode:     inode(rec.Inode),
+			N:         rec.N,
+			OpContext: oc,
+		}
+
+	case "BatchForget":
+		// Drop the entries for inodes we don't know, rather than the lot.
+		o := &fuseops.BatchForgetOp{OpContext: oc}
+		for _, e := range rec.Entries {
+			if mapped, found := r.inodes[e.Inode]; found {
+				o.Entries = append(o.Entries, fuseops.BatchForgetEntry{Inode: mapped, N: e.N})
+			}
+		}
+
+		ok = len(o.Entries) > 0
+		op = o
+
+	case "MkDir":
+		op = &fuseops.MkDirOp{
+			Parent:    inode(rec.Inode),
+			Name:      rec.Name,
+			Mode:      rec.Mode,
+			Umask:     rec.Umask,
+			OpContext: oc,
+		}
+
+	case "MkNode":
+		op = &fuseops.MkNodeOp{
+			Parent:    inode(rec.Inode),
+			Name:      rec.Name,
+			Mode:      rec.Mode,
+			Umask:     rec.Umask,
+			Rdev:      rec.Rdev,
+			OpContext: oc,
+		}
+
+	case "CreateFile":
+		op = &fuseops.CreateFileOp{
+			Parent:    inode(rec.Inode),
+			Name:      rec.Name,
+			Mode:      rec.Mode,
+			Umask:     rec.Umask,
+			OpenFlags: fusekernel.OpenFlags(rec.Flags),
+			OpContext: oc,
+		}
+
+	case "CreateTmpFile":
+		op = &fuseops.CreateTmpFileOp{
+			Parent:    inode(rec.Inode),
+			Mode:      rec.Mode,
+			Umask:     rec.Umask,
+			OpenFlags: fusekernel.OpenFlags(rec.Flags),
+			OpContext: oc,
+		}
+
+	case "CreateSymlink":
+		op = &fuseops.CreateSymlinkOp{
+			Parent:    inode(rec.Inode),
+			Name:      rec.Name,
+			Target:    rec.Target,
+			OpContext: oc,
+		}
+
+	case "CreateLink":
+		op = &fuseops.CreateLinkOp{
+			Parent:    inode(rec.Inode),
+			Name:      rec.Name,
+			Target:    inode(rec.NewParent),
+			OpContext: oc,
+		}
+
+	case "Rename":
+		op = &fuseops.RenameOp{
+			OldParent: inode(rec.Inode),
+			OldName:   rec.Name,
+			NewParent: inode(rec.NewParent),
+			NewName:   rec.NewName,
+			Flags:     rec.Flags,
+			OpContext: oc,
+		}
+
+	case "RmDir":
+		op = &fuseops.RmDirOp{
+			Parent:    inode(rec.Inode),
+			Name:      rec.Name,
+			OpContext: oc,
+		}
+
+	case "Unlink":
+		op = &fuseops.UnlinkOp{
+			Parent:    inode(rec.Inode),
+			Name:      rec.Name,
+			OpContext: oc,
+		}
+
+	case "OpenDir":
+		op = &fuseops.OpenDirOp{
+			Inode:     inode(rec.Inode),
+			OpContext: oc,
+		}
+
+	case "ReadDir":
+		op = &fuseops.ReadDirOp{
+			Inode:     inode(rec.Inode),
+			Handle:    handle(rec.Handle),
+			Offset:    fuseops.DirOffset(rec.Offset),
+			Dst:       r.buffer(rec.Size),
+			OpContext: oc,
+		}
+
+	case "ReleaseDirHandle":
+		op = &fuseops.ReleaseDirHandleOp{
+			Handle:    handle(rec.Handle),
+			OpContext: oc,
+		}
+
+	case "OpenFile":
+		op = &fuseops.OpenFileOp{
+			Inode:     inode(rec.Inode),
+			OpenFlags: fusekernel.OpenFlags(rec.Flags),
+			OpContext: oc,
+		}
+
+	case "ReadFile":
+		op = &fuseops.ReadFileOp{
+			Inode:     inode(rec.Inode),
+			Handle:    handle(rec.Handle),
+			Offset:    rec.Offset,
+			Dst:       r.buffer(rec.Size),
+			OpContext: oc,
+		}
+
+	case "WriteFile":
+		op = &fuseops.WriteFileOp{
+			Inode:     inode(rec.Inode),
+			Handle:    handle(rec.Handle),
+			Offset:    rec.Offset,
+			Data:      r.zeros(rec.Size),
+			OpContext: oc,
+		}
+
+	case "SyncFile":
+		op = &fuseops.SyncFileOp{
+			Inode:     inode(rec.Inode),
+			Handle:    handle(rec.Handle),
+			Datasync:  rec.Datasync,
+			OpContext: oc,
+		}
+
+	case "FlushFile":
+		op = &fuseops.FlushFileOp{
+			Inode:     inode(rec.Inode),
+			Handle:    handle(rec.Handle),
+			OpContext: oc,
+		}
+
+	case "ReleaseFileHandle":
+		op = &fuseops.ReleaseFileHandleOp{
+			Handle:    handle(rec.Handle),
+			OpContext: oc,
+		}
+
+	case "ReadSymlink":
+		op = &fuseops.ReadSymlinkOp{
+			Inode:     inode(rec.Inode),
+			OpContext: oc,
+		}
+
+	case "StatFS":
+		op = &fuseops.StatFSOp{OpContext: oc}
+
+	case "SyncFS":
+		op = &fuseops.SyncFSOp{
+			Inode:     inode(rec.Inode),
+			OpContext: oc,
+		}
+
+	case "Fallocate":
+		op = &fuseops.FallocateOp{
+			Inode:     inode(rec.Inode),
+			Handle:    handle(rec.Handle),
+			Offset:    uint64(rec.Offset),
+			Length:    uint64(rec.Size),
+			Mode:      rec.Flags,
+			OpContext: oc,
+		}
+
+	case "GetXattr":
+		op = &fuseops.GetXattrOp{
+			Inode:     inode(rec.Inode),
+			Name:      rec.Name,
+			Dst:       r.buffer(rec.Size),
+			OpContext: oc,
+		}
+
+	case "ListXattr":
+		op = &fuseops.ListXattrOp{
+			Inode:     inode(rec.Inode),
+			Dst:       r.buffer(rec.Size),
+			OpContext: oc,
+		}
+
+	case "SetXattr":
+		op = &fuseops.SetXattrOp{
+			Inode:     inode(rec.Inode),
+			Name:      rec.Name,
+			Value:     r.zeros(rec.Size),
+			Flags:     rec.Flags,
+			OpContext: oc,
+		}
+
+	case "RemoveXattr":
+		op = &fuseops.RemoveXattrOp{
+			Inode:     inode(rec.Inode),
+			Name:      rec.Name,
+			OpContext: oc,
+		}
+
+	default:
+		return nil, false
+	}
+
+	return op, ok
+}
+
+// Learn the IDs that the server handed out in reply to an op that succeeded,
+// as it did when recorded.
+func (r *replayer) update(rec *Record, op interface{}) {
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		r.inodes[rec.Child] = o.Entry.Child
+
+	case *fuseops.MkDirOp:
+		r.inodes[rec.Child] = o.Entry.Child
+
+	case *fuseops.MkNodeOp:
+		r.inodes[rec.Child] = o.Entry.Child
+
+	case *fuseops.CreateFileOp:
+		r.inodes[rec.Child] = o.Entry.Child
+		r.handles[rec.Handle] = o.Handle
+
+	case *fuseops.CreateTmpFileOp:
+		r.inodes[rec.Child] = o.Entry.Child
+		r.handles[rec.Handle] = o.Handle
+
+	case *fuseops.CreateSymlinkOp:
+		r.inodes[rec.Child] = o.Entry.Child
+
+	case *fuseops.CreateLinkOp:
+		r.inodes[rec.Child] = o.Entry.Child
+
+	case *fuseops.OpenDirOp:
+		r.handles[rec.Handle] = o.Handle
+
+	case *fuseops.OpenFileOp:
+		r.handles[rec.Handle] = o.Handle
+
+	case *fuseops.ReleaseDirHandleOp:
+		delete(r.handles, rec.Handle)
+
+	case *fuseops.ReleaseFileHandleOp:
+		delete(r.handles, rec.Handle)
+	}
+}
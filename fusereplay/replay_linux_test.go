@@ -0,0 +1,159 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusereplay_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusereplay"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// Run a small workload against a memfs, recording it.
+func record(t *testing.T) []fusereplay.Record {
+	t.Helper()
+
+	var buf bytes.Buffer
+	server, recorder := fusereplay.Wrap(memfs.NewMemFS(0, 0), &buf)
+
+	c, err := fusetesting.NewConn(server, nil)
+	if err != nil {
+		t.Fatalf("NewConn: %v", err)
+	}
+
+	do := func(op interface{}) {
+		t.Helper()
+		if err := c.Do(context.Background(), op); err != nil {
+			t.Fatalf("Do(%T): %v", op, err)
+		}
+	}
+
+	mkDir := &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "dir", Mode: 0755 | os.ModeDir}
+	do(mkDir)
+
+	create := &fuseops.CreateFileOp{
+		Parent:    mkDir.Entry.Child,
+		Name:      "foo",
+		Mode:      0644,
+		OpenFlags: syscall.O_RDWR,
+	}
+	do(create)
+
+	do(&fuseops.WriteFileOp{
+		Inode:  create.Entry.Child,
+		Handle: create.Handle,
+		Data:   bytes.Repeat([]byte("x"), 10000),
+	})
+
+	do(&fuseops.ReleaseFileHandleOp{Handle: create.Handle})
+
+	lookUp := &fuseops.LookUpInodeOp{Parent: mkDir.Entry.Child, Name: "foo"}
+	do(lookUp)
+
+	open := &fuseops.OpenFileOp{Inode: lookUp.Entry.Child, OpenFlags: syscall.O_RDONLY}
+	do(open)
+
+	do(&fuseops.ReadFileOp{
+		Inode:  lookUp.Entry.Child,
+		Handle: open.Handle,
+		Dst:    make([]byte, 4096),
+		Offset: 8192,
+	})
+
+	do(&fuseops.ReleaseFileHandleOp{Handle: open.Handle})
+
+	// A failure, which should fail again when replayed.
+	err = c.Do(context.Background(), &fuseops.LookUpInodeOp{Parent: mkDir.Entry.Child, Name: "bar"})
+	if err != syscall.ENOENT {
+		t.Fatalf("LookUpInode: got %v, want ENOENT", err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if err := recorder.Err(); err != nil {
+		t.Fatalf("Recorder: %v", err)
+	}
+
+	records, err := fusereplay.ReadRecords(&buf)
+	if err != nil {
+		t.Fatalf("ReadRecords: %v", err)
+	}
+
+	return records
+}
+
+func TestReplay(t *testing.T) {
+	records := record(t)
+	if len(records) != 9 {
+		t.Fatalf("Got %d records, want 9", len(records))
+	}
+
+	// Replay against a fresh file system, whose inode IDs and handles need not
+	// match.
+	stats, err := fusereplay.Replay(context.Background(), memfs.NewMemFS(0, 0), records)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+
+	if stats.Replayed != 9 || stats.Skipped != 0 || stats.Mismatches != 0 {
+		t.Errorf("Stats: %+v", stats)
+	}
+
+	if got := stats.ByOp["ReadFile"].Count; got != 1 {
+		t.Errorf("ReadFile count: %d", got)
+	}
+}
+
+func TestReplay_UnknownInode(t *testing.T) {
+	records := []fusereplay.Record{
+		// The kernel looked this inode up before recording began.
+		{Op: "GetInodeAttributes", Inode: 17},
+		{Op: "StatFS"},
+	}
+
+	stats, err := fusereplay.Replay(context.Background(), memfs.NewMemFS(0, 0), records)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+
+	if stats.Replayed != 1 || stats.Skipped != 1 {
+		t.Errorf("Stats: %+v", stats)
+	}
+}
+
+func TestReplay_Mismatch(t *testing.T) {
+	records := []fusereplay.Record{
+		// The file existed when recorded, but doesn't now.
+		{Op: "LookUpInode", Inode: fuseops.RootInodeID, Name: "foo", Child: 2},
+		{Op: "GetInodeAttributes", Inode: 2},
+	}
+
+	stats, err := fusereplay.Replay(context.Background(), memfs.NewMemFS(0, 0), records)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+
+	if stats.Replayed != 1 || stats.Mismatches != 1 || stats.Skipped != 1 {
+		t.Errorf("Stats: %+v", stats)
+	}
+}
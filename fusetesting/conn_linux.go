@@ -0,0 +1,1018 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// The flags offered in the INIT request, roughly those of a recent kernel.
+const connInitFlags = fusekernel.InitAsyncRead |
+	fusekernel.InitAtomicTrunc |
+	fusekernel.InitBigWrites |
+	fusekernel.InitDontMask |
+	fusekernel.InitWritebackCache |
+	fusekernel.InitNoOpenSupport |
+	fusekernel.InitParallelDirOps |
+	fusekernel.InitMaxPages |
+	fusekernel.InitCacheSymlinks |
+	fusekernel.InitNoOpendirSupport |
+	fusekernel.InitExplicitInvalData |
+	fusekernel.InitHandleKillprivV2 |
+	fusekernel.InitSetxattrExt
+
+// Conn plays the part of the kernel for a fuse.Server, so that a file system
+// can be tested without mounting it: no /dev/fuse, no root and no fusermount,
+// which makes it usable in containers and on CI machines that can't mount.
+//
+// Tests construct fuseops ops, hand them to Do, and check the outputs that
+// the server filled in. Ops travel over a socket in the same encoding the
+// kernel uses, so they are decoded and their replies encoded by the real
+// fuse.Connection, and interceptors, observers and the like all take part.
+//
+// Unlike the kernel, a Conn does nothing behind the server's back: there is no
+// page cache, no lookup counting and no permission checking, and an op reaches
+// the server only if a test sends it.
+type Conn struct {
+	kernel *os.File
+	mfs    *fuse.MountedFileSystem
+
+	// The reply to the INIT request.
+	init fusekernel.InitOut
+
+	// The Unique field of the last request sent. The INIT request was 1.
+	lastUnique atomic.Uint64
+
+	// Closed when the reader goroutine has returned.
+	readerDone chan struct{}
+
+	mu sync.Mutex
+
+	// Channels awaiting the replies to outstanding requests, by Unique. The
+	// reader goroutine closes those left when the connection goes away.
+	//
+	// GUARDED_BY(mu)
+	waiting map[uint64]chan connReply
+
+	// The error with which the reader goroutine stopped, if it has.
+	//
+	// GUARDED_BY(mu)
+	readErr error
+
+	// Invalidations received and not yet returned by Invalidations.
+	//
+	// GUARDED_BY(mu)
+	invalidations []Invalidation
+}
+
+// Invalidation is a notification sent by the server with
+// fuse.Connection.InvalidateInode or InvalidateEntry, as recorded by a Conn.
+type Invalidation struct {
+	// The inode, or for InvalidateEntry the parent directory.
+	Inode fuseops.InodeID
+
+	// For InvalidateEntry the name, and otherwise empty.
+	Name string
+
+	// For InvalidateInode the range of contents.
+	Offset int64
+	Length int64
+}
+
+type connReply struct {
+	hdr  fusekernel.OutHeader
+	body []byte
+}
+
+// NewConn starts serving ops from a Conn with the supplied server, and plays
+// the kernel's side of the INIT exchange. A nil config is the same as an
+// empty one. Call Close when done.
+func NewConn(server fuse.Server, config *fuse.MountConfig) (*Conn, error) {
+	if config == nil {
+		config = &fuse.MountConfig{}
+	}
+
+	// A pair of sockets that preserve message boundaries, as /dev/fuse does.
+	// The first goes to the server, the second stays with us.
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Socketpair: %v", err)
+	}
+
+	// Each message must fit into the socket buffers in one piece. The kernel
+	// caps these at net.core.wmem_max and rmem_max, so very large reads and
+	// writes may still fail with EMSGSIZE on some machines.
+	for _, fd := range fds {
+		for _, opt := range []int{syscall.SO_SNDBUF, syscall.SO_RCVBUF} {
+			if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, opt, 8<<20); err != nil {
+				syscall.Close(fds[0])
+				syscall.Close(fds[1])
+				return nil, fmt.Errorf("SetsockoptInt: %v", err)
+			}
+		}
+	}
+
+	// Closing our end must interrupt a read from it, which takes the runtime's
+	// poller, which takes a non-blocking descriptor.
+	if err := syscall.SetNonblock(fds[1], true); err != nil {
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		return nil, fmt.Errorf("SetNonblock: %v", err)
+	}
+
+	c := &Conn{
+		kernel:     os.NewFile(uintptr(fds[1]), "kernel"),
+		readerDone: make(chan struct{}),
+		waiting:    make(map[uint64]chan connReply),
+	}
+	c.lastUnique.Store(1)
+
+	// The connection reads the INIT request as soon as it is created, so send
+	// it first.
+	in := fusekernel.InitIn{
+		Major:        fusekernel.ProtoVersionMaxMajor,
+		Minor:        fusekernel.ProtoVersionMaxMinor,
+		MaxReadahead: 128 << 10,
+		Flags:        uint32(connInitFlags),
+	}
+
+	if err := c.send(fusekernel.OpInit, 1, 0, fuseops.OpContext{}, raw(&in)); err != nil {
+		syscall.Close(fds[0])
+		c.kernel.Close()
+		return nil, err
+	}
+
+	// Mounting at /dev/fd/N uses descriptor N as the connection to the kernel,
+	// and takes ownership of it.
+	c.mfs, err = fuse.Mount(fmt.Sprintf("/dev/fd/%d", fds[0]), server, config)
+	if err != nil {
+		c.kernel.Close()
+		return nil, fmt.Errorf("Mount: %v", err)
+	}
+
+	r, err := c.receive(newReplyBuffer())
+	if err == nil && r.hdr.Error != 0 {
+		err = syscall.Errno(-r.hdr.Error)
+	}
+
+	if err == nil {
+		err = decode(r.body, &c.init)
+	}
+
+	if err != nil {
+		c.kernel.Close()
+		c.mfs.Join(context.Background())
+		return nil, fmt.Errorf("INIT: %v", err)
+	}
+
+	go c.readReplies()
+	return c, nil
+}
+
+// Connection returns the connection through which the server is served, for
+// sending it notifications as a server would.
+func (c *Conn) Connection() *fuse.Connection {
+	return c.mfs.Conn()
+}
+
+// Invalidations returns the invalidations that the server has sent since the
+// last call, oldest first. Like the kernel, a Conn otherwise ignores them.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Conn) Invalidations() []Invalidation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	inv := c.invalidations
+	c.invalidations = nil
+	return inv
+}
+
+// Close hangs up on the server, as unmounting does, and waits for it to reply
+// to any ops it is still serving. It returns the result of Join on the
+// underlying fuse.MountedFileSystem.
+func (c *Conn) Close() error {
+	c.kernel.Close()
+	<-c.readerDone
+	return c.mfs.Join(context.Background())
+}
+
+// Do sends an op to the server as the kernel would, waits for the reply and
+// fills in the op's outputs from it. It returns the error the server replied
+// with, as a syscall.Errno, or an error describing a problem with the
+// connection.
+//
+// The op must be a pointer to one of the fuseops op types that the kernel
+// sends, with its inputs set as the kernel would. Its OpContext supplies the
+// Uid, Gid and Pid of the caller; the other fields of the OpContext are
+// ignored.
+//
+// A few ops differ slightly from what the server sees:
+//
+//   - ReadFileOp asks for Size bytes, or len(Dst) if Size is zero, and copies
+//     the reply into Dst. If Dst is nil it is set to the data read.
+//
+//   - ReadDirOp, GetXattrOp and ListXattrOp ask for len(Dst) bytes and copy the
+//     reply into Dst. For the xattr ops an empty Dst asks for the size only.
+//
+//   - ForgetInodeOp and BatchForgetOp have no reply, so Do returns as soon as
+//     they are sent.
+//
+// If ctx is cancelled before the reply arrives, Do sends an interrupt for the
+// op, as the kernel does when the calling process gets a signal, and then
+// carries on waiting for the reply.
+func (c *Conn) Do(ctx context.Context, op interface{}) error {
+	opcode, nodeid, body, err := c.encode(op)
+	if err != nil {
+		return err
+	}
+
+	var oc fuseops.OpContext
+	if v := reflect.ValueOf(op).Elem().FieldByName("OpContext"); v.IsValid() {
+		oc = v.Interface().(fuseops.OpContext)
+	}
+
+	unique := c.lastUnique.Add(1)
+
+	// There is no reply to wait for to these.
+	if opcode == fusekernel.OpForget || opcode == fusekernel.OpBatchForget {
+		return c.send(opcode, unique, nodeid, oc, body...)
+	}
+
+	ch := make(chan connReply, 1)
+	c.mu.Lock()
+	if c.readErr != nil {
+		err := c.readErr
+		c.mu.Unlock()
+		return err
+	}
+	c.waiting[unique] = ch
+	c.mu.Unlock()
+
+	if err := c.send(opcode, unique, nodeid, oc, body...); err != nil {
+		c.mu.Lock()
+		delete(c.waiting, unique)
+		c.mu.Unlock()
+		return err
+	}
+
+	var r connReply
+	var ok bool
+	select {
+	case r, ok = <-ch:
+	case <-ctx.Done():
+		in := fusekernel.InterruptIn{Unique: unique}
+		if err := c.send(fusekernel.OpInterrupt, c.lastUnique.Add(1), 0, oc, raw(&in)); err != nil {
+			return err
+		}
+
+		r, ok = <-ch
+	}
+
+	if !ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.readErr
+	}
+
+	if r.hdr.Error != 0 {
+		return syscall.Errno(-r.hdr.Error)
+	}
+
+	return c.decodeReply(op, r.body)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Wire format
+////////////////////////////////////////////////////////////////////////
+
+// Return the bytes of a struct in the kernel's encoding, which is the
+// in-memory layout on the machine at hand.
+func raw[T any](v *T) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(v)), unsafe.Sizeof(*v))
+}
+
+// Fill in a struct from the start of a message body.
+func decode[T any](body []byte, v *T) error {
+	b := raw(v)
+	if len(body) < len(b) {
+		return fmt.Errorf("Short reply: %d bytes for %T", len(body), v)
+	}
+
+	copy(b, body)
+	return nil
+}
+
+// Return a string with the terminating NUL that the kernel sends names with.
+func cstr(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// Write a request whose body is the concatenation of the supplied pieces.
+func (c *Conn) send(
+	opcode uint32,
+	unique uint64,
+	nodeid fuseops.InodeID,
+	oc fuseops.OpContext,
+	pieces ...[]byte) error {
+	hdr := fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize),
+		Opcode: opcode,
+		Unique: unique,
+		Nodeid: uint64(nodeid),
+		Uid:    oc.Uid,
+		Gid:    oc.Gid,
+		Pid:    oc.Pid,
+	}
+
+	for _, p := range pieces {
+		hdr.Len += uint32(len(p))
+	}
+
+	msg := make([]byte, 0, hdr.Len)
+	msg = append(msg, raw(&hdr)...)
+	for _, p := range pieces {
+		msg = append(msg, p...)
+	}
+
+	if _, err := c.kernel.Write(msg); err != nil {
+		return fmt.Errorf("Write: %v", err)
+	}
+
+	return nil
+}
+
+// Read the next message from the server into buf, which must have room for
+// the largest, returning a copy of the body.
+func (c *Conn) receive(buf []byte) (connReply, error) {
+	const hdrSize = int(unsafe.Sizeof(fusekernel.OutHeader{}))
+
+	n, err := c.kernel.Read(buf)
+	if err != nil {
+		return connReply{}, err
+	}
+
+	var r connReply
+	if err := decode(buf[:n], &r.hdr); err != nil {
+		return connReply{}, err
+	}
+
+	r.body = append([]byte(nil), buf[hdrSize:n]...)
+	return r, nil
+}
+
+// Return a buffer with room for any message the server sends.
+func newReplyBuffer() []byte {
+	return make([]byte, int(unsafe.Sizeof(fusekernel.OutHeader{}))+buffer.MaxReadSize)
+}
+
+// Hand replies to the calls to Do awaiting them, until the connection goes
+// away.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Conn) readReplies() {
+	defer close(c.readerDone)
+
+	buf := newReplyBuffer()
+	for {
+		r, err := c.receive(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) {
+				err = errors.New("Conn closed")
+			}
+
+			c.mu.Lock()
+			c.readErr = fmt.Errorf("Reading reply: %v", err)
+			for unique, ch := range c.waiting {
+				close(ch)
+				delete(c.waiting, unique)
+			}
+			c.mu.Unlock()
+
+			return
+		}
+
+		// Notifications have a zero Unique, and nobody waits for them.
+		if r.hdr.Unique == 0 {
+			c.notified(r)
+			continue
+		}
+
+		c.mu.Lock()
+		ch, ok := c.waiting[r.hdr.Unique]
+		delete(c.waiting, r.hdr.Unique)
+		c.mu.Unlock()
+
+		if ok {
+			ch <- r
+		}
+	}
+}
+
+// Record a notification, which carries its code in place of an error.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Conn) notified(r connReply) {
+	var inv Invalidation
+	switch r.hdr.Error {
+	case fusekernel.NotifyCodeInvalInode:
+		var out fusekernel.NotifyInvalInodeOut
+		if decode(r.body, &out) != nil {
+			return
+		}
+
+		inv = Invalidation{
+			Inode:  fuseops.InodeID(out.Ino),
+			Offset: out.Off,
+			Length: out.Len,
+		}
+
+	case fusekernel.NotifyCodeInvalEntry:
+		var out fusekernel.NotifyInvalEntryOut
+		if decode(r.body, &out) != nil {
+			return
+		}
+
+		name := r.body[unsafe.Sizeof(out):]
+		if len(name) < int(out.Namelen) {
+			return
+		}
+
+		inv = Invalidation{
+			Inode: fuseops.InodeID(out.Parent),
+			Name:  string(name[:out.Namelen]),
+		}
+
+	default:
+		return
+	}
+
+	c.mu.Lock()
+	c.invalidations = append(c.invalidations, inv)
+	c.mu.Unlock()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Conversions
+////////////////////////////////////////////////////////////////////////
+
+func convertTime(t time.Time) (secs uint64, nsec uint32) {
+	if t.IsZero() {
+		return 0, 0
+	}
+
+	return uint64(t.Unix()), uint32(t.Nanosecond())
+}
+
+func convertAttr(a *fusekernel.Attr) fuseops.InodeAttributes {
+	blocks := a.Blocks
+	return fuseops.InodeAttributes{
+		Size:      a.Size,
+		Blocks:    &blocks,
+		BlockSize: a.Blksize,
+		Nlink:     a.Nlink,
+		Mode:      fuse.ConvertFileMode(a.Mode),
+		Rdev:      a.Rdev,
+		Atime:     time.Unix(int64(a.Atime), int64(a.AtimeNsec)),
+		Mtime:     time.Unix(int64(a.Mtime), int64(a.MtimeNsec)),
+		Ctime:     time.Unix(int64(a.Ctime), int64(a.CtimeNsec)),
+		Crtime:    a.Crtime(),
+		Uid:       a.Uid,
+		Gid:       a.Gid,
+	}
+}
+
+func convertStatx(sx *fusekernel.Statx) fuseops.InodeAttributes {
+	blocks := sx.Blocks
+	a := fuseops.InodeAttributes{
+		Size:      sx.Size,
+		Blocks:    &blocks,
+		BlockSize: sx.Blksize,
+		Nlink:     sx.Nlink,
+		Mode:      fuse.ConvertFileMode(uint32(sx.Mode)),
+		Rdev:      (sx.RdevMinor & 0xff) | (sx.RdevMajor << 8) | ((sx.RdevMinor &^ 0xff) << 12),
+		Atime:     time.Unix(sx.Atime.Sec, int64(sx.Atime.Nsec)),
+		Mtime:     time.Unix(sx.Mtime.Sec, int64(sx.Mtime.Nsec)),
+		Ctime:     time.Unix(sx.Ctime.Sec, int64(sx.Ctime.Nsec)),
+		Uid:       sx.Uid,
+		Gid:       sx.Gid,
+	}
+
+	if sx.Mask&fusekernel.StatxBtime != 0 {
+		a.Crtime = time.Unix(sx.Btime.Sec, int64(sx.Btime.Nsec))
+	}
+
+	return a
+}
+
+// Turn a cache timeout relative to now back into an expiration time. A zero
+// timeout, which is what the server sends for a zero expiration, stays zero.
+func convertExpiration(secs uint64, nsecs uint32) time.Time {
+	if secs == 0 && nsecs == 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(time.Duration(secs)*time.Second + time.Duration(nsecs))
+}
+
+func convertEntry(out *fusekernel.EntryOut) fuseops.ChildInodeEntry {
+	return fuseops.ChildInodeEntry{
+		Child:                fuseops.InodeID(out.Nodeid),
+		Generation:           fuseops.GenerationNumber(out.Generation),
+		Attributes:           convertAttr(&out.Attr),
+		AttributesExpiration: convertExpiration(out.AttrValid, out.AttrValidNsec),
+		EntryExpiration:      convertExpiration(out.EntryValid, out.EntryValidNsec),
+	}
+}
+
+// Return the opcode, inode and body of the request for an op.
+func (c *Conn) encode(op interface{}) (
+	opcode uint32,
+	nodeid fuseops.InodeID,
+	body [][]byte,
+	err error) {
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		return fusekernel.OpLookup, o.Parent, [][]byte{cstr(o.Name)}, nil
+
+	case *fuseops.GetInodeAttributesOp:
+		if o.Statx {
+			in := fusekernel.StatxIn{SxMask: fusekernel.StatxBasicStats | fusekernel.StatxBtime}
+			if o.Handle != nil {
+				in.GetattrFlags = uint32(fusekernel.GetattrFh)
+				in.Fh = uint64(*o.Handle)
+			}
+
+			return fusekernel.OpStatx, o.Inode, [][]byte{raw(&in)}, nil
+		}
+
+		in := fusekernel.GetattrIn{}
+		if o.Handle != nil {
+			in.GetattrFlags = uint32(fusekernel.GetattrFh)
+			in.Fh = uint64(*o.Handle)
+		}
+
+		return fusekernel.OpGetattr, o.Inode, [][]byte{raw(&in)}, nil
+
+	case *fuseops.SetInodeAttributesOp:
+		var in fusekernel.SetattrIn
+		valid := o.Valid
+		if o.Handle != nil {
+			valid |= fusekernel.SetattrHandle
+			in.Fh = uint64(*o.Handle)
+		}
+
+		if o.Uid != nil {
+			valid |= fusekernel.SetattrUid
+			in.Uid = *o.Uid
+		}
+
+		if o.Gid != nil {
+			valid |= fusekernel.SetattrGid
+			in.Gid = *o.Gid
+		}
+
+		if o.Size != nil {
+			valid |= fusekernel.SetattrSize
+			in.Size = *o.Size
+		}
+
+		if o.Mode != nil {
+			valid |= fusekernel.SetattrMode
+			in.Mode = fuse.ConvertGoMode(*o.Mode)
+		}
+
+		if o.Atime != nil {
+			valid |= fusekernel.SetattrAtime
+			in.Atime, in.AtimeNsec = convertTime(*o.Atime)
+		}
+
+		if o.Mtime != nil {
+			valid |= fusekernel.SetattrMtime
+			in.Mtime, in.MtimeNsec = convertTime(*o.Mtime)
+		}
+
+		if o.Ctime != nil {
+			valid |= fusekernel.SetattrCtime
+			in.Ctime, in.CtimeNsec = convertTime(*o.Ctime)
+		}
+
+		if o.KillSuidgid {
+			valid |= fusekernel.SetattrKillSuidgid
+		}
+
+		in.Valid = uint32(valid)
+		return fusekernel.OpSetattr, o.Inode, [][]byte{raw(&in)}, nil
+
+	case *fuseops.ForgetInodeOp:
+		in := fusekernel.ForgetIn{Nlookup: o.N}
+		return fusekernel.OpForget, o.Inode, [][]byte{raw(&in)}, nil
+
+	case *fuseops.BatchForgetOp:
+		count := fusekernel.BatchForgetCountIn{Count: uint32(len(o.Entries))}
+		body = [][]byte{raw(&count)}
+		for _, e := range o.Entries {
+			in := fusekernel.BatchForgetEntryIn{Inode: int64(e.Inode), Nlookup: e.N}
+			body = append(body, raw(&in))
+		}
+
+		return fusekernel.OpBatchForget, 0, body, nil
+
+	case *fuseops.MkDirOp:
+		in := fusekernel.MkdirIn{
+			Mode:  fuse.ConvertGoMode(o.Mode),
+			Umask: uint32(o.Umask & os.ModePerm),
+		}
+
+		return fusekernel.OpMkdir, o.Parent, [][]byte{raw(&in), cstr(o.Name)}, nil
+
+	case *fuseops.MkNodeOp:
+		in := fusekernel.MknodIn{
+			Mode:  fuse.ConvertGoMode(o.Mode),
+			Rdev:  o.Rdev,
+			Umask: uint32(o.Umask & os.ModePerm),
+		}
+
+		return fusekernel.OpMknod, o.Parent, [][]byte{raw(&in), cstr(o.Name)}, nil
+
+	case *fuseops.CreateFileOp:
+		in := fusekernel.CreateIn{
+			Flags: uint32(o.OpenFlags),
+			Mode:  fuse.ConvertGoMode(o.Mode),
+			Umask: uint32(o.Umask & os.ModePerm),
+		}
+
+		if o.KillSuidgid {
+			in.OpenFlags |= fusekernel.OpenInKillSuidgid
+		}
+
+		return fusekernel.OpCreate, o.Parent, [][]byte{raw(&in), cstr(o.Name)}, nil
+
+	case *fuseops.CreateTmpFileOp:
+		in := fusekernel.CreateIn{
+			Flags: uint32(o.OpenFlags),
+			Mode:  fuse.ConvertGoMode(o.Mode),
+			Umask: uint32(o.Umask & os.ModePerm),
+		}
+
+		// Linux names the new file "/", which can't be a real name.
+		return fusekernel.OpTmpfile, o.Parent, [][]byte{raw(&in), cstr("/")}, nil
+
+	case *fuseops.CreateSymlinkOp:
+		return fusekernel.OpSymlink, o.Parent, [][]byte{cstr(o.Name), cstr(o.Target)}, nil
+
+	case *fuseops.CreateLinkOp:
+		in := fusekernel.LinkIn{Oldnodeid: uint64(o.Target)}
+		return fusekernel.OpLink, o.Parent, [][]byte{raw(&in), cstr(o.Name)}, nil
+
+	case *fuseops.RenameOp:
+		names := [][]byte{cstr(o.OldName), cstr(o.NewName)}
+		if o.Flags != 0 {
+			in := fusekernel.Rename2In{Newdir: uint64(o.NewParent), Flags: o.Flags}
+			return fusekernel.OpRename2, o.OldParent, append([][]byte{raw(&in)}, names...), nil
+		}
+
+		in := fusekernel.RenameIn{Newdir: uint64(o.NewParent)}
+		return fusekernel.OpRename, o.OldParent, append([][]byte{raw(&in)}, names...), nil
+
+	case *fuseops.RmDirOp:
+		return fusekernel.OpRmdir, o.Parent, [][]byte{cstr(o.Name)}, nil
+
+	case *fuseops.UnlinkOp:
+		return fusekernel.OpUnlink, o.Parent, [][]byte{cstr(o.Name)}, nil
+
+	case *fuseops.OpenDirOp:
+		in := fusekernel.OpenIn{Flags: uint32(os.O_RDONLY)}
+		return fusekernel.OpOpendir, o.Inode, [][]byte{raw(&in)}, nil
+
+	case *fuseops.ReadDirOp:
+		in := fusekernel.ReadIn{
+			Fh:     uint64(o.Handle),
+			Offset: uint64(o.Offset),
+			Size:   uint32(len(o.Dst)),
+		}
+
+		return fusekernel.OpReaddir, o.Inode, [][]byte{raw(&in)}, nil
+
+	case *fuseops.ReleaseDirHandleOp:
+		in := fusekernel.ReleaseIn{Fh: uint64(o.Handle)}
+		return fusekernel.OpReleasedir, 0, [][]byte{raw(&in)}, nil
+
+	case *fuseops.OpenFileOp:
+		in := fusekernel.OpenIn{Flags: uint32(o.OpenFlags)}
+		if o.KillSuidgid {
+			in.OpenFlags |= fusekernel.OpenInKillSuidgid
+		}
+
+		return fusekernel.OpOpen, o.Inode, [][]byte{raw(&in)}, nil
+
+	case *fuseops.ReadFileOp:
+		size := o.Size
+		if size == 0 {
+			size = int64(len(o.Dst))
+		}
+
+		in := fusekernel.ReadIn{
+			Fh:     uint64(o.Handle),
+			Offset: uint64(o.Offset),
+			Size:   uint32(size),
+		}
+
+		return fusekernel.OpRead, o.Inode, [][]byte{raw(&in)}, nil
+
+	case *fuseops.WriteFileOp:
+		if len(o.Data) > int(c.init.MaxWrite) {
+			return 0, 0, nil, fmt.Errorf(
+				"%d-byte write exceeds MaxWrite of %d", len(o.Data), c.init.MaxWrite)
+		}
+
+		in := fusekernel.WriteIn{
+			Fh:     uint64(o.Handle),
+			Offset: uint64(o.Offset),
+			Size:   uint32(len(o.Data)),
+		}
+
+		if o.KillSuidgid {
+			in.WriteFlags |= uint32(fusekernel.WriteKillSuidgid)
+		}
+
+		return fusekernel.OpWrite, o.Inode, [][]byte{raw(&in), o.Data}, nil
+
+	case *fuseops.SyncFileOp:
+		in := fusekernel.FsyncIn{Fh: uint64(o.Handle)}
+		if o.Datasync {
+			in.FsyncFlags |= fusekernel.FsyncFdatasync
+		}
+
+		return fusekernel.OpFsync, o.Inode, [][]byte{raw(&in)}, nil
+
+	case *fuseops.FlushFileOp:
+		in := fusekernel.FlushIn{Fh: uint64(o.Handle)}
+		return fusekernel.OpFlush, o.Inode, [][]byte{raw(&in)}, nil
+
+	case *fuseops.ReleaseFileHandleOp:
+		in := fusekernel.ReleaseIn{Fh: uint64(o.Handle)}
+		return fusekernel.OpRelease, 0, [][]byte{raw(&in)}, nil
+
+	case *fuseops.ReadSymlinkOp:
+		return fusekernel.OpReadlink, o.Inode, nil, nil
+
+	case *fuseops.StatFSOp:
+		return fusekernel.OpStatfs, fuseops.RootInodeID, nil, nil
+
+	case *fuseops.SyncFSOp:
+		in := fusekernel.SyncFSIn{}
+		return fusekernel.OpSyncFS, o.Inode, [][]byte{raw(&in)}, nil
+
+	case *fuseops.FallocateOp:
+		in := fusekernel.FallocateIn{
+			Fh:     uint64(o.Handle),
+			Offset: o.Offset,
+			Length: o.Length,
+			Mode:   o.Mode,
+		}
+
+		return fusekernel.OpFallocate, o.Inode, [][]byte{raw(&in)}, nil
+
+	case *fuseops.GetXattrOp:
+		var in fusekernel.GetxattrIn
+		in.Size = uint32(len(o.Dst))
+		return fusekernel.OpGetxattr, o.Inode, [][]byte{raw(&in), cstr(o.Name)}, nil
+
+	case *fuseops.ListXattrOp:
+		in := fusekernel.ListxattrIn{Size: uint32(len(o.Dst))}
+		return fusekernel.OpListxattr, o.Inode, [][]byte{raw(&in)}, nil
+
+	case *fuseops.SetXattrOp:
+		if fusekernel.InitFlags(c.init.Flags)&fusekernel.InitSetxattrExt != 0 {
+			var in fusekernel.SetxattrExtIn
+			in.Size = uint32(len(o.Value))
+			in.Flags = o.Flags
+			if o.KillSgid {
+				in.SetxattrFlags |= fusekernel.SetxattrAclKillSgid
+			}
+
+			return fusekernel.OpSetxattr, o.Inode, [][]byte{raw(&in), cstr(o.Name), o.Value}, nil
+		}
+
+		var in fusekernel.SetxattrIn
+		in.Size = uint32(len(o.Value))
+		in.Flags = o.Flags
+		return fusekernel.OpSetxattr, o.Inode, [][]byte{raw(&in), cstr(o.Name), o.Value}, nil
+
+	case *fuseops.RemoveXattrOp:
+		return fusekernel.OpRemovexattr, o.Inode, [][]byte{cstr(o.Name)}, nil
+	}
+
+	return 0, 0, nil, fmt.Errorf("Unsupported op: %T", op)
+}
+
+// Fill in the outputs of an op from the body of a successful reply.
+func (c *Conn) decodeReply(op interface{}, body []byte) error {
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		var out fusekernel.EntryOut
+		if err := decode(body, &out); err != nil {
+			return err
+		}
+
+		o.Entry = convertEntry(&out)
+
+	case *fuseops.GetInodeAttributesOp:
+		if o.Statx {
+			var out fusekernel.StatxOut
+			if err := decode(body, &out); err != nil {
+				return err
+			}
+
+			o.Attributes = convertStatx(&out.Stat)
+			o.AttributesExpiration = convertExpiration(out.AttrValid, out.AttrValidNsec)
+			break
+		}
+
+		var out fusekernel.AttrOut
+		if err := decode(body, &out); err != nil {
+			return err
+		}
+
+		o.Attributes = convertAttr(&out.Attr)
+		o.AttributesExpiration = convertExpiration(out.AttrValid, out.AttrValidNsec)
+
+	case *fuseops.SetInodeAttributesOp:
+		var out fusekernel.AttrOut
+		if err := decode(body, &out); err != nil {
+			return err
+		}
+
+		o.Attributes = convertAttr(&out.Attr)
+		o.AttributesExpiration = convertExpiration(out.AttrValid, out.AttrValidNsec)
+
+	case *fuseops.MkDirOp:
+		var out fusekernel.EntryOut
+		if err := decode(body, &out); err != nil {
+			return err
+		}
+
+		o.Entry = convertEntry(&out)
+
+	case *fuseops.MkNodeOp:
+		var out fusekernel.EntryOut
+		if err := decode(body, &out); err != nil {
+			return err
+		}
+
+		o.Entry = convertEntry(&out)
+
+	case *fuseops.CreateFileOp:
+		var out struct {
+			Entry fusekernel.EntryOut
+			Open  fusekernel.OpenOut
+		}
+
+		if err := decode(body, &out); err != nil {
+			return err
+		}
+
+		o.Entry = convertEntry(&out.Entry)
+		o.Handle = fuseops.HandleID(out.Open.Fh)
+		if out.Open.OpenFlags&uint32(fusekernel.OpenPassthrough) != 0 {
+			o.BackingID = fuseops.BackingID(out.Open.BackingID)
+		}
+
+	case *fuseops.CreateTmpFileOp:
+		var out struct {
+			Entry fusekernel.EntryOut
+			Open  fusekernel.OpenOut
+		}
+
+		if err := decode(body, &out); err != nil {
+			return err
+		}
+
+		o.Entry = convertEntry(&out.Entry)
+		o.Handle = fuseops.HandleID(out.Open.Fh)
+		if out.Open.OpenFlags&uint32(fusekernel.OpenPassthrough) != 0 {
+			o.BackingID = fuseops.BackingID(out.Open.BackingID)
+		}
+
+	case *fuseops.CreateSymlinkOp:
+		var out fusekernel.EntryOut
+		if err := decode(body, &out); err != nil {
+			return err
+		}
+
+		o.Entry = convertEntry(&out)
+
+	case *fuseops.CreateLinkOp:
+		var out fusekernel.EntryOut
+		if err := decode(body, &out); err != nil {
+			return err
+		}
+
+		o.Entry = convertEntry(&out)
+
+	case *fuseops.OpenDirOp:
+		var out fusekernel.OpenOut
+		if err := decode(body, &out); err != nil {
+			return err
+		}
+
+		o.Handle = fuseops.HandleID(out.Fh)
+		o.CacheDir = out.OpenFlags&uint32(fusekernel.OpenCacheDir) != 0
+		o.KeepCache = out.OpenFlags&uint32(fusekernel.OpenKeepCache) != 0
+
+	case *fuseops.ReadDirOp:
+		o.BytesRead = copy(o.Dst, body)
+
+	case *fuseops.OpenFileOp:
+		var out fusekernel.OpenOut
+		if err := decode(body, &out); err != nil {
+			return err
+		}
+
+		o.Handle = fuseops.HandleID(out.Fh)
+		o.KeepPageCache = out.OpenFlags&uint32(fusekernel.OpenKeepCache) != 0
+		o.UseDirectIO = out.OpenFlags&uint32(fusekernel.OpenDirectIO) != 0
+		if out.OpenFlags&uint32(fusekernel.OpenPassthrough) != 0 {
+			o.BackingID = fuseops.BackingID(out.BackingID)
+		}
+
+	case *fuseops.ReadFileOp:
+		if o.Dst == nil {
+			o.Dst = body
+		}
+
+		o.BytesRead = copy(o.Dst, body)
+
+	case *fuseops.ReadSymlinkOp:
+		o.Target = string(body)
+
+	case *fuseops.StatFSOp:
+		var out fusekernel.StatfsOut
+		if err := decode(body, &out); err != nil {
+			return err
+		}
+
+		o.Blocks = out.St.Blocks
+		o.BlocksFree = out.St.Bfree
+		o.BlocksAvailable = out.St.Bavail
+		o.Inodes = out.St.Files
+		o.InodesFree = out.St.Ffree
+		o.IoSize = out.St.Bsize
+		o.BlockSize = out.St.Frsize
+
+	case *fuseops.GetXattrOp:
+		if len(o.Dst) == 0 {
+			var out fusekernel.GetxattrOut
+			if err := decode(body, &out); err != nil {
+				return err
+			}
+
+			o.BytesRead = int(out.Size)
+			break
+		}
+
+		o.BytesRead = copy(o.Dst, body)
+
+	case *fuseops.ListXattrOp:
+		if len(o.Dst) == 0 {
+			var out fusekernel.GetxattrOut
+			if err := decode(body, &out); err != nil {
+				return err
+			}
+
+			o.BytesRead = int(out.Size)
+			break
+		}
+
+		o.BytesRead = copy(o.Dst, body)
+	}
+
+	return nil
+}
@@ -0,0 +1,546 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+func newConn(t *testing.T, server fuse.Server) *fusetesting.Conn {
+	t.Helper()
+
+	c, err := fusetesting.NewConn(server, nil)
+	if err != nil {
+		t.Fatalf("NewConn: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if err := c.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	})
+
+	return c
+}
+
+func do(t *testing.T, c *fusetesting.Conn, op interface{}) {
+	t.Helper()
+
+	if err := c.Do(context.Background(), op); err != nil {
+		t.Fatalf("Do(%T): %v", op, err)
+	}
+}
+
+// Return the names in a buffer of directory entries.
+func direntNames(b []byte) []string {
+	var names []string
+	for len(b) >= 24 {
+		n := int(binary.LittleEndian.Uint32(b[16:]))
+		names = append(names, string(b[24:24+n]))
+
+		size := (24 + n + 7) &^ 7
+		if size > len(b) {
+			break
+		}
+
+		b = b[size:]
+	}
+
+	return names
+}
+
+func TestConn_Memfs(t *testing.T) {
+	c := newConn(t, memfs.NewMemFS(123, 456))
+
+	// Create a file and write to it.
+	create := &fuseops.CreateFileOp{
+		Parent:    fuseops.RootInodeID,
+		Name:      "foo",
+		Mode:      0644,
+		OpenFlags: syscall.O_RDWR,
+	}
+	do(t, c, create)
+
+	if !create.Entry.Attributes.Mode.IsRegular() {
+		t.Errorf("Mode: %v", create.Entry.Attributes.Mode)
+	}
+
+	do(t, c, &fuseops.WriteFileOp{
+		Inode:  create.Entry.Child,
+		Handle: create.Handle,
+		Data:   []byte("taco"),
+	})
+
+	// Look it up and read it back.
+	lookUp := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "foo"}
+	do(t, c, lookUp)
+
+	if lookUp.Entry.Child != create.Entry.Child {
+		t.Errorf("Child: got %v, want %v", lookUp.Entry.Child, create.Entry.Child)
+	}
+
+	if lookUp.Entry.Attributes.Size != 4 {
+		t.Errorf("Size: %v", lookUp.Entry.Attributes.Size)
+	}
+
+	read := &fuseops.ReadFileOp{
+		Inode:  create.Entry.Child,
+		Handle: create.Handle,
+		Size:   100,
+	}
+	do(t, c, read)
+
+	if got := string(read.Dst[:read.BytesRead]); got != "taco" {
+		t.Errorf("Read: %q", got)
+	}
+
+	// Truncate it.
+	size := uint64(2)
+	setAttr := &fuseops.SetInodeAttributesOp{
+		Inode:  create.Entry.Child,
+		Handle: &create.Handle,
+		Size:   &size,
+	}
+	do(t, c, setAttr)
+
+	if setAttr.Attributes.Size != 2 {
+		t.Errorf("Size after truncate: %v", setAttr.Attributes.Size)
+	}
+
+	do(t, c, &fuseops.ReleaseFileHandleOp{Handle: create.Handle})
+
+	// The directory lists it.
+	openDir := &fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+	do(t, c, openDir)
+
+	readDir := &fuseops.ReadDirOp{
+		Inode:  fuseops.RootInodeID,
+		Handle: openDir.Handle,
+		Dst:    make([]byte, 4096),
+	}
+	do(t, c, readDir)
+
+	names := direntNames(readDir.Dst[:readDir.BytesRead])
+	if len(names) != 1 || names[0] != "foo" {
+		t.Errorf("Names: %q", names)
+	}
+
+	// Errors come back as errnos.
+	err := c.Do(context.Background(), &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "bar",
+	})
+
+	if err != syscall.ENOENT {
+		t.Errorf("LookUpInode: got %v, want ENOENT", err)
+	}
+
+	err = c.Do(context.Background(), &fuseops.MkDirOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+		Mode:   0755 | os.ModeDir,
+	})
+
+	if err != syscall.EEXIST {
+		t.Errorf("MkDir: got %v, want EEXIST", err)
+	}
+
+	do(t, c, &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "foo"})
+}
+
+// A file system that records the caller of StatFS.
+type callerFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	caller fuseops.OpContext
+}
+
+func (fs *callerFS) StatFS(ctx context.Context, op *fuseops.StatFSOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.caller = op.OpContext
+	op.Blocks = 100
+	op.BlockSize = 4096
+	return nil
+}
+
+func TestConn_Statx(t *testing.T) {
+	c := newConn(t, memfs.NewMemFS(123, 456))
+
+	before := time.Now()
+	create := &fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+		Mode:   0644,
+	}
+	do(t, c, create)
+
+	// A plain getattr has no room for the creation time on Linux.
+	getattr := &fuseops.GetInodeAttributesOp{Inode: create.Entry.Child}
+	do(t, c, getattr)
+
+	if !getattr.Attributes.Crtime.IsZero() {
+		t.Errorf("getattr Crtime: %v", getattr.Attributes.Crtime)
+	}
+
+	statx := &fuseops.GetInodeAttributesOp{Inode: create.Entry.Child, Statx: true}
+	do(t, c, statx)
+
+	if crtime := statx.Attributes.Crtime; crtime.Before(before) || crtime.After(time.Now()) {
+		t.Errorf("statx Crtime %v not between %v and now", crtime, before)
+	}
+
+	if statx.Attributes.Mode != 0644 || !statx.Attributes.Mtime.Equal(getattr.Attributes.Mtime) {
+		t.Errorf("statx attributes %+v differ from getattr %+v", statx.Attributes, getattr.Attributes)
+	}
+}
+
+func TestConn_TmpFile(t *testing.T) {
+	c := newConn(t, memfs.NewMemFS(123, 456))
+
+	tmp := &fuseops.CreateTmpFileOp{Parent: fuseops.RootInodeID, Mode: 0600}
+	do(t, c, tmp)
+	do(t, c, &fuseops.WriteFileOp{
+		Inode:  tmp.Entry.Child,
+		Handle: tmp.Handle,
+		Data:   []byte("taco"),
+	})
+
+	if n := tmp.Entry.Attributes.Nlink; n != 0 {
+		t.Errorf("Nlink before linking: %d", n)
+	}
+
+	// As for linkat(2) on the open file.
+	do(t, c, &fuseops.CreateLinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+		Target: tmp.Entry.Child,
+	})
+
+	lookUp := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "foo"}
+	do(t, c, lookUp)
+
+	if lookUp.Entry.Child != tmp.Entry.Child {
+		t.Errorf("foo is inode %d, want %d", lookUp.Entry.Child, tmp.Entry.Child)
+	}
+
+	if a := lookUp.Entry.Attributes; a.Nlink != 1 || a.Size != 4 || a.Mode != 0600 {
+		t.Errorf("foo attributes: %+v", a)
+	}
+}
+
+func TestConn_Caller(t *testing.T) {
+	fs := &callerFS{}
+	c := newConn(t, fuseutil.NewFileSystemServer(fs))
+
+	op := &fuseops.StatFSOp{
+		OpContext: fuseops.OpContext{Uid: 17, Gid: 19, Pid: 23},
+	}
+	do(t, c, op)
+
+	fs.mu.Lock()
+	caller := fs.caller
+	fs.mu.Unlock()
+
+	if caller.Uid != 17 || caller.Gid != 19 || caller.Pid != 23 {
+		t.Errorf("Caller: %+v", caller)
+	}
+
+	if op.Blocks != 100 || op.BlockSize != 4096 {
+		t.Errorf("StatFS: %+v", op)
+	}
+}
+
+// A file system whose reads wait to be interrupted.
+type blockingFS struct {
+	fuseutil.NotImplementedFileSystem
+	started chan struct{}
+}
+
+func (fs *blockingFS) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error {
+	close(fs.started)
+	<-ctx.Done()
+	return syscall.EINTR
+}
+
+func TestConn_Interrupt(t *testing.T) {
+	fs := &blockingFS{started: make(chan struct{})}
+	c := newConn(t, fuseutil.NewFileSystemServer(fs))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-fs.started
+		cancel()
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Do(ctx, &fuseops.ReadFileOp{Inode: 2, Size: 10})
+	}()
+
+	select {
+	case err := <-done:
+		if err != syscall.EINTR {
+			t.Errorf("Do: got %v, want EINTR", err)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the interrupted read")
+	}
+}
+
+// A file system that records the last SetXattr op.
+type xattrFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	op fuseops.SetXattrOp
+}
+
+func (fs *xattrFS) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.op = *op
+	return nil
+}
+
+func TestConn_SetxattrExt(t *testing.T) {
+	testCases := []struct {
+		name    string
+		enabled bool
+	}{
+		{"enabled", true},
+		{"disabled", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := &xattrFS{}
+			config := &fuse.MountConfig{EnableSetxattrExt: tc.enabled}
+			c, err := fusetesting.NewConn(fuseutil.NewFileSystemServer(fs), config)
+			if err != nil {
+				t.Fatalf("NewConn: %v", err)
+			}
+			defer c.Close()
+
+			init := c.Connection().InitOp()
+			if got := init.SetxattrExt(); got != tc.enabled {
+				t.Errorf("SetxattrExt() = %v, want %v", got, tc.enabled)
+			}
+
+			// The name and value must come through whichever layout is in use.
+			do(t, c, &fuseops.SetXattrOp{
+				Inode:    fuseops.RootInodeID,
+				Name:     "system.posix_acl_access",
+				Value:    []byte("taco"),
+				KillSgid: true,
+			})
+
+			fs.mu.Lock()
+			got := fs.op
+			fs.mu.Unlock()
+
+			if got.Name != "system.posix_acl_access" || string(got.Value) != "taco" {
+				t.Errorf("got (%q, %q)", got.Name, got.Value)
+			}
+
+			if got.KillSgid != tc.enabled {
+				t.Errorf("KillSgid = %v, want %v", got.KillSgid, tc.enabled)
+			}
+		})
+	}
+}
+
+func TestConn_OnReady(t *testing.T) {
+	var calls int
+	var init fuseops.InitOp
+	config := &fuse.MountConfig{
+		OnReady: func(op fuseops.InitOp) {
+			calls++
+			init = op
+		},
+	}
+
+	c, err := fusetesting.NewConn(memfs.NewMemFS(0, 0), config)
+	if err != nil {
+		t.Fatalf("NewConn: %v", err)
+	}
+
+	defer c.Close()
+
+	if calls != 1 {
+		t.Fatalf("OnReady called %d times, want 1", calls)
+	}
+
+	if init.Major != 7 || init.MaxWrite == 0 {
+		t.Errorf("OnReady got %+v, want protocol 7 and a MaxWrite", init)
+	}
+}
+
+func TestConn_Invalidations(t *testing.T) {
+	c := newConn(t, memfs.NewMemFS(0, 0))
+
+	if err := c.Connection().InvalidateInode(fuseops.RootInodeID, 0, 0); err != nil {
+		t.Fatalf("InvalidateInode: %v", err)
+	}
+
+	if err := c.Connection().InvalidateEntry(fuseops.RootInodeID, "foo"); err != nil {
+		t.Fatalf("InvalidateEntry: %v", err)
+	}
+
+	// The reader records notifications as they arrive, so make sure that it has
+	// got that far.
+	do(t, c, &fuseops.StatFSOp{})
+
+	got := c.Invalidations()
+	want := []fusetesting.Invalidation{
+		{Inode: fuseops.RootInodeID},
+		{Inode: fuseops.RootInodeID, Name: "foo"},
+	}
+
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if got := c.Invalidations(); len(got) != 0 {
+		t.Errorf("got %+v on second call, want none", got)
+	}
+}
+
+func TestConn_Closed(t *testing.T) {
+	c, err := fusetesting.NewConn(memfs.NewMemFS(0, 0), nil)
+	if err != nil {
+		t.Fatalf("NewConn: %v", err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	err = c.Do(context.Background(), &fuseops.StatFSOp{})
+	if err == nil {
+		t.Errorf("Do after Close: got nil error")
+	}
+}
+
+// A file system whose StatFS panics.
+type panickingFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *panickingFS) StatFS(ctx context.Context, op *fuseops.StatFSOp) error {
+	panic("taco")
+}
+
+func TestConn_Panic(t *testing.T) {
+	panics := make(chan fuse.OpPanic, 1)
+	config := &fuse.MountConfig{
+		OnOpPanic: func(p fuse.OpPanic) { panics <- p },
+	}
+
+	c, err := fusetesting.NewConn(fuseutil.NewFileSystemServer(&panickingFS{}), config)
+	if err != nil {
+		t.Fatalf("NewConn: %v", err)
+	}
+	defer c.Close()
+
+	// The op fails, and the panic is reported.
+	err = c.Do(context.Background(), &fuseops.StatFSOp{})
+	if err != syscall.EIO {
+		t.Errorf("StatFS: got %v, want EIO", err)
+	}
+
+	p := <-panics
+	if _, ok := p.Op.(*fuseops.StatFSOp); !ok || p.Value != "taco" {
+		t.Errorf("got panic %v in %T", p.Value, p.Op)
+	}
+
+	if !strings.Contains(p.Stack, "panickingFS).StatFS") {
+		t.Errorf("stack doesn't mention StatFS:\n%s", p.Stack)
+	}
+
+	// Other ops are still served.
+	err = c.Do(context.Background(), &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "foo"})
+	if err != syscall.ENOSYS {
+		t.Errorf("LookUpInode: got %v, want ENOSYS", err)
+	}
+}
+
+// A file system whose ReadFile sets a Callback that panics.
+type panickingCallbackFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *panickingCallbackFS) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error {
+	op.Callback = func() { panic("burrito") }
+	return nil
+}
+
+// Run by TestConn_PanicInCallback, in a copy of the test binary, which is
+// expected to crash.
+func TestConn_PanicInCallbackHelper(t *testing.T) {
+	if os.Getenv("FUSE_TEST_PANIC_IN_CALLBACK") == "" {
+		t.Skip("Not started by TestConn_PanicInCallback")
+	}
+
+	c := newConn(t, fuseutil.NewFileSystemServer(&panickingCallbackFS{}))
+	c.Do(context.Background(), &fuseops.ReadFileOp{Inode: 2, Size: 1})
+}
+
+func TestConn_PanicInCallback(t *testing.T) {
+	path, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Executable: %v", err)
+	}
+
+	// The panic happens after the op has been replied to, so it can't be
+	// turned into an error. It should crash the process as itself rather than
+	// as a second reply to the op.
+	cmd := exec.Command(path, "-test.run=^TestConn_PanicInCallbackHelper$")
+	cmd.Env = append(os.Environ(), "FUSE_TEST_PANIC_IN_CALLBACK=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("helper didn't crash:\n%s", out)
+	}
+
+	if !strings.Contains(string(out), "panic: burrito\n") {
+		t.Errorf("output doesn't report the panic as unrecovered:\n%s", out)
+	}
+
+	if strings.Contains(string(out), "Unknown request ID") {
+		t.Errorf("op was replied to twice:\n%s", out)
+	}
+}
@@ -0,0 +1,373 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/timeutil"
+)
+
+// AttributeCacheConfig configures NewAttributeCachingFS.
+type AttributeCacheConfig struct {
+	// How long the attributes of files (including symlinks and special files)
+	// and of directories may be served from the cache once fetched. Zero
+	// disables caching for that kind of inode.
+	FileTTL time.Duration
+	DirTTL  time.Duration
+
+	// The clock used to expire entries. If nil, timeutil.RealClock() is used.
+	Clock timeutil.Clock
+}
+
+// NewAttributeCachingFS returns a file system that passes ops to the supplied
+// one, remembering the inode attributes that it returns and answering
+// GetInodeAttributes from them until they expire. This is meant for backends
+// where fetching attributes is slow, and is independent of the kernel's own
+// attribute cache, which file systems control with AttributesExpiration.
+//
+// Attributes are remembered from GetInodeAttributes, SetInodeAttributes and
+// every op that returns a fuseops.ChildInodeEntry. An inode's cached
+// attributes are dropped when an op that may change them passes through:
+// writes, truncation, xattr changes, and the creation or removal of entries in
+// it or, for links, of links to it. Because RenameOp, UnlinkOp and RmDirOp
+// don't identify the inode whose link count changes, and ExchangeDataOp
+// doesn't identify the files it changes, they empty the cache.
+// Changes made to the backend by other means are not noticed until the TTL
+// expires. GetInodeAttributes ops that name a handle are always passed on,
+// since the file system may answer them from state kept for the handle.
+func NewAttributeCachingFS(fs FileSystem, cfg AttributeCacheConfig) FileSystem {
+	if cfg.Clock == nil {
+		cfg.Clock = timeutil.RealClock()
+	}
+
+	return &attrCachingFS{
+		FileSystem: fs,
+		cfg:        cfg,
+		entries:    make(map[fuseops.InodeID]attrCacheEntry),
+	}
+}
+
+type attrCachingFS struct {
+	FileSystem
+	cfg AttributeCacheConfig
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	entries map[fuseops.InodeID]attrCacheEntry
+
+	// Incremented by every invalidation, so that attributes fetched before one
+	// are not cached after it.
+	//
+	// GUARDED_BY(mu)
+	generation uint64
+}
+
+type attrCacheEntry struct {
+	attrs fuseops.InodeAttributes
+
+	// The expiration that the wrapped file system gave the kernel.
+	kernelExpiration time.Time
+
+	// When this entry may no longer be used.
+	expiration time.Time
+}
+
+// Return the current generation, to be passed to store once the wrapped file
+// system has returned.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attrCachingFS) currentGeneration() uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.generation
+}
+
+// Cache attributes fetched at the supplied generation, unless something has
+// been invalidated since.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attrCachingFS) store(
+	gen uint64,
+	inode fuseops.InodeID,
+	attrs fuseops.InodeAttributes,
+	kernelExpiration time.Time) {
+	ttl := fs.cfg.FileTTL
+	if attrs.Mode&os.ModeDir != 0 {
+		ttl = fs.cfg.DirTTL
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if gen != fs.generation {
+		return
+	}
+
+	fs.entries[inode] = attrCacheEntry{
+		attrs:            attrs,
+		kernelExpiration: kernelExpiration,
+		expiration:       fs.cfg.Clock.Now().Add(ttl),
+	}
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attrCachingFS) storeEntry(gen uint64, e *fuseops.ChildInodeEntry) {
+	if e.Child == 0 {
+		return
+	}
+
+	fs.store(gen, e.Child, e.Attributes, e.AttributesExpiration)
+}
+
+// Drop the cached attributes for the supplied inodes.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attrCachingFS) invalidate(inodes ...fuseops.InodeID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.generation++
+	for _, inode := range inodes {
+		delete(fs.entries, inode)
+	}
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attrCachingFS) invalidateAll() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.generation++
+	fs.entries = make(map[fuseops.InodeID]attrCacheEntry)
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *attrCachingFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if op.Handle != nil {
+		return fs.FileSystem.GetInodeAttributes(ctx, op)
+	}
+
+	fs.mu.Lock()
+	e, ok := fs.entries[op.Inode]
+	gen := fs.generation
+	if ok && fs.cfg.Clock.Now().After(e.expiration) {
+		delete(fs.entries, op.Inode)
+		ok = false
+	}
+	fs.mu.Unlock()
+
+	if ok {
+		op.Attributes = e.attrs
+		op.AttributesExpiration = e.kernelExpiration
+		return nil
+	}
+
+	if err := fs.FileSystem.GetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	fs.store(gen, op.Inode, op.Attributes, op.AttributesExpiration)
+	return nil
+}
+
+func (fs *attrCachingFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fs.invalidate(op.Inode)
+	gen := fs.currentGeneration()
+
+	if err := fs.FileSystem.SetInodeAttributes(ctx, op); err != nil {
+		fs.invalidate(op.Inode)
+		return err
+	}
+
+	fs.store(gen, op.Inode, op.Attributes, op.AttributesExpiration)
+	return nil
+}
+
+func (fs *attrCachingFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	gen := fs.currentGeneration()
+	if err := fs.FileSystem.LookUpInode(ctx, op); err != nil {
+		return err
+	}
+
+	fs.storeEntry(gen, &op.Entry)
+	return nil
+}
+
+func (fs *attrCachingFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.invalidate(op.Inode)
+	return fs.FileSystem.ForgetInode(ctx, op)
+}
+
+func (fs *attrCachingFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	inodes := make([]fuseops.InodeID, len(op.Entries))
+	for i, e := range op.Entries {
+		inodes[i] = e.Inode
+	}
+
+	fs.invalidate(inodes...)
+	return fs.FileSystem.BatchForget(ctx, op)
+}
+
+func (fs *attrCachingFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	defer fs.invalidate(op.Parent)
+	gen := fs.currentGeneration()
+	if err := fs.FileSystem.MkDir(ctx, op); err != nil {
+		return err
+	}
+
+	fs.storeEntry(gen, &op.Entry)
+	return nil
+}
+
+func (fs *attrCachingFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	defer fs.invalidate(op.Parent)
+	gen := fs.currentGeneration()
+	if err := fs.FileSystem.MkNode(ctx, op); err != nil {
+		return err
+	}
+
+	fs.storeEntry(gen, &op.Entry)
+	return nil
+}
+
+func (fs *attrCachingFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	defer fs.invalidate(op.Parent)
+	gen := fs.currentGeneration()
+	if err := fs.FileSystem.CreateFile(ctx, op); err != nil {
+		return err
+	}
+
+	fs.storeEntry(gen, &op.Entry)
+	return nil
+}
+
+func (fs *attrCachingFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	defer fs.invalidate(op.Parent)
+	gen := fs.currentGeneration()
+	if err := fs.FileSystem.CreateSymlink(ctx, op); err != nil {
+		return err
+	}
+
+	fs.storeEntry(gen, &op.Entry)
+	return nil
+}
+
+func (fs *attrCachingFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	// The target's link count changes, so the attributes returned for it can't
+	// be cached under a generation from before the change.
+	defer fs.invalidate(op.Parent, op.Target)
+	return fs.FileSystem.CreateLink(ctx, op)
+}
+
+func (fs *attrCachingFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	defer fs.invalidateAll()
+	return fs.FileSystem.Rename(ctx, op)
+}
+
+func (fs *attrCachingFS) ExchangeData(
+	ctx context.Context,
+	op *fuseops.ExchangeDataOp) error {
+	// The sizes and times of both files change, and we don't know their inodes.
+	defer fs.invalidateAll()
+	return fs.FileSystem.ExchangeData(ctx, op)
+}
+
+func (fs *attrCachingFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	defer fs.invalidateAll()
+	return fs.FileSystem.RmDir(ctx, op)
+}
+
+func (fs *attrCachingFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	defer fs.invalidateAll()
+	return fs.FileSystem.Unlink(ctx, op)
+}
+
+func (fs *attrCachingFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if op.OpenFlags&fusekernel.OpenTruncate != 0 {
+		defer fs.invalidate(op.Inode)
+	}
+
+	return fs.FileSystem.OpenFile(ctx, op)
+}
+
+func (fs *attrCachingFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	defer fs.invalidate(op.Inode)
+	return fs.FileSystem.WriteFile(ctx, op)
+}
+
+func (fs *attrCachingFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	defer fs.invalidate(op.Inode)
+	return fs.FileSystem.Fallocate(ctx, op)
+}
+
+func (fs *attrCachingFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	defer fs.invalidate(op.Inode)
+	return fs.FileSystem.SetXattr(ctx, op)
+}
+
+func (fs *attrCachingFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	defer fs.invalidate(op.Inode)
+	return fs.FileSystem.RemoveXattr(ctx, op)
+}
@@ -0,0 +1,129 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// A file system with a directory (inode 1) containing a file (inode 2), that
+// counts the attribute fetches it serves.
+type attrFS struct {
+	NotImplementedFileSystem
+	fetches map[fuseops.InodeID]int
+	size    uint64
+}
+
+func (fs *attrFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.fetches[op.Inode]++
+	op.Attributes = fuseops.InodeAttributes{Size: fs.size, Mode: 0644}
+	if op.Inode == 1 {
+		op.Attributes.Mode = os.ModeDir | 0755
+	}
+
+	return nil
+}
+
+func (fs *attrFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.size += uint64(len(op.Data))
+	return nil
+}
+
+func (fs *attrFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return nil
+}
+
+func TestAttributeCachingFS(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	wrapped := &attrFS{fetches: make(map[fuseops.InodeID]int)}
+	fs := NewAttributeCachingFS(wrapped, AttributeCacheConfig{
+		FileTTL: time.Minute,
+		Clock:   &clock,
+	})
+
+	ctx := context.Background()
+	getAttrs := func(inode fuseops.InodeID) fuseops.InodeAttributes {
+		op := &fuseops.GetInodeAttributesOp{Inode: inode}
+		if err := fs.GetInodeAttributes(ctx, op); err != nil {
+			t.Fatalf("GetInodeAttributes: %v", err)
+		}
+
+		return op.Attributes
+	}
+
+	checkFetches := func(inode fuseops.InodeID, want int) {
+		t.Helper()
+		if got := wrapped.fetches[inode]; got != want {
+			t.Errorf("fetches of inode %d: got %d, want %d", inode, got, want)
+		}
+	}
+
+	// The file's attributes are cached...
+	getAttrs(2)
+	getAttrs(2)
+	checkFetches(2, 1)
+
+	// ...but not the directory's, which has no TTL.
+	getAttrs(1)
+	getAttrs(1)
+	checkFetches(1, 2)
+
+	// A write invalidates the file's attributes.
+	if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: 2, Data: []byte("taco")}); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if got := getAttrs(2).Size; got != 4 {
+		t.Errorf("size after write: got %d, want 4", got)
+	}
+	checkFetches(2, 2)
+
+	// So does expiry.
+	getAttrs(2)
+	checkFetches(2, 2)
+	clock.AdvanceTime(time.Minute + time.Second)
+	getAttrs(2)
+	checkFetches(2, 3)
+
+	// Unlinking empties the cache, since the inode's link count changes.
+	if err := fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: 1, Name: "foo"}); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+
+	getAttrs(2)
+	checkFetches(2, 4)
+
+	// Ops that name a handle bypass the cache.
+	handle := fuseops.HandleID(7)
+	if err := fs.GetInodeAttributes(ctx, &fuseops.GetInodeAttributesOp{Inode: 2, Handle: &handle}); err != nil {
+		t.Fatalf("GetInodeAttributes: %v", err)
+	}
+
+	checkFetches(2, 5)
+}
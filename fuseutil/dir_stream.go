@@ -0,0 +1,228 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A DirIterator yields the entries of a directory listing in order, not
+// including "." and "..". Their Offset fields are ignored.
+type DirIterator interface {
+	// Return the next entry, or io.EOF once there are no more and on every
+	// call thereafter.
+	Next(ctx context.Context) (Dirent, error)
+
+	// Release any resources held by the iterator.
+	Close() error
+}
+
+// DirStream serves the fuseops.ReadDirOps for a single directory handle from
+// a DirIterator, so that the file system produces the listing one entry at a
+// time rather than holding it all in memory. It packs as many entries as fit
+// into op.Dst and exposes the position of each as its offset, counting "." and
+// ".." as positions zero and one like DirentBuffer.
+//
+// The kernel normally asks for each batch at the offset where the last one
+// stopped, in which case the stream carries on with the same iterator. When
+// it asks for offset zero, as after rewinddir, or seeks backward, the stream
+// starts a fresh listing and skips entries up to the offset.
+//
+// Create one in OpenDir, for example:
+//
+//	s := fuseutil.NewDirStream(op.Inode, parent, func(ctx context.Context) (fuseutil.DirIterator, error) {
+//		return fs.listChildren(ctx, op.Inode)
+//	})
+//
+// then call its ReadDir from the file system's ReadDir and Close it in
+// ReleaseDirHandle.
+type DirStream struct {
+	self   fuseops.InodeID
+	parent fuseops.InodeID
+	list   func(ctx context.Context) (DirIterator, error)
+
+	mu sync.Mutex
+
+	// The current listing, or nil if none has been started, and the position
+	// of the next entry it will yield. Entries start at position two.
+	//
+	// GUARDED_BY(mu)
+	it  DirIterator
+	pos fuseops.DirOffset
+
+	// An entry taken from it that didn't fit in the last batch, at position
+	// pos, if hasPending is set. Held by value so that listing allocates
+	// nothing per entry.
+	//
+	// GUARDED_BY(mu)
+	pending    Dirent
+	hasPending bool
+}
+
+// NewDirStream returns a stream for a handle on the directory self, whose
+// parent is the supplied inode, that calls list to start each listing.
+func NewDirStream(
+	self fuseops.InodeID,
+	parent fuseops.InodeID,
+	list func(ctx context.Context) (DirIterator, error)) *DirStream {
+	return &DirStream{
+		self:   self,
+		parent: parent,
+		list:   list,
+	}
+}
+
+// ReadDir fills in op.Dst and op.BytesRead with the entries of the listing
+// from op.Offset onward.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *DirStream) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int
+	write := func(d Dirent, pos fuseops.DirOffset) bool {
+		d.Offset = pos + 1
+		m := WriteDirent(op.Dst[n:], d)
+		n += m
+		return m != 0
+	}
+
+	// Offset zero asks for a fresh view of the directory.
+	if op.Offset == 0 {
+		if err := s.reset(); err != nil {
+			return err
+		}
+	}
+
+	// "." and ".." are always at hand.
+	pos := op.Offset
+	if pos == 0 {
+		if !write(Dirent{Inode: s.self, Name: ".", Type: DT_Directory}, 0) {
+			op.BytesRead = n
+			return nil
+		}
+
+		pos++
+	}
+
+	if pos == 1 {
+		if !write(Dirent{Inode: s.parent, Name: "..", Type: DT_Directory}, 1) {
+			op.BytesRead = n
+			return nil
+		}
+
+		pos++
+	}
+
+	if err := s.seek(ctx, pos); err != nil {
+		return err
+	}
+
+	for {
+		var d Dirent
+		if s.hasPending {
+			d = s.pending
+			s.hasPending = false
+		} else {
+			var err error
+			d, err = s.it.Next(ctx)
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				return fmt.Errorf("Next: %v", err)
+			}
+		}
+
+		if !write(d, s.pos) {
+			s.pending = d
+			s.hasPending = true
+			break
+		}
+
+		s.pos++
+	}
+
+	op.BytesRead = n
+	return nil
+}
+
+// Close releases the current listing, if any.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *DirStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.reset()
+}
+
+// Arrange for the next entry yielded to be the one at the supplied position,
+// which is at least two.
+//
+// LOCKS_REQUIRED(s.mu)
+func (s *DirStream) seek(ctx context.Context, pos fuseops.DirOffset) error {
+	if s.it == nil || pos < s.pos {
+		if err := s.reset(); err != nil {
+			return err
+		}
+
+		it, err := s.list(ctx)
+		if err != nil {
+			return err
+		}
+
+		s.it = it
+		s.pos = 2
+	}
+
+	for s.pos < pos {
+		if s.hasPending {
+			s.hasPending = false
+		} else if _, err := s.it.Next(ctx); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Next: %v", err)
+		}
+
+		s.pos++
+	}
+
+	return nil
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *DirStream) reset() error {
+	s.pending = Dirent{}
+	s.hasPending = false
+	if s.it == nil {
+		return nil
+	}
+
+	it := s.it
+	s.it = nil
+	if err := it.Close(); err != nil {
+		return fmt.Errorf("Close: %v", err)
+	}
+
+	return nil
+}
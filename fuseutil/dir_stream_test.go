@@ -0,0 +1,250 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// An iterator over the files file0, file1, ..., counting the calls made to
+// it by all iterators sharing the same counts.
+type countingIterator struct {
+	n      int
+	next   int
+	counts *iteratorCounts
+}
+
+type iteratorCounts struct {
+	lists, nexts, closes int
+}
+
+func (it *countingIterator) Next(ctx context.Context) (Dirent, error) {
+	it.counts.nexts++
+	if it.next == it.n {
+		return Dirent{}, io.EOF
+	}
+
+	d := Dirent{
+		Inode: fuseops.InodeID(100 + it.next),
+		Name:  fmt.Sprintf("file%d", it.next),
+		Type:  DT_File,
+	}
+
+	it.next++
+	return d, nil
+}
+
+func (it *countingIterator) Close() error {
+	it.counts.closes++
+	return nil
+}
+
+func newCountingStream(n int) (*DirStream, *iteratorCounts) {
+	counts := &iteratorCounts{}
+	s := NewDirStream(7, 3, func(ctx context.Context) (DirIterator, error) {
+		counts.lists++
+		return &countingIterator{n: n, counts: counts}, nil
+	})
+
+	return s, counts
+}
+
+// Read the rest of the listing from the supplied offset, with a buffer that
+// holds three short entries at a time.
+func readStream(
+	t *testing.T,
+	s *DirStream,
+	offset fuseops.DirOffset) []Dirent {
+	t.Helper()
+
+	var got []Dirent
+	op := &fuseops.ReadDirOp{Inode: 7, Offset: offset}
+	for {
+		op.Dst = make([]byte, 3*32)
+		if err := s.ReadDir(context.Background(), op); err != nil {
+			t.Fatalf("ReadDir: %v", err)
+		}
+
+		ds := parseDirents(t, op.Dst[:op.BytesRead])
+		if len(ds) == 0 {
+			return got
+		}
+
+		got = append(got, ds...)
+		op.Offset = ds[len(ds)-1].Offset
+	}
+}
+
+func TestDirStream(t *testing.T) {
+	const n = 1000
+	s, counts := newCountingStream(n)
+
+	got := readStream(t, s, 0)
+	want := []Dirent{
+		{Offset: 1, Inode: 7, Name: ".", Type: DT_Directory},
+		{Offset: 2, Inode: 3, Name: "..", Type: DT_Directory},
+	}
+	for i := 0; i < n; i++ {
+		want = append(want, Dirent{
+			Offset: fuseops.DirOffset(i + 3),
+			Inode:  fuseops.InodeID(100 + i),
+			Name:   fmt.Sprintf("file%d", i),
+			Type:   DT_File,
+		})
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("listing:\ngot  %+v\nwant %+v", got, want)
+	}
+
+	// One listing, with each entry produced once and EOF seen on the final
+	// two reads.
+	if counts.lists != 1 || counts.nexts != n+2 {
+		t.Errorf("got %d listings and %d calls to Next, want 1 and %d", counts.lists, counts.nexts, n+2)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if counts.closes != 1 {
+		t.Errorf("got %d calls to Close, want 1", counts.closes)
+	}
+}
+
+func TestDirStream_Seek(t *testing.T) {
+	s, counts := newCountingStream(10)
+
+	full := readStream(t, s, 0)
+	if len(full) != 12 {
+		t.Fatalf("got %d entries, want 12", len(full))
+	}
+
+	// Seeking backward starts a fresh listing, and skips to the offset.
+	if got := readStream(t, s, 6); !reflect.DeepEqual(got, full[6:]) {
+		t.Errorf("from offset 6:\ngot  %+v\nwant %+v", got, full[6:])
+	}
+
+	if counts.lists != 2 || counts.closes != 1 {
+		t.Errorf("got %d listings and %d closes, want 2 and 1", counts.lists, counts.closes)
+	}
+
+	// So does a rewind, even to where the current listing is.
+	if got := readStream(t, s, 0); !reflect.DeepEqual(got, full) {
+		t.Errorf("after rewind:\ngot  %+v\nwant %+v", got, full)
+	}
+
+	if counts.lists != 3 {
+		t.Errorf("got %d listings, want 3", counts.lists)
+	}
+}
+
+// An iterator over a fixed listing.
+type sliceIterator struct {
+	entries []Dirent
+	next    int
+}
+
+func (it *sliceIterator) Next(ctx context.Context) (Dirent, error) {
+	if it.next == len(it.entries) {
+		return Dirent{}, io.EOF
+	}
+
+	it.next++
+	return it.entries[it.next-1], nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
+
+func newSliceStream(n int) *DirStream {
+	entries := make([]Dirent, n)
+	for i := range entries {
+		entries[i] = Dirent{
+			Inode: fuseops.InodeID(100 + i),
+			Name:  fmt.Sprintf("file%07d", i),
+			Type:  DT_File,
+		}
+	}
+
+	return NewDirStream(7, 3, func(ctx context.Context) (DirIterator, error) {
+		return &sliceIterator{entries: entries}, nil
+	})
+}
+
+// Read a whole listing from the start in batches the size of dst, as the
+// kernel does, returning the number of entries. Allocates nothing itself.
+func listAll(s *DirStream, dst []byte) (int, error) {
+	var count int
+	op := fuseops.ReadDirOp{Inode: 7, Dst: dst}
+	for {
+		if err := s.ReadDir(context.Background(), &op); err != nil {
+			return 0, err
+		}
+
+		if op.BytesRead == 0 {
+			return count, nil
+		}
+
+		// Carry on from the offset of the last entry.
+		b := dst[:op.BytesRead]
+		for len(b) > 0 {
+			op.Offset = fuseops.DirOffset(binary.LittleEndian.Uint64(b[8:]))
+			nameLen := int(binary.LittleEndian.Uint32(b[16:]))
+			b = b[(24+nameLen+7)&^7:]
+			count++
+		}
+	}
+}
+
+func TestDirStream_Allocs(t *testing.T) {
+	const n = 1000
+	s := newSliceStream(n)
+	dst := make([]byte, 4096)
+
+	// Each listing costs an iterator, but the entries cost nothing.
+	allocs := testing.AllocsPerRun(10, func() {
+		if count, err := listAll(s, dst); err != nil || count != n+2 {
+			t.Fatalf("listAll: got %d entries, error %v", count, err)
+		}
+	})
+
+	if allocs > 1 {
+		t.Errorf("got %v allocations per listing of %d entries", allocs, n)
+	}
+}
+
+func BenchmarkDirStream(b *testing.B) {
+	const n = 1 << 20
+	s := newSliceStream(n)
+	dst := make([]byte, 4096)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := listAll(s, dst); err != nil {
+			b.Fatalf("listAll: %v", err)
+		}
+	}
+}
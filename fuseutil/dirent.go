@@ -15,8 +15,8 @@
 package fuseutil
 
 import (
+	"encoding/binary"
 	"syscall"
-	"unsafe"
 
 	"github.com/jacobsa/fuse/fuseops"
 )
@@ -53,53 +53,114 @@ type Dirent struct {
 // Write the supplied directory entry into the given buffer in the format
 // expected in fuseops.ReadFileOp.Data, returning the number of bytes written.
 // Return zero if the entry would not fit.
+//
+// The entry is encoded in place, without allocating, so that a listing can be
+// written straight into fuseops.ReadDirOp.Dst, which is part of the buffer
+// for the reply.
 func WriteDirent(buf []byte, d Dirent) (n int) {
 	// We want to write bytes with the layout of fuse_dirent
-	// (https://tinyurl.com/4k7y2h9r) in host order. The struct must be aligned
-	// according to FUSE_DIRENT_ALIGN (https://tinyurl.com/3m3ewu7h), which
-	// dictates 8-byte alignment.
-	type fuse_dirent struct {
-		ino     uint64
-		off     uint64
-		namelen uint32
-		type_   uint32
-		name    [0]byte
-	}
-
+	// (https://tinyurl.com/4k7y2h9r) in host order, followed by the name. The
+	// whole must be padded according to FUSE_DIRENT_ALIGN
+	// (https://tinyurl.com/3m3ewu7h), which dictates 8-byte alignment.
 	const direntAlignment = 8
 	const direntSize = 8 + 8 + 4 + 4
 
-	// Compute the number of bytes of padding we'll need to maintain alignment
-	// for the next entry.
-	var padLen int
-	if len(d.Name)%direntAlignment != 0 {
-		padLen = direntAlignment - (len(d.Name) % direntAlignment)
-	}
-
 	// Do we have enough room?
-	totalLen := direntSize + len(d.Name) + padLen
+	nameEnd := direntSize + len(d.Name)
+	totalLen := (nameEnd + direntAlignment - 1) &^ (direntAlignment - 1)
 	if totalLen > len(buf) {
-		return n
+		return 0
 	}
 
-	// Write the header.
-	de := fuse_dirent{
-		ino:     uint64(d.Inode),
-		off:     uint64(d.Offset),
-		namelen: uint32(len(d.Name)),
-		type_:   uint32(d.Type),
+	// Write the header, then the name, then zeros up to the next entry.
+	binary.NativeEndian.PutUint64(buf[0:], uint64(d.Inode))
+	binary.NativeEndian.PutUint64(buf[8:], uint64(d.Offset))
+	binary.NativeEndian.PutUint32(buf[16:], uint32(len(d.Name)))
+	binary.NativeEndian.PutUint32(buf[20:], uint32(d.Type))
+	copy(buf[direntSize:], d.Name)
+	clear(buf[nameEnd:totalLen])
+
+	return totalLen
+}
+
+// DirentBuffer builds the reply to a fuseops.ReadDirOp from a directory
+// listing, taking care of the entries "." and "..", the offsets exposed to the
+// kernel and resuming a listing partway through.
+//
+// The file system offers the entries of the directory to Add in the same
+// order each time, starting from the first, and stops once Add returns false.
+// Entries before op.Offset are skipped, and the entry at position i of the
+// listing, counting "." and ".." as positions zero and one, is given offset
+// i+1. For example:
+//
+//	b := fuseutil.NewDirentBuffer(op, op.Inode, parent)
+//	for _, e := range entries {
+//		if !b.Add(e) {
+//			break
+//		}
+//	}
+//
+//	op.BytesRead = len(b.Bytes())
+//
+// Because offsets are positions, entries added to or removed from the
+// directory between calls may cause others to be skipped or repeated by a
+// listing that is in progress, which Posix permits.
+type DirentBuffer struct {
+	dst []byte
+	n   int
+
+	// The offset at which to resume, and the offset that the next entry offered
+	// to Add will be given.
+	start fuseops.DirOffset
+	next  fuseops.DirOffset
+
+	// Set once an entry didn't fit.
+	full bool
+}
+
+// NewDirentBuffer returns a buffer that writes into op.Dst, and that has
+// already been offered "." and "..", referring to the supplied inodes.
+func NewDirentBuffer(
+	op *fuseops.ReadDirOp,
+	self fuseops.InodeID,
+	parent fuseops.InodeID) *DirentBuffer {
+	b := &DirentBuffer{
+		dst:   op.Dst,
+		start: op.Offset,
 	}
 
-	n += copy(buf[n:], (*[direntSize]byte)(unsafe.Pointer(&de))[:])
+	b.Add(Dirent{Inode: self, Name: ".", Type: DT_Directory})
+	b.Add(Dirent{Inode: parent, Name: "..", Type: DT_Directory})
+
+	return b
+}
+
+// Add offers the next entry of the listing. Its Offset field is ignored. Add
+// returns false if the buffer is full, in which case the entry has not been
+// written and the file system should stop.
+func (b *DirentBuffer) Add(d Dirent) bool {
+	if b.full {
+		return false
+	}
 
-	// Write the name afterward.
-	n += copy(buf[n:], d.Name)
+	b.next++
+	if b.next <= b.start {
+		return true
+	}
 
-	// Add any necessary padding.
-	if padLen != 0 {
-		var padding [direntAlignment]byte
-		n += copy(buf[n:], padding[:padLen])
+	d.Offset = b.next
+	n := WriteDirent(b.dst[b.n:], d)
+	if n == 0 {
+		b.full = true
+		return false
 	}
 
-	return n
+	b.n += n
+	return true
+}
+
+// Bytes returns the entries written so far, which share storage with op.Dst.
+// Its length is the value for op.BytesRead.
+func (b *DirentBuffer) Bytes() []byte {
+	return b.dst[:b.n]
 }
@@ -0,0 +1,115 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Decode the output of WriteDirent.
+func parseDirents(t *testing.T, b []byte) []Dirent {
+	t.Helper()
+
+	var ds []Dirent
+	for len(b) > 0 {
+		if len(b) < 24 {
+			t.Fatalf("truncated dirent: %d bytes", len(b))
+		}
+
+		nameLen := int(binary.LittleEndian.Uint32(b[16:]))
+		ds = append(ds, Dirent{
+			Inode:  fuseops.InodeID(binary.LittleEndian.Uint64(b[0:])),
+			Offset: fuseops.DirOffset(binary.LittleEndian.Uint64(b[8:])),
+			Type:   DirentType(binary.LittleEndian.Uint32(b[20:])),
+			Name:   string(b[24 : 24+nameLen]),
+		})
+
+		size := (24 + nameLen + 7) &^ 7
+		b = b[size:]
+	}
+
+	return ds
+}
+
+func TestDirentBuffer(t *testing.T) {
+	var entries []Dirent
+	for i := 0; i < 10; i++ {
+		entries = append(entries, Dirent{
+			Inode: fuseops.InodeID(100 + i),
+			Name:  fmt.Sprintf("file%d", i),
+			Type:  DT_File,
+		})
+	}
+
+	// List the directory with a buffer that holds only three entries at a
+	// time, as the kernel would, resuming from the last offset returned.
+	var got []Dirent
+	op := &fuseops.ReadDirOp{Inode: 7}
+	for calls := 0; ; calls++ {
+		if calls > 10 {
+			t.Fatal("listing never finished")
+		}
+
+		op.Dst = make([]byte, 3*32)
+		b := NewDirentBuffer(op, 7, 3)
+		for _, e := range entries {
+			if !b.Add(e) {
+				break
+			}
+		}
+
+		ds := parseDirents(t, b.Bytes())
+		if len(ds) == 0 {
+			break
+		}
+
+		if len(ds) > 3 {
+			t.Fatalf("got %d entries in a buffer of %d bytes", len(ds), len(op.Dst))
+		}
+
+		got = append(got, ds...)
+		op.Offset = ds[len(ds)-1].Offset
+	}
+
+	want := []Dirent{
+		{Offset: 1, Inode: 7, Name: ".", Type: DT_Directory},
+		{Offset: 2, Inode: 3, Name: "..", Type: DT_Directory},
+	}
+	for i, e := range entries {
+		e.Offset = fuseops.DirOffset(i + 3)
+		want = append(want, e)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listing:\ngot  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestDirentBuffer_TooSmall(t *testing.T) {
+	op := &fuseops.ReadDirOp{Dst: make([]byte, 16)}
+	b := NewDirentBuffer(op, 1, 1)
+	if b.Add(Dirent{Inode: 2, Name: "foo"}) {
+		t.Error("Add succeeded with a full buffer")
+	}
+
+	if len(b.Bytes()) != 0 {
+		t.Errorf("got %d bytes, want 0", len(b.Bytes()))
+	}
+}
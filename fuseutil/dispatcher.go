@@ -0,0 +1,290 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A dispatcher hands the work for each op read from the connection to a
+// goroutine, according to the Serialized, ServerWorkers, ServerClassWorkers
+// and ServerPrioritizeInteractive fields of the mount config.
+type dispatcher struct {
+	// Run all work inline, ignoring the pools.
+	serial bool
+
+	// The pool used for ops of each class, or nil if each such op should get a
+	// goroutine of its own. Classes without an override share a single pool.
+	pools [fuseops.NumOpClasses]pool
+
+	// The distinct non-nil pools above, for stop.
+	all []pool
+}
+
+// A fixed set of goroutines servicing dispatched work.
+type pool interface {
+	// Hand f, the work for op, to a worker, blocking if the pool has no room
+	// for it.
+	submit(op interface{}, f func())
+
+	// Wait for all submitted work to finish and shut down the workers.
+	stop()
+}
+
+func newDispatcher(cfg fuse.MountConfig) *dispatcher {
+	d := &dispatcher{}
+	if cfg.Serialized {
+		d.serial = true
+		return d
+	}
+
+	newPool := func(n int) pool {
+		if cfg.ServerPrioritizeInteractive {
+			return newPriorityPool(n)
+		}
+
+		return newWorkerPool(n)
+	}
+
+	var def pool
+	if cfg.ServerWorkers > 0 {
+		def = newPool(cfg.ServerWorkers)
+		d.all = append(d.all, def)
+	}
+
+	for c := range d.pools {
+		n, ok := cfg.ServerClassWorkers[fuseops.OpClass(c)]
+		switch {
+		case !ok:
+			d.pools[c] = def
+
+		case n > 0:
+			d.pools[c] = newPool(n)
+			d.all = append(d.all, d.pools[c])
+		}
+	}
+
+	return d
+}
+
+// Arrange for f, the work for the supplied op, to be run. Blocks until a
+// worker (or, with priority scheduling, a place in the queue) is available if
+// the op is subject to a bounded pool, or until f has finished if the
+// dispatcher is serial.
+func (d *dispatcher) dispatch(op interface{}, f func()) {
+	if d.serial {
+		f()
+		return
+	}
+
+	p := d.pools[fuseops.ClassOf(op)]
+	if p == nil {
+		go f()
+		return
+	}
+
+	p.submit(op, f)
+}
+
+// Wait for all dispatched work to finish and shut down the workers. dispatch
+// must not be called afterward.
+func (d *dispatcher) stop() {
+	for _, p := range d.all {
+		p.stop()
+	}
+}
+
+// A fixed set of goroutines consuming work from a channel.
+type workerPool struct {
+	work chan func()
+	wg   sync.WaitGroup
+}
+
+func newWorkerPool(n int) *workerPool {
+	p := &workerPool{
+		work: make(chan func()),
+	}
+
+	p.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go p.run()
+	}
+
+	return p
+}
+
+func (p *workerPool) run() {
+	defer p.wg.Done()
+	for f := range p.work {
+		f()
+	}
+}
+
+func (p *workerPool) submit(op interface{}, f func()) {
+	p.work <- f
+}
+
+func (p *workerPool) stop() {
+	close(p.work)
+	p.wg.Wait()
+}
+
+// Reads and writes larger than this, other than reads from the start of a
+// file, are considered bulk work by a priorityPool.
+const bulkSize = 64 << 10
+
+// When both kinds of work are waiting, a priorityPool gives a free worker to
+// bulk work after this many interactive ops in a row, so that a steady stream
+// of lookups can slow a large copy but not stall it.
+const interactiveStreak = 3
+
+// Is the op part of a bulk transfer, such as readahead or writeback of a large
+// file, rather than something a user is likely to be waiting on?
+func isBulk(op interface{}) bool {
+	switch o := op.(type) {
+	case *fuseops.ReadFileOp:
+		return o.Offset > 0 && o.Size > bulkSize
+
+	case *fuseops.WriteFileOp:
+		return len(o.Data) > bulkSize
+	}
+
+	return false
+}
+
+// A fixed set of goroutines that take interactive work (metadata ops, small
+// reads and writes, and reads from the start of a file) ahead of bulk work
+// whenever both are waiting.
+//
+// Interactive work is always queued without blocking: each such op is
+// synchronous for the process that caused it, so the kernel can't have many
+// outstanding. Bulk work blocks submit once as many bulk ops are queued as
+// there are workers, bounding the memory they hold.
+type priorityPool struct {
+	wg sync.WaitGroup
+
+	mu sync.Mutex
+
+	// Signalled when work is queued, when bulk work is taken from the queue,
+	// and when the pool is stopped.
+	cond *sync.Cond
+
+	// GUARDED_BY(mu)
+	interactive []func()
+
+	// GUARDED_BY(mu)
+	bulk    []func()
+	maxBulk int
+
+	// The number of interactive ops taken in a row while bulk work waited.
+	//
+	// GUARDED_BY(mu)
+	streak int
+
+	// GUARDED_BY(mu)
+	stopped bool
+}
+
+func newPriorityPool(n int) *priorityPool {
+	p := &priorityPool{
+		maxBulk: n,
+	}
+	p.cond = sync.NewCond(&p.mu)
+
+	p.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go p.run()
+	}
+
+	return p
+}
+
+func (p *priorityPool) submit(op interface{}, f func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if isBulk(op) {
+		for len(p.bulk) >= p.maxBulk {
+			p.cond.Wait()
+		}
+
+		p.bulk = append(p.bulk, f)
+	} else {
+		p.interactive = append(p.interactive, f)
+	}
+
+	p.cond.Broadcast()
+}
+
+func (p *priorityPool) run() {
+	defer p.wg.Done()
+	for {
+		f := p.next()
+		if f == nil {
+			return
+		}
+
+		f()
+	}
+}
+
+// Wait for work and take it from the queue, returning nil once the pool has
+// been stopped and drained.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *priorityPool) next() func() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.interactive) == 0 && len(p.bulk) == 0 {
+		if p.stopped {
+			return nil
+		}
+
+		p.cond.Wait()
+	}
+
+	if len(p.interactive) == 0 || (len(p.bulk) > 0 && p.streak >= interactiveStreak) {
+		f := p.bulk[0]
+		p.bulk[0] = nil
+		p.bulk = p.bulk[1:]
+		p.streak = 0
+
+		// Make room for a blocked submit.
+		p.cond.Broadcast()
+		return f
+	}
+
+	f := p.interactive[0]
+	p.interactive[0] = nil
+	p.interactive = p.interactive[1:]
+	if len(p.bulk) > 0 {
+		p.streak++
+	}
+
+	return f
+}
+
+func (p *priorityPool) stop() {
+	p.mu.Lock()
+	p.stopped = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
@@ -0,0 +1,322 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Work that counts how many instances are running at once and blocks until
+// released.
+type gate struct {
+	release chan struct{}
+	running int32
+	peak    int32
+	started chan struct{}
+}
+
+func newGate() *gate {
+	return &gate{
+		release: make(chan struct{}),
+		started: make(chan struct{}, 100),
+	}
+}
+
+func (g *gate) work() {
+	n := atomic.AddInt32(&g.running, 1)
+	for {
+		p := atomic.LoadInt32(&g.peak)
+		if n <= p || atomic.CompareAndSwapInt32(&g.peak, p, n) {
+			break
+		}
+	}
+
+	g.started <- struct{}{}
+	<-g.release
+	atomic.AddInt32(&g.running, -1)
+}
+
+// Wait for n instances of the work to have started.
+func (g *gate) awaitStarted(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-g.started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d started", i, n)
+		}
+	}
+}
+
+// Assert that nothing else starts for a little while.
+func (g *gate) assertNoneStarted(t *testing.T) {
+	t.Helper()
+	select {
+	case <-g.started:
+		t.Fatal("work started beyond the pool bound")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDispatcher_Bound(t *testing.T) {
+	const workers = 3
+	d := newDispatcher(fuse.MountConfig{ServerWorkers: workers})
+	g := newGate()
+
+	// Dispatch blocks once all workers are busy, so do it in the background.
+	const total = 2 * workers
+	go func() {
+		for i := 0; i < total; i++ {
+			d.dispatch(&fuseops.LookUpInodeOp{}, g.work)
+		}
+	}()
+
+	g.awaitStarted(t, workers)
+	g.assertNoneStarted(t)
+
+	close(g.release)
+	g.awaitStarted(t, total-workers)
+	d.stop()
+
+	if g.peak != workers {
+		t.Errorf("peak concurrency %d, want %d", g.peak, workers)
+	}
+}
+
+func TestDispatcher_ClassOverride(t *testing.T) {
+	d := newDispatcher(fuse.MountConfig{
+		ServerWorkers: 1,
+		ServerClassWorkers: map[fuseops.OpClass]int{
+			fuseops.OpClassRead: 2,
+		},
+	})
+
+	// Occupy both read workers.
+	reads := newGate()
+	for i := 0; i < 2; i++ {
+		d.dispatch(&fuseops.ReadFileOp{}, reads.work)
+	}
+	reads.awaitStarted(t, 2)
+
+	// Metadata ops should still get through, on their own pool.
+	lookups := newGate()
+	d.dispatch(&fuseops.LookUpInodeOp{}, lookups.work)
+	lookups.awaitStarted(t, 1)
+
+	// But a third read must wait.
+	go d.dispatch(&fuseops.ReadFileOp{}, reads.work)
+	reads.assertNoneStarted(t)
+
+	close(reads.release)
+	close(lookups.release)
+	reads.awaitStarted(t, 1)
+	d.stop()
+}
+
+func TestDispatcher_NoPool(t *testing.T) {
+	// With no workers configured, and with a class explicitly set to zero, each
+	// op gets a goroutine of its own and dispatch never blocks.
+	configs := []fuse.MountConfig{
+		{},
+		{
+			ServerWorkers: 1,
+			ServerClassWorkers: map[fuseops.OpClass]int{
+				fuseops.OpClassMetadata: 0,
+			},
+		},
+	}
+
+	for _, cfg := range configs {
+		d := newDispatcher(cfg)
+		g := newGate()
+
+		const total = 10
+		for i := 0; i < total; i++ {
+			d.dispatch(&fuseops.LookUpInodeOp{}, g.work)
+		}
+
+		g.awaitStarted(t, total)
+		close(g.release)
+		d.stop()
+	}
+}
+
+func TestDispatcher_StopDrains(t *testing.T) {
+	d := newDispatcher(fuse.MountConfig{ServerWorkers: 2})
+
+	var done int32
+	var wg sync.WaitGroup
+	const total = 20
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < total; i++ {
+			d.dispatch(&fuseops.WriteFileOp{}, func() {
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&done, 1)
+			})
+		}
+	}()
+
+	wg.Wait()
+	d.stop()
+
+	if got := atomic.LoadInt32(&done); got != total {
+		t.Errorf("%d of %d ops finished before stop returned", got, total)
+	}
+}
+
+func TestDispatcher_Serialized(t *testing.T) {
+	d := newDispatcher(fuse.MountConfig{
+		Serialized:    true,
+		ServerWorkers: 4,
+	})
+
+	// Each op should have finished by the time dispatch returns, so the order
+	// of completion is the order of dispatch.
+	var order []int
+	ops := []interface{}{
+		&fuseops.LookUpInodeOp{},
+		&fuseops.ReadFileOp{},
+		&fuseops.WriteFileOp{},
+		&fuseops.ReadDirOp{},
+	}
+
+	for i, op := range ops {
+		i := i
+		d.dispatch(op, func() {
+			time.Sleep(time.Millisecond)
+			order = append(order, i)
+		})
+
+		if len(order) != i+1 {
+			t.Fatalf("op %d not finished when dispatch returned", i)
+		}
+	}
+
+	d.stop()
+	for i, got := range order {
+		if got != i {
+			t.Errorf("order: got %v", order)
+			break
+		}
+	}
+}
+
+func TestDispatcher_PrioritizeInteractive(t *testing.T) {
+	d := newDispatcher(fuse.MountConfig{
+		ServerWorkers:               1,
+		ServerPrioritizeInteractive: true,
+	})
+
+	bulkRead := &fuseops.ReadFileOp{Offset: 1 << 20, Size: 1 << 20}
+	bulkWrite := &fuseops.WriteFileOp{Data: make([]byte, 1<<20)}
+
+	// Occupy the only worker.
+	busy := newGate()
+	d.dispatch(bulkRead, busy.work)
+	busy.awaitStarted(t, 1)
+
+	// Queue a bulk op, then interactive ones. None of this should block.
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) func() {
+		return func() {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+		}
+	}
+
+	d.dispatch(bulkWrite, record("bulk"))
+	d.dispatch(&fuseops.LookUpInodeOp{}, record("lookup"))
+	d.dispatch(&fuseops.ReadFileOp{Offset: 0, Size: 1 << 20}, record("first"))
+	d.dispatch(&fuseops.ReadFileOp{Offset: 1 << 20, Size: 4096}, record("small"))
+	d.dispatch(&fuseops.GetInodeAttributesOp{}, record("getattr"))
+
+	// The pool is now full of bulk work, so a further bulk op must wait while
+	// interactive ones still get through.
+	blocked := make(chan struct{})
+	go func() {
+		d.dispatch(bulkRead, record("late bulk"))
+		close(blocked)
+	}()
+
+	select {
+	case <-blocked:
+		t.Fatal("bulk op queued beyond the pool bound")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	d.dispatch(&fuseops.ReadDirOp{}, record("readdir"))
+
+	close(busy.release)
+	<-blocked
+	d.stop()
+
+	// Bulk work gets a turn after every three interactive ops.
+	want := []string{
+		"lookup",
+		"first",
+		"small",
+		"bulk",
+		"getattr",
+		"readdir",
+		"late bulk",
+	}
+
+	if len(order) != len(want) {
+		t.Fatalf("order: got %v, want %v", order, want)
+	}
+
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("order: got %v, want %v", order, want)
+		}
+	}
+}
+
+func TestDispatcher_PrioritizeInteractive_StopDrains(t *testing.T) {
+	d := newDispatcher(fuse.MountConfig{
+		ServerWorkers:               2,
+		ServerPrioritizeInteractive: true,
+	})
+
+	var done int32
+	const total = 20
+	for i := 0; i < total; i++ {
+		var op interface{} = &fuseops.LookUpInodeOp{}
+		if i%2 == 0 {
+			op = &fuseops.WriteFileOp{Data: make([]byte, 1<<20)}
+		}
+
+		d.dispatch(op, func() {
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&done, 1)
+		})
+	}
+
+	d.stop()
+
+	if got := atomic.LoadInt32(&done); got != total {
+		t.Errorf("%d of %d ops finished before stop returned", got, total)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// ExpirationPolicy configures NewExpirationPolicyFS. Each TTL says how long
+// the kernel may cache what a class of op returns; zero leaves the
+// expirations set by the wrapped file system alone.
+type ExpirationPolicy struct {
+	// For the entries returned by LookUpInode and by the ops that create
+	// inodes: how long the kernel may cache the name, and the attributes that
+	// come with it.
+	EntryTTL           time.Duration
+	EntryAttributesTTL time.Duration
+
+	// How long the kernel may cache a name that doesn't exist. If set, a
+	// LookUpInode that fails with ENOENT is reported as a negative entry; see
+	// fuseops.LookUpInodeOp.Entry.
+	NegativeTTL time.Duration
+
+	// How long the kernel may cache the attributes returned by
+	// GetInodeAttributes and SetInodeAttributes.
+	AttributesTTL time.Duration
+
+	// The fraction of each TTL, between zero and one, by which expirations are
+	// shortened at random, so that things cached at the same time don't all
+	// expire at once. For example 0.1 makes a one minute TTL anything from 54
+	// to 60 seconds.
+	Jitter float64
+
+	// The clock from which expirations are measured. If nil,
+	// timeutil.RealClock() is used.
+	Clock timeutil.Clock
+}
+
+// NewExpirationPolicyFS returns a file system that passes ops to the supplied
+// one, and sets the EntryExpiration and AttributesExpiration of what it
+// returns according to the policy, so that they are decided in one place
+// rather than by each op. The wrapped file system may leave them zero.
+func NewExpirationPolicyFS(fs FileSystem, p ExpirationPolicy) FileSystem {
+	if p.Clock == nil {
+		p.Clock = timeutil.RealClock()
+	}
+
+	return &expirationPolicyFS{FileSystem: fs, policy: p}
+}
+
+type expirationPolicyFS struct {
+	FileSystem
+	policy ExpirationPolicy
+}
+
+// Set *t to the expiration for the supplied TTL, if it is non-zero.
+func (fs *expirationPolicyFS) expire(t *time.Time, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	if fs.policy.Jitter > 0 {
+		ttl -= time.Duration(rand.Float64() * fs.policy.Jitter * float64(ttl))
+	}
+
+	*t = fs.policy.Clock.Now().Add(ttl)
+}
+
+func (fs *expirationPolicyFS) expireEntry(e *fuseops.ChildInodeEntry, err error) {
+	if err != nil {
+		return
+	}
+
+	if e.Child == 0 {
+		fs.expire(&e.EntryExpiration, fs.policy.NegativeTTL)
+		return
+	}
+
+	fs.expire(&e.EntryExpiration, fs.policy.EntryTTL)
+	fs.expire(&e.AttributesExpiration, fs.policy.EntryAttributesTTL)
+}
+
+func (fs *expirationPolicyFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	err := fs.FileSystem.LookUpInode(ctx, op)
+	if errors.Is(err, fuse.ENOENT) && fs.policy.NegativeTTL > 0 {
+		op.Entry = fuseops.ChildInodeEntry{}
+		err = nil
+	}
+
+	fs.expireEntry(&op.Entry, err)
+	return err
+}
+
+func (fs *expirationPolicyFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	err := fs.FileSystem.GetInodeAttributes(ctx, op)
+	if err == nil {
+		fs.expire(&op.AttributesExpiration, fs.policy.AttributesTTL)
+	}
+
+	return err
+}
+
+func (fs *expirationPolicyFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	err := fs.FileSystem.SetInodeAttributes(ctx, op)
+	if err == nil {
+		fs.expire(&op.AttributesExpiration, fs.policy.AttributesTTL)
+	}
+
+	return err
+}
+
+func (fs *expirationPolicyFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	err := fs.FileSystem.MkDir(ctx, op)
+	fs.expireEntry(&op.Entry, err)
+	return err
+}
+
+func (fs *expirationPolicyFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	err := fs.FileSystem.MkNode(ctx, op)
+	fs.expireEntry(&op.Entry, err)
+	return err
+}
+
+func (fs *expirationPolicyFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	err := fs.FileSystem.CreateFile(ctx, op)
+	fs.expireEntry(&op.Entry, err)
+	return err
+}
+
+func (fs *expirationPolicyFS) CreateTmpFile(
+	ctx context.Context,
+	op *fuseops.CreateTmpFileOp) error {
+	err := fs.FileSystem.CreateTmpFile(ctx, op)
+	fs.expireEntry(&op.Entry, err)
+	return err
+}
+
+func (fs *expirationPolicyFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	err := fs.FileSystem.CreateSymlink(ctx, op)
+	fs.expireEntry(&op.Entry, err)
+	return err
+}
+
+func (fs *expirationPolicyFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	err := fs.FileSystem.CreateLink(ctx, op)
+	fs.expireEntry(&op.Entry, err)
+	return err
+}
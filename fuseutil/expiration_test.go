@@ -0,0 +1,149 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestExpirationPolicyFS(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	now := time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local)
+	clock.SetTime(now)
+
+	wrapped := &lookupFS{
+		children: map[string]fuseops.InodeID{"foo": 2},
+		forgets:  make(map[fuseops.InodeID]uint64),
+	}
+
+	fs := NewExpirationPolicyFS(wrapped, ExpirationPolicy{
+		EntryTTL:           time.Minute,
+		EntryAttributesTTL: time.Second,
+		NegativeTTL:        time.Hour,
+		Clock:              &clock,
+	})
+
+	ctx := context.Background()
+	lookUp := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "foo"}
+	if err := fs.LookUpInode(ctx, lookUp); err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	if e := lookUp.Entry; !e.EntryExpiration.Equal(now.Add(time.Minute)) || !e.AttributesExpiration.Equal(now.Add(time.Second)) {
+		t.Errorf("foo: got expirations %v and %v", e.EntryExpiration, e.AttributesExpiration)
+	}
+
+	// A missing name becomes a negative entry.
+	missing := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "bar"}
+	if err := fs.LookUpInode(ctx, missing); err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	if e := missing.Entry; e.Child != 0 || !e.EntryExpiration.Equal(now.Add(time.Hour)) {
+		t.Errorf("bar: got %+v", e)
+	}
+
+	// Entries from ops that create inodes are treated like lookups.
+	create := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "baz"}
+	if err := fs.CreateFile(ctx, create); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	if !create.Entry.EntryExpiration.Equal(now.Add(time.Minute)) {
+		t.Errorf("baz: got expiration %v", create.Entry.EntryExpiration)
+	}
+
+	// Attributes are left alone without a TTL for them.
+	getattr := &fuseops.GetInodeAttributesOp{Inode: 2}
+	fs.GetInodeAttributes(ctx, getattr)
+	if !getattr.AttributesExpiration.IsZero() {
+		t.Errorf("getattr: got expiration %v", getattr.AttributesExpiration)
+	}
+}
+
+func TestExpirationPolicyFS_WrappedENOENT(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	now := time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local)
+	clock.SetTime(now)
+
+	// A missing name reported with a cause attached becomes a negative entry
+	// too.
+	wrapped := &lookupFS{
+		missing: fuse.NewError(fuse.ENOENT, errors.New("no such object")),
+		forgets: make(map[fuseops.InodeID]uint64),
+	}
+
+	fs := NewExpirationPolicyFS(wrapped, ExpirationPolicy{
+		NegativeTTL: time.Hour,
+		Clock:       &clock,
+	})
+
+	op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "bar"}
+	if err := fs.LookUpInode(context.Background(), op); err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	if e := op.Entry; e.Child != 0 || !e.EntryExpiration.Equal(now.Add(time.Hour)) {
+		t.Errorf("bar: got %+v", e)
+	}
+}
+
+type setattrFS struct {
+	NotImplementedFileSystem
+}
+
+func (fs *setattrFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return nil
+}
+
+func TestExpirationPolicyFS_Jitter(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	now := time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local)
+	clock.SetTime(now)
+
+	fs := NewExpirationPolicyFS(&setattrFS{}, ExpirationPolicy{
+		AttributesTTL: time.Minute,
+		Jitter:        0.1,
+		Clock:         &clock,
+	})
+
+	seen := make(map[time.Time]bool)
+	for i := 0; i < 100; i++ {
+		op := &fuseops.SetInodeAttributesOp{Inode: 2}
+		if err := fs.SetInodeAttributes(context.Background(), op); err != nil {
+			t.Fatalf("SetInodeAttributes: %v", err)
+		}
+
+		exp := op.AttributesExpiration
+		if exp.Before(now.Add(54*time.Second)) || exp.After(now.Add(time.Minute)) {
+			t.Fatalf("expiration %v outside [54s, 60s]", exp.Sub(now))
+		}
+
+		seen[exp] = true
+	}
+
+	if len(seen) < 2 {
+		t.Errorf("no jitter in %d expirations", len(seen))
+	}
+}
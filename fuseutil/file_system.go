@@ -16,7 +16,9 @@ package fuseutil
 
 import (
 	"context"
+	"errors"
 	"io"
+	"runtime/debug"
 	"sync"
 
 	"github.com/jacobsa/fuse"
@@ -31,21 +33,30 @@ import (
 // The FileSystem implementation should not call Connection.Reply, instead
 // returning the error with which the caller should respond.
 //
+// Each method receives the context of its op, as returned by
+// Connection.ReadOp. Pass it on to calls into backends, such as HTTP requests
+// or database queries, so that they are abandoned when the op is interrupted
+// or the file system is unmounted or shut down; a method that notices that the
+// context is done should return fuse.EINTR.
+//
 // See NotImplementedFileSystem for a convenient way to embed default
 // implementations for methods you don't care about.
 type FileSystem interface {
 	StatFS(context.Context, *fuseops.StatFSOp) error
 	LookUpInode(context.Context, *fuseops.LookUpInodeOp) error
 	GetInodeAttributes(context.Context, *fuseops.GetInodeAttributesOp) error
+	GetXTimes(context.Context, *fuseops.GetXTimesOp) error
 	SetInodeAttributes(context.Context, *fuseops.SetInodeAttributesOp) error
 	ForgetInode(context.Context, *fuseops.ForgetInodeOp) error
 	BatchForget(context.Context, *fuseops.BatchForgetOp) error
 	MkDir(context.Context, *fuseops.MkDirOp) error
 	MkNode(context.Context, *fuseops.MkNodeOp) error
 	CreateFile(context.Context, *fuseops.CreateFileOp) error
+	CreateTmpFile(context.Context, *fuseops.CreateTmpFileOp) error
 	CreateLink(context.Context, *fuseops.CreateLinkOp) error
 	CreateSymlink(context.Context, *fuseops.CreateSymlinkOp) error
 	Rename(context.Context, *fuseops.RenameOp) error
+	ExchangeData(context.Context, *fuseops.ExchangeDataOp) error
 	RmDir(context.Context, *fuseops.RmDirOp) error
 	Unlink(context.Context, *fuseops.UnlinkOp) error
 	OpenDir(context.Context, *fuseops.OpenDirOp) error
@@ -65,6 +76,10 @@ type FileSystem interface {
 	Fallocate(context.Context, *fuseops.FallocateOp) error
 	SyncFS(context.Context, *fuseops.SyncFSOp) error
 
+	// Learn the protocol version and capabilities negotiated with the kernel.
+	// This is called once, before any other method.
+	Init(*fuseops.InitOp)
+
 	// Regard all inodes (including the root inode) as having their lookup counts
 	// decremented to zero, and clean up any resources associated with the file
 	// system. No further calls to the file system will be made.
@@ -78,7 +93,15 @@ type FileSystem interface {
 // Each call to a FileSystem method (except ForgetInode) is made on
 // its own goroutine, and is free to block. ForgetInode may be called
 // synchronously, and should not depend on calls to other methods
-// being received concurrently.
+// being received concurrently. Set MountConfig.ServerWorkers and
+// MountConfig.ServerClassWorkers to service ops with a bounded set of
+// goroutines instead (with MountConfig.ServerPrioritizeInteractive to favor
+// metadata ops and small reads over bulk transfers when they are all busy), or
+// MountConfig.Serialized to have ops handled one at a time in the order they
+// arrive.
+//
+// A panic in a FileSystem method fails only the op concerned, with EIO, unless
+// MountConfig.CrashOnPanic is set.
 //
 // (It is safe to naively process ops concurrently because the kernel
 // guarantees to serialize operations that the user expects to happen in order,
@@ -93,16 +116,27 @@ func NewFileSystemServer(fs FileSystem) fuse.Server {
 type fileSystemServer struct {
 	fs          FileSystem
 	opsInFlight sync.WaitGroup
+
+	// See MountConfig.CrashOnPanic. Set before any op is handled.
+	crashOnPanic bool
 }
 
 func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
+	cfg := c.MountConfig()
+	d := newDispatcher(cfg)
+	s.crashOnPanic = cfg.CrashOnPanic
+
 	// When we are done, we clean up by waiting for all in-flight ops then
 	// destroying the file system.
 	defer func() {
+		d.stop()
 		s.opsInFlight.Wait()
 		s.fs.Destroy()
 	}()
 
+	initOp := c.InitOp()
+	s.fs.Init(&initOp)
+
 	for {
 		ctx, op, err := c.ReadOp()
 		if err == io.EOF {
@@ -121,7 +155,7 @@ func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
 			// cheap for the file system to handle
 			s.handleOp(c, ctx, op)
 		} else {
-			go s.handleOp(c, ctx, op)
+			d.dispatch(op, func() { s.handleOp(c, ctx, op) })
 		}
 	}
 }
@@ -131,9 +165,38 @@ func (s *fileSystemServer) handleOp(
 	ctx context.Context,
 	op interface{}) {
 	defer s.opsInFlight.Done()
+	c.MarkOpStarted(ctx)
+
+	// Panics past this point, for example in a ReadFileOp.Callback or in
+	// MountConfig.OnOpEnd, are not recovered: they happen once the op has been
+	// replied to, so ReplyPanic could only make matters worse.
+	err := s.callFS(c, ctx, op)
+	if err == errRepliedToPanic {
+		return
+	}
+
+	c.Reply(ctx, err)
+}
+
+// Returned by callFS when the file system method panicked and the op has
+// already been failed with ReplyPanic.
+var errRepliedToPanic = errors.New("replied to panic")
+
+// Call the file system method for the supplied op and return its result.
+func (s *fileSystemServer) callFS(
+	c *fuse.Connection,
+	ctx context.Context,
+	op interface{}) (err error) {
+	if !s.crashOnPanic {
+		defer func() {
+			if r := recover(); r != nil {
+				c.ReplyPanic(ctx, r, debug.Stack())
+				err = errRepliedToPanic
+			}
+		}()
+	}
 
 	// Dispatch to the appropriate method.
-	var err error
 	switch typed := op.(type) {
 	default:
 		err = fuse.ENOSYS
@@ -147,6 +210,9 @@ func (s *fileSystemServer) handleOp(
 	case *fuseops.GetInodeAttributesOp:
 		err = s.fs.GetInodeAttributes(ctx, typed)
 
+	case *fuseops.GetXTimesOp:
+		err = s.fs.GetXTimes(ctx, typed)
+
 	case *fuseops.SetInodeAttributesOp:
 		err = s.fs.SetInodeAttributes(ctx, typed)
 
@@ -155,7 +221,7 @@ func (s *fileSystemServer) handleOp(
 
 	case *fuseops.BatchForgetOp:
 		err = s.fs.BatchForget(ctx, typed)
-		if err == fuse.ENOSYS {
+		if errors.Is(err, fuse.ENOSYS) {
 			// Handle as a series of single-inode forget operations
 			for _, entry := range typed.Entries {
 				err = s.fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{
@@ -178,6 +244,9 @@ func (s *fileSystemServer) handleOp(
 	case *fuseops.CreateFileOp:
 		err = s.fs.CreateFile(ctx, typed)
 
+	case *fuseops.CreateTmpFileOp:
+		err = s.fs.CreateTmpFile(ctx, typed)
+
 	case *fuseops.CreateLinkOp:
 		err = s.fs.CreateLink(ctx, typed)
 
@@ -187,6 +256,9 @@ func (s *fileSystemServer) handleOp(
 	case *fuseops.RenameOp:
 		err = s.fs.Rename(ctx, typed)
 
+	case *fuseops.ExchangeDataOp:
+		err = s.fs.ExchangeData(ctx, typed)
+
 	case *fuseops.RmDirOp:
 		err = s.fs.RmDir(ctx, typed)
 
@@ -242,5 +314,5 @@ func (s *fileSystemServer) handleOp(
 		err = s.fs.SyncFS(ctx, typed)
 	}
 
-	c.Reply(ctx, err)
+	return err
 }
@@ -0,0 +1,137 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// HandleTable hands out the IDs that a file system returns from OpenFile,
+// CreateFile and OpenDir, and maps them to its state for each open file or
+// directory. It is safe for concurrent use, and the zero value is an empty
+// table ready for use. IDs start at one, and are not reused.
+//
+// A file system may forward ReleaseFileHandle or ReleaseDirHandle to the
+// table's method of the same name, which removes the handle and closes its
+// state if that has a Close method:
+//
+//	func (fs *myFS) ReleaseDirHandle(
+//		ctx context.Context,
+//		op *fuseops.ReleaseDirHandleOp) error {
+//		return fs.dirs.ReleaseDirHandle(ctx, op)
+//	}
+type HandleTable[T any] struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID]T
+
+	// The last ID handed out.
+	//
+	// GUARDED_BY(mu)
+	last fuseops.HandleID
+}
+
+// Add records the supplied state under a new handle ID, which it returns.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *HandleTable[T]) Add(v T) fuseops.HandleID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.handles == nil {
+		t.handles = make(map[fuseops.HandleID]T)
+	}
+
+	t.last++
+	t.handles[t.last] = v
+
+	return t.last
+}
+
+// Get returns the state for the supplied handle, or EBADF if there is none.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *HandleTable[T]) Get(h fuseops.HandleID) (T, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	v, ok := t.handles[h]
+	if !ok {
+		return v, syscall.EBADF
+	}
+
+	return v, nil
+}
+
+// Remove removes the supplied handle from the table and returns its state, or
+// returns EBADF if there is none.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *HandleTable[T]) Remove(h fuseops.HandleID) (T, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	v, ok := t.handles[h]
+	if !ok {
+		return v, syscall.EBADF
+	}
+
+	delete(t.handles, h)
+	return v, nil
+}
+
+// Len returns the number of handles in the table.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *HandleTable[T]) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.handles)
+}
+
+// ReleaseFileHandle removes op.Handle from the table, closing its state if
+// that has a Close method.
+func (t *HandleTable[T]) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return t.release(op.Handle)
+}
+
+// ReleaseDirHandle removes op.Handle from the table, closing its state if that
+// has a Close method.
+func (t *HandleTable[T]) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return t.release(op.Handle)
+}
+
+func (t *HandleTable[T]) release(h fuseops.HandleID) error {
+	v, err := t.Remove(h)
+	if err != nil {
+		return err
+	}
+
+	if c, ok := any(v).(interface{ Close() error }); ok {
+		return c.Close()
+	}
+
+	return nil
+}
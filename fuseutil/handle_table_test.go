@@ -0,0 +1,92 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+type closeCounter struct {
+	closes int
+}
+
+func (c *closeCounter) Close() error {
+	c.closes++
+	return nil
+}
+
+func TestHandleTable(t *testing.T) {
+	var table HandleTable[string]
+
+	foo := table.Add("foo")
+	bar := table.Add("bar")
+	if foo == 0 || foo == bar {
+		t.Fatalf("got handles %v and %v", foo, bar)
+	}
+
+	if v, err := table.Get(bar); err != nil || v != "bar" {
+		t.Errorf("Get: got %q, %v", v, err)
+	}
+
+	if v, err := table.Remove(foo); err != nil || v != "foo" {
+		t.Errorf("Remove: got %q, %v", v, err)
+	}
+
+	if _, err := table.Get(foo); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("Get after Remove: got %v, want EBADF", err)
+	}
+
+	if _, err := table.Remove(foo); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("Remove after Remove: got %v, want EBADF", err)
+	}
+
+	// IDs aren't reused.
+	if baz := table.Add("baz"); baz == foo || baz == bar {
+		t.Errorf("handle %v reused", baz)
+	}
+
+	if table.Len() != 2 {
+		t.Errorf("got length %d, want 2", table.Len())
+	}
+}
+
+func TestHandleTable_Release(t *testing.T) {
+	var table HandleTable[*closeCounter]
+	ctx := context.Background()
+
+	c := &closeCounter{}
+	h := table.Add(c)
+	if err := table.ReleaseDirHandle(ctx, &fuseops.ReleaseDirHandleOp{Handle: h}); err != nil {
+		t.Fatalf("ReleaseDirHandle: %v", err)
+	}
+
+	if c.closes != 1 || table.Len() != 0 {
+		t.Errorf("got %d closes and %d handles, want 1 and 0", c.closes, table.Len())
+	}
+
+	err := table.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: h})
+	if !errors.Is(err, syscall.EBADF) {
+		t.Errorf("second release: got %v, want EBADF", err)
+	}
+
+	if c.closes != 1 {
+		t.Errorf("got %d closes, want 1", c.closes)
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// InodeRegistry keeps the kernel's lookup count for each inode on behalf of a
+// file system returned by NewInodeRegistry. See the notes on
+// fuseops.ForgetInodeOp for what the count is.
+type InodeRegistry struct {
+	forgotten func(fuseops.InodeID)
+
+	mu sync.Mutex
+
+	// The lookup count of every inode for which it is non-zero.
+	//
+	// GUARDED_BY(mu)
+	counts map[fuseops.InodeID]uint64
+
+	// The number of ops that may return a ChildInodeEntry in progress, and the
+	// inodes whose counts have reached zero while there were any.
+	//
+	// GUARDED_BY(mu)
+	busy    int
+	pending map[fuseops.InodeID]struct{}
+}
+
+// NewInodeRegistry returns a file system that passes ops to the supplied one,
+// counting a lookup of the child of every ChildInodeEntry it returns
+// successfully, and deducting the lookups of ForgetInode and BatchForget ops,
+// which are not passed on. Once an inode's count drops to zero, forgotten is
+// called with it, after which the file system may free the inode and reuse
+// its ID. On Destroy, forgotten is called for every inode whose count is not
+// yet zero.
+//
+// So that the file system needn't worry about handing out an inode at the
+// same time as it is forgotten, forgotten is only called while no op that
+// may return a ChildInodeEntry is in progress, and no such op begins until it
+// returns. It must not call into the registry.
+func NewInodeRegistry(
+	fs FileSystem,
+	forgotten func(inode fuseops.InodeID)) (FileSystem, *InodeRegistry) {
+	r := &InodeRegistry{
+		forgotten: forgotten,
+		counts:    make(map[fuseops.InodeID]uint64),
+		pending:   make(map[fuseops.InodeID]struct{}),
+	}
+
+	return &inodeRegistryFS{FileSystem: fs, registry: r}, r
+}
+
+// LookupCount returns the kernel's lookup count for the supplied inode.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *InodeRegistry) LookupCount(inode fuseops.InodeID) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.counts[inode]
+}
+
+// LOCKS_EXCLUDED(r.mu)
+func (r *InodeRegistry) beginEntryOp() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.busy++
+}
+
+// Finish an op that began with beginEntryOp, counting a lookup of the entry's
+// child if it succeeded.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *InodeRegistry) endEntryOp(e *fuseops.ChildInodeEntry, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// A negative entry takes no lookup count.
+	if err == nil && e.Child != 0 {
+		r.counts[e.Child]++
+		delete(r.pending, e.Child)
+	}
+
+	r.busy--
+	if r.busy == 0 {
+		for inode := range r.pending {
+			delete(r.pending, inode)
+			r.forgotten(inode)
+		}
+	}
+}
+
+// Deduct n lookups of the inode. Forgets of inodes with no count, such as
+// those for the root inode when unmounting, are ignored.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *InodeRegistry) forget(inode fuseops.InodeID, n uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count, ok := r.counts[inode]
+	if !ok {
+		return
+	}
+
+	if n < count {
+		r.counts[inode] = count - n
+		return
+	}
+
+	delete(r.counts, inode)
+	if r.busy > 0 {
+		r.pending[inode] = struct{}{}
+		return
+	}
+
+	r.forgotten(inode)
+}
+
+// LOCKS_EXCLUDED(r.mu)
+func (r *InodeRegistry) forgetAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for inode := range r.counts {
+		r.forgotten(inode)
+	}
+
+	for inode := range r.pending {
+		r.forgotten(inode)
+	}
+
+	r.counts = make(map[fuseops.InodeID]uint64)
+	r.pending = make(map[fuseops.InodeID]struct{})
+}
+
+type inodeRegistryFS struct {
+	FileSystem
+	registry *InodeRegistry
+}
+
+func (fs *inodeRegistryFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.registry.beginEntryOp()
+	err := fs.FileSystem.LookUpInode(ctx, op)
+	fs.registry.endEntryOp(&op.Entry, err)
+	return err
+}
+
+func (fs *inodeRegistryFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	fs.registry.beginEntryOp()
+	err := fs.FileSystem.MkDir(ctx, op)
+	fs.registry.endEntryOp(&op.Entry, err)
+	return err
+}
+
+func (fs *inodeRegistryFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	fs.registry.beginEntryOp()
+	err := fs.FileSystem.MkNode(ctx, op)
+	fs.registry.endEntryOp(&op.Entry, err)
+	return err
+}
+
+func (fs *inodeRegistryFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	fs.registry.beginEntryOp()
+	err := fs.FileSystem.CreateFile(ctx, op)
+	fs.registry.endEntryOp(&op.Entry, err)
+	return err
+}
+
+func (fs *inodeRegistryFS) CreateTmpFile(
+	ctx context.Context,
+	op *fuseops.CreateTmpFileOp) error {
+	fs.registry.beginEntryOp()
+	err := fs.FileSystem.CreateTmpFile(ctx, op)
+	fs.registry.endEntryOp(&op.Entry, err)
+	return err
+}
+
+func (fs *inodeRegistryFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	fs.registry.beginEntryOp()
+	err := fs.FileSystem.CreateLink(ctx, op)
+	fs.registry.endEntryOp(&op.Entry, err)
+	return err
+}
+
+func (fs *inodeRegistryFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	fs.registry.beginEntryOp()
+	err := fs.FileSystem.CreateSymlink(ctx, op)
+	fs.registry.endEntryOp(&op.Entry, err)
+	return err
+}
+
+func (fs *inodeRegistryFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.registry.forget(op.Inode, op.N)
+	return nil
+}
+
+func (fs *inodeRegistryFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	for _, e := range op.Entries {
+		fs.registry.forget(e.Inode, e.N)
+	}
+
+	return nil
+}
+
+func (fs *inodeRegistryFS) Destroy() {
+	fs.registry.forgetAll()
+	fs.FileSystem.Destroy()
+}
@@ -0,0 +1,171 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Records the inodes passed to the callback of NewInodeRegistry.
+type forgottenInodes struct {
+	mu     sync.Mutex
+	inodes []fuseops.InodeID
+}
+
+func (f *forgottenInodes) record(inode fuseops.InodeID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.inodes = append(f.inodes, inode)
+}
+
+// Return the inodes recorded since the last call, in order of ID.
+func (f *forgottenInodes) take() []fuseops.InodeID {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	inodes := f.inodes
+	f.inodes = nil
+	sort.Slice(inodes, func(i, j int) bool { return inodes[i] < inodes[j] })
+	return inodes
+}
+
+func TestInodeRegistry(t *testing.T) {
+	wrapped := &lookupFS{
+		children: map[string]fuseops.InodeID{"foo": 2},
+		forgets:  make(map[fuseops.InodeID]uint64),
+	}
+
+	var forgotten forgottenInodes
+	fs, registry := NewInodeRegistry(wrapped, forgotten.record)
+
+	ctx := context.Background()
+	lookUp := func(name string) error {
+		op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: name}
+		return fs.LookUpInode(ctx, op)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := lookUp("foo"); err != nil {
+			t.Fatalf("LookUpInode: %v", err)
+		}
+	}
+
+	if err := fs.CreateFile(ctx, &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "bar"}); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	if err := lookUp("baz"); err != fuse.ENOENT {
+		t.Fatalf("LookUpInode: got %v, want ENOENT", err)
+	}
+
+	if got := registry.LookupCount(2); got != 2 {
+		t.Errorf("foo: got count %d, want 2", got)
+	}
+
+	if got := registry.LookupCount(3); got != 1 {
+		t.Errorf("bar: got count %d, want 1", got)
+	}
+
+	// Nothing is forgotten until its count reaches zero, and forgets of inodes
+	// never looked up are ignored.
+	fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: 2, N: 1})
+	fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: fuseops.RootInodeID, N: 1})
+	if got := forgotten.take(); len(got) != 0 {
+		t.Errorf("forgotten too soon: %v", got)
+	}
+
+	fs.BatchForget(ctx, &fuseops.BatchForgetOp{
+		Entries: []fuseops.BatchForgetEntry{
+			{Inode: 2, N: 1},
+			{Inode: 3, N: 1},
+		},
+	})
+
+	if got, want := forgotten.take(), []fuseops.InodeID{2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("forgotten: got %v, want %v", got, want)
+	}
+
+	if len(wrapped.forgets) != 0 {
+		t.Errorf("forgets passed on: %v", wrapped.forgets)
+	}
+
+	// Destroy forgets whatever remains.
+	if err := lookUp("foo"); err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	fs.Destroy()
+	if got, want := forgotten.take(), []fuseops.InodeID{2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after Destroy: got %v, want %v", got, want)
+	}
+}
+
+// A lookupFS whose lookups wait to be released.
+type blockingLookupFS struct {
+	lookupFS
+	started chan struct{}
+	release chan struct{}
+}
+
+func (fs *blockingLookupFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	close(fs.started)
+	<-fs.release
+	return fs.lookupFS.LookUpInode(ctx, op)
+}
+
+func TestInodeRegistry_ForgetDuringLookup(t *testing.T) {
+	wrapped := &blockingLookupFS{
+		lookupFS: lookupFS{children: map[string]fuseops.InodeID{"foo": 2}},
+		started:  make(chan struct{}),
+		release:  make(chan struct{}),
+	}
+
+	var forgotten forgottenInodes
+	fs, _ := NewInodeRegistry(wrapped, forgotten.record)
+
+	ctx := context.Background()
+	fs.CreateFile(ctx, &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "bar"})
+
+	done := make(chan struct{})
+	go func() {
+		fs.LookUpInode(ctx, &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "foo"})
+		close(done)
+	}()
+
+	// The lookup might be about to return the inode being forgotten, so the
+	// file system isn't told until it has finished.
+	<-wrapped.started
+	fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: 3, N: 1})
+	if got := forgotten.take(); len(got) != 0 {
+		t.Errorf("forgotten during lookup: %v", got)
+	}
+
+	close(wrapped.release)
+	<-done
+
+	if got, want := forgotten.take(), []fuseops.InodeID{3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("forgotten: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,436 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/timeutil"
+)
+
+// LookupCacheConfig configures NewLookupCachingFS.
+type LookupCacheConfig struct {
+	// How long a successful lookup may be answered from the cache. Zero
+	// disables caching of successful lookups.
+	TTL time.Duration
+
+	// How long a lookup that failed with ENOENT may be answered from the cache.
+	// Zero disables caching of missing names.
+	NegativeTTL time.Duration
+
+	// The clock used to expire entries. If nil, timeutil.RealClock() is used.
+	Clock timeutil.Clock
+}
+
+// LookupCache holds the entries remembered by a file system returned by
+// NewLookupCachingFS, and allows them to be invalidated when the backend
+// changes by means other than the file system's own ops.
+type LookupCache struct {
+	cfg LookupCacheConfig
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	entries map[dentryKey]dentry
+
+	// The keys of the positive entries for each child inode, so that they can
+	// be dropped when the inode's attributes change.
+	//
+	// GUARDED_BY(mu)
+	byChild map[fuseops.InodeID]map[dentryKey]struct{}
+
+	// For each inode, the number of lookups answered from the cache and so
+	// never seen by the wrapped file system. The kernel's lookup count includes
+	// them, so they are deducted from forgets before those are passed on.
+	//
+	// GUARDED_BY(mu)
+	unseen map[fuseops.InodeID]uint64
+
+	// Incremented by every invalidation, so that lookups that were in progress
+	// at the time are not cached after it.
+	//
+	// GUARDED_BY(mu)
+	generation uint64
+}
+
+type dentryKey struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+// A cached lookup result. A zero Child means that the name doesn't exist.
+type dentry struct {
+	entry      fuseops.ChildInodeEntry
+	expiration time.Time
+}
+
+// NewLookupCachingFS returns a file system that passes ops to the supplied
+// one, remembering the results of LookUpInode, including failures with
+// ENOENT and negative entries, and answering repeated lookups of the same name from them until they
+// expire. This is meant for remote backends, where deep trees otherwise cause
+// a lookup storm for every path resolved, and is independent of the kernel's
+// own dentry cache, which file systems control with EntryExpiration.
+//
+// Entries are dropped when an op that may change them passes through: the
+// creation, removal or renaming of the name, or a change to the child's
+// attributes, which the entry carries. Use the returned LookupCache to drop
+// entries after changes made to the backend by other means.
+//
+// Lookups answered from the cache increment the kernel's lookup count for the
+// child without the wrapped file system seeing them. The wrapper accounts for
+// this by absorbing the corresponding part of later forget ops, so the wrapped
+// file system's lookup counts stay correct.
+func NewLookupCachingFS(
+	fs FileSystem,
+	cfg LookupCacheConfig) (FileSystem, *LookupCache) {
+	if cfg.Clock == nil {
+		cfg.Clock = timeutil.RealClock()
+	}
+
+	c := &LookupCache{
+		cfg:     cfg,
+		entries: make(map[dentryKey]dentry),
+		byChild: make(map[fuseops.InodeID]map[dentryKey]struct{}),
+		unseen:  make(map[fuseops.InodeID]uint64),
+	}
+
+	return &lookupCachingFS{FileSystem: fs, cache: c}, c
+}
+
+// Invalidate drops any entry for the supplied name within the parent.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *LookupCache) Invalidate(parent fuseops.InodeID, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.removeLocked(dentryKey{parent, name})
+}
+
+// InvalidateDir drops every entry within the supplied directory.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *LookupCache) InvalidateDir(parent fuseops.InodeID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for k := range c.entries {
+		if k.parent == parent {
+			c.removeLocked(k)
+		}
+	}
+}
+
+// InvalidateInode drops every entry that refers to the supplied child.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *LookupCache) InvalidateInode(child fuseops.InodeID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for k := range c.byChild[child] {
+		c.removeLocked(k)
+	}
+}
+
+// Purge drops every entry.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *LookupCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.entries = make(map[dentryKey]dentry)
+	c.byChild = make(map[fuseops.InodeID]map[dentryKey]struct{})
+}
+
+// LOCKS_REQUIRED(c.mu)
+func (c *LookupCache) removeLocked(k dentryKey) {
+	d, ok := c.entries[k]
+	if !ok {
+		return
+	}
+
+	delete(c.entries, k)
+	if d.entry.Child != 0 {
+		keys := c.byChild[d.entry.Child]
+		delete(keys, k)
+		if len(keys) == 0 {
+			delete(c.byChild, d.entry.Child)
+		}
+	}
+}
+
+// Return the cached result for a name, if there is one that hasn't expired.
+// A positive result counts as a lookup of the child.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *LookupCache) get(k dentryKey) (d dentry, ok bool, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	gen = c.generation
+	d, ok = c.entries[k]
+	if !ok {
+		return
+	}
+
+	if c.cfg.Clock.Now().After(d.expiration) {
+		c.removeLocked(k)
+		ok = false
+		return
+	}
+
+	if d.entry.Child != 0 {
+		c.unseen[d.entry.Child]++
+	}
+
+	return
+}
+
+// Cache a lookup result obtained at the supplied generation, unless something
+// has been invalidated since.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *LookupCache) put(gen uint64, k dentryKey, e fuseops.ChildInodeEntry) {
+	ttl := c.cfg.TTL
+	if e.Child == 0 {
+		ttl = c.cfg.NegativeTTL
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.generation {
+		return
+	}
+
+	c.removeLocked(k)
+	c.entries[k] = dentry{
+		entry:      e,
+		expiration: c.cfg.Clock.Now().Add(ttl),
+	}
+
+	if e.Child != 0 {
+		if c.byChild[e.Child] == nil {
+			c.byChild[e.Child] = make(map[dentryKey]struct{})
+		}
+
+		c.byChild[e.Child][k] = struct{}{}
+	}
+}
+
+// Deduct lookups that the wrapped file system never saw from a forget of n
+// lookups of the inode, returning the number to pass on. Entries for the
+// inode are dropped, since the file system may reuse its ID once its lookup
+// count reaches zero.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *LookupCache) forget(inode fuseops.InodeID, n uint64) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for k := range c.byChild[inode] {
+		c.removeLocked(k)
+	}
+
+	absorbed := c.unseen[inode]
+	if absorbed > n {
+		absorbed = n
+	}
+
+	if c.unseen[inode] -= absorbed; c.unseen[inode] == 0 {
+		delete(c.unseen, inode)
+	}
+
+	return n - absorbed
+}
+
+type lookupCachingFS struct {
+	FileSystem
+	cache *LookupCache
+}
+
+func (fs *lookupCachingFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	k := dentryKey{op.Parent, op.Name}
+	d, ok, gen := fs.cache.get(k)
+	if ok {
+		// A missing name is reported as the wrapped file system did: as a
+		// negative entry that the kernel may cache too, or as ENOENT.
+		if d.entry.Child == 0 && d.entry.EntryExpiration.IsZero() {
+			return fuse.ENOENT
+		}
+
+		op.Entry = d.entry
+		return nil
+	}
+
+	err := fs.FileSystem.LookUpInode(ctx, op)
+	switch {
+	case err == nil:
+		fs.cache.put(gen, k, op.Entry)
+
+	case errors.Is(err, fuse.ENOENT):
+		fs.cache.put(gen, k, fuseops.ChildInodeEntry{})
+	}
+
+	return err
+}
+
+func (fs *lookupCachingFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	n := fs.cache.forget(op.Inode, op.N)
+	if n == 0 {
+		return nil
+	}
+
+	op.N = n
+	return fs.FileSystem.ForgetInode(ctx, op)
+}
+
+func (fs *lookupCachingFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	entries := op.Entries[:0]
+	for _, e := range op.Entries {
+		if e.N = fs.cache.forget(e.Inode, e.N); e.N != 0 {
+			entries = append(entries, e)
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	op.Entries = entries
+	return fs.FileSystem.BatchForget(ctx, op)
+}
+
+func (fs *lookupCachingFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	defer fs.cache.InvalidateInode(op.Inode)
+	return fs.FileSystem.SetInodeAttributes(ctx, op)
+}
+
+func (fs *lookupCachingFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	defer fs.cache.Invalidate(op.Parent, op.Name)
+	return fs.FileSystem.MkDir(ctx, op)
+}
+
+func (fs *lookupCachingFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	defer fs.cache.Invalidate(op.Parent, op.Name)
+	return fs.FileSystem.MkNode(ctx, op)
+}
+
+func (fs *lookupCachingFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	defer fs.cache.Invalidate(op.Parent, op.Name)
+	return fs.FileSystem.CreateFile(ctx, op)
+}
+
+func (fs *lookupCachingFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	defer fs.cache.Invalidate(op.Parent, op.Name)
+	return fs.FileSystem.CreateSymlink(ctx, op)
+}
+
+func (fs *lookupCachingFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	// The target's link count, which its entries carry, changes too.
+	defer fs.cache.InvalidateInode(op.Target)
+	defer fs.cache.Invalidate(op.Parent, op.Name)
+	return fs.FileSystem.CreateLink(ctx, op)
+}
+
+func (fs *lookupCachingFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	defer fs.cache.Invalidate(op.NewParent, op.NewName)
+	defer fs.cache.Invalidate(op.OldParent, op.OldName)
+	return fs.FileSystem.Rename(ctx, op)
+}
+
+func (fs *lookupCachingFS) ExchangeData(
+	ctx context.Context,
+	op *fuseops.ExchangeDataOp) error {
+	// The entries carry the attributes of both files, which change.
+	defer fs.cache.Invalidate(op.NewParent, op.NewName)
+	defer fs.cache.Invalidate(op.OldParent, op.OldName)
+	return fs.FileSystem.ExchangeData(ctx, op)
+}
+
+func (fs *lookupCachingFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	defer fs.cache.Invalidate(op.Parent, op.Name)
+	return fs.FileSystem.RmDir(ctx, op)
+}
+
+func (fs *lookupCachingFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	defer fs.cache.Invalidate(op.Parent, op.Name)
+	return fs.FileSystem.Unlink(ctx, op)
+}
+
+func (fs *lookupCachingFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if op.OpenFlags&fusekernel.OpenTruncate != 0 {
+		defer fs.cache.InvalidateInode(op.Inode)
+	}
+
+	return fs.FileSystem.OpenFile(ctx, op)
+}
+
+func (fs *lookupCachingFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	defer fs.cache.InvalidateInode(op.Inode)
+	return fs.FileSystem.WriteFile(ctx, op)
+}
+
+func (fs *lookupCachingFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	defer fs.cache.InvalidateInode(op.Inode)
+	return fs.FileSystem.Fallocate(ctx, op)
+}
@@ -0,0 +1,209 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// A file system whose root contains the names in children, that counts the
+// lookups and forgets it sees. Missing names fail with missing (ENOENT if
+// nil), or if negative is set are reported as negative entries that expire
+// then.
+type lookupFS struct {
+	NotImplementedFileSystem
+	children map[string]fuseops.InodeID
+	missing  error
+	negative time.Time
+	lookups  int
+	forgets  map[fuseops.InodeID]uint64
+}
+
+func (fs *lookupFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.lookups++
+	child, ok := fs.children[op.Name]
+	if !ok && fs.negative.IsZero() {
+		if fs.missing != nil {
+			return fs.missing
+		}
+
+		return fuse.ENOENT
+	}
+
+	if !ok {
+		op.Entry.EntryExpiration = fs.negative
+		return nil
+	}
+
+	op.Entry.Child = child
+	return nil
+}
+
+func (fs *lookupFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.forgets[op.Inode] += op.N
+	return nil
+}
+
+func (fs *lookupFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	fs.children[op.Name] = 3
+	op.Entry.Child = 3
+	return nil
+}
+
+func TestLookupCachingFS(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	wrapped := &lookupFS{
+		children: map[string]fuseops.InodeID{"foo": 2},
+		forgets:  make(map[fuseops.InodeID]uint64),
+	}
+
+	fs, cache := NewLookupCachingFS(wrapped, LookupCacheConfig{
+		TTL:         time.Minute,
+		NegativeTTL: time.Second,
+		Clock:       &clock,
+	})
+
+	ctx := context.Background()
+	lookUp := func(name string) (fuseops.InodeID, error) {
+		op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: name}
+		err := fs.LookUpInode(ctx, op)
+		return op.Entry.Child, err
+	}
+
+	checkLookups := func(want int) {
+		t.Helper()
+		if wrapped.lookups != want {
+			t.Errorf("lookups: got %d, want %d", wrapped.lookups, want)
+		}
+	}
+
+	// Positive and negative results are both cached.
+	for i := 0; i < 3; i++ {
+		if child, err := lookUp("foo"); err != nil || child != 2 {
+			t.Fatalf("lookUp(foo): %v, %v", child, err)
+		}
+
+		if _, err := lookUp("bar"); err != fuse.ENOENT {
+			t.Fatalf("lookUp(bar): %v", err)
+		}
+	}
+	checkLookups(2)
+
+	// Creating a name drops its negative entry.
+	if err := fs.CreateFile(ctx, &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "bar"}); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	if child, err := lookUp("bar"); err != nil || child != 3 {
+		t.Errorf("lookUp(bar) after create: %v, %v", child, err)
+	}
+	checkLookups(3)
+
+	// Entries expire, and can be invalidated explicitly.
+	clock.AdvanceTime(2 * time.Minute)
+	lookUp("foo")
+	checkLookups(4)
+
+	cache.Invalidate(fuseops.RootInodeID, "foo")
+	lookUp("foo")
+	checkLookups(5)
+
+	// The kernel has looked up foo five times, but the file system has seen
+	// only three of them. A forget of all five passes on three.
+	if err := fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: 2, N: 5}); err != nil {
+		t.Fatalf("ForgetInode: %v", err)
+	}
+
+	if got := wrapped.forgets[2]; got != 3 {
+		t.Errorf("forgets passed on: got %d, want 3", got)
+	}
+}
+
+func TestLookupCachingFS_WrappedENOENT(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	// A missing name reported with a cause attached is cached like a bare
+	// ENOENT.
+	wrapped := &lookupFS{
+		missing: fuse.NewError(fuse.ENOENT, errors.New("no such object")),
+		forgets: make(map[fuseops.InodeID]uint64),
+	}
+
+	fs, _ := NewLookupCachingFS(wrapped, LookupCacheConfig{
+		TTL:         time.Minute,
+		NegativeTTL: time.Second,
+		Clock:       &clock,
+	})
+
+	for i := 0; i < 3; i++ {
+		op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "bar"}
+		if err := fs.LookUpInode(context.Background(), op); !errors.Is(err, fuse.ENOENT) {
+			t.Fatalf("LookUpInode: %v", err)
+		}
+	}
+
+	if wrapped.lookups != 1 {
+		t.Errorf("lookups: got %d, want 1", wrapped.lookups)
+	}
+}
+
+func TestLookupCachingFS_NegativeEntries(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	expiration := clock.Now().Add(time.Hour)
+	wrapped := &lookupFS{
+		children: map[string]fuseops.InodeID{},
+		negative: expiration,
+		forgets:  make(map[fuseops.InodeID]uint64),
+	}
+
+	fs, _ := NewLookupCachingFS(wrapped, LookupCacheConfig{
+		NegativeTTL: time.Second,
+		Clock:       &clock,
+	})
+
+	// The negative entry is cached, and passed on to the kernel each time.
+	for i := 0; i < 2; i++ {
+		op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "foo"}
+		if err := fs.LookUpInode(context.Background(), op); err != nil {
+			t.Fatalf("LookUpInode: %v", err)
+		}
+
+		if op.Entry.Child != 0 || !op.Entry.EntryExpiration.Equal(expiration) {
+			t.Errorf("Entry: %+v", op.Entry)
+		}
+	}
+
+	if wrapped.lookups != 1 {
+		t.Errorf("lookups: got %d, want 1", wrapped.lookups)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NewNormalizingFileSystem returns a file system that converts the names in
+// ops to the supplied Unicode normalization form before passing them to the
+// wrapped one, so that names which differ only in how accented characters are
+// composed reach it as the same name.
+//
+// This matters on macOS, where the Finder and other Cocoa apps send names in
+// NFD, with accents decomposed, while the terminal, most other programs and
+// most backends use NFC. Wrapping a file system that stores names in NFC with
+// norm.NFC lets a file created by either one be found by the other. Names
+// returned by ReadDir and the targets of symlinks are passed through
+// unchanged.
+func NewNormalizingFileSystem(fs FileSystem, form norm.Form) FileSystem {
+	return &normalizingFS{
+		FileSystem: fs,
+		form:       form,
+	}
+}
+
+type normalizingFS struct {
+	FileSystem
+	form norm.Form
+}
+
+func (fs *normalizingFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	op.Name = fs.form.String(op.Name)
+	return fs.FileSystem.LookUpInode(ctx, op)
+}
+
+func (fs *normalizingFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	op.Name = fs.form.String(op.Name)
+	return fs.FileSystem.MkDir(ctx, op)
+}
+
+func (fs *normalizingFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	op.Name = fs.form.String(op.Name)
+	return fs.FileSystem.MkNode(ctx, op)
+}
+
+func (fs *normalizingFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	op.Name = fs.form.String(op.Name)
+	return fs.FileSystem.CreateFile(ctx, op)
+}
+
+func (fs *normalizingFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	op.Name = fs.form.String(op.Name)
+	return fs.FileSystem.CreateLink(ctx, op)
+}
+
+func (fs *normalizingFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	op.Name = fs.form.String(op.Name)
+	return fs.FileSystem.CreateSymlink(ctx, op)
+}
+
+func (fs *normalizingFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	op.OldName = fs.form.String(op.OldName)
+	op.NewName = fs.form.String(op.NewName)
+	return fs.FileSystem.Rename(ctx, op)
+}
+
+func (fs *normalizingFS) ExchangeData(
+	ctx context.Context,
+	op *fuseops.ExchangeDataOp) error {
+	op.OldName = fs.form.String(op.OldName)
+	op.NewName = fs.form.String(op.NewName)
+	return fs.FileSystem.ExchangeData(ctx, op)
+}
+
+func (fs *normalizingFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	op.Name = fs.form.String(op.Name)
+	return fs.FileSystem.RmDir(ctx, op)
+}
+
+func (fs *normalizingFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	op.Name = fs.form.String(op.Name)
+	return fs.FileSystem.Unlink(ctx, op)
+}
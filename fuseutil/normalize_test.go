@@ -0,0 +1,71 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/text/unicode/norm"
+)
+
+// A file system that records the names it is passed.
+type namesFS struct {
+	NotImplementedFileSystem
+	names []string
+}
+
+func (fs *namesFS) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) error {
+	fs.names = append(fs.names, op.Name)
+	return nil
+}
+
+func (fs *namesFS) CreateFile(ctx context.Context, op *fuseops.CreateFileOp) error {
+	fs.names = append(fs.names, op.Name)
+	return nil
+}
+
+func (fs *namesFS) Rename(ctx context.Context, op *fuseops.RenameOp) error {
+	fs.names = append(fs.names, op.OldName, op.NewName)
+	return nil
+}
+
+func TestNormalizingFileSystem(t *testing.T) {
+	const (
+		nfc = "café"  // é as one code point
+		nfd = "café" // e followed by a combining acute accent
+	)
+
+	wrapped := &namesFS{}
+	fs := NewNormalizingFileSystem(wrapped, norm.NFC)
+	ctx := context.Background()
+
+	fs.LookUpInode(ctx, &fuseops.LookUpInodeOp{Name: nfd})
+	fs.LookUpInode(ctx, &fuseops.LookUpInodeOp{Name: nfc})
+	fs.CreateFile(ctx, &fuseops.CreateFileOp{Name: nfd})
+	fs.Rename(ctx, &fuseops.RenameOp{OldName: nfd, NewName: "plain"})
+
+	want := []string{nfc, nfc, nfc, nfc, "plain"}
+	if len(wrapped.names) != len(want) {
+		t.Fatalf("got %q, want %q", wrapped.names, want)
+	}
+
+	for i := range want {
+		if wrapped.names[i] != want[i] {
+			t.Errorf("name %d: got %q, want %q", i, wrapped.names[i], want[i])
+		}
+	}
+}
@@ -48,6 +48,12 @@ func (fs *NotImplementedFileSystem) GetInodeAttributes(
 	return fuse.ENOSYS
 }
 
+func (fs *NotImplementedFileSystem) GetXTimes(
+	ctx context.Context,
+	op *fuseops.GetXTimesOp) error {
+	return fuse.ENOSYS
+}
+
 func (fs *NotImplementedFileSystem) SetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.SetInodeAttributesOp) error {
@@ -84,6 +90,12 @@ func (fs *NotImplementedFileSystem) CreateFile(
 	return fuse.ENOSYS
 }
 
+func (fs *NotImplementedFileSystem) CreateTmpFile(
+	ctx context.Context,
+	op *fuseops.CreateTmpFileOp) error {
+	return fuse.ENOSYS
+}
+
 func (fs *NotImplementedFileSystem) CreateSymlink(
 	ctx context.Context,
 	op *fuseops.CreateSymlinkOp) error {
@@ -102,6 +114,12 @@ func (fs *NotImplementedFileSystem) Rename(
 	return fuse.ENOSYS
 }
 
+func (fs *NotImplementedFileSystem) ExchangeData(
+	ctx context.Context,
+	op *fuseops.ExchangeDataOp) error {
+	return fuse.ENOSYS
+}
+
 func (fs *NotImplementedFileSystem) RmDir(
 	ctx context.Context,
 	op *fuseops.RmDirOp) error {
@@ -210,5 +228,8 @@ func (fs *NotImplementedFileSystem) SyncFS(
 	return fuse.ENOSYS
 }
 
+func (fs *NotImplementedFileSystem) Init(op *fuseops.InitOp) {
+}
+
 func (fs *NotImplementedFileSystem) Destroy() {
 }
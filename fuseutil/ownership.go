@@ -0,0 +1,329 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// IDMap maps a user or group ID to another. A nil IDMap leaves IDs unchanged.
+type IDMap func(id uint32) uint32
+
+// SquashIDs returns an IDMap that maps every ID to the supplied one.
+func SquashIDs(id uint32) IDMap {
+	return func(uint32) uint32 { return id }
+}
+
+// ShiftIDs returns an IDMap that adds delta to every ID, wrapping around, so
+// that ShiftIDs(-delta) undoes it.
+func ShiftIDs(delta int32) IDMap {
+	return func(id uint32) uint32 { return id + uint32(delta) }
+}
+
+func (m IDMap) apply(id *uint32) {
+	if m != nil {
+		*id = m(*id)
+	}
+}
+
+// OwnershipMapping configures NewOwnershipMappedFS.
+type OwnershipMapping struct {
+	// Map the UID and GID of the process making each op, as found in its
+	// OpContext, to those seen by the file system. These also map the owner and
+	// group requested by SetInodeAttributesOp, as for chown(2).
+	CallerUid IDMap
+	CallerGid IDMap
+
+	// Map the owner and group of inodes, as returned by the file system in
+	// InodeAttributes, to those reported to the kernel.
+	OwnerUid IDMap
+	OwnerGid IDMap
+}
+
+// NewOwnershipMappedFS returns a file system that maps the ownership of
+// inodes, and the credentials of the processes making ops, between those seen
+// by the kernel and those seen by the supplied file system. This suits
+// backends with no ownership of their own, which can report everything as
+// owned by the user who mounted them with OwnerUid: SquashIDs(uid), or ID
+// ranges that must be shifted to suit the mount, with a ShiftIDs pair.
+//
+// Forgets are passed on unchanged. Note that the kernel checks permissions
+// against the attributes it is given if MountConfig.DefaultPermissions is set,
+// and so against the mapped owner and group.
+func NewOwnershipMappedFS(fs FileSystem, m OwnershipMapping) FileSystem {
+	return &ownershipMappedFS{FileSystem: fs, m: m}
+}
+
+type ownershipMappedFS struct {
+	FileSystem
+	m OwnershipMapping
+}
+
+func (fs *ownershipMappedFS) caller(oc *fuseops.OpContext) {
+	fs.m.CallerUid.apply(&oc.Uid)
+	fs.m.CallerGid.apply(&oc.Gid)
+}
+
+// Map the attributes returned by an op that succeeded.
+func (fs *ownershipMappedFS) owner(attrs *fuseops.InodeAttributes, err error) error {
+	if err == nil {
+		fs.m.OwnerUid.apply(&attrs.Uid)
+		fs.m.OwnerGid.apply(&attrs.Gid)
+	}
+
+	return err
+}
+
+func (fs *ownershipMappedFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.StatFS(ctx, op)
+}
+
+func (fs *ownershipMappedFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.caller(&op.OpContext)
+	err := fs.FileSystem.LookUpInode(ctx, op)
+	return fs.owner(&op.Entry.Attributes, err)
+}
+
+func (fs *ownershipMappedFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.caller(&op.OpContext)
+	err := fs.FileSystem.GetInodeAttributes(ctx, op)
+	return fs.owner(&op.Attributes, err)
+}
+
+func (fs *ownershipMappedFS) GetXTimes(
+	ctx context.Context,
+	op *fuseops.GetXTimesOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.GetXTimes(ctx, op)
+}
+
+func (fs *ownershipMappedFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fs.caller(&op.OpContext)
+
+	// The IDs requested are those seen by the kernel, like the caller's.
+	if op.Uid != nil {
+		uid := *op.Uid
+		fs.m.CallerUid.apply(&uid)
+		op.Uid = &uid
+	}
+
+	if op.Gid != nil {
+		gid := *op.Gid
+		fs.m.CallerGid.apply(&gid)
+		op.Gid = &gid
+	}
+
+	err := fs.FileSystem.SetInodeAttributes(ctx, op)
+	return fs.owner(&op.Attributes, err)
+}
+
+func (fs *ownershipMappedFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	fs.caller(&op.OpContext)
+	err := fs.FileSystem.MkDir(ctx, op)
+	return fs.owner(&op.Entry.Attributes, err)
+}
+
+func (fs *ownershipMappedFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	fs.caller(&op.OpContext)
+	err := fs.FileSystem.MkNode(ctx, op)
+	return fs.owner(&op.Entry.Attributes, err)
+}
+
+func (fs *ownershipMappedFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	fs.caller(&op.OpContext)
+	err := fs.FileSystem.CreateFile(ctx, op)
+	return fs.owner(&op.Entry.Attributes, err)
+}
+
+func (fs *ownershipMappedFS) CreateTmpFile(
+	ctx context.Context,
+	op *fuseops.CreateTmpFileOp) error {
+	fs.caller(&op.OpContext)
+	err := fs.FileSystem.CreateTmpFile(ctx, op)
+	return fs.owner(&op.Entry.Attributes, err)
+}
+
+func (fs *ownershipMappedFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	fs.caller(&op.OpContext)
+	err := fs.FileSystem.CreateLink(ctx, op)
+	return fs.owner(&op.Entry.Attributes, err)
+}
+
+func (fs *ownershipMappedFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	fs.caller(&op.OpContext)
+	err := fs.FileSystem.CreateSymlink(ctx, op)
+	return fs.owner(&op.Entry.Attributes, err)
+}
+
+func (fs *ownershipMappedFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.Rename(ctx, op)
+}
+
+func (fs *ownershipMappedFS) ExchangeData(
+	ctx context.Context,
+	op *fuseops.ExchangeDataOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.ExchangeData(ctx, op)
+}
+
+func (fs *ownershipMappedFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.RmDir(ctx, op)
+}
+
+func (fs *ownershipMappedFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.Unlink(ctx, op)
+}
+
+func (fs *ownershipMappedFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.OpenDir(ctx, op)
+}
+
+func (fs *ownershipMappedFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.ReadDir(ctx, op)
+}
+
+func (fs *ownershipMappedFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.ReleaseDirHandle(ctx, op)
+}
+
+func (fs *ownershipMappedFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.OpenFile(ctx, op)
+}
+
+func (fs *ownershipMappedFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.ReadFile(ctx, op)
+}
+
+func (fs *ownershipMappedFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.WriteFile(ctx, op)
+}
+
+func (fs *ownershipMappedFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.SyncFile(ctx, op)
+}
+
+func (fs *ownershipMappedFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.FlushFile(ctx, op)
+}
+
+func (fs *ownershipMappedFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.ReleaseFileHandle(ctx, op)
+}
+
+func (fs *ownershipMappedFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.ReadSymlink(ctx, op)
+}
+
+func (fs *ownershipMappedFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.RemoveXattr(ctx, op)
+}
+
+func (fs *ownershipMappedFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.GetXattr(ctx, op)
+}
+
+func (fs *ownershipMappedFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.ListXattr(ctx, op)
+}
+
+func (fs *ownershipMappedFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.SetXattr(ctx, op)
+}
+
+func (fs *ownershipMappedFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.Fallocate(ctx, op)
+}
+
+func (fs *ownershipMappedFS) SyncFS(
+	ctx context.Context,
+	op *fuseops.SyncFSOp) error {
+	fs.caller(&op.OpContext)
+	return fs.FileSystem.SyncFS(ctx, op)
+}
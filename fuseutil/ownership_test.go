@@ -0,0 +1,132 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A file system that records the credentials it sees, and owns everything as
+// UID 1000 and GID 2000.
+type ownedFS struct {
+	NotImplementedFileSystem
+	caller fuseops.OpContext
+	chown  fuseops.SetInodeAttributesOp
+}
+
+func (fs *ownedFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.caller = op.OpContext
+	op.Attributes.Uid = 1000
+	op.Attributes.Gid = 2000
+	return nil
+}
+
+func (fs *ownedFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fs.chown = *op
+	op.Attributes.Uid = *op.Uid
+	op.Attributes.Gid = *op.Gid
+	return nil
+}
+
+func (fs *ownedFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	fs.caller = op.OpContext
+	op.Entry.Attributes.Uid = op.OpContext.Uid
+	op.Entry.Attributes.Gid = op.OpContext.Gid
+	return nil
+}
+
+func TestOwnershipMappedFS_Squash(t *testing.T) {
+	wrapped := &ownedFS{}
+	fs := NewOwnershipMappedFS(wrapped, OwnershipMapping{
+		OwnerUid: SquashIDs(17),
+		OwnerGid: SquashIDs(19),
+	})
+
+	op := &fuseops.GetInodeAttributesOp{
+		OpContext: fuseops.OpContext{Uid: 501, Gid: 20},
+	}
+
+	if err := fs.GetInodeAttributes(context.Background(), op); err != nil {
+		t.Fatalf("GetInodeAttributes: %v", err)
+	}
+
+	if op.Attributes.Uid != 17 || op.Attributes.Gid != 19 {
+		t.Errorf("Got owner %d:%d, want 17:19", op.Attributes.Uid, op.Attributes.Gid)
+	}
+
+	// The caller is left alone.
+	if wrapped.caller.Uid != 501 || wrapped.caller.Gid != 20 {
+		t.Errorf("Got caller %d:%d, want 501:20", wrapped.caller.Uid, wrapped.caller.Gid)
+	}
+}
+
+func TestOwnershipMappedFS_Shift(t *testing.T) {
+	wrapped := &ownedFS{}
+	fs := NewOwnershipMappedFS(wrapped, OwnershipMapping{
+		CallerUid: ShiftIDs(-100000),
+		CallerGid: ShiftIDs(-100000),
+		OwnerUid:  ShiftIDs(100000),
+		OwnerGid:  ShiftIDs(100000),
+	})
+
+	ctx := context.Background()
+
+	// The caller is shifted on the way in, and the new directory's owner on the
+	// way out, so the kernel sees the caller own it.
+	mkDir := &fuseops.MkDirOp{
+		OpContext: fuseops.OpContext{Uid: 101000, Gid: 102000},
+	}
+
+	if err := fs.MkDir(ctx, mkDir); err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	if wrapped.caller.Uid != 1000 || wrapped.caller.Gid != 2000 {
+		t.Errorf("Got caller %d:%d, want 1000:2000", wrapped.caller.Uid, wrapped.caller.Gid)
+	}
+
+	if a := mkDir.Entry.Attributes; a.Uid != 101000 || a.Gid != 102000 {
+		t.Errorf("Got owner %d:%d, want 101000:102000", a.Uid, a.Gid)
+	}
+
+	// The owner requested by chown is shifted like the caller.
+	uid, gid := uint32(101005), uint32(102005)
+	setAttrs := &fuseops.SetInodeAttributesOp{Uid: &uid, Gid: &gid}
+	if err := fs.SetInodeAttributes(ctx, setAttrs); err != nil {
+		t.Fatalf("SetInodeAttributes: %v", err)
+	}
+
+	if *wrapped.chown.Uid != 1005 || *wrapped.chown.Gid != 2005 {
+		t.Errorf("Got chown to %d:%d, want 1005:2005", *wrapped.chown.Uid, *wrapped.chown.Gid)
+	}
+
+	if a := setAttrs.Attributes; a.Uid != 101005 || a.Gid != 102005 {
+		t.Errorf("Got owner %d:%d, want 101005:102005", a.Uid, a.Gid)
+	}
+
+	// The caller's copies are untouched.
+	if uid != 101005 || gid != 102005 {
+		t.Errorf("Caller's IDs changed to %d:%d", uid, gid)
+	}
+}
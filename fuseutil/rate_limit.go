@@ -0,0 +1,270 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// RateLimit is a budget of ops and bytes per second, each enforced with a
+// token bucket that allows bursts once it has had time to fill.
+type RateLimit struct {
+	// Ops per second, and how many may be served in a burst. Zero disables. A
+	// zero burst means one second's worth, and at least one.
+	OpsPerSecond float64
+	OpBurst      int
+
+	// Bytes per second read by ReadFileOp or written by WriteFileOp, counted
+	// when the op arrives by the size asked for, and how many may be read or
+	// written in a burst. Zero disables. A zero burst means one second's worth.
+	// An op larger than the burst is charged only the burst, so that it isn't
+	// held up forever.
+	BytesPerSecond float64
+	ByteBurst      int64
+}
+
+// RateLimitScope says which ops share a budget.
+type RateLimitScope int
+
+const (
+	// One budget for all ops.
+	RateLimitPerMount RateLimitScope = iota
+
+	// A budget for each UID, so that one user can't starve the others. Writes
+	// from the page cache carry no UID and share the budget of UID 0.
+	RateLimitPerUID
+
+	// A budget for each fuseops.OpClass, so that for example a flood of
+	// metadata ops doesn't hold up reads.
+	RateLimitPerClass
+)
+
+// RateLimitConfig configures NewRateLimitedFS.
+type RateLimitConfig struct {
+	// The budget given to each group of ops.
+	Limit RateLimit
+	Scope RateLimitScope
+
+	// Fail ops that are over budget with EAGAIN at once, rather than delaying
+	// them until the budget allows.
+	FailFast bool
+
+	// The clock used to refill budgets. If nil, timeutil.RealClock() is used.
+	// Delays are always measured in real time.
+	Clock timeutil.Clock
+}
+
+// NewRateLimitedFS returns a file system that passes ops to the supplied one
+// at no more than the rate allowed by cfg, delaying or failing those that are
+// over budget, so that a shared file system service can stop one user or kind
+// of work from starving the rest. An op whose context is cancelled while it
+// waits, for example because the kernel interrupted it, fails with EINTR.
+//
+// Forgets and the release of file and directory handles are never limited,
+// since they free resources and the kernel ignores their errors. Compare
+// NewThrottledFS, which bounds the number of ops in progress rather than
+// their rate; the two may be combined.
+func NewRateLimitedFS(fs FileSystem, cfg RateLimitConfig) FileSystem {
+	if cfg.Clock == nil {
+		cfg.Clock = timeutil.RealClock()
+	}
+
+	l := &rateLimiter{
+		cfg:     cfg,
+		budgets: make(map[uint64]*budget),
+	}
+
+	return &throttledFS{FileSystem: fs, admit: l.admit}
+}
+
+type rateLimiter struct {
+	cfg RateLimitConfig
+
+	mu sync.Mutex
+
+	// Keyed by UID or class, depending on the scope.
+	//
+	// GUARDED_BY(mu)
+	budgets map[uint64]*budget
+}
+
+type budget struct {
+	ops   *tokenBucket
+	bytes *tokenBucket
+}
+
+// Return the number of bytes the op is to be charged for.
+func opBytes(op interface{}) int64 {
+	switch o := op.(type) {
+	case *fuseops.ReadFileOp:
+		return o.Size
+
+	case *fuseops.WriteFileOp:
+		return int64(len(o.Data))
+
+	default:
+		return 0
+	}
+}
+
+// Return the key of the budget for the supplied op.
+func (l *rateLimiter) key(op interface{}) uint64 {
+	switch l.cfg.Scope {
+	case RateLimitPerUID:
+		ctx, _ := fuseops.ContextOf(op)
+		return uint64(ctx.Uid)
+
+	case RateLimitPerClass:
+		return uint64(fuseops.ClassOf(op))
+
+	default:
+		return 0
+	}
+}
+
+// LOCKS_EXCLUDED(l.mu)
+func (l *rateLimiter) admit(ctx context.Context, op interface{}) (func(), error) {
+	switch op.(type) {
+	case *fuseops.ReleaseFileHandleOp, *fuseops.ReleaseDirHandleOp:
+		return nil, nil
+	}
+
+	n := opBytes(op)
+
+	l.mu.Lock()
+	b := l.budgets[l.key(op)]
+	if b == nil {
+		b = l.newBudget()
+		l.budgets[l.key(op)] = b
+	}
+
+	now := l.cfg.Clock.Now()
+	if l.cfg.FailFast && !(b.ops.available(now, 1) && b.bytes.available(now, n)) {
+		l.mu.Unlock()
+		return nil, syscall.EAGAIN
+	}
+
+	wait := max(b.ops.take(now, 1), b.bytes.take(now, n))
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil, nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil, nil
+
+	case <-ctx.Done():
+		// Give back what we took, so that others needn't wait for it.
+		l.mu.Lock()
+		b.ops.giveBack(1)
+		b.bytes.giveBack(n)
+		l.mu.Unlock()
+
+		return nil, fuse.EINTR
+	}
+}
+
+// LOCKS_REQUIRED(l.mu)
+func (l *rateLimiter) newBudget() *budget {
+	lim := l.cfg.Limit
+	now := l.cfg.Clock.Now()
+
+	opBurst := float64(lim.OpBurst)
+	if opBurst <= 0 {
+		opBurst = max(1, lim.OpsPerSecond)
+	}
+
+	byteBurst := float64(lim.ByteBurst)
+	if byteBurst <= 0 {
+		byteBurst = lim.BytesPerSecond
+	}
+
+	return &budget{
+		ops:   newTokenBucket(lim.OpsPerSecond, opBurst, now),
+		bytes: newTokenBucket(lim.BytesPerSecond, byteBurst, now),
+	}
+}
+
+// A token bucket that refills at rate tokens per second up to burst. Takers
+// may drive it negative, and must then wait for it to refill to zero. Nil
+// means unlimited.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Return nil if rate is not positive.
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// Report whether n tokens could be taken without waiting.
+func (b *tokenBucket) available(now time.Time, n int64) bool {
+	if b == nil {
+		return true
+	}
+
+	b.refill(now)
+	return b.tokens >= min(float64(n), b.burst)
+}
+
+// Take n tokens, returning how long to wait until they're due.
+func (b *tokenBucket) take(now time.Time, n int64) time.Duration {
+	if b == nil || n == 0 {
+		return 0
+	}
+
+	b.refill(now)
+	b.tokens -= min(float64(n), b.burst)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Return tokens taken by an op that didn't go ahead after all.
+func (b *tokenBucket) giveBack(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+
+	b.tokens = min(b.burst, b.tokens+min(float64(n), b.burst))
+}
@@ -0,0 +1,164 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+func readAs(fs FileSystem, uid uint32, size int64) error {
+	return fs.ReadFile(context.Background(), &fuseops.ReadFileOp{
+		Size:      size,
+		OpContext: fuseops.OpContext{Uid: uid},
+	})
+}
+
+func TestRateLimitedFS_FailFast(t *testing.T) {
+	clock := &timeutil.SimulatedClock{}
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	fs := NewRateLimitedFS(&NotImplementedFileSystem{}, RateLimitConfig{
+		Limit:    RateLimit{OpsPerSecond: 2, OpBurst: 3},
+		FailFast: true,
+		Clock:    clock,
+	})
+
+	// The burst goes through to the wrapped file system.
+	for i := 0; i < 3; i++ {
+		if err := readAs(fs, 0, 0); err != syscall.ENOSYS {
+			t.Fatalf("Op %d: got %v, want ENOSYS", i, err)
+		}
+	}
+
+	if err := readAs(fs, 0, 0); err != syscall.EAGAIN {
+		t.Fatalf("Over budget: got %v, want EAGAIN", err)
+	}
+
+	// Releases are never limited.
+	err := fs.ReleaseFileHandle(context.Background(), &fuseops.ReleaseFileHandleOp{})
+	if err != syscall.ENOSYS {
+		t.Errorf("ReleaseFileHandle: got %v, want ENOSYS", err)
+	}
+
+	// Half a second buys one more op.
+	clock.AdvanceTime(500 * time.Millisecond)
+	if err := readAs(fs, 0, 0); err != syscall.ENOSYS {
+		t.Fatalf("After refill: got %v, want ENOSYS", err)
+	}
+
+	if err := readAs(fs, 0, 0); err != syscall.EAGAIN {
+		t.Fatalf("After refill, over budget: got %v, want EAGAIN", err)
+	}
+}
+
+func TestRateLimitedFS_Bytes(t *testing.T) {
+	clock := &timeutil.SimulatedClock{}
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	fs := NewRateLimitedFS(&NotImplementedFileSystem{}, RateLimitConfig{
+		Limit:    RateLimit{BytesPerSecond: 1000},
+		FailFast: true,
+		Clock:    clock,
+	})
+
+	if err := readAs(fs, 0, 600); err != syscall.ENOSYS {
+		t.Fatalf("First read: got %v, want ENOSYS", err)
+	}
+
+	if err := readAs(fs, 0, 600); err != syscall.EAGAIN {
+		t.Fatalf("Second read: got %v, want EAGAIN", err)
+	}
+
+	// Ops that move no bytes aren't held up.
+	err := fs.LookUpInode(context.Background(), &fuseops.LookUpInodeOp{})
+	if err != syscall.ENOSYS {
+		t.Fatalf("LookUpInode: got %v, want ENOSYS", err)
+	}
+
+	// A read larger than the burst is charged only the burst.
+	clock.AdvanceTime(time.Second)
+	if err := readAs(fs, 0, 1<<20); err != syscall.ENOSYS {
+		t.Fatalf("Large read: got %v, want ENOSYS", err)
+	}
+}
+
+func TestRateLimitedFS_PerUID(t *testing.T) {
+	clock := &timeutil.SimulatedClock{}
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	fs := NewRateLimitedFS(&NotImplementedFileSystem{}, RateLimitConfig{
+		Limit:    RateLimit{OpsPerSecond: 1},
+		Scope:    RateLimitPerUID,
+		FailFast: true,
+		Clock:    clock,
+	})
+
+	if err := readAs(fs, 17, 0); err != syscall.ENOSYS {
+		t.Fatalf("UID 17: got %v, want ENOSYS", err)
+	}
+
+	if err := readAs(fs, 17, 0); err != syscall.EAGAIN {
+		t.Fatalf("UID 17 again: got %v, want EAGAIN", err)
+	}
+
+	// Another user has their own budget.
+	if err := readAs(fs, 19, 0); err != syscall.ENOSYS {
+		t.Fatalf("UID 19: got %v, want ENOSYS", err)
+	}
+}
+
+func TestRateLimitedFS_Delays(t *testing.T) {
+	const rate = 50
+	fs := NewRateLimitedFS(&NotImplementedFileSystem{}, RateLimitConfig{
+		Limit: RateLimit{OpsPerSecond: rate, OpBurst: 1},
+	})
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := readAs(fs, 0, 0); err != syscall.ENOSYS {
+			t.Fatalf("Op %d: got %v, want ENOSYS", i, err)
+		}
+	}
+
+	// The first op uses the burst, and each of the rest waits for a token.
+	if elapsed, want := time.Since(start), 3*time.Second/rate; elapsed < want {
+		t.Errorf("Took %v, want at least %v", elapsed, want)
+	}
+}
+
+func TestRateLimitedFS_Cancelled(t *testing.T) {
+	fs := NewRateLimitedFS(&NotImplementedFileSystem{}, RateLimitConfig{
+		Limit: RateLimit{OpsPerSecond: 0.001},
+	})
+
+	if err := readAs(fs, 0, 0); err != syscall.ENOSYS {
+		t.Fatalf("First op: got %v, want ENOSYS", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := fs.ReadFile(ctx, &fuseops.ReadFileOp{})
+	if err != fuse.EINTR {
+		t.Errorf("Cancelled op: got %v, want EINTR", err)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// SetReadData responds to the supplied read with the given chunks, which hold
+// consecutive file contents starting at op.Offset, without copying them. The
+// chunks are trimmed so that no more than op.Size bytes are sent, and
+// op.BytesRead is set to the number that will be. Supplying fewer than
+// op.Size bytes signals EOF, as for any read.
+//
+// The chunks must remain valid and unmodified until the response has been
+// sent; see fuseops.ReadFileOp.Data.
+func SetReadData(op *fuseops.ReadFileOp, chunks ...[]byte) {
+	remaining := int(op.Size)
+	data := make([][]byte, 0, len(chunks))
+	for _, c := range chunks {
+		if remaining == 0 {
+			break
+		}
+
+		if len(c) == 0 {
+			continue
+		}
+
+		if len(c) > remaining {
+			c = c[:remaining]
+		}
+
+		data = append(data, c)
+		remaining -= len(c)
+	}
+
+	op.Data = data
+	op.BytesRead = int(op.Size) - remaining
+}
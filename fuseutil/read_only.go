@@ -0,0 +1,136 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// NewReadOnlyFileSystem returns a file system that passes ops that only read
+// to the supplied one, and fails those that would modify it (see
+// fuseops.Mutates) with EROFS without passing them on, so that any file system
+// can be served read-only. Unlike MountConfig.ReadOnly it composes with other
+// wrappers, for example to guard a writable backend beneath a cache.
+func NewReadOnlyFileSystem(fs FileSystem) FileSystem {
+	return &readOnlyFS{FileSystem: fs}
+}
+
+type readOnlyFS struct {
+	FileSystem
+}
+
+func (fs *readOnlyFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) CreateTmpFile(
+	ctx context.Context,
+	op *fuseops.CreateTmpFileOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) ExchangeData(
+	ctx context.Context,
+	op *fuseops.ExchangeDataOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return syscall.EROFS
+}
+
+// Opening for reading is fine; opening for writing or with O_TRUNC is not.
+func (fs *readOnlyFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if fuseops.Mutates(op) {
+		return syscall.EROFS
+	}
+
+	return fs.FileSystem.OpenFile(ctx, op)
+}
+
+func (fs *readOnlyFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	return syscall.EROFS
+}
@@ -0,0 +1,74 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestReadOnlyFileSystem(t *testing.T) {
+	// Ops that are passed on fail with ENOSYS.
+	fs := NewReadOnlyFileSystem(&NotImplementedFileSystem{})
+	ctx := context.Background()
+
+	testCases := []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{"StatFS", func() error { return fs.StatFS(ctx, &fuseops.StatFSOp{}) }, syscall.ENOSYS},
+		{"LookUpInode", func() error { return fs.LookUpInode(ctx, &fuseops.LookUpInodeOp{}) }, syscall.ENOSYS},
+		{"GetInodeAttributes", func() error { return fs.GetInodeAttributes(ctx, &fuseops.GetInodeAttributesOp{}) }, syscall.ENOSYS},
+		{"ReadDir", func() error { return fs.ReadDir(ctx, &fuseops.ReadDirOp{}) }, syscall.ENOSYS},
+		{"ReadFile", func() error { return fs.ReadFile(ctx, &fuseops.ReadFileOp{}) }, syscall.ENOSYS},
+		{"GetXattr", func() error { return fs.GetXattr(ctx, &fuseops.GetXattrOp{}) }, syscall.ENOSYS},
+		{"GetXTimes", func() error { return fs.GetXTimes(ctx, &fuseops.GetXTimesOp{}) }, syscall.ENOSYS},
+		{"OpenFile for reading", func() error {
+			return fs.OpenFile(ctx, &fuseops.OpenFileOp{OpenFlags: fusekernel.OpenReadOnly})
+		}, syscall.ENOSYS},
+
+		{"OpenFile for writing", func() error {
+			return fs.OpenFile(ctx, &fuseops.OpenFileOp{OpenFlags: fusekernel.OpenReadWrite})
+		}, syscall.EROFS},
+		{"OpenFile with O_TRUNC", func() error {
+			return fs.OpenFile(ctx, &fuseops.OpenFileOp{OpenFlags: fusekernel.OpenReadOnly | fusekernel.OpenTruncate})
+		}, syscall.EROFS},
+		{"SetInodeAttributes", func() error { return fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{}) }, syscall.EROFS},
+		{"MkDir", func() error { return fs.MkDir(ctx, &fuseops.MkDirOp{}) }, syscall.EROFS},
+		{"MkNode", func() error { return fs.MkNode(ctx, &fuseops.MkNodeOp{}) }, syscall.EROFS},
+		{"CreateFile", func() error { return fs.CreateFile(ctx, &fuseops.CreateFileOp{}) }, syscall.EROFS},
+		{"CreateLink", func() error { return fs.CreateLink(ctx, &fuseops.CreateLinkOp{}) }, syscall.EROFS},
+		{"CreateSymlink", func() error { return fs.CreateSymlink(ctx, &fuseops.CreateSymlinkOp{}) }, syscall.EROFS},
+		{"Rename", func() error { return fs.Rename(ctx, &fuseops.RenameOp{}) }, syscall.EROFS},
+		{"ExchangeData", func() error { return fs.ExchangeData(ctx, &fuseops.ExchangeDataOp{}) }, syscall.EROFS},
+		{"RmDir", func() error { return fs.RmDir(ctx, &fuseops.RmDirOp{}) }, syscall.EROFS},
+		{"Unlink", func() error { return fs.Unlink(ctx, &fuseops.UnlinkOp{}) }, syscall.EROFS},
+		{"WriteFile", func() error { return fs.WriteFile(ctx, &fuseops.WriteFileOp{}) }, syscall.EROFS},
+		{"SetXattr", func() error { return fs.SetXattr(ctx, &fuseops.SetXattrOp{}) }, syscall.EROFS},
+		{"RemoveXattr", func() error { return fs.RemoveXattr(ctx, &fuseops.RemoveXattrOp{}) }, syscall.EROFS},
+		{"Fallocate", func() error { return fs.Fallocate(ctx, &fuseops.FallocateOp{}) }, syscall.EROFS},
+	}
+
+	for _, tc := range testCases {
+		if err := tc.call(); err != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
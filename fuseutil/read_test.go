@@ -0,0 +1,68 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestSetReadData(t *testing.T) {
+	testCases := []struct {
+		name   string
+		size   int64
+		chunks []string
+		want   string
+	}{
+		{"exact", 6, []string{"foo", "bar"}, "foobar"},
+		{"trimmed", 4, []string{"foo", "bar", "baz"}, "foob"},
+		{"short", 10, []string{"foo", "", "bar"}, "foobar"},
+		{"empty", 10, nil, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var chunks [][]byte
+			for _, c := range tc.chunks {
+				chunks = append(chunks, []byte(c))
+			}
+
+			op := &fuseops.ReadFileOp{Size: tc.size}
+			SetReadData(op, chunks...)
+
+			if op.Data == nil {
+				t.Fatalf("Data is nil")
+			}
+
+			if got := string(bytes.Join(op.Data, nil)); got != tc.want {
+				t.Errorf("Data = %q, want %q", got, tc.want)
+			}
+
+			if op.BytesRead != len(tc.want) {
+				t.Errorf("BytesRead = %d, want %d", op.BytesRead, len(tc.want))
+			}
+		})
+	}
+
+	// The chunks should be sent as they are, not copied.
+	chunk := []byte("foobar")
+	op := &fuseops.ReadFileOp{Size: 3}
+	SetReadData(op, chunk)
+	if &op.Data[0][0] != &chunk[0] {
+		t.Errorf("Data[0] doesn't alias the supplied chunk")
+	}
+}
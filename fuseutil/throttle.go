@@ -0,0 +1,414 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// NewThrottledFS returns a file system that passes ops to the supplied one,
+// allowing at most limits[c] ops of each class c (see fuseops.ClassOf) to be
+// in progress at once. This suits backends with API rate limits, which can
+// then bound their parallelism without semaphores of their own. Classes that
+// are absent from limits, or whose limit is not positive, are not limited.
+// Forget ops are never held up, since they may be delivered synchronously.
+//
+// Ops that find their class at its limit wait in a queue, and are admitted in
+// the order they arrived, so a steady stream of ops cannot starve one that has
+// been waiting. An op whose context is cancelled while it waits, for example
+// because the kernel interrupted it, fails with EINTR.
+//
+// Unlike MountConfig.ServerClassWorkers, which bounds the goroutines serving
+// each class, this bounds only the calls into the wrapped file system, and
+// works with any server.
+func NewThrottledFS(fs FileSystem, limits map[fuseops.OpClass]int) FileSystem {
+	// Nil for classes that aren't limited.
+	var sems [fuseops.NumOpClasses]*fifoSemaphore
+	for c, n := range limits {
+		if n > 0 && int(c) >= 0 && int(c) < fuseops.NumOpClasses {
+			sems[c] = &fifoSemaphore{avail: n}
+		}
+	}
+
+	admit := func(ctx context.Context, op interface{}) (func(), error) {
+		s := sems[fuseops.ClassOf(op)]
+		if s == nil {
+			return nil, nil
+		}
+
+		if err := s.acquire(ctx); err != nil {
+			return nil, fuse.EINTR
+		}
+
+		return s.release, nil
+	}
+
+	return &throttledFS{FileSystem: fs, admit: admit}
+}
+
+// A file system that passes every op except forgets through admit before
+// handing it to the wrapped one. Shared by NewThrottledFS and
+// NewRateLimitedFS.
+type throttledFS struct {
+	FileSystem
+
+	// Wait until the op may go ahead, or return the error with which to fail
+	// it. Returns a function to call once the op is done, or nil.
+	admit func(ctx context.Context, op interface{}) (release func(), err error)
+}
+
+// Call f once the op has been admitted.
+func (fs *throttledFS) do(
+	ctx context.Context,
+	op interface{},
+	f func() error) error {
+	release, err := fs.admit(ctx, op)
+	if err != nil {
+		return err
+	}
+
+	if release != nil {
+		defer release()
+	}
+
+	return f()
+}
+
+// A counting semaphore that admits waiters in the order they arrived.
+type fifoSemaphore struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	avail int
+
+	// Channels of the goroutines waiting in acquire, oldest first. A waiter is
+	// admitted by removing it and closing its channel.
+	//
+	// GUARDED_BY(mu)
+	waiters list.List
+}
+
+// Wait for a slot, returning ctx.Err() if ctx is done first.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *fifoSemaphore) acquire(ctx context.Context) error {
+	s.mu.Lock()
+
+	// Take a slot straight away only if nobody is already waiting for one.
+	if s.avail > 0 && s.waiters.Len() == 0 {
+		s.avail--
+		s.mu.Unlock()
+		return nil
+	}
+
+	ready := make(chan struct{})
+	e := s.waiters.PushBack(ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// We may have been admitted in the meantime, in which case the slot must
+		// be handed on.
+		select {
+		case <-ready:
+			s.releaseLocked()
+		default:
+			s.waiters.Remove(e)
+		}
+
+		return ctx.Err()
+	}
+}
+
+// LOCKS_EXCLUDED(s.mu)
+func (s *fifoSemaphore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked()
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *fifoSemaphore) releaseLocked() {
+	if e := s.waiters.Front(); e != nil {
+		s.waiters.Remove(e)
+		close(e.Value.(chan struct{}))
+		return
+	}
+
+	s.avail++
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *throttledFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.StatFS(ctx, op)
+	})
+}
+
+func (fs *throttledFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.LookUpInode(ctx, op)
+	})
+}
+
+func (fs *throttledFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.GetInodeAttributes(ctx, op)
+	})
+}
+
+func (fs *throttledFS) GetXTimes(
+	ctx context.Context,
+	op *fuseops.GetXTimesOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.GetXTimes(ctx, op)
+	})
+}
+
+func (fs *throttledFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.SetInodeAttributes(ctx, op)
+	})
+}
+
+func (fs *throttledFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.MkDir(ctx, op)
+	})
+}
+
+func (fs *throttledFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.MkNode(ctx, op)
+	})
+}
+
+func (fs *throttledFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.CreateFile(ctx, op)
+	})
+}
+
+func (fs *throttledFS) CreateTmpFile(
+	ctx context.Context,
+	op *fuseops.CreateTmpFileOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.CreateTmpFile(ctx, op)
+	})
+}
+
+func (fs *throttledFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.CreateLink(ctx, op)
+	})
+}
+
+func (fs *throttledFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.CreateSymlink(ctx, op)
+	})
+}
+
+func (fs *throttledFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.Rename(ctx, op)
+	})
+}
+
+func (fs *throttledFS) ExchangeData(
+	ctx context.Context,
+	op *fuseops.ExchangeDataOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.ExchangeData(ctx, op)
+	})
+}
+
+func (fs *throttledFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.RmDir(ctx, op)
+	})
+}
+
+func (fs *throttledFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.Unlink(ctx, op)
+	})
+}
+
+func (fs *throttledFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.OpenDir(ctx, op)
+	})
+}
+
+func (fs *throttledFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.ReadDir(ctx, op)
+	})
+}
+
+func (fs *throttledFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.ReleaseDirHandle(ctx, op)
+	})
+}
+
+func (fs *throttledFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.OpenFile(ctx, op)
+	})
+}
+
+func (fs *throttledFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.ReadFile(ctx, op)
+	})
+}
+
+func (fs *throttledFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.WriteFile(ctx, op)
+	})
+}
+
+func (fs *throttledFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.SyncFile(ctx, op)
+	})
+}
+
+func (fs *throttledFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.FlushFile(ctx, op)
+	})
+}
+
+func (fs *throttledFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.ReleaseFileHandle(ctx, op)
+	})
+}
+
+func (fs *throttledFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.ReadSymlink(ctx, op)
+	})
+}
+
+func (fs *throttledFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.RemoveXattr(ctx, op)
+	})
+}
+
+func (fs *throttledFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.GetXattr(ctx, op)
+	})
+}
+
+func (fs *throttledFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.ListXattr(ctx, op)
+	})
+}
+
+func (fs *throttledFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.SetXattr(ctx, op)
+	})
+}
+
+func (fs *throttledFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.Fallocate(ctx, op)
+	})
+}
+
+func (fs *throttledFS) SyncFS(
+	ctx context.Context,
+	op *fuseops.SyncFSOp) error {
+	return fs.do(ctx, op, func() error {
+		return fs.FileSystem.SyncFS(ctx, op)
+	})
+}
@@ -0,0 +1,150 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A file system whose reads and lookups run through a gate.
+type gatedFS struct {
+	NotImplementedFileSystem
+	g *gate
+}
+
+func (fs *gatedFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.g.work()
+	return nil
+}
+
+func (fs *gatedFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.g.work()
+	return nil
+}
+
+func TestThrottledFS_Limits(t *testing.T) {
+	g := newGate()
+	fs := NewThrottledFS(&gatedFS{g: g}, map[fuseops.OpClass]int{
+		fuseops.OpClassRead: 2,
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fs.ReadFile(context.Background(), &fuseops.ReadFileOp{})
+		}()
+	}
+
+	g.awaitStarted(t, 2)
+	g.assertNoneStarted(t)
+
+	// Lookups are in a different class, which isn't limited.
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fs.LookUpInode(context.Background(), &fuseops.LookUpInodeOp{})
+		}()
+	}
+
+	g.awaitStarted(t, 3)
+
+	close(g.release)
+	wg.Wait()
+}
+
+func TestFIFOSemaphore_Order(t *testing.T) {
+	s := &fifoSemaphore{avail: 1}
+	if err := s.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	// Queue up waiters one at a time, so that their order is known.
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.acquire(context.Background())
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			s.release()
+		}(i)
+
+		for {
+			s.mu.Lock()
+			n := s.waiters.Len()
+			s.mu.Unlock()
+			if n == i+1 {
+				break
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	s.release()
+	wg.Wait()
+
+	if want := []int{0, 1, 2, 3, 4}; !reflect.DeepEqual(order, want) {
+		t.Errorf("order: got %v, want %v", order, want)
+	}
+}
+
+func TestThrottledFS_Cancelled(t *testing.T) {
+	g := newGate()
+	fs := NewThrottledFS(&gatedFS{g: g}, map[fuseops.OpClass]int{
+		fuseops.OpClassRead: 1,
+	})
+
+	done := make(chan struct{})
+	go func() {
+		fs.ReadFile(context.Background(), &fuseops.ReadFileOp{})
+		close(done)
+	}()
+
+	g.awaitStarted(t, 1)
+
+	// A read that can't get in gives up when its context is cancelled.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := fs.ReadFile(ctx, &fuseops.ReadFileOp{}); err != syscall.EINTR {
+		t.Errorf("ReadFile: got %v, want EINTR", err)
+	}
+
+	close(g.release)
+	<-done
+
+	// The slot is free again.
+	if err := fs.ReadFile(context.Background(), &fuseops.ReadFileOp{}); err != nil {
+		t.Errorf("ReadFile: %v", err)
+	}
+}
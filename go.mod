@@ -1,6 +1,6 @@
 module github.com/jacobsa/fuse
 
-go 1.20
+go 1.21
 
 require (
 	github.com/detailyang/go-fallocate v0.0.0-20180908115635-432fa640bd2e
@@ -9,8 +9,10 @@ require (
 	github.com/jacobsa/syncutil v0.0.0-20180201203307-228ac8e5a6c3
 	github.com/jacobsa/timeutil v0.0.0-20170205232429-577e5acbbcf6
 	github.com/kylelemons/godebug v1.1.0
+	golang.org/x/crypto v0.21.0
 	golang.org/x/net v0.23.0
 	golang.org/x/sys v0.18.0
+	golang.org/x/text v0.14.0
 )
 
 require (
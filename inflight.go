@@ -0,0 +1,237 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Stats describes the ops that a connection has read from the kernel but not
+// yet replied to, so as to tell where a slow mount is spending its time:
+//
+//   - Queued ops are waiting to be dispatched. A server created by
+//     fuseutil.NewFileSystemServer reads no more ops while one waits for a
+//     worker from a bounded pool (see MountConfig.ServerWorkers), so a queued
+//     op means that the pool is exhausted and further requests are waiting in
+//     the kernel.
+//   - Started ops are waiting on the server or whatever backs it.
+//   - If there are few of either while requests are slow, the time is being
+//     spent in the kernel.
+type Stats struct {
+	// Ops that the server hasn't yet started work on, as told by
+	// Connection.MarkOpStarted. Servers created by fuseutil.NewFileSystemServer
+	// call it; for servers that don't, every op counts as queued.
+	Queued int
+
+	// Ops that the server has started work on but not yet replied to.
+	Started int
+
+	// The bytes of file data carried by the WriteFileOps among the above, which
+	// are held in memory until replied to.
+	WriteBytes int64
+}
+
+// Stats returns a snapshot of the ops read from the kernel but not yet replied
+// to. Forget ops, which get no reply, aren't counted.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var s Stats
+	for _, o := range c.inflight {
+		if o.started {
+			s.Started++
+		} else {
+			s.Queued++
+		}
+
+		s.WriteBytes += int64(o.writeBytes)
+	}
+
+	return s
+}
+
+// DumpInflight writes a description of every op that has been read from the
+// kernel but not yet replied to, oldest first: its unique ID, name, inode and
+// age, and, if MountConfig.TrackOpGoroutines is set and the server has called
+// MarkOpStarted for it, the stack of the goroutine serving it. This is meant
+// for working out why a mount has hung.
+func (mfs *MountedFileSystem) DumpInflight(w io.Writer) error {
+	return mfs.conn.dumpInflight(w, time.Now())
+}
+
+// DumpInflightOnSignal arranges for DumpInflight to write to w each time the
+// process receives one of the supplied signals, or SIGQUIT if none are given.
+// Note that this replaces the runtime's default handling of those signals,
+// which for SIGQUIT is to dump all goroutines and exit. Call the returned
+// function to stop.
+func (mfs *MountedFileSystem) DumpInflightOnSignal(
+	w io.Writer,
+	sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGQUIT}
+	}
+
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, sigs...)
+
+	go func() {
+		for {
+			select {
+			case <-ch:
+				mfs.DumpInflight(w)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) dumpInflight(w io.Writer, now time.Time) error {
+	// Take a snapshot, so as not to hold the lock while walking stacks.
+	c.mu.Lock()
+	ops := make([]inflightOp, 0, len(c.inflight))
+	ids := make([]uint64, 0, len(c.inflight))
+	for id, o := range c.inflight {
+		ops = append(ops, *o)
+		ids = append(ids, id)
+	}
+	c.mu.Unlock()
+
+	order := make([]int, len(ops))
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.Slice(order, func(i, j int) bool {
+		a, b := ops[order[i]], ops[order[j]]
+		if !a.start.Equal(b.start) {
+			return a.start.Before(b.start)
+		}
+
+		return ids[order[i]] < ids[order[j]]
+	})
+
+	var stacks map[uint64]string
+	if c.cfg.TrackOpGoroutines {
+		stacks = goroutineStacks()
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%d ops in flight\n", len(ops))
+	for _, i := range order {
+		o := ops[i]
+		fmt.Fprintf(
+			bw,
+			"unique %d: %s, inode %d, age %v",
+			ids[i],
+			OpName(o.op),
+			o.inode,
+			now.Sub(o.start).Round(time.Millisecond))
+
+		if o.aborted {
+			fmt.Fprint(bw, ", aborted")
+		}
+
+		switch {
+		case o.goroutine == 0:
+			fmt.Fprint(bw, "\n")
+
+		case stacks[o.goroutine] == "":
+			fmt.Fprintf(bw, ", goroutine %d (exited)\n", o.goroutine)
+
+		default:
+			fmt.Fprintf(bw, ", goroutine %d\n", o.goroutine)
+			for _, line := range strings.Split(stacks[o.goroutine], "\n") {
+				fmt.Fprintf(bw, "\t%s\n", line)
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Return the ID of the calling goroutine, as shown in stack traces.
+func currentGoroutineID() uint64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	id, _ := parseGoroutineHeader(buf[:n])
+	return id
+}
+
+// Parse the ID out of a line of the form "goroutine 17 [running]:", returning
+// false if it isn't one.
+func parseGoroutineHeader(b []byte) (uint64, bool) {
+	const prefix = "goroutine "
+	if !bytes.HasPrefix(b, []byte(prefix)) {
+		return 0, false
+	}
+
+	b = b[len(prefix):]
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+
+	id, err := strconv.ParseUint(string(b), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return id, true
+}
+
+// Return the stack of every goroutine, keyed by ID, without the header line.
+func goroutineStacks() map[uint64]string {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+
+		buf = make([]byte, 2*len(buf))
+	}
+
+	stacks := make(map[uint64]string)
+	for _, g := range bytes.Split(buf, []byte("\n\n")) {
+		header, body, _ := bytes.Cut(g, []byte("\n"))
+		if id, ok := parseGoroutineHeader(header); ok {
+			stacks[id] = string(bytes.TrimRight(body, "\n"))
+		}
+	}
+
+	return stacks
+}
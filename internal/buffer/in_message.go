@@ -46,10 +46,11 @@ type InMessage struct {
 	size      int
 }
 
-// NewInMessage creates a new InMessage with its storage initialized.
+// NewInMessage creates a new InMessage with its storage initialized. The
+// storage is page-aligned. Most callers should use GetInMessage instead.
 func NewInMessage() *InMessage {
 	return &InMessage{
-		storage: make([]byte, bufSize),
+		storage: alignedBytes(bufSize),
 	}
 }
 
@@ -114,6 +115,12 @@ func (m *InMessage) Header() *fusekernel.InHeader {
 	return (*fusekernel.InHeader)(unsafe.Pointer(&m.storage[0]))
 }
 
+// Bytes returns the whole message read in the most recent call to Init,
+// including the header, regardless of how much has been consumed.
+func (m *InMessage) Bytes() []byte {
+	return m.storage[:m.size]
+}
+
 // Return the number of bytes left to consume.
 func (m *InMessage) Len() uintptr {
 	return uintptr(len(m.remaining))
@@ -145,10 +152,17 @@ func (m *InMessage) ConsumeBytes(n uintptr) []byte {
 	return b
 }
 
-// Get the next n bytes after the message to use them as a temporary buffer
+// Get n bytes of the storage following the message to use as a temporary
+// buffer. The result begins on a page boundary when there is room for that,
+// which is always the case for a read request of up to MaxReadSize bytes.
 func (m *InMessage) GetFree(n int) []byte {
-	if n <= 0 || n > len(m.storage)-m.size {
+	start := (m.size + pageSize - 1) &^ (pageSize - 1)
+	if start+n > len(m.storage) {
+		start = m.size
+	}
+
+	if n <= 0 || n > len(m.storage)-start {
 		return nil
 	}
-	return m.storage[m.size : m.size+n]
+	return m.storage[start : start+n]
 }
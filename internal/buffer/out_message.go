@@ -26,21 +26,53 @@ import (
 // properly-constructed OutMessage. Reset brings the message back to this size.
 const OutMessageHeaderSize = int(unsafe.Sizeof(fusekernel.OutHeader{}))
 
+// The size of the scratch space embedded in each OutMessage. It is large
+// enough for every fixed-size response struct, so that most replies don't
+// allocate at all.
+const outMessageScratchSize = 256
+
 // OutMessage provides a mechanism for constructing a single contiguous fuse
 // message from multiple segments, where the first segment is always a
 // fusekernel.OutHeader message.
 //
+// Segments created by Grow live in storage owned by the message (either the
+// embedded scratch space or pooled page-aligned buffers), and are only valid
+// until the next call to Reset.
+//
 // Must be initialized with Reset.
 type OutMessage struct {
 	header fusekernel.OutHeader
 	Sglist [][]byte
+
+	// Backing storage for Sglist, covering the common case of a header plus a
+	// few segments.
+	sglist [4][]byte
+
+	// Scratch space for small segments. Declared as uint64s so that response
+	// structs carved out of it are suitably aligned.
+	scratch     [outMessageScratchSize / 8]uint64
+	scratchUsed int
+
+	// Pooled buffers backing larger segments, returned by Reset.
+	pooled []*[]byte
 }
 
 // Reset resets m so that it's ready to be used again. Afterward, the contents
 // are solely a zeroed fusekernel.OutHeader struct.
 func (m *OutMessage) Reset() {
 	m.header = fusekernel.OutHeader{}
-	m.Sglist = nil
+	for i := range m.Sglist {
+		m.Sglist[i] = nil
+	}
+	m.sglist = [len(m.sglist)][]byte{}
+	m.Sglist = m.sglist[:0]
+	m.scratchUsed = 0
+
+	for i, p := range m.pooled {
+		putBuffer(p)
+		m.pooled[i] = nil
+	}
+	m.pooled = m.pooled[:0]
 }
 
 // OutHeader returns a pointer to the header at the start of the message.
@@ -51,10 +83,31 @@ func (m *OutMessage) OutHeader() *fusekernel.OutHeader {
 // Grow adds a new buffer of <n> bytes to the message, returning a pointer to
 // the start of the new segment, which is guaranteed to be zeroed.
 func (m *OutMessage) Grow(n int) unsafe.Pointer {
-	b := make([]byte, n)
+	var b []byte
+	if start := (m.scratchUsed + 7) &^ 7; start+n <= outMessageScratchSize {
+		scratch := (*[outMessageScratchSize]byte)(unsafe.Pointer(&m.scratch))
+		b = scratch[start : start+n : start+n]
+		for i := range b {
+			b[i] = 0
+		}
+		m.scratchUsed = start + n
+	} else {
+		p := getBuffer(n)
+		m.pooled = append(m.pooled, p)
+		b = *p
+	}
+
 	m.Append(b)
-	p := unsafe.Pointer(&b[0])
-	return p
+	return unsafe.Pointer(&b[0])
+}
+
+// Borrow returns a zeroed, page-aligned buffer of n bytes that is owned by
+// the message, like the segments created by Grow, but is not part of it. It is
+// valid until the next call to Reset.
+func (m *OutMessage) Borrow(n int) []byte {
+	p := getBuffer(n)
+	m.pooled = append(m.pooled, p)
+	return *p
 }
 
 // ShrinkTo shrinks m to the given size. It panics if the size is greater than
@@ -67,7 +120,7 @@ func (m *OutMessage) ShrinkTo(n int) {
 			m.Len()))
 	}
 	if n == OutMessageHeaderSize {
-		m.Sglist = nil
+		m.Sglist = m.Sglist[:0]
 	} else {
 		i := 1
 		n -= OutMessageHeaderSize
@@ -86,7 +139,7 @@ func (m *OutMessage) ShrinkTo(n int) {
 // Append is equivalent to growing by len(src), then copying src over the new
 // segment. Int panics if there is not enough room available.
 func (m *OutMessage) Append(src ...[]byte) {
-	if m.Sglist == nil {
+	if len(m.Sglist) == 0 {
 		// First element of Sglist is pre-filled with a pointer to the header
 		// to allow sending it with a single writev() call without copying the
 		// slice again
@@ -104,7 +157,7 @@ func (m *OutMessage) AppendString(src string) {
 
 // Len returns the current size of the message, including the leading header.
 func (m *OutMessage) Len() int {
-	if m.Sglist == nil {
+	if len(m.Sglist) == 0 {
 		return OutMessageHeaderSize
 	}
 	// First element of Sglist is the header, so we don't need to count it here
@@ -321,3 +321,33 @@ func BenchmarkOutMessageGrowShrink(b *testing.B) {
 		b.SetBytes(int64(MaxReadSize))
 	})
 }
+
+func TestOutMessageBorrow(t *testing.T) {
+	var om OutMessage
+	om.Reset()
+
+	size := 3 * pageSize
+	b := om.Borrow(size)
+	if len(b) != size {
+		t.Fatalf("len(b) = %d, want %d", len(b), size)
+	}
+
+	if p := uintptr(unsafe.Pointer(&b[0])); p%uintptr(pageSize) != 0 {
+		t.Errorf("buffer at %#x is not page-aligned", p)
+	}
+
+	// The buffer isn't part of the message.
+	if got, want := om.Len(), OutMessageHeaderSize; got != want {
+		t.Errorf("om.Len() = %d, want %d", got, want)
+	}
+
+	// It is returned to the pool by Reset.
+	if len(om.pooled) != 1 {
+		t.Fatalf("got %d pooled buffers, want 1", len(om.pooled))
+	}
+
+	om.Reset()
+	if len(om.pooled) != 0 {
+		t.Errorf("got %d pooled buffers after Reset, want 0", len(om.pooled))
+	}
+}
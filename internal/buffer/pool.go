@@ -0,0 +1,151 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package buffer
+
+import (
+	"math/bits"
+	"sync"
+	"unsafe"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Messages
+////////////////////////////////////////////////////////////////////////
+
+// The maximum number of idle InMessages kept for reuse. Each holds a little
+// more than MaxWriteSize bytes of storage, so this bounds the memory retained
+// after a burst of concurrent requests, while letting a steady workload of up
+// to this many requests in flight run without allocating.
+const inMessageFreelistSize = 64
+
+// Idle InMessages. Unlike a sync.Pool, a channel isn't emptied by the garbage
+// collector, which would otherwise force each large buffer to be reallocated
+// (and zeroed) after every couple of collections.
+var inMessages = make(chan *InMessage, inMessageFreelistSize)
+
+// OutMessages are small, so a sync.Pool suits them.
+var outMessages = sync.Pool{
+	New: func() interface{} {
+		m := new(OutMessage)
+		m.Reset()
+		return m
+	},
+}
+
+// GetInMessage returns an idle InMessage, allocating one if necessary. Return
+// it with PutInMessage once nothing refers to its contents any longer.
+func GetInMessage() *InMessage {
+	select {
+	case m := <-inMessages:
+		return m
+	default:
+		return NewInMessage()
+	}
+}
+
+// PutInMessage makes m available for reuse, or drops it if enough are idle
+// already. The caller must not use m, or any slice of its storage, afterward.
+func PutInMessage(m *InMessage) {
+	select {
+	case inMessages <- m:
+	default:
+	}
+}
+
+// GetOutMessage returns a reset OutMessage from a process-wide pool.
+func GetOutMessage() *OutMessage {
+	return outMessages.Get().(*OutMessage)
+}
+
+// PutOutMessage resets m, releasing any buffers it holds, and returns it to the
+// pool. The caller must not use m, or any segment of it, afterward.
+func PutOutMessage(m *OutMessage) {
+	m.Reset()
+	outMessages.Put(m)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Page-aligned buffers
+////////////////////////////////////////////////////////////////////////
+
+// The smallest and largest size classes handed out by getBuffer, as powers of
+// two. Requests above the largest class are allocated directly.
+const (
+	minBufferShift = 12 // 4 KiB
+	maxBufferShift = 20 // MaxReadSize
+)
+
+// One pool per size class. Elements are *[]byte so that Put doesn't allocate.
+var bufferPools [maxBufferShift - minBufferShift + 1]sync.Pool
+
+// Return the size class index for a buffer of n bytes, or -1 if n is too
+// large to be pooled.
+func sizeClass(n int) int {
+	if n <= 1<<minBufferShift {
+		return 0
+	}
+
+	shift := bits.Len(uint(n - 1))
+	if shift > maxBufferShift {
+		return -1
+	}
+
+	return shift - minBufferShift
+}
+
+// Allocate a slice of n bytes whose first byte lies on a page boundary.
+func alignedBytes(n int) []byte {
+	b := make([]byte, n+pageSize)
+	off := 0
+	if rem := int(uintptr(unsafe.Pointer(&b[0])) % uintptr(pageSize)); rem != 0 {
+		off = pageSize - rem
+	}
+
+	return b[off : off+n : off+n]
+}
+
+// Get a zeroed, page-aligned buffer of length n. The result must be handed
+// back to putBuffer, at which point the caller must no longer use it.
+func getBuffer(n int) *[]byte {
+	c := sizeClass(n)
+	if c < 0 {
+		b := alignedBytes(n)
+		return &b
+	}
+
+	p, _ := bufferPools[c].Get().(*[]byte)
+	if p == nil {
+		b := alignedBytes(1 << (c + minBufferShift))
+		p = &b
+	}
+
+	b := (*p)[:n]
+	for i := range b {
+		b[i] = 0
+	}
+	*p = b
+
+	return p
+}
+
+// Return a buffer obtained from getBuffer to its pool.
+func putBuffer(p *[]byte) {
+	c := sizeClass(cap(*p))
+	if c < 0 || cap(*p) != 1<<(c+minBufferShift) {
+		return
+	}
+
+	bufferPools[c].Put(p)
+}
@@ -0,0 +1,119 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package buffer
+
+import (
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+func isPageAligned(b []byte) bool {
+	return uintptr(unsafe.Pointer(&b[0]))%uintptr(pageSize) == 0
+}
+
+func TestGetBuffer(t *testing.T) {
+	sizes := []int{1, 100, 4096, 4097, 65536, MaxReadSize, MaxReadSize + 1}
+	for _, n := range sizes {
+		p := getBuffer(n)
+		b := *p
+
+		if len(b) != n {
+			t.Errorf("getBuffer(%d): len %d", n, len(b))
+		}
+
+		if !isPageAligned(b) {
+			t.Errorf("getBuffer(%d): not page-aligned", n)
+		}
+
+		for i, x := range b {
+			if x != 0 {
+				t.Fatalf("getBuffer(%d): non-zero byte at %d", n, i)
+			}
+		}
+
+		// Dirty it before returning it, so that a subsequent get of the same
+		// class would notice a failure to zero.
+		for i := range b {
+			b[i] = 0xff
+		}
+		putBuffer(p)
+	}
+}
+
+func TestOutMessageGrowLarge(t *testing.T) {
+	om := GetOutMessage()
+	defer PutOutMessage(om)
+
+	// Small segments come from the embedded scratch space.
+	small := om.Grow(64)
+	if uintptr(small)%8 != 0 {
+		t.Errorf("small segment %p is not 8-byte aligned", small)
+	}
+
+	// Large ones from a page-aligned pooled buffer.
+	const n = 3 * 4096
+	large := om.Grow(n)
+	if uintptr(large)%uintptr(pageSize) != 0 {
+		t.Errorf("large segment %p is not page-aligned", large)
+	}
+
+	if got, want := om.Len(), OutMessageHeaderSize+64+n; got != want {
+		t.Errorf("om.Len() = %d, want %d", got, want)
+	}
+}
+
+func TestInMessageGetFree(t *testing.T) {
+	m := GetInMessage()
+	defer PutInMessage(m)
+
+	// Pretend that a small request has been read.
+	m.size = 80
+
+	b := m.GetFree(MaxReadSize)
+	if b == nil {
+		t.Fatal("GetFree returned nil")
+	}
+
+	if !isPageAligned(b) {
+		t.Error("GetFree result is not page-aligned")
+	}
+
+	if m.GetFree(len(m.storage)) != nil {
+		t.Error("GetFree succeeded for an oversized request")
+	}
+}
+
+// Simulate a server with a few requests in flight, collecting garbage
+// periodically as a busy process would. Steady state should not allocate.
+func BenchmarkInMessageGetPutWithGC(b *testing.B) {
+	const inFlight = 16
+	msgs := make([]*InMessage, inFlight)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for j := range msgs {
+			msgs[j] = GetInMessage()
+		}
+
+		for _, m := range msgs {
+			PutInMessage(m)
+		}
+
+		if i%100 == 0 {
+			runtime.GC()
+		}
+	}
+}
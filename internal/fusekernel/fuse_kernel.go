@@ -46,7 +46,7 @@ const (
 	ProtoVersionMinMajor = 7
 	ProtoVersionMinMinor = 18
 	ProtoVersionMaxMajor = 7
-	ProtoVersionMaxMinor = 34
+	ProtoVersionMaxMinor = 36
 )
 
 const (
@@ -103,9 +103,11 @@ const (
 	SetattrHandle SetattrValid = 1 << 6
 
 	// Linux only(?)
-	SetattrAtimeNow  SetattrValid = 1 << 7
-	SetattrMtimeNow  SetattrValid = 1 << 8
-	SetattrLockOwner SetattrValid = 1 << 9 // http://www.mail-archive.com/git-commits-head@vger.kernel.org/msg27852.html
+	SetattrAtimeNow    SetattrValid = 1 << 7
+	SetattrMtimeNow    SetattrValid = 1 << 8
+	SetattrLockOwner   SetattrValid = 1 << 9  // http://www.mail-archive.com/git-commits-head@vger.kernel.org/msg27852.html
+	SetattrCtime       SetattrValid = 1 << 10 // With InitWritebackCache
+	SetattrKillSuidgid SetattrValid = 1 << 11 // With InitHandleKillprivV2
 
 	// OS X only
 	SetattrCrtime   SetattrValid = 1 << 28
@@ -114,20 +116,22 @@ const (
 	SetattrFlags    SetattrValid = 1 << 31
 )
 
-func (fl SetattrValid) Mode() bool      { return fl&SetattrMode != 0 }
-func (fl SetattrValid) Uid() bool       { return fl&SetattrUid != 0 }
-func (fl SetattrValid) Gid() bool       { return fl&SetattrGid != 0 }
-func (fl SetattrValid) Size() bool      { return fl&SetattrSize != 0 }
-func (fl SetattrValid) Atime() bool     { return fl&SetattrAtime != 0 }
-func (fl SetattrValid) Mtime() bool     { return fl&SetattrMtime != 0 }
-func (fl SetattrValid) Handle() bool    { return fl&SetattrHandle != 0 }
-func (fl SetattrValid) AtimeNow() bool  { return fl&SetattrAtimeNow != 0 }
-func (fl SetattrValid) MtimeNow() bool  { return fl&SetattrMtimeNow != 0 }
-func (fl SetattrValid) LockOwner() bool { return fl&SetattrLockOwner != 0 }
-func (fl SetattrValid) Crtime() bool    { return fl&SetattrCrtime != 0 }
-func (fl SetattrValid) Chgtime() bool   { return fl&SetattrChgtime != 0 }
-func (fl SetattrValid) Bkuptime() bool  { return fl&SetattrBkuptime != 0 }
-func (fl SetattrValid) Flags() bool     { return fl&SetattrFlags != 0 }
+func (fl SetattrValid) Mode() bool        { return fl&SetattrMode != 0 }
+func (fl SetattrValid) Uid() bool         { return fl&SetattrUid != 0 }
+func (fl SetattrValid) Gid() bool         { return fl&SetattrGid != 0 }
+func (fl SetattrValid) Size() bool        { return fl&SetattrSize != 0 }
+func (fl SetattrValid) Atime() bool       { return fl&SetattrAtime != 0 }
+func (fl SetattrValid) Mtime() bool       { return fl&SetattrMtime != 0 }
+func (fl SetattrValid) Handle() bool      { return fl&SetattrHandle != 0 }
+func (fl SetattrValid) AtimeNow() bool    { return fl&SetattrAtimeNow != 0 }
+func (fl SetattrValid) MtimeNow() bool    { return fl&SetattrMtimeNow != 0 }
+func (fl SetattrValid) LockOwner() bool   { return fl&SetattrLockOwner != 0 }
+func (fl SetattrValid) Ctime() bool       { return fl&SetattrCtime != 0 }
+func (fl SetattrValid) KillSuidgid() bool { return fl&SetattrKillSuidgid != 0 }
+func (fl SetattrValid) Crtime() bool      { return fl&SetattrCrtime != 0 }
+func (fl SetattrValid) Chgtime() bool     { return fl&SetattrChgtime != 0 }
+func (fl SetattrValid) Bkuptime() bool    { return fl&SetattrBkuptime != 0 }
+func (fl SetattrValid) Flags() bool       { return fl&SetattrFlags != 0 }
 
 func (fl SetattrValid) String() string {
 	return flagString(uint32(fl), setattrValidNames)
@@ -144,6 +148,8 @@ var setattrValidNames = []flagName{
 	{uint32(SetattrAtimeNow), "SetattrAtimeNow"},
 	{uint32(SetattrMtimeNow), "SetattrMtimeNow"},
 	{uint32(SetattrLockOwner), "SetattrLockOwner"},
+	{uint32(SetattrCtime), "SetattrCtime"},
+	{uint32(SetattrKillSuidgid), "SetattrKillSuidgid"},
 	{uint32(SetattrCrtime), "SetattrCrtime"},
 	{uint32(SetattrChgtime), "SetattrChgtime"},
 	{uint32(SetattrBkuptime), "SetattrBkuptime"},
@@ -164,6 +170,7 @@ const (
 	OpenExclusive OpenFlags = syscall.O_EXCL
 	OpenSync      OpenFlags = syscall.O_SYNC
 	OpenTruncate  OpenFlags = syscall.O_TRUNC
+	OpenNonblock  OpenFlags = syscall.O_NONBLOCK
 )
 
 // OpenAccessModeMask is a bitmask that separates the access mode
@@ -199,6 +206,26 @@ func (fl OpenFlags) IsReadWrite() bool {
 	return fl&OpenAccessModeMask == OpenReadWrite
 }
 
+// Return true if OpenAppend is set: writes are to be made at the end of the
+// file, wherever the caller thinks that is.
+func (fl OpenFlags) Append() bool { return fl&OpenAppend != 0 }
+
+// Return true if OpenExclusive is set: creation is to fail with EEXIST if the
+// name already exists.
+func (fl OpenFlags) Exclusive() bool { return fl&OpenExclusive != 0 }
+
+// Return true if OpenTruncate is set: the file is to be truncated to zero
+// length.
+func (fl OpenFlags) Truncate() bool { return fl&OpenTruncate != 0 }
+
+// Return true if OpenDirect is set: the caller wants to bypass caches. Always
+// false on OS X.
+func (fl OpenFlags) Direct() bool { return fl&OpenDirect != 0 }
+
+// Return true if OpenNoatime is set: reads through the handle are not to
+// update the access time. Always false on OS X.
+func (fl OpenFlags) Noatime() bool { return fl&OpenNoatime != 0 }
+
 func accModeName(flags OpenFlags) string {
 	switch flags {
 	case OpenReadOnly:
@@ -218,6 +245,7 @@ var openFlagNames = []flagName{
 	{uint32(OpenTruncate), "OpenTruncate"},
 	{uint32(OpenAppend), "OpenAppend"},
 	{uint32(OpenSync), "OpenSync"},
+	{uint32(OpenNonblock), "OpenNonblock"},
 }
 
 // The OpenResponseFlags are returned in the OpenResponse.
@@ -228,6 +256,7 @@ const (
 	OpenKeepCache   OpenResponseFlags = 1 << 1 // don't invalidate the data cache on open
 	OpenNonSeekable OpenResponseFlags = 1 << 2 // mark the file as non-seekable (not supported on OS X)
 	OpenCacheDir    OpenResponseFlags = 1 << 3 // allow caching this directory
+	OpenPassthrough OpenResponseFlags = 1 << 7 // pass IO to OpenOut.BackingID (Linux)
 
 	OpenPurgeAttr OpenResponseFlags = 1 << 30 // OS X
 	OpenPurgeUBC  OpenResponseFlags = 1 << 31 // OS X
@@ -242,6 +271,7 @@ var openResponseFlagNames = []flagName{
 	{uint32(OpenKeepCache), "OpenKeepCache"},
 	{uint32(OpenNonSeekable), "OpenNonSeekable"},
 	{uint32(OpenCacheDir), "OpenCacheDir"},
+	{uint32(OpenPassthrough), "OpenPassthrough"},
 	{uint32(OpenPurgeAttr), "OpenPurgeAttr"},
 	{uint32(OpenPurgeUBC), "OpenPurgeUBC"},
 }
@@ -250,29 +280,37 @@ var openResponseFlagNames = []flagName{
 type InitFlags uint32
 
 const (
-	InitAsyncRead        InitFlags = 1 << 0
-	InitPosixLocks       InitFlags = 1 << 1
-	InitFileOps          InitFlags = 1 << 2
-	InitAtomicTrunc      InitFlags = 1 << 3
-	InitExportSupport    InitFlags = 1 << 4
-	InitBigWrites        InitFlags = 1 << 5
-	InitDontMask         InitFlags = 1 << 6
-	InitSpliceWrite      InitFlags = 1 << 7
-	InitSpliceMove       InitFlags = 1 << 8
-	InitSpliceRead       InitFlags = 1 << 9
-	InitFlockLocks       InitFlags = 1 << 10
-	InitHasIoctlDir      InitFlags = 1 << 11
-	InitAutoInvalData    InitFlags = 1 << 12
-	InitDoReaddirplus    InitFlags = 1 << 13
-	InitReaddirplusAuto  InitFlags = 1 << 14
-	InitAsyncDIO         InitFlags = 1 << 15
-	InitWritebackCache   InitFlags = 1 << 16
-	InitNoOpenSupport    InitFlags = 1 << 17
-	InitParallelDirOps   InitFlags = 1 << 18
-	InitMaxPages         InitFlags = 1 << 22
-	InitCacheSymlinks    InitFlags = 1 << 23
-	InitNoOpendirSupport InitFlags = 1 << 24
-
+	InitAsyncRead         InitFlags = 1 << 0
+	InitPosixLocks        InitFlags = 1 << 1
+	InitFileOps           InitFlags = 1 << 2
+	InitAtomicTrunc       InitFlags = 1 << 3
+	InitExportSupport     InitFlags = 1 << 4
+	InitBigWrites         InitFlags = 1 << 5
+	InitDontMask          InitFlags = 1 << 6
+	InitSpliceWrite       InitFlags = 1 << 7
+	InitSpliceMove        InitFlags = 1 << 8
+	InitSpliceRead        InitFlags = 1 << 9
+	InitFlockLocks        InitFlags = 1 << 10
+	InitHasIoctlDir       InitFlags = 1 << 11
+	InitAutoInvalData     InitFlags = 1 << 12
+	InitDoReaddirplus     InitFlags = 1 << 13
+	InitReaddirplusAuto   InitFlags = 1 << 14
+	InitAsyncDIO          InitFlags = 1 << 15
+	InitWritebackCache    InitFlags = 1 << 16
+	InitNoOpenSupport     InitFlags = 1 << 17
+	InitParallelDirOps    InitFlags = 1 << 18
+	InitAbortError        InitFlags = 1 << 21 // Linux only
+	InitMaxPages          InitFlags = 1 << 22
+	InitCacheSymlinks     InitFlags = 1 << 23
+	InitNoOpendirSupport  InitFlags = 1 << 24
+	InitExplicitInvalData InitFlags = 1 << 25
+	InitHandleKillprivV2  InitFlags = 1 << 28 // Linux only
+	InitSetxattrExt       InitFlags = 1 << 29 // Linux only
+	InitExt               InitFlags = 1 << 30 // Linux only; see InitFlags2
+
+	// These share bits with the Linux-only flags above.
+	InitAllocate      InitFlags = 1 << 27 // OS X only
+	InitExchangeData  InitFlags = 1 << 28 // OS X only
 	InitCaseSensitive InitFlags = 1 << 29 // OS X only
 	InitVolRename     InitFlags = 1 << 30 // OS X only
 	InitXtimes        InitFlags = 1 << 31 // OS X only
@@ -305,16 +343,39 @@ var initFlagNames = []flagName{
 	{uint32(InitNoOpenSupport), "InitNoOpenSupport"},
 	{uint32(InitCacheSymlinks), "InitCacheSymlinks"},
 	{uint32(InitNoOpendirSupport), "InitNoOpendirSupport"},
+	{uint32(InitExplicitInvalData), "InitExplicitInvalData"},
+}
 
-	{uint32(InitCaseSensitive), "InitCaseSensitive"},
-	{uint32(InitVolRename), "InitVolRename"},
-	{uint32(InitXtimes), "InitXtimes"},
+func init() {
+	// The high bits mean different things on different platforms.
+	initFlagNames = append(initFlagNames, osInitFlagNames...)
+	openFlagNames = append(openFlagNames, osOpenFlagNames...)
 }
 
 func (fl InitFlags) String() string {
 	return flagString(uint32(fl), initFlagNames)
 }
 
+// The InitFlags2 are the upper 32 bits of the Init exchange flags. They are
+// only meaningful when both sides set InitExt (protocol 7.36 and later).
+type InitFlags2 uint32
+
+const (
+	InitSecurityCtx InitFlags2 = 1 << 0
+	InitPassthrough InitFlags2 = 1 << 5
+	InitOverIoUring InitFlags2 = 1 << 9
+)
+
+var initFlags2Names = []flagName{
+	{uint32(InitSecurityCtx), "InitSecurityCtx"},
+	{uint32(InitPassthrough), "InitPassthrough"},
+	{uint32(InitOverIoUring), "InitOverIoUring"},
+}
+
+func (fl InitFlags2) String() string {
+	return flagString(uint32(fl), initFlags2Names)
+}
+
 func flagString(f uint32, names []flagName) string {
 	var s string
 
@@ -399,6 +460,8 @@ const (
 	OpSetupMapping  = 48
 	OpRemoveMapping = 49
 	OpSyncFS        = 50
+	OpTmpfile       = 51 // Linux >= 6.1
+	OpStatx         = 52 // Linux >= 6.6
 
 	// OS X
 	OpSetvolname = 61
@@ -406,6 +469,71 @@ const (
 	OpExchange   = 63
 )
 
+var opcodeNames = map[uint32]string{
+	OpLookup:        "LOOKUP",
+	OpForget:        "FORGET",
+	OpGetattr:       "GETATTR",
+	OpSetattr:       "SETATTR",
+	OpReadlink:      "READLINK",
+	OpSymlink:       "SYMLINK",
+	OpMknod:         "MKNOD",
+	OpMkdir:         "MKDIR",
+	OpUnlink:        "UNLINK",
+	OpRmdir:         "RMDIR",
+	OpRename:        "RENAME",
+	OpLink:          "LINK",
+	OpOpen:          "OPEN",
+	OpRead:          "READ",
+	OpWrite:         "WRITE",
+	OpStatfs:        "STATFS",
+	OpRelease:       "RELEASE",
+	OpFsync:         "FSYNC",
+	OpSetxattr:      "SETXATTR",
+	OpGetxattr:      "GETXATTR",
+	OpListxattr:     "LISTXATTR",
+	OpRemovexattr:   "REMOVEXATTR",
+	OpFlush:         "FLUSH",
+	OpInit:          "INIT",
+	OpOpendir:       "OPENDIR",
+	OpReaddir:       "READDIR",
+	OpReleasedir:    "RELEASEDIR",
+	OpFsyncdir:      "FSYNCDIR",
+	OpGetlk:         "GETLK",
+	OpSetlk:         "SETLK",
+	OpSetlkw:        "SETLKW",
+	OpAccess:        "ACCESS",
+	OpCreate:        "CREATE",
+	OpInterrupt:     "INTERRUPT",
+	OpBmap:          "BMAP",
+	OpDestroy:       "DESTROY",
+	OpIoctl:         "IOCTL",
+	OpPoll:          "POLL",
+	OpBatchForget:   "BATCH_FORGET",
+	OpFallocate:     "FALLOCATE",
+	OpReaddirplus:   "READDIRPLUS",
+	OpRename2:       "RENAME2",
+	OpLseek:         "LSEEK",
+	OpCopyFileRange: "COPY_FILE_RANGE",
+	OpSetupMapping:  "SETUPMAPPING",
+	OpRemoveMapping: "REMOVEMAPPING",
+	OpSyncFS:        "SYNCFS",
+	OpTmpfile:       "TMPFILE",
+	OpStatx:         "STATX",
+	OpSetvolname:    "SETVOLNAME",
+	OpGetxtimes:     "GETXTIMES",
+	OpExchange:      "EXCHANGE",
+}
+
+// OpcodeName returns the name of an opcode as used by the kernel and libfuse,
+// e.g. "LOOKUP", or "UNKNOWN" if it is not one we know of.
+func OpcodeName(opcode uint32) string {
+	if name, ok := opcodeNames[opcode]; ok {
+		return name
+	}
+
+	return "UNKNOWN"
+}
+
 type EntryOut struct {
 	Nodeid         uint64 // Inode ID
 	Generation     uint64 // Inode generation
@@ -445,6 +573,60 @@ type GetattrIn struct {
 	Fh           uint64
 }
 
+// The request for OpStatx. GetattrFlags and Fh are as for GetattrIn, and
+// SxFlags and SxMask are the flags and mask passed to statx(2).
+type StatxIn struct {
+	GetattrFlags uint32
+	Reserved     uint32
+	Fh           uint64
+	SxFlags      uint32
+	SxMask       uint32
+}
+
+// The STATX_* bits of Statx.Mask that a file system may report.
+const (
+	StatxBasicStats = 0x7ff
+	StatxBtime      = 0x800
+)
+
+type SxTime struct {
+	Sec      int64
+	Nsec     uint32
+	Reserved int32
+}
+
+type Statx struct {
+	Mask           uint32
+	Blksize        uint32
+	Attributes     uint64
+	Nlink          uint32
+	Uid            uint32
+	Gid            uint32
+	Mode           uint16
+	Spare0         uint16
+	Ino            uint64
+	Size           uint64
+	Blocks         uint64
+	AttributesMask uint64
+	Atime          SxTime
+	Btime          SxTime
+	Ctime          SxTime
+	Mtime          SxTime
+	RdevMajor      uint32
+	RdevMinor      uint32
+	DevMajor       uint32
+	DevMinor       uint32
+	Spare2         [14]uint64
+}
+
+type StatxOut struct {
+	AttrValid     uint64 // Cache timeout for the attributes
+	AttrValidNsec uint32
+	Flags         uint32
+	Spare         [2]uint64
+	Stat          Statx
+}
+
 type AttrOut struct {
 	AttrValid     uint64 // Cache timeout for the attributes
 	AttrValidNsec uint32
@@ -506,6 +688,13 @@ type RenameIn struct {
 	// "oldname\x00newname\x00" follows
 }
 
+type Rename2In struct {
+	Newdir  uint64
+	Flags   uint32
+	Padding uint32
+	// "oldname\x00newname\x00" follows
+}
+
 // OS X
 type ExchangeIn struct {
 	Olddir  uint64
@@ -525,10 +714,10 @@ type setattrInCommon struct {
 	LockOwner uint64 // unused on OS X?
 	Atime     uint64
 	Mtime     uint64
-	Unused2   uint64
+	Ctime     uint64
 	AtimeNsec uint32
 	MtimeNsec uint32
-	Unused3   uint32
+	CtimeNsec uint32
 	Mode      uint32
 	Unused4   uint32
 	Uid       uint32
@@ -537,21 +726,26 @@ type setattrInCommon struct {
 }
 
 type OpenIn struct {
-	Flags  uint32
-	Unused uint32
+	Flags     uint32
+	OpenFlags uint32 // OpenInKillSuidgid
 }
 
+// OpenInKillSuidgid is set in OpenIn.OpenFlags and CreateIn.OpenFlags when
+// InitHandleKillprivV2 is in effect and the file is being truncated by a
+// caller without CAP_FSETID.
+const OpenInKillSuidgid = 1 << 0
+
 type OpenOut struct {
 	Fh        uint64
 	OpenFlags uint32
-	Padding   uint32
+	BackingID int32 // With OpenPassthrough
 }
 
 type CreateIn struct {
-	Flags   uint32
-	Mode    uint32
-	Umask   uint32
-	padding uint32
+	Flags     uint32
+	Mode      uint32
+	Umask     uint32
+	OpenFlags uint32 // OpenInKillSuidgid
 }
 
 func CreateInSize(p Protocol) uintptr {
@@ -643,11 +837,14 @@ const (
 	WriteCache WriteFlags = 1 << 0
 	// LockOwner field is valid.
 	WriteLockOwner WriteFlags = 1 << 1
+	// With InitHandleKillprivV2, the caller lacks CAP_FSETID.
+	WriteKillSuidgid WriteFlags = 1 << 2
 )
 
 var writeFlagNames = []flagName{
 	{uint32(WriteCache), "WriteCache"},
 	{uint32(WriteLockOwner), "WriteLockOwner"},
+	{uint32(WriteKillSuidgid), "WriteKillSuidgid"},
 }
 
 func (fl WriteFlags) String() string {
@@ -666,6 +863,10 @@ type FsyncIn struct {
 	Padding    uint32
 }
 
+// Set in FsyncIn.FsyncFlags when only the data, and the metadata needed to
+// read it back, must be flushed, as for fdatasync(2).
+const FsyncFdatasync = 1 << 0
+
 type setxattrInCommon struct {
 	Size  uint32
 	Flags uint32
@@ -675,6 +876,21 @@ func (setxattrInCommon) GetPosition() uint32 {
 	return 0
 }
 
+// SetxattrExtIn is sent in place of SetxattrIn once InitSetxattrExt has been
+// negotiated. Linux only.
+type SetxattrExtIn struct {
+	setxattrInCommon
+	SetxattrFlags uint32
+	padding       uint32
+}
+
+// Bits in SetxattrExtIn.SetxattrFlags.
+const (
+	// The caller is setting a POSIX access ACL without being in the file's
+	// group or having CAP_FSETID, so the setgid bit must be cleared.
+	SetxattrAclKillSgid = 1 << 0
+)
+
 type getxattrInCommon struct {
 	Size    uint32
 	Padding uint32
@@ -737,6 +953,12 @@ type InitIn struct {
 
 const InitInSize = int(unsafe.Sizeof(InitIn{}))
 
+// InitInExt follows InitIn when the kernel sets InitExt.
+type InitInExt struct {
+	Flags2 uint32
+	Unused [11]uint32
+}
+
 type InitOut struct {
 	Major               uint32
 	Minor               uint32
@@ -748,7 +970,9 @@ type InitOut struct {
 	TimeGran            uint32
 	MaxPages            uint16
 	MapAlignment        uint16
-	Unused              [8]uint32
+	Flags2              uint32
+	MaxStackDepth       uint32 // With InitPassthrough
+	Unused              [6]uint32
 }
 
 type InterruptIn struct {
@@ -766,14 +990,15 @@ type BmapOut struct {
 }
 
 type InHeader struct {
-	Len     uint32
-	Opcode  uint32
-	Unique  uint64
-	Nodeid  uint64
-	Uid     uint32
-	Gid     uint32
-	Pid     uint32
-	Padding uint32
+	Len         uint32
+	Opcode      uint32
+	Unique      uint64
+	Nodeid      uint64
+	Uid         uint32
+	Gid         uint32
+	Pid         uint32
+	TotalExtlen uint16 // In units of 8 bytes; protocol 7.38 and later.
+	Padding     uint16
 }
 
 const InHeaderSize = int(unsafe.Sizeof(InHeader{}))
@@ -815,3 +1040,20 @@ type NotifyInvalEntryOut struct {
 type SyncFSIn struct {
 	Padding uint64
 }
+
+// ExtHeader precedes each request extension appended to a message. Types
+// 0..MaxNrSecctx denote a list of security contexts (struct
+// fuse_secctx_header), with Type holding the number of entries.
+type ExtHeader struct {
+	Size uint32 // Including this header and any trailing padding.
+	Type uint32
+}
+
+const MaxNrSecctx = 31
+
+// Secctx is followed by a null-terminated xattr name and then Size bytes of
+// value. The whole record is padded to a multiple of eight bytes.
+type Secctx struct {
+	Size    uint32
+	Padding uint32
+}
@@ -86,3 +86,20 @@ type SetxattrIn struct {
 func (s *SetxattrIn) GetPosition() uint32 {
 	return s.Position
 }
+
+// Names for the InitFlags bits whose meaning is specific to OS X.
+// OS X has no O_DIRECT or O_NOATIME.
+const (
+	OpenDirect  OpenFlags = 0
+	OpenNoatime OpenFlags = 0
+)
+
+var osOpenFlagNames []flagName
+
+var osInitFlagNames = []flagName{
+	{uint32(InitAllocate), "InitAllocate"},
+	{uint32(InitExchangeData), "InitExchangeData"},
+	{uint32(InitCaseSensitive), "InitCaseSensitive"},
+	{uint32(InitVolRename), "InitVolRename"},
+	{uint32(InitXtimes), "InitXtimes"},
+}
@@ -1,6 +1,9 @@
 package fusekernel
 
-import "time"
+import (
+	"syscall"
+	"time"
+)
 
 type Attr struct {
 	Ino       uint64
@@ -68,3 +71,76 @@ type GetxattrIn struct {
 type SetxattrIn struct {
 	setxattrInCommon
 }
+
+// BackingMap is passed to DevIocBackingOpen to register a backing file for
+// passthrough.
+type BackingMap struct {
+	Fd      int32
+	Flags   uint32
+	padding uint64
+}
+
+// Ioctl on a newly opened fuse device that attaches it to the connection of
+// the device whose fd it is passed, so that requests can be read from either.
+const DevIocClone = 0x8004e500 // _IOR(229, 0, uint32)
+
+// Ioctls on the device for managing backing files, returning and taking the
+// backing ID.
+const (
+	DevIocBackingOpen  = 0x4010e501 // _IOW(229, 1, BackingMap)
+	DevIocBackingClose = 0x4004e502 // _IOW(229, 2, uint32)
+)
+
+// Commands for serving requests over io_uring, issued as IORING_OP_URING_CMD
+// on the device with a UringCmdReq. Registering hands the kernel a ring entry,
+// made up of a UringReqHeader and a payload buffer, in which it will place a
+// request; committing sends the reply placed there and hands it back.
+const (
+	UringCmdRegister       = 1
+	UringCmdCommitAndFetch = 2
+)
+
+// UringReqHeader is the header of an io_uring ring entry. For a request, InOut
+// holds the InHeader and OpIn the op's first argument, with the rest in the
+// payload buffer; for a reply, InOut holds the OutHeader, with the rest in the
+// payload buffer.
+type UringReqHeader struct {
+	InOut        [128]byte
+	OpIn         [128]byte
+	RingEntInOut UringEntInOut
+}
+
+type UringEntInOut struct {
+	Flags     uint64
+	CommitID  uint64 // For UringCmdReq, when replying.
+	PayloadSz uint32 // The length of the payload.
+	padding   uint32
+	reserved  uint64
+}
+
+// UringCmdReq is the command of an io_uring submission.
+type UringCmdReq struct {
+	Flags    uint64
+	CommitID uint64
+	Qid      uint16
+	padding  [6]uint8
+}
+
+// Names for the InitFlags bits whose meaning is specific to Linux.
+// Flags that can be seen in OpenRequest.Flags on Linux only.
+const (
+	OpenDirect  OpenFlags = syscall.O_DIRECT
+	OpenNoatime OpenFlags = syscall.O_NOATIME
+)
+
+var osOpenFlagNames = []flagName{
+	{uint32(OpenDirect), "OpenDirect"},
+	{uint32(OpenNoatime), "OpenNoatime"},
+}
+
+var osInitFlagNames = []flagName{
+	{uint32(InitAbortError), "InitAbortError"},
+	{uint32(InitHandleKillprivV2), "InitHandleKillprivV2"},
+	{uint32(InitSetxattrExt), "InitSetxattrExt"},
+	{uint32(InitExt), "InitExt"},
+}
@@ -0,0 +1,276 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package iouring is a minimal io_uring, with just what serving fuse requests
+// over io_uring needs: rings with 128-byte submission queue entries, which
+// one goroutine at a time may submit to while another waits for completions.
+package iouring
+
+import (
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Opcodes.
+const (
+	OpNop      = 0
+	OpUringCmd = 46
+)
+
+const (
+	setupSQE128 = 1 << 10
+
+	enterGetEvents = 1 << 0
+
+	offSQRing = 0
+	offCQRing = 0x8000000
+	offSQEs   = 0x10000000
+)
+
+// SQE is a submission queue entry, struct io_uring_sqe with room for the
+// 80-byte command of an OpUringCmd.
+type SQE struct {
+	Opcode      uint8
+	Flags       uint8
+	Ioprio      uint16
+	Fd          int32
+	CmdOp       uint32 // Or the low half of the offset, for other ops.
+	pad1        uint32
+	Addr        uint64
+	Len         uint32
+	OpFlags     uint32
+	UserData    uint64
+	BufIndex    uint16
+	Personality uint16
+	SpliceFdIn  int32
+	Cmd         [80]byte
+}
+
+// CQE is a completion queue entry, struct io_uring_cqe.
+type CQE struct {
+	UserData uint64
+	Res      int32
+	Flags    uint32
+}
+
+type sqringOffsets struct {
+	Head        uint32
+	Tail        uint32
+	RingMask    uint32
+	RingEntries uint32
+	Flags       uint32
+	Dropped     uint32
+	Array       uint32
+	Resv1       uint32
+	UserAddr    uint64
+}
+
+type cqringOffsets struct {
+	Head        uint32
+	Tail        uint32
+	RingMask    uint32
+	RingEntries uint32
+	Overflow    uint32
+	Cqes        uint32
+	Flags       uint32
+	Resv1       uint32
+	UserAddr    uint64
+}
+
+type params struct {
+	SQEntries    uint32
+	CQEntries    uint32
+	Flags        uint32
+	SQThreadCPU  uint32
+	SQThreadIdle uint32
+	Features     uint32
+	WQFd         uint32
+	Resv         [3]uint32
+	SQOff        sqringOffsets
+	CQOff        cqringOffsets
+}
+
+// Ring is an io_uring instance.
+type Ring struct {
+	fd int
+
+	sqRing []byte
+	cqRing []byte
+	sqeMem []byte
+
+	sqHead  *uint32
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray []uint32
+	sqes    []SQE
+
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+	cqes   []CQE
+}
+
+// New creates a ring with room for at least the supplied number of
+// submissions in flight.
+func New(entries uint32) (*Ring, error) {
+	p := params{Flags: setupSQE128}
+	fd, _, errno := unix.Syscall(
+		unix.SYS_IO_URING_SETUP,
+		uintptr(entries),
+		uintptr(unsafe.Pointer(&p)),
+		0)
+	if errno != 0 {
+		return nil, fmt.Errorf("io_uring_setup: %v", errno)
+	}
+
+	r := &Ring{fd: int(fd)}
+	if err := r.mmap(&p); err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Ring) mmap(p *params) error {
+	var err error
+	mmap := func(offset int64, size uint32) []byte {
+		if err != nil {
+			return nil
+		}
+
+		var b []byte
+		b, err = unix.Mmap(
+			r.fd,
+			offset,
+			int(size),
+			unix.PROT_READ|unix.PROT_WRITE,
+			unix.MAP_SHARED|unix.MAP_POPULATE)
+		return b
+	}
+
+	r.sqRing = mmap(offSQRing, p.SQOff.Array+p.SQEntries*4)
+	r.cqRing = mmap(offCQRing, p.CQOff.Cqes+p.CQEntries*uint32(unsafe.Sizeof(CQE{})))
+	r.sqeMem = mmap(offSQEs, p.SQEntries*uint32(unsafe.Sizeof(SQE{})))
+	if err != nil {
+		return fmt.Errorf("Mmap: %v", err)
+	}
+
+	u32 := func(b []byte, off uint32) *uint32 {
+		return (*uint32)(unsafe.Pointer(&b[off]))
+	}
+
+	r.sqHead = u32(r.sqRing, p.SQOff.Head)
+	r.sqTail = u32(r.sqRing, p.SQOff.Tail)
+	r.sqMask = *u32(r.sqRing, p.SQOff.RingMask)
+	r.sqArray = unsafe.Slice(u32(r.sqRing, p.SQOff.Array), p.SQEntries)
+	r.sqes = unsafe.Slice((*SQE)(unsafe.Pointer(&r.sqeMem[0])), p.SQEntries)
+
+	r.cqHead = u32(r.cqRing, p.CQOff.Head)
+	r.cqTail = u32(r.cqRing, p.CQOff.Tail)
+	r.cqMask = *u32(r.cqRing, p.CQOff.RingMask)
+	r.cqes = unsafe.Slice((*CQE)(unsafe.Pointer(&r.cqRing[p.CQOff.Cqes])), p.CQEntries)
+
+	return nil
+}
+
+// Close releases the ring, cancelling any submissions in flight. It must not
+// be called concurrently with Submit or Wait.
+func (r *Ring) Close() error {
+	for _, b := range [][]byte{r.sqRing, r.cqRing, r.sqeMem} {
+		if b != nil {
+			unix.Munmap(b)
+		}
+	}
+
+	return unix.Close(r.fd)
+}
+
+// Submit hands the supplied entries to the kernel. It must not be called
+// concurrently with itself.
+func (r *Ring) Submit(sqes ...SQE) error {
+	head := atomic.LoadUint32(r.sqHead)
+	tail := *r.sqTail
+	if int(tail-head)+len(sqes) > len(r.sqes) {
+		return fmt.Errorf("Submission queue full")
+	}
+
+	for _, sqe := range sqes {
+		i := tail & r.sqMask
+		r.sqes[i] = sqe
+		r.sqArray[i] = i
+		tail++
+	}
+
+	atomic.StoreUint32(r.sqTail, tail)
+
+	for toSubmit := len(sqes); toSubmit > 0; {
+		n, err := r.enter(uint32(toSubmit), 0, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("io_uring_enter: %v", err)
+		}
+
+		toSubmit -= n
+	}
+
+	return nil
+}
+
+// Wait blocks until there is at least one completion, then copies as many as
+// fit into cqes and returns how many it copied. It must not be called
+// concurrently with itself.
+func (r *Ring) Wait(cqes []CQE) (int, error) {
+	for {
+		head := *r.cqHead
+		tail := atomic.LoadUint32(r.cqTail)
+		if head != tail {
+			n := 0
+			for ; head != tail && n < len(cqes); n++ {
+				cqes[n] = r.cqes[head&r.cqMask]
+				head++
+			}
+
+			atomic.StoreUint32(r.cqHead, head)
+			return n, nil
+		}
+
+		if _, err := r.enter(0, 1, enterGetEvents); err != nil && err != syscall.EINTR {
+			return 0, fmt.Errorf("io_uring_enter: %v", err)
+		}
+	}
+}
+
+func (r *Ring) enter(toSubmit, minComplete, flags uint32) (int, error) {
+	n, _, errno := unix.Syscall6(
+		unix.SYS_IO_URING_ENTER,
+		uintptr(r.fd),
+		uintptr(toSubmit),
+		uintptr(minComplete),
+		uintptr(flags),
+		0,
+		0)
+	if errno != 0 {
+		return 0, errno
+	}
+
+	return int(n), nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iouring
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestSizes(t *testing.T) {
+	if s := unsafe.Sizeof(SQE{}); s != 128 {
+		t.Errorf("SQE is %d bytes; expected 128", s)
+	}
+
+	if s := unsafe.Sizeof(params{}); s != 120 {
+		t.Errorf("params is %d bytes; expected 120", s)
+	}
+}
+
+func TestNop(t *testing.T) {
+	r, err := New(4)
+	if err != nil {
+		t.Skipf("New: %v", err)
+	}
+
+	defer r.Close()
+
+	// More than fit in the submission queue in total, to check that it's
+	// reused.
+	cqes := make([]CQE, 4)
+	for i := uint64(0); i < 10; i++ {
+		if err := r.Submit(SQE{Opcode: OpNop, UserData: i}); err != nil {
+			t.Fatalf("Submit: %v", err)
+		}
+
+		n, err := r.Wait(cqes)
+		if err != nil {
+			t.Fatalf("Wait: %v", err)
+		}
+
+		if n != 1 || cqes[0].UserData != i || cqes[0].Res != 0 {
+			t.Fatalf("Got %d completions, first %+v; expected one for %d", n, cqes[0], i)
+		}
+	}
+}
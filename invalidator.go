@@ -0,0 +1,330 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// How long an Invalidator waits before retrying an invalidation the kernel
+// refused with EAGAIN, doubling each time up to the maximum, and how many
+// times it tries before giving up.
+const (
+	invalidateRetryDelay    = time.Millisecond
+	invalidateMaxRetryDelay = 100 * time.Millisecond
+	invalidateMaxAttempts   = 10
+)
+
+// How often an Invalidator checks whether the ops holding back an
+// invalidation have been replied to.
+const invalidateBusyPoll = 5 * time.Millisecond
+
+// An Invalidator sends the invalidations of Connection.InvalidateInode and
+// Connection.InvalidateEntry from a goroutine of its own, so that a file
+// system can ask for them from anywhere, including while serving an op on the
+// inode or directory concerned, without risking the deadlocks described
+// there. In particular:
+//
+//   - An invalidation is held back while an op addressed to the inode, or for
+//     an entry to the parent directory, has been read and not yet replied to,
+//     so that the kernel won't block it on locks held for the op.
+//   - An invalidation refused with EAGAIN is retried after a delay.
+//   - An invalidation refused with ENOENT is dropped quietly, as the kernel
+//     has nothing cached that it could apply to.
+//
+// Other errors, and invalidations still refused after several retries, are
+// written to the connection's error logger. Asking for an invalidation that
+// is already waiting to be sent has no effect.
+type Invalidator struct {
+	c *Connection
+
+	mu sync.Mutex
+
+	// Invalidations not yet sent, in the order they were asked for, and the
+	// set of them for spotting duplicates.
+	//
+	// GUARDED_BY(mu)
+	queue  []*queuedInvalidation
+	queued map[invalidation]bool
+
+	// Broadcast when the queue empties.
+	//
+	// GUARDED_BY(mu)
+	idle *sync.Cond
+
+	// Set by Close.
+	//
+	// GUARDED_BY(mu)
+	closed bool
+
+	// Written to, without blocking, when the queue grows.
+	wake chan struct{}
+
+	// Closed by Close to stop the goroutine, which then closes done.
+	stop chan struct{}
+	done chan struct{}
+}
+
+// An invalidation of an entry if name is non-empty, and of an inode otherwise.
+type invalidation struct {
+	inode fuseops.InodeID
+	name  string
+
+	off    int64
+	length int64
+}
+
+type queuedInvalidation struct {
+	invalidation
+
+	// The number of times the kernel has refused it with EAGAIN, and when it
+	// may next be sent.
+	attempts int
+	next     time.Time
+}
+
+// NewInvalidator starts an Invalidator for the supplied connection. Call
+// Close when finished with it.
+func NewInvalidator(c *Connection) *Invalidator {
+	inv := &Invalidator{
+		c:      c,
+		queued: make(map[invalidation]bool),
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	inv.idle = sync.NewCond(&inv.mu)
+	go inv.run()
+
+	return inv
+}
+
+// InvalidateInode arranges for Connection.InvalidateInode to be called with
+// the supplied arguments, and returns without waiting for it.
+//
+// LOCKS_EXCLUDED(inv.mu)
+func (inv *Invalidator) InvalidateInode(
+	inode fuseops.InodeID,
+	off int64,
+	length int64) {
+	inv.enqueue(invalidation{inode: inode, off: off, length: length})
+}
+
+// InvalidateEntry arranges for Connection.InvalidateEntry to be called with
+// the supplied arguments, and returns without waiting for it.
+//
+// LOCKS_EXCLUDED(inv.mu)
+func (inv *Invalidator) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) {
+	inv.enqueue(invalidation{inode: parent, name: name})
+}
+
+// Flush waits until every invalidation asked for so far has been sent or
+// given up on. Don't call it while serving an op that an invalidation is
+// waiting for, which would wait forever.
+//
+// LOCKS_EXCLUDED(inv.mu)
+func (inv *Invalidator) Flush() {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	for len(inv.queue) > 0 && !inv.closed {
+		inv.idle.Wait()
+	}
+}
+
+// Close stops the invalidator, discarding any invalidations not yet sent.
+// Later invalidations are ignored.
+//
+// LOCKS_EXCLUDED(inv.mu)
+func (inv *Invalidator) Close() {
+	inv.mu.Lock()
+	if inv.closed {
+		inv.mu.Unlock()
+		return
+	}
+
+	inv.closed = true
+	inv.queue = nil
+	inv.queued = nil
+	inv.idle.Broadcast()
+	inv.mu.Unlock()
+
+	close(inv.stop)
+	<-inv.done
+}
+
+// LOCKS_EXCLUDED(inv.mu)
+func (inv *Invalidator) enqueue(i invalidation) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	if inv.closed || inv.queued[i] {
+		return
+	}
+
+	inv.queue = append(inv.queue, &queuedInvalidation{invalidation: i})
+	inv.queued[i] = true
+
+	select {
+	case inv.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (inv *Invalidator) run() {
+	defer close(inv.done)
+
+	for {
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if wait, ok := inv.sendDue(time.Now()); ok {
+			timer = time.NewTimer(wait)
+			fire = timer.C
+		}
+
+		select {
+		case <-inv.wake:
+		case <-fire:
+		case <-inv.stop:
+			return
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Send every queued invalidation that is due and not held back by an op in
+// flight, then return how long to wait before trying the rest, or false if
+// there are none.
+//
+// LOCKS_EXCLUDED(inv.mu)
+func (inv *Invalidator) sendDue(now time.Time) (time.Duration, bool) {
+	inv.mu.Lock()
+	var due []*queuedInvalidation
+	for _, q := range inv.queue {
+		if !q.next.After(now) {
+			due = append(due, q)
+		}
+	}
+	inv.mu.Unlock()
+
+	// Don't hold the lock while writing to the kernel, which may block.
+	done := make(map[*queuedInvalidation]bool)
+	for _, q := range due {
+		if inv.c.inodeBusy(q.inode) {
+			q.next = now.Add(invalidateBusyPoll)
+			continue
+		}
+
+		err := inv.send(q.invalidation)
+		switch {
+		case errors.Is(err, syscall.EAGAIN) && q.attempts+1 < invalidateMaxAttempts:
+			q.attempts++
+			q.next = now.Add(min(invalidateRetryDelay<<q.attempts, invalidateMaxRetryDelay))
+			continue
+
+		case err != nil && !errors.Is(err, syscall.ENOENT) && inv.c.errorLogger != nil:
+			inv.c.errorLogger.Printf("%s: %v", q.invalidation, err)
+		}
+
+		done[q] = true
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	if inv.closed {
+		return 0, false
+	}
+
+	remaining := inv.queue[:0]
+	for _, q := range inv.queue {
+		if done[q] {
+			delete(inv.queued, q.invalidation)
+			continue
+		}
+
+		remaining = append(remaining, q)
+	}
+
+	clear(inv.queue[len(remaining):])
+	inv.queue = remaining
+
+	if len(inv.queue) == 0 {
+		inv.idle.Broadcast()
+		return 0, false
+	}
+
+	next := inv.queue[0].next
+	for _, q := range inv.queue[1:] {
+		if q.next.Before(next) {
+			next = q.next
+		}
+	}
+
+	return max(next.Sub(now), 0), true
+}
+
+func (inv *Invalidator) send(i invalidation) error {
+	if i.name != "" {
+		return inv.c.InvalidateEntry(i.inode, i.name)
+	}
+
+	return inv.c.InvalidateInode(i.inode, i.off, i.length)
+}
+
+func (i invalidation) String() string {
+	if i.name != "" {
+		return fmt.Sprintf("InvalidateEntry (parent %v, name %q)", i.inode, i.name)
+	}
+
+	return fmt.Sprintf("InvalidateInode (inode %v, off %d, len %d)", i.inode, i.off, i.length)
+}
+
+// Return true if an op that hasn't been replied to is addressed to the
+// supplied inode, or is a rename into it.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) inodeBusy(inode fuseops.InodeID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, o := range c.inflight {
+		if o.aborted {
+			continue
+		}
+
+		if o.inode == uint64(inode) {
+			return true
+		}
+
+		if r, ok := o.op.(*fuseops.RenameOp); ok && r.NewParent == inode {
+			return true
+		}
+	}
+
+	return false
+}
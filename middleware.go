@@ -0,0 +1,101 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import "context"
+
+// ServerFunc adapts an ordinary function to the Server interface.
+type ServerFunc func(*Connection)
+
+func (f ServerFunc) ServeOps(c *Connection) {
+	f(c)
+}
+
+// An Interceptor sees every op on its way from the kernel to a Server, and
+// every reply on its way back, without the Server being aware of it. This is
+// the place for cross-cutting concerns such as logging, metrics, access
+// control and fault injection. Install interceptors with Chain.
+//
+// Methods may be called concurrently.
+type Interceptor interface {
+	// Called for each op read from the kernel, before ReadOp returns it. Returns
+	// the context to be used for the op, which must be derived from ctx.
+	//
+	// If the error is non-nil, the op is replied to with that error at once:
+	// it never reaches the Server or any interceptor installed after this one.
+	InterceptOp(ctx context.Context, op interface{}) (context.Context, error)
+
+	// Called when an op that this interceptor let through is replied to, with
+	// the context passed to Reply and the error that was supplied, or that was
+	// returned by the interceptor installed after this one. Returns the error
+	// to be sent to the kernel.
+	InterceptReply(ctx context.Context, op interface{}, err error) error
+}
+
+// A StartObserver is an Interceptor that also wants to know when the server
+// begins work on an op, as opposed to when it was read from the kernel. The
+// difference is the time the op spent queued, for example waiting for a free
+// worker.
+type StartObserver interface {
+	Interceptor
+
+	// Called by Connection.MarkOpStarted, on the goroutine handling the op, with
+	// the context returned by ReadOp.
+	OpStarted(ctx context.Context, op interface{})
+}
+
+// InterceptorFuncs implements Interceptor in terms of optional functions. A
+// nil field passes the op or reply through unchanged.
+type InterceptorFuncs struct {
+	Op    func(ctx context.Context, op interface{}) (context.Context, error)
+	Reply func(ctx context.Context, op interface{}, err error) error
+}
+
+func (f InterceptorFuncs) InterceptOp(
+	ctx context.Context,
+	op interface{}) (context.Context, error) {
+	if f.Op == nil {
+		return ctx, nil
+	}
+
+	return f.Op(ctx, op)
+}
+
+func (f InterceptorFuncs) InterceptReply(
+	ctx context.Context,
+	op interface{},
+	err error) error {
+	if f.Reply == nil {
+		return err
+	}
+
+	return f.Reply(ctx, op, err)
+}
+
+// Chain returns a Server that installs the supplied interceptors on the
+// connection and then has server serve it. Ops pass through the interceptors
+// in the order given and replies in the reverse order, so the first is the
+// outermost. For example:
+//
+//	server := fuse.Chain(fuseutil.NewFileSystemServer(fs), logging, metrics)
+//
+// Chains may be nested, in which case the interceptors of the outer chain
+// come first.
+func Chain(server Server, interceptors ...Interceptor) Server {
+	return ServerFunc(func(c *Connection) {
+		c.interceptors = append(c.interceptors, interceptors...)
+		server.ServeOps(c)
+	})
+}
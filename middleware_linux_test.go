@@ -0,0 +1,194 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+type interceptorKey string
+
+// An interceptor that records what it sees.
+type recordingInterceptor struct {
+	name   string
+	events *[]string
+	mu     *sync.Mutex
+
+	// If non-nil, reject lookups with this error.
+	reject error
+}
+
+func (r *recordingInterceptor) record(e string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*r.events = append(*r.events, r.name+" "+e)
+}
+
+func (r *recordingInterceptor) InterceptOp(
+	ctx context.Context,
+	op interface{}) (context.Context, error) {
+	r.record("op")
+	if _, ok := op.(*fuseops.LookUpInodeOp); ok && r.reject != nil {
+		return nil, r.reject
+	}
+
+	return context.WithValue(ctx, interceptorKey(r.name), true), nil
+}
+
+func (r *recordingInterceptor) OpStarted(ctx context.Context, op interface{}) {
+	r.record("started")
+}
+
+func (r *recordingInterceptor) InterceptReply(
+	ctx context.Context,
+	op interface{},
+	err error) error {
+	r.record("reply")
+
+	// Translate the server's error so that the kernel sees something else.
+	if err == syscall.ENOENT {
+		return syscall.ENOTDIR
+	}
+
+	return err
+}
+
+// Send a lookup through the supplied interceptors, followed by a statfs, and
+// serve whichever of them reaches the server first. Lookups are answered with
+// ENOENT, anything else with ENOSYS. Returns the error that the kernel sees for
+// the lookup.
+func serveLookup(
+	t *testing.T,
+	interceptors []Interceptor,
+	record func(string)) int32 {
+	t.Helper()
+
+	c, kernel, _ := initConnection(
+		t,
+		MountConfig{},
+		fusekernel.InitIn{Major: 7, Minor: 36},
+		fusekernel.InitInExt{})
+
+	sendRequest(t, kernel, fusekernel.OpLookup, 2, []byte("foo\x00"))
+
+	// Follow up with a second request, so that the server has something to
+	// read if the first one was answered by an interceptor.
+	sendRequest(t, kernel, fusekernel.OpStatfs, 3)
+
+	server := ServerFunc(func(c *Connection) {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			t.Errorf("ReadOp: %v", err)
+			return
+		}
+
+		switch op.(type) {
+		case *fuseops.LookUpInodeOp:
+			c.MarkOpStarted(ctx)
+			record("server")
+			for _, ic := range interceptors {
+				name := ic.(*recordingInterceptor).name
+				if ctx.Value(interceptorKey(name)) == nil {
+					t.Errorf("context is missing value from %s", name)
+				}
+			}
+			c.Reply(ctx, syscall.ENOENT)
+
+		default:
+			c.Reply(ctx, syscall.ENOSYS)
+		}
+	})
+
+	Chain(server, interceptors...).ServeOps(c)
+
+	hdr, _ := readReply(t, kernel)
+	if hdr.Unique != 2 {
+		t.Fatalf("first reply is for request %d, want 2", hdr.Unique)
+	}
+
+	return hdr.Error
+}
+
+func TestChain(t *testing.T) {
+	var events []string
+	var mu sync.Mutex
+	a := &recordingInterceptor{name: "a", events: &events, mu: &mu}
+	b := &recordingInterceptor{name: "b", events: &events, mu: &mu}
+
+	record := func(e string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}
+
+	errno := serveLookup(t, []Interceptor{a, b}, record)
+
+	want := []string{
+		"a op", "b op",
+		"a started", "b started",
+		"server",
+		"b reply", "a reply",
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events: got %q, want %q", events, want)
+	}
+
+	// b turns ENOENT into ENOTDIR, which a then passes through.
+	if errno != -int32(syscall.ENOTDIR) {
+		t.Errorf("errno: got %d, want %d", errno, -int32(syscall.ENOTDIR))
+	}
+}
+
+func TestChain_ShortCircuit(t *testing.T) {
+	var events []string
+	var mu sync.Mutex
+	a := &recordingInterceptor{name: "a", events: &events, mu: &mu}
+	b := &recordingInterceptor{
+		name:   "b",
+		events: &events,
+		mu:     &mu,
+		reject: syscall.EACCES,
+	}
+	c := &recordingInterceptor{name: "c", events: &events, mu: &mu}
+
+	record := func(e string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}
+
+	errno := serveLookup(t, []Interceptor{a, b, c}, record)
+
+	// Only a let the lookup through, so only a sees the reply. The server went
+	// on to read the statfs, which made it all the way.
+	want := []string{
+		"a op", "b op", "a reply",
+		"a op", "b op", "c op", "c reply", "b reply", "a reply",
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events: got %q, want %q", events, want)
+	}
+
+	if errno != -int32(syscall.EACCES) {
+		t.Errorf("errno: got %d, want %d", errno, -int32(syscall.EACCES))
+	}
+}
@@ -16,6 +16,7 @@ package fuse
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -23,6 +24,7 @@ import (
 	"os/exec"
 	"strings"
 	"syscall"
+	"time"
 )
 
 // Server is an interface for any type that knows how to serve ops read from a
@@ -34,9 +36,29 @@ type Server interface {
 	ServeOps(*Connection)
 }
 
+// ErrMountTimeout is returned by Mount when the file system hasn't become
+// usable within MountConfig.MountTimeout. Use errors.Is to test for it.
+var ErrMountTimeout = errors.New("timed out waiting for the mount to complete")
+
+// MountRetry is a policy for retrying mounts that fail because fusermount(1)
+// exits with an error. See MountConfig.MountRetry.
+type MountRetry struct {
+	// How many times to retry after the first attempt. Zero means that only one
+	// attempt is made.
+	Retries int
+
+	// The delay before the first retry, doubled after each one up to
+	// MaxBackoff. Default 100ms and 5s respectively.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
 // Mount attempts to mount a file system on the given directory, using the
 // supplied Server to serve connection requests. It blocks until the file
-// system is successfully mounted.
+// system is successfully mounted, which includes the INIT handshake with the
+// kernel, so that the mount point is usable as soon as it returns. See
+// MountConfig.OnReady for being told so elsewhere, and MountConfig.MountTimeout
+// and MountConfig.MountRetry for bounding the wait and retrying failures.
 func Mount(
 	dir string,
 	server Server,
@@ -53,14 +75,172 @@ func Mount(
 		joinStatusAvailable: make(chan struct{}),
 	}
 
+	// Give up once the timeout, if any, has passed.
+	var timeout <-chan time.Time
+	if config.MountTimeout > 0 {
+		t := time.NewTimer(config.MountTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	// Mount and complete the INIT handshake.
+	connection, ready, err := connect(dir, config, timeout, mount, unmountLazy)
+	if err != nil {
+		return nil, err
+	}
+	mfs.conn = connection
+
+	// Serve the connection in the background. When done, set the join status.
+	go func() {
+		server.ServeOps(connection)
+		mfs.disconnect(connection.close())
+	}()
+
+	if config.DebugLogger != nil {
+		config.DebugLogger.Println("Waiting for mounting process to complete")
+	}
+
+	// Wait for the mount process to complete. Detaching the mount if it doesn't
+	// ends the connection, and with it ServeOps.
+	select {
+	case err := <-ready:
+		if err != nil {
+			return nil, fmt.Errorf("mount (background): %v", err)
+		}
+
+	case <-timeout:
+		abandonMount(dir, config, unmountLazy)
+		return nil, fmt.Errorf("mount (background): %w", ErrMountTimeout)
+	}
+
+	if config.OnReady != nil {
+		config.OnReady(connection.InitOp())
+	}
+
+	return mfs, nil
+}
+
+// The signature of mount, which tests replace.
+type mountFunc func(
+	ctx context.Context,
+	dir string,
+	cfg *MountConfig,
+	ready chan<- error) (*os.File, error)
+
+// Mount at dir and create a connection to the kernel, retrying failures of the
+// mount helper as the config's MountRetry allows, until timeout fires. Return
+// the connection and the channel on which the outcome of the background part
+// of mounting will arrive.
+func connect(
+	dir string,
+	config *MountConfig,
+	timeout <-chan time.Time,
+	mount mountFunc,
+	unmountLazy func(string) error) (*Connection, <-chan error, error) {
+	p := config.MountRetry
+	backoff := p.InitialBackoff
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 5 * time.Second
+	}
+
+	for attempt := 0; ; attempt++ {
+		c, ready, err := connectOnce(dir, config, timeout, mount, unmountLazy)
+		if err == nil || attempt >= p.Retries || !isHelperFailure(err) {
+			return c, ready, err
+		}
+
+		if config.DebugLogger != nil {
+			config.DebugLogger.Printf("Mounting failed; retrying in %v: %v", backoff, err)
+		}
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-timeout:
+			t.Stop()
+			return nil, nil, fmt.Errorf("%w (last error: %v)", ErrMountTimeout, err)
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Does the error say that the mount helper ran but failed, which may not
+// happen again?
+func isHelperFailure(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr)
+}
+
+// Make one attempt at mounting and creating a connection. If timeout fires
+// first, kill the mount helper and detach whatever has been mounted, which
+// makes the kernel fail the read of its INIT request.
+func connectOnce(
+	dir string,
+	config *MountConfig,
+	timeout <-chan time.Time,
+	mount mountFunc,
+	unmountLazy func(string) error) (*Connection, <-chan error, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		c   *Connection
+		err error
+	}
+
+	ready := make(chan error, 1)
+	done := make(chan result, 1)
+	go func() {
+		c, err := connectDevice(ctx, dir, config, ready, mount)
+		done <- result{c, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.c, ready, r.err
+
+	case <-timeout:
+	}
+
+	cancel()
+	abandonMount(dir, config, unmountLazy)
+
+	// The attempt may yet succeed, if the mount raced with detaching it. Undo
+	// it if so.
+	go func() {
+		if r := <-done; r.c != nil {
+			abandonMount(dir, config, unmountLazy)
+			r.c.close()
+		}
+	}()
+
+	return nil, nil, fmt.Errorf("mount: %w", ErrMountTimeout)
+}
+
+// Mount at dir and create a connection to the kernel, which completes the INIT
+// handshake.
+func connectDevice(
+	ctx context.Context,
+	dir string,
+	config *MountConfig,
+	ready chan<- error,
+	mount mountFunc) (*Connection, error) {
 	// Begin the mounting process, which will continue in the background.
 	if config.DebugLogger != nil {
 		config.DebugLogger.Println("Beginning the mounting kickoff process")
 	}
-	ready := make(chan error, 1)
-	dev, err := mount(dir, config, ready)
+	dev, err := mount(ctx, dir, config, ready)
 	if err != nil {
-		return nil, fmt.Errorf("mount: %v", err)
+		return nil, fmt.Errorf("mount: %w", err)
 	}
 	if config.DebugLogger != nil {
 		config.DebugLogger.Println("Completed the mounting kickoff process")
@@ -80,7 +260,7 @@ func Mount(
 		cfgCopy,
 		config.DebugLogger,
 		config.ErrorLogger,
-		dev)
+		&deviceTransport{dev})
 	if err != nil {
 		return nil, fmt.Errorf("newConnection: %v", err)
 	}
@@ -88,23 +268,34 @@ func Mount(
 		config.DebugLogger.Println("Successfully created the connection")
 	}
 
-	// Serve the connection in the background. When done, set the join status.
-	go func() {
-		server.ServeOps(connection)
-		mfs.joinStatus = connection.close()
-		close(mfs.joinStatusAvailable)
-	}()
+	return connection, nil
+}
 
-	if config.DebugLogger != nil {
-		config.DebugLogger.Println("Waiting for mounting process to complete")
+// Detach whatever an abandoned attempt at mounting left at dir, if anything.
+func abandonMount(dir string, config *MountConfig, unmountLazy func(string) error) {
+	if err := unmountLazy(dir); err != nil && config.DebugLogger != nil {
+		config.DebugLogger.Printf("Detaching abandoned mount: %v", err)
 	}
+}
 
-	// Wait for the mount process to complete.
-	if err := <-ready; err != nil {
-		return nil, fmt.Errorf("mount (background): %v", err)
+// MountTransport mounts a file system on the given directory as Mount does,
+// but rather than serving it returns the Transport over which the kernel sends
+// its requests, so that they can be relayed elsewhere (see package fuseproxy).
+// Mounting is complete once the outcome arrives on the returned channel, which
+// on OS X happens only after the INIT handshake has been relayed and answered.
+// Options in the config that concern serving rather than mounting are ignored.
+func MountTransport(dir string, config *MountConfig) (Transport, <-chan error, error) {
+	if err := checkMountPoint(dir); err != nil {
+		return nil, nil, err
 	}
 
-	return mfs, nil
+	ready := make(chan error, 1)
+	dev, err := mount(context.Background(), dir, config, ready)
+	if err != nil {
+		return nil, nil, fmt.Errorf("mount: %v", err)
+	}
+
+	return &deviceTransport{dev}, ready, nil
 }
 
 func checkMountPoint(dir string) error {
@@ -127,7 +318,7 @@ func checkMountPoint(dir string) error {
 	return nil
 }
 
-func fusermount(binary string, argv []string, additionalEnv []string, wait bool, debugLogger *log.Logger) (*os.File, error) {
+func fusermount(ctx context.Context, binary string, argv []string, additionalEnv []string, wait bool, debugLogger *log.Logger) (*os.File, error) {
 	if debugLogger != nil {
 		debugLogger.Println("Creating a socket pair")
 	}
@@ -151,7 +342,7 @@ func fusermount(binary string, argv []string, additionalEnv []string, wait bool,
 		debugLogger.Println("Starting fusermount/os mount")
 	}
 	// Start fusermount/mount_macfuse/mount_osxfuse.
-	cmd := exec.Command(binary, argv...)
+	cmd := exec.CommandContext(ctx, binary, argv...)
 	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
 	cmd.Env = append(cmd.Env, additionalEnv...)
 	cmd.ExtraFiles = []*os.File{writeFile}
@@ -164,7 +355,7 @@ func fusermount(binary string, argv []string, additionalEnv []string, wait bool,
 		err = cmd.Start()
 	}
 	if err != nil {
-		return nil, fmt.Errorf("running %v: %v", binary, err)
+		return nil, fmt.Errorf("running %v: %w", binary, err)
 	}
 
 	if debugLogger != nil {
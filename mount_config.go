@@ -18,8 +18,12 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"runtime"
 	"strings"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
 )
 
 // Optional configuration accepted by Mount.
@@ -28,16 +32,35 @@ type MountConfig struct {
 	// should inherit. If nil, context.Background() will be used.
 	OpContext context.Context
 
-	// If non-empty, the name of the file system as displayed by e.g. `mount`.
-	// This is important because the `umount` command requires root privileges if
-	// it doesn't agree with /etc/fstab.
+	// If non-empty, the name of the file system as displayed by e.g. `mount`,
+	// `df` and in the first field of /proc/mounts. This is important because the
+	// `umount` command requires root privileges if it doesn't agree with
+	// /etc/fstab. On Linux it defaults to Subtype or, failing that, a generic
+	// name.
 	FSName string
 
 	// Mount the file system in read-only mode. File modes will appear as normal,
 	// but opening a file for writing and metadata operations like chmod,
 	// chtimes, etc. will fail.
+	//
+	// Besides passing the ro flag to the kernel, the connection fails any op
+	// that would modify the file system (see fuseops.Mutates) with EROFS
+	// without passing it to the server, so a read-only server needn't check
+	// for them itself.
 	ReadOnly bool
 
+	// Standard mount flags, as for mount(8): forbid executing files, and don't
+	// update access times.
+	NoExec  bool
+	NoAtime bool
+
+	// Let set-user-ID and set-group-ID bits, and device files, take effect,
+	// which by default they don't (nosuid and nodev). Only privileged mounts
+	// can do this; fusermount(1) ignores these for anyone else. See
+	// MountedFileSystem.MountFlags for the flags that took effect.
+	AllowSuid bool
+	AllowDev  bool
+
 	// A logger to use for logging errors. All errors are logged, with the
 	// exception of a few blacklisted errors that are expected. If nil, no error
 	// logging is performed.
@@ -47,6 +70,103 @@ type MountConfig struct {
 	// performed.
 	DebugLogger *log.Logger
 
+	// Also log every message exchanged with the kernel to DebugLogger, decoded
+	// in the manner of libfuse's -d option: the opcode name, header fields and
+	// a summary of each request, and the unique ID, error and size of each
+	// reply. Has no effect if DebugLogger is nil.
+	DebugProtocol bool
+
+	// Along with DebugProtocol, include a hex dump of the body of each message,
+	// truncated to the first 512 bytes.
+	DebugHexdump bool
+
+	// A structured logger to which a record is emitted as each op is replied
+	// to, with the op name, unique ID, inode, pid, uid, latency and, for
+	// failures, the error and errno. Successful ops and the errors that
+	// ErrorLogger skips are logged at slog.LevelDebug, other errors at
+	// slog.LevelError, so the handler's level decides how much is kept. If nil,
+	// no structured logging is performed.
+	Logger *slog.Logger
+
+	// If greater than one, only one in this many successful ops is logged to
+	// Logger, so that it can stay on in production. Errors are always logged.
+	LogSampleRate int
+
+	// If set, called as each op is read from the kernel, before ReadOp returns
+	// it, with the op and its unique ID. Along with OnOpEnd, this lets the
+	// latency of ops be fed to any metrics system without this package
+	// depending on it. Both are called synchronously, so must be cheap.
+	OnOpStart func(op interface{}, unique uint64)
+
+	// If set, called as each op is replied to, after the reply has been sent,
+	// with the op, its unique ID, the time since it was read and the error
+	// (nil on success) that was sent to the kernel.
+	OnOpEnd func(op interface{}, unique uint64, d time.Duration, err error)
+
+	// If set, called once by Mount when the file system is usable: the kernel
+	// has completed the INIT handshake and, on macOS, the mount helper has
+	// finished. It is passed the protocol version and parameters negotiated,
+	// as later returned by Connection.InitOp, so that a caller can start
+	// sending traffic to the mount point without polling it. Ops may already
+	// be arriving at the server when it is called.
+	OnReady func(init fuseops.InitOp)
+
+	// If positive, the longest that Mount waits for the file system to become
+	// usable, retries included. If the mount helper hasn't finished or the
+	// kernel's INIT hasn't arrived by then, Mount kills fusermount(1) (on
+	// Linux), detaches whatever was mounted as UnmountLazy does, and returns an
+	// error for which errors.Is(err, ErrMountTimeout) holds. Zero means waiting
+	// for as long as it takes.
+	MountTimeout time.Duration
+
+	// Linux only.
+	//
+	// How to retry mounts that fail because fusermount(1) exits with an error,
+	// as it may while a previous mount at the same point is still being torn
+	// down. By default they are not retried.
+	MountRetry MountRetry
+
+	// Reuse the structs of the most common ops (lookups, attribute fetches,
+	// forgets, opens, reads, writes, flushes and releases) rather than
+	// allocating each afresh, so that metadata-heavy workloads produce little
+	// garbage. When set, an op must not be used in any way once it has been
+	// replied to: not by the server, nor by interceptors or callbacks such as
+	// OnOpStall that may still hold it. (OnOpEnd is called before the op is
+	// reused.)
+	PoolOps bool
+
+	// Record the goroutine serving each op, as reported by
+	// Connection.MarkOpStarted, so that MountedFileSystem.DumpInflight can show
+	// its stack. This costs a stack walk per op, so is off by default.
+	TrackOpGoroutines bool
+
+	// If positive, watch for ops that have been in flight for longer than this
+	// and report each of them once, so that a backend that occasionally wedges
+	// is noticed before the whole mount appears dead. Stalls are passed to
+	// OnOpStall if it is set, and are otherwise logged to ErrorLogger. Set
+	// TrackOpGoroutines too to have the report include the stack of the
+	// goroutine serving the op.
+	StallThreshold time.Duration
+
+	// See StallThreshold. Called from a dedicated goroutine.
+	OnOpStall func(s OpStall)
+
+	// Let a panic while serving an op crash the process, as it would if the
+	// op were served without this package in the way. By default servers
+	// created by fuseutil.NewFileSystemServer recover the panic and reply to
+	// the op with EIO, reporting the panic to OnOpPanic if it is set and
+	// otherwise to ErrorLogger, so that one bad op doesn't take down the
+	// process and wedge the mount point. Tests may prefer to fail fast.
+	//
+	// Only panics in the FileSystem method itself are recovered. Those in code
+	// run once the op has been replied to, such as ReadFileOp.Callback or
+	// OnOpEnd, always crash the process.
+	CrashOnPanic bool
+
+	// See CrashOnPanic. Called on the goroutine that panicked, before the op
+	// is replied to.
+	OnOpPanic func(p OpPanic)
+
 	// Linux only. OS X always behaves as if writeback caching is disabled.
 	//
 	// By default on Linux we allow the kernel to perform writeback caching
@@ -114,6 +234,88 @@ type MountConfig struct {
 	// syscall doesn't return until the file system returns.
 	DisableWritebackCaching bool
 
+	// Linux only.
+	//
+	// The granularity of the timestamps that the file system stores, for
+	// example time.Second for a backend that keeps whole seconds. The kernel
+	// truncates the times that it sets itself, such as the mtime and ctime it
+	// maintains with writeback caching and the times of utimensat(2) with
+	// UTIME_NOW, to a multiple of it, so that what it caches agrees with what
+	// the file system will later report rather than silently differing from
+	// it. Zero, the default, means one nanosecond. Values above one second are
+	// treated as one second.
+	TimestampGranularity time.Duration
+
+	// Linux only.
+	//
+	// Take full control of when the kernel drops the file contents it has
+	// cached. Without writeback caching, the kernel otherwise throws away all
+	// cached pages of a file whenever the attributes returned by the file
+	// system show a different size, which for a backend with coarse change
+	// detection can mean discarding good data over and over. With this set it
+	// keeps them (truncating the cache to the new size if it shrank), and the
+	// file system calls Connection.InvalidateInode when contents change behind
+	// the kernel's back. Opening a file still drops its cache unless
+	// OpenFileOp.KeepPageCache is set.
+	//
+	// Requires Linux 5.2 or later; silently ignored otherwise. Whether the
+	// kernel agreed is reported by fuseops.InitOp.ExplicitInvalData.
+	EnableExplicitInvalData bool
+
+	// Linux only.
+	//
+	// Allow OpenFileOp and CreateFileOp to hand a file's IO to a backing file
+	// (see OpenFileOp.BackingID), so that reads and writes go between the
+	// kernel and the backing file directly, while metadata ops are still served
+	// by the file system. Backing files are registered with
+	// Connection.OpenBackingFile, which needs CAP_SYS_ADMIN.
+	//
+	// Backing files may not themselves be on a stacked file system such as
+	// overlayfs. The kernel won't pass through with writeback caching, so this
+	// has no effect unless DisableWritebackCaching is also set.
+	//
+	// Requires Linux 6.9 or later built with CONFIG_FUSE_PASSTHROUGH; silently
+	// ignored otherwise. Whether the kernel agreed is reported by
+	// fuseops.InitOp.Passthrough.
+	EnablePassthrough bool
+
+	// Linux only.
+	//
+	// Serve requests over io_uring rather than by reading and writing the fuse
+	// device, which saves a couple of system calls per request. Each possible
+	// CPU gets a queue of IoUringQueueDepth entries, each of which holds a
+	// request and then its reply, with a buffer as large as the largest write
+	// (1 MiB, on 4 KiB pages). Interrupts and forgets still arrive on the
+	// device, as do all requests if registering the queues fails, which is
+	// logged to ErrorLogger.
+	//
+	// Applies to file systems mounted with Mount, not to other transports.
+	// Requires Linux 6.14 or later with io_uring enabled for fuse (see
+	// /sys/module/fuse/parameters/enable_uring); silently ignored otherwise.
+	// Whether the kernel agreed is reported by fuseops.InitOp.IoUring.
+	EnableIoUring bool
+
+	// The number of requests each io_uring queue can hold at once, with
+	// EnableIoUring. Zero means 8.
+	IoUringQueueDepth int
+
+	// Linux only.
+	//
+	// Read requests from the fuse device with this many goroutines, each with
+	// its own clone of the device (FUSE_DEV_IOC_CLONE), so that taking them
+	// from the kernel scales across CPUs when a single reader can't keep up.
+	// Each reader reads into a message from the same pool as a single reader
+	// would, and holds on to it until ReadOp takes it, so requests are not
+	// copied on the way and each reader ties up at most one message. Ops are
+	// still returned one at a time by Connection.ReadOp, but not necessarily
+	// in the order the kernel sent them, which it allows for ops that may be
+	// in flight together. Zero or one means a single reader.
+	//
+	// Applies to file systems mounted with Mount, not to other transports, and
+	// not when requests are served over io_uring. If cloning the device fails,
+	// which is logged to ErrorLogger, fewer readers are used.
+	DeviceReaders int
+
 	// OS X only.
 	//
 	// Normally on OS X we mount with the novncache option
@@ -138,18 +340,33 @@ type MountConfig struct {
 	// file systems could return any size in the inode attributes of
 	// symlinks. After enabling caching, the specified size caps the symlink
 	// target.
+	//
+	// With caching, a symlink is read once rather than on every traversal, and
+	// the kernel keeps the target until it evicts the inode. A file system
+	// whose symlinks can change behind the kernel's back should call
+	// Connection.InvalidateInode when they do. Whether the kernel agreed is
+	// reported by fuseops.InitOp.CacheSymlinks.
 	EnableSymlinkCaching bool
 
 	// Linux only.
 	//
 	// Tell the kernel to treat returning -ENOSYS on OpenFile as not needing
 	// OpenFile calls at all (Linux >= 3.16):
+	//
+	// Once a server has declined an open in this way, the kernel opens files
+	// without asking and sends neither OpenFileOp nor ReleaseFileHandleOp, which
+	// saves two round trips per file access for file systems that keep no
+	// per-handle state. Ops on the files then carry a zero handle. A
+	// fuseutil.FileSystem that leaves OpenFile to NotImplementedFileSystem gets
+	// this automatically. Whether the kernel agreed is reported by
+	// fuseops.InitOp.NoOpen; if it didn't, returning ENOSYS fails the open(2).
 	EnableNoOpenSupport bool
 
 	// Linux only.
 	//
 	// Tell the kernel to treat returning -ENOSYS on OpenDir as not needing
-	// OpenDir calls at all (Linux >= 5.1):
+	// OpenDir calls at all (Linux >= 5.1). As with EnableNoOpenSupport, the
+	// kernel then sends neither OpenDirOp nor ReleaseDirHandleOp.
 	EnableNoOpendirSupport bool
 
 	// Disable FUSE default permissions.
@@ -161,7 +378,9 @@ type MountConfig struct {
 	// Vectored read allows file systems to avoid memory copying overhead if
 	// the data is already in memory when they return it to FUSE.
 	// When turned on, ReadFileOp.Dst is always nil and the FS must return data
-	// being read from the file as a list of slices in ReadFileOp.Data.
+	// being read from the file as a list of slices in ReadFileOp.Data. (The FS
+	// may set ReadFileOp.Data for individual reads whether or not this is set;
+	// turning it on merely avoids reserving a buffer that won't be used.)
 	UseVectoredRead bool
 
 	// OS X only.
@@ -171,6 +390,48 @@ type MountConfig struct {
 	// is used.
 	VolumeName string
 
+	// OS X only.
+	//
+	// Mark the volume as case-insensitive with macFUSE's caseins option and the
+	// matching INIT capability, so that the Finder and other apps expect names
+	// that differ only in case to refer to the same file. The kernel doesn't fold case itself: the file
+	// system must match names case-insensitively in LookUpInodeOp and the ops
+	// that create, rename and remove entries.
+	//
+	// Unicode normalization is a separate matter: the Finder sends names in
+	// NFD, while most other programs use NFC. See
+	// fuseutil.NewNormalizingFileSystem.
+	CaseInsensitive bool
+
+	// OS X only.
+	//
+	// Normally on OS X we mount with the noappledouble option, so that the
+	// kernel refuses access to AppleDouble (._foo) and .DS_Store files without
+	// consulting the file system. They add noise to debug output and can have
+	// significant cost on network-based file systems.
+	//
+	// This field disables the use of noappledouble, for file systems that can
+	// store the files and would rather the Finder kept its metadata in them.
+	EnableAppleDouble bool
+
+	// OS X only.
+	//
+	// Mount with the noapplexattr option, so that the kernel refuses access to
+	// com.apple.* extended attributes, among them resource forks and Finder
+	// info, without consulting the file system. File systems that can't store
+	// them should set this: the Finder then copies files without them rather
+	// than failing on every copy.
+	NoAppleXattr bool
+
+	// OS X only.
+	//
+	// Tell the kernel that the file system serves fuseops.GetXTimesOp, for the
+	// backup and creation times of inodes, and fuseops.ExchangeDataOp, for
+	// exchangedata(2). The kernel sends neither op otherwise. Whether it agreed
+	// is reported by fuseops.InitOp.Xtimes and fuseops.InitOp.ExchangeData.
+	EnableXtimes       bool
+	EnableExchangeData bool
+
 	// OS X only.
 	//
 	// The FUSE implementation to use. One of FUSEImplFuseT (default) or
@@ -185,9 +446,11 @@ type MountConfig struct {
 	// documentation for this package.
 	Options map[string]string
 
-	// Sets the filesystem type (third field in /etc/mtab). /etc/mtab and
-	// /proc/mounts will show the filesystem type as fuse.<Subtype>.
-	// If not set, /proc/mounts will show the filesystem type as fuse/fuseblk.
+	// Sets the filesystem type (third field in /etc/mtab). /etc/mtab,
+	// /proc/mounts and `df -T` will show the filesystem type as
+	// fuse.<Subtype>, which lets monitoring and automount configs pick out
+	// mounts of a particular file system. If not set, /proc/mounts will show
+	// the filesystem type as fuse/fuseblk.
 	Subtype string
 
 	// Flag to enable async reads that are received from
@@ -197,6 +460,15 @@ type MountConfig struct {
 	// Flag to enable parallel lookup and readdir operations from the
 	// kernel
 	// Ref: https://github.com/torvalds/linux/commit/5c672ab3f0ee0f78f7acad183f34db0f8781a200
+	//
+	// By default the kernel holds a directory's lock across each lookup and
+	// readdir in it, so that a file system sees at most one of them per
+	// directory at a time. That makes tree walks and build systems, which look
+	// up many names in the same directory at once, wait on each other. Set this
+	// if the file system copes with LookUpInodeOp and ReadDirOp arriving
+	// concurrently for the same directory, as one that takes its own locks
+	// does. Ops that modify the directory are still serialized against them.
+	// Whether the kernel agreed is reported by fuseops.InitOp.ParallelDirOps.
 	EnableParallelDirOps bool
 
 	// Flag to enable atomic truncate during file open operations.
@@ -205,6 +477,94 @@ type MountConfig struct {
 	// without O_TRUNC, followed by a SetInodeAttributes op with the target size set to 0.
 	// Ref: https://github.com/torvalds/linux/commit/6ff958edbf39c014eb06b65ad25b736be08c4e63
 	EnableAtomicTrunc bool
+
+	// Ask the kernel not to apply the caller's umask to the mode of new inodes.
+	// When set, the Mode fields of MkDirOp, MkNodeOp, CreateFileOp and
+	// CreateTmpFileOp carry the mode exactly as requested by the caller, and
+	// the file system is responsible for applying the accompanying Umask field
+	// itself (e.g. ignoring it when the parent has a default ACL). When unset,
+	// the kernel has already masked the mode.
+	EnableDontMask bool
+
+	// Ask the kernel to send the security labels (e.g. SELinux contexts) that
+	// should be applied to new inodes along with MkDirOp, MkNodeOp,
+	// CreateFileOp, CreateTmpFileOp and CreateSymlinkOp, in their
+	// SecurityContexts fields.
+	// Requires Linux 5.17 or later; silently ignored otherwise.
+	// Ref: https://github.com/torvalds/linux/commit/3e2b6fdbdc9ab5a02d9d5676a36f5aa6ab31ce51
+	EnableSecurityContext bool
+
+	// Take over from the kernel the job of clearing the setuid and setgid bits
+	// (and the security.capability xattr) when a file is written or truncated
+	// by a caller without CAP_FSETID. The kernel then no longer does this with
+	// a separate SetInodeAttributesOp, which a file system doing its own
+	// permission checks may refuse, but instead sets KillSuidgid on the
+	// WriteFileOp, SetInodeAttributesOp, OpenFileOp (with O_TRUNC) or
+	// CreateFileOp concerned. When it is set the file system must clear the
+	// setuid bit, and the setgid bit if the group execute bit is set, along
+	// with making the change.
+	//
+	// Requires Linux 5.11 or later; silently ignored otherwise. Whether the
+	// kernel agreed is reported by fuseops.InitOp.HandleKillPrivV2.
+	EnableHandleKillPrivV2 bool
+
+	// Ask the kernel to use the extended form of setxattr requests, which says
+	// when setting a POSIX access ACL must also clear the setgid bit (see
+	// fuseops.SetXattrOp.KillSgid). File systems that implement ACLs and
+	// EnableHandleKillPrivV2 need this to clear the bit in the cases the kernel
+	// would. Requires Linux 5.16 or later; silently ignored otherwise. Whether
+	// the kernel agreed is reported by fuseops.InitOp.SetxattrExt.
+	EnableSetxattrExt bool
+
+	// Pass renameat2(2) calls with flags through to the file system, in
+	// RenameOp.Flags. When unset the kernel fails such calls with EINVAL
+	// itself, so file systems that don't look at the flags can't silently
+	// ignore them. Linux only; macOS has its own rename flags, which are never
+	// passed on.
+	EnableRenameFlags bool
+
+	// The number of goroutines that a server created with
+	// fuseutil.NewFileSystemServer uses to service ops. If zero (the default),
+	// each op is handled on a goroutine of its own, which places no bound on
+	// concurrency or on the memory held by in-flight ops. Servers that read ops
+	// from the Connection themselves are unaffected.
+	//
+	// When all workers are busy, no further requests are read from the kernel
+	// until one frees up. This includes interrupt requests, so the file system
+	// must not rely on being interrupted in order to make progress.
+	ServerWorkers int
+
+	// Per-class overrides for ServerWorkers, again honored only by
+	// fuseutil.NewFileSystemServer. Ops of a class listed here are serviced by a
+	// dedicated set of this many workers, so that for example a flood of slow
+	// reads (fuseops.OpClassRead) cannot starve lookups. A value of zero gives
+	// each op of that class a goroutine of its own.
+	ServerClassWorkers map[fuseops.OpClass]int
+
+	// Have the worker pools of a server created with
+	// fuseutil.NewFileSystemServer service interactive ops ahead of bulk ones
+	// when all workers are busy, so that for example ls stays responsive while
+	// a large file is being copied. Metadata ops, directory reads, reads from
+	// the start of a file and reads and writes of up to 64 KiB count as
+	// interactive; larger reads (typically readahead) and writes (typically
+	// writeback) count as bulk. Bulk ops still get every fourth free worker
+	// while interactive ones wait, so they are slowed but never starved.
+	//
+	// With this set, interactive ops continue to be read from the kernel while
+	// all workers are busy, and only bulk ops wait for room in the queue. Has no
+	// effect on ops that are not subject to a worker pool.
+	ServerPrioritizeInteractive bool
+
+	// Have a server created with fuseutil.NewFileSystemServer handle each op to
+	// completion, on the goroutine that reads them, before reading the next.
+	// Ops are then delivered one at a time in the order the kernel sent them,
+	// like libfuse's -s option, and the file system needs no locking of its
+	// own. Overrides ServerWorkers and ServerClassWorkers.
+	//
+	// Because nothing is read from the kernel while an op is being handled,
+	// interrupts are never delivered to a running op, and a file system that
+	// blocks waiting for another request to arrive will deadlock.
+	Serialized bool
 }
 
 type FUSEImpl uint8
@@ -236,6 +596,10 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 	// Cf. https://github.com/bazil/fuse/issues/89
 	// Cf. https://bugs.freedesktop.org/show_bug.cgi?id=90907
 	fsname := c.FSName
+	if runtime.GOOS == "linux" && fsname == "" {
+		fsname = c.Subtype
+	}
+
 	if runtime.GOOS == "linux" && fsname == "" {
 		fsname = "some_fuse_file_system"
 	}
@@ -255,6 +619,23 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 		opts["ro"] = ""
 	}
 
+	// Other standard flags.
+	if c.NoExec {
+		opts["noexec"] = ""
+	}
+
+	if c.NoAtime {
+		opts["noatime"] = ""
+	}
+
+	if c.AllowSuid {
+		opts["suid"] = ""
+	}
+
+	if c.AllowDev {
+		opts["dev"] = ""
+	}
+
 	// Handle OS X options.
 	if isDarwin {
 		if !c.EnableVnodeCaching {
@@ -265,15 +646,19 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 			// Cf. https://github.com/osxfuse/osxfuse/wiki/Mount-options#volname
 			opts["volname"] = c.VolumeName
 		}
-	}
 
-	// OS X: disable the use of "Apple Double" (._foo and .DS_Store) files, which
-	// just add noise to debug output and can have significant cost on
-	// network-based file systems.
-	//
-	// Cf. https://github.com/osxfuse/osxfuse/wiki/Mount-options
-	if isDarwin {
-		opts["noappledouble"] = ""
+		if c.CaseInsensitive {
+			opts["caseins"] = ""
+		}
+
+		// Cf. https://github.com/osxfuse/osxfuse/wiki/Mount-options
+		if !c.EnableAppleDouble {
+			opts["noappledouble"] = ""
+		}
+
+		if c.NoAppleXattr {
+			opts["noapplexattr"] = ""
+		}
 	}
 
 	// Last but not least: other user-supplied options.
@@ -284,6 +669,8 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 	return opts
 }
 
+// Escape a key or value for the options string, as understood by
+// fusermount(1).
 func escapeOptionsKey(s string) (res string) {
 	res = s
 	res = strings.Replace(res, `\`, `\\`, -1)
@@ -298,7 +685,7 @@ func mapToOptionsString(opts map[string]string) string {
 
 		component := k
 		if v != "" {
-			component = fmt.Sprintf("%s=%s", k, v)
+			component = fmt.Sprintf("%s=%s", k, escapeOptionsKey(v))
 		}
 
 		components = append(components, component)
@@ -0,0 +1,120 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestMountConfig_FSNameAndSubtype(t *testing.T) {
+	cfg := &MountConfig{
+		FSName:  "mybackend",
+		Subtype: "mybackend",
+	}
+
+	opts := cfg.toMap()
+	if got := opts["fsname"]; got != "mybackend" {
+		t.Errorf("fsname = %q, want %q", got, "mybackend")
+	}
+
+	if got := opts["subtype"]; got != "mybackend" {
+		t.Errorf("subtype = %q, want %q", got, "mybackend")
+	}
+}
+
+func TestMountConfig_FSNameDefaultsToSubtype(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("FSName only has a default on Linux")
+	}
+
+	cfg := &MountConfig{Subtype: "mybackend"}
+	if got := cfg.toMap()["fsname"]; got != "mybackend" {
+		t.Errorf("fsname = %q, want %q", got, "mybackend")
+	}
+
+	cfg = &MountConfig{}
+	if got := cfg.toMap()["fsname"]; got != "some_fuse_file_system" {
+		t.Errorf("fsname = %q, want %q", got, "some_fuse_file_system")
+	}
+}
+
+func TestMountConfig_MountFlags(t *testing.T) {
+	opts := (&MountConfig{}).toMap()
+	for _, k := range []string{"noexec", "noatime", "suid", "dev"} {
+		if _, ok := opts[k]; ok {
+			t.Errorf("%s set by default", k)
+		}
+	}
+
+	cfg := &MountConfig{
+		NoExec:    true,
+		NoAtime:   true,
+		AllowSuid: true,
+		AllowDev:  true,
+	}
+
+	opts = cfg.toMap()
+	for _, k := range []string{"noexec", "noatime", "suid", "dev"} {
+		if v, ok := opts[k]; !ok || v != "" {
+			t.Errorf("%s: got %q, %v", k, v, ok)
+		}
+	}
+}
+
+func TestMapToOptionsString_Escaping(t *testing.T) {
+	s := mapToOptionsString(map[string]string{
+		"fsname": `my,back\end`,
+	})
+
+	if want := `fsname=my\,back\\end`; s != want {
+		t.Errorf("got %q, want %q", s, want)
+	}
+
+	s = mapToOptionsString(map[string]string{"ro": ""})
+	if strings.Contains(s, "=") {
+		t.Errorf("got %q for an option without a value", s)
+	}
+}
+
+func TestMountConfig_AppleDouble(t *testing.T) {
+	if runtime.GOOS != "darwin" {
+		t.Skip("AppleDouble options are OS X only")
+	}
+
+	opts := (&MountConfig{}).toMap()
+	if _, ok := opts["noappledouble"]; !ok {
+		t.Errorf("noappledouble not set by default")
+	}
+
+	if _, ok := opts["noapplexattr"]; ok {
+		t.Errorf("noapplexattr set by default")
+	}
+
+	cfg := &MountConfig{
+		EnableAppleDouble: true,
+		NoAppleXattr:      true,
+	}
+
+	opts = cfg.toMap()
+	if _, ok := opts["noappledouble"]; ok {
+		t.Errorf("noappledouble set with EnableAppleDouble")
+	}
+
+	if v, ok := opts["noapplexattr"]; !ok || v != "" {
+		t.Errorf("noapplexattr: got %q, %v", v, ok)
+	}
+}
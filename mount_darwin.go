@@ -2,6 +2,7 @@ package fuse
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/jacobsa/fuse/internal/buffer"
 	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
 )
 
 var errNoAvail = errors.New("no available fuse devices")
@@ -209,7 +211,9 @@ func callMountCommFD(
 	env = append(env, "_FUSE_COMMVERS=2")
 	argv = append(argv, dir)
 
-	return fusermount(bin, argv, env, false, cfg.DebugLogger)
+	// The helper carries on mounting after handing over the device, so it's
+	// left to finish rather than tied to a context.
+	return fusermount(context.Background(), bin, argv, env, false, cfg.DebugLogger)
 }
 
 // Begin the process of mounting at the given directory, returning a connection
@@ -410,6 +414,7 @@ func mountFuset(
 }
 
 func mount(
+	_ context.Context,
 	dir string,
 	cfg *MountConfig,
 	ready chan<- error) (dev *os.File, err error) {
@@ -425,3 +430,26 @@ func mount(
 	}
 	return
 }
+
+// Neither macFUSE nor fuse-t supports remounting, so the read-only guard
+// installed by RemountReadOnly is all we can offer.
+func remountReadOnly(dir string) error {
+	return &os.PathError{Op: "remount", Path: dir, Err: syscall.ENOTSUP}
+}
+
+func mountFlags(dir string) (MountFlags, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return MountFlags{}, &os.PathError{Op: "statfs", Path: dir, Err: err}
+	}
+
+	f := MountFlags{
+		ReadOnly: st.Flags&unix.MNT_RDONLY != 0,
+		NoSuid:   st.Flags&unix.MNT_NOSUID != 0,
+		NoDev:    st.Flags&unix.MNT_NODEV != 0,
+		NoExec:   st.Flags&unix.MNT_NOEXEC != 0,
+		NoAtime:  st.Flags&unix.MNT_NOATIME != 0,
+	}
+
+	return f, nil
+}
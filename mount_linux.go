@@ -1,6 +1,7 @@
 package fuse
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -118,8 +119,9 @@ func directmount(dir string, cfg *MountConfig) (*os.File, error) {
 // Begin the process of mounting at the given directory, returning a connection
 // to the kernel. Mounting continues in the background, and is complete when an
 // error is written to the supplied channel. The file system may need to
-// service the connection in order for mounting to complete.
-func mount(dir string, cfg *MountConfig, ready chan<- error) (*os.File, error) {
+// service the connection in order for mounting to complete. Cancelling ctx
+// kills fusermount(1) if it is still running.
+func mount(ctx context.Context, dir string, cfg *MountConfig, ready chan<- error) (*os.File, error) {
 	// On linux, mounting is never delayed.
 	ready <- nil
 
@@ -150,7 +152,7 @@ func mount(dir string, cfg *MountConfig, ready chan<- error) (*os.File, error) {
 			"--",
 			dir,
 		}
-		return fusermount(fusermountPath, argv, []string{}, true, cfg.DebugLogger)
+		return fusermount(ctx, fusermountPath, argv, []string{}, true, cfg.DebugLogger)
 	}
 	return dev, err
 }
@@ -167,3 +169,57 @@ func parseFuseFd(dir string) (int, error) {
 
 	return int(fd), nil
 }
+
+// The per-mount flags reported by statfs(2) that must be carried over when
+// remounting, since the kernel otherwise clears them (or refuses, for the
+// ones locked by a user namespace).
+var remountPreservedFlags = []struct {
+	st    int64
+	mount uintptr
+}{
+	{unix.ST_NOSUID, unix.MS_NOSUID},
+	{unix.ST_NODEV, unix.MS_NODEV},
+	{unix.ST_NOEXEC, unix.MS_NOEXEC},
+	{unix.ST_NOATIME, unix.MS_NOATIME},
+	{unix.ST_NODIRATIME, unix.MS_NODIRATIME},
+	{unix.ST_RELATIME, unix.MS_RELATIME},
+}
+
+// Make the mount at dir read-only, leaving its other flags alone. This needs
+// CAP_SYS_ADMIN; fusermount has no equivalent.
+func remountReadOnly(dir string) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return &os.PathError{Op: "statfs", Path: dir, Err: err}
+	}
+
+	flags := uintptr(unix.MS_REMOUNT | unix.MS_BIND | unix.MS_RDONLY)
+	for _, f := range remountPreservedFlags {
+		if st.Flags&f.st != 0 {
+			flags |= f.mount
+		}
+	}
+
+	if err := unix.Mount("", dir, "", flags, ""); err != nil {
+		return &os.PathError{Op: "remount", Path: dir, Err: err}
+	}
+
+	return nil
+}
+
+func mountFlags(dir string) (MountFlags, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return MountFlags{}, &os.PathError{Op: "statfs", Path: dir, Err: err}
+	}
+
+	f := MountFlags{
+		ReadOnly: st.Flags&unix.ST_RDONLY != 0,
+		NoSuid:   st.Flags&unix.ST_NOSUID != 0,
+		NoDev:    st.Flags&unix.ST_NODEV != 0,
+		NoExec:   st.Flags&unix.ST_NOEXEC != 0,
+		NoAtime:  st.Flags&unix.ST_NOATIME != 0,
+	}
+
+	return f, nil
+}
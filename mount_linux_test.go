@@ -1,7 +1,18 @@
 package fuse
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
 )
 
 func Test_parseFuseFd(t *testing.T) {
@@ -35,3 +46,126 @@ func Test_parseFuseFd(t *testing.T) {
 		}
 	})
 }
+
+func Test_mountFlags(t *testing.T) {
+	// Check the flags of /proc, which is usually nosuid, nodev and noexec,
+	// against those listed for it in the mount table. The last mount wins.
+	mounts, err := os.ReadFile("/proc/self/mounts")
+	if err != nil {
+		t.Skipf("ReadFile: %v", err)
+	}
+
+	var procOpts string
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[1] == "/proc" {
+			procOpts = "," + fields[3] + ","
+		}
+	}
+
+	f, err := mountFlags("/proc")
+	if err != nil {
+		t.Fatalf("mountFlags: %v", err)
+	}
+
+	want := MountFlags{
+		ReadOnly: strings.Contains(procOpts, ",ro,"),
+		NoSuid:   strings.Contains(procOpts, ",nosuid,"),
+		NoDev:    strings.Contains(procOpts, ",nodev,"),
+		NoExec:   strings.Contains(procOpts, ",noexec,"),
+		NoAtime:  strings.Contains(procOpts, ",noatime,"),
+	}
+
+	if f != want {
+		t.Errorf("got %+v, want %+v (options %q)", f, want, procOpts)
+	}
+}
+
+func TestConnect_Timeout(t *testing.T) {
+	dev, kernel := fakeDevice(t)
+
+	// The kernel never sends INIT, until detaching the mount ends the
+	// connection.
+	mount := func(context.Context, string, *MountConfig, chan<- error) (*os.File, error) {
+		return dev, nil
+	}
+
+	var detached []string
+	unmountLazy := func(dir string) error {
+		detached = append(detached, dir)
+		return kernel.Close()
+	}
+
+	_, _, err := connect(
+		"/mnt/foo",
+		&MountConfig{},
+		time.After(10*time.Millisecond),
+		mount,
+		unmountLazy)
+
+	if !errors.Is(err, ErrMountTimeout) {
+		t.Errorf("connect: got %v, want ErrMountTimeout", err)
+	}
+
+	if want := []string{"/mnt/foo"}; !reflect.DeepEqual(detached, want) {
+		t.Errorf("detached %q, want %q", detached, want)
+	}
+}
+
+func TestConnect_Retry(t *testing.T) {
+	// A real failure of a helper process.
+	exitErr := exec.Command("false").Run()
+	if exitErr == nil {
+		t.Fatal("false succeeded")
+	}
+
+	testCases := []struct {
+		name    string
+		retries int
+		failure error
+		wantErr bool
+		want    int
+	}{
+		{"no retries", 0, exitErr, true, 1},
+		{"succeeds", 2, exitErr, false, 3},
+		{"gives up", 1, exitErr, true, 2},
+		{"not transient", 2, syscall.ENODEV, true, 1},
+	}
+
+	for _, tc := range testCases {
+		// Fail twice, then mount.
+		calls := 0
+		mount := func(context.Context, string, *MountConfig, chan<- error) (*os.File, error) {
+			calls++
+			if calls <= 2 {
+				return nil, fmt.Errorf("running fusermount: %w", tc.failure)
+			}
+
+			dev, kernel := fakeDevice(t)
+			in := fusekernel.InitIn{Major: 7, Minor: 36}
+			sendRequest(t, kernel, fusekernel.OpInit, 1, wire(t, in), wire(t, fusekernel.InitInExt{}))
+			return dev, nil
+		}
+
+		cfg := &MountConfig{
+			OpContext: context.Background(),
+			MountRetry: MountRetry{
+				Retries:        tc.retries,
+				InitialBackoff: time.Millisecond,
+			},
+		}
+
+		c, _, err := connect("/mnt/foo", cfg, nil, mount, func(string) error { return nil })
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("%s: connect: %v", tc.name, err)
+		}
+
+		if c != nil {
+			c.close()
+		}
+
+		if calls != tc.want {
+			t.Errorf("%s: %d attempts, want %d", tc.name, calls, tc.want)
+		}
+	}
+}
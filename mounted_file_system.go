@@ -16,17 +16,34 @@ package fuse
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // MountedFileSystem represents the status of a mount operation, with a method
 // that waits for unmounting.
 type MountedFileSystem struct {
-	dir string
+	dir  string
+	conn *Connection
 
 	// The result to return from Join. Not valid until the channel is closed.
 	joinStatus          error
 	joinStatusAvailable chan struct{}
+
+	mu sync.Mutex
+
+	// The hooks registered with OnDisconnect, and whether they have been run.
+	//
+	// GUARDED_BY(mu)
+	disconnectHooks []func(reason error)
+
+	// GUARDED_BY(mu)
+	disconnected bool
 }
 
 // Dir returns the directory on which the file system is mounted (or where we
@@ -35,13 +52,39 @@ func (mfs *MountedFileSystem) Dir() string {
 	return mfs.dir
 }
 
+// Conn returns the connection to the kernel through which the file system is
+// served, for instance to find out what was negotiated with Connection.InitOp.
+func (mfs *MountedFileSystem) Conn() *Connection {
+	return mfs.conn
+}
+
+// MountFlags describes the standard flags in effect for a mount, as shown in
+// /proc/mounts.
+type MountFlags struct {
+	ReadOnly bool
+	NoSuid   bool
+	NoDev    bool
+	NoExec   bool
+	NoAtime  bool
+}
+
+// MountFlags returns the flags in effect for the mount. Besides those set by
+// the MountConfig, these include any that were forced, such as nosuid and
+// nodev for mounts by unprivileged users. Not meaningful for file systems
+// mounted at /dev/fd/N.
+func (mfs *MountedFileSystem) MountFlags() (MountFlags, error) {
+	return mountFlags(mfs.dir)
+}
+
 // Join blocks until a mounted file system has been unmounted. It does not
 // return successfully until all ops read from the connection have been
 // responded to (i.e. the file system server has finished processing all
 // in-flight ops).
 //
 // The return value will be non-nil if anything unexpected happened while
-// serving. May be called multiple times.
+// serving, including the kernel aborting the connection, in which case
+// errors.Is(err, ErrConnectionAborted) holds. See also OnDisconnect. May be
+// called multiple times.
 func (mfs *MountedFileSystem) Join(ctx context.Context) error {
 	select {
 	case <-mfs.joinStatusAvailable:
@@ -51,6 +94,54 @@ func (mfs *MountedFileSystem) Join(ctx context.Context) error {
 	}
 }
 
+// OnDisconnect registers f to be called once the kernel has hung up and the
+// server has returned from ServeOps, before Join returns, so that a daemon can
+// release resources or raise an alarm. f is passed the reason, as returned by
+// Connection.Err: ErrUnmounted for an unmount and ErrConnectionAborted when
+// something went wrong. (It is nil if the server returned before the kernel
+// hung up.)
+//
+// Hooks are called in the order in which they were registered. If the server
+// has already returned, f is called at once.
+//
+// LOCKS_EXCLUDED(mfs.mu)
+func (mfs *MountedFileSystem) OnDisconnect(f func(reason error)) {
+	mfs.mu.Lock()
+	if !mfs.disconnected {
+		mfs.disconnectHooks = append(mfs.disconnectHooks, f)
+		mfs.mu.Unlock()
+		return
+	}
+	mfs.mu.Unlock()
+
+	f(mfs.conn.Err())
+}
+
+// Called once the server has returned. Run the hooks registered with
+// OnDisconnect, and work out what Join should return.
+//
+// LOCKS_EXCLUDED(mfs.mu)
+func (mfs *MountedFileSystem) disconnect(closeErr error) {
+	reason := mfs.conn.Err()
+
+	mfs.mu.Lock()
+	mfs.disconnected = true
+	hooks := mfs.disconnectHooks
+	mfs.disconnectHooks = nil
+	mfs.mu.Unlock()
+
+	for _, f := range hooks {
+		f(reason)
+	}
+
+	mfs.joinStatus = closeErr
+	if mfs.joinStatus == nil && errors.Is(reason, ErrConnectionAborted) {
+		mfs.joinStatus = reason
+	}
+
+	close(mfs.joinStatusAvailable)
+}
+
 // GetFuseContext implements the equiv. of FUSE-C fuse_get_context() and thus
 // returns the UID / GID / PID associated with all FUSE requests send by the kernel.
 // ctx parameter must be one of the context from the fuseops handlers (e.g.: CreateFile)
@@ -64,3 +155,132 @@ func (mfs *MountedFileSystem) GetFuseContext(ctx context.Context) (uid, gid, pid
 	header := inMsg.Header()
 	return header.Uid, header.Gid, header.Pid, nil
 }
+
+// Shutdown unmounts the file system gracefully, so that a daemon can restart
+// without failing writes that were already under way.
+//
+// It first stops handing newly arriving ops to the server, failing them with
+// EIO instead, and waits for the ops already handed out to be replied to. If
+// ctx is done before that happens, the ops that remain are failed with EINTR
+// on the server's behalf and their contexts cancelled; the server's replies
+// to them, when they come, are discarded. Finally the file system is
+// unmounted, which may fail if it is still in use; see UnmountWithRetry.
+//
+// Shutdown returns once the unmount has been issued; use Join to wait for the
+// server to return. If ops had to be failed, it returns ctx.Err() even though
+// the unmount succeeded.
+func (mfs *MountedFileSystem) Shutdown(ctx context.Context) error {
+	abortErr := mfs.drain(ctx)
+	if err := Unmount(mfs.dir); err != nil {
+		return err
+	}
+
+	return abortErr
+}
+
+// Stop handing ops to the server and wait for those already handed out to be
+// replied to, failing them with EINTR and returning ctx.Err() if ctx is done
+// first.
+func (mfs *MountedFileSystem) drain(ctx context.Context) error {
+	select {
+	case <-mfs.conn.beginDrain():
+		return nil
+	case <-ctx.Done():
+		mfs.conn.abortInflight(syscall.EINTR)
+		return ctx.Err()
+	}
+}
+
+// UnmountOnSignal arranges for the file system to be shut down when the
+// process receives one of the supplied signals, or SIGINT or SIGTERM if none
+// are given, so that Join returns and the daemon can exit.
+//
+// On the first signal the ops already handed to the server are given up to
+// grace to finish, as for Shutdown. The file system is then unmounted,
+// retrying while it is busy for whatever is left of the grace period, and
+// finally detached with UnmountLazy if it is still in use; in that case Join
+// returns once the files that remain open are closed. A second signal cuts
+// the grace period short. Errors are written to MountConfig.ErrorLogger.
+//
+// Note that this replaces the runtime's default handling of those signals,
+// which is to exit. Call the returned function to stop.
+func (mfs *MountedFileSystem) UnmountOnSignal(
+	grace time.Duration,
+	sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, sigs...)
+
+	go func() {
+		select {
+		case <-ch:
+		case <-done:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+
+		go func() {
+			select {
+			case <-ch:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		err := mfs.shutdownOnSignal(ctx, unmount, unmountLazy)
+		if err != nil && mfs.conn.errorLogger != nil {
+			mfs.conn.errorLogger.Printf("UnmountOnSignal: %v", err)
+		}
+	}()
+
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
+
+func (mfs *MountedFileSystem) shutdownOnSignal(
+	ctx context.Context,
+	unmount func(string) error,
+	unmountLazy func(string) error) error {
+	abortErr := mfs.drain(ctx)
+
+	// Fall back to a lazy unmount even if ctx is cancelled while retrying, so
+	// that the mount point doesn't outlive the daemon.
+	var p BusyRetry
+	if deadline, ok := ctx.Deadline(); ok {
+		p.Timeout = time.Until(deadline)
+	}
+
+	err := unmountWithRetry(ctx, mfs.dir, p, unmount, unmountLazy)
+	if errors.Is(err, syscall.EBUSY) {
+		err = unmountLazy(mfs.dir)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return abortErr
+}
+
+// RemountReadOnly makes the file system read-only from now on, for example
+// after the backend detects corruption or loses its write credentials.
+//
+// Ops that would modify the file system (see fuseops.Mutates) are failed with
+// EROFS from now on, without reaching the server; ops already handed to it are
+// unaffected. In addition the kernel mount is flipped to read-only, so that
+// the change is visible in /proc/mounts and writes fail before leaving the
+// kernel. That requires CAP_SYS_ADMIN on Linux and isn't possible on macOS,
+// and an error is returned if it fails, but the read-only guard remains in
+// effect regardless.
+func (mfs *MountedFileSystem) RemountReadOnly() error {
+	mfs.conn.readOnly.Store(true)
+	return remountReadOnly(mfs.dir)
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// InvalidateInode tells the kernel that the supplied inode has changed behind
+// its back, so that it drops its cached attributes for the inode and the
+// contents that it has cached for the byte range [off, off+length), or from
+// off to the end if length is zero. A negative off drops only the attributes.
+// For a symlink whose target is cached (see MountConfig.EnableSymlinkCaching),
+// dropping the contents drops the target.
+//
+// It returns ENOENT if the kernel has nothing cached for the inode. Don't call
+// it while serving a read or write of the inode, as the kernel may be waiting
+// for the reply with pages of the inode locked. Invalidator takes care of
+// both of these.
+func (c *Connection) InvalidateInode(
+	inode fuseops.InodeID,
+	off int64,
+	length int64) error {
+	m := buffer.GetOutMessage()
+	defer buffer.PutOutMessage(m)
+
+	out := (*fusekernel.NotifyInvalInodeOut)(m.Grow(int(unsafe.Sizeof(fusekernel.NotifyInvalInodeOut{}))))
+	out.Ino = uint64(inode)
+	out.Off = off
+	out.Len = length
+
+	c.debugLog(0, 1, "<- InvalidateInode (inode %v, off %d, len %d)", inode, off, length)
+	return c.notify(fusekernel.NotifyCodeInvalInode, m)
+}
+
+// InvalidateEntry tells the kernel that the entry with the supplied name in
+// the parent directory has changed behind its back, for example been removed
+// or made to refer to a different inode, so that it drops the entry from its
+// cache of names (and with it any negative entry).
+//
+// It returns ENOENT if the kernel has nothing cached for the parent. Don't
+// call it while serving an op on the parent directory, such as a lookup in
+// it, as the kernel holds the directory's lock until the op is replied to.
+// Invalidator takes care of both of these.
+func (c *Connection) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) error {
+	m := buffer.GetOutMessage()
+	defer buffer.PutOutMessage(m)
+
+	out := (*fusekernel.NotifyInvalEntryOut)(m.Grow(int(unsafe.Sizeof(fusekernel.NotifyInvalEntryOut{}))))
+	out.Parent = uint64(parent)
+	out.Namelen = uint32(len(name))
+	m.AppendString(name)
+	m.Append([]byte{0})
+
+	c.debugLog(0, 1, "<- InvalidateEntry (parent %v, name %q)", parent, name)
+	return c.notify(fusekernel.NotifyCodeInvalEntry, m)
+}
+
+// Send a notification, an unsolicited message to the kernel identified by
+// code rather than by the unique ID of a request.
+func (c *Connection) notify(code int32, m *buffer.OutMessage) error {
+	h := m.OutHeader()
+	h.Error = code
+	h.Len = uint32(m.Len())
+
+	return c.transport.Writev(m.Sglist)
+}
@@ -0,0 +1,213 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestConnection_InvalidateInode(t *testing.T) {
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	c, kernel, _ := initConnection(t, MountConfig{}, in, fusekernel.InitInExt{})
+
+	if err := c.InvalidateInode(17, 4096, -1); err != nil {
+		t.Fatalf("InvalidateInode: %v", err)
+	}
+
+	hdr, body := readReply(t, kernel)
+	if hdr.Unique != 0 || hdr.Error != fusekernel.NotifyCodeInvalInode {
+		t.Fatalf("got header %+v, want an inode invalidation", hdr)
+	}
+
+	var out fusekernel.NotifyInvalInodeOut
+	if err := binary.Read(bytes.NewReader(body), binary.LittleEndian, &out); err != nil {
+		t.Fatalf("binary.Read: %v", err)
+	}
+
+	want := fusekernel.NotifyInvalInodeOut{Ino: 17, Off: 4096, Len: -1}
+	if out != want {
+		t.Errorf("got %+v, want %+v", out, want)
+	}
+}
+
+func TestConnection_InvalidateEntry(t *testing.T) {
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	c, kernel, _ := initConnection(t, MountConfig{}, in, fusekernel.InitInExt{})
+
+	if err := c.InvalidateEntry(17, "foo"); err != nil {
+		t.Fatalf("InvalidateEntry: %v", err)
+	}
+
+	hdr, body := readReply(t, kernel)
+	if hdr.Unique != 0 || hdr.Error != fusekernel.NotifyCodeInvalEntry {
+		t.Fatalf("got header %+v, want an entry invalidation", hdr)
+	}
+
+	if int(hdr.Len) != 16+len(body) {
+		t.Errorf("header length %d for %d-byte body", hdr.Len, len(body))
+	}
+
+	// The parent, the length of the name and padding, then the name and a NUL.
+	want := []byte{17, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 'f', 'o', 'o', 0}
+	if !bytes.Equal(body, want) {
+		t.Errorf("got body %v, want %v", body, want)
+	}
+}
+
+// A transport that refuses the first notifications written through it with
+// the supplied errors, and counts those it passes on.
+type refusingTransport struct {
+	Transport
+
+	mu   sync.Mutex
+	errs []error
+	sent int
+}
+
+func (t *refusingTransport) Writev(bufs [][]byte) error {
+	t.mu.Lock()
+	if len(t.errs) > 0 {
+		err := t.errs[0]
+		t.errs = t.errs[1:]
+		t.mu.Unlock()
+		return err
+	}
+
+	t.sent++
+	t.mu.Unlock()
+
+	return t.Transport.Writev(bufs)
+}
+
+func (t *refusingTransport) Sent() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.sent
+}
+
+func TestInvalidator_RetriesAgain(t *testing.T) {
+	var logged bytes.Buffer
+	cfg := MountConfig{ErrorLogger: log.New(&logged, "", 0)}
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	c, kernel, _ := initConnection(t, cfg, in, fusekernel.InitInExt{})
+
+	tr := &refusingTransport{
+		Transport: c.transport,
+		errs:      []error{syscall.EAGAIN, syscall.EAGAIN},
+	}
+	c.transport = tr
+
+	inv := NewInvalidator(c)
+	defer inv.Close()
+
+	inv.InvalidateEntry(17, "foo")
+	inv.Flush()
+
+	hdr, _ := readReply(t, kernel)
+	if hdr.Error != fusekernel.NotifyCodeInvalEntry {
+		t.Errorf("got header %+v, want an entry invalidation", hdr)
+	}
+
+	if tr.Sent() != 1 {
+		t.Errorf("sent %d notifications, want 1", tr.Sent())
+	}
+
+	if logged.Len() != 0 {
+		t.Errorf("unexpected errors logged: %q", logged.String())
+	}
+}
+
+func TestInvalidator_IgnoresNotCached(t *testing.T) {
+	var logged bytes.Buffer
+	cfg := MountConfig{ErrorLogger: log.New(&logged, "", 0)}
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	c, _, _ := initConnection(t, cfg, in, fusekernel.InitInExt{})
+
+	tr := &refusingTransport{
+		Transport: c.transport,
+		errs:      []error{syscall.ENOENT, syscall.EIO},
+	}
+	c.transport = tr
+
+	inv := NewInvalidator(c)
+	defer inv.Close()
+
+	inv.InvalidateInode(17, 0, 0)
+	inv.InvalidateEntry(17, "foo")
+	inv.Flush()
+
+	// Only the second failure is worth reporting.
+	want := "InvalidateEntry (parent 17, name \"foo\"): input/output error\n"
+	if got := logged.String(); got != want {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
+
+func TestInvalidator_WaitsForOps(t *testing.T) {
+	in := fusekernel.InitIn{Major: 7, Minor: 36}
+	c, kernel, _ := initConnection(t, MountConfig{}, in, fusekernel.InitInExt{})
+
+	tr := &refusingTransport{Transport: c.transport}
+	c.transport = tr
+
+	inv := NewInvalidator(c)
+	defer inv.Close()
+
+	// Ask for the invalidation of an entry while serving a lookup in its
+	// directory, as a file system might on discovering it is stale.
+	sendRequest(t, kernel, fusekernel.OpLookup, 2, []byte("foo\x00"))
+	ctx, _, err := c.ReadOp()
+	if err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	inv.InvalidateEntry(fuseops.RootInodeID, "foo")
+	inv.InvalidateEntry(fuseops.RootInodeID, "foo")
+
+	time.Sleep(5 * invalidateBusyPoll)
+	if tr.Sent() != 0 {
+		t.Fatalf("invalidation sent while the lookup was in flight")
+	}
+
+	if err := c.Reply(ctx, syscall.ENOENT); err != nil {
+		t.Fatalf("Reply: %v", err)
+	}
+
+	inv.Flush()
+
+	// The reply and then a single invalidation, though the invalidation may
+	// overtake the reply.
+	var notified int
+	for i := 0; i < 2; i++ {
+		hdr, _ := readReply(t, kernel)
+		if hdr.Unique == 0 {
+			notified++
+		}
+	}
+
+	if notified != 1 || tr.Sent() != 2 {
+		t.Errorf("got %d invalidations of %d messages, want 1 of 2", notified, tr.Sent())
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A pool of ops of a single type, used if MountConfig.PoolOps is set.
+type opPool[T any] struct {
+	p sync.Pool
+}
+
+// Return a zeroed op, from the pool if pooling is enabled.
+func (p *opPool[T]) get(cfg *MountConfig) *T {
+	if cfg.PoolOps {
+		if op, ok := p.p.Get().(*T); ok {
+			return op
+		}
+	}
+
+	return new(T)
+}
+
+func (p *opPool[T]) put(op *T) {
+	var zero T
+	*op = zero
+	p.p.Put(op)
+}
+
+// The op types that are pooled: those that dominate stat storms and bulk
+// reads and writes.
+var (
+	lookUpInodeOps        opPool[fuseops.LookUpInodeOp]
+	getInodeAttributesOps opPool[fuseops.GetInodeAttributesOp]
+	forgetInodeOps        opPool[fuseops.ForgetInodeOp]
+	openFileOps           opPool[fuseops.OpenFileOp]
+	readFileOps           opPool[fuseops.ReadFileOp]
+	writeFileOps          opPool[fuseops.WriteFileOp]
+	flushFileOps          opPool[fuseops.FlushFileOp]
+	releaseFileHandleOps  opPool[fuseops.ReleaseFileHandleOp]
+)
+
+// Return an op that has been replied to to its pool, if it has one. Must only
+// be called if pooling is enabled.
+func releaseOp(op interface{}) {
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		lookUpInodeOps.put(o)
+
+	case *fuseops.GetInodeAttributesOp:
+		getInodeAttributesOps.put(o)
+
+	case *fuseops.ForgetInodeOp:
+		forgetInodeOps.put(o)
+
+	case *fuseops.OpenFileOp:
+		openFileOps.put(o)
+
+	case *fuseops.ReadFileOp:
+		readFileOps.put(o)
+
+	case *fuseops.WriteFileOp:
+		writeFileOps.put(o)
+
+	case *fuseops.FlushFileOp:
+		flushFileOps.put(o)
+
+	case *fuseops.ReleaseFileHandleOp:
+		releaseFileHandleOps.put(o)
+	}
+}
@@ -37,7 +37,8 @@ type initOp struct {
 	Kernel fusekernel.Protocol
 
 	// In/out
-	Flags fusekernel.InitFlags
+	Flags  fusekernel.InitFlags
+	Flags2 fusekernel.InitFlags2
 
 	// Out
 	Library       fusekernel.Protocol
@@ -45,4 +46,6 @@ type initOp struct {
 	MaxBackground uint16
 	MaxWrite      uint32
 	MaxPages      uint16
+	MaxStackDepth uint32
+	TimeGran      uint32
 }
@@ -0,0 +1,157 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package otelfuse traces FUSE ops with OpenTelemetry.
+//
+// Each op read from the kernel gets a span, started in the op's context before
+// the file system sees it and ended when it is replied to. Work that the file
+// system does with that context, such as calls to a backend store, therefore
+// shows up as children of the op's span. To attach the spans themselves to an
+// existing trace, set MountConfig.OpContext to a context carrying its span.
+//
+// The package is a module of its own, so that programs that don't use it
+// don't depend on OpenTelemetry.
+package otelfuse
+
+import (
+	"context"
+	"errors"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The instrumentation name reported to the tracer provider.
+const instrumentationName = "github.com/jacobsa/fuse/otelfuse"
+
+// Attribute keys set on op spans.
+const (
+	OpKey     = attribute.Key("fuse.op")
+	UniqueKey = attribute.Key("fuse.unique")
+	InodeKey  = attribute.Key("fuse.inode")
+	PidKey    = attribute.Key("fuse.pid")
+	OffsetKey = attribute.Key("fuse.offset")
+	SizeKey   = attribute.Key("fuse.size")
+	ErrnoKey  = attribute.Key("fuse.errno")
+
+	// Set on ReadFile spans once the op succeeds.
+	BytesReadKey = attribute.Key("fuse.bytes_read")
+)
+
+// Wrap returns a server that traces every op served by the supplied one, using
+// spans from the given provider. If tp is nil, the global provider is used.
+func Wrap(server fuse.Server, tp trace.TracerProvider) fuse.Server {
+	return fuse.Chain(server, NewInterceptor(tp))
+}
+
+// NewInterceptor returns an interceptor that traces ops as described in the
+// package documentation, for use with fuse.Chain. If tp is nil, the global
+// provider is used.
+func NewInterceptor(tp trace.TracerProvider) fuse.Interceptor {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+
+	return &interceptor{
+		tracer: tp.Tracer(instrumentationName),
+	}
+}
+
+type interceptor struct {
+	tracer trace.Tracer
+}
+
+// The key under which an op's span is stored in its context. We don't rely on
+// trace.SpanFromContext in InterceptReply, since an interceptor or file system
+// further in may have started a span of its own.
+type spanKey struct{}
+
+func (ic *interceptor) InterceptOp(
+	ctx context.Context,
+	op interface{}) (context.Context, error) {
+	ctx, span := ic.tracer.Start(
+		ctx,
+		"fuse."+fuse.OpName(op),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(opAttributes(op)...))
+
+	return context.WithValue(ctx, spanKey{}, span), nil
+}
+
+func (ic *interceptor) InterceptReply(
+	ctx context.Context,
+	op interface{},
+	err error) error {
+	span, ok := ctx.Value(spanKey{}).(trace.Span)
+	if !ok {
+		return err
+	}
+
+	// Sizes that are only known once the op has been handled.
+	if o, ok := op.(*fuseops.ReadFileOp); ok && err == nil {
+		span.SetAttributes(BytesReadKey.Int(o.BytesRead))
+	}
+
+	if err != nil {
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			span.SetAttributes(ErrnoKey.Int(int(errno)))
+		}
+
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+	return err
+}
+
+// Return the attributes known about an op before it is handled.
+func opAttributes(op interface{}) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{OpKey.String(fuse.OpName(op))}
+
+	if oc, ok := fuseops.ContextOf(op); ok {
+		attrs = append(
+			attrs,
+			UniqueKey.Int64(int64(oc.FuseID)),
+			PidKey.Int64(int64(oc.Pid)))
+
+		if oc.Inode != 0 {
+			attrs = append(attrs, InodeKey.Int64(int64(oc.Inode)))
+		}
+	}
+
+	switch o := op.(type) {
+	case *fuseops.ReadFileOp:
+		attrs = append(attrs, OffsetKey.Int64(o.Offset), SizeKey.Int64(o.Size))
+
+	case *fuseops.WriteFileOp:
+		attrs = append(
+			attrs,
+			OffsetKey.Int64(o.Offset),
+			SizeKey.Int(len(o.Data)))
+
+	case *fuseops.ReadDirOp:
+		attrs = append(
+			attrs,
+			OffsetKey.Int64(int64(o.Offset)),
+			SizeKey.Int(len(o.Dst)))
+	}
+
+	return attrs
+}
@@ -0,0 +1,152 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package otelfuse
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newRecorder() (*tracetest.SpanRecorder, trace.TracerProvider) {
+	sr := tracetest.NewSpanRecorder()
+	return sr, sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+}
+
+func attrMap(kvs []attribute.KeyValue) map[attribute.Key]attribute.Value {
+	m := make(map[attribute.Key]attribute.Value)
+	for _, kv := range kvs {
+		m[kv.Key] = kv.Value
+	}
+
+	return m
+}
+
+func TestInterceptor_Read(t *testing.T) {
+	sr, tp := newRecorder()
+	ic := NewInterceptor(tp)
+
+	// Start from a context that already carries a span, as though the mount
+	// were part of a larger trace.
+	parentCtx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+
+	op := &fuseops.ReadFileOp{
+		Inode:     17,
+		Offset:    4096,
+		Size:      8192,
+		OpContext: fuseops.OpContext{FuseID: 3, Inode: 17, Pid: 1234},
+	}
+
+	ctx, err := ic.InterceptOp(parentCtx, op)
+	if err != nil {
+		t.Fatalf("InterceptOp: %v", err)
+	}
+
+	// Work done by the file system should be a child of the op's span.
+	opSpan := trace.SpanFromContext(ctx)
+	if opSpan.SpanContext().TraceID() != parent.SpanContext().TraceID() {
+		t.Error("op span is not part of the parent trace")
+	}
+
+	op.BytesRead = 100
+	if err := ic.InterceptReply(ctx, op, nil); err != nil {
+		t.Fatalf("InterceptReply: %v", err)
+	}
+
+	spans := sr.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d ended spans, want 1", len(spans))
+	}
+
+	s := spans[0]
+	if s.Name() != "fuse.ReadFile" {
+		t.Errorf("name: got %q", s.Name())
+	}
+
+	if s.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Error("op span's parent is not the parent span")
+	}
+
+	if s.Status().Code != codes.Unset {
+		t.Errorf("status: got %v", s.Status())
+	}
+
+	attrs := attrMap(s.Attributes())
+	want := map[attribute.Key]int64{
+		InodeKey:     17,
+		OffsetKey:    4096,
+		SizeKey:      8192,
+		UniqueKey:    3,
+		PidKey:       1234,
+		BytesReadKey: 100,
+	}
+
+	for k, v := range want {
+		if got := attrs[k].AsInt64(); got != v {
+			t.Errorf("%s: got %d, want %d", k, got, v)
+		}
+	}
+
+	if got := attrs[OpKey].AsString(); got != "ReadFile" {
+		t.Errorf("%s: got %q", OpKey, got)
+	}
+}
+
+func TestInterceptor_Error(t *testing.T) {
+	sr, tp := newRecorder()
+	ic := NewInterceptor(tp)
+
+	op := &fuseops.LookUpInodeOp{
+		Parent:    fuseops.RootInodeID,
+		Name:      "foo",
+		OpContext: fuseops.OpContext{Inode: fuseops.RootInodeID},
+	}
+
+	ctx, err := ic.InterceptOp(context.Background(), op)
+	if err != nil {
+		t.Fatalf("InterceptOp: %v", err)
+	}
+
+	// The error must be passed through unchanged.
+	if err := ic.InterceptReply(ctx, op, syscall.ENOENT); err != syscall.ENOENT {
+		t.Errorf("InterceptReply: got %v, want ENOENT", err)
+	}
+
+	spans := sr.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d ended spans, want 1", len(spans))
+	}
+
+	s := spans[0]
+	if s.Status().Code != codes.Error {
+		t.Errorf("status: got %v", s.Status())
+	}
+
+	attrs := attrMap(s.Attributes())
+	if got := attrs[ErrnoKey].AsInt64(); got != int64(syscall.ENOENT) {
+		t.Errorf("errno: got %d", got)
+	}
+
+	if got := attrs[InodeKey].AsInt64(); got != int64(fuseops.RootInodeID) {
+		t.Errorf("inode: got %d", got)
+	}
+}
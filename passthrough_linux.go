@@ -0,0 +1,78 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// OpenBackingFile registers f with the kernel as a backing file for passthrough
+// (see MountConfig.EnablePassthrough), returning an ID for
+// OpenFileOp.BackingID or CreateFileOp.BackingID. The kernel takes its own
+// reference to the file, so f may be closed once this returns.
+//
+// It fails with EPERM unless the process has CAP_SYS_ADMIN, with EOPNOTSUPP
+// if passthrough wasn't negotiated, and with ENOTSUP for connections not
+// served through the fuse device (see Serve).
+func (c *Connection) OpenBackingFile(f *os.File) (fuseops.BackingID, error) {
+	dev, ok := c.fuseDevice()
+	if !ok {
+		return 0, syscall.ENOTSUP
+	}
+
+	m := fusekernel.BackingMap{Fd: int32(f.Fd())}
+	id, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		dev.f.Fd(),
+		fusekernel.DevIocBackingOpen,
+		uintptr(unsafe.Pointer(&m)))
+	runtime.KeepAlive(f)
+
+	if errno != 0 {
+		return 0, errno
+	}
+
+	c.debugLog(0, 1, "<- OpenBackingFile (%s): %d", f.Name(), id)
+	return fuseops.BackingID(id), nil
+}
+
+// CloseBackingFile unregisters a backing file registered by OpenBackingFile.
+// Handles already opened with it keep using the file until they are released.
+func (c *Connection) CloseBackingFile(id fuseops.BackingID) error {
+	dev, ok := c.fuseDevice()
+	if !ok {
+		return syscall.ENOTSUP
+	}
+
+	v := uint32(id)
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		dev.f.Fd(),
+		fusekernel.DevIocBackingClose,
+		uintptr(unsafe.Pointer(&v)))
+
+	if errno != 0 {
+		return errno
+	}
+
+	c.debugLog(0, 1, "<- CloseBackingFile (%d)", id)
+	return nil
+}
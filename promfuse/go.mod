@@ -0,0 +1,21 @@
+module github.com/jacobsa/fuse/promfuse
+
+go 1.21
+
+require (
+	github.com/jacobsa/fuse v0.0.0-00010101000000-000000000000
+	github.com/prometheus/client_golang v1.19.0
+	golang.org/x/sys v0.18.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	google.golang.org/protobuf v1.32.0 // indirect
+)
+
+replace github.com/jacobsa/fuse => ../
@@ -0,0 +1,283 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package promfuse exports Prometheus metrics about the ops served by a
+// fuse.Server:
+//
+//	fuse_ops_total{op}                 ops replied to
+//	fuse_op_errors_total{op,errno}     ops replied to with an error
+//	fuse_op_duration_seconds{op}       time from reading an op to replying
+//	fuse_op_queue_seconds{op}          time from reading an op to starting work
+//	fuse_ops_in_flight                 ops read but not yet replied to
+//	fuse_ops_queued                    ops read but not yet started
+//	fuse_ops_started                   ops started but not yet replied to
+//	fuse_write_bytes_in_flight         bytes carried by WriteFile ops in flight
+//	fuse_read_bytes_total              bytes returned by ReadFile
+//	fuse_written_bytes_total           bytes passed to WriteFile
+//
+// The queue latency, and the split of ops in flight between queued and
+// started, are recorded only for servers that call
+// fuse.Connection.MarkOpStarted, which includes those created by
+// fuseutil.NewFileSystemServer. See fuse.Stats for what they say about where
+// a slow mount is spending its time.
+//
+// The package is a module of its own, so that programs that don't use it
+// don't depend on the Prometheus client library.
+package promfuse
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+// Metrics is a fuse.Interceptor that records metrics about the ops that pass
+// through it. Create one with New.
+type Metrics struct {
+	ops          *prometheus.CounterVec
+	errors       *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	queue        *prometheus.HistogramVec
+	inFlight     prometheus.Gauge
+	queued       prometheus.Gauge
+	started      prometheus.Gauge
+	writeBytes   prometheus.Gauge
+	bytesRead    prometheus.Counter
+	bytesWritten prometheus.Counter
+}
+
+var _ fuse.StartObserver = &Metrics{}
+
+// New creates metrics and registers them with reg. The constant labels, which
+// may be nil, are attached to every metric; use them to tell mounts apart when
+// a process serves more than one.
+func New(reg prometheus.Registerer, constLabels prometheus.Labels) (*Metrics, error) {
+	const ns = "fuse"
+	m := &Metrics{
+		ops: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   ns,
+				Name:        "ops_total",
+				Help:        "FUSE ops replied to, by op.",
+				ConstLabels: constLabels,
+			},
+			[]string{"op"}),
+
+		errors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   ns,
+				Name:        "op_errors_total",
+				Help:        "FUSE ops replied to with an error, by op and errno.",
+				ConstLabels: constLabels,
+			},
+			[]string{"op", "errno"}),
+
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   ns,
+				Name:        "op_duration_seconds",
+				Help:        "Time from reading a FUSE op to replying to it.",
+				Buckets:     prometheus.ExponentialBuckets(1e-5, 4, 10),
+				ConstLabels: constLabels,
+			},
+			[]string{"op"}),
+
+		queue: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   ns,
+				Name:        "op_queue_seconds",
+				Help:        "Time from reading a FUSE op to starting work on it.",
+				Buckets:     prometheus.ExponentialBuckets(1e-6, 4, 10),
+				ConstLabels: constLabels,
+			},
+			[]string{"op"}),
+
+		inFlight: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   ns,
+				Name:        "ops_in_flight",
+				Help:        "FUSE ops read but not yet replied to.",
+				ConstLabels: constLabels,
+			}),
+
+		queued: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   ns,
+				Name:        "ops_queued",
+				Help:        "FUSE ops read but not yet started.",
+				ConstLabels: constLabels,
+			}),
+
+		started: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   ns,
+				Name:        "ops_started",
+				Help:        "FUSE ops started but not yet replied to.",
+				ConstLabels: constLabels,
+			}),
+
+		writeBytes: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   ns,
+				Name:        "write_bytes_in_flight",
+				Help:        "Bytes carried by WriteFile ops read but not yet replied to.",
+				ConstLabels: constLabels,
+			}),
+
+		bytesRead: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace:   ns,
+				Name:        "read_bytes_total",
+				Help:        "Bytes returned by ReadFile ops.",
+				ConstLabels: constLabels,
+			}),
+
+		bytesWritten: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace:   ns,
+				Name:        "written_bytes_total",
+				Help:        "Bytes passed to WriteFile ops.",
+				ConstLabels: constLabels,
+			}),
+	}
+
+	collectors := []prometheus.Collector{
+		m.ops,
+		m.errors,
+		m.duration,
+		m.queue,
+		m.inFlight,
+		m.queued,
+		m.started,
+		m.writeBytes,
+		m.bytesRead,
+		m.bytesWritten,
+	}
+
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// Wrap returns a server that records metrics, registered with reg, about every
+// op served by the supplied one.
+func Wrap(
+	server fuse.Server,
+	reg prometheus.Registerer,
+	constLabels prometheus.Labels) (fuse.Server, error) {
+	m, err := New(reg, constLabels)
+	if err != nil {
+		return nil, err
+	}
+
+	return fuse.Chain(server, m), nil
+}
+
+// What we know about an op in flight, stored in its context.
+type opInfoKey struct{}
+
+type opInfo struct {
+	// When the op was read.
+	read time.Time
+
+	// Set by OpStarted.
+	started atomic.Bool
+}
+
+func (m *Metrics) InterceptOp(
+	ctx context.Context,
+	op interface{}) (context.Context, error) {
+	m.inFlight.Inc()
+	m.queued.Inc()
+	if w, ok := op.(*fuseops.WriteFileOp); ok {
+		m.writeBytes.Add(float64(len(w.Data)))
+	}
+
+	return context.WithValue(ctx, opInfoKey{}, &opInfo{read: time.Now()}), nil
+}
+
+func (m *Metrics) OpStarted(ctx context.Context, op interface{}) {
+	info, ok := ctx.Value(opInfoKey{}).(*opInfo)
+	if !ok || !info.started.CompareAndSwap(false, true) {
+		return
+	}
+
+	m.queued.Dec()
+	m.started.Inc()
+	m.queue.WithLabelValues(fuse.OpName(op)).Observe(time.Since(info.read).Seconds())
+}
+
+func (m *Metrics) InterceptReply(
+	ctx context.Context,
+	op interface{},
+	err error) error {
+	name := fuse.OpName(op)
+
+	m.inFlight.Dec()
+	m.ops.WithLabelValues(name).Inc()
+	if info, ok := ctx.Value(opInfoKey{}).(*opInfo); ok {
+		if info.started.Load() {
+			m.started.Dec()
+		} else {
+			m.queued.Dec()
+		}
+
+		m.duration.WithLabelValues(name).Observe(time.Since(info.read).Seconds())
+	}
+
+	if w, ok := op.(*fuseops.WriteFileOp); ok {
+		m.writeBytes.Sub(float64(len(w.Data)))
+	}
+
+	if err != nil {
+		m.errors.WithLabelValues(name, errnoLabel(err)).Inc()
+		return err
+	}
+
+	switch o := op.(type) {
+	case *fuseops.ReadFileOp:
+		m.bytesRead.Add(float64(o.BytesRead))
+
+	case *fuseops.WriteFileOp:
+		m.bytesWritten.Add(float64(len(o.Data)))
+	}
+
+	return err
+}
+
+// Return the errno label for an error: the symbolic name of the errno in its
+// chain, such as "ENOENT", or "other" if there is none.
+func errnoLabel(err error) string {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return "other"
+	}
+
+	if name := unix.ErrnoName(errno); name != "" {
+		return name
+	}
+
+	return "other"
+}
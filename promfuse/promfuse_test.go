@@ -0,0 +1,174 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promfuse
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Pass an op through the interceptor, replying with the supplied error.
+func serve(t *testing.T, m *Metrics, op interface{}, err error) {
+	t.Helper()
+
+	ctx, ierr := m.InterceptOp(context.Background(), op)
+	if ierr != nil {
+		t.Fatalf("InterceptOp: %v", ierr)
+	}
+
+	m.OpStarted(ctx, op)
+
+	if got := m.InterceptReply(ctx, op, err); got != err {
+		t.Fatalf("InterceptReply: got %v, want %v", got, err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	m, err := New(reg, prometheus.Labels{"mount": "/mnt/test"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	serve(t, m, &fuseops.ReadFileOp{BytesRead: 100}, nil)
+	serve(t, m, &fuseops.ReadFileOp{BytesRead: 50}, nil)
+	serve(t, m, &fuseops.WriteFileOp{Data: make([]byte, 30)}, nil)
+	serve(t, m, &fuseops.LookUpInodeOp{}, syscall.ENOENT)
+	serve(t, m, &fuseops.LookUpInodeOp{}, errors.New("taco"))
+
+	if got := testutil.ToFloat64(m.ops.WithLabelValues("ReadFile")); got != 2 {
+		t.Errorf("ReadFile ops: got %v, want 2", got)
+	}
+
+	if got := testutil.ToFloat64(m.ops.WithLabelValues("LookUpInode")); got != 2 {
+		t.Errorf("LookUpInode ops: got %v, want 2", got)
+	}
+
+	errorCases := []struct {
+		errno string
+		want  float64
+	}{
+		{"ENOENT", 1},
+		{"other", 1},
+	}
+
+	for _, tc := range errorCases {
+		c := m.errors.WithLabelValues("LookUpInode", tc.errno)
+		if got := testutil.ToFloat64(c); got != tc.want {
+			t.Errorf("errors{errno=%s}: got %v, want %v", tc.errno, got, tc.want)
+		}
+	}
+
+	if got := testutil.ToFloat64(m.bytesRead); got != 150 {
+		t.Errorf("bytes read: got %v, want 150", got)
+	}
+
+	if got := testutil.ToFloat64(m.bytesWritten); got != 30 {
+		t.Errorf("bytes written: got %v, want 30", got)
+	}
+
+	if got := testutil.ToFloat64(m.inFlight); got != 0 {
+		t.Errorf("in flight: got %v, want 0", got)
+	}
+
+	// Every op should have been timed, both in the queue and overall.
+	if got := testutil.CollectAndCount(m.duration); got != 3 {
+		t.Errorf("duration series: got %d, want 3", got)
+	}
+
+	if got := testutil.CollectAndCount(m.queue); got != 3 {
+		t.Errorf("queue series: got %d, want 3", got)
+	}
+
+	// Metrics should be exported with the constant labels.
+	if _, err := reg.Gather(); err != nil {
+		t.Errorf("Gather: %v", err)
+	}
+}
+
+func TestMetrics_InFlight(t *testing.T) {
+	m, err := New(prometheus.NewRegistry(), nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	op := &fuseops.GetInodeAttributesOp{}
+	ctx, _ := m.InterceptOp(context.Background(), op)
+	if got := testutil.ToFloat64(m.inFlight); got != 1 {
+		t.Errorf("in flight: got %v, want 1", got)
+	}
+
+	m.InterceptReply(ctx, op, nil)
+	if got := testutil.ToFloat64(m.inFlight); got != 0 {
+		t.Errorf("in flight: got %v, want 0", got)
+	}
+}
+
+func TestMetrics_QueuedAndStarted(t *testing.T) {
+	m, err := New(prometheus.NewRegistry(), nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	check := func(desc string, queued, started, writeBytes float64) {
+		t.Helper()
+		if got := testutil.ToFloat64(m.queued); got != queued {
+			t.Errorf("%s: queued: got %v, want %v", desc, got, queued)
+		}
+
+		if got := testutil.ToFloat64(m.started); got != started {
+			t.Errorf("%s: started: got %v, want %v", desc, got, started)
+		}
+
+		if got := testutil.ToFloat64(m.writeBytes); got != writeBytes {
+			t.Errorf("%s: write bytes: got %v, want %v", desc, got, writeBytes)
+		}
+	}
+
+	write := &fuseops.WriteFileOp{Data: []byte("taco")}
+	writeCtx, _ := m.InterceptOp(context.Background(), write)
+
+	stat := &fuseops.GetInodeAttributesOp{}
+	statCtx, _ := m.InterceptOp(context.Background(), stat)
+	check("read", 2, 0, 4)
+
+	m.OpStarted(writeCtx, write)
+	m.OpStarted(writeCtx, write)
+	check("started", 1, 1, 4)
+
+	m.InterceptReply(writeCtx, write, nil)
+	check("write replied to", 1, 0, 0)
+
+	// An op can be replied to without having been started.
+	m.InterceptReply(statCtx, stat, nil)
+	check("all replied to", 0, 0, 0)
+}
+
+func TestNew_DuplicateRegistration(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	if _, err := New(reg, nil); err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if _, err := New(reg, nil); err == nil {
+		t.Error("second New with the same labels: expected an error")
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+)
+
+// OpPanic describes a panic while serving an op, as passed to
+// MountConfig.OnOpPanic.
+type OpPanic struct {
+	Op     interface{}
+	Unique uint64
+	Inode  uint64
+
+	// The value passed to panic, and the stack of the goroutine that panicked.
+	Value interface{}
+	Stack string
+}
+
+// ReplyPanic replies with EIO to an op whose server panicked with the
+// supplied value, after reporting the panic to MountConfig.OnOpPanic, or to
+// the error logger if that is nil. The context must be the context returned
+// by ReadOp, and stack that of the goroutine that panicked, as returned by
+// debug.Stack in the deferred function that recovered. It must not be called
+// for an op that has already been replied to.
+//
+// Servers created by fuseutil.NewFileSystemServer call it unless
+// MountConfig.CrashOnPanic is set. Other servers may do the same, so that a
+// bug in serving one op doesn't take down the process and leave the mount
+// point wedged.
+func (c *Connection) ReplyPanic(ctx context.Context, r interface{}, stack []byte) {
+	state, ok := ctx.Value(contextKey).(opState)
+	if !ok {
+		panic(fmt.Sprintf("ReplyPanic called with invalid context: %#v", ctx))
+	}
+
+	p := OpPanic{
+		Op:     state.op,
+		Unique: state.inMsg.Header().Unique,
+		Inode:  state.inMsg.Header().Nodeid,
+		Value:  r,
+		Stack:  string(stack),
+	}
+
+	switch {
+	case c.cfg.OnOpPanic != nil:
+		c.cfg.OnOpPanic(p)
+
+	case c.errorLogger != nil:
+		c.errorLogger.Printf(
+			"%s (unique %d, inode %d) panicked: %v\n%s",
+			OpName(p.Op),
+			p.Unique,
+			p.Inode,
+			p.Value,
+			p.Stack)
+	}
+
+	c.Reply(ctx, syscall.EIO)
+}
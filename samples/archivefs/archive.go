@@ -0,0 +1,245 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archivefs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// An entry read from an archive's index.
+type entry struct {
+	// The cleaned path of the entry within the archive, without a leading
+	// slash.
+	name string
+
+	mode  os.FileMode
+	size  int64
+	mtime time.Time
+	uid   uint32
+	gid   uint32
+
+	// For symlinks, the target.
+	target string
+
+	// For hard links, the name of the earlier entry that is linked to.
+	link string
+
+	// For files, a function that decompresses the contents.
+	open func() (io.ReadCloser, error)
+}
+
+// Clean up a name from an archive, keeping it within the root. Return false
+// if it refers to the root itself.
+func cleanName(name string) (string, bool) {
+	name = path.Clean("/" + name)[1:]
+	if name == "" {
+		return "", false
+	}
+
+	return name, true
+}
+
+// Read the index of the archive at the supplied path, which must be a zip
+// file or a possibly gzipped tar file.
+func readArchive(p string) ([]entry, error) {
+	switch {
+	case strings.HasSuffix(p, ".zip"):
+		return readZip(p)
+
+	case strings.HasSuffix(p, ".tar"):
+		return readTar(p, false)
+
+	case strings.HasSuffix(p, ".tar.gz"), strings.HasSuffix(p, ".tgz"):
+		return readTar(p, true)
+	}
+
+	return nil, fmt.Errorf("Unknown archive type: %s", p)
+}
+
+func readZip(p string) ([]entry, error) {
+	// The archive stays open for as long as the file system exists, so that
+	// entries can be decompressed on demand.
+	r, err := zip.OpenReader(p)
+	if err != nil {
+		return nil, fmt.Errorf("OpenReader: %v", err)
+	}
+
+	uid := uint32(os.Getuid())
+	gid := uint32(os.Getgid())
+
+	var entries []entry
+	for _, f := range r.File {
+		e := entry{
+			mode:  f.Mode(),
+			size:  int64(f.UncompressedSize64),
+			mtime: f.Modified,
+			uid:   uid,
+			gid:   gid,
+			open:  f.Open,
+		}
+
+		var ok bool
+		if e.name, ok = cleanName(f.Name); !ok {
+			continue
+		}
+
+		// Symlinks store their targets as their contents, which are small
+		// enough to read now.
+		if e.mode&os.ModeSymlink != 0 {
+			target, err := readAll(f.Open)
+			if err != nil {
+				return nil, fmt.Errorf("Reading symlink %s: %v", f.Name, err)
+			}
+
+			e.target = string(target)
+			e.size = int64(len(target))
+			e.open = nil
+		}
+
+		switch {
+		case e.mode.IsDir():
+			e.size = 0
+			e.open = nil
+
+		case e.mode&os.ModeType&^os.ModeSymlink != 0:
+			continue
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// Open the tar stream in the archive at the supplied path.
+func openTar(p string, gzipped bool) (*tar.Reader, io.Closer, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !gzipped {
+		return tar.NewReader(f), f, nil
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("gzip.NewReader: %v", err)
+	}
+
+	return tar.NewReader(gz), f, nil
+}
+
+func readTar(p string, gzipped bool) ([]entry, error) {
+	tr, closer, err := openTar(p, gzipped)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closer.Close()
+
+	var entries []entry
+	for i := 0; ; i++ {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Next: %v", err)
+		}
+
+		e := entry{
+			mode:  h.FileInfo().Mode(),
+			size:  h.Size,
+			mtime: h.ModTime,
+			uid:   uint32(h.Uid),
+			gid:   uint32(h.Gid),
+		}
+
+		var ok bool
+		if e.name, ok = cleanName(h.Name); !ok {
+			continue
+		}
+
+		switch h.Typeflag {
+		case tar.TypeReg:
+			e.open = tarOpener(p, gzipped, i)
+
+		case tar.TypeDir:
+			e.size = 0
+
+		case tar.TypeSymlink:
+			e.target = h.Linkname
+			e.size = int64(len(h.Linkname))
+
+		case tar.TypeLink:
+			if e.link, ok = cleanName(h.Linkname); !ok {
+				continue
+			}
+
+		default:
+			// Devices, FIFOs and so on have no business in a read-only archive.
+			continue
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// Return a function that decompresses the contents of the i'th header in the
+// tar stream. A tar stream can't be read out of order, so this starts again
+// from the beginning.
+func tarOpener(p string, gzipped bool, i int) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		tr, closer, err := openTar(p, gzipped)
+		if err != nil {
+			return nil, err
+		}
+
+		for j := 0; j <= i; j++ {
+			if _, err := tr.Next(); err != nil {
+				closer.Close()
+				return nil, fmt.Errorf("Next: %v", err)
+			}
+		}
+
+		return struct {
+			io.Reader
+			io.Closer
+		}{tr, closer}, nil
+	}
+}
+
+func readAll(open func() (io.ReadCloser, error)) ([]byte, error) {
+	rc, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
@@ -0,0 +1,487 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package archivefs contains a read-only file system that serves the contents
+// of a zip or tar archive.
+package archivefs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+type inode struct {
+	attrs fuseops.InodeAttributes
+
+	// For directories, the children in archive order, and their IDs by name.
+	//
+	// INVARIANT: For each i, entries[i].Offset == i+1
+	entries  []fuseutil.Dirent
+	children map[string]fuseops.InodeID
+
+	// For symlinks, the target.
+	target string
+
+	// For files, a function that decompresses the contents.
+	open func() (io.ReadCloser, error)
+
+	mu sync.Mutex
+
+	// The number of open handles for the file.
+	openCount int // GUARDED_BY(mu)
+
+	// The decompressed contents of the file, while it is open.
+	//
+	// INVARIANT: contents != nil iff openCount > 0
+	contents []byte // GUARDED_BY(mu)
+}
+
+type archiveFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	// The inodes, indexed by ID. Those for entries of the archive have IDs
+	// following the root in archive order, so that they are the same each time
+	// the archive is mounted; directories that the archive doesn't list
+	// explicitly come after. Entries that are overridden by later ones with the
+	// same name, and hard links, leave nil gaps.
+	//
+	// The tree is built up front and never changes.
+	inodes []*inode
+
+	// The total size of the files in the archive.
+	totalSize uint64
+
+	mu sync.Mutex
+
+	// The inode of each open file handle.
+	handles    map[fuseops.HandleID]fuseops.InodeID // GUARDED_BY(mu)
+	nextHandle fuseops.HandleID                     // GUARDED_BY(mu)
+}
+
+// NewArchiveFS creates a read-only file system that serves the contents of
+// the archive at the supplied path, which must end in .zip, .tar, .tar.gz or
+// .tgz. Only the index of the archive is read up front. A file's contents are
+// decompressed into memory when it's first opened and dropped when it's last
+// closed; since tar files can't be read out of order, opening one of their
+// files reads the archive up to that file.
+//
+// The archive must not change while mounted, and the file system should be
+// mounted with MountConfig.ReadOnly set.
+func NewArchiveFS(archive string) (fuse.Server, error) {
+	entries, err := readArchive(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(archive)
+	if err != nil {
+		return nil, fmt.Errorf("Stat: %v", err)
+	}
+
+	fs := &archiveFS{
+		inodes:  make([]*inode, fuseops.RootInodeID+1+len(entries)),
+		handles: make(map[fuseops.HandleID]fuseops.InodeID),
+	}
+
+	// Directories that the archive doesn't list get the attributes of the
+	// archive itself.
+	dirAttrs := fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0555 | os.ModeDir,
+		Atime: fi.ModTime(),
+		Mtime: fi.ModTime(),
+		Ctime: fi.ModTime(),
+		Uid:   uint32(os.Getuid()),
+		Gid:   uint32(os.Getgid()),
+	}
+
+	fs.inodes[fuseops.RootInodeID] = newDir(dirAttrs)
+
+	ids := map[string]fuseops.InodeID{"": fuseops.RootInodeID}
+	for i, e := range entries {
+		fs.add(ids, fuseops.RootInodeID+1+fuseops.InodeID(i), e, dirAttrs)
+	}
+
+	return fuseutil.NewFileSystemServer(fs), nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func newDir(attrs fuseops.InodeAttributes) *inode {
+	return &inode{
+		attrs:    attrs,
+		children: make(map[string]fuseops.InodeID),
+	}
+}
+
+func (in *inode) isDir() bool {
+	return in.attrs.Mode&os.ModeDir != 0
+}
+
+func direntType(m os.FileMode) fuseutil.DirentType {
+	switch {
+	case m&os.ModeDir != 0:
+		return fuseutil.DT_Directory
+
+	case m&os.ModeSymlink != 0:
+		return fuseutil.DT_Link
+	}
+
+	return fuseutil.DT_File
+}
+
+// Add a child to the directory, replacing any existing child with the same
+// name.
+func (in *inode) addChild(id fuseops.InodeID, name string, t fuseutil.DirentType) {
+	if _, ok := in.children[name]; ok {
+		for i := range in.entries {
+			if in.entries[i].Name == name {
+				in.entries[i].Inode = id
+				in.entries[i].Type = t
+			}
+		}
+	} else {
+		in.entries = append(in.entries, fuseutil.Dirent{
+			Offset: fuseops.DirOffset(len(in.entries) + 1),
+			Inode:  id,
+			Name:   name,
+			Type:   t,
+		})
+	}
+
+	in.children[name] = id
+}
+
+// Return the name of the directory containing the supplied entry, with the
+// root being "".
+func parentName(name string) string {
+	dir := path.Dir(name)
+	if dir == "." {
+		return ""
+	}
+
+	return dir
+}
+
+// Return the ID of the directory with the supplied name, creating it and its
+// parents if the archive hasn't listed them.
+func (fs *archiveFS) mkdirAll(
+	ids map[string]fuseops.InodeID,
+	name string,
+	attrs fuseops.InodeAttributes) (fuseops.InodeID, bool) {
+	if id, ok := ids[name]; ok {
+		return id, fs.inodes[id].isDir()
+	}
+
+	parent, ok := fs.mkdirAll(ids, parentName(name), attrs)
+	if !ok {
+		return 0, false
+	}
+
+	id := fuseops.InodeID(len(fs.inodes))
+	fs.inodes = append(fs.inodes, newDir(attrs))
+	fs.inodes[parent].addChild(id, path.Base(name), fuseutil.DT_Directory)
+	ids[name] = id
+
+	return id, true
+}
+
+// Add the archive entry with the supplied ID. An entry whose name was seen
+// earlier replaces the earlier one, except that directories are never
+// replaced, only given new attributes. Entries beneath something other than
+// a directory are dropped.
+func (fs *archiveFS) add(
+	ids map[string]fuseops.InodeID,
+	id fuseops.InodeID,
+	e entry,
+	dirAttrs fuseops.InodeAttributes) {
+	parent, ok := fs.mkdirAll(ids, parentName(e.name), dirAttrs)
+	if !ok {
+		return
+	}
+
+	attrs := fuseops.InodeAttributes{
+		Size:  uint64(e.size),
+		Nlink: 1,
+		Mode:  e.mode &^ (os.ModePerm &^ 0555),
+		Atime: e.mtime,
+		Mtime: e.mtime,
+		Ctime: e.mtime,
+		Uid:   e.uid,
+		Gid:   e.gid,
+	}
+
+	// Hard links share the inode of the entry that they link to.
+	if e.link != "" {
+		target, ok := ids[e.link]
+		if !ok || fs.inodes[target].isDir() || e.link == e.name {
+			return
+		}
+
+		id = target
+		attrs = fs.inodes[id].attrs
+	}
+
+	if existing, ok := ids[e.name]; ok {
+		old := fs.inodes[existing]
+		if old.isDir() {
+			if attrs.Mode.IsDir() {
+				old.attrs = attrs
+			}
+
+			return
+		}
+
+		fs.unlink(existing)
+	}
+
+	switch {
+	case e.link != "":
+		fs.inodes[id].attrs.Nlink++
+
+	case attrs.Mode.IsDir():
+		fs.inodes[id] = newDir(attrs)
+
+	default:
+		fs.inodes[id] = &inode{
+			attrs:  attrs,
+			target: e.target,
+			open:   e.open,
+		}
+
+		if attrs.Mode.IsRegular() {
+			fs.totalSize += attrs.Size
+		}
+	}
+
+	fs.inodes[parent].addChild(id, path.Base(e.name), direntType(attrs.Mode))
+	ids[e.name] = id
+}
+
+// Drop a link to a non-directory inode that's been replaced by a later entry.
+func (fs *archiveFS) unlink(id fuseops.InodeID) {
+	in := fs.inodes[id]
+	in.attrs.Nlink--
+	if in.attrs.Nlink != 0 {
+		return
+	}
+
+	if in.attrs.Mode.IsRegular() {
+		fs.totalSize -= in.attrs.Size
+	}
+
+	fs.inodes[id] = nil
+}
+
+func (fs *archiveFS) getInodeOrDie(id fuseops.InodeID) *inode {
+	if int(id) >= len(fs.inodes) || fs.inodes[id] == nil {
+		panic(fmt.Sprintf("Unknown inode: %v", id))
+	}
+
+	return fs.inodes[id]
+}
+
+// The tree never changes, so the kernel may cache everything for as long as it
+// likes.
+func expiration() time.Time {
+	return time.Now().Add(365 * 24 * time.Hour)
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *archiveFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	const blockSize = 4096
+
+	op.BlockSize = blockSize
+	op.Blocks = (fs.totalSize + blockSize - 1) / blockSize
+	op.Inodes = uint64(len(fs.inodes))
+
+	return nil
+}
+
+func (fs *archiveFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	parent := fs.getInodeOrDie(op.Parent)
+	id, ok := parent.children[op.Name]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = id
+	op.Entry.Attributes = fs.getInodeOrDie(id).attrs
+	op.Entry.AttributesExpiration = expiration()
+	op.Entry.EntryExpiration = op.Entry.AttributesExpiration
+
+	return nil
+}
+
+func (fs *archiveFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fs.getInodeOrDie(op.Inode).attrs
+	op.AttributesExpiration = expiration()
+
+	return nil
+}
+
+func (fs *archiveFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	// Inodes live as long as the file system.
+	return nil
+}
+
+func (fs *archiveFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	return nil
+}
+
+func (fs *archiveFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	if !fs.getInodeOrDie(op.Inode).isDir() {
+		return fuse.ENOTDIR
+	}
+
+	op.CacheDir = true
+	op.KeepCache = true
+
+	return nil
+}
+
+func (fs *archiveFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	entries := fs.getInodeOrDie(op.Inode).entries
+	if op.Offset > fuseops.DirOffset(len(entries)) {
+		return nil
+	}
+
+	for _, e := range entries[op.Offset:] {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *archiveFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+func (fs *archiveFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	in := fs.getInodeOrDie(op.Inode)
+	if in.open == nil {
+		return fuse.EIO
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	// Decompress the contents if nobody else has.
+	if in.openCount == 0 {
+		contents, err := readAll(in.open)
+		if err != nil {
+			return fmt.Errorf("Decompressing: %v", err)
+		}
+
+		in.contents = contents
+	}
+
+	in.openCount++
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.nextHandle++
+	op.Handle = fs.nextHandle
+	fs.handles[op.Handle] = op.Inode
+
+	op.KeepPageCache = true
+
+	return nil
+}
+
+func (fs *archiveFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	in := fs.getInodeOrDie(op.Inode)
+
+	in.mu.Lock()
+	contents := in.contents
+	in.mu.Unlock()
+
+	if op.Offset < int64(len(contents)) {
+		op.BytesRead = copy(op.Dst, contents[op.Offset:])
+	}
+
+	return nil
+}
+
+func (fs *archiveFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	id, ok := fs.handles[op.Handle]
+	delete(fs.handles, op.Handle)
+	fs.mu.Unlock()
+
+	if !ok {
+		panic(fmt.Sprintf("Unknown handle: %v", op.Handle))
+	}
+
+	in := fs.getInodeOrDie(id)
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.openCount--
+	if in.openCount == 0 {
+		in.contents = nil
+	}
+
+	return nil
+}
+
+func (fs *archiveFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	op.Target = fs.getInodeOrDie(op.Inode).target
+	return nil
+}
@@ -0,0 +1,271 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archivefs_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/samples"
+	"github.com/jacobsa/fuse/samples/archivefs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestArchiveFS(t *testing.T) { RunTests(t) }
+
+// The contents of the archives used by the tests.
+var mtime = time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+
+var archiveFiles = []struct {
+	name     string
+	contents string
+}{
+	{"foo", "taco"},
+	{"dir/bar", "burrito"},
+	{"dir/sub/baz", ""},
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Common tests, run against each kind of archive. Embedders set up the
+// archive and then call setUp.
+type archiveFSTest struct {
+	samples.SampleTest
+	archiveDir string
+}
+
+func (t *archiveFSTest) setUp(ti *TestInfo, write func(p string) error, ext string) {
+	var err error
+
+	t.archiveDir, err = ioutil.TempDir("", "archivefs_test")
+	AssertEq(nil, err)
+
+	p := path.Join(t.archiveDir, "archive"+ext)
+	err = write(p)
+	AssertEq(nil, err)
+
+	t.Server, err = archivefs.NewArchiveFS(p)
+	AssertEq(nil, err)
+
+	t.MountConfig.ReadOnly = true
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *archiveFSTest) TearDown() {
+	t.SampleTest.TearDown()
+
+	err := os.RemoveAll(t.archiveDir)
+	AssertEq(nil, err)
+}
+
+type ZipTest struct {
+	archiveFSTest
+}
+
+func init() { RegisterTestSuite(&ZipTest{}) }
+
+func (t *ZipTest) SetUp(ti *TestInfo) {
+	t.setUp(ti, writeZip, ".zip")
+}
+
+func writeZip(p string) error {
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	// Leave the directories implicit.
+	w := zip.NewWriter(f)
+	for _, file := range archiveFiles {
+		h := &zip.FileHeader{
+			Name:     file.name,
+			Method:   zip.Deflate,
+			Modified: mtime,
+		}
+
+		h.SetMode(0644)
+		fw, err := w.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+
+		if _, err := fw.Write([]byte(file.contents)); err != nil {
+			return err
+		}
+	}
+
+	h := &zip.FileHeader{Name: "link", Modified: mtime}
+	h.SetMode(0777 | os.ModeSymlink)
+	fw, err := w.CreateHeader(h)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fw.Write([]byte("foo")); err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+type TarGzTest struct {
+	archiveFSTest
+}
+
+func init() { RegisterTestSuite(&TarGzTest{}) }
+
+func (t *TarGzTest) SetUp(ti *TestInfo) {
+	t.setUp(ti, writeTarGz, ".tar.gz")
+}
+
+func writeTarGz(p string) error {
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	w := tar.NewWriter(gz)
+
+	err = w.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     "dir/",
+		Mode:     0755,
+		ModTime:  mtime,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, file := range archiveFiles {
+		err := w.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     file.name,
+			Mode:     0644,
+			Size:     int64(len(file.contents)),
+			ModTime:  mtime,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.Write([]byte(file.contents)); err != nil {
+			return err
+		}
+	}
+
+	err = w.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     "link",
+		Linkname: "foo",
+		Mode:     0777,
+		ModTime:  mtime,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *archiveFSTest) ReadFiles() {
+	for _, file := range archiveFiles {
+		contents, err := ioutil.ReadFile(path.Join(t.Dir, file.name))
+		AssertEq(nil, err, "%s", file.name)
+		ExpectEq(file.contents, string(contents), "%s", file.name)
+	}
+}
+
+func (t *archiveFSTest) ListDirectories() {
+	entries, err := ioutil.ReadDir(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(3, len(entries))
+
+	ExpectEq("dir", entries[0].Name())
+	ExpectTrue(entries[0].IsDir())
+
+	ExpectEq("foo", entries[1].Name())
+	ExpectEq(4, entries[1].Size())
+	ExpectEq(0444, entries[1].Mode())
+	ExpectThat(entries[1].ModTime(), timeutil.TimeEq(mtime))
+
+	ExpectEq("link", entries[2].Name())
+	ExpectEq(os.ModeSymlink, entries[2].Mode()&os.ModeType)
+
+	entries, err = ioutil.ReadDir(path.Join(t.Dir, "dir"))
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+	ExpectEq("bar", entries[0].Name())
+	ExpectEq("sub", entries[1].Name())
+}
+
+func (t *archiveFSTest) ReadSymlink() {
+	target, err := os.Readlink(path.Join(t.Dir, "link"))
+	AssertEq(nil, err)
+	ExpectEq("foo", target)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "link"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *archiveFSTest) NonExistent() {
+	_, err := os.Stat(path.Join(t.Dir, "dir", "taco"))
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+}
+
+func (t *archiveFSTest) ReadOnly() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("enchilada"), 0644)
+	ExpectThat(err, Error(HasSubstr("read-only")))
+
+	err = os.Mkdir(path.Join(t.Dir, "new"), 0755)
+	ExpectThat(err, Error(HasSubstr("read-only")))
+}
+
+func (t *archiveFSTest) StatFS() {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(t.Dir, &stat)
+	AssertEq(nil, err)
+
+	// The files fit in a single block between them.
+	ExpectEq(1, stat.Blocks)
+	ExpectEq(0, stat.Bfree)
+}
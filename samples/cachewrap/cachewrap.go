@@ -0,0 +1,904 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cachewrap contains a file system that puts a fast local cache of
+// file contents in front of a slow origin file system, as a template for
+// file systems backed by remote storage.
+package cachewrap
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// The size of the reads and writes sent to the origin.
+const transferSize = 1 << 20
+
+// Config configures Wrap.
+type Config struct {
+	// The directory in which to keep the cached contents of files. If empty,
+	// they are kept in memory.
+	CacheDir string
+
+	// The maximum total size in bytes of the cached contents of files that are
+	// neither open nor dirty, beyond which the least recently closed are
+	// dropped. Zero means no limit.
+	Capacity int64
+}
+
+// Wrap returns a file system that serves the namespace and attributes of
+// origin, but caches the contents of its files:
+//
+//   - The first read of a file copies the whole of it from origin into the
+//     cache, and reads are then served from the cache.
+//   - Writes go only to the cache, and are written back to origin when the
+//     file is flushed, which happens on each close, or synced.
+//   - Cached contents are dropped, along with the kernel's page cache for the
+//     file, when origin reports a size or modification time for the file other
+//     than the one it had when it was cached or last written back. Contents
+//     with writes not yet written back are kept, and their size is reported in
+//     place of origin's.
+//
+// Cached contents are also dropped when the kernel forgets the inode. Writes
+// that could not be written back by then are lost, though the error will have
+// been returned by close(2).
+func Wrap(origin fuseutil.FileSystem, cfg Config) (fuseutil.FileSystem, error) {
+	if cfg.CacheDir != "" {
+		fi, err := os.Stat(cfg.CacheDir)
+		if err != nil {
+			return nil, fmt.Errorf("Stat: %v", err)
+		}
+
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", cfg.CacheDir)
+		}
+	}
+
+	fs := &cacheFS{
+		FileSystem: origin,
+		cfg:        cfg,
+		entries:    make(map[fuseops.InodeID]*entry),
+		handles:    make(map[fuseops.HandleID]*handle),
+	}
+
+	return fs, nil
+}
+
+type cacheFS struct {
+	// The origin. Ops that don't involve file contents pass straight through.
+	fuseutil.FileSystem
+
+	cfg Config
+
+	mu sync.Mutex
+
+	// The cache entries of files that are open or have cached contents.
+	//
+	// GUARDED_BY(mu)
+	entries map[fuseops.InodeID]*entry
+
+	// The files that are open, by the handles that origin gave them.
+	//
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID]*handle
+
+	// Entries that may be evicted, most recently closed first, and the total
+	// size of their contents when they were closed.
+	//
+	// GUARDED_BY(mu)
+	lru       list.List
+	lruCached int64
+
+	// Whether the kernel caches writes, in which case it decides the offsets of
+	// appending writes itself.
+	//
+	// GUARDED_BY(mu)
+	writebackCache bool
+}
+
+type entry struct {
+	// The number of open handles. An entry is in the LRU list when this is
+	// zero and its contents are clean.
+	//
+	// GUARDED_BY(cacheFS.mu)
+	opens   int
+	lruElem *list.Element // GUARDED_BY(cacheFS.mu)
+	lruSize int64         // GUARDED_BY(cacheFS.mu)
+
+	// Held while filling the cache from origin and writing back to it, as well
+	// as for access to the contents.
+	mu sync.Mutex
+
+	// The cached contents, or nil if the file hasn't been read since it was
+	// opened or last invalidated.
+	//
+	// GUARDED_BY(mu)
+	c    contents
+	size int64 // GUARDED_BY(mu)
+
+	// The size and modification time that origin reported when the contents
+	// were cached or last written back.
+	//
+	// GUARDED_BY(mu)
+	originSize  uint64
+	originMtime time.Time
+
+	// The range of the contents that has been written since they were last
+	// written back, if dirty is set, and the time of the last write.
+	//
+	// GUARDED_BY(mu)
+	dirty      bool
+	dirtyStart int64
+	dirtyEnd   int64
+	mtime      time.Time
+}
+
+type handle struct {
+	inode fuseops.InodeID
+	e     *entry
+
+	// Whether the file was opened for writing, and so can write back.
+	writable bool
+
+	// Whether the file was opened with O_APPEND.
+	append bool
+}
+
+// Return the flags with which to open a file in origin, and whether the
+// handle is writable and appending. Origin must be able to read through any
+// handle to fill the cache, and writes back at explicit offsets.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cacheFS) originFlags(
+	flags fusekernel.OpenFlags) (f fusekernel.OpenFlags, writable, append bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	writable = !flags.IsReadOnly()
+	append = flags&fusekernel.OpenAppend != 0 && !fs.writebackCache
+
+	f = flags &^ fusekernel.OpenAppend
+	if flags.IsWriteOnly() {
+		f = f&^fusekernel.OpenAccessModeMask | fusekernel.OpenReadWrite
+	}
+
+	return
+}
+
+// Record a newly opened handle, returning the entry for its file.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cacheFS) open(
+	h fuseops.HandleID,
+	inode fuseops.InodeID,
+	writable bool,
+	append bool) *entry {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	e := fs.entries[inode]
+	if e == nil {
+		e = &entry{}
+		fs.entries[inode] = e
+	}
+
+	e.opens++
+	if e.lruElem != nil {
+		fs.lru.Remove(e.lruElem)
+		fs.lruCached -= e.lruSize
+		e.lruElem = nil
+	}
+
+	fs.handles[h] = &handle{
+		inode:    inode,
+		e:        e,
+		writable: writable,
+		append:   append,
+	}
+
+	return e
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cacheFS) getHandle(h fuseops.HandleID) (*handle, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	hd, ok := fs.handles[h]
+	if !ok {
+		return nil, fmt.Errorf("Unknown handle: %d", h)
+	}
+
+	return hd, nil
+}
+
+// Return the entry for the supplied inode, or nil if there is none.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cacheFS) getEntry(inode fuseops.InodeID) *entry {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.entries[inode]
+}
+
+// Forget a handle, making its file's cached contents eligible for eviction if
+// it was the last one.
+//
+// LOCKS_EXCLUDED(fs.mu, hd.e.mu)
+func (fs *cacheFS) close(h fuseops.HandleID, hd *handle) {
+	e := hd.e
+
+	e.mu.Lock()
+	clean := e.c != nil && !e.dirty
+	size := e.size
+	e.mu.Unlock()
+
+	fs.mu.Lock()
+	delete(fs.handles, h)
+	e.opens--
+	if e.opens > 0 || !clean {
+		fs.mu.Unlock()
+		return
+	}
+
+	e.lruElem = fs.lru.PushFront(hd.inode)
+	e.lruSize = size
+	fs.lruCached += size
+
+	var victims []*entry
+	for fs.cfg.Capacity > 0 && fs.lruCached > fs.cfg.Capacity {
+		back := fs.lru.Back()
+		inode := back.Value.(fuseops.InodeID)
+		victim := fs.entries[inode]
+
+		fs.lru.Remove(back)
+		fs.lruCached -= victim.lruSize
+		victim.lruElem = nil
+		delete(fs.entries, inode)
+		victims = append(victims, victim)
+	}
+
+	fs.mu.Unlock()
+
+	for _, v := range victims {
+		v.mu.Lock()
+		v.drop()
+		v.mu.Unlock()
+	}
+}
+
+// Forget the cached contents of the supplied inode, if any.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cacheFS) forget(inode fuseops.InodeID) {
+	fs.mu.Lock()
+	e := fs.entries[inode]
+	if e == nil || e.opens > 0 {
+		fs.mu.Unlock()
+		return
+	}
+
+	if e.lruElem != nil {
+		fs.lru.Remove(e.lruElem)
+		fs.lruCached -= e.lruSize
+		e.lruElem = nil
+	}
+
+	delete(fs.entries, inode)
+	fs.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.drop()
+}
+
+// Drop the cached contents.
+//
+// LOCKS_REQUIRED(e.mu)
+func (e *entry) drop() {
+	if e.c != nil {
+		e.c.Close()
+	}
+
+	e.c = nil
+	e.dirty = false
+}
+
+// Record the attributes that origin now reports for the file.
+//
+// LOCKS_REQUIRED(e.mu)
+func (e *entry) setOriginAttrs(attrs *fuseops.InodeAttributes) {
+	e.originSize = attrs.Size
+	e.originMtime = attrs.Mtime
+}
+
+// Check attributes returned by origin against the cached contents of the
+// inode, dropping them if the file has changed and otherwise adjusting the
+// attributes to account for writes not yet written back.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cacheFS) invalidate(
+	inode fuseops.InodeID,
+	attrs *fuseops.InodeAttributes) {
+	e := fs.getEntry(inode)
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch {
+	case e.c == nil:
+
+	case e.dirty:
+		attrs.Size = uint64(e.size)
+		attrs.Mtime = e.mtime
+
+	case attrs.Size != e.originSize || !attrs.Mtime.Equal(e.originMtime):
+		e.drop()
+	}
+}
+
+// Fetch the attributes of the file from origin, and check them against the
+// cached contents.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cacheFS) revalidate(
+	ctx context.Context,
+	inode fuseops.InodeID,
+	opCtx fuseops.OpContext) error {
+	op := &fuseops.GetInodeAttributesOp{
+		Inode:     inode,
+		OpContext: opCtx,
+	}
+
+	if err := fs.FileSystem.GetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	fs.invalidate(inode, &op.Attributes)
+	return nil
+}
+
+// Make sure that the contents of the file are cached, reading them from
+// origin through the supplied handle if not.
+//
+// LOCKS_REQUIRED(e.mu)
+func (fs *cacheFS) fill(
+	ctx context.Context,
+	e *entry,
+	inode fuseops.InodeID,
+	h fuseops.HandleID,
+	opCtx fuseops.OpContext) error {
+	if e.c != nil {
+		return nil
+	}
+
+	// Note the attributes before reading, so that a change made meanwhile is
+	// noticed next time.
+	attrsOp := &fuseops.GetInodeAttributesOp{
+		Inode:     inode,
+		OpContext: opCtx,
+	}
+
+	if err := fs.FileSystem.GetInodeAttributes(ctx, attrsOp); err != nil {
+		return err
+	}
+
+	c, err := newContents(fs.cfg.CacheDir)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, transferSize)
+	var size int64
+	for {
+		op := &fuseops.ReadFileOp{
+			Inode:     inode,
+			Handle:    h,
+			Offset:    size,
+			Size:      int64(len(buf)),
+			Dst:       buf,
+			OpContext: opCtx,
+		}
+
+		if err := fs.FileSystem.ReadFile(ctx, op); err != nil {
+			c.Close()
+			return err
+		}
+
+		if op.BytesRead == 0 {
+			break
+		}
+
+		data := op.Data
+		if data == nil {
+			data = [][]byte{buf}
+		}
+
+		remaining := op.BytesRead
+		for _, d := range data {
+			if len(d) > remaining {
+				d = d[:remaining]
+			}
+
+			if _, err := c.WriteAt(d, size); err != nil {
+				c.Close()
+				return fmt.Errorf("WriteAt: %v", err)
+			}
+
+			size += int64(len(d))
+			remaining -= len(d)
+		}
+
+		if op.Callback != nil {
+			op.Callback()
+		}
+	}
+
+	e.c = c
+	e.size = size
+	e.setOriginAttrs(&attrsOp.Attributes)
+
+	return nil
+}
+
+// Write any dirty contents back to origin through the supplied handle.
+//
+// LOCKS_REQUIRED(hd.e.mu)
+func (fs *cacheFS) writeBack(
+	ctx context.Context,
+	h fuseops.HandleID,
+	hd *handle,
+	opCtx fuseops.OpContext) error {
+	e := hd.e
+	if !e.dirty || !hd.writable {
+		return nil
+	}
+
+	// Write the dirty range.
+	buf := make([]byte, transferSize)
+	end := e.dirtyEnd
+	if end > e.size {
+		end = e.size
+	}
+
+	for off := e.dirtyStart; off < end; {
+		n := end - off
+		if n > transferSize {
+			n = transferSize
+		}
+
+		if _, err := e.c.ReadAt(buf[:n], off); err != nil && err != io.EOF {
+			return fmt.Errorf("ReadAt: %v", err)
+		}
+
+		op := &fuseops.WriteFileOp{
+			Inode:     hd.inode,
+			Handle:    h,
+			Offset:    off,
+			Data:      buf[:n],
+			OpContext: opCtx,
+		}
+
+		if err := fs.FileSystem.WriteFile(ctx, op); err != nil {
+			return err
+		}
+
+		off += n
+	}
+
+	// Fix up the size, if origin's differs, and note the result.
+	attrsOp := &fuseops.GetInodeAttributesOp{
+		Inode:     hd.inode,
+		OpContext: opCtx,
+	}
+
+	if err := fs.FileSystem.GetInodeAttributes(ctx, attrsOp); err != nil {
+		return err
+	}
+
+	if attrsOp.Attributes.Size != uint64(e.size) {
+		size := uint64(e.size)
+		op := &fuseops.SetInodeAttributesOp{
+			Inode:     hd.inode,
+			Handle:    &h,
+			Size:      &size,
+			OpContext: opCtx,
+		}
+
+		if err := fs.FileSystem.SetInodeAttributes(ctx, op); err != nil {
+			return err
+		}
+
+		attrsOp.Attributes = op.Attributes
+	}
+
+	e.setOriginAttrs(&attrsOp.Attributes)
+	e.dirty = false
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *cacheFS) Init(op *fuseops.InitOp) {
+	fs.mu.Lock()
+	fs.writebackCache = op.Flags&fusekernel.InitWritebackCache != 0
+	fs.mu.Unlock()
+
+	fs.FileSystem.Init(op)
+}
+
+func (fs *cacheFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if err := fs.FileSystem.LookUpInode(ctx, op); err != nil {
+		return err
+	}
+
+	fs.invalidate(op.Entry.Child, &op.Entry.Attributes)
+	return nil
+}
+
+func (fs *cacheFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if err := fs.FileSystem.GetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	fs.invalidate(op.Inode, &op.Attributes)
+	return nil
+}
+
+func (fs *cacheFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	e := fs.getEntry(op.Inode)
+	if e == nil {
+		return fs.FileSystem.SetInodeAttributes(ctx, op)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := fs.FileSystem.SetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	if e.c == nil {
+		return nil
+	}
+
+	if op.Size != nil {
+		size := int64(*op.Size)
+		if err := e.c.Truncate(size); err != nil {
+			e.drop()
+			return fmt.Errorf("Truncate: %v", err)
+		}
+
+		e.size = size
+	}
+
+	// The change was ours, so the contents remain valid.
+	e.setOriginAttrs(&op.Attributes)
+	if e.dirty {
+		op.Attributes.Size = uint64(e.size)
+		op.Attributes.Mtime = e.mtime
+	}
+
+	return nil
+}
+
+func (fs *cacheFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.forget(op.Inode)
+	return fs.FileSystem.ForgetInode(ctx, op)
+}
+
+func (fs *cacheFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	for _, e := range op.Entries {
+		fs.forget(e.Inode)
+	}
+
+	return fs.FileSystem.BatchForget(ctx, op)
+}
+
+func (fs *cacheFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	var writable, append bool
+	op.OpenFlags, writable, append = fs.originFlags(op.OpenFlags)
+	if err := fs.FileSystem.CreateFile(ctx, op); err != nil {
+		return err
+	}
+
+	fs.open(op.Handle, op.Entry.Child, writable, append)
+	return nil
+}
+
+func (fs *cacheFS) CreateTmpFile(
+	ctx context.Context,
+	op *fuseops.CreateTmpFileOp) error {
+	var writable, append bool
+	op.OpenFlags, writable, append = fs.originFlags(op.OpenFlags)
+	if err := fs.FileSystem.CreateTmpFile(ctx, op); err != nil {
+		return err
+	}
+
+	fs.open(op.Handle, op.Entry.Child, writable, append)
+	return nil
+}
+
+func (fs *cacheFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	if err := fs.FileSystem.CreateLink(ctx, op); err != nil {
+		return err
+	}
+
+	fs.invalidate(op.Entry.Child, &op.Entry.Attributes)
+	return nil
+}
+
+func (fs *cacheFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	flags := op.OpenFlags
+	var writable, append bool
+	op.OpenFlags, writable, append = fs.originFlags(flags)
+	if err := fs.FileSystem.OpenFile(ctx, op); err != nil {
+		return err
+	}
+
+	e := fs.open(op.Handle, op.Inode, writable, append)
+
+	// Origin has truncated the file.
+	if flags&fusekernel.OpenTruncate != 0 {
+		e.mu.Lock()
+		e.drop()
+		e.mu.Unlock()
+	}
+
+	// Let the kernel keep the pages it has cached, unless the file has changed.
+	if err := fs.revalidate(ctx, op.Inode, op.OpContext); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	op.KeepPageCache = e.c != nil
+	e.mu.Unlock()
+
+	return nil
+}
+
+func (fs *cacheFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	hd, err := fs.getHandle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	e := hd.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := fs.fill(ctx, e, op.Inode, op.Handle, op.OpContext); err != nil {
+		return err
+	}
+
+	dst := op.Dst
+	if dst == nil {
+		dst = make([]byte, op.Size)
+		op.Data = [][]byte{dst}
+	}
+
+	// Reads past the end are short, which is how the kernel learns of EOF.
+	if op.Offset >= e.size {
+		return nil
+	}
+
+	if n := e.size - op.Offset; int64(len(dst)) > n {
+		dst = dst[:n]
+	}
+
+	op.BytesRead, err = e.c.ReadAt(dst, op.Offset)
+	if err == io.EOF {
+		err = nil
+	}
+
+	return err
+}
+
+func (fs *cacheFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	hd, err := fs.getHandle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	e := hd.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := fs.fill(ctx, e, op.Inode, op.Handle, op.OpContext); err != nil {
+		return err
+	}
+
+	off := op.Offset
+	if hd.append {
+		off = e.size
+	}
+
+	if _, err := e.c.WriteAt(op.Data, off); err != nil {
+		return fmt.Errorf("WriteAt: %v", err)
+	}
+
+	end := off + int64(len(op.Data))
+	if end > e.size {
+		e.size = end
+	}
+
+	if !e.dirty {
+		e.dirty = true
+		e.dirtyStart = off
+		e.dirtyEnd = end
+	}
+
+	if off < e.dirtyStart {
+		e.dirtyStart = off
+	}
+
+	if end > e.dirtyEnd {
+		e.dirtyEnd = end
+	}
+
+	e.mtime = time.Now()
+
+	return nil
+}
+
+func (fs *cacheFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	hd, err := fs.getHandle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	hd.e.mu.Lock()
+	err = fs.writeBack(ctx, op.Handle, hd, op.OpContext)
+	hd.e.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return fs.FileSystem.SyncFile(ctx, op)
+}
+
+func (fs *cacheFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	hd, err := fs.getHandle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	hd.e.mu.Lock()
+	err = fs.writeBack(ctx, op.Handle, hd, op.OpContext)
+	hd.e.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return fs.FileSystem.FlushFile(ctx, op)
+}
+
+func (fs *cacheFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	hd, err := fs.getHandle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	// The kernel flushes before releasing, but may have written since through
+	// a writable mapping.
+	hd.e.mu.Lock()
+	wbErr := fs.writeBack(ctx, op.Handle, hd, op.OpContext)
+	hd.e.mu.Unlock()
+
+	err = fs.FileSystem.ReleaseFileHandle(ctx, op)
+	fs.close(op.Handle, hd)
+
+	if wbErr != nil {
+		return wbErr
+	}
+
+	return err
+}
+
+func (fs *cacheFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	hd, err := fs.getHandle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	// Let origin do the work on up-to-date contents, then read them again.
+	hd.e.mu.Lock()
+	defer hd.e.mu.Unlock()
+
+	if err := fs.writeBack(ctx, op.Handle, hd, op.OpContext); err != nil {
+		return err
+	}
+
+	hd.e.drop()
+	return fs.FileSystem.Fallocate(ctx, op)
+}
+
+func (fs *cacheFS) ExchangeData(
+	ctx context.Context,
+	op *fuseops.ExchangeDataOp) error {
+	// Exchanging contents in origin behind the cache's back could leave it
+	// serving each file the other's contents. Apps that get ENOTSUP fall back
+	// to saving with rename(2) instead.
+	return syscall.ENOTSUP
+}
+
+func (fs *cacheFS) SyncFS(
+	ctx context.Context,
+	op *fuseops.SyncFSOp) error {
+	fs.mu.Lock()
+	handles := make(map[fuseops.HandleID]*handle, len(fs.handles))
+	for h, hd := range fs.handles {
+		handles[h] = hd
+	}
+	fs.mu.Unlock()
+
+	for h, hd := range handles {
+		hd.e.mu.Lock()
+		err := fs.writeBack(ctx, h, hd, op.OpContext)
+		hd.e.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return fs.FileSystem.SyncFS(ctx, op)
+}
@@ -0,0 +1,216 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cachewrap_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples"
+	"github.com/jacobsa/fuse/samples/cachewrap"
+	"github.com/jacobsa/fuse/samples/loopbackfs"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestCacheWrap(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// An origin that counts the reads that reach it.
+type countingFS struct {
+	fuseutil.FileSystem
+	reads int64
+}
+
+func (fs *countingFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	atomic.AddInt64(&fs.reads, 1)
+	return fs.FileSystem.ReadFile(ctx, op)
+}
+
+type CacheWrapTest struct {
+	samples.SampleTest
+
+	// The directory served by the origin, and where the cache is kept.
+	originDir string
+	cacheDir  string
+
+	origin *countingFS
+}
+
+func init() { RegisterTestSuite(&CacheWrapTest{}) }
+
+func (t *CacheWrapTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.originDir, err = ioutil.TempDir("", "cachewrap_origin")
+	AssertEq(nil, err)
+
+	t.cacheDir, err = ioutil.TempDir("", "cachewrap_cache")
+	AssertEq(nil, err)
+
+	lb, err := loopbackfs.NewLoopbackFileSystem(t.originDir)
+	AssertEq(nil, err)
+	t.origin = &countingFS{FileSystem: lb}
+
+	fs, err := cachewrap.Wrap(t.origin, cachewrap.Config{CacheDir: t.cacheDir})
+	AssertEq(nil, err)
+
+	t.Server = fuseutil.NewFileSystemServer(fs)
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *CacheWrapTest) TearDown() {
+	t.SampleTest.TearDown()
+
+	err := os.RemoveAll(t.originDir)
+	AssertEq(nil, err)
+
+	err = os.RemoveAll(t.cacheDir)
+	AssertEq(nil, err)
+}
+
+// Write a file in the origin, with a modification time that differs from any
+// that it has had before.
+func (t *CacheWrapTest) writeOrigin(name string, contents string) {
+	p := path.Join(t.originDir, name)
+	err := ioutil.WriteFile(p, []byte(contents), 0644)
+	AssertEq(nil, err)
+
+	mtime := time.Now().Add(time.Duration(len(contents)) * time.Hour)
+	err = os.Chtimes(p, mtime, mtime)
+	AssertEq(nil, err)
+}
+
+func (t *CacheWrapTest) readOrigin(name string) string {
+	contents, err := ioutil.ReadFile(path.Join(t.originDir, name))
+	AssertEq(nil, err)
+	return string(contents)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CacheWrapTest) ReadThrough() {
+	t.writeOrigin("foo", "taco")
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	reads := atomic.LoadInt64(&t.origin.reads)
+	ExpectGt(reads, 0)
+
+	// Later reads are served from the cache.
+	f, err := os.Open(path.Join(t.Dir, "foo"))
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	buf := make([]byte, 3)
+	n, err := f.ReadAt(buf, 1)
+	AssertEq(nil, err)
+	ExpectEq("aco", string(buf[:n]))
+	ExpectEq(reads, atomic.LoadInt64(&t.origin.reads))
+}
+
+func (t *CacheWrapTest) WriteBackOnSync() {
+	t.writeOrigin("foo", "taco")
+
+	f, err := os.OpenFile(path.Join(t.Dir, "foo"), os.O_WRONLY, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	_, err = f.WriteAt([]byte("burrito"), 2)
+	AssertEq(nil, err)
+
+	// The write hasn't reached the origin, but is visible through the mount.
+	ExpectEq("taco", t.readOrigin("foo"))
+
+	fi, err := os.Stat(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq(len("taburrito"), fi.Size())
+
+	err = f.Sync()
+	AssertEq(nil, err)
+	ExpectEq("taburrito", t.readOrigin("foo"))
+}
+
+func (t *CacheWrapTest) WriteBackOnClose() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0644)
+	AssertEq(nil, err)
+	ExpectEq("taco", t.readOrigin("foo"))
+
+	// Shrink the file.
+	err = ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("sal"), 0644)
+	AssertEq(nil, err)
+	ExpectEq("sal", t.readOrigin("foo"))
+}
+
+func (t *CacheWrapTest) Append() {
+	t.writeOrigin("foo", "taco")
+
+	f, err := os.OpenFile(path.Join(t.Dir, "foo"), os.O_WRONLY|os.O_APPEND, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	_, err = f.Write([]byte("burrito"))
+	AssertEq(nil, err)
+
+	err = f.Close()
+	t.ToClose = nil
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", t.readOrigin("foo"))
+}
+
+func (t *CacheWrapTest) Truncate() {
+	t.writeOrigin("foo", "taco")
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	err = os.Truncate(path.Join(t.Dir, "foo"), 2)
+	AssertEq(nil, err)
+	ExpectEq("ta", t.readOrigin("foo"))
+
+	contents, err = ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("ta", string(contents))
+}
+
+func (t *CacheWrapTest) ChangedInOrigin() {
+	t.writeOrigin("foo", "taco")
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	t.writeOrigin("foo", "enchilada")
+
+	contents, err = ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("enchilada", string(contents))
+}
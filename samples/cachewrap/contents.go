@@ -0,0 +1,97 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cachewrap
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// The cached contents of a file. Implemented by *os.File for caches on disk.
+type contents interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	Close() error
+}
+
+// Return empty contents, on disk if dir is non-empty and in memory otherwise.
+func newContents(dir string) (contents, error) {
+	if dir == "" {
+		return &memContents{}, nil
+	}
+
+	f, err := os.CreateTemp(dir, "cachewrap")
+	if err != nil {
+		return nil, fmt.Errorf("CreateTemp: %v", err)
+	}
+
+	// Nobody else needs to find the file, and this way it can't outlive us.
+	if err := os.Remove(f.Name()); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Remove: %v", err)
+	}
+
+	return f, nil
+}
+
+type memContents struct {
+	b []byte
+}
+
+func (m *memContents) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.b)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, m.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (m *memContents) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(m.b)) {
+		m.Truncate(end)
+	}
+
+	return copy(m.b[off:], p), nil
+}
+
+func (m *memContents) Truncate(size int64) error {
+	if size <= int64(cap(m.b)) {
+		old := len(m.b)
+		m.b = m.b[:size]
+		if size > int64(old) {
+			clear(m.b[old:])
+		}
+
+		return nil
+	}
+
+	b := make([]byte, size, 2*size)
+	copy(b, m.b)
+	m.b = b
+
+	return nil
+}
+
+func (m *memContents) Close() error {
+	m.b = nil
+	return nil
+}
@@ -0,0 +1,1320 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cryptfs contains a file system that stores its files encrypted in a
+// directory of the host file system.
+//
+// File contents are split into blocks of 4 KiB, each sealed separately with
+// AES-GCM, so that any part of a file can be read or written without
+// touching the rest. A read decrypts the blocks that it covers; a write that
+// covers only part of a block must read, decrypt and re-encrypt the whole of
+// it. Since each block carries a nonce and a tag, the sizes of backing files
+// differ from those that the kernel sees, and are converted in both
+// directions.
+//
+// File names are encrypted too, deterministically so that they can be looked
+// up, with an IV stored in each backing directory so that equal names in
+// different directories look different. Symlink targets are encrypted;
+// ownership, permissions, times and the shape of the tree are not.
+//
+// Each backing directory's IV is made durable before the directory is used,
+// since without it the names within can't be decrypted. A file's header is
+// written before the blocks that depend on it, in the same file, so one fsync
+// makes both durable.
+package cryptfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/fuse/samples/internal/hostfs"
+	"golang.org/x/sys/unix"
+)
+
+// The name of the file holding each backing directory's IV. Encrypted names
+// never contain dots, so it can't collide with one.
+const dirIVName = "cryptfs.diriv"
+
+// Identifies a file in the host file system.
+type fileKey struct {
+	dev uint64
+	ino uint64
+}
+
+type inode struct {
+	// The backing path at which the inode was most recently seen. Renames
+	// update it.
+	path string
+
+	key fileKey
+
+	// For directories, the IV with which the names within are encrypted,
+	// once it has been read.
+	dirIV []byte
+
+	// The number of references that the kernel holds to the inode. See notes on
+	// fuseops.ForgetInodeOp.
+	lookupCount uint64
+
+	// Held for reading while reading the contents of the file, and for writing
+	// while changing them, since a write may re-encrypt blocks that a
+	// concurrent op is also using.
+	contentMu sync.RWMutex
+}
+
+type fileHandle struct {
+	f  *os.File
+	in *inode
+
+	// Whether the file was opened with O_APPEND.
+	append bool
+}
+
+type dirHandle struct {
+	f     *os.File
+	dirIV []byte
+
+	// The listing returned by the most recent ReadDir at offset zero.
+	entries []fuseutil.Dirent
+}
+
+type cryptFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	c *cryptor
+
+	// The backing directory.
+	root string
+
+	// Ops that touch the namespace hold mu throughout, so that the paths of
+	// inodes stay in step with the host. Reads and writes hold it only to find
+	// their handle.
+	mu sync.Mutex
+
+	// The inodes that the kernel knows about, by ID and by host file.
+	//
+	// INVARIANT: For each id, in of inodes, ids[in.key] is id or absent.
+	// INVARIANT: For each key, id of ids, inodes[id].key == key
+	inodes map[fuseops.InodeID]*inode  // GUARDED_BY(mu)
+	ids    map[fileKey]fuseops.InodeID // GUARDED_BY(mu)
+
+	// The ID to give the next inode.
+	nextInode fuseops.InodeID // GUARDED_BY(mu)
+
+	// Open files and directories.
+	files      map[fuseops.HandleID]*fileHandle // GUARDED_BY(mu)
+	dirs       map[fuseops.HandleID]*dirHandle  // GUARDED_BY(mu)
+	nextHandle fuseops.HandleID                 // GUARDED_BY(mu)
+}
+
+// NewCryptFS creates a file system that stores its files in the host
+// directory at root, encrypted with the supplied key of KeySize bytes. The
+// directory must be empty or have been used with NewCryptFS before. Using it
+// with a different key makes its contents unreadable.
+//
+// As with loopbackfs, ops are performed on the host with the credentials of
+// the current process, and attributes aren't cached by the kernel.
+func NewCryptFS(root string, key []byte) (fuse.Server, error) {
+	c, err := newCryptor(key)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("Abs: %v", err)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Stat(root, &st); err != nil {
+		return nil, fmt.Errorf("Stat: %v", err)
+	}
+
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	// Set up an empty directory for use.
+	if _, err := os.Stat(filepath.Join(root, dirIVName)); os.IsNotExist(err) {
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			return nil, fmt.Errorf("ReadDir: %v", err)
+		}
+
+		if len(entries) != 0 {
+			return nil, fmt.Errorf("%s is neither empty nor a cryptfs directory", root)
+		}
+
+		if err := writeDirIV(root); err != nil {
+			return nil, fmt.Errorf("writeDirIV: %v", err)
+		}
+	}
+
+	rootKey := keyOf(&st)
+	fs := &cryptFS{
+		c:    c,
+		root: root,
+		inodes: map[fuseops.InodeID]*inode{
+			fuseops.RootInodeID: {path: root, key: rootKey, lookupCount: 1},
+		},
+		ids:        map[fileKey]fuseops.InodeID{rootKey: fuseops.RootInodeID},
+		nextInode:  fuseops.RootInodeID + 1,
+		files:      make(map[fuseops.HandleID]*fileHandle),
+		dirs:       make(map[fuseops.HandleID]*dirHandle),
+		nextHandle: 1,
+	}
+
+	return fuseutil.NewFileSystemServer(fs), nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func keyOf(st *unix.Stat_t) fileKey {
+	return fileKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+}
+
+// Return the attributes that the kernel should see for a backing file.
+func attributes(st *unix.Stat_t) fuseops.InodeAttributes {
+	attrs := hostfs.Attributes(st)
+
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFREG:
+		attrs.Size = uint64(plainSize(st.Size))
+	case unix.S_IFLNK:
+		attrs.Size = uint64(targetSize(st.Size))
+	}
+
+	return attrs
+}
+
+// Create the IV file for a new backing directory, and make sure that it and
+// its name are on disk before any names are encrypted with it.
+func writeDirIV(dir string) error {
+	f, err := os.OpenFile(filepath.Join(dir, dirIVName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(randomBytes(dirIVSize))
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// Remove the IV file from a backing directory that holds nothing else, so
+// that the host sees it as empty, returning a function that puts it back.
+func removeDirIV(dir string) (restore func(), err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, hostfs.Errno(err)
+	}
+
+	for _, e := range entries {
+		if e.Name() != dirIVName {
+			return nil, fuse.ENOTEMPTY
+		}
+	}
+
+	p := filepath.Join(dir, dirIVName)
+	iv, err := os.ReadFile(p)
+	if err != nil {
+		return nil, hostfs.Errno(err)
+	}
+
+	if err := os.Remove(p); err != nil {
+		return nil, hostfs.Errno(err)
+	}
+
+	restore = func() {
+		os.WriteFile(p, iv, 0444)
+	}
+
+	return restore, nil
+}
+
+func isDir(path string) bool {
+	var st unix.Stat_t
+	return unix.Lstat(path, &st) == nil && st.Mode&unix.S_IFMT == unix.S_IFDIR
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *cryptFS) getInodeOrDie(id fuseops.InodeID) *inode {
+	in := fs.inodes[id]
+	if in == nil {
+		panic(fmt.Sprintf("Unknown inode: %v", id))
+	}
+
+	return in
+}
+
+// Return the IV of the directory.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *cryptFS) dirIV(in *inode) ([]byte, error) {
+	if in.dirIV != nil {
+		return in.dirIV, nil
+	}
+
+	iv, err := os.ReadFile(filepath.Join(in.path, dirIVName))
+	if err != nil {
+		return nil, hostfs.Errno(err)
+	}
+
+	if len(iv) != dirIVSize {
+		return nil, fuse.EIO
+	}
+
+	in.dirIV = iv
+
+	return iv, nil
+}
+
+// Return the backing path for the named child of the directory.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *cryptFS) childPath(parent fuseops.InodeID, name string) (string, error) {
+	in := fs.getInodeOrDie(parent)
+	iv, err := fs.dirIV(in)
+	if err != nil {
+		return "", err
+	}
+
+	enc, err := fs.c.encryptName(iv, name)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(in.path, enc), nil
+}
+
+// Fill in an entry for the file at the supplied backing path, incrementing
+// the lookup count of its inode and allocating one if the kernel doesn't
+// already know about the file.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *cryptFS) lookUp(path string, e *fuseops.ChildInodeEntry) error {
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	key := keyOf(&st)
+	id, ok := fs.ids[key]
+	if !ok {
+		id = fs.nextInode
+		fs.nextInode++
+
+		fs.inodes[id] = &inode{key: key}
+		fs.ids[key] = id
+	}
+
+	in := fs.inodes[id]
+	in.path = path
+	in.lookupCount++
+
+	e.Child = id
+	e.Attributes = attributes(&st)
+
+	return nil
+}
+
+// Decrement the lookup count of the inode, forgetting it once the kernel no
+// longer refers to it.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *cryptFS) forget(id fuseops.InodeID, n uint64) {
+	in := fs.getInodeOrDie(id)
+	if n > in.lookupCount {
+		panic(fmt.Sprintf("Forgetting %d references to inode %d with %d", n, id, in.lookupCount))
+	}
+
+	in.lookupCount -= n
+	if in.lookupCount != 0 || id == fuseops.RootInodeID {
+		return
+	}
+
+	delete(fs.inodes, id)
+	if fs.ids[in.key] == id {
+		delete(fs.ids, in.key)
+	}
+}
+
+// Return the key of the file at the supplied path if removing that name will
+// remove the file itself, after which the host may give its inode number to
+// a new file. Such keys are dropped from fs.ids once the removal succeeds, so
+// that the new file gets a new inode.
+func lastLink(path string) (key fileKey, ok bool) {
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return
+	}
+
+	if st.Nlink > 1 && st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return
+	}
+
+	return keyOf(&st), true
+}
+
+// Handle IDs start at one, so this returns an ID that isn't in use for nil.
+func derefHandle(h *fuseops.HandleID) fuseops.HandleID {
+	if h == nil {
+		return 0
+	}
+
+	return *h
+}
+
+// Return the flags with which to open a backing file for the supplied kernel
+// flags. Any handle that may write must also be able to read, since writing
+// part of a block means decrypting the rest of it, and the file system
+// decides the offsets of appending writes itself.
+func hostFlags(flags fusekernel.OpenFlags) int {
+	f := int(flags) &^ (os.O_CREATE | os.O_EXCL | os.O_APPEND | syscall.O_NOCTTY)
+	if f&os.O_WRONLY != 0 {
+		f = f&^os.O_WRONLY | os.O_RDWR
+	}
+
+	return f
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *cryptFS) openHandle(f *os.File, in *inode, flags fusekernel.OpenFlags) fuseops.HandleID {
+	handle := fs.nextHandle
+	fs.nextHandle++
+
+	fs.files[handle] = &fileHandle{
+		f:      f,
+		in:     in,
+		append: flags&syscall.O_APPEND != 0,
+	}
+
+	return handle
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cryptFS) getFile(h fuseops.HandleID) (*fileHandle, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fh, ok := fs.files[h]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+
+	return fh, nil
+}
+
+// Read the whole of an open backing directory, from the start, decrypting the
+// names. Entries whose names don't decrypt weren't made by the file system,
+// and are left out.
+func (fs *cryptFS) readDir(f *os.File, dirIV []byte) ([]fuseutil.Dirent, error) {
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, hostfs.Errno(err)
+	}
+
+	children, err := f.ReadDir(-1)
+	if err != nil {
+		return nil, hostfs.Errno(err)
+	}
+
+	var entries []fuseutil.Dirent
+	for _, child := range children {
+		name, err := fs.c.decryptName(dirIV, child.Name())
+		if err != nil {
+			continue
+		}
+
+		// Skip entries that have disappeared since the listing.
+		fi, err := child.Info()
+		if err != nil {
+			continue
+		}
+
+		var ino uint64
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			ino = uint64(st.Ino)
+		}
+
+		var t fuseutil.DirentType
+		switch m := fi.Mode(); {
+		case m.IsDir():
+			t = fuseutil.DT_Directory
+		case m&os.ModeSymlink != 0:
+			t = fuseutil.DT_Link
+		case m&os.ModeNamedPipe != 0:
+			t = fuseutil.DT_FIFO
+		case m&os.ModeSocket != 0:
+			t = fuseutil.DT_Socket
+		default:
+			t = fuseutil.DT_File
+		}
+
+		entries = append(entries, fuseutil.Dirent{
+			Offset: fuseops.DirOffset(len(entries) + 1),
+			Inode:  fuseops.InodeID(ino),
+			Name:   name,
+			Type:   t,
+		})
+	}
+
+	return entries, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Contents
+////////////////////////////////////////////////////////////////////////
+
+// Return the ID of the backing file, or nil if it is empty and so has no
+// header yet.
+func readFileID(f *os.File) ([]byte, error) {
+	h := make([]byte, headerSize)
+	n, err := f.ReadAt(h, 0)
+	if n == 0 && err == io.EOF {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, hostfs.Errno(err)
+	}
+
+	id, err := parseHeader(h)
+	if err != nil {
+		return nil, fuse.EIO
+	}
+
+	return id, nil
+}
+
+// Read plaintext from the supplied offset of a backing file, returning a
+// short count at the end of the file.
+//
+// LOCKS_REQUIRED(in.contentMu) for reading
+func (fs *cryptFS) readAt(f *os.File, dst []byte, off int64) (int, error) {
+	if len(dst) == 0 {
+		return 0, nil
+	}
+
+	fileID, err := readFileID(f)
+	if err != nil || fileID == nil {
+		return 0, err
+	}
+
+	first := off / blockSize
+	last := (off + int64(len(dst)) - 1) / blockSize
+
+	buf := make([]byte, (last-first+1)*cipherBlockSize)
+	n, err := f.ReadAt(buf, blockOffset(first))
+	if err != nil && err != io.EOF {
+		return 0, hostfs.Errno(err)
+	}
+
+	buf = buf[:n]
+
+	var read int
+	for i := first; len(buf) > 0; i++ {
+		sealed := buf[:min(len(buf), cipherBlockSize)]
+		buf = buf[len(sealed):]
+
+		plain, err := fs.c.openBlock(fileID, i, sealed)
+		if err != nil {
+			return 0, fuse.EIO
+		}
+
+		var skip int64
+		if i == first {
+			skip = off % blockSize
+		}
+
+		if skip >= int64(len(plain)) {
+			break
+		}
+
+		read += copy(dst[read:], plain[skip:])
+	}
+
+	return read, nil
+}
+
+// Write plaintext at the supplied offset of a backing file, filling any gap
+// beyond the current end with zeros.
+//
+// LOCKS_REQUIRED(in.contentMu) for writing
+func (fs *cryptFS) writeAt(f *os.File, data []byte, off int64) error {
+	var st unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	size := plainSize(st.Size)
+
+	fileID, err := readFileID(f)
+	if err != nil {
+		return err
+	}
+
+	// The header must be in place before any block sealed with its ID. Both
+	// are in the same file, so there's no need to sync in between.
+	if fileID == nil || st.Size < headerSize {
+		h := newHeader()
+		if _, err := f.WriteAt(h, 0); err != nil {
+			return hostfs.Errno(err)
+		}
+
+		fileID, _ = parseHeader(h)
+		size = 0
+	}
+
+	// The host would read a gap as zeros, which don't decrypt, so fill it with
+	// encrypted zeros instead.
+	for size < off {
+		n := min(off-size, 64*blockSize)
+		if err := fs.writeBlocks(f, fileID, make([]byte, n), size, size); err != nil {
+			return err
+		}
+
+		size += n
+	}
+
+	return fs.writeBlocks(f, fileID, data, off, size)
+}
+
+// Seal and write the blocks covering the supplied range, which starts at or
+// before size, the current size of the plaintext.
+//
+// LOCKS_REQUIRED(in.contentMu) for writing
+func (fs *cryptFS) writeBlocks(
+	f *os.File,
+	fileID []byte,
+	data []byte,
+	off int64,
+	size int64) error {
+	first := off / blockSize
+
+	var out []byte
+	for i := first; len(data) > 0; i++ {
+		start := int64(0)
+		if i == first {
+			start = off % blockSize
+		}
+
+		n := min(int64(len(data)), blockSize-start)
+
+		// Anything in the block that the write doesn't cover must be kept.
+		var plain []byte
+		blockStart := i * blockSize
+		if (start != 0 || start+n < blockSize) && blockStart < size {
+			sealed := make([]byte, cipherBlockSize)
+			m, err := f.ReadAt(sealed, blockOffset(i))
+			if err != nil && err != io.EOF {
+				return hostfs.Errno(err)
+			}
+
+			plain, err = fs.c.openBlock(fileID, i, sealed[:m])
+			if err != nil {
+				return fuse.EIO
+			}
+		}
+
+		if int64(len(plain)) < start+n {
+			plain = append(plain, make([]byte, start+n-int64(len(plain)))...)
+		}
+
+		copy(plain[start:], data[:n])
+		data = data[n:]
+
+		out = fs.c.sealBlock(out, fileID, i, plain)
+	}
+
+	if _, err := f.WriteAt(out, blockOffset(first)); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	return nil
+}
+
+// Change the size of the plaintext of a backing file.
+//
+// LOCKS_REQUIRED(in.contentMu) for writing
+func (fs *cryptFS) truncate(f *os.File, newSize int64) error {
+	var st unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	size := plainSize(st.Size)
+	switch {
+	case newSize == size:
+		return nil
+
+	case newSize > size:
+		// Fill with encrypted zeros, as for a write beyond the end.
+		return fs.writeAt(f, nil, newSize)
+
+	case newSize == 0:
+		return hostfs.Errno(f.Truncate(0))
+	}
+
+	// Re-encrypt the block that becomes the last, since its tag covers the
+	// part being cut off.
+	if rem := newSize % blockSize; rem != 0 {
+		fileID, err := readFileID(f)
+		if err != nil {
+			return err
+		}
+
+		i := newSize / blockSize
+		sealed := make([]byte, cipherBlockSize)
+		n, err := f.ReadAt(sealed, blockOffset(i))
+		if err != nil && err != io.EOF {
+			return hostfs.Errno(err)
+		}
+
+		plain, err := fs.c.openBlock(fileID, i, sealed[:n])
+		if err != nil {
+			return fuse.EIO
+		}
+
+		out := fs.c.sealBlock(nil, fileID, i, plain[:rem])
+		if _, err := f.WriteAt(out, blockOffset(i)); err != nil {
+			return hostfs.Errno(err)
+		}
+	}
+
+	return hostfs.Errno(f.Truncate(cipherSize(newSize)))
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *cryptFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(fs.root, &st); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	op.BlockSize, op.IoSize = hostfs.BlockSizes(&st)
+	op.Blocks = st.Blocks
+	op.BlocksFree = st.Bfree
+	op.BlocksAvailable = st.Bavail
+	op.Inodes = st.Files
+	op.InodesFree = st.Ffree
+
+	return nil
+}
+
+func (fs *cryptFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	return fs.lookUp(path, &op.Entry)
+}
+
+func (fs *cryptFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var st unix.Stat_t
+	if err := unix.Lstat(fs.getInodeOrDie(op.Inode).path, &st); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	op.Attributes = attributes(&st)
+
+	return nil
+}
+
+func (fs *cryptFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in := fs.getInodeOrDie(op.Inode)
+	path := in.path
+
+	if op.Size != nil {
+		var f *os.File
+		if fh, ok := fs.files[derefHandle(op.Handle)]; ok {
+			f = fh.f
+		} else {
+			var err error
+			f, err = os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				return hostfs.Errno(err)
+			}
+
+			defer f.Close()
+		}
+
+		in.contentMu.Lock()
+		err := fs.truncate(f, int64(*op.Size))
+		in.contentMu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if op.Mode != nil {
+		if err := os.Chmod(path, *op.Mode); err != nil {
+			return hostfs.Errno(err)
+		}
+	}
+
+	if op.Uid != nil || op.Gid != nil {
+		uid, gid := -1, -1
+		if op.Uid != nil {
+			uid = int(*op.Uid)
+		}
+
+		if op.Gid != nil {
+			gid = int(*op.Gid)
+		}
+
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return hostfs.Errno(err)
+		}
+	}
+
+	// Zero times are left unchanged.
+	if op.Atime != nil || op.Mtime != nil {
+		var atime, mtime time.Time
+		if op.Atime != nil {
+			atime = *op.Atime
+		}
+
+		if op.Mtime != nil {
+			mtime = *op.Mtime
+		}
+
+		if err := os.Chtimes(path, atime, mtime); err != nil {
+			return hostfs.Errno(err)
+		}
+	}
+
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	op.Attributes = attributes(&st)
+
+	return nil
+}
+
+func (fs *cryptFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.forget(op.Inode, op.N)
+
+	return nil
+}
+
+func (fs *cryptFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, e := range op.Entries {
+		fs.forget(e.Inode, e.N)
+	}
+
+	return nil
+}
+
+func (fs *cryptFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	// Create the directory writable by the process, whatever its final mode,
+	// so that the IV can be put in it. A directory without an IV is unusable,
+	// so don't leave one behind.
+	if err := os.Mkdir(path, 0700); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	err = writeDirIV(path)
+	if err == nil {
+		err = os.Chmod(path, op.Mode&(os.ModePerm|os.ModeSetgid|os.ModeSticky))
+	}
+
+	if err != nil {
+		os.RemoveAll(path)
+		return hostfs.Errno(err)
+	}
+
+	return fs.lookUp(path, &op.Entry)
+}
+
+func (fs *cryptFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	// Device files would let anyone who can see the backing directory open
+	// the device, so allow only those that hold no data.
+	mode := uint32(op.Mode.Perm())
+	switch {
+	case op.Mode&os.ModeNamedPipe != 0:
+		mode |= unix.S_IFIFO
+	case op.Mode&os.ModeSocket != 0:
+		mode |= unix.S_IFSOCK
+	default:
+		return syscall.EPERM
+	}
+
+	if err := unix.Mknod(path, mode, 0); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	return fs.lookUp(path, &op.Entry)
+}
+
+func (fs *cryptFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	flags := hostFlags(op.OpenFlags) | os.O_CREATE | os.O_EXCL
+	f, err := os.OpenFile(path, flags, op.Mode.Perm())
+	if err != nil {
+		return hostfs.Errno(err)
+	}
+
+	if err := fs.lookUp(path, &op.Entry); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+
+	op.Handle = fs.openHandle(f, fs.inodes[op.Entry.Child], op.OpenFlags)
+
+	return nil
+}
+
+func (fs *cryptFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Symlink(fs.c.encryptTarget(op.Target), path); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	return fs.lookUp(path, &op.Entry)
+}
+
+func (fs *cryptFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	// Blocks are bound to the file's ID rather than its name, so the new link
+	// reads the same contents.
+	if err := os.Link(fs.getInodeOrDie(op.Target).path, path); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	return fs.lookUp(path, &op.Entry)
+}
+
+func (fs *cryptFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	oldPath, err := fs.childPath(op.OldParent, op.OldName)
+	if err != nil {
+		return err
+	}
+
+	newPath, err := fs.childPath(op.NewParent, op.NewName)
+	if err != nil {
+		return err
+	}
+
+	// An empty directory can be replaced by another, but the host sees its IV
+	// file as an entry.
+	restore := func() {}
+	if isDir(oldPath) && isDir(newPath) {
+		restore, err = removeDirIV(newPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Renaming over the last link to another file removes it. Unlike
+	// os.Rename, unix.Rename replaces empty directories.
+	replaced, ok := lastLink(newPath)
+	if err := unix.Rename(oldPath, newPath); err != nil {
+		restore()
+		return hostfs.Errno(err)
+	}
+
+	if ok && oldPath != newPath {
+		delete(fs.ids, replaced)
+	}
+
+	// Move the inode and everything beneath it. A directory keeps its IV, so
+	// the names within don't change.
+	for _, in := range fs.inodes {
+		switch {
+		case in.path == oldPath:
+			in.path = newPath
+
+		case strings.HasPrefix(in.path, oldPath+"/"):
+			in.path = newPath + in.path[len(oldPath):]
+		}
+	}
+
+	return nil
+}
+
+func (fs *cryptFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	key, ok := lastLink(path)
+	restore, err := removeDirIV(path)
+	if err != nil {
+		return err
+	}
+
+	if err := unix.Rmdir(path); err != nil {
+		restore()
+		return hostfs.Errno(err)
+	}
+
+	// The host may now give the inode number to a new file.
+	if ok {
+		delete(fs.ids, key)
+	}
+
+	return nil
+}
+
+func (fs *cryptFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	key, ok := lastLink(path)
+	if err := unix.Unlink(path); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	if ok {
+		delete(fs.ids, key)
+	}
+
+	return nil
+}
+
+func (fs *cryptFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in := fs.getInodeOrDie(op.Inode)
+	iv, err := fs.dirIV(in)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(in.path)
+	if err != nil {
+		return hostfs.Errno(err)
+	}
+
+	op.Handle = fs.nextHandle
+	fs.nextHandle++
+	fs.dirs[op.Handle] = &dirHandle{f: f, dirIV: iv}
+
+	return nil
+}
+
+func (fs *cryptFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dh, ok := fs.dirs[op.Handle]
+	if !ok {
+		return syscall.EBADF
+	}
+
+	// Take a fresh listing at the start, so that rewinddir sees changes.
+	if op.Offset == 0 || dh.entries == nil {
+		entries, err := fs.readDir(dh.f, dh.dirIV)
+		if err != nil {
+			return err
+		}
+
+		dh.entries = entries
+	}
+
+	if op.Offset > fuseops.DirOffset(len(dh.entries)) {
+		return nil
+	}
+
+	for _, e := range dh.entries[op.Offset:] {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *cryptFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dh, ok := fs.dirs[op.Handle]
+	if !ok {
+		return syscall.EBADF
+	}
+
+	delete(fs.dirs, op.Handle)
+
+	return hostfs.Errno(dh.f.Close())
+}
+
+func (fs *cryptFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in := fs.getInodeOrDie(op.Inode)
+
+	// Truncation drops the header along with the blocks, so it mustn't happen
+	// in the middle of a write through another handle.
+	flags := hostFlags(op.OpenFlags)
+	if flags&os.O_TRUNC != 0 {
+		in.contentMu.Lock()
+		defer in.contentMu.Unlock()
+	}
+
+	f, err := os.OpenFile(in.path, flags, 0)
+	if err != nil {
+		return hostfs.Errno(err)
+	}
+
+	op.Handle = fs.openHandle(f, in, op.OpenFlags)
+
+	return nil
+}
+
+func (fs *cryptFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fh, err := fs.getFile(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	fh.in.contentMu.RLock()
+	defer fh.in.contentMu.RUnlock()
+
+	op.BytesRead, err = fs.readAt(fh.f, op.Dst, op.Offset)
+
+	return err
+}
+
+func (fs *cryptFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fh, err := fs.getFile(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	fh.in.contentMu.Lock()
+	defer fh.in.contentMu.Unlock()
+
+	off := op.Offset
+	if fh.append {
+		var st unix.Stat_t
+		if err := unix.Fstat(int(fh.f.Fd()), &st); err != nil {
+			return hostfs.Errno(err)
+		}
+
+		off = plainSize(st.Size)
+	}
+
+	return fs.writeAt(fh.f, op.Data, off)
+}
+
+func (fs *cryptFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	fh, err := fs.getFile(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	// Wait for any write in progress, so that all of its blocks are synced.
+	fh.in.contentMu.RLock()
+	defer fh.in.contentMu.RUnlock()
+
+	return hostfs.Errno(fh.f.Sync())
+}
+
+func (fs *cryptFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	// Writes go straight to the host, so there's nothing to flush.
+	return nil
+}
+
+func (fs *cryptFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fh, ok := fs.files[op.Handle]
+	if !ok {
+		return syscall.EBADF
+	}
+
+	delete(fs.files, op.Handle)
+
+	return hostfs.Errno(fh.f.Close())
+}
+
+func (fs *cryptFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	enc, err := os.Readlink(fs.getInodeOrDie(op.Inode).path)
+	if err != nil {
+		return hostfs.Errno(err)
+	}
+
+	target, err := fs.c.decryptTarget(enc)
+	if err != nil {
+		return fuse.EIO
+	}
+
+	op.Target = target
+
+	return nil
+}
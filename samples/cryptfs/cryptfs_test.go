@@ -0,0 +1,284 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cryptfs_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse/samples"
+	"github.com/jacobsa/fuse/samples/cryptfs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestCryptFS(t *testing.T) { RunTests(t) }
+
+type CryptFSTest struct {
+	samples.SampleTest
+
+	// The backing directory.
+	physicalPath string
+}
+
+func init() { RegisterTestSuite(&CryptFSTest{}) }
+
+func (t *CryptFSTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.physicalPath, err = ioutil.TempDir("", "cryptfs_test")
+	AssertEq(nil, err)
+
+	key := bytes.Repeat([]byte{0x17}, cryptfs.KeySize)
+	t.Server, err = cryptfs.NewCryptFS(t.physicalPath, key)
+	AssertEq(nil, err)
+
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *CryptFSTest) TearDown() {
+	t.SampleTest.TearDown()
+
+	err := os.RemoveAll(t.physicalPath)
+	AssertEq(nil, err)
+}
+
+// Return the contents of every file beneath the backing directory, along
+// with all of the names.
+func (t *CryptFSTest) backingContents() string {
+	var b strings.Builder
+	err := filepath.Walk(t.physicalPath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		b.WriteString(fi.Name())
+		if fi.Mode().IsRegular() {
+			contents, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+
+			b.Write(contents)
+		}
+
+		return nil
+	})
+
+	AssertEq(nil, err)
+	return b.String()
+}
+
+// A pattern that differs in every block, so that misplaced blocks show up.
+func pattern(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i/4096 + i*7)
+	}
+
+	return b
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CryptFSTest) WriteAndRead() {
+	data := pattern(3*4096 + 100)
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), data, 0600)
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(data, contents))
+
+	fi, err := os.Stat(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq(len(data), fi.Size())
+}
+
+func (t *CryptFSTest) BackingIsEncrypted() {
+	err := os.Mkdir(path.Join(t.Dir, "secret_dir"), 0755)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "secret_dir", "secret_name"), []byte("secret contents"), 0600)
+	AssertEq(nil, err)
+
+	backing := t.backingContents()
+	ExpectThat(backing, Not(HasSubstr("secret")))
+}
+
+func (t *CryptFSTest) OverwritePartOfBlock() {
+	data := pattern(2 * 4096)
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), data, 0600)
+	AssertEq(nil, err)
+
+	f, err := os.OpenFile(path.Join(t.Dir, "foo"), os.O_WRONLY, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	// Straddle the boundary between the blocks.
+	_, err = f.WriteAt([]byte("taco"), 4094)
+	AssertEq(nil, err)
+
+	err = f.Sync()
+	AssertEq(nil, err)
+
+	copy(data[4094:], "taco")
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(data, contents))
+}
+
+func (t *CryptFSTest) WriteBeyondEnd() {
+	f, err := os.Create(path.Join(t.Dir, "foo"))
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	_, err = f.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = f.WriteAt([]byte("burrito"), 10000)
+	AssertEq(nil, err)
+
+	// The gap reads as zeros.
+	expected := make([]byte, 10007)
+	copy(expected, "taco")
+	copy(expected[10000:], "burrito")
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(expected, contents))
+}
+
+func (t *CryptFSTest) Truncate() {
+	data := pattern(3 * 4096)
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), data, 0600)
+	AssertEq(nil, err)
+
+	// Shrink into the middle of a block.
+	err = os.Truncate(path.Join(t.Dir, "foo"), 5000)
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(data[:5000], contents))
+
+	// Grow again.
+	err = os.Truncate(path.Join(t.Dir, "foo"), 6000)
+	AssertEq(nil, err)
+
+	contents, err = ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	AssertEq(6000, len(contents))
+	ExpectTrue(bytes.Equal(data[:5000], contents[:5000]))
+	ExpectTrue(bytes.Equal(make([]byte, 1000), contents[5000:]))
+}
+
+func (t *CryptFSTest) Append() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	f, err := os.OpenFile(path.Join(t.Dir, "foo"), os.O_WRONLY|os.O_APPEND, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	_, err = f.Write([]byte("burrito"))
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(contents))
+}
+
+func (t *CryptFSTest) ReadDir() {
+	err := os.Mkdir(path.Join(t.Dir, "dir"), 0755)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "dir", "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	entries, err := ioutil.ReadDir(path.Join(t.Dir, "dir"))
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq("foo", entries[0].Name())
+	ExpectEq(4, entries[0].Size())
+
+	// The IV files don't show.
+	entries, err = ioutil.ReadDir(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq("dir", entries[0].Name())
+}
+
+func (t *CryptFSTest) RenameDirectory() {
+	err := os.MkdirAll(path.Join(t.Dir, "dir", "sub"), 0755)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "dir", "sub", "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Rename(path.Join(t.Dir, "dir"), path.Join(t.Dir, "other"))
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "other", "sub", "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *CryptFSTest) RmDir() {
+	err := os.MkdirAll(path.Join(t.Dir, "dir", "sub"), 0755)
+	AssertEq(nil, err)
+
+	err = os.Remove(path.Join(t.Dir, "dir"))
+	ExpectThat(err, Error(HasSubstr("not empty")))
+
+	err = os.Remove(path.Join(t.Dir, "dir", "sub"))
+	AssertEq(nil, err)
+
+	err = os.Remove(path.Join(t.Dir, "dir"))
+	AssertEq(nil, err)
+}
+
+func (t *CryptFSTest) Symlink() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Symlink("foo", path.Join(t.Dir, "link"))
+	AssertEq(nil, err)
+
+	target, err := os.Readlink(path.Join(t.Dir, "link"))
+	AssertEq(nil, err)
+	ExpectEq("foo", target)
+
+	fi, err := os.Lstat(path.Join(t.Dir, "link"))
+	AssertEq(nil, err)
+	ExpectEq(len("foo"), fi.Size())
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "link"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *CryptFSTest) NameTooLong() {
+	err := ioutil.WriteFile(path.Join(t.Dir, strings.Repeat("x", 200)), nil, 0600)
+	ExpectThat(err, Error(HasSubstr("too long")))
+}
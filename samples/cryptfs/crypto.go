@@ -0,0 +1,282 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cryptfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// The layout of a backing file is a header followed by a sequence of
+// encrypted blocks:
+//
+//	header:  version (2 bytes, big endian) | file ID (16 random bytes)
+//	block i: nonce (12 random bytes) | AES-GCM ciphertext | tag (16 bytes)
+//
+// Every block but the last holds blockSize bytes of plaintext. Each is sealed
+// with the file ID and its own index as additional data, so that blocks can't
+// be moved within or between files without detection. An empty file has no
+// header at all.
+const (
+	version    = 1
+	fileIDSize = 16
+	headerSize = 2 + fileIDSize
+
+	blockSize       = 4096
+	nonceSize       = 12
+	tagSize         = 16
+	blockOverhead   = nonceSize + tagSize
+	cipherBlockSize = blockSize + blockOverhead
+)
+
+// KeySize is the size of the keys accepted by NewCryptFS.
+const KeySize = 32
+
+// The size of the random IV stored in each backing directory.
+const dirIVSize = 16
+
+// The longest name that the host is guaranteed to accept.
+const maxHostName = 255
+
+var errAuth = errors.New("message authentication failed")
+
+type cryptor struct {
+	// Seals file contents and symlink targets.
+	content cipher.AEAD
+
+	// Seals file names, deterministically.
+	names cipher.AEAD
+
+	// Derives the nonces with which names are sealed.
+	nameIVKey []byte
+}
+
+func newCryptor(key []byte) (*cryptor, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("Key is %d bytes; want %d", len(key), KeySize)
+	}
+
+	// Use independent keys for each purpose.
+	derive := func(info string) []byte {
+		k := make([]byte, 32)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(info)), k); err != nil {
+			panic(err)
+		}
+
+		return k
+	}
+
+	content, err := newGCM(derive("cryptfs content"))
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := newGCM(derive("cryptfs names"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &cryptor{
+		content:   content,
+		names:     names,
+		nameIVKey: derive("cryptfs name IVs"),
+	}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("NewCipher: %v", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("NewGCM: %v", err)
+	}
+
+	return gcm, nil
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("rand.Read: %v", err))
+	}
+
+	return b
+}
+
+////////////////////////////////////////////////////////////////////////
+// Sizes
+////////////////////////////////////////////////////////////////////////
+
+// Return the size of the plaintext of a backing file of the supplied size.
+func plainSize(cipherSize int64) int64 {
+	if cipherSize <= headerSize {
+		return 0
+	}
+
+	n := cipherSize - headerSize
+	size := n / cipherBlockSize * blockSize
+	if rem := n % cipherBlockSize; rem > blockOverhead {
+		size += rem - blockOverhead
+	}
+
+	return size
+}
+
+// Return the size of the backing file for plaintext of the supplied size.
+func cipherSize(plainSize int64) int64 {
+	if plainSize == 0 {
+		return 0
+	}
+
+	size := headerSize + plainSize/blockSize*cipherBlockSize
+	if rem := plainSize % blockSize; rem != 0 {
+		size += rem + blockOverhead
+	}
+
+	return size
+}
+
+// Return the offset in the backing file of the supplied block.
+func blockOffset(i int64) int64 {
+	return headerSize + i*cipherBlockSize
+}
+
+////////////////////////////////////////////////////////////////////////
+// Contents
+////////////////////////////////////////////////////////////////////////
+
+func newHeader() []byte {
+	h := make([]byte, 2, headerSize)
+	binary.BigEndian.PutUint16(h, version)
+	return append(h, randomBytes(fileIDSize)...)
+}
+
+// Return the file ID from a header, which must be of headerSize bytes.
+func parseHeader(h []byte) ([]byte, error) {
+	if v := binary.BigEndian.Uint16(h); v != version {
+		return nil, fmt.Errorf("Unknown version %d", v)
+	}
+
+	return h[2:], nil
+}
+
+func blockAD(fileID []byte, i int64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte{}, fileID...), uint64(i))
+}
+
+// Append the sealed form of the supplied plaintext for block i to dst.
+func (c *cryptor) sealBlock(dst []byte, fileID []byte, i int64, plain []byte) []byte {
+	nonce := randomBytes(nonceSize)
+	dst = append(dst, nonce...)
+	return c.content.Seal(dst, nonce, plain, blockAD(fileID, i))
+}
+
+// Return the plaintext of block i.
+func (c *cryptor) openBlock(fileID []byte, i int64, sealed []byte) ([]byte, error) {
+	if len(sealed) < blockOverhead {
+		return nil, errAuth
+	}
+
+	return c.content.Open(nil, sealed[:nonceSize], sealed[nonceSize:], blockAD(fileID, i))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Names
+////////////////////////////////////////////////////////////////////////
+
+// Encrypt a name for the directory with the supplied IV. The result is the
+// same each time, so that names can be looked up, but differs between
+// directories.
+//
+// The nonce is derived from the name itself, as in SIV mode, so reusing it
+// only ever reveals that two names in a directory are equal, which is
+// already apparent.
+func (c *cryptor) encryptName(dirIV []byte, name string) (string, error) {
+	mac := hmac.New(sha256.New, c.nameIVKey)
+	mac.Write(dirIV)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:nonceSize]
+
+	sealed := c.names.Seal(append([]byte{}, nonce...), nonce, []byte(name), dirIV)
+	enc := base64.RawURLEncoding.EncodeToString(sealed)
+	if len(enc) > maxHostName {
+		return "", syscall.ENAMETOOLONG
+	}
+
+	return enc, nil
+}
+
+// The inverse of encryptName.
+func (c *cryptor) decryptName(dirIV []byte, enc string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil || len(sealed) < nonceSize+tagSize {
+		return "", errAuth
+	}
+
+	name, err := c.names.Open(nil, sealed[:nonceSize], sealed[nonceSize:], dirIV)
+	if err != nil {
+		return "", err
+	}
+
+	return string(name), nil
+}
+
+// Encrypt the target of a symlink. Unlike names, targets are never looked up,
+// so they have random nonces.
+func (c *cryptor) encryptTarget(target string) string {
+	nonce := randomBytes(nonceSize)
+	sealed := c.content.Seal(append([]byte{}, nonce...), nonce, []byte(target), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// The inverse of encryptTarget.
+func (c *cryptor) decryptTarget(enc string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil || len(sealed) < blockOverhead {
+		return "", errAuth
+	}
+
+	target, err := c.content.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(target), nil
+}
+
+// Return the length of the target of a symlink whose encrypted target has the
+// supplied length.
+func targetSize(encSize int64) int64 {
+	n := int64(base64.RawURLEncoding.DecodedLen(int(encSize))) - blockOverhead
+	if n < 0 {
+		return 0
+	}
+
+	return n
+}
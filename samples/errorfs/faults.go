@@ -0,0 +1,214 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package errorfs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// FaultConfig describes the faults injected by a Faults. The zero value
+// injects none.
+type FaultConfig struct {
+	// Fail every ReadErrorEvery'th ReadFile op with EIO, without passing it on.
+	// Zero disables.
+	ReadErrorEvery int
+
+	// Fail WriteFile ops with ENOSPC, without passing them on, once they would
+	// take the number of bytes successfully written beyond WriteLimit. Zero
+	// disables.
+	WriteLimit int64
+
+	// Delay the reply to every LatencyEvery'th op by Latency, or to every op if
+	// LatencyEvery is zero. A zero Latency disables.
+	Latency      time.Duration
+	LatencyEvery int
+}
+
+// ParseFaultConfig parses a config from whitespace-separated key=value pairs,
+// as found in the control file of mount_errorfs, for example:
+//
+//	read_error_every=10
+//	write_limit=1048576
+//	latency=200ms latency_every=50
+//
+// Lines starting with '#' are ignored, as are keys that are absent.
+func ParseFaultConfig(s string) (FaultConfig, error) {
+	var cfg FaultConfig
+	for _, line := range strings.Split(s, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		for _, field := range strings.Fields(line) {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				return FaultConfig{}, fmt.Errorf("Expected key=value: %q", field)
+			}
+
+			var err error
+			switch key {
+			case "read_error_every":
+				cfg.ReadErrorEvery, err = strconv.Atoi(value)
+
+			case "write_limit":
+				cfg.WriteLimit, err = strconv.ParseInt(value, 10, 64)
+
+			case "latency":
+				cfg.Latency, err = time.ParseDuration(value)
+
+			case "latency_every":
+				cfg.LatencyEvery, err = strconv.Atoi(value)
+
+			default:
+				return FaultConfig{}, fmt.Errorf("Unknown key: %q", key)
+			}
+
+			if err != nil {
+				return FaultConfig{}, fmt.Errorf("%s: %v", key, err)
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// Faults is a fuse.Interceptor that injects the faults described by a
+// FaultConfig into the ops served by any server, for testing how
+// applications cope with an unreliable file system. Install it with
+// WrapWithFaults or fuse.Chain, and change the faults at any time with Set.
+type Faults struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	cfg FaultConfig
+
+	// The number of ReadFile ops seen since the config was set.
+	//
+	// GUARDED_BY(mu)
+	reads int
+
+	// The number of bytes successfully written since the config was set.
+	//
+	// GUARDED_BY(mu)
+	written int64
+
+	// The number of ops seen since the config was set.
+	//
+	// GUARDED_BY(mu)
+	ops int
+}
+
+var _ fuse.Interceptor = &Faults{}
+
+// NewFaults returns a Faults that injects the faults described by cfg.
+func NewFaults(cfg FaultConfig) *Faults {
+	return &Faults{cfg: cfg}
+}
+
+// WrapWithFaults returns a server that injects the faults controlled by f into
+// the ops served by the supplied one.
+func WrapWithFaults(server fuse.Server, f *Faults) fuse.Server {
+	return fuse.Chain(server, f)
+}
+
+// Set replaces the faults to inject, and restarts the counts of reads, bytes
+// written and ops from zero.
+//
+// LOCKS_EXCLUDED(f.mu)
+func (f *Faults) Set(cfg FaultConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.cfg = cfg
+	f.reads = 0
+	f.written = 0
+	f.ops = 0
+}
+
+// Config returns the faults currently injected.
+//
+// LOCKS_EXCLUDED(f.mu)
+func (f *Faults) Config() FaultConfig {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.cfg
+}
+
+// LOCKS_EXCLUDED(f.mu)
+func (f *Faults) InterceptOp(
+	ctx context.Context,
+	op interface{}) (context.Context, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch o := op.(type) {
+	case *fuseops.ReadFileOp:
+		f.reads++
+		if n := f.cfg.ReadErrorEvery; n > 0 && f.reads%n == 0 {
+			return ctx, syscall.EIO
+		}
+
+	case *fuseops.WriteFileOp:
+		if limit := f.cfg.WriteLimit; limit > 0 && f.written+int64(len(o.Data)) > limit {
+			return ctx, syscall.ENOSPC
+		}
+	}
+
+	return ctx, nil
+}
+
+// LOCKS_EXCLUDED(f.mu)
+func (f *Faults) InterceptReply(
+	ctx context.Context,
+	op interface{},
+	err error) error {
+	f.mu.Lock()
+
+	if o, ok := op.(*fuseops.WriteFileOp); ok && err == nil {
+		f.written += int64(len(o.Data))
+	}
+
+	f.ops++
+	var delay time.Duration
+	if n := f.cfg.LatencyEvery; n <= 0 || f.ops%n == 0 {
+		delay = f.cfg.Latency
+	}
+
+	f.mu.Unlock()
+
+	// Replies are sent on the goroutine that served the op, so this holds up
+	// only the op itself. Give up early if the kernel interrupts it.
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+
+	return err
+}
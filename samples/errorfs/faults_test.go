@@ -0,0 +1,144 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package errorfs_test
+
+import (
+	"context"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/samples/errorfs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Exercises Faults directly, without mounting anything.
+type FaultsTest struct {
+	ctx    context.Context
+	faults *errorfs.Faults
+}
+
+func init() { RegisterTestSuite(&FaultsTest{}) }
+
+func (t *FaultsTest) SetUp(ti *TestInfo) {
+	t.ctx = context.Background()
+	t.faults = errorfs.NewFaults(errorfs.FaultConfig{})
+}
+
+// Pass the op through the interceptor, with the supplied result from the
+// server, returning the error that would reach the kernel.
+func (t *FaultsTest) serve(op interface{}, serverErr error) error {
+	ctx, err := t.faults.InterceptOp(t.ctx, op)
+	if err != nil {
+		return err
+	}
+
+	return t.faults.InterceptReply(ctx, op, serverErr)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FaultsTest) NoFaults() {
+	for i := 0; i < 10; i++ {
+		ExpectEq(nil, t.serve(&fuseops.ReadFileOp{}, nil))
+		ExpectEq(nil, t.serve(&fuseops.WriteFileOp{Data: make([]byte, 1<<20)}, nil))
+	}
+
+	ExpectEq(syscall.ENOENT, t.serve(&fuseops.LookUpInodeOp{}, syscall.ENOENT))
+}
+
+func (t *FaultsTest) ReadErrorEvery() {
+	t.faults.Set(errorfs.FaultConfig{ReadErrorEvery: 3})
+
+	var errs []error
+	for i := 0; i < 6; i++ {
+		errs = append(errs, t.serve(&fuseops.ReadFileOp{}, nil))
+	}
+
+	ExpectThat(errs, ElementsAre(nil, nil, syscall.EIO, nil, nil, syscall.EIO))
+
+	// Other ops are unaffected.
+	ExpectEq(nil, t.serve(&fuseops.LookUpInodeOp{}, nil))
+}
+
+func (t *FaultsTest) WriteLimit() {
+	t.faults.Set(errorfs.FaultConfig{WriteLimit: 10})
+
+	ExpectEq(nil, t.serve(&fuseops.WriteFileOp{Data: make([]byte, 4)}, nil))
+
+	// A failed write doesn't count.
+	ExpectEq(syscall.EIO, t.serve(&fuseops.WriteFileOp{Data: make([]byte, 4)}, syscall.EIO))
+
+	ExpectEq(nil, t.serve(&fuseops.WriteFileOp{Data: make([]byte, 6)}, nil))
+	ExpectEq(syscall.ENOSPC, t.serve(&fuseops.WriteFileOp{Data: make([]byte, 1)}, nil))
+
+	// Setting the config again starts afresh.
+	t.faults.Set(errorfs.FaultConfig{WriteLimit: 10})
+	ExpectEq(nil, t.serve(&fuseops.WriteFileOp{Data: make([]byte, 1)}, nil))
+}
+
+func (t *FaultsTest) Latency() {
+	const latency = 50 * time.Millisecond
+	t.faults.Set(errorfs.FaultConfig{Latency: latency, LatencyEvery: 2})
+
+	start := time.Now()
+	t.serve(&fuseops.LookUpInodeOp{}, nil)
+	ExpectLt(time.Since(start), latency)
+
+	start = time.Now()
+	t.serve(&fuseops.LookUpInodeOp{}, nil)
+	ExpectGe(time.Since(start), latency)
+}
+
+func (t *FaultsTest) LatencyInterrupted() {
+	t.faults.Set(errorfs.FaultConfig{Latency: time.Hour})
+
+	ctx, cancel := context.WithCancel(t.ctx)
+	cancel()
+
+	t.ctx = ctx
+	ExpectEq(nil, t.serve(&fuseops.LookUpInodeOp{}, nil))
+}
+
+func (t *FaultsTest) ParseFaultConfig() {
+	cfg, err := errorfs.ParseFaultConfig(`
+# Fail reads.
+read_error_every=10
+write_limit=1048576
+latency=200ms latency_every=50
+`)
+
+	AssertEq(nil, err)
+	ExpectEq(10, cfg.ReadErrorEvery)
+	ExpectEq(1048576, cfg.WriteLimit)
+	ExpectEq(200*time.Millisecond, cfg.Latency)
+	ExpectEq(50, cfg.LatencyEvery)
+
+	_, err = errorfs.ParseFaultConfig("taco=1")
+	ExpectThat(err, Error(HasSubstr("Unknown key")))
+
+	_, err = errorfs.ParseFaultConfig("latency")
+	ExpectThat(err, Error(HasSubstr("key=value")))
+
+	_, err = errorfs.ParseFaultConfig("read_error_every=x")
+	ExpectThat(err, Error(HasSubstr("read_error_every")))
+}
@@ -45,6 +45,11 @@ type helloFS struct {
 	fuseutil.NotImplementedFileSystem
 
 	Clock timeutil.Clock
+
+	// Whether the kernel will stop sending OpenDir and ReleaseDirHandle ops if
+	// we decline one, as it does when mounted with EnableNoOpendirSupport. Set
+	// by Init and constant thereafter.
+	noOpendir bool
 }
 
 const (
@@ -194,9 +199,19 @@ func (fs *helloFS) GetInodeAttributes(
 	return nil
 }
 
+func (fs *helloFS) Init(op *fuseops.InitOp) {
+	fs.noOpendir = op.NoOpendir()
+}
+
 func (fs *helloFS) OpenDir(
 	ctx context.Context,
 	op *fuseops.OpenDirOp) error {
+	// We keep no state for directory handles, so if the kernel is able to do
+	// without opening directories, tell it not to bother.
+	if fs.noOpendir {
+		return fuse.ENOSYS
+	}
+
 	// Allow opening any directory.
 	return nil
 }
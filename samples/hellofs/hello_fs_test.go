@@ -50,6 +50,19 @@ func (t *HelloFSTest) SetUp(ti *TestInfo) {
 	t.SampleTest.SetUp(ti)
 }
 
+// The same tests, with the kernel asked to do without OpenDir ops, which the
+// file system declines.
+type NoOpendirTest struct {
+	HelloFSTest
+}
+
+func init() { RegisterTestSuite(&NoOpendirTest{}) }
+
+func (t *NoOpendirTest) SetUp(ti *TestInfo) {
+	t.MountConfig.EnableNoOpendirSupport = true
+	t.HelloFSTest.SetUp(ti)
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Test functions
 ////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,931 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package httpfs contains a read-only file system that mirrors a tree of files
+// served over HTTP.
+//
+// Directories are listed either by parsing the HTML indexes that most web
+// servers generate for them, or with WebDAV PROPFIND requests. Files are read
+// with range requests, so that only the parts that are used are transferred.
+//
+// The contents of files may be cached in one of two ways, chosen by
+// Config.DirectIO:
+//
+//   - By default reads go through the kernel's page cache, which serves
+//     repeated reads without a round trip and reads ahead of sequential
+//     readers. Each time a file is opened, a conditional GET asks the server
+//     whether it has changed, and the cache is kept only if it hasn't. A file
+//     that changes while open may be seen in a mixture of versions.
+//   - With direct IO every read goes to the server, so readers always see the
+//     latest contents at the cost of a round trip per read, even of data that
+//     was read a moment ago.
+//
+// Files whose size the server doesn't report are always opened with direct
+// IO, since the kernel doesn't read beyond the size that it knows.
+package httpfs
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"golang.org/x/net/html"
+)
+
+// Config configures NewHTTPFS.
+type Config struct {
+	// List directories with WebDAV PROPFIND requests, rather than by parsing
+	// HTML indexes. Listings from WebDAV include the attributes of each file,
+	// which saves a HEAD request per file looked up.
+	WebDAV bool
+
+	// Open every file with direct IO. See the package documentation.
+	DirectIO bool
+
+	// How long the attributes of files and the contents of directory listings
+	// may be cached, by both the kernel and the file system, before the server
+	// is asked again.
+	AttributeTTL time.Duration
+
+	// The owner reported for every file.
+	Uid uint32
+	Gid uint32
+
+	// The client with which to make requests. The default is
+	// http.DefaultClient.
+	Client *http.Client
+}
+
+// NewHTTPFS returns a file system that mirrors the files beneath the supplied
+// URL, which must name a directory.
+func NewHTTPFS(rawURL string, cfg Config) (fuse.Server, error) {
+	root, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse: %v", err)
+	}
+
+	if root.Scheme != "http" && root.Scheme != "https" {
+		return nil, fmt.Errorf("Unsupported URL scheme: %q", root.Scheme)
+	}
+
+	if !strings.HasSuffix(root.Path, "/") {
+		root.Path += "/"
+	}
+
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+
+	fs := &httpFS{
+		root: root,
+		cfg:  cfg,
+		inodes: map[fuseops.InodeID]*inode{
+			fuseops.RootInodeID: {
+				info:        fileInfo{dir: true, known: true},
+				lookupCount: 1,
+			},
+		},
+		ids:        map[string]fuseops.InodeID{"": fuseops.RootInodeID},
+		nextInode:  fuseops.RootInodeID + 1,
+		dirs:       make(map[fuseops.HandleID][]entry),
+		nextHandle: 1,
+	}
+
+	// Make sure that the server can be reached and lists the directory.
+	if _, err := fs.listing(context.Background(), fuseops.RootInodeID); err != nil {
+		return nil, fmt.Errorf("Listing %v: %v", root, err)
+	}
+
+	return fuseutil.NewFileSystemServer(fs), nil
+}
+
+// What the server has said about a file or directory.
+type fileInfo struct {
+	dir bool
+
+	// Whether the fields below have been filled in. HTML indexes say only
+	// whether each entry is a directory.
+	known bool
+
+	// The size of the file, or -1 if the server doesn't say.
+	size int64
+
+	mtime time.Time
+
+	// Validators for conditional requests, as sent by the server. Either may be
+	// empty.
+	etag         string
+	lastModified string
+}
+
+// Return true if the two describe the same version of a file.
+func (info fileInfo) sameVersion(other fileInfo) bool {
+	if info.size != other.size {
+		return false
+	}
+
+	switch {
+	case info.etag != "" && other.etag != "":
+		return info.etag == other.etag
+
+	case info.lastModified != "" && other.lastModified != "":
+		return info.lastModified == other.lastModified
+	}
+
+	return false
+}
+
+// An entry in a directory listing.
+type entry struct {
+	name string
+	info fileInfo
+}
+
+type inode struct {
+	// The path of the inode relative to the root URL, without leading or
+	// trailing slashes. Immutable.
+	path string
+
+	info fileInfo
+
+	// When info was last confirmed by the server.
+	fetched time.Time
+
+	// For directories, the most recent listing, and when it was made. Nil if
+	// the directory hasn't been listed.
+	entries []entry
+	listed  time.Time
+
+	// The number of references that the kernel holds to the inode. See notes on
+	// fuseops.ForgetInodeOp.
+	lookupCount uint64
+}
+
+type httpFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	// The URL of the root directory, with a trailing slash. Immutable.
+	root *url.URL
+
+	cfg Config
+
+	// Guards everything below, as well as the fields of each inode. Never held
+	// during a request to the server.
+	mu sync.Mutex
+
+	// The inodes that the kernel knows about, by ID and by path.
+	//
+	// INVARIANT: For each p, id of ids, inodes[id].path == p
+	inodes map[fuseops.InodeID]*inode // GUARDED_BY(mu)
+	ids    map[string]fuseops.InodeID // GUARDED_BY(mu)
+
+	// The ID to give the next inode.
+	nextInode fuseops.InodeID // GUARDED_BY(mu)
+
+	// The listing taken when each directory handle was opened.
+	dirs       map[fuseops.HandleID][]entry // GUARDED_BY(mu)
+	nextHandle fuseops.HandleID             // GUARDED_BY(mu)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Requests
+////////////////////////////////////////////////////////////////////////
+
+// Return the URL of the file or directory with the supplied path.
+func (fs *httpFS) url(p string, dir bool) *url.URL {
+	if dir && p != "" {
+		p += "/"
+	}
+
+	return fs.root.ResolveReference(&url.URL{Path: p})
+}
+
+// Convert an unexpected HTTP status to an errno.
+func statusError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return fuse.ENOENT
+
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return syscall.EACCES
+	}
+
+	return fuse.EIO
+}
+
+// Send a request, returning EINTR if the op is interrupted and EIO for any
+// other failure. On success the caller must close the response body.
+func (fs *httpFS) do(
+	ctx context.Context,
+	method string,
+	u *url.URL,
+	header http.Header,
+	body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, fuse.EIO
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	// Ask for the contents as they are, so that sizes and ranges refer to the
+	// bytes that readers see.
+	req.Header.Set("Accept-Encoding", "identity")
+
+	resp, err := fs.cfg.Client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fuse.EINTR
+		}
+
+		return nil, fuse.EIO
+	}
+
+	return resp, nil
+}
+
+// Read a file's attributes from the headers of a response for its contents.
+func headerInfo(resp *http.Response) fileInfo {
+	info := fileInfo{
+		known:        true,
+		size:         resp.ContentLength,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+
+	info.mtime, _ = http.ParseTime(info.lastModified)
+
+	return info
+}
+
+// Fetch the attributes of the file with the supplied path.
+func (fs *httpFS) head(ctx context.Context, p string) (fileInfo, error) {
+	resp, err := fs.do(ctx, "HEAD", fs.url(p, false), nil, nil)
+	if err != nil {
+		return fileInfo{}, err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fileInfo{}, statusError(resp)
+	}
+
+	return headerInfo(resp), nil
+}
+
+// Ask the server whether the file with the supplied path has changed since
+// the version described by old, returning its current attributes.
+func (fs *httpFS) validate(
+	ctx context.Context,
+	p string,
+	old fileInfo) (info fileInfo, changed bool, err error) {
+	header := make(http.Header)
+	switch {
+	case old.etag != "":
+		header.Set("If-None-Match", old.etag)
+
+	case old.lastModified != "":
+		header.Set("If-Modified-Since", old.lastModified)
+
+	default:
+		// There's nothing to validate against.
+		info, err = fs.head(ctx, p)
+		return info, true, err
+	}
+
+	resp, err := fs.do(ctx, "GET", fs.url(p, false), header, nil)
+	if err != nil {
+		return fileInfo{}, false, err
+	}
+
+	// The body, if any, isn't wanted: reads fetch only the ranges that they
+	// need.
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return old, false, nil
+
+	case http.StatusOK:
+		// Not every server supports conditional requests, so compare the
+		// validators as well.
+		info = headerInfo(resp)
+		return info, !info.sameVersion(old), nil
+	}
+
+	return fileInfo{}, false, statusError(resp)
+}
+
+// Read from the file with the supplied path at the supplied offset.
+func (fs *httpFS) readAt(
+	ctx context.Context,
+	p string,
+	dst []byte,
+	off int64) (int, error) {
+	header := make(http.Header)
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(dst))-1))
+
+	resp, err := fs.do(ctx, "GET", fs.url(p, false), header, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+
+	case http.StatusOK:
+		// The server ignores ranges, so skip to the offset.
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err == io.EOF {
+			return 0, nil
+		} else if err != nil {
+			return 0, fs.bodyError(ctx)
+		}
+
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The offset is at or beyond the end of the file.
+		return 0, nil
+
+	default:
+		return 0, statusError(resp)
+	}
+
+	n, err := io.ReadFull(resp.Body, dst)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	if err != nil {
+		return 0, fs.bodyError(ctx)
+	}
+
+	return n, nil
+}
+
+// Return the error for a failure to read a response body.
+func (fs *httpFS) bodyError(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return fuse.EINTR
+	}
+
+	return fuse.EIO
+}
+
+// List the directory with the supplied path.
+func (fs *httpFS) list(ctx context.Context, p string) ([]entry, error) {
+	if fs.cfg.WebDAV {
+		return fs.propfind(ctx, p)
+	}
+
+	u := fs.url(p, true)
+	resp, err := fs.do(ctx, "GET", u, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp)
+	}
+
+	entries, err := parseIndex(u, resp.Body)
+	if err != nil {
+		return nil, fs.bodyError(ctx)
+	}
+
+	return entries, nil
+}
+
+// Return the name of the entry of the directory with the supplied URL to
+// which the link refers, along with whether the link is to a directory. Links
+// to anything other than a child of the directory, such as those that sort
+// the index or lead to its parent, are ignored.
+func childName(dir *url.URL, href string) (string, bool, bool) {
+	u, err := dir.Parse(href)
+	if err != nil || u.Host != dir.Host || u.RawQuery != "" {
+		return "", false, false
+	}
+
+	rest, ok := strings.CutPrefix(u.Path, dir.Path)
+	if !ok {
+		return "", false, false
+	}
+
+	name, isDir := strings.CutSuffix(rest, "/")
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", false, false
+	}
+
+	return name, isDir, true
+}
+
+// Parse an HTML directory index, such as those generated by Apache, nginx or
+// net/http.FileServer, into the entries to which it links.
+func parseIndex(dir *url.URL, r io.Reader) ([]entry, error) {
+	var entries []entry
+	seen := make(map[string]bool)
+
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return entries, nil
+			}
+
+			return nil, z.Err()
+
+		case html.StartTagToken:
+			tag, hasAttr := z.TagName()
+			if string(tag) != "a" {
+				continue
+			}
+
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				if string(key) != "href" {
+					continue
+				}
+
+				name, isDir, ok := childName(dir, string(val))
+				if ok && !seen[name] {
+					seen[name] = true
+					entries = append(entries, entry{name: name, info: fileInfo{dir: isDir, known: isDir}})
+				}
+			}
+		}
+	}
+}
+
+// The properties requested by PROPFIND.
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:">
+  <prop>
+    <resourcetype/>
+    <getcontentlength/>
+    <getlastmodified/>
+    <getetag/>
+  </prop>
+</propfind>`
+
+// The parts of a PROPFIND response that are used. See RFC 4918.
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength string `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+				ETag          string `xml:"getetag"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// List the directory with the supplied path using WebDAV.
+func (fs *httpFS) propfind(ctx context.Context, p string) ([]entry, error) {
+	header := make(http.Header)
+	header.Set("Depth", "1")
+	header.Set("Content-Type", `application/xml; charset="utf-8"`)
+
+	u := fs.url(p, true)
+	resp, err := fs.do(ctx, "PROPFIND", u, header, strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, statusError(resp)
+	}
+
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		if ctx.Err() != nil {
+			return nil, fuse.EINTR
+		}
+
+		return nil, fuse.EIO
+	}
+
+	var entries []entry
+	for _, r := range ms.Responses {
+		// The response includes the directory itself, which isn't a child.
+		name, isDir, ok := childName(u, r.Href)
+		if !ok {
+			continue
+		}
+
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+
+			info := fileInfo{
+				dir:          isDir || ps.Prop.ResourceType.Collection != nil,
+				known:        true,
+				size:         -1,
+				etag:         ps.Prop.ETag,
+				lastModified: ps.Prop.LastModified,
+			}
+
+			if n, err := strconv.ParseInt(ps.Prop.ContentLength, 10, 64); err == nil {
+				info.size = n
+			}
+
+			info.mtime, _ = http.ParseTime(info.lastModified)
+			entries = append(entries, entry{name: name, info: info})
+			break
+		}
+	}
+
+	return entries, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func (fs *httpFS) attributes(info fileInfo) fuseops.InodeAttributes {
+	attrs := fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0444,
+		Atime: info.mtime,
+		Mtime: info.mtime,
+		Ctime: info.mtime,
+		Uid:   fs.cfg.Uid,
+		Gid:   fs.cfg.Gid,
+	}
+
+	if info.dir {
+		attrs.Mode = 0555 | os.ModeDir
+	} else if info.size > 0 {
+		attrs.Size = uint64(info.size)
+	}
+
+	return attrs
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *httpFS) getInode(id fuseops.InodeID) *inode {
+	in := fs.inodes[id]
+	if in == nil {
+		panic(fmt.Sprintf("Unknown inode: %v", id))
+	}
+
+	return in
+}
+
+// Return the listing of the directory, asking the server again if the cached
+// one is too old.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *httpFS) listing(ctx context.Context, id fuseops.InodeID) ([]entry, error) {
+	fs.mu.Lock()
+	in := fs.getInode(id)
+	p := in.path
+	if in.entries != nil && time.Since(in.listed) < fs.cfg.AttributeTTL {
+		entries := in.entries
+		fs.mu.Unlock()
+		return entries, nil
+	}
+	fs.mu.Unlock()
+
+	entries, err := fs.list(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	// An empty directory must still count as listed.
+	if entries == nil {
+		entries = []entry{}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in.entries = entries
+	in.listed = time.Now()
+
+	return entries, nil
+}
+
+// Fill in an entry for the file or directory with the supplied path and
+// attributes, incrementing the lookup count of its inode and allocating one if
+// the kernel doesn't already know about the path.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *httpFS) entry(p string, info fileInfo, e *fuseops.ChildInodeEntry) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	id, ok := fs.ids[p]
+
+	// A file that has become a directory, or vice versa, is a different inode.
+	if ok && fs.inodes[id].info.dir != info.dir {
+		delete(fs.ids, p)
+		ok = false
+	}
+
+	if !ok {
+		id = fs.nextInode
+		fs.nextInode++
+
+		fs.inodes[id] = &inode{path: p}
+		fs.ids[p] = id
+	}
+
+	in := fs.inodes[id]
+	in.info = info
+	in.fetched = time.Now()
+	in.lookupCount++
+
+	e.Child = id
+	e.Attributes = fs.attributes(info)
+	e.AttributesExpiration = in.fetched.Add(fs.cfg.AttributeTTL)
+	e.EntryExpiration = e.AttributesExpiration
+}
+
+// Decrement the lookup count of the inode, forgetting it once the kernel no
+// longer refers to it.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *httpFS) forget(id fuseops.InodeID, n uint64) {
+	in := fs.getInode(id)
+	if n > in.lookupCount {
+		panic(fmt.Sprintf("Forgetting %d references to inode %d with %d", n, id, in.lookupCount))
+	}
+
+	in.lookupCount -= n
+	if in.lookupCount != 0 || id == fuseops.RootInodeID {
+		return
+	}
+
+	delete(fs.inodes, id)
+	if fs.ids[in.path] == id {
+		delete(fs.ids, in.path)
+	}
+}
+
+// Record fresh attributes for the inode.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *httpFS) update(id fuseops.InodeID, info fileInfo) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in := fs.getInode(id)
+	in.info = info
+	in.fetched = time.Now()
+}
+
+// Return a stable number for a directory entry. The kernel doesn't use it,
+// but it must not be zero, since readdir(3) implementations may skip such
+// entries.
+func direntInode(p string) fuseops.InodeID {
+	h := fnv.New64a()
+	h.Write([]byte(p))
+	return fuseops.InodeID(h.Sum64() | 1)
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *httpFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	entries, err := fs.listing(ctx, op.Parent)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	p := fs.getInode(op.Parent).path
+	fs.mu.Unlock()
+
+	if p != "" {
+		p += "/"
+	}
+	p += op.Name
+
+	for _, e := range entries {
+		if e.name != op.Name {
+			continue
+		}
+
+		info := e.info
+		if !info.known {
+			info, err = fs.head(ctx, p)
+			if err != nil {
+				return err
+			}
+		}
+
+		fs.entry(p, info, &op.Entry)
+		return nil
+	}
+
+	return fuse.ENOENT
+}
+
+func (fs *httpFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	in := fs.getInode(op.Inode)
+	p, info, fetched := in.path, in.info, in.fetched
+	fs.mu.Unlock()
+
+	if !info.dir && time.Since(fetched) >= fs.cfg.AttributeTTL {
+		var err error
+		info, err = fs.head(ctx, p)
+		if err != nil {
+			return err
+		}
+
+		fs.update(op.Inode, info)
+		fetched = time.Now()
+	}
+
+	op.Attributes = fs.attributes(info)
+	op.AttributesExpiration = fetched.Add(fs.cfg.AttributeTTL)
+
+	return nil
+}
+
+func (fs *httpFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.forget(op.Inode, op.N)
+
+	return nil
+}
+
+func (fs *httpFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, e := range op.Entries {
+		fs.forget(e.Inode, e.N)
+	}
+
+	return nil
+}
+
+func (fs *httpFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	entries, err := fs.listing(ctx, op.Inode)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Handle = fs.nextHandle
+	fs.nextHandle++
+	fs.dirs[op.Handle] = entries
+
+	return nil
+}
+
+func (fs *httpFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	fs.mu.Lock()
+	entries, ok := fs.dirs[op.Handle]
+	p := fs.getInode(op.Inode).path
+	fs.mu.Unlock()
+
+	if !ok {
+		return syscall.EBADF
+	}
+
+	if op.Offset > fuseops.DirOffset(len(entries)) {
+		return nil
+	}
+
+	for i, e := range entries[op.Offset:] {
+		d := fuseutil.Dirent{
+			Offset: op.Offset + fuseops.DirOffset(i) + 1,
+			Inode:  direntInode(p + "/" + e.name),
+			Name:   e.name,
+			Type:   fuseutil.DT_File,
+		}
+
+		if e.info.dir {
+			d.Type = fuseutil.DT_Directory
+		}
+
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], d)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *httpFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	delete(fs.dirs, op.Handle)
+
+	return nil
+}
+
+func (fs *httpFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.mu.Lock()
+	in := fs.getInode(op.Inode)
+	p, old := in.path, in.info
+	fs.mu.Unlock()
+
+	if fs.cfg.DirectIO || old.size < 0 {
+		op.UseDirectIO = true
+		return nil
+	}
+
+	info, changed, err := fs.validate(ctx, p, old)
+	if err != nil {
+		return err
+	}
+
+	fs.update(op.Inode, info)
+
+	// If the file has become one of unknown size, the kernel mustn't use the
+	// old one to limit reads.
+	if info.size < 0 {
+		op.UseDirectIO = true
+		return nil
+	}
+
+	op.KeepPageCache = !changed
+
+	return nil
+}
+
+func (fs *httpFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	p := fs.getInode(op.Inode).path
+	fs.mu.Unlock()
+
+	if len(op.Dst) == 0 {
+		return nil
+	}
+
+	var err error
+	op.BytesRead, err = fs.readAt(ctx, p, op.Dst, op.Offset)
+
+	return err
+}
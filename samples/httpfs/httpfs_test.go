@@ -0,0 +1,267 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpfs_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/samples"
+	"github.com/jacobsa/fuse/samples/httpfs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/webdav"
+)
+
+func TestHTTPFS(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Common tests, run against each kind of server. Embedders choose the server
+// and configuration and then call setUp.
+type httpFSTest struct {
+	samples.SampleTest
+
+	// The directory served.
+	remote string
+
+	server *httptest.Server
+
+	// The number of range requests that the server has received.
+	reads int64
+}
+
+func (t *httpFSTest) setUp(
+	ti *TestInfo,
+	handler func(dir string) http.Handler,
+	cfg httpfs.Config) {
+	var err error
+
+	t.remote, err = ioutil.TempDir("", "httpfs_test")
+	AssertEq(nil, err)
+
+	// Populate the directory:
+	//
+	//     foo            "taco"
+	//     dir/
+	//     dir/bar        "burrito"
+	//     dir/sub/
+	//
+	err = os.MkdirAll(path.Join(t.remote, "dir", "sub"), 0755)
+	AssertEq(nil, err)
+
+	t.writeRemote("foo", "taco")
+	t.writeRemote("dir/bar", "burrito")
+
+	h := handler(t.remote)
+	t.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && r.Header.Get("Range") != "" {
+			atomic.AddInt64(&t.reads, 1)
+		}
+
+		h.ServeHTTP(w, r)
+	}))
+
+	t.Server, err = httpfs.NewHTTPFS(t.server.URL, cfg)
+	AssertEq(nil, err)
+
+	t.MountConfig.ReadOnly = true
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *httpFSTest) TearDown() {
+	t.SampleTest.TearDown()
+	t.server.Close()
+
+	err := os.RemoveAll(t.remote)
+	AssertEq(nil, err)
+}
+
+// Write a file on the server, with a modification time that differs from any
+// that it has had before.
+func (t *httpFSTest) writeRemote(name string, contents string) {
+	p := path.Join(t.remote, name)
+	err := ioutil.WriteFile(p, []byte(contents), 0644)
+	AssertEq(nil, err)
+
+	mtime := time.Now().Add(time.Duration(len(contents)) * time.Hour)
+	err = os.Chtimes(p, mtime, mtime)
+	AssertEq(nil, err)
+}
+
+func fileServer(dir string) http.Handler {
+	return http.FileServer(http.Dir(dir))
+}
+
+func webDAVServer(dir string) http.Handler {
+	return &webdav.Handler{
+		FileSystem: webdav.Dir(dir),
+		LockSystem: webdav.NewMemLS(),
+	}
+}
+
+// Return the sorted names in the directory.
+func readNames(dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	AssertEq(nil, err)
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+////////////////////////////////////////////////////////////////////////
+// Common tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *httpFSTest) ReadDir() {
+	ExpectThat(readNames(t.Dir), ElementsAre("dir", "foo"))
+	ExpectThat(readNames(path.Join(t.Dir, "dir")), ElementsAre("bar", "sub"))
+	ExpectThat(readNames(path.Join(t.Dir, "dir", "sub")), ElementsAre())
+}
+
+func (t *httpFSTest) Stat() {
+	fi, err := os.Stat(path.Join(t.Dir, "dir", "bar"))
+	AssertEq(nil, err)
+
+	ExpectEq(len("burrito"), fi.Size())
+	ExpectEq(os.FileMode(0444), fi.Mode())
+
+	fi, err = os.Stat(path.Join(t.Dir, "dir"))
+	AssertEq(nil, err)
+	ExpectEq(0555|os.ModeDir, fi.Mode())
+}
+
+func (t *httpFSTest) Missing() {
+	_, err := os.Stat(path.Join(t.Dir, "qux"))
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+}
+
+func (t *httpFSTest) ReadFile() {
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "dir", "bar"))
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *httpFSTest) ReadAt() {
+	f, err := os.Open(path.Join(t.Dir, "dir", "bar"))
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	buf := make([]byte, 3)
+	n, err := f.ReadAt(buf, 2)
+	AssertEq(nil, err)
+	ExpectEq("rri", string(buf[:n]))
+}
+
+func (t *httpFSTest) ChangedOnServer() {
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	t.writeRemote("foo", "enchilada")
+
+	contents, err = ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("enchilada", string(contents))
+}
+
+func (t *httpFSTest) ReadOnly() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("queso"), 0644)
+	ExpectThat(err, Error(HasSubstr("read-only")))
+}
+
+////////////////////////////////////////////////////////////////////////
+// HTML indexes
+////////////////////////////////////////////////////////////////////////
+
+type IndexTest struct {
+	httpFSTest
+}
+
+func init() { RegisterTestSuite(&IndexTest{}) }
+
+func (t *IndexTest) SetUp(ti *TestInfo) {
+	t.setUp(ti, fileServer, httpfs.Config{})
+}
+
+func (t *IndexTest) PageCacheKeptWhenUnchanged() {
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	reads := atomic.LoadInt64(&t.reads)
+	ExpectGt(reads, 0)
+
+	// The second time, the page cache serves the read.
+	contents, err = ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+	ExpectEq(reads, atomic.LoadInt64(&t.reads))
+}
+
+////////////////////////////////////////////////////////////////////////
+// WebDAV
+////////////////////////////////////////////////////////////////////////
+
+type WebDAVTest struct {
+	httpFSTest
+}
+
+func init() { RegisterTestSuite(&WebDAVTest{}) }
+
+func (t *WebDAVTest) SetUp(ti *TestInfo) {
+	t.setUp(ti, webDAVServer, httpfs.Config{WebDAV: true})
+}
+
+////////////////////////////////////////////////////////////////////////
+// Direct IO
+////////////////////////////////////////////////////////////////////////
+
+type DirectIOTest struct {
+	httpFSTest
+}
+
+func init() { RegisterTestSuite(&DirectIOTest{}) }
+
+func (t *DirectIOTest) SetUp(ti *TestInfo) {
+	t.setUp(ti, fileServer, httpfs.Config{DirectIO: true})
+}
+
+func (t *DirectIOTest) EveryReadReachesServer() {
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	reads := atomic.LoadInt64(&t.reads)
+
+	contents, err = ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+	ExpectGt(atomic.LoadInt64(&t.reads), reads)
+}
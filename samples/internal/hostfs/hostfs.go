@@ -0,0 +1,127 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hostfs contains helpers shared by the sample file systems that keep
+// their contents in a directory of the host file system.
+package hostfs
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/sys/unix"
+)
+
+// Errno converts an error from the os or unix packages to the errno that the
+// kernel should see, as given by fuse.ErrnoFromError. Anything else becomes
+// EIO, and is passed on as it is so that it can be logged.
+func Errno(err error) error {
+	switch errno := fuse.ErrnoFromError(err); errno {
+	case 0:
+		return nil
+
+	case syscall.EIO:
+		return err
+
+	default:
+		return errno
+	}
+}
+
+// FileMode converts the mode bits of a stat structure.
+func FileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	switch mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		m |= os.ModeDir
+	case unix.S_IFLNK:
+		m |= os.ModeSymlink
+	case unix.S_IFIFO:
+		m |= os.ModeNamedPipe
+	case unix.S_IFSOCK:
+		m |= os.ModeSocket
+	case unix.S_IFCHR:
+		m |= os.ModeDevice | os.ModeCharDevice
+	case unix.S_IFBLK:
+		m |= os.ModeDevice
+	}
+
+	if mode&unix.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+
+	if mode&unix.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+
+	if mode&unix.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+
+	return m
+}
+
+// UnixMode is the inverse of FileMode, for mknod(2).
+func UnixMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	switch {
+	case m&os.ModeNamedPipe != 0:
+		mode |= unix.S_IFIFO
+	case m&os.ModeSocket != 0:
+		mode |= unix.S_IFSOCK
+	case m&os.ModeCharDevice != 0:
+		mode |= unix.S_IFCHR
+	case m&os.ModeDevice != 0:
+		mode |= unix.S_IFBLK
+	default:
+		mode |= unix.S_IFREG
+	}
+
+	if m&os.ModeSetuid != 0 {
+		mode |= unix.S_ISUID
+	}
+
+	if m&os.ModeSetgid != 0 {
+		mode |= unix.S_ISGID
+	}
+
+	if m&os.ModeSticky != 0 {
+		mode |= unix.S_ISVTX
+	}
+
+	return mode
+}
+
+// Attributes returns the attributes of the host file with the supplied stat
+// structure.
+func Attributes(st *unix.Stat_t) fuseops.InodeAttributes {
+	// Report what the host has allocated, so that sparse files look sparse.
+	blocks := uint64(st.Blocks)
+	return fuseops.InodeAttributes{
+		Size:      uint64(st.Size),
+		Blocks:    &blocks,
+		BlockSize: uint32(st.Blksize),
+		Nlink:     uint32(st.Nlink),
+		Mode:      FileMode(uint32(st.Mode)),
+		Rdev:      uint32(st.Rdev),
+		Atime:     time.Unix(st.Atim.Unix()),
+		Mtime:     time.Unix(st.Mtim.Unix()),
+		Ctime:     time.Unix(st.Ctim.Unix()),
+		Uid:       st.Uid,
+		Gid:       st.Gid,
+	}
+}
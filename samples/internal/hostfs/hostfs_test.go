@@ -0,0 +1,38 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostfs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestUnixMode(t *testing.T) {
+	modes := []os.FileMode{
+		0644,
+		0755 | os.ModeSetuid | os.ModeSetgid,
+		0777 | os.ModeSticky,
+		0600 | os.ModeNamedPipe,
+		0600 | os.ModeSocket,
+		0660 | os.ModeDevice,
+		0660 | os.ModeDevice | os.ModeCharDevice,
+	}
+
+	for _, m := range modes {
+		if got := FileMode(UnixMode(m)); got != m {
+			t.Errorf("%v: round trip gave %v", m, got)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loopbackfs
+
+import (
+	"context"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/samples/internal/hostfs"
+	"golang.org/x/sys/unix"
+)
+
+// fallocate(2) is specific to Linux. Elsewhere the embedded
+// NotImplementedFileSystem returns ENOSYS.
+func (fs *loopbackFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	fh, err := fs.files.Get(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	err = unix.Fallocate(
+		int(fh.f.Fd()),
+		op.Mode,
+		int64(op.Offset),
+		int64(op.Length))
+
+	return hostfs.Errno(err)
+}
@@ -0,0 +1,881 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package loopbackfs contains a file system that mirrors a directory of the
+// host file system, passing every op through to it.
+package loopbackfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/fuse/samples/internal/hostfs"
+	"golang.org/x/sys/unix"
+)
+
+// Identifies a file in the host file system.
+type fileKey struct {
+	dev uint64
+	ino uint64
+}
+
+type inode struct {
+	// The host path at which the inode was most recently seen. Renames update
+	// it, but other links to the same file are not tracked, so ops on a hard
+	// link whose remembered name has been unlinked fail until it is looked up
+	// again under another name.
+	path string
+
+	key fileKey
+
+	// The number of references that the kernel holds to the inode. See notes on
+	// fuseops.ForgetInodeOp.
+	lookupCount uint64
+}
+
+type fileHandle struct {
+	f *os.File
+
+	// Whether the file was opened with O_APPEND, in which case the host file
+	// decides where writes go.
+	append bool
+}
+
+type dirHandle struct {
+	f *os.File
+
+	// The listing returned by the most recent ReadDir at offset zero.
+	entries []fuseutil.Dirent
+}
+
+type loopbackFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	// The host directory being mirrored.
+	root string
+
+	// Ops that touch the namespace hold mu throughout, so that the paths of
+	// inodes stay in step with the host. Reads and writes hold it only to find
+	// their handle.
+	mu sync.Mutex
+
+	// The inodes that the kernel knows about, by ID and by host file.
+	//
+	// INVARIANT: For each id, in of inodes, ids[in.key] is id or absent.
+	// INVARIANT: For each key, id of ids, inodes[id].key == key
+	inodes map[fuseops.InodeID]*inode  // GUARDED_BY(mu)
+	ids    map[fileKey]fuseops.InodeID // GUARDED_BY(mu)
+
+	// The ID to give the next inode.
+	nextInode fuseops.InodeID // GUARDED_BY(mu)
+
+	// Open files and directories.
+	files fuseutil.HandleTable[*fileHandle]
+	dirs  fuseutil.HandleTable[*dirHandle]
+
+	// Whether the kernel caches writes, in which case it decides the offsets of
+	// appending writes itself.
+	writebackCache bool // GUARDED_BY(mu)
+}
+
+// NewLoopbackFS creates a file system that mirrors the host directory at
+// root. Ops are performed on the host with the credentials of the current
+// process rather than those of the caller, and the modes of new files are
+// restricted by the process's umask.
+//
+// Attributes and entries aren't cached by the kernel, since the host
+// directory may change behind its back.
+func NewLoopbackFS(root string) (fuse.Server, error) {
+	fs, err := NewLoopbackFileSystem(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return fuseutil.NewFileSystemServer(fs), nil
+}
+
+// NewLoopbackFileSystem is like NewLoopbackFS, but returns the file system
+// itself, for wrapping in others before serving.
+func NewLoopbackFileSystem(root string) (fuseutil.FileSystem, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("Abs: %v", err)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Stat(root, &st); err != nil {
+		return nil, fmt.Errorf("Stat: %v", err)
+	}
+
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	key := keyOf(&st)
+	fs := &loopbackFS{
+		root: root,
+		inodes: map[fuseops.InodeID]*inode{
+			fuseops.RootInodeID: {path: root, key: key, lookupCount: 1},
+		},
+		ids:       map[fileKey]fuseops.InodeID{key: fuseops.RootInodeID},
+		nextInode: fuseops.RootInodeID + 1,
+	}
+
+	return fs, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func keyOf(st *unix.Stat_t) fileKey {
+	return fileKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *loopbackFS) getInodeOrDie(id fuseops.InodeID) *inode {
+	in := fs.inodes[id]
+	if in == nil {
+		panic(fmt.Sprintf("Unknown inode: %v", id))
+	}
+
+	return in
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *loopbackFS) childPath(parent fuseops.InodeID, name string) string {
+	return filepath.Join(fs.getInodeOrDie(parent).path, name)
+}
+
+// Fill in an entry for the file at the supplied host path, incrementing the
+// lookup count of its inode and allocating one if the kernel doesn't already
+// know about the file.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *loopbackFS) lookUp(path string, e *fuseops.ChildInodeEntry) error {
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	key := keyOf(&st)
+	id, ok := fs.ids[key]
+	if !ok {
+		id = fs.nextInode
+		fs.nextInode++
+
+		fs.inodes[id] = &inode{key: key}
+		fs.ids[key] = id
+	}
+
+	in := fs.inodes[id]
+	in.path = path
+	in.lookupCount++
+
+	e.Child = id
+	e.Attributes = hostfs.Attributes(&st)
+
+	return nil
+}
+
+// Decrement the lookup count of the inode, forgetting it once the kernel no
+// longer refers to it.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *loopbackFS) forget(id fuseops.InodeID, n uint64) {
+	in := fs.getInodeOrDie(id)
+	if n > in.lookupCount {
+		panic(fmt.Sprintf("Forgetting %d references to inode %d with %d", n, id, in.lookupCount))
+	}
+
+	in.lookupCount -= n
+	if in.lookupCount != 0 || id == fuseops.RootInodeID {
+		return
+	}
+
+	delete(fs.inodes, id)
+	if fs.ids[in.key] == id {
+		delete(fs.ids, in.key)
+	}
+}
+
+// Return the key of the file at the supplied path if removing that name will
+// remove the file itself, after which the host may give its inode number to
+// a new file. Such keys are dropped from fs.ids once the removal succeeds, so
+// that the new file gets a new inode.
+func lastLink(path string) (key fileKey, ok bool) {
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return
+	}
+
+	if st.Nlink > 1 && st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return
+	}
+
+	return keyOf(&st), true
+}
+
+// Apply the supplied security labels to a new file.
+func setSecurityContexts(path string, contexts []fuseops.SecurityContext) error {
+	for _, c := range contexts {
+		if err := unix.Lsetxattr(path, c.Name, c.Value, 0); err != nil {
+			return hostfs.Errno(err)
+		}
+	}
+
+	return nil
+}
+
+// Handle IDs start at one, so this returns an ID that isn't in use for nil.
+func derefHandle(h *fuseops.HandleID) fuseops.HandleID {
+	if h == nil {
+		return 0
+	}
+
+	return *h
+}
+
+// Return the flags with which to open a host file for the supplied kernel
+// flags.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *loopbackFS) hostFlags(flags fusekernel.OpenFlags) int {
+	f := int(flags) &^ (os.O_CREATE | os.O_EXCL | syscall.O_NOCTTY)
+
+	// With writeback caching the kernel works out where appending writes go,
+	// and may read through any handle to fill its cache.
+	if fs.writebackCache {
+		f &^= os.O_APPEND
+		if f&os.O_WRONLY != 0 {
+			f = f&^os.O_WRONLY | os.O_RDWR
+		}
+	}
+
+	return f
+}
+
+// Record a newly opened file, returning its handle.
+func (fs *loopbackFS) openHandle(f *os.File, flags int) fuseops.HandleID {
+	return fs.files.Add(&fileHandle{
+		f:      f,
+		append: flags&os.O_APPEND != 0,
+	})
+}
+
+// Read the whole of an open directory, from the start.
+func readDir(f *os.File) ([]fuseutil.Dirent, error) {
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, hostfs.Errno(err)
+	}
+
+	children, err := f.ReadDir(-1)
+	if err != nil {
+		return nil, hostfs.Errno(err)
+	}
+
+	var entries []fuseutil.Dirent
+	for _, child := range children {
+		// Skip entries that have disappeared since the listing.
+		fi, err := child.Info()
+		if err != nil {
+			continue
+		}
+
+		var ino uint64
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			ino = uint64(st.Ino)
+		}
+
+		var t fuseutil.DirentType
+		switch m := fi.Mode(); {
+		case m.IsDir():
+			t = fuseutil.DT_Directory
+		case m&os.ModeSymlink != 0:
+			t = fuseutil.DT_Link
+		case m&os.ModeNamedPipe != 0:
+			t = fuseutil.DT_FIFO
+		case m&os.ModeSocket != 0:
+			t = fuseutil.DT_Socket
+		case m&os.ModeCharDevice != 0:
+			t = fuseutil.DT_Char
+		case m&os.ModeDevice != 0:
+			t = fuseutil.DT_Block
+		default:
+			t = fuseutil.DT_File
+		}
+
+		entries = append(entries, fuseutil.Dirent{
+			Offset: fuseops.DirOffset(len(entries) + 1),
+			Inode:  fuseops.InodeID(ino),
+			Name:   child.Name(),
+			Type:   t,
+		})
+	}
+
+	return entries, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *loopbackFS) Init(op *fuseops.InitOp) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.writebackCache = op.Flags&fusekernel.InitWritebackCache != 0
+}
+
+func (fs *loopbackFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(fs.root, &st); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	op.BlockSize, op.IoSize = hostfs.BlockSizes(&st)
+	op.Blocks = st.Blocks
+	op.BlocksFree = st.Bfree
+	op.BlocksAvailable = st.Bavail
+	op.Inodes = st.Files
+	op.InodesFree = st.Ffree
+
+	return nil
+}
+
+func (fs *loopbackFS) SyncFS(
+	ctx context.Context,
+	op *fuseops.SyncFSOp) error {
+	return hostfs.Errno(syncfs(fs.root))
+}
+
+func (fs *loopbackFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.lookUp(fs.childPath(op.Parent, op.Name), &op.Entry)
+}
+
+func (fs *loopbackFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var st unix.Stat_t
+	if err := unix.Lstat(fs.getInodeOrDie(op.Inode).path, &st); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	op.Attributes = hostfs.Attributes(&st)
+
+	return nil
+}
+
+func (fs *loopbackFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path := fs.getInodeOrDie(op.Inode).path
+
+	if op.Size != nil {
+		var err error
+		if fh, err := fs.files.Get(derefHandle(op.Handle)); err == nil {
+			err = fh.f.Truncate(int64(*op.Size))
+		} else {
+			err = os.Truncate(path, int64(*op.Size))
+		}
+
+		if err != nil {
+			return hostfs.Errno(err)
+		}
+	}
+
+	if op.Mode != nil {
+		if err := os.Chmod(path, *op.Mode); err != nil {
+			return hostfs.Errno(err)
+		}
+	}
+
+	if op.Uid != nil || op.Gid != nil {
+		uid, gid := -1, -1
+		if op.Uid != nil {
+			uid = int(*op.Uid)
+		}
+
+		if op.Gid != nil {
+			gid = int(*op.Gid)
+		}
+
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return hostfs.Errno(err)
+		}
+	}
+
+	// Zero times are left unchanged.
+	if op.Atime != nil || op.Mtime != nil {
+		var atime, mtime time.Time
+		if op.Atime != nil {
+			atime = *op.Atime
+		}
+
+		if op.Mtime != nil {
+			mtime = *op.Mtime
+		}
+
+		if err := os.Chtimes(path, atime, mtime); err != nil {
+			return hostfs.Errno(err)
+		}
+	}
+
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	op.Attributes = hostfs.Attributes(&st)
+
+	return nil
+}
+
+func (fs *loopbackFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.forget(op.Inode, op.N)
+
+	return nil
+}
+
+func (fs *loopbackFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, e := range op.Entries {
+		fs.forget(e.Inode, e.N)
+	}
+
+	return nil
+}
+
+func (fs *loopbackFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path := fs.childPath(op.Parent, op.Name)
+	if err := os.Mkdir(path, op.Mode); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	if err := setSecurityContexts(path, op.SecurityContexts); err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	return fs.lookUp(path, &op.Entry)
+}
+
+func (fs *loopbackFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path := fs.childPath(op.Parent, op.Name)
+	if err := unix.Mknod(path, hostfs.UnixMode(op.Mode), int(op.Rdev)); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	if err := setSecurityContexts(path, op.SecurityContexts); err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	return fs.lookUp(path, &op.Entry)
+}
+
+func (fs *loopbackFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path := fs.childPath(op.Parent, op.Name)
+	flags := fs.hostFlags(op.OpenFlags) | os.O_CREATE | os.O_EXCL
+	f, err := os.OpenFile(path, flags, op.Mode.Perm())
+	if err != nil {
+		return hostfs.Errno(err)
+	}
+
+	err = setSecurityContexts(path, op.SecurityContexts)
+	if err == nil {
+		err = fs.lookUp(path, &op.Entry)
+	}
+
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+
+	op.Handle = fs.openHandle(f, flags)
+
+	return nil
+}
+
+func (fs *loopbackFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path := fs.childPath(op.Parent, op.Name)
+	if err := os.Symlink(op.Target, path); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	if err := setSecurityContexts(path, op.SecurityContexts); err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	return fs.lookUp(path, &op.Entry)
+}
+
+func (fs *loopbackFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path := fs.childPath(op.Parent, op.Name)
+	if err := os.Link(fs.getInodeOrDie(op.Target).path, path); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	return fs.lookUp(path, &op.Entry)
+}
+
+func (fs *loopbackFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	oldPath := fs.childPath(op.OldParent, op.OldName)
+	newPath := fs.childPath(op.NewParent, op.NewName)
+
+	// Renaming over the last link to another file removes it.
+	replaced, ok := lastLink(newPath)
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	if ok && oldPath != newPath {
+		delete(fs.ids, replaced)
+	}
+
+	// Move the inode and everything beneath it.
+	for _, in := range fs.inodes {
+		switch {
+		case in.path == oldPath:
+			in.path = newPath
+
+		case strings.HasPrefix(in.path, oldPath+"/"):
+			in.path = newPath + in.path[len(oldPath):]
+		}
+	}
+
+	return nil
+}
+
+func (fs *loopbackFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path := fs.childPath(op.Parent, op.Name)
+	key, ok := lastLink(path)
+	if err := unix.Rmdir(path); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	// The host may now give the inode number to a new file.
+	if ok {
+		delete(fs.ids, key)
+	}
+
+	return nil
+}
+
+func (fs *loopbackFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path := fs.childPath(op.Parent, op.Name)
+	key, ok := lastLink(path)
+	if err := unix.Unlink(path); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	if ok {
+		delete(fs.ids, key)
+	}
+
+	return nil
+}
+
+func (fs *loopbackFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f, err := os.Open(fs.getInodeOrDie(op.Inode).path)
+	if err != nil {
+		return hostfs.Errno(err)
+	}
+
+	op.Handle = fs.dirs.Add(&dirHandle{f: f})
+
+	return nil
+}
+
+func (fs *loopbackFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dh, err := fs.dirs.Get(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	// Take a fresh listing at the start, so that rewinddir sees changes.
+	if op.Offset == 0 || dh.entries == nil {
+		entries, err := readDir(dh.f)
+		if err != nil {
+			return err
+		}
+
+		dh.entries = entries
+	}
+
+	if op.Offset > fuseops.DirOffset(len(dh.entries)) {
+		return nil
+	}
+
+	for _, e := range dh.entries[op.Offset:] {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *loopbackFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	dh, err := fs.dirs.Remove(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	return hostfs.Errno(dh.f.Close())
+}
+
+func (fs *loopbackFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	flags := fs.hostFlags(op.OpenFlags)
+	f, err := os.OpenFile(fs.getInodeOrDie(op.Inode).path, flags, 0)
+	if err != nil {
+		return hostfs.Errno(err)
+	}
+
+	op.Handle = fs.openHandle(f, flags)
+
+	return nil
+}
+
+func (fs *loopbackFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fh, err := fs.files.Get(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	// Reads past the end are short, which is how the kernel learns of EOF.
+	op.BytesRead, err = fh.f.ReadAt(op.Dst, op.Offset)
+	if err == io.EOF {
+		return nil
+	}
+
+	return hostfs.Errno(err)
+}
+
+func (fs *loopbackFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fh, err := fs.files.Get(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	// The host appends atomically, wherever the kernel thinks the end is.
+	// os.File refuses WriteAt for such files anyway.
+	if fh.append {
+		_, err = fh.f.Write(op.Data)
+	} else {
+		_, err = fh.f.WriteAt(op.Data, op.Offset)
+	}
+
+	return hostfs.Errno(err)
+}
+
+func (fs *loopbackFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	fh, err := fs.files.Get(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	if op.Datasync {
+		return hostfs.Errno(datasync(fh.f))
+	}
+
+	return hostfs.Errno(fh.f.Sync())
+}
+
+func (fs *loopbackFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	// Writes go straight to the host, so there's nothing to flush.
+	return nil
+}
+
+func (fs *loopbackFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fh, err := fs.files.Remove(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	return hostfs.Errno(fh.f.Close())
+}
+
+func (fs *loopbackFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	target, err := os.Readlink(fs.getInodeOrDie(op.Inode).path)
+	if err != nil {
+		return hostfs.Errno(err)
+	}
+
+	op.Target = target
+
+	return nil
+}
+
+func (fs *loopbackFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := unix.Lgetxattr(fs.getInodeOrDie(op.Inode).path, op.Name, op.Dst)
+	if err != nil {
+		return hostfs.Errno(err)
+	}
+
+	op.BytesRead = n
+
+	return nil
+}
+
+func (fs *loopbackFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := unix.Llistxattr(fs.getInodeOrDie(op.Inode).path, op.Dst)
+	if err != nil {
+		return hostfs.Errno(err)
+	}
+
+	op.BytesRead = n
+
+	return nil
+}
+
+func (fs *loopbackFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return hostfs.Errno(unix.Lremovexattr(fs.getInodeOrDie(op.Inode).path, op.Name))
+}
+
+func (fs *loopbackFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path := fs.getInodeOrDie(op.Inode).path
+
+	return hostfs.Errno(unix.Lsetxattr(path, op.Name, op.Value, int(op.Flags)))
+}
@@ -0,0 +1,232 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loopbackfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/samples"
+	"github.com/jacobsa/fuse/samples/loopbackfs"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestLoopbackFS(t *testing.T) { RunTests(t) }
+
+type LoopbackFSTest struct {
+	samples.SampleTest
+
+	// The host directory being mirrored.
+	physicalPath string
+}
+
+func init() { RegisterTestSuite(&LoopbackFSTest{}) }
+
+func (t *LoopbackFSTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.physicalPath, err = ioutil.TempDir("", "loopbackfs_test")
+	AssertEq(nil, err)
+
+	t.Server, err = loopbackfs.NewLoopbackFS(t.physicalPath)
+	AssertEq(nil, err)
+
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *LoopbackFSTest) TearDown() {
+	t.SampleTest.TearDown()
+
+	err := os.RemoveAll(t.physicalPath)
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *LoopbackFSTest) ReadHostFile() {
+	err := ioutil.WriteFile(path.Join(t.physicalPath, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *LoopbackFSTest) WriteFile() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.physicalPath, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *LoopbackFSTest) AppendMode() {
+	err := ioutil.WriteFile(path.Join(t.physicalPath, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	f, err := os.OpenFile(path.Join(t.Dir, "foo"), os.O_WRONLY|os.O_APPEND, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	_, err = f.Write([]byte("burrito"))
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.physicalPath, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(contents))
+}
+
+func (t *LoopbackFSTest) Truncate() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Truncate(path.Join(t.Dir, "foo"), 2)
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.physicalPath, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("ta", string(contents))
+}
+
+func (t *LoopbackFSTest) Chmod() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Chmod(path.Join(t.Dir, "foo"), 0640)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(path.Join(t.physicalPath, "foo"))
+	AssertEq(nil, err)
+	ExpectEq(os.FileMode(0640), fi.Mode())
+}
+
+func (t *LoopbackFSTest) MkdirAndReadDir() {
+	err := os.Mkdir(path.Join(t.Dir, "dir"), 0700)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "dir", "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(path.Join(t.physicalPath, "dir"))
+	AssertEq(nil, err)
+	ExpectTrue(fi.IsDir())
+
+	entries, err := ioutil.ReadDir(path.Join(t.Dir, "dir"))
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq("foo", entries[0].Name())
+	ExpectEq(4, entries[0].Size())
+}
+
+func (t *LoopbackFSTest) RenameDirectory() {
+	err := os.Mkdir(path.Join(t.Dir, "dir"), 0700)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "dir", "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Rename(path.Join(t.Dir, "dir"), path.Join(t.Dir, "other"))
+	AssertEq(nil, err)
+
+	// The directory's inode should follow it to its new name.
+	err = ioutil.WriteFile(path.Join(t.Dir, "other", "bar"), []byte("burrito"), 0600)
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.physicalPath, "other", "bar"))
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	contents, err = ioutil.ReadFile(path.Join(t.Dir, "other", "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *LoopbackFSTest) HardLink() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Link(path.Join(t.Dir, "foo"), path.Join(t.Dir, "bar"))
+	AssertEq(nil, err)
+
+	fi1, err := os.Stat(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	fi2, err := os.Stat(path.Join(t.Dir, "bar"))
+	AssertEq(nil, err)
+
+	ExpectTrue(os.SameFile(fi1, fi2))
+	ExpectEq(2, fi1.Sys().(*syscall.Stat_t).Nlink)
+}
+
+func (t *LoopbackFSTest) Symlink() {
+	err := os.Symlink("foo", path.Join(t.Dir, "bar"))
+	AssertEq(nil, err)
+
+	target, err := os.Readlink(path.Join(t.physicalPath, "bar"))
+	AssertEq(nil, err)
+	ExpectEq("foo", target)
+
+	target, err = os.Readlink(path.Join(t.Dir, "bar"))
+	AssertEq(nil, err)
+	ExpectEq("foo", target)
+}
+
+func (t *LoopbackFSTest) Unlink() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Remove(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	_, err = os.Stat(path.Join(t.physicalPath, "foo"))
+	ExpectTrue(os.IsNotExist(err))
+}
+
+func (t *LoopbackFSTest) StatFS() {
+	var host, mounted syscall.Statfs_t
+	err := syscall.Statfs(t.physicalPath, &host)
+	AssertEq(nil, err)
+
+	err = syscall.Statfs(t.Dir, &mounted)
+	AssertEq(nil, err)
+
+	ExpectEq(host.Blocks, mounted.Blocks)
+	ExpectEq(host.Files, mounted.Files)
+}
+
+func (t *LoopbackFSTest) SparseFile() {
+	// A file with a hole, which takes up almost no space on the host.
+	f, err := os.Create(path.Join(t.physicalPath, "foo"))
+	AssertEq(nil, err)
+	AssertEq(nil, f.Truncate(1<<30))
+	AssertEq(nil, f.Close())
+
+	var host, mounted syscall.Stat_t
+	err = syscall.Stat(path.Join(t.physicalPath, "foo"), &host)
+	AssertEq(nil, err)
+
+	err = syscall.Stat(path.Join(t.Dir, "foo"), &mounted)
+	AssertEq(nil, err)
+
+	ExpectEq(1<<30, mounted.Size)
+	ExpectEq(host.Blocks, mounted.Blocks)
+	ExpectEq(host.Blksize, mounted.Blksize)
+}
@@ -0,0 +1,31 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loopbackfs
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// There's no fdatasync(2) on OS X, so flush everything.
+func datasync(f *os.File) error {
+	return f.Sync()
+}
+
+// There's no syncfs(2) on OS X either, so sync every file system.
+func syncfs(dir string) error {
+	return unix.Sync()
+}
@@ -12,29 +12,27 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package freelist
+package loopbackfs
 
-import "unsafe"
+import (
+	"os"
 
-// A freelist for arbitrary pointers. Not safe for concurrent access.
-type Freelist struct {
-	list []unsafe.Pointer
+	"golang.org/x/sys/unix"
+)
+
+// Flush f's contents to storage, along with only the metadata needed to read
+// them back.
+func datasync(f *os.File) error {
+	return unix.Fdatasync(int(f.Fd()))
 }
 
-// Get an element from the freelist, returning nil if empty.
-func (fl *Freelist) Get() unsafe.Pointer {
-	l := len(fl.list)
-	if l == 0 {
-		return nil
+// Flush everything buffered for the host file system containing dir.
+func syncfs(dir string) error {
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
 	}
 
-	p := fl.list[l-1]
-	fl.list = fl.list[:l-1]
-
-	return p
-}
-
-// Contribute an element back to the freelist.
-func (fl *Freelist) Put(p unsafe.Pointer) {
-	fl.list = append(fl.list, p)
+	defer unix.Close(fd)
+	return unix.Syncfs(fd)
 }
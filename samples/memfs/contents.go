@@ -0,0 +1,131 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs
+
+import (
+	"fmt"
+)
+
+// The size of the chunks in which file contents are stored.
+const chunkSize = 4096
+
+// The contents of a file, stored as fixed-size chunks indexed by offset /
+// chunkSize. Chunks that have never been written, or that have been entirely
+// zeroed since, are missing and read as zeroes, so that sparse files take
+// space only for the data they actually contain.
+//
+// The length of the file is tracked by the owner; the only requirement is that
+// data past it be zero, so that the file can be extended without rewriting
+// anything.
+type fileContents map[int64][]byte
+
+// Panic unless the contents are consistent with a file of the supplied size.
+func (c fileContents) checkInvariants(size uint64) {
+	for i, chunk := range c {
+		// INVARIANT: For each chunk, len(chunk) == chunkSize
+		if len(chunk) != chunkSize {
+			panic(fmt.Sprintf("Chunk %d has length %d", i, len(chunk)))
+		}
+
+		// INVARIANT: No chunk lies entirely past the end of the file.
+		start := uint64(i) * chunkSize
+		if i < 0 || start >= size {
+			panic(fmt.Sprintf("Chunk %d past end of file of size %d", i, size))
+		}
+
+		// INVARIANT: Data past the end of the file is zero.
+		if size < start+chunkSize {
+			for _, b := range chunk[size-start:] {
+				if b != 0 {
+					panic(fmt.Sprintf("Non-zero data past end of file of size %d", size))
+				}
+			}
+		}
+	}
+}
+
+// Fill p with the data at the supplied offset.
+func (c fileContents) readAt(p []byte, off int64) {
+	for len(p) > 0 {
+		i := off / chunkSize
+		n := min(len(p), int(chunkSize-off%chunkSize))
+		if chunk, ok := c[i]; ok {
+			copy(p[:n], chunk[off%chunkSize:])
+		} else {
+			clear(p[:n])
+		}
+
+		p = p[n:]
+		off += int64(n)
+	}
+}
+
+// Store p at the supplied offset, allocating chunks as necessary.
+func (c fileContents) writeAt(p []byte, off int64) {
+	for len(p) > 0 {
+		i := off / chunkSize
+		chunk, ok := c[i]
+		if !ok {
+			chunk = make([]byte, chunkSize)
+			c[i] = chunk
+		}
+
+		n := copy(chunk[off%chunkSize:], p)
+		p = p[n:]
+		off += int64(n)
+	}
+}
+
+// Zero the range [off, end), freeing the chunks that lie entirely within it.
+func (c fileContents) zero(off int64, end int64) {
+	if off >= end {
+		return
+	}
+
+	// Free whole chunks. The range may be far larger than the data actually
+	// stored, so walk whichever is smaller.
+	first := (off + chunkSize - 1) / chunkSize
+	last := end / chunkSize
+	if last-first > int64(len(c)) {
+		for i := range c {
+			if first <= i && i < last {
+				delete(c, i)
+			}
+		}
+	} else {
+		for i := first; i < last; i++ {
+			delete(c, i)
+		}
+	}
+
+	// Clear the parts of the chunks at either end that are in range.
+	for _, i := range []int64{off / chunkSize, (end - 1) / chunkSize} {
+		chunk, ok := c[i]
+		if !ok {
+			continue
+		}
+
+		start := max(off, i*chunkSize) - i*chunkSize
+		stop := min(end, (i+1)*chunkSize) - i*chunkSize
+		clear(chunk[start:stop])
+	}
+}
+
+// Discard the data at and past the supplied offset in a file of size oldSize,
+// freeing the chunks that no longer hold any of the file.
+func (c fileContents) truncate(size int64, oldSize int64) {
+	// Round up to the end of the last chunk, which is zero past oldSize.
+	c.zero(size, (oldSize+chunkSize-1)/chunkSize*chunkSize)
+}
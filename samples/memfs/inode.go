@@ -17,19 +17,31 @@ package memfs
 import (
 	"fmt"
 	"io"
-	"io/fs"
+	"math"
 	"os"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 )
 
 // Common attributes for files and directories.
 //
-// External synchronization is required.
+// External synchronization is required: the file system's lock, and for
+// attrs and contents also mu.
 type inode struct {
+	// Guards attrs and contents. ReadFile and WriteFile hold this, shared for
+	// reads, without holding the file system lock, so that the data of
+	// different files can be read and written in parallel. Any other op that
+	// reads or changes the size, times, link count or contents of a file must
+	// hold it too. Fields that ReadFile and WriteFile don't change, such as
+	// the mode and owner, may be read with just the file system lock.
+	//
+	// Lock ordering: the file system's lock, then inodes in order of ID.
+	mu sync.RWMutex
+
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
@@ -40,9 +52,10 @@ type inode struct {
 
 	// The current attributes of this inode.
 	//
-	// INVARIANT: attrs.Mode &^ (os.ModePerm|os.ModeDir|os.ModeSymlink) == 0
+	// GUARDED_BY(mu)
+	// INVARIANT: attrs.Mode &^ (modePermBits|os.ModeDir|os.ModeSymlink) == 0
 	// INVARIANT: !(isDir() && isSymlink())
-	// INVARIANT: attrs.Size == len(contents)
+	// INVARIANT: If !isFile(), attrs.Size == 0
 	attrs fuseops.InodeAttributes
 
 	// For directories, entries describing the children of the directory. Unused
@@ -60,8 +73,9 @@ type inode struct {
 
 	// For files, the current contents of the file.
 	//
+	// INVARIANT: contents.checkInvariants(attrs.Size) does not panic
 	// INVARIANT: If !isFile(), len(contents) == 0
-	contents []byte
+	contents fileContents // GUARDED_BY(mu)
 
 	// For symlinks, the target of the symlink.
 	//
@@ -70,6 +84,13 @@ type inode struct {
 
 	// extended attributes and values
 	xattrs map[string][]byte
+
+	// The number of references that the kernel holds to the inode. See notes on
+	// fuseops.ForgetInodeOp.
+	lookupCount uint64
+
+	// The number of open handles for the file.
+	openCount int
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -81,20 +102,37 @@ type inode struct {
 func newInode(attrs fuseops.InodeAttributes, name string) *inode {
 	// Update time info.
 	now := time.Now()
+	attrs.Atime = now
 	attrs.Mtime = now
+	attrs.Ctime = now
 	attrs.Crtime = now
 
 	// Create the object.
 	return &inode{
-		name:   name,
-		attrs:  attrs,
-		xattrs: make(map[string][]byte),
+		name:     name,
+		attrs:    attrs,
+		contents: make(fileContents),
+		xattrs:   make(map[string][]byte),
 	}
 }
 
+// Record a change to the inode's contents, which is also a change to its
+// metadata.
+func (in *inode) touchModified() {
+	now := time.Now()
+	in.attrs.Mtime = now
+	in.attrs.Ctime = now
+}
+
+// Record a change to the inode's metadata alone, such as its mode or link
+// count.
+func (in *inode) touchChanged() {
+	in.attrs.Ctime = time.Now()
+}
+
 func (in *inode) CheckInvariants() {
-	// INVARIANT: attrs.Mode &^ (os.ModePerm|os.ModeDir|os.ModeSymlink) == 0
-	if !(in.attrs.Mode&^(os.ModePerm|os.ModeDir|os.ModeSymlink) == 0) {
+	// INVARIANT: attrs.Mode &^ (modePermBits|os.ModeDir|os.ModeSymlink) == 0
+	if !(in.attrs.Mode&^(modePermBits|os.ModeDir|os.ModeSymlink) == 0) {
 		panic(fmt.Sprintf("Unexpected mode: %v", in.attrs.Mode))
 	}
 
@@ -103,14 +141,14 @@ func (in *inode) CheckInvariants() {
 		panic(fmt.Sprintf("Unexpected mode: %v", in.attrs.Mode))
 	}
 
-	// INVARIANT: attrs.Size == len(contents)
-	if in.attrs.Size != uint64(len(in.contents)) {
-		panic(fmt.Sprintf(
-			"Size mismatch: %d vs. %d",
-			in.attrs.Size,
-			len(in.contents)))
+	// INVARIANT: If !isFile(), attrs.Size == 0
+	if !in.isFile() && in.attrs.Size != 0 {
+		panic(fmt.Sprintf("Unexpected size: %d", in.attrs.Size))
 	}
 
+	// INVARIANT: contents.checkInvariants(attrs.Size) does not panic
+	in.contents.checkInvariants(in.attrs.Size)
+
 	// INVARIANT: If !isDir(), len(entries) == 0
 	if !in.isDir() && len(in.entries) != 0 {
 		panic(fmt.Sprintf("Unexpected entries length: %d", len(in.entries)))
@@ -148,6 +186,24 @@ func (in *inode) CheckInvariants() {
 	return
 }
 
+// Record that the kernel has been given a reference to the inode, by way of a
+// fuseops.ChildInodeEntry.
+func (in *inode) IncrementLookupCount() {
+	in.lookupCount++
+}
+
+// Drop n of the kernel's references to the inode.
+func (in *inode) DecrementLookupCount(n uint64) {
+	if in.lookupCount < n {
+		panic(fmt.Sprintf(
+			"Overly large decrement: %v, %v",
+			in.lookupCount,
+			n))
+	}
+
+	in.lookupCount -= n
+}
+
 func (in *inode) isDir() bool {
 	return in.attrs.Mode&os.ModeDir != 0
 }
@@ -223,7 +279,7 @@ func (in *inode) AddChild(
 	var index int
 
 	// Update the modification time.
-	in.attrs.Mtime = time.Now()
+	in.touchModified()
 
 	// No matter where we place the entry, make sure it has the correct Offset
 	// field.
@@ -257,7 +313,7 @@ func (in *inode) AddChild(
 // REQUIRES: An entry for the given name exists.
 func (in *inode) RemoveChild(name string) {
 	// Update the modification time.
-	in.attrs.Mtime = time.Now()
+	in.touchModified()
 
 	// Find the entry.
 	i, ok := in.findChild(name)
@@ -303,18 +359,25 @@ func (in *inode) ReadDir(p []byte, offset int) int {
 // Read from the file's contents. See documentation for ioutil.ReaderAt.
 //
 // REQUIRES: in.isFile()
+// LOCKS_REQUIRED(in.mu)
 func (in *inode) ReadAt(p []byte, off int64) (int, error) {
 	if !in.isFile() {
 		panic("ReadAt called on non-file.")
 	}
 
 	// Ensure the offset is in range.
-	if off > int64(len(in.contents)) {
+	size := int64(in.attrs.Size)
+	if off > size {
 		return 0, io.EOF
 	}
 
 	// Read what we can.
-	n := copy(p, in.contents[off:])
+	n := len(p)
+	if int64(n) > size-off {
+		n = int(size - off)
+	}
+
+	in.contents.readAt(p[:n], off)
 	if n < len(p) {
 		return n, io.EOF
 	}
@@ -325,51 +388,45 @@ func (in *inode) ReadAt(p []byte, off int64) (int, error) {
 // Write to the file's contents. See documentation for ioutil.WriterAt.
 //
 // REQUIRES: in.isFile()
+// LOCKS_REQUIRED(in.mu)
 func (in *inode) WriteAt(p []byte, off int64) (int, error) {
 	if !in.isFile() {
 		panic("WriteAt called on non-file.")
 	}
 
 	// Update the modification time.
-	in.attrs.Mtime = time.Now()
-
-	// Ensure that the contents slice is long enough.
-	newLen := int(off) + len(p)
-	if len(in.contents) < newLen {
-		padding := make([]byte, newLen-len(in.contents))
-		in.contents = append(in.contents, padding...)
-		in.attrs.Size = uint64(newLen)
-	}
-
-	// Copy in the data.
-	n := copy(in.contents[off:], p)
+	in.touchModified()
 
-	// Sanity check.
-	if n != len(p) {
-		panic(fmt.Sprintf("Unexpected short copy: %v", n))
+	// Copy in the data, extending the file if necessary. Anything between the
+	// old end of the file and the offset is already zero.
+	in.contents.writeAt(p, off)
+	if newLen := uint64(off) + uint64(len(p)); newLen > in.attrs.Size {
+		in.attrs.Size = newLen
 	}
 
-	return n, nil
+	return len(p), nil
 }
 
 // Update attributes from non-nil parameters.
+//
+// LOCKS_REQUIRED(in.mu)
 func (in *inode) SetAttributes(
 	size *uint64,
 	mode *os.FileMode,
+	atime *time.Time,
 	mtime *time.Time) {
-	// Update the modification time.
-	in.attrs.Mtime = time.Now()
+	// Any change is a change to the metadata, but only truncation changes the
+	// contents.
+	in.touchChanged()
 
 	// Truncate?
 	if size != nil {
-		intSize := int(*size)
-
-		// Update contents.
-		if intSize <= len(in.contents) {
-			in.contents = in.contents[:intSize]
-		} else {
-			padding := make([]byte, intSize-len(in.contents))
-			in.contents = append(in.contents, padding...)
+		in.touchModified()
+
+		// Discard anything past the new end. Extending needs no work, since the
+		// data past the old end is zero and holes take no space.
+		if *size < in.attrs.Size {
+			in.contents.truncate(int64(*size), int64(in.attrs.Size))
 		}
 
 		// Update attributes.
@@ -378,25 +435,64 @@ func (in *inode) SetAttributes(
 
 	// Change mode?
 	if mode != nil {
-		in.attrs.Mode &= ^fs.ModePerm
-		in.attrs.Mode |= *mode & fs.ModePerm
+		in.attrs.Mode &= ^modePermBits
+		in.attrs.Mode |= *mode & modePermBits
+	}
+
+	// Change atime or mtime?
+	if atime != nil {
+		in.attrs.Atime = *atime
 	}
 
-	// Change mtime?
 	if mtime != nil {
 		in.attrs.Mtime = *mtime
 	}
 }
 
+// Values for the mode argument of fallocate(2).
+const (
+	fallocKeepSize  = 0x1 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x2 // FALLOC_FL_PUNCH_HOLE
+)
+
+// Preallocate or deallocate space for the file, as for fallocate(2). Mode zero
+// extends the file with zeroes to cover the range if necessary, and
+// FALLOC_FL_PUNCH_HOLE (which must be accompanied by FALLOC_FL_KEEP_SIZE)
+// zeroes the part of the range within the file. FALLOC_FL_KEEP_SIZE alone
+// has nothing to do, since space is always allocated on write. Other modes
+// are not supported.
+//
+// REQUIRES: in.isFile()
+// LOCKS_REQUIRED(in.mu)
 func (in *inode) Fallocate(mode uint32, offset uint64, length uint64) error {
-	if mode != 0 {
-		return fuse.ENOSYS
+	end := offset + length
+	if end < offset || end > math.MaxInt64 {
+		return syscall.EFBIG
 	}
-	newSize := int(offset + length)
-	if newSize > len(in.contents) {
-		padding := make([]byte, newSize-len(in.contents))
-		in.contents = append(in.contents, padding...)
-		in.attrs.Size = offset + length
+
+	switch mode {
+	case 0:
+		if end > in.attrs.Size {
+			in.SetAttributes(&end, nil, nil, nil)
+		}
+
+	case fallocKeepSize:
+
+	case fallocPunchHole | fallocKeepSize:
+		if end > in.attrs.Size {
+			end = in.attrs.Size
+		}
+
+		if offset < end {
+			in.touchModified()
+			in.contents.zero(int64(offset), int64(end))
+		}
+
+	default:
+		// Not ENOSYS, which would make the kernel stop sending fallocate
+		// altogether.
+		return syscall.EOPNOTSUPP
 	}
+
 	return nil
 }
@@ -19,15 +19,17 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
 	"github.com/jacobsa/syncutil"
-	"golang.org/x/sys/unix"
 )
 
 const (
@@ -42,10 +44,21 @@ type memFS struct {
 	uid uint32
 	gid uint32
 
+	// Don't update access times.
+	noAtime bool
+
+	// Enforce permission bits using the credentials of each op.
+	checkPermissions bool
+
+	// The maximum total size of the contents of files, or zero for no limit.
+	capacity uint64
+
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
 
+	// Guards the inode table and everything else below, except for the
+	// attributes and contents of files; see inode.mu.
 	mu syncutil.InvariantMutex
 
 	// The collection of live inodes, indexed by ID. IDs of free inodes that may
@@ -68,15 +81,44 @@ type memFS struct {
 	// fuseops.RootInodeID and inodes[i] == nil
 	freeInodes []fuseops.InodeID // GUARDED_BY(mu)
 
+	// The total size of the contents of inodes that are still linked into the
+	// tree. Files that have been unlinked don't count against the capacity.
+	//
+	// Updated atomically, since WriteFile changes sizes without holding mu.
+	//
+	// INVARIANT: usedBytes is the sum of attrs.Size over inodes with Nlink > 0
+	usedBytes atomic.Uint64
+
+	// The open file handles.
+	//
+	// INVARIANT: For each inode in, in.openCount is the number of handles for
+	// its ID.
+	handles map[fuseops.HandleID]fileHandle // GUARDED_BY(mu)
+
+	// The ID to give the next file handle.
+	nextHandle fuseops.HandleID // GUARDED_BY(mu)
+
 	readFileCallback  func()
 	writeFileCallback func()
+
+	// Whether the kernel caches writes, in which case it decides the offsets of
+	// appending writes itself.
+	writebackCache bool // GUARDED_BY(mu)
+}
+
+// An open file, as returned by OpenFile and CreateFile.
+type fileHandle struct {
+	inode fuseops.InodeID
+
+	// Whether the file was opened with O_APPEND.
+	append bool
 }
 
 // Create a file system that stores data and metadata in memory.
 //
 // The supplied UID/GID pair will own the root inode. This file system does no
 // permissions checking, and should therefore be mounted with the
-// default_permissions option.
+// default_permissions option. See Options.CheckPermissions for an alternative.
 func NewMemFS(
 	uid uint32,
 	gid uint32) fuse.Server {
@@ -88,13 +130,71 @@ func NewMemFSWithCallbacks(
 	gid uint32,
 	readFileCallback func(),
 	writeFileCallback func()) fuse.Server {
+	return NewMemFSWithOptions(uid, gid, Options{
+		ReadFileCallback:  readFileCallback,
+		WriteFileCallback: writeFileCallback,
+	})
+}
+
+// Options for NewMemFSWithOptions. The zero value gives the behavior of
+// NewMemFS.
+type Options struct {
+	// Functions to be called once the reply to each ReadFileOp or WriteFileOp
+	// has been sent, if non-nil.
+	ReadFileCallback  func()
+	WriteFileCallback func()
+
+	// Don't update access times when files are read, directories listed and
+	// symlinks followed, as with the noatime mount option. Useful when
+	// benchmarking.
+	NoAtime bool
+
+	// Enforce the permission bits of inodes, including the sticky bit on
+	// directories, against the credentials of the process making each request,
+	// and make new inodes owned by that process. This allows mounting with
+	// MountConfig.DisableDefaultPermissions, for testing permission handling
+	// in the file system rather than the kernel. (Set
+	// MountConfig.Options["allow_other"] too, to let other users through the
+	// kernel at all.)
+	CheckPermissions bool
+
+	// The maximum total size in bytes of the contents of all files, or zero
+	// for no limit. Writes, truncations and allocations that would exceed it
+	// fail with ENOSPC, and StatFS reports the space used and remaining.
+	Capacity uint64
+}
+
+// A memfs server whose contents can be saved and restored, for example to
+// keep them across restarts of the daemon.
+type MemFS interface {
+	fuse.Server
+
+	// Write a snapshot of the whole file system to w.
+	Save(w io.Writer) error
+
+	// Replace the contents of the file system with a snapshot written by Save.
+	// The file system must not be mounted, since the kernel's view of it would
+	// no longer match. If the snapshot can't be read, the file system is left
+	// unchanged.
+	Load(r io.Reader) error
+}
+
+// Like NewMemFS, but with the supplied options.
+func NewMemFSWithOptions(
+	uid uint32,
+	gid uint32,
+	opts Options) MemFS {
 	// Set up the basic struct.
 	fs := &memFS{
 		inodes:            make([]*inode, fuseops.RootInodeID+1),
+		handles:           make(map[fuseops.HandleID]fileHandle),
 		uid:               uid,
 		gid:               gid,
-		readFileCallback:  readFileCallback,
-		writeFileCallback: writeFileCallback,
+		noAtime:           opts.NoAtime,
+		checkPermissions:  opts.CheckPermissions,
+		capacity:          opts.Capacity,
+		readFileCallback:  opts.ReadFileCallback,
+		writeFileCallback: opts.WriteFileCallback,
 	}
 
 	// Set up the root inode.
@@ -106,10 +206,16 @@ func NewMemFSWithCallbacks(
 
 	fs.inodes[fuseops.RootInodeID] = newInode(rootAttrs, "")
 
+	// The root inode starts with a lookup count of one.
+	fs.inodes[fuseops.RootInodeID].IncrementLookupCount()
+
 	// Set up invariant checking.
 	fs.mu = syncutil.NewInvariantMutex(fs.checkInvariants)
 
-	return fuseutil.NewFileSystemServer(fs)
+	return &server{
+		Server: fuseutil.NewFileSystemServer(fs),
+		fs:     fs,
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -117,6 +223,9 @@ func NewMemFSWithCallbacks(
 ////////////////////////////////////////////////////////////////////////
 
 func (fs *memFS) checkInvariants() {
+	fs.rlockInodes()
+	defer fs.runlockInodes()
+
 	// Check reserved inodes.
 	for i := 0; i < fuseops.RootInodeID; i++ {
 		if fs.inodes[i] != nil {
@@ -129,14 +238,24 @@ func (fs *memFS) checkInvariants() {
 		panic("Expected root to be a directory.")
 	}
 
-	// Build our own list of free IDs.
+	// Build our own list of free IDs, and add up the space used.
 	freeIDsEncountered := make(map[fuseops.InodeID]struct{})
+	var usedBytes uint64
 	for i := fuseops.RootInodeID + 1; i < len(fs.inodes); i++ {
 		inode := fs.inodes[i]
 		if inode == nil {
 			freeIDsEncountered[fuseops.InodeID(i)] = struct{}{}
 			continue
 		}
+
+		if inode.attrs.Nlink > 0 {
+			usedBytes += inode.attrs.Size
+		}
+	}
+
+	// INVARIANT: usedBytes is the sum of attrs.Size over inodes with Nlink > 0
+	if fs.usedBytes.Load() != usedBytes {
+		panic(fmt.Sprintf("Used bytes mismatch: %v vs. %v", fs.usedBytes.Load(), usedBytes))
 	}
 
 	// Check fs.freeInodes.
@@ -156,7 +275,26 @@ func (fs *memFS) checkInvariants() {
 
 	// INVARIANT: For each inode in, in.CheckInvariants() does not panic.
 	for _, in := range fs.inodes {
-		in.CheckInvariants()
+		if in != nil {
+			in.CheckInvariants()
+		}
+	}
+
+	// INVARIANT: For each inode in, in.openCount is the number of handles for
+	// its ID.
+	openCounts := make(map[fuseops.InodeID]int)
+	for _, h := range fs.handles {
+		openCounts[h.inode]++
+	}
+
+	for i, in := range fs.inodes {
+		if in != nil && in.openCount != openCounts[fuseops.InodeID(i)] {
+			panic(fmt.Sprintf(
+				"Open count mismatch for inode %d: %d vs. %d",
+				i,
+				in.openCount,
+				openCounts[fuseops.InodeID(i)]))
+		}
 	}
 }
 
@@ -172,6 +310,41 @@ func (fs *memFS) getInodeOrDie(id fuseops.InodeID) *inode {
 	return inode
 }
 
+// Record that the inode's contents were read, unless access times are
+// disabled.
+//
+// LOCKS_EXCLUDED(inode.mu)
+func (fs *memFS) touchAccessed(inode *inode) {
+	if fs.noAtime {
+		return
+	}
+
+	inode.mu.Lock()
+	inode.attrs.Atime = time.Now()
+	inode.mu.Unlock()
+}
+
+// Lock every inode for reading, so that nothing changes underneath us even
+// though ReadFile and WriteFile don't hold fs.mu.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *memFS) rlockInodes() {
+	for _, in := range fs.inodes {
+		if in != nil {
+			in.mu.RLock()
+		}
+	}
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *memFS) runlockInodes() {
+	for _, in := range fs.inodes {
+		if in != nil {
+			in.mu.RUnlock()
+		}
+	}
+}
+
 // Allocate a new inode, assigning it an ID that is not in use.
 //
 // LOCKS_REQUIRED(fs.mu)
@@ -200,13 +373,129 @@ func (fs *memFS) deallocateInode(id fuseops.InodeID) {
 	fs.inodes[id] = nil
 }
 
+// Deallocate the inode if nothing refers to it any more: it has been unlinked,
+// the kernel has forgotten it, and it has no open handles. Until then an
+// unlinked file's contents stay available to those who have it open.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *memFS) maybeDeallocateInode(id fuseops.InodeID) {
+	in := fs.getInodeOrDie(id)
+	if id == fuseops.RootInodeID ||
+		in.attrs.Nlink != 0 ||
+		in.lookupCount != 0 ||
+		in.openCount != 0 {
+		return
+	}
+
+	fs.deallocateInode(id)
+}
+
+// Create a handle for the supplied file, opened with the supplied flags.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *memFS) openHandle(
+	id fuseops.InodeID,
+	flags fusekernel.OpenFlags) fuseops.HandleID {
+	handle := fs.nextHandle
+	fs.nextHandle++
+
+	fs.handles[handle] = fileHandle{
+		inode:  id,
+		append: flags&fusekernel.OpenAppend != 0,
+	}
+
+	fs.getInodeOrDie(id).openCount++
+
+	return handle
+}
+
+// Account for the inode's contents changing size from oldSize to newSize,
+// which the caller must then do. Return ENOSPC, accounting for nothing, if
+// growing would exceed the capacity.
+//
+// LOCKS_REQUIRED(in.mu)
+func (fs *memFS) charge(in *inode, oldSize uint64, newSize uint64) error {
+	if in.attrs.Nlink == 0 {
+		return nil
+	}
+
+	for {
+		used := fs.usedBytes.Load()
+		if fs.capacity != 0 &&
+			newSize > oldSize &&
+			newSize-oldSize > fs.capacity-used {
+			return syscall.ENOSPC
+		}
+
+		if fs.usedBytes.CompareAndSwap(used, used-oldSize+newSize) {
+			return nil
+		}
+	}
+}
+
+// Remove a link to the inode, releasing the space used by its contents if it
+// was the last.
+//
+// LOCKS_REQUIRED(fs.mu)
+// LOCKS_EXCLUDED(in.mu)
+func (fs *memFS) unlinkInode(id fuseops.InodeID) {
+	in := fs.getInodeOrDie(id)
+
+	in.mu.Lock()
+	if in.attrs.Nlink == 1 {
+		// Shrinking can't fail.
+		fs.charge(in, in.attrs.Size, 0)
+	}
+
+	in.attrs.Nlink--
+	in.touchChanged()
+	nlink := in.attrs.Nlink
+	in.mu.Unlock()
+
+	if nlink == 0 {
+		fs.maybeDeallocateInode(id)
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////
 // FileSystem methods
 ////////////////////////////////////////////////////////////////////////
 
+func (fs *memFS) Init(op *fuseops.InitOp) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.writebackCache = op.Flags&fusekernel.InitWritebackCache != 0
+}
+
 func (fs *memFS) StatFS(
 	ctx context.Context,
 	op *fuseops.StatFSOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	const blockSize = 4096
+
+	op.BlockSize = blockSize
+	op.IoSize = blockSize
+
+	// Without a capacity, report plenty of free space.
+	usedBytes := fs.usedBytes.Load()
+	free := uint64(math.MaxUint32 * blockSize)
+	if fs.capacity != 0 {
+		free = fs.capacity - usedBytes
+	}
+
+	used := (usedBytes + blockSize - 1) / blockSize
+	op.BlocksFree = free / blockSize
+	op.BlocksAvailable = op.BlocksFree
+	op.Blocks = used + op.BlocksFree
+
+	// There's no limit on the number of inodes, but report how many are
+	// allocated, including those for files that are unlinked but still open.
+	op.Inodes = math.MaxUint32
+	op.InodesFree = op.Inodes - uint64(len(fs.inodes)-fuseops.RootInodeID-len(fs.freeInodes))
+
 	return nil
 }
 
@@ -218,6 +507,9 @@ func (fs *memFS) LookUpInode(
 
 	// Grab the parent directory.
 	inode := fs.getInodeOrDie(op.Parent)
+	if err := fs.checkAccess(inode, op.OpContext, permExec); err != nil {
+		return err
+	}
 
 	// Does the directory have an entry with the given name?
 	childID, _, ok := inode.LookUpChild(op.Name)
@@ -229,8 +521,12 @@ func (fs *memFS) LookUpInode(
 	child := fs.getInodeOrDie(childID)
 
 	// Fill in the response.
+	child.IncrementLookupCount()
 	op.Entry.Child = childID
+
+	child.mu.RLock()
 	op.Entry.Attributes = child.attrs
+	child.mu.RUnlock()
 
 	// We don't spontaneously mutate, so the kernel can cache as long as it wants
 	// (since it also handles invalidation).
@@ -250,7 +546,9 @@ func (fs *memFS) GetInodeAttributes(
 	inode := fs.getInodeOrDie(op.Inode)
 
 	// Fill in the response.
+	inode.mu.RLock()
 	op.Attributes = inode.attrs
+	inode.mu.RUnlock()
 
 	// We don't spontaneously mutate, so the kernel can cache as long as it wants
 	// (since it also handles invalidation).
@@ -259,6 +557,22 @@ func (fs *memFS) GetInodeAttributes(
 	return nil
 }
 
+func (fs *memFS) GetXTimes(
+	ctx context.Context,
+	op *fuseops.GetXTimesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	inode := fs.getInodeOrDie(op.Inode)
+
+	// We keep no backups, so leave Bkuptime zero.
+	inode.mu.RLock()
+	op.Crtime = inode.attrs.Crtime
+	inode.mu.RUnlock()
+
+	return nil
+}
+
 func (fs *memFS) SetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.SetInodeAttributesOp) error {
@@ -274,9 +588,28 @@ func (fs *memFS) SetInodeAttributes(
 
 	// Grab the inode.
 	inode := fs.getInodeOrDie(op.Inode)
+	if err := fs.checkSetAttributes(inode, op); err != nil {
+		return err
+	}
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	if op.Size != nil {
+		if err := fs.charge(inode, inode.attrs.Size, *op.Size); err != nil {
+			return err
+		}
+	}
 
 	// Handle the request.
-	inode.SetAttributes(op.Size, op.Mode, op.Mtime)
+	inode.SetAttributes(op.Size, op.Mode, op.Atime, op.Mtime)
+	if op.Uid != nil {
+		inode.attrs.Uid = *op.Uid
+	}
+
+	if op.Gid != nil {
+		inode.attrs.Gid = *op.Gid
+	}
 
 	// Fill in the response.
 	op.Attributes = inode.attrs
@@ -288,6 +621,32 @@ func (fs *memFS) SetInodeAttributes(
 	return err
 }
 
+func (fs *memFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.getInodeOrDie(op.Inode).DecrementLookupCount(op.N)
+	fs.maybeDeallocateInode(op.Inode)
+
+	return nil
+}
+
+func (fs *memFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, e := range op.Entries {
+		fs.getInodeOrDie(e.Inode).DecrementLookupCount(e.N)
+		fs.maybeDeallocateInode(e.Inode)
+	}
+
+	return nil
+}
+
 func (fs *memFS) MkDir(
 	ctx context.Context,
 	op *fuseops.MkDirOp) error {
@@ -296,6 +655,9 @@ func (fs *memFS) MkDir(
 
 	// Grab the parent, which we will update shortly.
 	parent := fs.getInodeOrDie(op.Parent)
+	if err := fs.checkCreate(parent, op.OpContext); err != nil {
+		return err
+	}
 
 	// Ensure that the name doesn't already exist, so we don't wind up with a
 	// duplicate.
@@ -305,11 +667,12 @@ func (fs *memFS) MkDir(
 	}
 
 	// Set up attributes from the child.
+	uid, gid := fs.newOwner(op.OpContext)
 	childAttrs := fuseops.InodeAttributes{
 		Nlink: 1,
 		Mode:  op.Mode,
-		Uid:   fs.uid,
-		Gid:   fs.gid,
+		Uid:   uid,
+		Gid:   gid,
 	}
 
 	// Allocate a child.
@@ -319,6 +682,7 @@ func (fs *memFS) MkDir(
 	parent.AddChild(childID, op.Name, fuseutil.DT_Directory)
 
 	// Fill in the response.
+	child.IncrementLookupCount()
 	op.Entry.Child = childID
 	op.Entry.Attributes = child.attrs
 
@@ -337,7 +701,7 @@ func (fs *memFS) MkNode(
 	defer fs.mu.Unlock()
 
 	var err error
-	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
+	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode, op.OpContext)
 	return err
 }
 
@@ -345,9 +709,13 @@ func (fs *memFS) MkNode(
 func (fs *memFS) createFile(
 	parentID fuseops.InodeID,
 	name string,
-	mode os.FileMode) (fuseops.ChildInodeEntry, error) {
+	mode os.FileMode,
+	ctx fuseops.OpContext) (fuseops.ChildInodeEntry, error) {
 	// Grab the parent, which we will update shortly.
 	parent := fs.getInodeOrDie(parentID)
+	if err := fs.checkCreate(parent, ctx); err != nil {
+		return fuseops.ChildInodeEntry{}, err
+	}
 
 	// Ensure that the name doesn't already exist, so we don't wind up with a
 	// duplicate.
@@ -358,6 +726,7 @@ func (fs *memFS) createFile(
 
 	// Set up attributes for the child.
 	now := time.Now()
+	uid, gid := fs.newOwner(ctx)
 	childAttrs := fuseops.InodeAttributes{
 		Nlink:  1,
 		Mode:   mode,
@@ -365,8 +734,8 @@ func (fs *memFS) createFile(
 		Mtime:  now,
 		Ctime:  now,
 		Crtime: now,
-		Uid:    fs.uid,
-		Gid:    fs.gid,
+		Uid:    uid,
+		Gid:    gid,
 	}
 
 	// Allocate a child.
@@ -376,6 +745,8 @@ func (fs *memFS) createFile(
 	parent.AddChild(childID, name, fuseutil.DT_File)
 
 	// Fill in the response entry.
+	child.IncrementLookupCount()
+
 	var entry fuseops.ChildInodeEntry
 	entry.Child = childID
 	entry.Attributes = child.attrs
@@ -394,8 +765,49 @@ func (fs *memFS) CreateFile(
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
-	return err
+	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode, op.OpContext)
+	if err != nil {
+		return err
+	}
+
+	op.Handle = fs.openHandle(op.Entry.Child, op.OpenFlags)
+	return nil
+}
+
+func (fs *memFS) CreateTmpFile(
+	ctx context.Context,
+	op *fuseops.CreateTmpFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	parent := fs.getInodeOrDie(op.Parent)
+	if err := fs.checkCreate(parent, op.OpContext); err != nil {
+		return err
+	}
+
+	// The file has no links until CreateLink gives it one, so like an
+	// unlinked file its contents don't count towards the capacity.
+	now := time.Now()
+	uid, gid := fs.newOwner(op.OpContext)
+	childAttrs := fuseops.InodeAttributes{
+		Mode:   op.Mode,
+		Atime:  now,
+		Mtime:  now,
+		Ctime:  now,
+		Crtime: now,
+		Uid:    uid,
+		Gid:    gid,
+	}
+
+	childID, child := fs.allocateInode(childAttrs, "")
+	child.IncrementLookupCount()
+
+	op.Entry.Child = childID
+	op.Entry.Attributes = child.attrs
+	op.Entry.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
+	op.Handle = fs.openHandle(childID, op.OpenFlags)
+
+	return nil
 }
 
 func (fs *memFS) CreateSymlink(
@@ -406,6 +818,9 @@ func (fs *memFS) CreateSymlink(
 
 	// Grab the parent, which we will update shortly.
 	parent := fs.getInodeOrDie(op.Parent)
+	if err := fs.checkCreate(parent, op.OpContext); err != nil {
+		return err
+	}
 
 	// Ensure that the name doesn't already exist, so we don't wind up with a
 	// duplicate.
@@ -416,6 +831,7 @@ func (fs *memFS) CreateSymlink(
 
 	// Set up attributes from the child.
 	now := time.Now()
+	uid, gid := fs.newOwner(op.OpContext)
 	childAttrs := fuseops.InodeAttributes{
 		Nlink:  1,
 		Mode:   0444 | os.ModeSymlink,
@@ -423,8 +839,8 @@ func (fs *memFS) CreateSymlink(
 		Mtime:  now,
 		Ctime:  now,
 		Crtime: now,
-		Uid:    fs.uid,
-		Gid:    fs.gid,
+		Uid:    uid,
+		Gid:    gid,
 	}
 
 	// Allocate a child.
@@ -437,6 +853,7 @@ func (fs *memFS) CreateSymlink(
 	parent.AddChild(childID, op.Name, fuseutil.DT_Link)
 
 	// Fill in the response entry.
+	child.IncrementLookupCount()
 	op.Entry.Child = childID
 	op.Entry.Attributes = child.attrs
 
@@ -456,6 +873,9 @@ func (fs *memFS) CreateLink(
 
 	// Grab the parent, which we will update shortly.
 	parent := fs.getInodeOrDie(op.Parent)
+	if err := fs.checkCreate(parent, op.OpContext); err != nil {
+		return err
+	}
 
 	// Ensure that the name doesn't already exist, so we don't wind up with a
 	// duplicate.
@@ -468,16 +888,28 @@ func (fs *memFS) CreateLink(
 	target := fs.getInodeOrDie(op.Target)
 
 	// Update the attributes
-	now := time.Now()
+	target.mu.Lock()
 	target.attrs.Nlink++
-	target.attrs.Ctime = now
+	if target.attrs.Nlink == 1 {
+		// A file from CreateTmpFile is being linked into place, so its contents
+		// count from now on.
+		if err := fs.charge(target, 0, target.attrs.Size); err != nil {
+			target.attrs.Nlink--
+			target.mu.Unlock()
+			return err
+		}
+	}
+
+	target.attrs.Ctime = time.Now()
+	op.Entry.Attributes = target.attrs
+	target.mu.Unlock()
 
 	// Add an entry in the parent.
 	parent.AddChild(op.Target, op.Name, fuseutil.DT_File)
 
 	// Return the response.
+	target.IncrementLookupCount()
 	op.Entry.Child = op.Target
-	op.Entry.Attributes = target.attrs
 
 	// We don't spontaneously mutate, so the kernel can cache as long as it wants
 	// (since it also handles invalidation).
@@ -501,19 +933,58 @@ func (fs *memFS) Rename(
 		return fuse.ENOENT
 	}
 
-	// If the new name exists already in the new parent, make sure it's not a
-	// non-empty directory, then delete it.
+	child := fs.getInodeOrDie(childID)
+	if err := fs.checkDelete(oldParent, child, op.OpContext); err != nil {
+		return err
+	}
+
+	// Moving a directory to a new parent changes its ".." entry.
+	if child.isDir() && op.OldParent != op.NewParent {
+		if err := fs.checkAccess(child, op.OpContext, permWrite); err != nil {
+			return err
+		}
+	}
+
+	// Renaming an entry to itself is a no-op.
+	if op.OldParent == op.NewParent && op.OldName == op.NewName {
+		return nil
+	}
+
+	// If the new name exists already in the new parent, make sure it can be
+	// replaced, then delete it.
 	newParent := fs.getInodeOrDie(op.NewParent)
 	existingID, _, ok := newParent.LookUpChild(op.NewName)
-	if ok {
+	if ok && existingID == childID {
+		// Both names are links to the same inode, in which case rename(2) does
+		// nothing.
+		return nil
+	}
+
+	if !ok {
+		if err := fs.checkCreate(newParent, op.OpContext); err != nil {
+			return err
+		}
+	} else {
 		existing := fs.getInodeOrDie(existingID)
+		if err := fs.checkDelete(newParent, existing, op.OpContext); err != nil {
+			return err
+		}
+
+		switch {
+		case child.isDir() && !existing.isDir():
+			return fuse.ENOTDIR
 
-		var buf [4096]byte
-		if existing.isDir() && existing.ReadDir(buf[:], 0) > 0 {
+		case !child.isDir() && existing.isDir():
+			return syscall.EISDIR
+
+		case existing.isDir() && existing.Len() != 0:
 			return fuse.ENOTEMPTY
 		}
 
 		newParent.RemoveChild(op.NewName)
+
+		// Mark the replaced inode as unlinked, as Unlink and RmDir would.
+		fs.unlinkInode(existingID)
 	}
 
 	// Link the new name.
@@ -525,6 +996,73 @@ func (fs *memFS) Rename(
 	// Finally, remove the old name from the old parent.
 	oldParent.RemoveChild(op.OldName)
 
+	child.mu.Lock()
+	child.touchChanged()
+	child.mu.Unlock()
+
+	return nil
+}
+
+func (fs *memFS) ExchangeData(
+	ctx context.Context,
+	op *fuseops.ExchangeDataOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Find both files.
+	oldParent := fs.getInodeOrDie(op.OldParent)
+	oldID, _, ok := oldParent.LookUpChild(op.OldName)
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	newParent := fs.getInodeOrDie(op.NewParent)
+	newID, _, ok := newParent.LookUpChild(op.NewName)
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	oldInode := fs.getInodeOrDie(oldID)
+	newInode := fs.getInodeOrDie(newID)
+	if !oldInode.isFile() || !newInode.isFile() {
+		return fuse.EINVAL
+	}
+
+	// Both files are written to.
+	if err := fs.checkAccess(oldInode, op.OpContext, permWrite); err != nil {
+		return err
+	}
+
+	if err := fs.checkAccess(newInode, op.OpContext, permWrite); err != nil {
+		return err
+	}
+
+	// Two links to the same file have nothing to exchange.
+	if oldID == newID {
+		return nil
+	}
+
+	// Lock the inodes in ID order so that we can't deadlock with another
+	// exchange of the same pair.
+	first, second := oldInode, newInode
+	if newID < oldID {
+		first, second = second, first
+	}
+
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	second.mu.Lock()
+	defer second.mu.Unlock()
+
+	// Swap the contents and what describes them, leaving ownership, mode and
+	// the like with the names.
+	oldInode.contents, newInode.contents = newInode.contents, oldInode.contents
+	oldInode.attrs.Size, newInode.attrs.Size = newInode.attrs.Size, oldInode.attrs.Size
+	oldInode.attrs.Mtime, newInode.attrs.Mtime = newInode.attrs.Mtime, oldInode.attrs.Mtime
+
+	oldInode.touchChanged()
+	newInode.touchChanged()
+
 	return nil
 }
 
@@ -545,6 +1083,9 @@ func (fs *memFS) RmDir(
 
 	// Grab the child.
 	child := fs.getInodeOrDie(childID)
+	if err := fs.checkDelete(parent, child, op.OpContext); err != nil {
+		return err
+	}
 
 	// Make sure the child is empty.
 	if child.Len() != 0 {
@@ -555,7 +1096,7 @@ func (fs *memFS) RmDir(
 	parent.RemoveChild(op.Name)
 
 	// Mark the child as unlinked.
-	child.attrs.Nlink--
+	fs.unlinkInode(childID)
 
 	return nil
 }
@@ -577,12 +1118,15 @@ func (fs *memFS) Unlink(
 
 	// Grab the child.
 	child := fs.getInodeOrDie(childID)
+	if err := fs.checkDelete(parent, child, op.OpContext); err != nil {
+		return err
+	}
 
 	// Remove the entry within the parent.
 	parent.RemoveChild(op.Name)
 
 	// Mark the child as unlinked.
-	child.attrs.Nlink--
+	fs.unlinkInode(childID)
 
 	return nil
 }
@@ -602,7 +1146,7 @@ func (fs *memFS) OpenDir(
 		panic("Found non-dir.")
 	}
 
-	return nil
+	return fs.checkAccess(inode, op.OpContext, permRead)
 }
 
 func (fs *memFS) ReadDir(
@@ -616,6 +1160,7 @@ func (fs *memFS) ReadDir(
 
 	// Serve the request.
 	op.BytesRead = inode.ReadDir(op.Dst, int(op.Offset))
+	fs.touchAccessed(inode)
 
 	return nil
 }
@@ -635,6 +1180,10 @@ func (fs *memFS) OpenFile(
 		panic("Found non-file.")
 	}
 
+	if err := fs.checkOpen(inode, op.OpContext, op.OpenFlags); err != nil {
+		return err
+	}
+
 	if inode.name == CheckFileOpenFlagsFileName {
 		// For testing purpose only.
 		// Set attribute (name=fileOpenFlagsXattr, value=OpenFlags) to test whether
@@ -650,21 +1199,34 @@ func (fs *memFS) OpenFile(
 		}
 	}
 
+	// With atomic_o_trunc, truncation is left to us.
+	if op.OpenFlags&fusekernel.OpenTruncate != 0 {
+		var size uint64
+		inode.mu.Lock()
+		fs.charge(inode, inode.attrs.Size, size)
+		inode.SetAttributes(&size, nil, nil, nil)
+		inode.mu.Unlock()
+	}
+
+	op.Handle = fs.openHandle(op.Inode, op.OpenFlags)
 	return nil
 }
 
 func (fs *memFS) ReadFile(
 	ctx context.Context,
 	op *fuseops.ReadFileOp) error {
+	// Find the inode in question. The file system lock isn't needed after
+	// that, so that reads of different files don't wait for each other.
 	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	// Find the inode in question.
 	inode := fs.getInodeOrDie(op.Inode)
+	fs.mu.Unlock()
 
 	// Serve the request.
 	var err error
+	inode.mu.RLock()
 	op.BytesRead, err = inode.ReadAt(op.Dst, op.Offset)
+	inode.mu.RUnlock()
+	fs.touchAccessed(inode)
 
 	op.Callback = fs.readFileCallback
 
@@ -679,11 +1241,30 @@ func (fs *memFS) ReadFile(
 func (fs *memFS) WriteFile(
 	ctx context.Context,
 	op *fuseops.WriteFileOp) error {
+	// Find the inode in question. As for ReadFile, only the inode's lock is
+	// held while writing.
+	//
+	// Appending writes go to the end of the file, whatever the kernel thinks
+	// that is. With writeback caching the kernel has already worked out the
+	// offset, and may send the write through any handle.
 	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	// Find the inode in question.
 	inode := fs.getInodeOrDie(op.Inode)
+	h, ok := fs.handles[op.Handle]
+	appending := ok && h.append && !fs.writebackCache
+	fs.mu.Unlock()
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	if appending {
+		op.Offset = int64(inode.attrs.Size)
+	}
+
+	oldSize := inode.attrs.Size
+	newSize := max(oldSize, uint64(op.Offset)+uint64(len(op.Data)))
+	if err := fs.charge(inode, oldSize, newSize); err != nil {
+		return err
+	}
 
 	// Serve the request.
 	_, err := inode.WriteAt(op.Data, op.Offset)
@@ -693,6 +1274,24 @@ func (fs *memFS) WriteFile(
 	return err
 }
 
+func (fs *memFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	h, ok := fs.handles[op.Handle]
+	if !ok {
+		panic(fmt.Sprintf("Unknown handle: %v", op.Handle))
+	}
+
+	delete(fs.handles, op.Handle)
+	fs.getInodeOrDie(h.inode).openCount--
+	fs.maybeDeallocateInode(h.inode)
+
+	return nil
+}
+
 func (fs *memFS) FlushFile(
 	ctx context.Context,
 	op *fuseops.FlushFileOp) (err error) {
@@ -710,6 +1309,7 @@ func (fs *memFS) ReadSymlink(
 
 	// Serve the request.
 	op.Target = inode.target
+	fs.touchAccessed(inode)
 
 	return nil
 }
@@ -720,6 +1320,10 @@ func (fs *memFS) GetXattr(ctx context.Context,
 	defer fs.mu.Unlock()
 
 	inode := fs.getInodeOrDie(op.Inode)
+	if err := fs.checkAccess(inode, op.OpContext, permRead); err != nil {
+		return err
+	}
+
 	if value, ok := inode.xattrs[op.Name]; ok {
 		op.BytesRead = len(value)
 		if len(op.Dst) >= len(value) {
@@ -762,9 +1366,16 @@ func (fs *memFS) RemoveXattr(ctx context.Context,
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 	inode := fs.getInodeOrDie(op.Inode)
+	if err := fs.checkAccess(inode, op.OpContext, permWrite); err != nil {
+		return err
+	}
 
 	if _, ok := inode.xattrs[op.Name]; ok {
 		delete(inode.xattrs, op.Name)
+
+		inode.mu.Lock()
+		inode.touchChanged()
+		inode.mu.Unlock()
 	} else {
 		return fuse.ENOATTR
 	}
@@ -776,6 +1387,9 @@ func (fs *memFS) SetXattr(ctx context.Context,
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 	inode := fs.getInodeOrDie(op.Inode)
+	if err := fs.checkAccess(inode, op.OpContext, permWrite); err != nil {
+		return err
+	}
 
 	return fs.setXattrHelper(inode, op)
 }
@@ -785,11 +1399,11 @@ func (fs *memFS) setXattrHelper(inode *inode, op *fuseops.SetXattrOp) error {
 	_, ok := inode.xattrs[op.Name]
 
 	switch op.Flags {
-	case unix.XATTR_CREATE:
+	case fuseops.XattrCreate:
 		if ok {
 			return fuse.EEXIST
 		}
-	case unix.XATTR_REPLACE:
+	case fuseops.XattrReplace:
 		if !ok {
 			return fuse.ENOATTR
 		}
@@ -798,6 +1412,11 @@ func (fs *memFS) setXattrHelper(inode *inode, op *fuseops.SetXattrOp) error {
 	value := make([]byte, len(op.Value))
 	copy(value, op.Value)
 	inode.xattrs[op.Name] = value
+
+	inode.mu.Lock()
+	inode.touchChanged()
+	inode.mu.Unlock()
+
 	return nil
 }
 
@@ -806,6 +1425,25 @@ func (fs *memFS) Fallocate(ctx context.Context,
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 	inode := fs.getInodeOrDie(op.Inode)
-	inode.Fallocate(op.Mode, op.Offset, op.Length)
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	// Only plain preallocation changes the size.
+	oldSize := inode.attrs.Size
+	newSize := oldSize
+	if op.Mode == 0 {
+		newSize = max(oldSize, op.Offset+op.Length)
+	}
+
+	if err := fs.charge(inode, oldSize, newSize); err != nil {
+		return err
+	}
+
+	if err := inode.Fallocate(op.Mode, op.Offset, op.Length); err != nil {
+		fs.charge(inode, newSize, oldSize)
+		return err
+	}
+
 	return nil
 }
@@ -0,0 +1,101 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/sys/unix"
+)
+
+////////////////////////////////////////////////////////////////////////
+// fallocate
+////////////////////////////////////////////////////////////////////////
+
+type FallocateTest struct {
+	memFSTest
+}
+
+func init() { RegisterTestSuite(&FallocateTest{}) }
+
+// Create a file with the supplied contents and open it for writing.
+func (t *FallocateTest) createFile(contents string) (*os.File, string) {
+	p := path.Join(t.Dir, "foo")
+	err := ioutil.WriteFile(p, []byte(contents), 0600)
+	AssertEq(nil, err)
+
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	return f, p
+}
+
+func (t *FallocateTest) KeepSize() {
+	f, p := t.createFile("taco")
+
+	// Preallocating past the end shouldn't change the size.
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, 100)
+	AssertEq(nil, err)
+
+	fi, err := f.Stat()
+	AssertEq(nil, err)
+	ExpectEq(4, fi.Size())
+
+	contents, err := ioutil.ReadFile(p)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *FallocateTest) PunchHole() {
+	f, p := t.createFile("tacoburrito")
+
+	// Punch a hole in the middle, and one running past the end.
+	mode := unix.FALLOC_FL_PUNCH_HOLE | unix.FALLOC_FL_KEEP_SIZE
+
+	err := unix.Fallocate(int(f.Fd()), uint32(mode), 2, 4)
+	AssertEq(nil, err)
+
+	err = unix.Fallocate(int(f.Fd()), uint32(mode), 9, 100)
+	AssertEq(nil, err)
+
+	// The size should be unchanged, and the holes should read as zeroes.
+	fi, err := f.Stat()
+	AssertEq(nil, err)
+	ExpectEq(11, fi.Size())
+
+	contents, err := ioutil.ReadFile(p)
+	AssertEq(nil, err)
+	ExpectEq("ta\x00\x00\x00\x00rrit\x00\x00", string(contents))
+}
+
+func (t *FallocateTest) UnsupportedMode() {
+	f, p := t.createFile("taco")
+
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_ZERO_RANGE, 0, 2)
+	ExpectEq(unix.EOPNOTSUPP, err)
+
+	// The kernel should still send plain fallocate requests afterward.
+	err = unix.Fallocate(int(f.Fd()), 0, 0, 6)
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(p)
+	AssertEq(nil, err)
+	ExpectThat(contents, DeepEquals([]byte("taco\x00\x00")))
+}
@@ -17,6 +17,7 @@ package memfs_test
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -25,6 +26,7 @@ import (
 	"reflect"
 	"runtime"
 	"strconv"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -37,6 +39,7 @@ import (
 	"github.com/jacobsa/fuse/samples/memfs"
 	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
 	"golang.org/x/sys/unix"
 )
 
@@ -625,6 +628,42 @@ func (t *MemFSTest) Rmdir_NonExistent() {
 	ExpectThat(err, Error(HasSubstr("no such file or directory")))
 }
 
+func (t *MemFSTest) UnlinkFile_StillOpen_FreedOnClose() {
+	// Return the number of inodes in use.
+	inodesUsed := func() uint64 {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(t.Dir, &stat)
+		AssertEq(nil, err)
+
+		return stat.Files - stat.Ffree
+	}
+
+	before := inodesUsed()
+
+	// Create and open a file, then unlink it.
+	fileName := path.Join(t.Dir, "foo")
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0600)
+	AssertEq(nil, err)
+
+	err = os.Remove(fileName)
+	AssertEq(nil, err)
+
+	// The inode should survive as long as the file is open.
+	ExpectEq(before+1, inodesUsed())
+
+	// Once it's closed, the kernel should forget the inode, and the file system
+	// should free it. Forgetting is asynchronous, so wait for it.
+	err = f.Close()
+	AssertEq(nil, err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for inodesUsed() != before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ExpectEq(before, inodesUsed())
+}
+
 func (t *MemFSTest) Rmdir_OpenedForReading() {
 	var err error
 
@@ -774,6 +813,70 @@ func (t *MemFSTest) WriteStartsPastEndOfFile() {
 	ExpectEq("\x00\x00taco", string(contents))
 }
 
+func (t *MemFSTest) WriteStartsPastEndOfFile_AppendMode() {
+	var err error
+	var n int
+
+	// Create a file.
+	f, err := os.OpenFile(
+		path.Join(t.Dir, "foo"),
+		os.O_RDWR|os.O_APPEND|os.O_CREATE,
+		0600)
+
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	// Write three bytes.
+	n, err = f.Write([]byte("111"))
+	AssertEq(nil, err)
+	AssertEq(3, n)
+
+	// Write at offset six.
+	n, err = syscall.Pwrite(int(f.Fd()), []byte("222"), 6)
+	AssertEq(nil, err)
+	AssertEq(3, n)
+
+	// Read the full contents of the file. See the notes on the pwrite(2) bug in
+	// PosixTest.WriteStartsPastEndOfFile_AppendMode.
+	contents, err := ioutil.ReadFile(f.Name())
+	AssertEq(nil, err)
+
+	if runtime.GOOS == "linux" {
+		ExpectEq("111222", string(contents))
+	} else {
+		ExpectEq("111\x00\x00\x00222", string(contents))
+	}
+}
+
+func (t *MemFSTest) AppendMode_TwoHandles() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Open the same file twice, once in append mode.
+	f1, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	t.ToClose = append(t.ToClose, f1)
+	AssertEq(nil, err)
+
+	f2, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	t.ToClose = append(t.ToClose, f2)
+	AssertEq(nil, err)
+
+	// Interleave writes through each. Appending writes should always land at
+	// the end, after whatever the other handle wrote.
+	_, err = f1.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = f2.WriteAt([]byte("burrito"), 4)
+	AssertEq(nil, err)
+
+	_, err = f1.Write([]byte("enchilada"))
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(fileName)
+	AssertEq(nil, err)
+	ExpectEq("tacoburritoenchilada", string(contents))
+}
+
 func (t *MemFSTest) WriteAtDoesntChangeOffset_NotAppendMode() {
 	var err error
 	var n int
@@ -936,6 +1039,63 @@ func (t *MemFSTest) ReadsPastEndOfFile() {
 	ExpectEq("", string(buf[:n]))
 }
 
+func (t *MemFSTest) ConcurrentReadsAndWrites() {
+	const numFiles = 4
+	const numWrites = 64
+	const writeSize = 4096
+
+	// Write to several files at once, reading each back as we go.
+	var wg sync.WaitGroup
+	errs := make(chan error, numFiles)
+	for i := 0; i < numFiles; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- func() error {
+				f, err := os.Create(path.Join(t.Dir, strconv.Itoa(i)))
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+
+				data := bytes.Repeat([]byte{byte('a' + i)}, writeSize)
+				buf := make([]byte, writeSize)
+				for j := 0; j < numWrites; j++ {
+					off := int64(j * writeSize)
+					if _, err := f.WriteAt(data, off); err != nil {
+						return err
+					}
+
+					if _, err := f.ReadAt(buf, off); err != nil {
+						return err
+					}
+
+					if !bytes.Equal(data, buf) {
+						return fmt.Errorf("File %d: unexpected contents at %d", i, off)
+					}
+				}
+
+				return nil
+			}()
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		ExpectEq(nil, err)
+	}
+
+	// Each file should contain only what was written to it.
+	for i := 0; i < numFiles; i++ {
+		contents, err := ioutil.ReadFile(path.Join(t.Dir, strconv.Itoa(i)))
+		AssertEq(nil, err)
+		ExpectTrue(bytes.Equal(
+			bytes.Repeat([]byte{byte('a' + i)}, numWrites*writeSize),
+			contents))
+	}
+}
+
 func (t *MemFSTest) Truncate_Smaller() {
 	var err error
 	fileName := path.Join(t.Dir, memfs.CheckFileOpenFlagsFileName)
@@ -1022,6 +1182,47 @@ func (t *MemFSTest) Truncate_Larger() {
 	ExpectEq("taco\x00\x00", string(contents))
 }
 
+func (t *MemFSTest) Truncate_HugeSparse() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Create a file.
+	err = ioutil.WriteFile(fileName, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	// Open it for modification.
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	// Make it a terabyte long, which should take no space for the hole.
+	const size = 1 << 40
+	err = f.Truncate(size)
+	AssertEq(nil, err)
+
+	fi, err := f.Stat()
+	AssertEq(nil, err)
+	ExpectEq(size, fi.Size())
+
+	// Write in the middle, then read around it and at the end.
+	_, err = f.WriteAt([]byte("burrito"), size/2)
+	AssertEq(nil, err)
+
+	buf := make([]byte, 11)
+	_, err = f.ReadAt(buf, size/2-2)
+	AssertEq(nil, err)
+	ExpectEq("\x00\x00burrito\x00\x00", string(buf))
+
+	n, err := f.ReadAt(buf, size-4)
+	ExpectEq(io.EOF, err)
+	ExpectThat(buf[:n], DeepEquals(make([]byte, 4)))
+
+	// The beginning should be intact.
+	_, err = f.ReadAt(buf[:4], 0)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(buf[:4]))
+}
+
 func (t *MemFSTest) Chmod() {
 	var err error
 	fileName := path.Join(t.Dir, "foo")
@@ -1059,6 +1260,106 @@ func (t *MemFSTest) Chtimes() {
 	ExpectThat(fi, fusetesting.MtimeIsWithin(expectedMtime, timeSlop))
 }
 
+func (t *MemFSTest) Chtimes_Atime() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Create a file.
+	err = ioutil.WriteFile(fileName, []byte(""), 0600)
+	AssertEq(nil, err)
+
+	// Chtimes it.
+	expectedAtime := time.Now().Add(-123 * time.Second).Round(time.Second)
+	err = os.Chtimes(fileName, expectedAtime, time.Now())
+	AssertEq(nil, err)
+
+	// Stat it.
+	fi, err := os.Stat(fileName)
+	AssertEq(nil, err)
+
+	atime, _, _ := fusetesting.GetTimes(fi)
+	ExpectThat(atime, timeutil.TimeNear(expectedAtime, timeSlop))
+}
+
+func (t *MemFSTest) Chmod_Timestamps() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Create a file with times in the past.
+	err = ioutil.WriteFile(fileName, []byte(""), 0600)
+	AssertEq(nil, err)
+
+	past := time.Now().Add(-123 * time.Second).Round(time.Second)
+	err = os.Chtimes(fileName, past, past)
+	AssertEq(nil, err)
+
+	// Chmod it.
+	chmodTime := time.Now()
+	err = os.Chmod(fileName, 0754)
+	AssertEq(nil, err)
+
+	// Only the ctime should have changed.
+	fi, err := os.Stat(fileName)
+	AssertEq(nil, err)
+
+	atime, ctime, mtime := fusetesting.GetTimes(fi)
+	ExpectThat(atime, timeutil.TimeNear(past, timeSlop))
+	ExpectThat(mtime, timeutil.TimeNear(past, timeSlop))
+	ExpectThat(ctime, timeutil.TimeNear(chmodTime, timeSlop))
+}
+
+func (t *MemFSTest) Read_UpdatesAtime() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Create a file with times in the past.
+	err = ioutil.WriteFile(fileName, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	past := time.Now().Add(-123 * time.Second).Round(time.Second)
+	err = os.Chtimes(fileName, past, past)
+	AssertEq(nil, err)
+
+	// Read it.
+	readTime := time.Now()
+	_, err = ioutil.ReadFile(fileName)
+	AssertEq(nil, err)
+
+	// The atime should have changed, but not the mtime.
+	fi, err := os.Stat(fileName)
+	AssertEq(nil, err)
+
+	atime, _, mtime := fusetesting.GetTimes(fi)
+	ExpectThat(atime, timeutil.TimeNear(readTime, timeSlop))
+	ExpectThat(mtime, timeutil.TimeNear(past, timeSlop))
+}
+
+func (t *MemFSTest) ReadDir_UpdatesAtime() {
+	var err error
+	dirName := path.Join(t.Dir, "dir")
+
+	// Create a directory with times in the past.
+	err = os.Mkdir(dirName, 0700)
+	AssertEq(nil, err)
+
+	past := time.Now().Add(-123 * time.Second).Round(time.Second)
+	err = os.Chtimes(dirName, past, past)
+	AssertEq(nil, err)
+
+	// List it.
+	readTime := time.Now()
+	_, err = fusetesting.ReadDirPicky(dirName)
+	AssertEq(nil, err)
+
+	// The atime should have changed, but not the mtime.
+	fi, err := os.Stat(dirName)
+	AssertEq(nil, err)
+
+	atime, _, mtime := fusetesting.GetTimes(fi)
+	ExpectThat(atime, timeutil.TimeNear(readTime, timeSlop))
+	ExpectThat(mtime, timeutil.TimeNear(past, timeSlop))
+}
+
 func (t *MemFSTest) ReadDirWhileModifying() {
 	dirName := path.Join(t.Dir, "dir")
 	createFile := func(name string) {
@@ -1822,6 +2123,140 @@ func (t *MemFSTest) RenameNonExistentFile() {
 	ExpectThat(err, Error(HasSubstr("no such file")))
 }
 
+func (t *MemFSTest) RenameOverExistingFile_OpenHandle() {
+	var err error
+
+	// Create two files, and open the second.
+	oldPath := path.Join(t.Dir, "foo")
+	err = ioutil.WriteFile(oldPath, []byte("taco"), 0400)
+	AssertEq(nil, err)
+
+	newPath := path.Join(t.Dir, "bar")
+	err = ioutil.WriteFile(newPath, []byte("burrito"), 0600)
+	AssertEq(nil, err)
+
+	f, err := os.Open(newPath)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	// Rename one over the other.
+	err = os.Rename(oldPath, newPath)
+	AssertEq(nil, err)
+
+	// The replaced file should show as having no links, but its contents
+	// should still be available through the handle.
+	fi, err := f.Stat()
+	AssertEq(nil, err)
+	ExpectEq(0, fi.Sys().(*syscall.Stat_t).Nlink)
+
+	buf := make([]byte, 1024)
+	n, err := f.ReadAt(buf, 0)
+	AssertEq(io.EOF, err)
+	ExpectEq("burrito", string(buf[:n]))
+
+	// The new name should refer to the renamed file.
+	contents, err := ioutil.ReadFile(newPath)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *MemFSTest) RenameAcrossDirs_OverExistingFile() {
+	var err error
+
+	// Create two parent directories, each with a file.
+	oldParentPath := path.Join(t.Dir, "old")
+	newParentPath := path.Join(t.Dir, "new")
+
+	err = os.Mkdir(oldParentPath, 0700)
+	AssertEq(nil, err)
+
+	err = os.Mkdir(newParentPath, 0700)
+	AssertEq(nil, err)
+
+	oldPath := path.Join(oldParentPath, "foo")
+	err = ioutil.WriteFile(oldPath, []byte("taco"), 0400)
+	AssertEq(nil, err)
+
+	newPath := path.Join(newParentPath, "bar")
+	err = ioutil.WriteFile(newPath, []byte("burrito"), 0600)
+	AssertEq(nil, err)
+
+	// Rename the first over the second.
+	err = os.Rename(oldPath, newPath)
+	AssertEq(nil, err)
+
+	// The old parent should now be empty.
+	entries, err := fusetesting.ReadDirPicky(oldParentPath)
+	AssertEq(nil, err)
+	ExpectEq(0, len(entries))
+
+	// The new one should contain only the renamed file.
+	entries, err = fusetesting.ReadDirPicky(newParentPath)
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	fi := entries[0]
+
+	ExpectEq("bar", fi.Name())
+	ExpectEq(os.FileMode(0400), fi.Mode())
+	ExpectEq(len("taco"), fi.Size())
+}
+
+func (t *MemFSTest) RenameOverEmptyDirectory() {
+	var err error
+
+	// Create a non-empty directory and an empty one.
+	oldPath := path.Join(t.Dir, "foo")
+	err = os.MkdirAll(path.Join(oldPath, "child"), 0700)
+	AssertEq(nil, err)
+
+	newPath := path.Join(t.Dir, "bar")
+	err = os.Mkdir(newPath, 0700)
+	AssertEq(nil, err)
+
+	// Rename the first over the second. os.Rename refuses to do this, so go
+	// straight to the system call.
+	err = syscall.Rename(oldPath, newPath)
+	AssertEq(nil, err)
+
+	// Only the renamed directory should remain, with its contents.
+	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq("bar", entries[0].Name())
+	ExpectTrue(entries[0].IsDir())
+
+	entries, err = fusetesting.ReadDirPicky(newPath)
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq("child", entries[0].Name())
+}
+
+func (t *MemFSTest) RenameOverNonEmptyDirectory() {
+	var err error
+
+	// Create an empty directory and a non-empty one.
+	oldPath := path.Join(t.Dir, "foo")
+	err = os.Mkdir(oldPath, 0700)
+	AssertEq(nil, err)
+
+	newPath := path.Join(t.Dir, "bar")
+	err = os.MkdirAll(path.Join(newPath, "child"), 0700)
+	AssertEq(nil, err)
+
+	// Renaming over the non-empty directory should fail.
+	err = syscall.Rename(oldPath, newPath)
+	ExpectEq(syscall.ENOTEMPTY, err)
+
+	// Both should still be present.
+	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	AssertEq(nil, err)
+	ExpectEq(2, len(entries))
+
+	entries, err = fusetesting.ReadDirPicky(newPath)
+	AssertEq(nil, err)
+	ExpectEq(1, len(entries))
+}
+
 func (t *MemFSTest) NoXattrs() {
 	var err error
 	var sz int
@@ -2035,6 +2470,329 @@ func (t *MknodTest) Fallocate_Larger() {
 	ExpectEq("taco\x00\x00", string(contents))
 }
 
+////////////////////////////////////////////////////////////////////////
+// noatime
+////////////////////////////////////////////////////////////////////////
+
+type NoAtimeTest struct {
+	memFSTest
+}
+
+func init() { RegisterTestSuite(&NoAtimeTest{}) }
+
+func (t *NoAtimeTest) SetUp(ti *TestInfo) {
+	t.MountConfig.DisableWritebackCaching = true
+
+	t.Server = memfs.NewMemFSWithOptions(
+		currentUid(),
+		currentGid(),
+		memfs.Options{NoAtime: true})
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *NoAtimeTest) Read_DoesntUpdateAtime() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Create a file with times in the past.
+	err = ioutil.WriteFile(fileName, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	past := time.Now().Add(-123 * time.Second).Round(time.Second)
+	err = os.Chtimes(fileName, past, past)
+	AssertEq(nil, err)
+
+	// Read it.
+	contents, err := ioutil.ReadFile(fileName)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	// The atime should be unchanged.
+	fi, err := os.Stat(fileName)
+	AssertEq(nil, err)
+
+	atime, _, _ := fusetesting.GetTimes(fi)
+	ExpectThat(atime, timeutil.TimeNear(past, timeSlop))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Permission checking in the file system
+////////////////////////////////////////////////////////////////////////
+
+type CheckPermissionsTest struct {
+	memFSTest
+}
+
+func init() { RegisterTestSuite(&CheckPermissionsTest{}) }
+
+func (t *CheckPermissionsTest) SetUp(ti *TestInfo) {
+	t.MountConfig.DisableWritebackCaching = true
+	t.MountConfig.DisableDefaultPermissions = true
+
+	t.Server = memfs.NewMemFSWithOptions(
+		currentUid(),
+		currentGid(),
+		memfs.Options{CheckPermissions: true})
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *CheckPermissionsTest) NewFileOwnedByCaller() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	err = ioutil.WriteFile(fileName, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(fileName)
+	AssertEq(nil, err)
+
+	stat := fi.Sys().(*syscall.Stat_t)
+	ExpectEq(currentUid(), stat.Uid)
+	ExpectEq(currentGid(), stat.Gid)
+}
+
+func (t *CheckPermissionsTest) Chmod_SpecialBits() {
+	var err error
+	dirName := path.Join(t.Dir, "dir")
+
+	err = os.Mkdir(dirName, 0700)
+	AssertEq(nil, err)
+
+	err = os.Chmod(dirName, 0777|os.ModeSticky)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(dirName)
+	AssertEq(nil, err)
+	ExpectEq(os.ModeDir|os.ModeSticky|0777, fi.Mode())
+}
+
+func (t *CheckPermissionsTest) Mkdir_PermissionDenied() {
+	// Root bypasses the checks.
+	if currentUid() == 0 {
+		return
+	}
+
+	var err error
+
+	// Create a directory within the root without write permissions.
+	err = os.Mkdir(path.Join(t.Dir, "parent"), 0500)
+	AssertEq(nil, err)
+
+	// Attempt to create a child of that directory.
+	err = os.Mkdir(path.Join(t.Dir, "parent/dir"), 0754)
+	ExpectThat(err, Error(HasSubstr("permission denied")))
+}
+
+func (t *CheckPermissionsTest) Open_PermissionDenied() {
+	// Root bypasses the checks.
+	if currentUid() == 0 {
+		return
+	}
+
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Create a file that we may write but not read.
+	err = ioutil.WriteFile(fileName, []byte("taco"), 0200)
+	AssertEq(nil, err)
+
+	_, err = os.Open(fileName)
+	ExpectThat(err, Error(HasSubstr("permission denied")))
+
+	// Writing should still work.
+	f, err := os.OpenFile(fileName, os.O_WRONLY, 0)
+	t.ToClose = append(t.ToClose, f)
+	ExpectEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Capacity
+////////////////////////////////////////////////////////////////////////
+
+const capacityBlocks = 4
+
+type CapacityTest struct {
+	memFSTest
+}
+
+func init() { RegisterTestSuite(&CapacityTest{}) }
+
+func (t *CapacityTest) SetUp(ti *TestInfo) {
+	t.MountConfig.DisableWritebackCaching = true
+
+	t.Server = memfs.NewMemFSWithOptions(
+		currentUid(),
+		currentGid(),
+		memfs.Options{Capacity: capacityBlocks * 4096})
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *CapacityTest) statFS() syscall.Statfs_t {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(t.Dir, &stat)
+	AssertEq(nil, err)
+
+	return stat
+}
+
+func (t *CapacityTest) StatFS_Empty() {
+	stat := t.statFS()
+	ExpectEq(capacityBlocks, stat.Blocks)
+	ExpectEq(capacityBlocks, stat.Bfree)
+	ExpectEq(capacityBlocks, stat.Bavail)
+}
+
+func (t *CapacityTest) StatFS_PartiallyFull() {
+	var err error
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "foo"), make([]byte, 4096), 0600)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "bar"), make([]byte, 1), 0600)
+	AssertEq(nil, err)
+
+	// The partially used block counts as used, and isn't free either.
+	stat := t.statFS()
+	ExpectEq(capacityBlocks, stat.Blocks)
+	ExpectEq(capacityBlocks-2, stat.Bfree)
+}
+
+func (t *CapacityTest) Write_NoSpace() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Fill the file system.
+	err = ioutil.WriteFile(fileName, make([]byte, capacityBlocks*4096), 0600)
+	AssertEq(nil, err)
+	ExpectEq(0, t.statFS().Bfree)
+
+	// Appending should fail, and leave the file alone.
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	_, err = f.Write([]byte("taco"))
+	ExpectThat(err, Error(HasSubstr("no space left")))
+
+	fi, err := os.Stat(fileName)
+	AssertEq(nil, err)
+	ExpectEq(capacityBlocks*4096, fi.Size())
+
+	// Overwriting within the file is fine.
+	_, err = f.WriteAt([]byte("taco"), 0)
+	ExpectEq(nil, err)
+}
+
+func (t *CapacityTest) Truncate_NoSpace() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	err = ioutil.WriteFile(fileName, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Truncate(fileName, capacityBlocks*4096+1)
+	ExpectThat(err, Error(HasSubstr("no space left")))
+
+	err = os.Truncate(fileName, capacityBlocks*4096)
+	ExpectEq(nil, err)
+}
+
+func (t *CapacityTest) Unlink_FreesSpace() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Fill the file system, then remove the file.
+	err = ioutil.WriteFile(fileName, make([]byte, capacityBlocks*4096), 0600)
+	AssertEq(nil, err)
+
+	err = os.Remove(fileName)
+	AssertEq(nil, err)
+
+	// The space should be available again.
+	ExpectEq(capacityBlocks, t.statFS().Bfree)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "bar"), []byte("taco"), 0600)
+	ExpectEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Snapshots
+////////////////////////////////////////////////////////////////////////
+
+type SnapshotTest struct {
+	memFSTest
+	fs memfs.MemFS
+}
+
+func init() { RegisterTestSuite(&SnapshotTest{}) }
+
+func (t *SnapshotTest) SetUp(ti *TestInfo) {
+	t.MountConfig.DisableWritebackCaching = true
+
+	t.fs = memfs.NewMemFSWithOptions(currentUid(), currentGid(), memfs.Options{})
+	t.Server = t.fs
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *SnapshotTest) SaveAndLoad() {
+	var err error
+
+	// Set up some contents.
+	err = os.Mkdir(path.Join(t.Dir, "dir"), 0750)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "dir/foo"), []byte("taco"), 0640)
+	AssertEq(nil, err)
+
+	err = os.Symlink("dir/foo", path.Join(t.Dir, "bar"))
+	AssertEq(nil, err)
+
+	// Save them, and load them into a new file system.
+	var buf bytes.Buffer
+	err = t.fs.Save(&buf)
+	AssertEq(nil, err)
+
+	server := memfs.NewMemFSWithOptions(currentUid(), currentGid(), memfs.Options{})
+	err = server.Load(&buf)
+	AssertEq(nil, err)
+
+	// Mount it alongside the original.
+	dir, err := ioutil.TempDir("", "memfs_test")
+	AssertEq(nil, err)
+	defer os.Remove(dir)
+
+	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{})
+	AssertEq(nil, err)
+
+	defer func() {
+		AssertEq(nil, fuse.Unmount(dir))
+		AssertEq(nil, mfs.Join(t.Ctx))
+	}()
+
+	// The contents should have survived.
+	fi, err := os.Stat(path.Join(dir, "dir"))
+	AssertEq(nil, err)
+	ExpectEq(os.ModeDir|0750, fi.Mode())
+
+	fi, err = os.Stat(path.Join(dir, "dir/foo"))
+	AssertEq(nil, err)
+	ExpectEq(0640, fi.Mode())
+
+	contents, err := ioutil.ReadFile(path.Join(dir, "bar"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	// And the loaded file system should be usable.
+	err = ioutil.WriteFile(path.Join(dir, "baz"), []byte("burrito"), 0600)
+	ExpectEq(nil, err)
+}
+
+func (t *SnapshotTest) Load_Garbage() {
+	server := memfs.NewMemFSWithOptions(currentUid(), currentGid(), memfs.Options{})
+	err := server.Load(bytes.NewReader([]byte("taco")))
+	ExpectNe(nil, err)
+}
+
 ////////////////////////////////////////////////////////////////////////
 // atomic_o_trunc
 ////////////////////////////////////////////////////////////////////////
@@ -2073,6 +2831,27 @@ func (t *atomicOTruncTest) OpenFileWithOTrunc() {
 	}
 }
 
+func (t *atomicOTruncTest) OpenFileWithOTrunc_Contents() {
+	// Write a file.
+	fileName := path.Join(t.Dir, "foo")
+	err := ioutil.WriteFile(fileName, []byte("Hello, world!"), 0600)
+	AssertEq(nil, err)
+
+	// Open it with O_TRUNC. Whether the kernel truncates it with a separate
+	// SetInodeAttributesOp or leaves it to OpenFile, it should now be empty.
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_TRUNC, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	fi, err := f.Stat()
+	AssertEq(nil, err)
+	ExpectEq(0, fi.Size())
+
+	contents, err := ioutil.ReadFile(fileName)
+	AssertEq(nil, err)
+	ExpectEq("", string(contents))
+}
+
 type AtmoicOTruncEnabledTest struct {
 	atomicOTruncTest
 }
@@ -0,0 +1,182 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// The mode bits that chmod(2) may change.
+const modePermBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// Bits of an access mask, as for access(2).
+const (
+	permRead  = 04
+	permWrite = 02
+	permExec  = 01
+)
+
+// Return the owner for an inode created by the caller.
+func (fs *memFS) newOwner(ctx fuseops.OpContext) (uid uint32, gid uint32) {
+	if fs.checkPermissions {
+		return ctx.Uid, ctx.Gid
+	}
+
+	return fs.uid, fs.gid
+}
+
+// Does the caller bypass permission checks, either because they are disabled
+// or because the caller is root?
+func (fs *memFS) privileged(ctx fuseops.OpContext) bool {
+	return !fs.checkPermissions || ctx.Uid == 0
+}
+
+// Return EACCES unless the caller may access the inode in all of the ways
+// given by mask, a combination of permRead, permWrite and permExec. The
+// caller's supplementary groups aren't known, so only their primary group is
+// taken into account.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *memFS) checkAccess(
+	in *inode,
+	ctx fuseops.OpContext,
+	mask uint32) error {
+	if fs.privileged(ctx) {
+		return nil
+	}
+
+	perm := uint32(in.attrs.Mode.Perm())
+	switch {
+	case ctx.Uid == in.attrs.Uid:
+		perm >>= 6
+
+	case ctx.Gid == in.attrs.Gid:
+		perm >>= 3
+	}
+
+	if perm&mask != mask {
+		return syscall.EACCES
+	}
+
+	return nil
+}
+
+// Return an error unless the caller may open the inode with the supplied
+// flags.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *memFS) checkOpen(
+	in *inode,
+	ctx fuseops.OpContext,
+	flags fusekernel.OpenFlags) error {
+	var mask uint32
+	switch {
+	case flags.IsReadOnly():
+		mask = permRead
+
+	case flags.IsWriteOnly():
+		mask = permWrite
+
+	case flags.IsReadWrite():
+		mask = permRead | permWrite
+	}
+
+	if flags&fusekernel.OpenFlags(syscall.O_TRUNC) != 0 {
+		mask |= permWrite
+	}
+
+	return fs.checkAccess(in, ctx, mask)
+}
+
+// Return an error unless the caller may add entries to the directory.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *memFS) checkCreate(dir *inode, ctx fuseops.OpContext) error {
+	return fs.checkAccess(dir, ctx, permWrite|permExec)
+}
+
+// Return an error unless the caller may remove or replace the directory's
+// entry for child. As well as write and search permission on the directory,
+// this requires that the caller own the directory or the child if the
+// directory's sticky bit is set.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *memFS) checkDelete(
+	dir *inode,
+	child *inode,
+	ctx fuseops.OpContext) error {
+	if err := fs.checkAccess(dir, ctx, permWrite|permExec); err != nil {
+		return err
+	}
+
+	if fs.privileged(ctx) || dir.attrs.Mode&os.ModeSticky == 0 {
+		return nil
+	}
+
+	if ctx.Uid != dir.attrs.Uid && ctx.Uid != child.attrs.Uid {
+		return syscall.EPERM
+	}
+
+	return nil
+}
+
+// Return an error unless the caller may make the supplied changes to the
+// inode's attributes. Only the owner may change the mode or set the times
+// explicitly, and truncation requires write permission.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *memFS) checkSetAttributes(
+	in *inode,
+	op *fuseops.SetInodeAttributesOp) error {
+	ctx := op.OpContext
+	if fs.privileged(ctx) {
+		return nil
+	}
+
+	owner := ctx.Uid == in.attrs.Uid
+	if op.Uid != nil && *op.Uid != in.attrs.Uid {
+		return syscall.EPERM
+	}
+
+	if op.Gid != nil && *op.Gid != in.attrs.Gid && !(owner && *op.Gid == ctx.Gid) {
+		return syscall.EPERM
+	}
+
+	if op.Mode != nil && !owner {
+		return syscall.EPERM
+	}
+
+	// The kernel doesn't tell us whether times are being set to the current
+	// time, which anyone with write permission may do, or to explicit values,
+	// which only the owner may. Allow the former.
+	if (op.Atime != nil || op.Mtime != nil) && !owner {
+		if err := fs.checkAccess(in, ctx, permWrite); err != nil {
+			return syscall.EPERM
+		}
+	}
+
+	// ftruncate(2) is checked when the file is opened.
+	if op.Size != nil && op.Handle == nil {
+		if err := fs.checkAccess(in, ctx, permWrite); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
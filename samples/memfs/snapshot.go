@@ -0,0 +1,213 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// The version of the snapshot format written by Save. Bump this when making
+// incompatible changes to the types below.
+const snapshotVersion = 2
+
+// The gob-encoded form of the file system.
+type snapshot struct {
+	Version int
+
+	// The length of memFS.inodes. Free IDs are missing from Inodes.
+	NumInodes int
+	Inodes    map[fuseops.InodeID]inodeSnapshot
+}
+
+type inodeSnapshot struct {
+	Name     string
+	Attrs    fuseops.InodeAttributes
+	Entries  []fuseutil.Dirent
+	Contents map[int64][]byte
+	Target   string
+	Xattrs   map[string][]byte
+}
+
+// The MemFS returned by NewMemFSWithOptions.
+type server struct {
+	fuse.Server
+	fs *memFS
+}
+
+func (s *server) Save(w io.Writer) error {
+	return s.fs.save(w)
+}
+
+func (s *server) Load(r io.Reader) error {
+	return s.fs.load(r)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *memFS) save(w io.Writer) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Hold off writes while encoding.
+	fs.rlockInodes()
+	defer fs.runlockInodes()
+
+	snap := snapshot{
+		Version:   snapshotVersion,
+		NumInodes: len(fs.inodes),
+		Inodes:    make(map[fuseops.InodeID]inodeSnapshot),
+	}
+
+	for i, in := range fs.inodes {
+		// Skip files that have been unlinked but are still open, since nobody
+		// will be able to refer to them after loading.
+		if in == nil || (in.attrs.Nlink == 0 && i != fuseops.RootInodeID) {
+			continue
+		}
+
+		snap.Inodes[fuseops.InodeID(i)] = inodeSnapshot{
+			Name:     in.name,
+			Attrs:    in.attrs,
+			Entries:  in.entries,
+			Contents: in.contents,
+			Target:   in.target,
+			Xattrs:   in.xattrs,
+		}
+	}
+
+	if err := gob.NewEncoder(w).Encode(&snap); err != nil {
+		return fmt.Errorf("Encode: %v", err)
+	}
+
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *memFS) load(r io.Reader) error {
+	var snap snapshot
+	if err := gob.NewDecoder(r).Decode(&snap); err != nil {
+		return fmt.Errorf("Decode: %v", err)
+	}
+
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("Unsupported snapshot version: %d", snap.Version)
+	}
+
+	if snap.NumInodes <= fuseops.RootInodeID {
+		return fmt.Errorf("Bad inode count: %d", snap.NumInodes)
+	}
+
+	// Rebuild the inode table.
+	inodes := make([]*inode, snap.NumInodes)
+	var freeInodes []fuseops.InodeID
+	var usedBytes uint64
+	for id, s := range snap.Inodes {
+		if id < fuseops.RootInodeID || int(id) >= len(inodes) {
+			return fmt.Errorf("Bad inode ID: %d", id)
+		}
+
+		in := &inode{
+			name:     s.Name,
+			attrs:    s.Attrs,
+			entries:  s.Entries,
+			contents: s.Contents,
+			target:   s.Target,
+			xattrs:   s.Xattrs,
+		}
+
+		if in.contents == nil {
+			in.contents = make(fileContents)
+		}
+
+		if in.xattrs == nil {
+			in.xattrs = make(map[string][]byte)
+		}
+
+		if in.attrs.Nlink > 0 {
+			usedBytes += in.attrs.Size
+		}
+
+		inodes[id] = in
+	}
+
+	for i := fuseops.RootInodeID + 1; i < len(inodes); i++ {
+		if inodes[i] == nil {
+			freeInodes = append(freeInodes, fuseops.InodeID(i))
+		}
+	}
+
+	if inodes[fuseops.RootInodeID] == nil {
+		return fmt.Errorf("Missing root inode")
+	}
+
+	// The root inode starts with a lookup count of one.
+	inodes[fuseops.RootInodeID].IncrementLookupCount()
+
+	// Make sure that directory entries refer to inodes that exist.
+	for _, in := range inodes {
+		if in == nil {
+			continue
+		}
+
+		for _, e := range in.entries {
+			if e.Type == fuseutil.DT_Unknown {
+				continue
+			}
+
+			if int(e.Inode) >= len(inodes) || inodes[e.Inode] == nil {
+				return fmt.Errorf("Entry %q refers to unknown inode %d", e.Name, e.Inode)
+			}
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Check the result before committing to it, since the snapshot may have
+	// been corrupted.
+	candidate := &memFS{
+		inodes:     inodes,
+		freeInodes: freeInodes,
+	}
+	candidate.usedBytes.Store(usedBytes)
+
+	if err := candidate.validate(); err != nil {
+		return err
+	}
+
+	fs.inodes = inodes
+	fs.freeInodes = freeInodes
+	fs.usedBytes.Store(usedBytes)
+	fs.handles = make(map[fuseops.HandleID]fileHandle)
+
+	return nil
+}
+
+// Like checkInvariants, but returning an error rather than panicking.
+func (fs *memFS) validate() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Invalid snapshot: %v", r)
+		}
+	}()
+
+	fs.checkInvariants()
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples/cachewrap"
+	"github.com/jacobsa/fuse/samples/loopbackfs"
+)
+
+var fOrigin = flag.String("origin", "", "Directory to serve, typically on slow storage.")
+var fCacheDir = flag.String("cache_dir", "", "Directory in which to cache file contents. If unset, they are cached in memory.")
+var fCapacity = flag.Int64("capacity", 0, "Bytes of closed files to keep cached, or zero for no limit.")
+var fMountPoint = flag.String("mount_point", "", "Path to mount point.")
+
+var fDebug = flag.Bool("debug", false, "Enable debug logging.")
+
+func main() {
+	flag.Parse()
+
+	if *fOrigin == "" {
+		log.Fatalf("You must set --origin.")
+	}
+
+	if *fMountPoint == "" {
+		log.Fatalf("You must set --mount_point.")
+	}
+
+	// The kernel has already applied the caller's umask to the modes of new
+	// files, so don't apply ours as well.
+	syscall.Umask(0)
+
+	origin, err := loopbackfs.NewLoopbackFileSystem(*fOrigin)
+	if err != nil {
+		log.Fatalf("NewLoopbackFileSystem: %v", err)
+	}
+
+	fs, err := cachewrap.Wrap(origin, cachewrap.Config{
+		CacheDir: *fCacheDir,
+		Capacity: *fCapacity,
+	})
+
+	if err != nil {
+		log.Fatalf("Wrap: %v", err)
+	}
+
+	cfg := &fuse.MountConfig{
+		FSName:      "cachewrap",
+		ErrorLogger: log.New(os.Stderr, "fuse: ", 0),
+	}
+
+	if *fDebug {
+		cfg.DebugLogger = log.New(os.Stdout, "fuse: ", 0)
+	}
+
+	mfs, err := fuse.Mount(*fMountPoint, fuseutil.NewFileSystemServer(fs), cfg)
+	if err != nil {
+		log.Fatalf("Mount: %v", err)
+	}
+
+	// Wait for it to be unmounted.
+	if err = mfs.Join(context.Background()); err != nil {
+		log.Fatalf("Join: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/samples/cryptfs"
+)
+
+var fBacking = flag.String("backing", "", "Directory in which to store encrypted files.")
+var fKeyFile = flag.String("key_file", "", "File containing the key, in hex.")
+var fInit = flag.Bool("init", false, "Generate a key if --key_file doesn't exist.")
+var fMountPoint = flag.String("mount_point", "", "Path to mount point.")
+
+var fDebug = flag.Bool("debug", false, "Enable debug logging.")
+
+func readKey() ([]byte, error) {
+	contents, err := ioutil.ReadFile(*fKeyFile)
+	if os.IsNotExist(err) && *fInit {
+		key := make([]byte, cryptfs.KeySize)
+		if _, err = rand.Read(key); err != nil {
+			return nil, err
+		}
+
+		err = ioutil.WriteFile(*fKeyFile, []byte(hex.EncodeToString(key)+"\n"), 0600)
+		return key, err
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return hex.DecodeString(strings.TrimSpace(string(contents)))
+}
+
+func main() {
+	flag.Parse()
+
+	if *fBacking == "" {
+		log.Fatalf("You must set --backing.")
+	}
+
+	if *fKeyFile == "" {
+		log.Fatalf("You must set --key_file.")
+	}
+
+	if *fMountPoint == "" {
+		log.Fatalf("You must set --mount_point.")
+	}
+
+	key, err := readKey()
+	if err != nil {
+		log.Fatalf("readKey: %v", err)
+	}
+
+	// The kernel has already applied the caller's umask to the modes of new
+	// files, so don't apply ours as well.
+	syscall.Umask(0)
+
+	server, err := cryptfs.NewCryptFS(*fBacking, key)
+	if err != nil {
+		log.Fatalf("NewCryptFS: %v", err)
+	}
+
+	cfg := &fuse.MountConfig{
+		FSName:      "cryptfs",
+		ErrorLogger: log.New(os.Stderr, "fuse: ", 0),
+	}
+
+	if *fDebug {
+		cfg.DebugLogger = log.New(os.Stdout, "fuse: ", 0)
+	}
+
+	mfs, err := fuse.Mount(*fMountPoint, server, cfg)
+	if err != nil {
+		log.Fatalf("Mount: %v", err)
+	}
+
+	// Wait for it to be unmounted.
+	if err = mfs.Join(context.Background()); err != nil {
+		log.Fatalf("Join: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/samples/errorfs"
+	"github.com/jacobsa/fuse/samples/loopbackfs"
+)
+
+var fPhysicalPath = flag.String("path", "", "Physical path to loopback.")
+var fControl = flag.String("control", "", "File describing the faults to inject, re-read when it changes.")
+var fMountPoint = flag.String("mount_point", "", "Path to mount point.")
+
+var fDebug = flag.Bool("debug", false, "Enable debug logging.")
+
+// Apply the control file to the faults whenever its modification time
+// changes. A missing file means no faults.
+func watchControl(faults *errorfs.Faults) {
+	var last time.Time
+	for ; ; time.Sleep(time.Second) {
+		fi, err := os.Stat(*fControl)
+		var mtime time.Time
+		if err == nil {
+			mtime = fi.ModTime()
+		}
+
+		if mtime.Equal(last) {
+			continue
+		}
+
+		last = mtime
+		cfg, err := readControl()
+		if err != nil {
+			log.Printf("readControl: %v", err)
+			continue
+		}
+
+		log.Printf("Injecting faults: %+v", cfg)
+		faults.Set(cfg)
+	}
+}
+
+func readControl() (errorfs.FaultConfig, error) {
+	contents, err := ioutil.ReadFile(*fControl)
+	if os.IsNotExist(err) {
+		return errorfs.FaultConfig{}, nil
+	}
+
+	if err != nil {
+		return errorfs.FaultConfig{}, err
+	}
+
+	return errorfs.ParseFaultConfig(string(contents))
+}
+
+func main() {
+	flag.Parse()
+
+	if *fPhysicalPath == "" {
+		log.Fatalf("You must set --path.")
+	}
+
+	if *fControl == "" {
+		log.Fatalf("You must set --control.")
+	}
+
+	if *fMountPoint == "" {
+		log.Fatalf("You must set --mount_point.")
+	}
+
+	// The kernel has already applied the caller's umask to the modes of new
+	// files, so don't apply ours as well.
+	syscall.Umask(0)
+
+	server, err := loopbackfs.NewLoopbackFS(*fPhysicalPath)
+	if err != nil {
+		log.Fatalf("NewLoopbackFS: %v", err)
+	}
+
+	faults := errorfs.NewFaults(errorfs.FaultConfig{})
+	go watchControl(faults)
+
+	cfg := &fuse.MountConfig{
+		FSName:      "errorfs",
+		ErrorLogger: log.New(os.Stderr, "fuse: ", 0),
+	}
+
+	if *fDebug {
+		cfg.DebugLogger = log.New(os.Stdout, "fuse: ", 0)
+	}
+
+	mfs, err := fuse.Mount(*fMountPoint, errorfs.WrapWithFaults(server, faults), cfg)
+	if err != nil {
+		log.Fatalf("Mount: %v", err)
+	}
+
+	// Wait for it to be unmounted.
+	if err = mfs.Join(context.Background()); err != nil {
+		log.Fatalf("Join: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/samples/httpfs"
+)
+
+var fURL = flag.String("url", "", "URL of the directory to mount.")
+var fMountPoint = flag.String("mount_point", "", "Path to mount point.")
+
+var fWebDAV = flag.Bool("webdav", false, "List directories with WebDAV rather than HTML indexes.")
+var fDirectIO = flag.Bool("direct_io", false, "Send every read to the server, bypassing the page cache.")
+var fTTL = flag.Duration("ttl", time.Minute, "How long to cache attributes and directory listings.")
+
+var fDebug = flag.Bool("debug", false, "Enable debug logging.")
+
+func main() {
+	flag.Parse()
+
+	if *fURL == "" {
+		log.Fatalf("You must set --url.")
+	}
+
+	if *fMountPoint == "" {
+		log.Fatalf("You must set --mount_point.")
+	}
+
+	server, err := httpfs.NewHTTPFS(*fURL, httpfs.Config{
+		WebDAV:       *fWebDAV,
+		DirectIO:     *fDirectIO,
+		AttributeTTL: *fTTL,
+		Uid:          uint32(os.Getuid()),
+		Gid:          uint32(os.Getgid()),
+	})
+	if err != nil {
+		log.Fatalf("NewHTTPFS: %v", err)
+	}
+
+	cfg := &fuse.MountConfig{
+		FSName:      "httpfs",
+		ReadOnly:    true,
+		ErrorLogger: log.New(os.Stderr, "fuse: ", 0),
+	}
+
+	if *fDebug {
+		cfg.DebugLogger = log.New(os.Stdout, "fuse: ", 0)
+	}
+
+	mfs, err := fuse.Mount(*fMountPoint, server, cfg)
+	if err != nil {
+		log.Fatalf("Mount: %v", err)
+	}
+
+	// Wait for it to be unmounted.
+	if err = mfs.Join(context.Background()); err != nil {
+		log.Fatalf("Join: %v", err)
+	}
+}
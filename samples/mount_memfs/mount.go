@@ -15,9 +15,11 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"flag"
 	"log"
+	"os"
 	"os/user"
 	"strconv"
 
@@ -26,6 +28,9 @@ import (
 )
 
 var fMountPoint = flag.String("mount_point", "", "Path to mount point.")
+var fNoAtime = flag.Bool("noatime", false, "Don't update access times.")
+var fCapacity = flag.Uint64("capacity", 0, "Maximum bytes of file contents, or zero for no limit.")
+var fSnapshot = flag.String("snapshot", "", "File from which to load the contents at startup, if it exists, and to which to save them after unmounting.")
 
 func main() {
 	flag.Parse()
@@ -49,7 +54,19 @@ func main() {
 		panic(err)
 	}
 
-	server := memfs.NewMemFS(uint32(uid), uint32(gid))
+	server := memfs.NewMemFSWithOptions(
+		uint32(uid),
+		uint32(gid),
+		memfs.Options{
+			NoAtime:  *fNoAtime,
+			Capacity: *fCapacity,
+		})
+
+	if *fSnapshot != "" {
+		if err := loadSnapshot(server, *fSnapshot); err != nil {
+			log.Fatalf("loadSnapshot: %v", err)
+		}
+	}
 
 	cfg := &fuse.MountConfig{
 		// Disable writeback caching so that pid is always available in OpContext
@@ -65,4 +82,51 @@ func main() {
 	if err = mfs.Join(context.Background()); err != nil {
 		log.Fatalf("Join: %v", err)
 	}
+
+	if *fSnapshot != "" {
+		if err := saveSnapshot(server, *fSnapshot); err != nil {
+			log.Fatalf("saveSnapshot: %v", err)
+		}
+	}
+}
+
+func loadSnapshot(server memfs.MemFS, path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	return server.Load(bufio.NewReader(f))
+}
+
+// Write the snapshot to a temporary file first, so that a failure doesn't
+// clobber the previous one.
+func saveSnapshot(server memfs.MemFS, path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	if err := server.Save(w); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
 }
@@ -0,0 +1,176 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/samples/sftpfs"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var fHost = flag.String("host", "", "Remote host, as [user@]host[:port].")
+var fRoot = flag.String("root", "", "Remote directory to mount. Defaults to the home directory.")
+var fIdentity = flag.String("identity", "", "Private key file. By default, keys are taken from ssh-agent.")
+var fKnownHosts = flag.String("known_hosts", "", "Known hosts file. Defaults to ~/.ssh/known_hosts.")
+var fMountPoint = flag.String("mount_point", "", "Path to mount point.")
+
+var fTTL = flag.Duration("ttl", time.Second, "How long to cache attributes and lookups.")
+var fReadAhead = flag.Int("read_ahead", 1<<20, "Bytes to read ahead of sequential readers.")
+var fPendingWrites = flag.Int("pending_writes", 64, "Writes per file that may await acknowledgement.")
+
+var fDebug = flag.Bool("debug", false, "Enable debug logging.")
+
+// Parse --host into a user name and an address with a port.
+func parseHost(host string) (string, string, error) {
+	var name string
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		name, host = host[:i], host[i+1:]
+	} else {
+		u, err := user.Current()
+		if err != nil {
+			return "", "", err
+		}
+
+		name = u.Username
+	}
+
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+
+	return name, host, nil
+}
+
+func authMethods() ([]ssh.AuthMethod, error) {
+	if *fIdentity != "" {
+		key, err := os.ReadFile(*fIdentity)
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil
+	}
+
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, nil
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+
+	return []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(conn).Signers)}, nil
+}
+
+func main() {
+	flag.Parse()
+
+	if *fHost == "" {
+		log.Fatalf("You must set --host.")
+	}
+
+	if *fMountPoint == "" {
+		log.Fatalf("You must set --mount_point.")
+	}
+
+	name, addr, err := parseHost(*fHost)
+	if err != nil {
+		log.Fatalf("parseHost: %v", err)
+	}
+
+	auth, err := authMethods()
+	if err != nil {
+		log.Fatalf("authMethods: %v", err)
+	}
+
+	knownHosts := *fKnownHosts
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			log.Fatalf("UserHomeDir: %v", err)
+		}
+
+		knownHosts = path.Join(home, ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		log.Fatalf("knownhosts.New: %v", err)
+	}
+
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            name,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		log.Fatalf("Dial: %v", err)
+	}
+
+	server, err := sftpfs.NewSFTPFS(conn, sftpfs.Config{
+		Root:              *fRoot,
+		Uid:               uint32(os.Getuid()),
+		Gid:               uint32(os.Getgid()),
+		AttributeTTL:      *fTTL,
+		LookupTTL:         *fTTL,
+		NegativeLookupTTL: *fTTL,
+		ReadAhead:         *fReadAhead,
+		MaxPendingWrites:  *fPendingWrites,
+	})
+	if err != nil {
+		log.Fatalf("NewSFTPFS: %v", err)
+	}
+
+	cfg := &fuse.MountConfig{
+		FSName:      "sftpfs",
+		ErrorLogger: log.New(os.Stderr, "fuse: ", 0),
+
+		// SFTP keeps whole seconds.
+		TimestampGranularity: time.Second,
+	}
+
+	if *fDebug {
+		cfg.DebugLogger = log.New(os.Stdout, "fuse: ", 0)
+	}
+
+	mfs, err := fuse.Mount(*fMountPoint, server, cfg)
+	if err != nil {
+		log.Fatalf("Mount: %v", err)
+	}
+
+	// Wait for it to be unmounted.
+	if err = mfs.Join(context.Background()); err != nil {
+		log.Fatalf("Join: %v", err)
+	}
+}
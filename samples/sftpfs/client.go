@@ -0,0 +1,915 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sftpfs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+)
+
+// A client for version 3 of the SFTP protocol, which is the one spoken by
+// OpenSSH. See draft-ietf-secsh-filexfer-02.
+//
+// Requests are pipelined: any number may be outstanding at once, and each
+// caller waits only for its own response. The server is assumed to process
+// requests in the order that they were sent, as OpenSSH's does, so that for
+// example a read sent after a write sees its data.
+
+// Packet types.
+const (
+	fxpInit          = 1
+	fxpVersion       = 2
+	fxpOpen          = 3
+	fxpClose         = 4
+	fxpRead          = 5
+	fxpWrite         = 6
+	fxpLstat         = 7
+	fxpFstat         = 8
+	fxpSetstat       = 9
+	fxpFsetstat      = 10
+	fxpOpendir       = 11
+	fxpReaddir       = 12
+	fxpRemove        = 13
+	fxpMkdir         = 14
+	fxpRmdir         = 15
+	fxpRealpath      = 16
+	fxpRename        = 18
+	fxpReadlink      = 19
+	fxpSymlink       = 20
+	fxpStatus        = 101
+	fxpHandle        = 102
+	fxpData          = 103
+	fxpName          = 104
+	fxpAttrs         = 105
+	fxpExtended      = 200
+	fxpExtendedReply = 201
+)
+
+// Status codes.
+const (
+	fxOK               = 0
+	fxEOF              = 1
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxOpUnsupported    = 8
+)
+
+// Flags for fxpOpen.
+const (
+	fxfRead   = 0x01
+	fxfWrite  = 0x02
+	fxfAppend = 0x04
+	fxfCreat  = 0x08
+	fxfTrunc  = 0x10
+	fxfExcl   = 0x20
+)
+
+// Flags saying which fields of fileAttrs are present.
+const (
+	attrSize        = 0x01
+	attrUIDGID      = 0x02
+	attrPermissions = 0x04
+	attrACModTime   = 0x08
+	attrExtended    = 0x80000000
+)
+
+// OpenSSH extensions that are used when the server supports them.
+const (
+	extPosixRename = "posix-rename@openssh.com"
+	extStatVFS     = "statvfs@openssh.com"
+	extHardlink    = "hardlink@openssh.com"
+	extFsync       = "fsync@openssh.com"
+)
+
+// The attributes of a remote file. Only the fields named by flags are
+// meaningful.
+type fileAttrs struct {
+	flags uint32
+	size  uint64
+	uid   uint32
+	gid   uint32
+
+	// The permission bits, along with the file type bits from stat(2).
+	perm uint32
+
+	atime uint32
+	mtime uint32
+}
+
+// The file system statistics returned by statvfs@openssh.com.
+type statVFS struct {
+	bsize   uint64
+	frsize  uint64
+	blocks  uint64
+	bfree   uint64
+	bavail  uint64
+	files   uint64
+	ffree   uint64
+	favail  uint64
+	fsid    uint64
+	flag    uint64
+	namemax uint64
+}
+
+// A directory entry returned by fxpReaddir.
+type nameEntry struct {
+	name  string
+	attrs fileAttrs
+}
+
+// A response to a request, with the type and request ID stripped, or the
+// error that ended the connection before it arrived.
+type response struct {
+	typ  byte
+	data []byte
+	err  error
+}
+
+type client struct {
+	// Extensions advertised by the server, by name. Set up before the client
+	// is used, and never modified afterward.
+	extensions map[string]string
+
+	// Held while writing a packet, so that they aren't interleaved.
+	wmu sync.Mutex
+	w   io.WriteCloser // GUARDED_BY(wmu)
+
+	mu sync.Mutex
+
+	// The channels on which to deliver the responses to outstanding requests,
+	// by request ID. Each is buffered, so that delivery never blocks even if
+	// the caller has given up waiting.
+	//
+	// GUARDED_BY(mu)
+	pending map[uint32]chan response
+
+	// GUARDED_BY(mu)
+	nextID uint32
+
+	// The error that ended the connection, after which new requests fail
+	// immediately.
+	//
+	// GUARDED_BY(mu)
+	err error
+}
+
+// Start an SFTP session over the supplied streams, which are typically the
+// stdout and stdin of the "sftp" subsystem of an SSH session.
+func newClient(r io.Reader, w io.WriteCloser) (*client, error) {
+	c := &client{
+		extensions: make(map[string]string),
+		w:          w,
+		pending:    make(map[uint32]chan response),
+	}
+
+	var b buffer
+	b.u8(fxpInit)
+	b.u32(3)
+	if err := c.writePacket(b); err != nil {
+		return nil, fmt.Errorf("Writing init: %v", err)
+	}
+
+	p, err := readPacket(r)
+	if err != nil {
+		return nil, fmt.Errorf("Reading version: %v", err)
+	}
+
+	if p[0] != fxpVersion {
+		return nil, fmt.Errorf("Unexpected packet type %d", p[0])
+	}
+
+	d := decoder{b: p[1:]}
+	if version := d.u32(); version != 3 {
+		return nil, fmt.Errorf("Unsupported SFTP version %d", version)
+	}
+
+	for len(d.b) > 0 && d.err == nil {
+		name := d.str()
+		c.extensions[name] = d.str()
+	}
+
+	if d.err != nil {
+		return nil, fmt.Errorf("Corrupt version packet: %v", d.err)
+	}
+
+	go c.readLoop(r)
+
+	return c, nil
+}
+
+func (c *client) hasExtension(name string) bool {
+	_, ok := c.extensions[name]
+	return ok
+}
+
+// Close the connection. Outstanding requests fail.
+func (c *client) close() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return c.w.Close()
+}
+
+// Read a length-prefixed packet.
+func readPacket(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n == 0 || n > 1<<24 {
+		return nil, fmt.Errorf("Bad packet length %d", n)
+	}
+
+	p := make([]byte, n)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Write a packet, prefixing it with its length.
+//
+// LOCKS_EXCLUDED(c.wmu)
+func (c *client) writePacket(b buffer) error {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(b)))
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if _, err := c.w.Write(append(hdr[:], b...)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Deliver responses to the requests awaiting them, until the connection
+// fails.
+func (c *client) readLoop(r io.Reader) {
+	for {
+		p, err := readPacket(r)
+		if err == nil && len(p) < 5 {
+			err = errors.New("Short packet")
+		}
+
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		id := binary.BigEndian.Uint32(p[1:5])
+
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+
+		if ok {
+			ch <- response{typ: p[0], data: p[5:]}
+		}
+	}
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *client) fail(err error) {
+	if err == io.EOF {
+		err = errors.New("Connection closed")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.err = err
+	for id, ch := range c.pending {
+		ch <- response{err: err}
+		delete(c.pending, id)
+	}
+}
+
+// Send a request of the supplied type, whose fields after the request ID are
+// added by args, returning the channel on which its response will arrive.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *client) send(typ byte, args func(b *buffer)) (<-chan response, error) {
+	ch := make(chan response, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+
+	id := c.nextID
+	c.nextID++
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	var b buffer
+	b.u8(typ)
+	b.u32(id)
+	args(&b)
+
+	if err := c.writePacket(b); err != nil {
+		c.fail(err)
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+// Wait for a response, giving up with EINTR if the context is cancelled
+// first. This is how interrupted ops return promptly however slow the server
+// is; the response is discarded when it does arrive.
+func wait(ctx context.Context, ch <-chan response) (response, error) {
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			// The connection is gone, and will stay gone.
+			return r, fuse.EIO
+		}
+
+		return r, nil
+
+	case <-ctx.Done():
+		return response{}, fuse.EINTR
+	}
+}
+
+// Send a request and wait for its response.
+func (c *client) call(
+	ctx context.Context,
+	typ byte,
+	args func(b *buffer)) (response, error) {
+	ch, err := c.send(typ, args)
+	if err != nil {
+		return response{}, fuse.EIO
+	}
+
+	return wait(ctx, ch)
+}
+
+// Convert a status response to an error, which is nil for fxOK.
+func statusError(r response) error {
+	d := decoder{b: r.data}
+	code := d.u32()
+	if d.err != nil {
+		return fuse.EIO
+	}
+
+	switch code {
+	case fxOK:
+		return nil
+	case fxEOF:
+		return io.EOF
+	case fxNoSuchFile:
+		return fuse.ENOENT
+	case fxPermissionDenied:
+		return syscall.EACCES
+	case fxOpUnsupported:
+		return fuse.ENOSYS
+	}
+
+	// fxFailure and the rest say nothing more specific.
+	return fuse.EIO
+}
+
+// Return the error for a response of an unexpected type.
+func unexpected(r response) error {
+	if r.typ == fxpStatus {
+		if err := statusError(r); err != nil {
+			return err
+		}
+	}
+
+	return fuse.EIO
+}
+
+// Make a request whose response is a status.
+func (c *client) status(
+	ctx context.Context,
+	typ byte,
+	args func(b *buffer)) error {
+	r, err := c.call(ctx, typ, args)
+	if err != nil {
+		return err
+	}
+
+	if r.typ != fxpStatus {
+		return fuse.EIO
+	}
+
+	return statusError(r)
+}
+
+// Make a request whose response is attributes.
+func (c *client) attrs(
+	ctx context.Context,
+	typ byte,
+	args func(b *buffer)) (fileAttrs, error) {
+	r, err := c.call(ctx, typ, args)
+	if err != nil {
+		return fileAttrs{}, err
+	}
+
+	if r.typ != fxpAttrs {
+		return fileAttrs{}, unexpected(r)
+	}
+
+	d := decoder{b: r.data}
+	a := d.attrs()
+	if d.err != nil {
+		return fileAttrs{}, fuse.EIO
+	}
+
+	return a, nil
+}
+
+// Make a request whose response is a handle. If the context is cancelled
+// before the response arrives, the handle is closed once it does, rather than
+// being leaked.
+func (c *client) handle(
+	ctx context.Context,
+	typ byte,
+	args func(b *buffer)) (string, error) {
+	ch, err := c.send(typ, args)
+	if err != nil {
+		return "", fuse.EIO
+	}
+
+	r, err := wait(ctx, ch)
+	if err == fuse.EINTR {
+		go func() {
+			if r := <-ch; r.typ == fxpHandle {
+				d := decoder{b: r.data}
+				c.closeHandle(context.Background(), d.str())
+			}
+		}()
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if r.typ != fxpHandle {
+		return "", unexpected(r)
+	}
+
+	d := decoder{b: r.data}
+	h := d.str()
+	if d.err != nil {
+		return "", fuse.EIO
+	}
+
+	return h, nil
+}
+
+// Make a request whose response is a list of names.
+func (c *client) names(
+	ctx context.Context,
+	typ byte,
+	args func(b *buffer)) ([]nameEntry, error) {
+	r, err := c.call(ctx, typ, args)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.typ != fxpName {
+		return nil, unexpected(r)
+	}
+
+	d := decoder{b: r.data}
+	n := d.u32()
+
+	var entries []nameEntry
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		var e nameEntry
+		e.name = d.str()
+		d.str() // The ls -l style long name.
+		e.attrs = d.attrs()
+		entries = append(entries, e)
+	}
+
+	if d.err != nil {
+		return nil, fuse.EIO
+	}
+
+	return entries, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Requests
+////////////////////////////////////////////////////////////////////////
+
+func (c *client) lstat(ctx context.Context, p string) (fileAttrs, error) {
+	return c.attrs(ctx, fxpLstat, func(b *buffer) {
+		b.str(p)
+	})
+}
+
+func (c *client) fstat(ctx context.Context, h string) (fileAttrs, error) {
+	return c.attrs(ctx, fxpFstat, func(b *buffer) {
+		b.str(h)
+	})
+}
+
+func (c *client) setstat(ctx context.Context, p string, a fileAttrs) error {
+	return c.status(ctx, fxpSetstat, func(b *buffer) {
+		b.str(p)
+		b.attrs(a)
+	})
+}
+
+func (c *client) fsetstat(ctx context.Context, h string, a fileAttrs) error {
+	return c.status(ctx, fxpFsetstat, func(b *buffer) {
+		b.str(h)
+		b.attrs(a)
+	})
+}
+
+func (c *client) open(
+	ctx context.Context,
+	p string,
+	pflags uint32,
+	a fileAttrs) (string, error) {
+	return c.handle(ctx, fxpOpen, func(b *buffer) {
+		b.str(p)
+		b.u32(pflags)
+		b.attrs(a)
+	})
+}
+
+func (c *client) closeHandle(ctx context.Context, h string) error {
+	return c.status(ctx, fxpClose, func(b *buffer) {
+		b.str(h)
+	})
+}
+
+// Start reading up to n bytes at the supplied offset. Use readResult to
+// interpret the response.
+func (c *client) sendRead(h string, off int64, n int) (<-chan response, error) {
+	return c.send(fxpRead, func(b *buffer) {
+		b.str(h)
+		b.u64(uint64(off))
+		b.u32(uint32(n))
+	})
+}
+
+// Return the data from a response to fxpRead, which is empty at the end of
+// the file.
+func readResult(r response) ([]byte, error) {
+	switch r.typ {
+	case fxpData:
+		d := decoder{b: r.data}
+		data := d.bytes()
+		if d.err != nil {
+			return nil, fuse.EIO
+		}
+
+		return data, nil
+
+	case fxpStatus:
+		if err := statusError(r); err != io.EOF {
+			return nil, err
+		}
+
+		return nil, nil
+	}
+
+	return nil, fuse.EIO
+}
+
+// Start writing data at the supplied offset. The response is a status.
+func (c *client) sendWrite(h string, off int64, data []byte) (<-chan response, error) {
+	return c.send(fxpWrite, func(b *buffer) {
+		b.str(h)
+		b.u64(uint64(off))
+		b.str(string(data))
+	})
+}
+
+func (c *client) opendir(ctx context.Context, p string) (string, error) {
+	return c.handle(ctx, fxpOpendir, func(b *buffer) {
+		b.str(p)
+	})
+}
+
+// Read the whole of the directory at p, leaving out "." and "..".
+func (c *client) readDir(ctx context.Context, p string) ([]nameEntry, error) {
+	h, err := c.opendir(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	defer c.closeHandle(context.Background(), h)
+
+	var entries []nameEntry
+	for {
+		batch, err := c.names(ctx, fxpReaddir, func(b *buffer) {
+			b.str(h)
+		})
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range batch {
+			if e.name != "." && e.name != ".." {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+func (c *client) remove(ctx context.Context, p string) error {
+	return c.status(ctx, fxpRemove, func(b *buffer) {
+		b.str(p)
+	})
+}
+
+func (c *client) mkdir(ctx context.Context, p string, a fileAttrs) error {
+	return c.status(ctx, fxpMkdir, func(b *buffer) {
+		b.str(p)
+		b.attrs(a)
+	})
+}
+
+func (c *client) rmdir(ctx context.Context, p string) error {
+	return c.status(ctx, fxpRmdir, func(b *buffer) {
+		b.str(p)
+	})
+}
+
+// Return the canonical absolute form of p.
+func (c *client) realpath(ctx context.Context, p string) (string, error) {
+	entries, err := c.names(ctx, fxpRealpath, func(b *buffer) {
+		b.str(p)
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(entries) != 1 {
+		return "", fuse.EIO
+	}
+
+	return entries[0].name, nil
+}
+
+// Rename oldPath to newPath, replacing anything there already if the server
+// supports it. Plain fxpRename fails if newPath exists.
+func (c *client) rename(ctx context.Context, oldPath string, newPath string) error {
+	if c.hasExtension(extPosixRename) {
+		return c.status(ctx, fxpExtended, func(b *buffer) {
+			b.str(extPosixRename)
+			b.str(oldPath)
+			b.str(newPath)
+		})
+	}
+
+	return c.status(ctx, fxpRename, func(b *buffer) {
+		b.str(oldPath)
+		b.str(newPath)
+	})
+}
+
+func (c *client) readlink(ctx context.Context, p string) (string, error) {
+	entries, err := c.names(ctx, fxpReadlink, func(b *buffer) {
+		b.str(p)
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(entries) != 1 {
+		return "", fuse.EIO
+	}
+
+	return entries[0].name, nil
+}
+
+func (c *client) symlink(ctx context.Context, target string, p string) error {
+	// OpenSSH takes the arguments in the opposite order to the draft, and
+	// every other server has followed it.
+	return c.status(ctx, fxpSymlink, func(b *buffer) {
+		b.str(target)
+		b.str(p)
+	})
+}
+
+func (c *client) hardlink(ctx context.Context, oldPath string, newPath string) error {
+	if !c.hasExtension(extHardlink) {
+		return fuse.ENOSYS
+	}
+
+	return c.status(ctx, fxpExtended, func(b *buffer) {
+		b.str(extHardlink)
+		b.str(oldPath)
+		b.str(newPath)
+	})
+}
+
+func (c *client) fsync(ctx context.Context, h string) error {
+	if !c.hasExtension(extFsync) {
+		return nil
+	}
+
+	return c.status(ctx, fxpExtended, func(b *buffer) {
+		b.str(extFsync)
+		b.str(h)
+	})
+}
+
+func (c *client) statVFS(ctx context.Context, p string) (statVFS, error) {
+	if !c.hasExtension(extStatVFS) {
+		return statVFS{}, fuse.ENOSYS
+	}
+
+	r, err := c.call(ctx, fxpExtended, func(b *buffer) {
+		b.str(extStatVFS)
+		b.str(p)
+	})
+
+	if err != nil {
+		return statVFS{}, err
+	}
+
+	if r.typ != fxpExtendedReply {
+		return statVFS{}, unexpected(r)
+	}
+
+	d := decoder{b: r.data}
+	st := statVFS{
+		bsize:   d.u64(),
+		frsize:  d.u64(),
+		blocks:  d.u64(),
+		bfree:   d.u64(),
+		bavail:  d.u64(),
+		files:   d.u64(),
+		ffree:   d.u64(),
+		favail:  d.u64(),
+		fsid:    d.u64(),
+		flag:    d.u64(),
+		namemax: d.u64(),
+	}
+
+	if d.err != nil {
+		return statVFS{}, fuse.EIO
+	}
+
+	return st, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Encoding
+////////////////////////////////////////////////////////////////////////
+
+// A packet being built.
+type buffer []byte
+
+func (b *buffer) u8(v byte) {
+	*b = append(*b, v)
+}
+
+func (b *buffer) u32(v uint32) {
+	*b = binary.BigEndian.AppendUint32(*b, v)
+}
+
+func (b *buffer) u64(v uint64) {
+	*b = binary.BigEndian.AppendUint64(*b, v)
+}
+
+func (b *buffer) str(s string) {
+	b.u32(uint32(len(s)))
+	*b = append(*b, s...)
+}
+
+func (b *buffer) attrs(a fileAttrs) {
+	flags := a.flags &^ attrExtended
+	b.u32(flags)
+	if flags&attrSize != 0 {
+		b.u64(a.size)
+	}
+
+	if flags&attrUIDGID != 0 {
+		b.u32(a.uid)
+		b.u32(a.gid)
+	}
+
+	if flags&attrPermissions != 0 {
+		b.u32(a.perm)
+	}
+
+	if flags&attrACModTime != 0 {
+		b.u32(a.atime)
+		b.u32(a.mtime)
+	}
+}
+
+// A packet being parsed. The first error is recorded in err, after which
+// every field reads as zero.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if n < 0 || len(d.b) < n {
+		d.err = errors.New("Short packet")
+		d.b = nil
+		return nil
+	}
+
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) u32() uint32 {
+	if v := d.take(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+
+	return 0
+}
+
+func (d *decoder) u64() uint64 {
+	if v := d.take(8); v != nil {
+		return binary.BigEndian.Uint64(v)
+	}
+
+	return 0
+}
+
+func (d *decoder) bytes() []byte {
+	return d.take(int(d.u32()))
+}
+
+func (d *decoder) str() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) attrs() fileAttrs {
+	var a fileAttrs
+	a.flags = d.u32()
+	if a.flags&attrSize != 0 {
+		a.size = d.u64()
+	}
+
+	if a.flags&attrUIDGID != 0 {
+		a.uid = d.u32()
+		a.gid = d.u32()
+	}
+
+	if a.flags&attrPermissions != 0 {
+		a.perm = d.u32()
+	}
+
+	if a.flags&attrACModTime != 0 {
+		a.atime = d.u32()
+		a.mtime = d.u32()
+	}
+
+	if a.flags&attrExtended != 0 {
+		for n := d.u32(); n > 0 && d.err == nil; n-- {
+			d.str()
+			d.str()
+		}
+	}
+
+	return a
+}
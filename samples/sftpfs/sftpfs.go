@@ -0,0 +1,1233 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sftpfs contains a file system that mounts a directory of a remote
+// host over SFTP.
+//
+// Every op costs at least one round trip to the server, so the file system
+// shows the patterns that suit a backend with high latency:
+//
+//   - Attributes and lookups are cached, both by the kernel and, through
+//     fuseutil.NewAttributeCachingFS and fuseutil.NewLookupCachingFS, by the
+//     file system itself. Cached lookups are invalidated when the server shows
+//     that they are out of date.
+//   - Sequential reads are served from chunks that were requested ahead of
+//     time, so that the round trips overlap.
+//   - Writes are sent without waiting for the server to acknowledge them, and
+//     any error is reported when the file is flushed, synced or closed.
+//   - Round trips are made without holding any lock, and an op waiting for
+//     one returns EINTR as soon as the kernel interrupts it.
+package sftpfs
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"golang.org/x/crypto/ssh"
+)
+
+// The size of the reads sent to the server. OpenSSH's sftp-server returns at
+// most this much per read in older versions.
+const chunkSize = 32 << 10
+
+// Config configures NewSFTPFS.
+type Config struct {
+	// The remote directory to mount. Relative paths are relative to the home
+	// directory of the remote user. The default is the home directory itself.
+	Root string
+
+	// The owner reported for every file, since remote user IDs mean nothing
+	// locally. Attempts to change ownership fail with EPERM.
+	Uid uint32
+	Gid uint32
+
+	// How long the attributes of inodes, and the results of lookups that
+	// succeeded or failed with ENOENT, may be cached. Zero disables the cache
+	// in question.
+	AttributeTTL      time.Duration
+	LookupTTL         time.Duration
+	NegativeLookupTTL time.Duration
+
+	// How many bytes to request ahead of a sequential reader. Zero disables
+	// readahead.
+	ReadAhead int
+
+	// How many writes to each open file may await acknowledgement by the
+	// server before WriteFile waits for one. Zero makes writes synchronous.
+	MaxPendingWrites int
+}
+
+// NewSFTPFS starts an SFTP session over the supplied SSH connection and
+// returns a file system that mirrors the remote directory named by
+// cfg.Root. The session is closed when the file system is unmounted.
+func NewSFTPFS(conn *ssh.Client, cfg Config) (fuse.Server, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("NewSession: %v", err)
+	}
+
+	w, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("StdinPipe: %v", err)
+	}
+
+	r, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("StdoutPipe: %v", err)
+	}
+
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("RequestSubsystem: %v", err)
+	}
+
+	server, err := NewSFTPFSFromStreams(r, w, cfg)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return server, nil
+}
+
+// NewSFTPFSFromStreams is like NewSFTPFS, but speaks SFTP over the supplied
+// streams, for example the stdout and stdin of a local sftp-server process.
+// w is closed when the file system is unmounted.
+func NewSFTPFSFromStreams(
+	r io.Reader,
+	w io.WriteCloser,
+	cfg Config) (fuse.Server, error) {
+	c, err := newClient(r, w)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	if cfg.Root == "" {
+		cfg.Root = "."
+	}
+
+	root, err := c.realpath(context.Background(), cfg.Root)
+	if err != nil {
+		c.close()
+		return nil, fmt.Errorf("realpath: %v", err)
+	}
+
+	fs := &sftpFS{
+		c:   c,
+		cfg: cfg,
+		inodes: map[fuseops.InodeID]*inode{
+			fuseops.RootInodeID: {path: root, lookupCount: 1},
+		},
+		ids:        map[string]fuseops.InodeID{root: fuseops.RootInodeID},
+		nextInode:  fuseops.RootInodeID + 1,
+		files:      make(map[fuseops.HandleID]*fileHandle),
+		dirs:       make(map[fuseops.HandleID]*dirHandle),
+		nextHandle: 1,
+	}
+
+	wrapped, lookups := fuseutil.NewLookupCachingFS(fs, fuseutil.LookupCacheConfig{
+		TTL:         cfg.LookupTTL,
+		NegativeTTL: cfg.NegativeLookupTTL,
+	})
+
+	fs.lookups = lookups
+	wrapped = fuseutil.NewAttributeCachingFS(wrapped, fuseutil.AttributeCacheConfig{
+		FileTTL: cfg.AttributeTTL,
+		DirTTL:  cfg.AttributeTTL,
+	})
+
+	return fuseutil.NewFileSystemServer(wrapped), nil
+}
+
+type inode struct {
+	// The remote path of the inode.
+	path string
+
+	// Set once the name has been removed, after which ops on the inode fail
+	// with ENOENT.
+	removed bool
+
+	// The number of references that the kernel holds to the inode. See notes on
+	// fuseops.ForgetInodeOp.
+	lookupCount uint64
+}
+
+// A read request, possibly made ahead of time.
+type chunk struct {
+	// Closed once data and err are set.
+	done chan struct{}
+
+	// The data read, which is short at the end of the file.
+	data []byte
+	err  error
+}
+
+type fileHandle struct {
+	inode fuseops.InodeID
+
+	// The remote handle. Immutable.
+	h string
+
+	mu sync.Mutex
+
+	// Reads that are in progress or have completed but not yet been used, by
+	// offset. Each offset is a multiple of chunkSize.
+	//
+	// GUARDED_BY(mu)
+	chunks map[int64]*chunk
+
+	// The offset just beyond the previous read, so that sequential reads can
+	// be recognised.
+	//
+	// GUARDED_BY(mu)
+	next int64
+
+	// Slots for writes awaiting acknowledgement, which are sent into when a
+	// write is sent and received from when it is acknowledged. Nil if writes
+	// are synchronous.
+	writes chan struct{}
+
+	// The first error returned for a write that no op has yet reported.
+	//
+	// GUARDED_BY(mu)
+	writeErr error
+}
+
+type dirHandle struct {
+	path string
+
+	// The listing returned by the most recent ReadDir at offset zero.
+	entries []fuseutil.Dirent
+}
+
+type sftpFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	c   *client
+	cfg Config
+
+	// The cache of lookups that wraps the file system, to be told when the
+	// server shows its entries to be stale.
+	lookups *fuseutil.LookupCache
+
+	// Guards the tables below. Never held during a round trip to the server.
+	mu sync.Mutex
+
+	// The inodes that the kernel knows about, by ID and by remote path. SFTP
+	// doesn't expose inode numbers, so files are identified by path.
+	//
+	// INVARIANT: For each id, in of inodes, ids[in.path] is id or absent.
+	// INVARIANT: For each p, id of ids, inodes[id].path == p && !inodes[id].removed
+	inodes map[fuseops.InodeID]*inode // GUARDED_BY(mu)
+	ids    map[string]fuseops.InodeID // GUARDED_BY(mu)
+
+	// The ID to give the next inode.
+	nextInode fuseops.InodeID // GUARDED_BY(mu)
+
+	// Open files and directories.
+	files      map[fuseops.HandleID]*fileHandle // GUARDED_BY(mu)
+	dirs       map[fuseops.HandleID]*dirHandle  // GUARDED_BY(mu)
+	nextHandle fuseops.HandleID                 // GUARDED_BY(mu)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Convert remote attributes to what the kernel should see.
+func (fs *sftpFS) attributes(a fileAttrs) fuseops.InodeAttributes {
+	mtime := time.Unix(int64(a.mtime), 0)
+	return fuseops.InodeAttributes{
+		Size:  a.size,
+		Nlink: 1,
+		Mode:  fuse.ConvertFileMode(a.perm),
+		Atime: time.Unix(int64(a.atime), 0),
+		Mtime: mtime,
+		Ctime: mtime,
+		Uid:   fs.cfg.Uid,
+		Gid:   fs.cfg.Gid,
+	}
+}
+
+func (fs *sftpFS) expiration(ttl time.Duration) time.Time {
+	return time.Now().Add(ttl)
+}
+
+// Return the remote path of the inode, or ENOENT if it has been removed.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *sftpFS) pathOf(id fuseops.InodeID) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in := fs.inodes[id]
+	if in == nil {
+		panic(fmt.Sprintf("Unknown inode: %v", id))
+	}
+
+	if in.removed {
+		return "", fuse.ENOENT
+	}
+
+	return in.path, nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *sftpFS) childPath(parent fuseops.InodeID, name string) (string, error) {
+	p, err := fs.pathOf(parent)
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(p, name), nil
+}
+
+// Fill in an entry for the file at the supplied remote path with the supplied
+// attributes, incrementing the lookup count of its inode and allocating one if
+// the kernel doesn't already know about the path.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *sftpFS) entry(p string, a fileAttrs, e *fuseops.ChildInodeEntry) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	id, ok := fs.ids[p]
+	if !ok {
+		id = fs.nextInode
+		fs.nextInode++
+
+		fs.inodes[id] = &inode{path: p}
+		fs.ids[p] = id
+	}
+
+	fs.inodes[id].lookupCount++
+
+	e.Child = id
+	e.Attributes = fs.attributes(a)
+	e.AttributesExpiration = fs.expiration(fs.cfg.AttributeTTL)
+	e.EntryExpiration = fs.expiration(fs.cfg.LookupTTL)
+}
+
+// Fetch the attributes of a newly created file and fill in its entry.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *sftpFS) lookUp(ctx context.Context, p string, e *fuseops.ChildInodeEntry) error {
+	a, err := fs.c.lstat(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	fs.entry(p, a, e)
+
+	return nil
+}
+
+// Decrement the lookup count of the inode, forgetting it once the kernel no
+// longer refers to it.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *sftpFS) forget(id fuseops.InodeID, n uint64) {
+	in := fs.inodes[id]
+	if in == nil {
+		panic(fmt.Sprintf("Unknown inode: %v", id))
+	}
+
+	if n > in.lookupCount {
+		panic(fmt.Sprintf("Forgetting %d references to inode %d with %d", n, id, in.lookupCount))
+	}
+
+	in.lookupCount -= n
+	if in.lookupCount != 0 || id == fuseops.RootInodeID {
+		return
+	}
+
+	delete(fs.inodes, id)
+	if !in.removed {
+		delete(fs.ids, in.path)
+	}
+}
+
+// Note that the remote path no longer refers to the inode it used to, so that
+// a new file created there gets a new inode.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *sftpFS) removed(p string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if id, ok := fs.ids[p]; ok {
+		fs.inodes[id].removed = true
+		delete(fs.ids, p)
+	}
+}
+
+// Handle an error from an op on the supplied inode. If the server says that
+// the file no longer exists, it was removed by some other client, so cached
+// lookups that lead to it are dropped.
+func (fs *sftpFS) checkStale(id fuseops.InodeID, err error) error {
+	if err == fuse.ENOENT {
+		fs.lookups.InvalidateInode(id)
+	}
+
+	return err
+}
+
+// Return a stable number for a directory entry. The kernel doesn't use it,
+// but it must not be zero, since readdir(3) implementations may skip such
+// entries.
+func direntInode(p string) fuseops.InodeID {
+	h := fnv.New64a()
+	h.Write([]byte(p))
+	return fuseops.InodeID(h.Sum64() | 1)
+}
+
+func direntType(mode os.FileMode) fuseutil.DirentType {
+	switch {
+	case mode.IsDir():
+		return fuseutil.DT_Directory
+	case mode&os.ModeSymlink != 0:
+		return fuseutil.DT_Link
+	case mode&os.ModeNamedPipe != 0:
+		return fuseutil.DT_FIFO
+	case mode&os.ModeSocket != 0:
+		return fuseutil.DT_Socket
+	case mode&os.ModeCharDevice != 0:
+		return fuseutil.DT_Char
+	case mode&os.ModeDevice != 0:
+		return fuseutil.DT_Block
+	}
+
+	return fuseutil.DT_File
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *sftpFS) getFile(h fuseops.HandleID) (*fileHandle, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fh, ok := fs.files[h]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+
+	return fh, nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *sftpFS) openHandle(id fuseops.InodeID, h string) fuseops.HandleID {
+	fh := &fileHandle{
+		inode:  id,
+		h:      h,
+		chunks: make(map[int64]*chunk),
+	}
+
+	if fs.cfg.MaxPendingWrites > 0 {
+		fh.writes = make(chan struct{}, fs.cfg.MaxPendingWrites)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	handle := fs.nextHandle
+	fs.nextHandle++
+	fs.files[handle] = fh
+
+	return handle
+}
+
+// Drop the data read ahead for the inode by all of its handles, since it is
+// about to change.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *sftpFS) dropChunks(id fuseops.InodeID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, fh := range fs.files {
+		if fh.inode == id {
+			fh.mu.Lock()
+			clear(fh.chunks)
+			fh.mu.Unlock()
+		}
+	}
+}
+
+// Start reading the chunk at the supplied offset.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fs *sftpFS) fetch(fh *fileHandle, off int64) *chunk {
+	c := &chunk{done: make(chan struct{})}
+	fh.chunks[off] = c
+
+	ch, err := fs.c.sendRead(fh.h, off, chunkSize)
+	if err != nil {
+		c.err = fuse.EIO
+		close(c.done)
+		return c
+	}
+
+	go func() {
+		r := <-ch
+		if r.err != nil {
+			c.err = fuse.EIO
+		} else {
+			c.data, c.err = readResult(r)
+		}
+
+		close(c.done)
+	}()
+
+	return c
+}
+
+// Wait for the writes sent through the handle to be acknowledged, returning
+// the first error that hasn't already been reported.
+func (fh *fileHandle) flush(ctx context.Context) error {
+	if fh.writes != nil {
+		// Fill every slot, which means that no write is outstanding.
+		for i := 0; i < cap(fh.writes); i++ {
+			select {
+			case fh.writes <- struct{}{}:
+			case <-ctx.Done():
+				for ; i > 0; i-- {
+					<-fh.writes
+				}
+
+				return fuse.EINTR
+			}
+		}
+
+		for i := 0; i < cap(fh.writes); i++ {
+			<-fh.writes
+		}
+	}
+
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	err := fh.writeErr
+	fh.writeErr = nil
+
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *sftpFS) Destroy() {
+	fs.c.close()
+}
+
+func (fs *sftpFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	root, err := fs.pathOf(fuseops.RootInodeID)
+	if err != nil {
+		return err
+	}
+
+	st, err := fs.c.statVFS(ctx, root)
+	if err == fuse.ENOSYS {
+		// The server can't say, so report an empty file system rather than
+		// breaking df(1).
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	op.BlockSize = uint32(st.frsize)
+	op.IoSize = uint32(st.bsize)
+	op.Blocks = st.blocks
+	op.BlocksFree = st.bfree
+	op.BlocksAvailable = st.bavail
+	op.Inodes = st.files
+	op.InodesFree = st.ffree
+
+	return nil
+}
+
+func (fs *sftpFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	return fs.lookUp(ctx, p, &op.Entry)
+}
+
+func (fs *sftpFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	a, err := fs.c.lstat(ctx, p)
+	if err != nil {
+		return fs.checkStale(op.Inode, err)
+	}
+
+	op.Attributes = fs.attributes(a)
+	op.AttributesExpiration = fs.expiration(fs.cfg.AttributeTTL)
+
+	return nil
+}
+
+func (fs *sftpFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if (op.Uid != nil && *op.Uid != fs.cfg.Uid) || (op.Gid != nil && *op.Gid != fs.cfg.Gid) {
+		return syscall.EPERM
+	}
+
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	var a fileAttrs
+	if op.Size != nil {
+		a.flags |= attrSize
+		a.size = *op.Size
+	}
+
+	if op.Mode != nil {
+		a.flags |= attrPermissions
+		a.perm = uint32(op.Mode.Perm())
+	}
+
+	// SFTP sets both times or neither.
+	if op.Atime != nil || op.Mtime != nil {
+		old, err := fs.c.lstat(ctx, p)
+		if err != nil {
+			return fs.checkStale(op.Inode, err)
+		}
+
+		a.flags |= attrACModTime
+		a.atime, a.mtime = old.atime, old.mtime
+		if op.Atime != nil {
+			a.atime = uint32(op.Atime.Unix())
+		}
+
+		if op.Mtime != nil {
+			a.mtime = uint32(op.Mtime.Unix())
+		}
+	}
+
+	// Truncate through the handle if there is one, in case the file's name has
+	// been removed.
+	if a.flags != 0 {
+		var fh *fileHandle
+		if op.Handle != nil {
+			fh, _ = fs.getFile(*op.Handle)
+		}
+
+		if fh != nil {
+			if err := fh.flush(ctx); err != nil {
+				return err
+			}
+
+			err = fs.c.fsetstat(ctx, fh.h, a)
+		} else {
+			err = fs.c.setstat(ctx, p, a)
+		}
+
+		if err != nil {
+			return fs.checkStale(op.Inode, err)
+		}
+
+		fs.dropChunks(op.Inode)
+	}
+
+	a, err = fs.c.lstat(ctx, p)
+	if err != nil {
+		return fs.checkStale(op.Inode, err)
+	}
+
+	op.Attributes = fs.attributes(a)
+	op.AttributesExpiration = fs.expiration(fs.cfg.AttributeTTL)
+
+	return nil
+}
+
+func (fs *sftpFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.forget(op.Inode, op.N)
+
+	return nil
+}
+
+func (fs *sftpFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, e := range op.Entries {
+		fs.forget(e.Inode, e.N)
+	}
+
+	return nil
+}
+
+func (fs *sftpFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	// The server fails in the same way whatever the reason, so check for the
+	// common one first.
+	if _, err := fs.c.lstat(ctx, p); err == nil {
+		return fuse.EEXIST
+	}
+
+	perm := fileAttrs{flags: attrPermissions, perm: uint32(op.Mode.Perm())}
+	if err := fs.c.mkdir(ctx, p, perm); err != nil {
+		return err
+	}
+
+	a, err := fs.c.lstat(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	// The kernel has already applied the caller's umask, but the server may
+	// apply its own or ignore the permissions altogether.
+	if a.perm&0777 != perm.perm {
+		if err := fs.c.setstat(ctx, p, perm); err != nil {
+			return err
+		}
+
+		a.perm = a.perm&^0777 | perm.perm
+	}
+
+	fs.entry(p, a, &op.Entry)
+
+	return nil
+}
+
+func (fs *sftpFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	perm := fileAttrs{flags: attrPermissions, perm: uint32(op.Mode.Perm())}
+	h, err := fs.c.open(ctx, p, fxfRead|fxfWrite|fxfCreat|fxfExcl, perm)
+	if err != nil {
+		if err == fuse.EIO {
+			// Most likely the name exists already.
+			if _, statErr := fs.c.lstat(ctx, p); statErr == nil {
+				return fuse.EEXIST
+			}
+		}
+
+		return err
+	}
+
+	// As for MkDir, make sure the server used the permissions requested.
+	a, err := fs.c.fstat(ctx, h)
+	if err == nil && a.perm&0777 != perm.perm {
+		err = fs.c.fsetstat(ctx, h, perm)
+		a.perm = a.perm&^0777 | perm.perm
+	}
+
+	if err != nil {
+		fs.c.closeHandle(context.Background(), h)
+		return err
+	}
+
+	fs.entry(p, a, &op.Entry)
+	op.Handle = fs.openHandle(op.Entry.Child, h)
+
+	return nil
+}
+
+func (fs *sftpFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.c.symlink(ctx, op.Target, p); err != nil {
+		return err
+	}
+
+	return fs.lookUp(ctx, p, &op.Entry)
+}
+
+func (fs *sftpFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	target, err := fs.pathOf(op.Target)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.c.hardlink(ctx, target, p); err != nil {
+		return err
+	}
+
+	// SFTP can't tell that the names refer to the same file, so the new one
+	// gets an inode of its own.
+	return fs.lookUp(ctx, p, &op.Entry)
+}
+
+func (fs *sftpFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	oldPath, err := fs.childPath(op.OldParent, op.OldName)
+	if err != nil {
+		return err
+	}
+
+	newPath, err := fs.childPath(op.NewParent, op.NewName)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.c.rename(ctx, oldPath, newPath); err != nil {
+		return err
+	}
+
+	fs.removed(newPath)
+
+	// Move the inode and everything beneath it.
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	moved := make(map[fuseops.InodeID]string)
+	for id, in := range fs.inodes {
+		if in.removed {
+			continue
+		}
+
+		switch {
+		case in.path == oldPath:
+			moved[id] = newPath
+
+		case strings.HasPrefix(in.path, oldPath+"/"):
+			moved[id] = newPath + in.path[len(oldPath):]
+		}
+	}
+
+	for id := range moved {
+		delete(fs.ids, fs.inodes[id].path)
+	}
+
+	for id, p := range moved {
+		fs.inodes[id].path = p
+		fs.ids[p] = id
+	}
+
+	return nil
+}
+
+func (fs *sftpFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.c.rmdir(ctx, p); err != nil {
+		// The server fails in the same way whatever the reason, and the
+		// directory not being empty is much the most likely.
+		if err == fuse.EIO {
+			return fuse.ENOTEMPTY
+		}
+
+		return err
+	}
+
+	fs.removed(p)
+
+	return nil
+}
+
+func (fs *sftpFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.c.remove(ctx, p); err != nil {
+		return err
+	}
+
+	fs.removed(p)
+
+	return nil
+}
+
+func (fs *sftpFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Handle = fs.nextHandle
+	fs.nextHandle++
+	fs.dirs[op.Handle] = &dirHandle{path: p}
+
+	return nil
+}
+
+func (fs *sftpFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	fs.mu.Lock()
+	dh, ok := fs.dirs[op.Handle]
+	fs.mu.Unlock()
+
+	if !ok {
+		return syscall.EBADF
+	}
+
+	// Take a fresh listing at the start, so that rewinddir sees changes. The
+	// kernel doesn't send concurrent reads for a single handle.
+	if op.Offset == 0 || dh.entries == nil {
+		names, err := fs.c.readDir(ctx, dh.path)
+		if err != nil {
+			return fs.checkStale(op.Inode, err)
+		}
+
+		// The listing is the latest word on what the directory contains.
+		fs.lookups.InvalidateDir(op.Inode)
+
+		dh.entries = nil
+		for _, n := range names {
+			dh.entries = append(dh.entries, fuseutil.Dirent{
+				Offset: fuseops.DirOffset(len(dh.entries) + 1),
+				Inode:  direntInode(path.Join(dh.path, n.name)),
+				Name:   n.name,
+				Type:   direntType(fuse.ConvertFileMode(n.attrs.perm)),
+			})
+		}
+	}
+
+	if op.Offset > fuseops.DirOffset(len(dh.entries)) {
+		return nil
+	}
+
+	for _, e := range dh.entries[op.Offset:] {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *sftpFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.dirs[op.Handle]; !ok {
+		return syscall.EBADF
+	}
+
+	delete(fs.dirs, op.Handle)
+
+	return nil
+}
+
+func (fs *sftpFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	var pflags uint32
+	switch {
+	case op.OpenFlags.IsReadOnly():
+		pflags = fxfRead
+	case op.OpenFlags.IsWriteOnly():
+		pflags = fxfWrite
+	default:
+		pflags = fxfRead | fxfWrite
+	}
+
+	if op.OpenFlags&syscall.O_APPEND != 0 {
+		pflags |= fxfAppend
+	}
+
+	if op.OpenFlags&syscall.O_TRUNC != 0 {
+		pflags |= fxfTrunc
+	}
+
+	h, err := fs.c.open(ctx, p, pflags, fileAttrs{})
+	if err != nil {
+		return fs.checkStale(op.Inode, err)
+	}
+
+	op.Handle = fs.openHandle(op.Inode, h)
+
+	return nil
+}
+
+func (fs *sftpFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fh, err := fs.getFile(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	end := op.Offset + int64(len(op.Dst))
+
+	fh.mu.Lock()
+
+	// Collect the chunks that cover the read, requesting any that aren't
+	// already on their way.
+	var chunks []*chunk
+	first := op.Offset - op.Offset%chunkSize
+	for off := first; off < end; off += chunkSize {
+		c := fh.chunks[off]
+		if c == nil {
+			c = fs.fetch(fh, off)
+		}
+
+		chunks = append(chunks, c)
+	}
+
+	// Request the chunks beyond a sequential reader, and forget those that it
+	// has finished with.
+	if op.Offset == fh.next {
+		for off := first; off < end+int64(fs.cfg.ReadAhead); off += chunkSize {
+			if fh.chunks[off] == nil {
+				fs.fetch(fh, off)
+			}
+		}
+	}
+
+	for off := range fh.chunks {
+		if off+chunkSize <= end || len(fh.chunks) > 2*(fs.cfg.ReadAhead/chunkSize)+8 {
+			delete(fh.chunks, off)
+		}
+	}
+
+	fh.next = end
+	fh.mu.Unlock()
+
+	// Copy out of the chunks, stopping at the end of the file.
+	for i, c := range chunks {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return fuse.EINTR
+		}
+
+		if c.err != nil {
+			return fs.checkStale(op.Inode, c.err)
+		}
+
+		off := first + int64(i)*chunkSize
+		start := max(op.Offset-off, 0)
+		if start >= int64(len(c.data)) {
+			break
+		}
+
+		op.BytesRead += copy(op.Dst[op.BytesRead:], c.data[start:])
+		if len(c.data) < chunkSize {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (fs *sftpFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fh, err := fs.getFile(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	// Data read ahead before the write was sent is stale, while the server
+	// handles any read sent later after the write.
+	if fh.writes == nil {
+		ch, err := fs.c.sendWrite(fh.h, op.Offset, op.Data)
+		if err != nil {
+			return fuse.EIO
+		}
+
+		fs.dropChunks(fh.inode)
+
+		r, err := wait(ctx, ch)
+		if err != nil {
+			return err
+		}
+
+		return statusError(r)
+	}
+
+	// Take a slot, then let the acknowledgement free it. The data is copied
+	// into the request, so op.Data may be reused as soon as this returns.
+	select {
+	case fh.writes <- struct{}{}:
+	case <-ctx.Done():
+		return fuse.EINTR
+	}
+
+	ch, err := fs.c.sendWrite(fh.h, op.Offset, op.Data)
+	if err != nil {
+		<-fh.writes
+		return fuse.EIO
+	}
+
+	fs.dropChunks(fh.inode)
+
+	go func() {
+		r := <-ch
+		err := r.err
+		if err == nil {
+			err = statusError(r)
+		}
+
+		if err != nil {
+			fh.mu.Lock()
+			if fh.writeErr == nil {
+				fh.writeErr = err
+			}
+			fh.mu.Unlock()
+		}
+
+		<-fh.writes
+	}()
+
+	// Report the failure of an earlier write as soon as possible.
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	err = fh.writeErr
+	fh.writeErr = nil
+
+	return err
+}
+
+func (fs *sftpFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	fh, err := fs.getFile(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	if err := fh.flush(ctx); err != nil {
+		return err
+	}
+
+	return fs.c.fsync(ctx, fh.h)
+}
+
+func (fs *sftpFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	fh, err := fs.getFile(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	return fh.flush(ctx)
+}
+
+func (fs *sftpFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	fh, ok := fs.files[op.Handle]
+	delete(fs.files, op.Handle)
+	fs.mu.Unlock()
+
+	if !ok {
+		return syscall.EBADF
+	}
+
+	// Nobody is left to hear about write errors, which FlushFile has already
+	// reported if it could.
+	fh.flush(context.Background())
+
+	return fs.c.closeHandle(context.Background(), fh.h)
+}
+
+func (fs *sftpFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	target, err := fs.c.readlink(ctx, p)
+	if err != nil {
+		return fs.checkStale(op.Inode, err)
+	}
+
+	op.Target = target
+
+	return nil
+}
@@ -0,0 +1,295 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sftpfs_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/samples"
+	"github.com/jacobsa/fuse/samples/sftpfs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestSFTPFS(t *testing.T) { RunTests(t) }
+
+// Return the path of OpenSSH's sftp-server, which the tests talk to through
+// its stdin and stdout, or the empty string if it isn't installed.
+func findServer() string {
+	for _, p := range []string{
+		"/usr/lib/openssh/sftp-server",
+		"/usr/libexec/openssh/sftp-server",
+		"/usr/libexec/sftp-server",
+	} {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+
+	p, _ := exec.LookPath("sftp-server")
+	return p
+}
+
+type SFTPFSTest struct {
+	samples.SampleTest
+
+	// The directory served by sftp-server.
+	remote string
+
+	server *exec.Cmd
+}
+
+func init() {
+	if findServer() != "" {
+		RegisterTestSuite(&SFTPFSTest{})
+	}
+}
+
+func (t *SFTPFSTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.remote, err = ioutil.TempDir("", "sftpfs_test")
+	AssertEq(nil, err)
+
+	// Populate the remote directory:
+	//
+	//     foo            "taco"
+	//     dir/
+	//     dir/bar        "burrito"
+	//
+	err = os.Mkdir(path.Join(t.remote, "dir"), 0755)
+	AssertEq(nil, err)
+
+	t.writeRemote("foo", "taco")
+	t.writeRemote("dir/bar", "burrito")
+
+	t.server = exec.Command(findServer())
+	w, err := t.server.StdinPipe()
+	AssertEq(nil, err)
+
+	r, err := t.server.StdoutPipe()
+	AssertEq(nil, err)
+
+	err = t.server.Start()
+	AssertEq(nil, err)
+
+	t.Server, err = sftpfs.NewSFTPFSFromStreams(r, w, sftpfs.Config{
+		Root:              t.remote,
+		Uid:               uint32(os.Getuid()),
+		Gid:               uint32(os.Getgid()),
+		AttributeTTL:      time.Minute,
+		LookupTTL:         time.Minute,
+		NegativeLookupTTL: time.Minute,
+		ReadAhead:         1 << 20,
+		MaxPendingWrites:  16,
+	})
+	AssertEq(nil, err)
+
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *SFTPFSTest) TearDown() {
+	t.SampleTest.TearDown()
+
+	// Unmounting closed the server's stdin.
+	t.server.Wait()
+
+	err := os.RemoveAll(t.remote)
+	AssertEq(nil, err)
+}
+
+func (t *SFTPFSTest) writeRemote(name string, contents string) {
+	err := ioutil.WriteFile(path.Join(t.remote, name), []byte(contents), 0644)
+	AssertEq(nil, err)
+}
+
+func (t *SFTPFSTest) readRemote(name string) string {
+	contents, err := ioutil.ReadFile(path.Join(t.remote, name))
+	AssertEq(nil, err)
+	return string(contents)
+}
+
+// Return the sorted names in the directory.
+func readNames(dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	AssertEq(nil, err)
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SFTPFSTest) ReadDir() {
+	ExpectThat(readNames(t.Dir), ElementsAre("dir", "foo"))
+	ExpectThat(readNames(path.Join(t.Dir, "dir")), ElementsAre("bar"))
+}
+
+func (t *SFTPFSTest) Stat() {
+	fi, err := os.Stat(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	ExpectEq(4, fi.Size())
+	ExpectEq(os.FileMode(0644), fi.Mode())
+
+	fi, err = os.Stat(path.Join(t.Dir, "dir"))
+	AssertEq(nil, err)
+	ExpectTrue(fi.IsDir())
+}
+
+func (t *SFTPFSTest) ReadFile() {
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "dir", "bar"))
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *SFTPFSTest) ReadLargeFile() {
+	// Several times the readahead, in a size that doesn't fill the last chunk.
+	data := bytes.Repeat([]byte("0123456789abcdef"), 300000)
+	err := ioutil.WriteFile(path.Join(t.remote, "large"), data, 0644)
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "large"))
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(data, contents))
+}
+
+func (t *SFTPFSTest) WriteFile() {
+	data := bytes.Repeat([]byte("taco"), 100000)
+	err := ioutil.WriteFile(path.Join(t.Dir, "qux"), data, 0600)
+	AssertEq(nil, err)
+
+	ExpectEq(string(data), t.readRemote("qux"))
+
+	fi, err := os.Stat(path.Join(t.remote, "qux"))
+	AssertEq(nil, err)
+	ExpectEq(os.FileMode(0600), fi.Mode())
+}
+
+func (t *SFTPFSTest) ReadAfterWrite() {
+	f, err := os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	buf := make([]byte, 4)
+	_, err = f.ReadAt(buf, 0)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(buf))
+
+	_, err = f.WriteAt([]byte("burr"), 0)
+	AssertEq(nil, err)
+
+	_, err = f.ReadAt(buf, 0)
+	AssertEq(nil, err)
+	ExpectEq("burr", string(buf))
+}
+
+func (t *SFTPFSTest) Truncate() {
+	err := os.Truncate(path.Join(t.Dir, "foo"), 2)
+	AssertEq(nil, err)
+
+	ExpectEq("ta", t.readRemote("foo"))
+}
+
+func (t *SFTPFSTest) Chown() {
+	err := os.Chown(path.Join(t.Dir, "foo"), os.Getuid()+1, -1)
+	ExpectThat(err, Error(HasSubstr("not permitted")))
+}
+
+func (t *SFTPFSTest) MkDirAndRmDir() {
+	err := os.Mkdir(path.Join(t.Dir, "new"), 0755)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(path.Join(t.remote, "new"))
+	AssertEq(nil, err)
+	ExpectTrue(fi.IsDir())
+
+	err = os.Mkdir(path.Join(t.Dir, "new"), 0755)
+	ExpectTrue(os.IsExist(err), "err: %v", err)
+
+	err = os.Remove(path.Join(t.Dir, "dir"))
+	ExpectThat(err, Error(HasSubstr("not empty")))
+
+	err = os.Remove(path.Join(t.Dir, "new"))
+	AssertEq(nil, err)
+
+	_, err = os.Stat(path.Join(t.remote, "new"))
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+}
+
+func (t *SFTPFSTest) Unlink() {
+	err := os.Remove(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	_, err = os.Stat(path.Join(t.remote, "foo"))
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+	ExpectThat(readNames(t.Dir), ElementsAre("dir"))
+}
+
+func (t *SFTPFSTest) Rename() {
+	err := os.Rename(path.Join(t.Dir, "dir"), path.Join(t.Dir, "other"))
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "other", "bar"))
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	// Over an existing file.
+	err = os.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, "other", "bar"))
+	AssertEq(nil, err)
+
+	ExpectEq("taco", t.readRemote("other/bar"))
+}
+
+func (t *SFTPFSTest) Symlink() {
+	err := os.Symlink("foo", path.Join(t.Dir, "link"))
+	AssertEq(nil, err)
+
+	target, err := os.Readlink(path.Join(t.remote, "link"))
+	AssertEq(nil, err)
+	ExpectEq("foo", target)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "link"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *SFTPFSTest) RemovedByServer() {
+	_, err := os.Stat(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	err = os.Remove(path.Join(t.remote, "foo"))
+	AssertEq(nil, err)
+
+	// The cached lookup is dropped once the server shows it to be stale.
+	ExpectThat(readNames(t.Dir), ElementsAre("dir"))
+
+	_, err = ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+}
@@ -0,0 +1,1571 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package unionfs contains a file system that layers a writable host
+// directory over one or more read-only ones, in the manner of overlayfs.
+//
+// The layers use overlayfs's on-disk format (with its userxattr option):
+// deleting a name that a lower layer provides leaves a whiteout in the upper
+// layer, which is a character device with device number zero, and a
+// directory in the upper layer that hides everything beneath it carries the
+// xattr "user.overlay.opaque" with value "y". Files from lower layers are
+// copied up to the upper layer in full before they are first modified.
+package unionfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/fuse/samples/internal/hostfs"
+	"golang.org/x/sys/unix"
+)
+
+// The xattr that marks an upper directory as hiding the lower layers.
+const opaqueXattr = "user.overlay.opaque"
+
+// The index of the upper layer within unionFS.layers.
+const upper = 0
+
+type inode struct {
+	// The path of the inode relative to the root of the union, or "" for the
+	// root itself.
+	path string
+
+	// Set once the name has been removed, after which the inode can no longer
+	// be found in the layers.
+	removed bool
+
+	// The number of references that the kernel holds to the inode. See notes on
+	// fuseops.ForgetInodeOp.
+	lookupCount uint64
+}
+
+type fileHandle struct {
+	f *os.File
+
+	// Whether the file was opened with O_APPEND, in which case the host file
+	// decides where writes go.
+	append bool
+}
+
+type dirHandle struct {
+	path string
+
+	// The merged listing returned by the most recent ReadDir at offset zero.
+	entries []fuseutil.Dirent
+}
+
+// A file as seen through the union.
+type node struct {
+	// The layers that hold the file, topmost first. Only directories are
+	// merged from more than one layer.
+	layers []int
+
+	// The attributes of the file in the topmost of those layers.
+	st unix.Stat_t
+}
+
+func (n *node) isDir() bool {
+	return n.st.Mode&unix.S_IFMT == unix.S_IFDIR
+}
+
+type unionFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	// The host directories being layered, the writable one first. Lower layers
+	// are never modified.
+	layers []string
+
+	// All ops hold mu throughout, including while copying a file up, except
+	// reads and writes, which hold it only to find their handle.
+	mu sync.Mutex
+
+	// The inodes that the kernel knows about, by ID and by path. Inodes are
+	// identified by path rather than by host file, since copying a file up
+	// moves it to another one.
+	//
+	// INVARIANT: For each id, in of inodes, ids[in.path] is id or absent.
+	// INVARIANT: For each p, id of ids, inodes[id].path == p && !inodes[id].removed
+	inodes map[fuseops.InodeID]*inode // GUARDED_BY(mu)
+	ids    map[string]fuseops.InodeID // GUARDED_BY(mu)
+
+	// The ID to give the next inode.
+	nextInode fuseops.InodeID // GUARDED_BY(mu)
+
+	// Open files and directories.
+	files      map[fuseops.HandleID]*fileHandle // GUARDED_BY(mu)
+	dirs       map[fuseops.HandleID]*dirHandle  // GUARDED_BY(mu)
+	nextHandle fuseops.HandleID                 // GUARDED_BY(mu)
+
+	// Whether the kernel caches writes, in which case it decides the offsets of
+	// appending writes itself.
+	writebackCache bool // GUARDED_BY(mu)
+}
+
+// NewUnionFS creates a file system that shows the host directory upper layered
+// over the lower directories, the first of which takes precedence. Changes are
+// made only to upper. As with loopbackfs, ops are performed on the host with
+// the credentials of the current process.
+//
+// Creating whiteouts requires Linux 5.8 or later when not running as root,
+// and hiding lower directories requires upper to support user xattrs. Renames
+// of directories that are merged from lower layers fail with EXDEV, which
+// mv(1) handles by copying. Hard links are given an inode for each name.
+//
+// Mount with MountConfig.EnableRenameFlags to support RENAME_NOREPLACE.
+func NewUnionFS(upperDir string, lowerDirs []string) (fuse.Server, error) {
+	fs := &unionFS{
+		inodes: map[fuseops.InodeID]*inode{
+			fuseops.RootInodeID: {lookupCount: 1},
+		},
+		ids:        map[string]fuseops.InodeID{"": fuseops.RootInodeID},
+		nextInode:  fuseops.RootInodeID + 1,
+		files:      make(map[fuseops.HandleID]*fileHandle),
+		dirs:       make(map[fuseops.HandleID]*dirHandle),
+		nextHandle: 1,
+	}
+
+	for _, dir := range append([]string{upperDir}, lowerDirs...) {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, fmt.Errorf("Abs: %v", err)
+		}
+
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return nil, fmt.Errorf("Stat: %v", err)
+		}
+
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		}
+
+		fs.layers = append(fs.layers, dir)
+	}
+
+	return fuseutil.NewFileSystemServer(fs), nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func isWhiteout(st *unix.Stat_t) bool {
+	return st.Mode&unix.S_IFMT == unix.S_IFCHR && st.Rdev == 0
+}
+
+func direntType(mode os.FileMode) fuseutil.DirentType {
+	switch {
+	case mode.IsDir():
+		return fuseutil.DT_Directory
+	case mode&os.ModeSymlink != 0:
+		return fuseutil.DT_Link
+	case mode&os.ModeNamedPipe != 0:
+		return fuseutil.DT_FIFO
+	case mode&os.ModeSocket != 0:
+		return fuseutil.DT_Socket
+	case mode&os.ModeCharDevice != 0:
+		return fuseutil.DT_Char
+	case mode&os.ModeDevice != 0:
+		return fuseutil.DT_Block
+	}
+
+	return fuseutil.DT_File
+}
+
+// Apply the supplied security labels to a new file.
+func setSecurityContexts(path string, contexts []fuseops.SecurityContext) error {
+	for _, c := range contexts {
+		if err := unix.Lsetxattr(path, c.Name, c.Value, 0); err != nil {
+			return hostfs.Errno(err)
+		}
+	}
+
+	return nil
+}
+
+// Handle IDs start at one, so this returns an ID that isn't in use for nil.
+func derefHandle(h *fuseops.HandleID) fuseops.HandleID {
+	if h == nil {
+		return 0
+	}
+
+	return *h
+}
+
+// Return the path of the named child of the directory at p.
+func childPath(p string, name string) string {
+	if p == "" {
+		return name
+	}
+
+	return p + "/" + name
+}
+
+// Return the path of the directory containing p.
+func parentPath(p string) string {
+	i := strings.LastIndexByte(p, '/')
+	if i < 0 {
+		return ""
+	}
+
+	return p[:i]
+}
+
+func (fs *unionFS) hostPath(layer int, p string) string {
+	return filepath.Join(fs.layers[layer], p)
+}
+
+func (fs *unionFS) isOpaque(layer int, p string) bool {
+	buf := make([]byte, 1)
+	n, err := unix.Lgetxattr(fs.hostPath(layer, p), opaqueXattr, buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
+
+// Find the named child of the directory dir at p.
+func (fs *unionFS) child(dir *node, p string) (*node, error) {
+	n := &node{}
+	for _, l := range dir.layers {
+		var st unix.Stat_t
+		err := unix.Lstat(fs.hostPath(l, p), &st)
+		if errors.Is(err, unix.ENOENT) {
+			continue
+		}
+
+		if err != nil {
+			return nil, hostfs.Errno(err)
+		}
+
+		if isWhiteout(&st) {
+			break
+		}
+
+		// Anything but a directory hides the layers beneath it, and is itself
+		// hidden by a directory above it.
+		if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+			if len(n.layers) == 0 {
+				n.layers = []int{l}
+				n.st = st
+			}
+
+			break
+		}
+
+		if len(n.layers) == 0 {
+			n.st = st
+		}
+
+		n.layers = append(n.layers, l)
+		if fs.isOpaque(l, p) {
+			break
+		}
+	}
+
+	if len(n.layers) == 0 {
+		return nil, fuse.ENOENT
+	}
+
+	return n, nil
+}
+
+// Find the file at the supplied path in the union.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *unionFS) resolve(p string) (*node, error) {
+	n := &node{}
+	for l := range fs.layers {
+		n.layers = append(n.layers, l)
+	}
+
+	if err := unix.Lstat(fs.layers[upper], &n.st); err != nil {
+		return nil, hostfs.Errno(err)
+	}
+
+	if p == "" {
+		return n, nil
+	}
+
+	var prefix string
+	for _, name := range strings.Split(p, "/") {
+		if !n.isDir() {
+			return nil, fuse.ENOTDIR
+		}
+
+		prefix = childPath(prefix, name)
+
+		var err error
+		if n, err = fs.child(n, prefix); err != nil {
+			return nil, err
+		}
+	}
+
+	return n, nil
+}
+
+// Return the path of the inode, or ENOENT if it has been removed.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *unionFS) pathOf(id fuseops.InodeID) (string, error) {
+	in := fs.inodes[id]
+	if in == nil {
+		panic(fmt.Sprintf("Unknown inode: %v", id))
+	}
+
+	if in.removed {
+		return "", fuse.ENOENT
+	}
+
+	return in.path, nil
+}
+
+// Fill in an entry for the file at the supplied path, incrementing the lookup
+// count of its inode and allocating one if the kernel doesn't already know
+// about the path.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *unionFS) lookUp(p string, e *fuseops.ChildInodeEntry) error {
+	n, err := fs.resolve(p)
+	if err != nil {
+		return err
+	}
+
+	id, ok := fs.ids[p]
+	if !ok {
+		id = fs.nextInode
+		fs.nextInode++
+
+		fs.inodes[id] = &inode{path: p}
+		fs.ids[p] = id
+	}
+
+	fs.inodes[id].lookupCount++
+
+	e.Child = id
+	e.Attributes = hostfs.Attributes(&n.st)
+
+	return nil
+}
+
+// Decrement the lookup count of the inode, forgetting it once the kernel no
+// longer refers to it.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *unionFS) forget(id fuseops.InodeID, n uint64) {
+	in := fs.inodes[id]
+	if in == nil {
+		panic(fmt.Sprintf("Unknown inode: %v", id))
+	}
+
+	if n > in.lookupCount {
+		panic(fmt.Sprintf("Forgetting %d references to inode %d with %d", n, id, in.lookupCount))
+	}
+
+	in.lookupCount -= n
+	if in.lookupCount != 0 || id == fuseops.RootInodeID {
+		return
+	}
+
+	delete(fs.inodes, id)
+	if !in.removed {
+		delete(fs.ids, in.path)
+	}
+}
+
+// Note that the name p no longer refers to the inode it used to, so that a
+// new file created there gets a new inode.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *unionFS) removed(p string) {
+	if id, ok := fs.ids[p]; ok {
+		fs.inodes[id].removed = true
+		delete(fs.ids, p)
+	}
+}
+
+// Make sure that the file at p is in the upper layer, copying it and its
+// parents up from the lower layers if necessary. Directories are created empty
+// and so continue to be merged with the lower layers.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *unionFS) copyUp(p string) (*node, error) {
+	n, err := fs.resolve(p)
+	if err != nil || n.layers[0] == upper {
+		return n, err
+	}
+
+	if _, err := fs.copyUp(parentPath(p)); err != nil {
+		return nil, err
+	}
+
+	src := fs.hostPath(n.layers[0], p)
+	dst := fs.hostPath(upper, p)
+	if err := copyFile(src, dst, &n.st); err != nil {
+		os.Remove(dst)
+		return nil, err
+	}
+
+	return fs.resolve(p)
+}
+
+// Copy a single file, directory, symlink or device, along with its
+// permissions, ownership and times. Directories are copied without their
+// contents. Ownership is copied only if the process may change it.
+func copyFile(src string, dst string, st *unix.Stat_t) error {
+	var err error
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		err = unix.Mkdir(dst, 0700)
+
+	case unix.S_IFREG:
+		err = copyContents(src, dst)
+
+	case unix.S_IFLNK:
+		var target string
+		if target, err = os.Readlink(src); err == nil {
+			err = os.Symlink(target, dst)
+		}
+
+	default:
+		err = unix.Mknod(dst, uint32(st.Mode), int(st.Rdev))
+	}
+
+	if err != nil {
+		return hostfs.Errno(err)
+	}
+
+	os.Lchown(dst, int(st.Uid), int(st.Gid))
+
+	// Symlinks have no permissions of their own.
+	if st.Mode&unix.S_IFMT != unix.S_IFLNK {
+		if err := os.Chmod(dst, hostfs.FileMode(uint32(st.Mode))); err != nil {
+			return hostfs.Errno(err)
+		}
+	}
+
+	times := []unix.Timespec{st.Atim, st.Mtim}
+	return hostfs.Errno(unix.UtimesNanoAt(unix.AT_FDCWD, dst, times, unix.AT_SYMLINK_NOFOLLOW))
+}
+
+func copyContents(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// Hide the lower layers' file at p, which must not exist in the upper layer.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *unionFS) whiteOut(p string) error {
+	if _, err := fs.copyUp(parentPath(p)); err != nil {
+		return err
+	}
+
+	return hostfs.Errno(unix.Mknod(fs.hostPath(upper, p), unix.S_IFCHR, 0))
+}
+
+// Hide the lower layers' file at p if there is still one there after the
+// upper layer's was removed.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *unionFS) whiteOutIfLower(p string) error {
+	_, err := fs.resolve(p)
+	switch {
+	case err == fuse.ENOENT:
+		return nil
+
+	case err != nil:
+		return err
+	}
+
+	return fs.whiteOut(p)
+}
+
+// Remove a whiteout from the upper layer at p, returning true if there was
+// one.
+func (fs *unionFS) removeWhiteout(p string) (bool, error) {
+	var st unix.Stat_t
+	host := fs.hostPath(upper, p)
+	if err := unix.Lstat(host, &st); err != nil || !isWhiteout(&st) {
+		return false, nil
+	}
+
+	if err := unix.Unlink(host); err != nil {
+		return false, hostfs.Errno(err)
+	}
+
+	return true, nil
+}
+
+// Remove the whiteouts left in an upper directory that appears empty in the
+// union, so that the host will let it be removed or replaced.
+func (fs *unionFS) clearWhiteouts(p string) error {
+	host := fs.hostPath(upper, p)
+	names, err := readNames(host)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := unix.Unlink(filepath.Join(host, name)); err != nil {
+			return hostfs.Errno(err)
+		}
+	}
+
+	return nil
+}
+
+func readNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, hostfs.Errno(err)
+	}
+
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, hostfs.Errno(err)
+	}
+
+	return names, nil
+}
+
+// Create a new file named name in the directory at dir by calling mk with its
+// host path in the upper layer, replacing any whiteout for a file of the same
+// name from a lower layer.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *unionFS) create(
+	dir string,
+	name string,
+	contexts []fuseops.SecurityContext,
+	mk func(host string) error) (string, error) {
+	p := childPath(dir, name)
+	if _, err := fs.resolve(p); err == nil {
+		return "", fuse.EEXIST
+	} else if err != fuse.ENOENT {
+		return "", err
+	}
+
+	if _, err := fs.copyUp(dir); err != nil {
+		return "", err
+	}
+
+	hadWhiteout, err := fs.removeWhiteout(p)
+	if err != nil {
+		return "", err
+	}
+
+	host := fs.hostPath(upper, p)
+	if err := mk(host); err != nil {
+		if hadWhiteout {
+			fs.whiteOut(p)
+		}
+
+		return "", hostfs.Errno(err)
+	}
+
+	err = setSecurityContexts(host, contexts)
+
+	// A new directory mustn't show the contents of one that was deleted from a
+	// lower layer.
+	if err == nil && hadWhiteout {
+		if fi, statErr := os.Lstat(host); statErr == nil && fi.IsDir() {
+			err = hostfs.Errno(unix.Lsetxattr(host, opaqueXattr, []byte("y"), 0))
+		}
+	}
+
+	if err != nil {
+		os.Remove(host)
+		if hadWhiteout {
+			fs.whiteOut(p)
+		}
+
+		return "", err
+	}
+
+	return p, nil
+}
+
+// Read the merged listing of the directory at p, from the start.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *unionFS) readDir(p string) ([]fuseutil.Dirent, error) {
+	n, err := fs.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if !n.isDir() {
+		return nil, fuse.ENOTDIR
+	}
+
+	// Names in upper layers hide those in lower ones, whether or not they are
+	// whiteouts.
+	seen := make(map[string]bool)
+	var entries []fuseutil.Dirent
+	for _, l := range n.layers {
+		f, err := os.Open(fs.hostPath(l, p))
+		if err != nil {
+			return nil, hostfs.Errno(err)
+		}
+
+		children, err := f.ReadDir(-1)
+		f.Close()
+		if err != nil {
+			return nil, hostfs.Errno(err)
+		}
+
+		for _, child := range children {
+			if seen[child.Name()] {
+				continue
+			}
+
+			seen[child.Name()] = true
+
+			// Skip entries that have disappeared since the listing.
+			fi, err := child.Info()
+			if err != nil {
+				continue
+			}
+
+			var ino uint64
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+				if st.Mode&syscall.S_IFMT == syscall.S_IFCHR && st.Rdev == 0 {
+					continue
+				}
+
+				ino = uint64(st.Ino)
+			}
+
+			entries = append(entries, fuseutil.Dirent{
+				Offset: fuseops.DirOffset(len(entries) + 1),
+				Inode:  fuseops.InodeID(ino),
+				Name:   child.Name(),
+				Type:   direntType(fi.Mode()),
+			})
+		}
+	}
+
+	return entries, nil
+}
+
+// Return the flags with which to open a host file for the supplied kernel
+// flags.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *unionFS) hostFlags(flags fusekernel.OpenFlags) int {
+	f := int(flags) &^ (os.O_CREATE | os.O_EXCL | syscall.O_NOCTTY)
+
+	// With writeback caching the kernel works out where appending writes go,
+	// and may read through any handle to fill its cache.
+	if fs.writebackCache {
+		f &^= os.O_APPEND
+		if f&os.O_WRONLY != 0 {
+			f = f&^os.O_WRONLY | os.O_RDWR
+		}
+	}
+
+	return f
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *unionFS) openHandle(f *os.File, flags int) fuseops.HandleID {
+	handle := fs.nextHandle
+	fs.nextHandle++
+
+	fs.files[handle] = &fileHandle{
+		f:      f,
+		append: flags&os.O_APPEND != 0,
+	}
+
+	return handle
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *unionFS) getFile(h fuseops.HandleID) (*fileHandle, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fh, ok := fs.files[h]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+
+	return fh, nil
+}
+
+// Return the upper layer's path for the inode, copying it up first.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *unionFS) upperPath(id fuseops.InodeID) (string, error) {
+	p, err := fs.pathOf(id)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := fs.copyUp(p); err != nil {
+		return "", err
+	}
+
+	return fs.hostPath(upper, p), nil
+}
+
+// Return the host path of the inode in its topmost layer.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *unionFS) topPath(id fuseops.InodeID) (string, error) {
+	p, err := fs.pathOf(id)
+	if err != nil {
+		return "", err
+	}
+
+	n, err := fs.resolve(p)
+	if err != nil {
+		return "", err
+	}
+
+	return fs.hostPath(n.layers[0], p), nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *unionFS) Init(op *fuseops.InitOp) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.writebackCache = op.Flags&fusekernel.InitWritebackCache != 0
+}
+
+func (fs *unionFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	// New data all goes to the upper layer.
+	var st unix.Statfs_t
+	if err := unix.Statfs(fs.layers[upper], &st); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	op.BlockSize, op.IoSize = hostfs.BlockSizes(&st)
+	op.Blocks = st.Blocks
+	op.BlocksFree = st.Bfree
+	op.BlocksAvailable = st.Bavail
+	op.Inodes = st.Files
+	op.InodesFree = st.Ffree
+
+	return nil
+}
+
+func (fs *unionFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, err := fs.pathOf(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	return fs.lookUp(childPath(dir, op.Name), &op.Entry)
+}
+
+func (fs *unionFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	n, err := fs.resolve(p)
+	if err != nil {
+		return err
+	}
+
+	op.Attributes = hostfs.Attributes(&n.st)
+
+	return nil
+}
+
+func (fs *unionFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path, err := fs.upperPath(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if op.Size != nil {
+		if fh, ok := fs.files[derefHandle(op.Handle)]; ok {
+			err = fh.f.Truncate(int64(*op.Size))
+		} else {
+			err = os.Truncate(path, int64(*op.Size))
+		}
+
+		if err != nil {
+			return hostfs.Errno(err)
+		}
+	}
+
+	if op.Mode != nil {
+		if err := os.Chmod(path, *op.Mode); err != nil {
+			return hostfs.Errno(err)
+		}
+	}
+
+	if op.Uid != nil || op.Gid != nil {
+		uid, gid := -1, -1
+		if op.Uid != nil {
+			uid = int(*op.Uid)
+		}
+
+		if op.Gid != nil {
+			gid = int(*op.Gid)
+		}
+
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return hostfs.Errno(err)
+		}
+	}
+
+	// Zero times are left unchanged.
+	if op.Atime != nil || op.Mtime != nil {
+		var atime, mtime time.Time
+		if op.Atime != nil {
+			atime = *op.Atime
+		}
+
+		if op.Mtime != nil {
+			mtime = *op.Mtime
+		}
+
+		if err := os.Chtimes(path, atime, mtime); err != nil {
+			return hostfs.Errno(err)
+		}
+	}
+
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return hostfs.Errno(err)
+	}
+
+	op.Attributes = hostfs.Attributes(&st)
+
+	return nil
+}
+
+func (fs *unionFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.forget(op.Inode, op.N)
+
+	return nil
+}
+
+func (fs *unionFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, e := range op.Entries {
+		fs.forget(e.Inode, e.N)
+	}
+
+	return nil
+}
+
+func (fs *unionFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, err := fs.pathOf(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	p, err := fs.create(dir, op.Name, op.SecurityContexts, func(host string) error {
+		return os.Mkdir(host, op.Mode)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return fs.lookUp(p, &op.Entry)
+}
+
+func (fs *unionFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, err := fs.pathOf(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	// A device numbered zero would be taken for a whiteout, and vanish.
+	if op.Mode&os.ModeCharDevice != 0 && op.Rdev == 0 {
+		return syscall.EPERM
+	}
+
+	p, err := fs.create(dir, op.Name, op.SecurityContexts, func(host string) error {
+		return unix.Mknod(host, hostfs.UnixMode(op.Mode), int(op.Rdev))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return fs.lookUp(p, &op.Entry)
+}
+
+func (fs *unionFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, err := fs.pathOf(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	var f *os.File
+	flags := fs.hostFlags(op.OpenFlags) | os.O_CREATE | os.O_EXCL
+	p, err := fs.create(dir, op.Name, op.SecurityContexts, func(host string) error {
+		var err error
+		f, err = os.OpenFile(host, flags, op.Mode.Perm())
+		return err
+	})
+
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+
+		return err
+	}
+
+	if err := fs.lookUp(p, &op.Entry); err != nil {
+		f.Close()
+		return err
+	}
+
+	op.Handle = fs.openHandle(f, flags)
+
+	return nil
+}
+
+func (fs *unionFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, err := fs.pathOf(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	p, err := fs.create(dir, op.Name, op.SecurityContexts, func(host string) error {
+		return os.Symlink(op.Target, host)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return fs.lookUp(p, &op.Entry)
+}
+
+func (fs *unionFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, err := fs.pathOf(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	target, err := fs.upperPath(op.Target)
+	if err != nil {
+		return err
+	}
+
+	p, err := fs.create(dir, op.Name, nil, func(host string) error {
+		return os.Link(target, host)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return fs.lookUp(p, &op.Entry)
+}
+
+func (fs *unionFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Flags&^fuseops.RenameNoReplace != 0 {
+		return fuse.EINVAL
+	}
+
+	oldDir, err := fs.pathOf(op.OldParent)
+	if err != nil {
+		return err
+	}
+
+	newDir, err := fs.pathOf(op.NewParent)
+	if err != nil {
+		return err
+	}
+
+	oldPath := childPath(oldDir, op.OldName)
+	newPath := childPath(newDir, op.NewName)
+
+	src, err := fs.resolve(oldPath)
+	if err != nil {
+		return err
+	}
+
+	// Moving a directory that is merged from the lower layers would mean
+	// moving their contents too.
+	if src.isDir() && (len(src.layers) > 1 || src.layers[0] != upper) {
+		return syscall.EXDEV
+	}
+
+	dst, err := fs.resolve(newPath)
+	switch {
+	case err == fuse.ENOENT:
+		dst = nil
+
+	case err != nil:
+		return err
+
+	case op.Flags&fuseops.RenameNoReplace != 0:
+		return fuse.EEXIST
+
+	case oldPath == newPath:
+		return nil
+
+	case src.isDir() && !dst.isDir():
+		return fuse.ENOTDIR
+
+	case !src.isDir() && dst.isDir():
+		return syscall.EISDIR
+
+	case dst.isDir():
+		entries, err := fs.readDir(newPath)
+		if err != nil {
+			return err
+		}
+
+		if len(entries) != 0 {
+			return fuse.ENOTEMPTY
+		}
+	}
+
+	if _, err := fs.copyUp(oldPath); err != nil {
+		return err
+	}
+
+	if _, err := fs.copyUp(newDir); err != nil {
+		return err
+	}
+
+	// Clear the way in the upper layer, where the host will only replace an
+	// empty directory with another.
+	if dst != nil && dst.isDir() && dst.layers[0] == upper {
+		if err := fs.clearWhiteouts(newPath); err != nil {
+			return err
+		}
+	}
+
+	hadWhiteout, err := fs.removeWhiteout(newPath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(fs.hostPath(upper, oldPath), fs.hostPath(upper, newPath)); err != nil {
+		if hadWhiteout {
+			fs.whiteOut(newPath)
+		}
+
+		return hostfs.Errno(err)
+	}
+
+	// A directory now at the new name mustn't be merged with whatever the lower
+	// layers have there.
+	if src.isDir() {
+		if n, err := fs.resolve(newPath); err == nil && len(n.layers) > 1 {
+			err = unix.Lsetxattr(fs.hostPath(upper, newPath), opaqueXattr, []byte("y"), 0)
+			if err != nil {
+				return hostfs.Errno(err)
+			}
+		}
+	}
+
+	if err := fs.whiteOutIfLower(oldPath); err != nil {
+		return err
+	}
+
+	// Move the inode and everything beneath it.
+	fs.removed(newPath)
+	moved := make(map[fuseops.InodeID]string)
+	for id, in := range fs.inodes {
+		if in.removed {
+			continue
+		}
+
+		switch {
+		case in.path == oldPath:
+			moved[id] = newPath
+
+		case strings.HasPrefix(in.path, oldPath+"/"):
+			moved[id] = newPath + in.path[len(oldPath):]
+		}
+	}
+
+	for id := range moved {
+		delete(fs.ids, fs.inodes[id].path)
+	}
+
+	for id, p := range moved {
+		fs.inodes[id].path = p
+		fs.ids[p] = id
+	}
+
+	return nil
+}
+
+func (fs *unionFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, err := fs.pathOf(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	p := childPath(dir, op.Name)
+	n, err := fs.resolve(p)
+	if err != nil {
+		return err
+	}
+
+	if !n.isDir() {
+		return fuse.ENOTDIR
+	}
+
+	entries, err := fs.readDir(p)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) != 0 {
+		return fuse.ENOTEMPTY
+	}
+
+	if n.layers[0] == upper {
+		if err := fs.clearWhiteouts(p); err != nil {
+			return err
+		}
+
+		if err := unix.Rmdir(fs.hostPath(upper, p)); err != nil {
+			return hostfs.Errno(err)
+		}
+	}
+
+	fs.removed(p)
+
+	return fs.whiteOutIfLower(p)
+}
+
+func (fs *unionFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, err := fs.pathOf(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	p := childPath(dir, op.Name)
+	n, err := fs.resolve(p)
+	if err != nil {
+		return err
+	}
+
+	if n.isDir() {
+		return syscall.EISDIR
+	}
+
+	if n.layers[0] == upper {
+		if err := unix.Unlink(fs.hostPath(upper, p)); err != nil {
+			return hostfs.Errno(err)
+		}
+	}
+
+	fs.removed(p)
+
+	return fs.whiteOutIfLower(p)
+}
+
+func (fs *unionFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Handle = fs.nextHandle
+	fs.nextHandle++
+	fs.dirs[op.Handle] = &dirHandle{path: p}
+
+	return nil
+}
+
+func (fs *unionFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dh, ok := fs.dirs[op.Handle]
+	if !ok {
+		return syscall.EBADF
+	}
+
+	// Take a fresh listing at the start, so that rewinddir sees changes.
+	if op.Offset == 0 || dh.entries == nil {
+		entries, err := fs.readDir(dh.path)
+		if err != nil {
+			return err
+		}
+
+		dh.entries = entries
+	}
+
+	if op.Offset > fuseops.DirOffset(len(dh.entries)) {
+		return nil
+	}
+
+	for _, e := range dh.entries[op.Offset:] {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *unionFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.dirs[op.Handle]; !ok {
+		return syscall.EBADF
+	}
+
+	delete(fs.dirs, op.Handle)
+
+	return nil
+}
+
+func (fs *unionFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Files are copied up when opened for writing, so a handle opened earlier
+	// for reading continues to see the lower layer's copy.
+	var path string
+	var err error
+	flags := fs.hostFlags(op.OpenFlags)
+	if flags&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0 {
+		path, err = fs.upperPath(op.Inode)
+	} else {
+		path, err = fs.topPath(op.Inode)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, flags, 0)
+	if err != nil {
+		return hostfs.Errno(err)
+	}
+
+	op.Handle = fs.openHandle(f, flags)
+
+	return nil
+}
+
+func (fs *unionFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fh, err := fs.getFile(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	// Reads past the end are short, which is how the kernel learns of EOF.
+	op.BytesRead, err = fh.f.ReadAt(op.Dst, op.Offset)
+	if err == io.EOF {
+		return nil
+	}
+
+	return hostfs.Errno(err)
+}
+
+func (fs *unionFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fh, err := fs.getFile(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	// The host appends atomically, wherever the kernel thinks the end is.
+	// os.File refuses WriteAt for such files anyway.
+	if fh.append {
+		_, err = fh.f.Write(op.Data)
+	} else {
+		_, err = fh.f.WriteAt(op.Data, op.Offset)
+	}
+
+	return hostfs.Errno(err)
+}
+
+func (fs *unionFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	fh, err := fs.getFile(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	return hostfs.Errno(fh.f.Sync())
+}
+
+func (fs *unionFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	// Writes go straight to the host, so there's nothing to flush.
+	return nil
+}
+
+func (fs *unionFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fh, ok := fs.files[op.Handle]
+	if !ok {
+		return syscall.EBADF
+	}
+
+	delete(fs.files, op.Handle)
+
+	return hostfs.Errno(fh.f.Close())
+}
+
+func (fs *unionFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path, err := fs.topPath(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	target, err := os.Readlink(path)
+	if err != nil {
+		return hostfs.Errno(err)
+	}
+
+	op.Target = target
+
+	return nil
+}
+
+func (fs *unionFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Name == opaqueXattr {
+		return fuse.ENOATTR
+	}
+
+	path, err := fs.topPath(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	n, err := unix.Lgetxattr(path, op.Name, op.Dst)
+	if err != nil {
+		return hostfs.Errno(err)
+	}
+
+	op.BytesRead = n
+
+	return nil
+}
+
+func (fs *unionFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path, err := fs.topPath(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	// Read the whole list, in order to leave out the opaque marker.
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		return hostfs.Errno(err)
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return hostfs.Errno(err)
+	}
+
+	dst := op.Dst[:]
+	for _, name := range strings.SplitAfter(string(buf[:size]), "\x00") {
+		if name == "" || name == opaqueXattr+"\x00" {
+			continue
+		}
+
+		if len(dst) >= len(name) {
+			copy(dst, name)
+			dst = dst[len(name):]
+		} else if len(op.Dst) != 0 {
+			return fuse.ERANGE
+		}
+
+		op.BytesRead += len(name)
+	}
+
+	return nil
+}
+
+func (fs *unionFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Name == opaqueXattr {
+		return syscall.EPERM
+	}
+
+	path, err := fs.upperPath(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	return hostfs.Errno(unix.Lremovexattr(path, op.Name))
+}
+
+func (fs *unionFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Name == opaqueXattr {
+		return syscall.EPERM
+	}
+
+	path, err := fs.upperPath(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	return hostfs.Errno(unix.Lsetxattr(path, op.Name, op.Value, int(op.Flags)))
+}
@@ -0,0 +1,56 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unionfs_test
+
+import (
+	"io/ioutil"
+	"path"
+
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/sys/unix"
+)
+
+////////////////////////////////////////////////////////////////////////
+// renameat2
+////////////////////////////////////////////////////////////////////////
+
+func (t *UnionFSTest) RenameNoReplace() {
+	err := unix.Renameat2(
+		unix.AT_FDCWD, path.Join(t.Dir, "dir", "bar"),
+		unix.AT_FDCWD, path.Join(t.Dir, "foo"),
+		unix.RENAME_NOREPLACE)
+
+	ExpectEq(unix.EEXIST, err)
+
+	err = unix.Renameat2(
+		unix.AT_FDCWD, path.Join(t.Dir, "dir", "bar"),
+		unix.AT_FDCWD, path.Join(t.Dir, "qux"),
+		unix.RENAME_NOREPLACE)
+
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "qux"))
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *UnionFSTest) RenameExchangeUnsupported() {
+	err := unix.Renameat2(
+		unix.AT_FDCWD, path.Join(t.Dir, "dir", "bar"),
+		unix.AT_FDCWD, path.Join(t.Dir, "foo"),
+		unix.RENAME_EXCHANGE)
+
+	ExpectEq(unix.EINVAL, err)
+}
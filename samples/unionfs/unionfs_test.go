@@ -0,0 +1,269 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unionfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/samples"
+	"github.com/jacobsa/fuse/samples/unionfs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestUnionFS(t *testing.T) { RunTests(t) }
+
+type UnionFSTest struct {
+	samples.SampleTest
+
+	// The host directories being layered.
+	upper string
+	lower string
+}
+
+func init() { RegisterTestSuite(&UnionFSTest{}) }
+
+func (t *UnionFSTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.upper, err = ioutil.TempDir("", "unionfs_test_upper")
+	AssertEq(nil, err)
+
+	t.lower, err = ioutil.TempDir("", "unionfs_test_lower")
+	AssertEq(nil, err)
+
+	// Populate the lower layer:
+	//
+	//     foo            "taco"
+	//     dir/
+	//     dir/bar        "burrito"
+	//     dir/sub/
+	//     dir/sub/baz    "enchilada"
+	//
+	err = os.MkdirAll(path.Join(t.lower, "dir", "sub"), 0755)
+	AssertEq(nil, err)
+
+	t.writeLower("foo", "taco")
+	t.writeLower("dir/bar", "burrito")
+	t.writeLower("dir/sub/baz", "enchilada")
+
+	t.Server, err = unionfs.NewUnionFS(t.upper, []string{t.lower})
+	AssertEq(nil, err)
+
+	t.MountConfig.EnableRenameFlags = true
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *UnionFSTest) TearDown() {
+	t.SampleTest.TearDown()
+
+	err := os.RemoveAll(t.upper)
+	AssertEq(nil, err)
+
+	err = os.RemoveAll(t.lower)
+	AssertEq(nil, err)
+}
+
+func (t *UnionFSTest) writeLower(name string, contents string) {
+	err := ioutil.WriteFile(path.Join(t.lower, name), []byte(contents), 0644)
+	AssertEq(nil, err)
+}
+
+// Return the lower layer's contents for the supplied name, which must be
+// unchanged.
+func (t *UnionFSTest) readLower(name string) string {
+	contents, err := ioutil.ReadFile(path.Join(t.lower, name))
+	AssertEq(nil, err)
+	return string(contents)
+}
+
+// Return the sorted names in the directory.
+func readNames(dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	AssertEq(nil, err)
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *UnionFSTest) ReadLowerFile() {
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "dir", "sub", "baz"))
+	AssertEq(nil, err)
+	ExpectEq("enchilada", string(contents))
+
+	// Reading doesn't copy anything up.
+	ExpectThat(readNames(t.upper), ElementsAre())
+}
+
+func (t *UnionFSTest) MergedDirectory() {
+	err := os.Mkdir(path.Join(t.upper, "dir"), 0755)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.upper, "dir", "qux"), []byte("upper"), 0644)
+	AssertEq(nil, err)
+
+	// A file in the upper layer hides one of the same name beneath it.
+	err = ioutil.WriteFile(path.Join(t.upper, "dir", "bar"), []byte("upper"), 0644)
+	AssertEq(nil, err)
+
+	ExpectThat(readNames(path.Join(t.Dir, "dir")), ElementsAre("bar", "qux", "sub"))
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "dir", "bar"))
+	AssertEq(nil, err)
+	ExpectEq("upper", string(contents))
+}
+
+func (t *UnionFSTest) CopyUpOnWrite() {
+	f, err := os.OpenFile(path.Join(t.Dir, "dir", "bar"), os.O_WRONLY, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	_, err = f.WriteAt([]byte("qu"), 0)
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.upper, "dir", "bar"))
+	AssertEq(nil, err)
+	ExpectEq("qurrito", string(contents))
+
+	ExpectEq("burrito", t.readLower("dir/bar"))
+
+	// The copy keeps the permissions of the original.
+	fi, err := os.Stat(path.Join(t.upper, "dir", "bar"))
+	AssertEq(nil, err)
+	ExpectEq(os.FileMode(0644), fi.Mode())
+}
+
+func (t *UnionFSTest) CopyUpOnChmod() {
+	err := os.Chmod(path.Join(t.Dir, "foo"), 0600)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(path.Join(t.upper, "foo"))
+	AssertEq(nil, err)
+	ExpectEq(os.FileMode(0600), fi.Mode())
+
+	contents, err := ioutil.ReadFile(path.Join(t.upper, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *UnionFSTest) CreateFile() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "dir", "qux"), []byte("queso"), 0644)
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.upper, "dir", "qux"))
+	AssertEq(nil, err)
+	ExpectEq("queso", string(contents))
+
+	_, err = os.Stat(path.Join(t.lower, "dir", "qux"))
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+}
+
+func (t *UnionFSTest) UnlinkLowerFile() {
+	err := os.Remove(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	_, err = os.Stat(path.Join(t.Dir, "foo"))
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+	ExpectThat(readNames(t.Dir), ElementsAre("dir"))
+
+	// A whiteout hides the lower layer's file.
+	ExpectEq("taco", t.readLower("foo"))
+
+	var st syscall.Stat_t
+	err = syscall.Lstat(path.Join(t.upper, "foo"), &st)
+	AssertEq(nil, err)
+	ExpectEq(syscall.S_IFCHR, st.Mode&syscall.S_IFMT)
+	ExpectEq(0, st.Rdev)
+
+	// The name can be used again.
+	err = ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("burrito"), 0644)
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *UnionFSTest) RemoveAndRecreateLowerDirectory() {
+	err := os.RemoveAll(path.Join(t.Dir, "dir"))
+	AssertEq(nil, err)
+
+	_, err = os.Stat(path.Join(t.Dir, "dir"))
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+
+	// A new directory of the same name doesn't show the old contents.
+	err = os.Mkdir(path.Join(t.Dir, "dir"), 0755)
+	AssertEq(nil, err)
+
+	ExpectThat(readNames(path.Join(t.Dir, "dir")), ElementsAre())
+	ExpectEq("burrito", t.readLower("dir/bar"))
+}
+
+func (t *UnionFSTest) RmDirNotEmpty() {
+	err := os.Remove(path.Join(t.Dir, "dir", "sub"))
+	ExpectThat(err, Error(HasSubstr("not empty")))
+}
+
+func (t *UnionFSTest) RenameLowerFile() {
+	err := os.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, "dir", "qux"))
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "dir", "qux"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	_, err = os.Stat(path.Join(t.Dir, "foo"))
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+	ExpectEq("taco", t.readLower("foo"))
+}
+
+func (t *UnionFSTest) RenameMergedDirectory() {
+	err := os.Rename(path.Join(t.Dir, "dir"), path.Join(t.Dir, "other"))
+	ExpectThat(err, Error(HasSubstr("cross-device")))
+}
+
+func (t *UnionFSTest) RenameUpperDirectory() {
+	err := os.Mkdir(path.Join(t.Dir, "new"), 0755)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "new", "qux"), []byte("queso"), 0644)
+	AssertEq(nil, err)
+
+	err = os.Rename(path.Join(t.Dir, "new"), path.Join(t.Dir, "other"))
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "other", "qux"))
+	AssertEq(nil, err)
+	ExpectEq("queso", string(contents))
+}
+
+func (t *UnionFSTest) WhiteoutMknod() {
+	err := syscall.Mknod(path.Join(t.Dir, "qux"), syscall.S_IFCHR|0644, 0)
+	ExpectEq(syscall.EPERM, err)
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Transport carries the messages of the fuse protocol between a Connection and
+// whatever plays the part of the kernel. Mount uses the fuse device; others,
+// such as a virtio-fs device (see package virtiofs), let a Server be exposed
+// in other ways with Serve.
+type Transport interface {
+	// Read exactly one request into p, which is large enough for any request
+	// the connection allows, and return its length. Return io.EOF once the
+	// other side has gone away for good.
+	Read(p []byte) (int, error)
+
+	// Send exactly one reply or notification, made up of the concatenation of
+	// the supplied slices, the first of which begins with the
+	// fusekernel.OutHeader. May be called concurrently, including with Read.
+	Writev(bufs [][]byte) error
+
+	// Release the transport. Called once, when all replies have been sent.
+	Close() error
+}
+
+// Implemented by transports that read requests into messages of their own,
+// such as one from each of several goroutines, so that they can be handed to
+// the connection without being copied.
+type messageReader interface {
+	// Return the next request, in a message from buffer.GetInMessage that the
+	// connection then owns. Errors are as for Transport.Read.
+	ReadMessage() (*buffer.InMessage, error)
+}
+
+// Serve serves the fuse protocol over the supplied transport with the supplied
+// server until the transport reports EOF, starting with the INIT handshake.
+// It returns once all ops read have been replied to. The config is used as
+// for Mount, except that the options affecting how the file system is mounted
+// are ignored.
+func Serve(t Transport, server Server, config *MountConfig) error {
+	cfgCopy := *config
+	if cfgCopy.OpContext == nil {
+		cfgCopy.OpContext = context.Background()
+	}
+
+	c, err := newConnection(cfgCopy, config.DebugLogger, config.ErrorLogger, t)
+	if err != nil {
+		return fmt.Errorf("newConnection: %v", err)
+	}
+
+	if config.OnReady != nil {
+		config.OnReady(c.InitOp())
+	}
+
+	server.ServeOps(c)
+	return c.close()
+}
+
+// The Transport for the fuse device, or the socket that stands in for it with
+// fuse-t.
+type deviceTransport struct {
+	f *os.File
+}
+
+func (d *deviceTransport) Read(p []byte) (int, error) {
+	return d.f.Read(p)
+}
+
+func (d *deviceTransport) Writev(bufs [][]byte) error {
+	if len(bufs) == 1 {
+		// Avoid the retry loop in os.File.Write.
+		n, err := syscall.Write(int(d.f.Fd()), bufs[0])
+		if err != nil {
+			return err
+		}
+
+		if n != len(bufs[0]) {
+			return fmt.Errorf("Wrote %d bytes; expected %d", n, len(bufs[0]))
+		}
+
+		return nil
+	}
+
+	if fusekernel.IsPlatformFuseT {
+		// writev is not atomic on macos, restrict to fuse-t platform
+		writeLock.Lock()
+		defer writeLock.Unlock()
+	}
+
+	_, err := writev(int(d.f.Fd()), bufs)
+	return err
+}
+
+func (d *deviceTransport) Close() error {
+	return d.f.Close()
+}
@@ -14,8 +14,101 @@
 
 package fuse
 
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+)
+
 // Unmount attempts to unmount the file system whose mount point is the
 // supplied directory.
 func Unmount(dir string) error {
 	return unmount(dir)
 }
+
+// UnmountLazy detaches the file system whose mount point is the supplied
+// directory even if it is in use, like `fusermount -z` or umount(2) with
+// MNT_DETACH. The mount point disappears at once, and the file system keeps
+// serving ops for files that are still open until they are closed.
+//
+// On macOS, which has no lazy unmount, the unmount is forced instead.
+func UnmountLazy(dir string) error {
+	return unmountLazy(dir)
+}
+
+// BusyRetry is a policy for UnmountWithRetry.
+type BusyRetry struct {
+	// How long to keep retrying an unmount that fails because the file system
+	// is busy. Zero means that only one attempt is made.
+	Timeout time.Duration
+
+	// The delay before the first retry, doubled after each one up to
+	// MaxBackoff. Default 10ms and 1s respectively.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// If the file system is still busy once Timeout has passed, detach it with
+	// UnmountLazy rather than returning the error.
+	FallBackToLazy bool
+}
+
+// UnmountWithRetry unmounts the file system whose mount point is the supplied
+// directory, retrying with backoff for as long as the policy allows while the
+// unmount fails with EBUSY, as it does while files are open or processes have
+// their working directory inside the mount. It gives up early if ctx is done.
+func UnmountWithRetry(ctx context.Context, dir string, p BusyRetry) error {
+	return unmountWithRetry(ctx, dir, p, unmount, unmountLazy)
+}
+
+func unmountWithRetry(
+	ctx context.Context,
+	dir string,
+	p BusyRetry,
+	unmount func(string) error,
+	unmountLazy func(string) error) error {
+	backoff := p.InitialBackoff
+	if backoff <= 0 {
+		backoff = 10 * time.Millisecond
+	}
+
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = time.Second
+	}
+
+	deadline := time.Now().Add(p.Timeout)
+	for {
+		err := unmount(dir)
+		if err == nil || !errors.Is(err, syscall.EBUSY) {
+			return err
+		}
+
+		// Don't sleep past the deadline.
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			if p.FallBackToLazy {
+				return unmountLazy(dir)
+			}
+
+			return err
+		}
+
+		if backoff > remaining {
+			backoff = remaining
+		}
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
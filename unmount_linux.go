@@ -4,18 +4,34 @@ import (
 	"bytes"
 	"fmt"
 	"os/exec"
+	"syscall"
 )
 
 func unmount(dir string) error {
+	return fusermountUnmount(dir, "-u")
+}
+
+func unmountLazy(dir string) error {
+	return fusermountUnmount(dir, "-u", "-z")
+}
+
+func fusermountUnmount(dir string, args ...string) error {
 	fusermount, err := findFusermount()
 	if err != nil {
 		return err
 	}
-	cmd := exec.Command(fusermount, "-u", dir)
+	cmd := exec.Command(fusermount, append(args, dir)...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		if len(output) > 0 {
 			output = bytes.TrimRight(output, "\n")
+
+			// fusermount reports the errno only in its output. Preserve EBUSY so
+			// that callers can tell when retrying might help.
+			if bytes.Contains(output, []byte(syscall.EBUSY.Error())) {
+				return fmt.Errorf("%v: %s: %w", err, output, syscall.EBUSY)
+			}
+
 			return fmt.Errorf("%v: %s", err, output)
 		}
 
@@ -6,6 +6,8 @@ package fuse
 import (
 	"os"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 func unmount(dir string) error {
@@ -15,3 +17,13 @@ func unmount(dir string) error {
 
 	return nil
 }
+
+// There is no lazy unmount outside of Linux; forcing the unmount is the
+// closest equivalent.
+func unmountLazy(dir string) error {
+	if err := syscall.Unmount(dir, unix.MNT_FORCE); err != nil {
+		return &os.PathError{Op: "unmount", Path: dir, Err: err}
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// An unmount function that fails with EBUSY the given number of times.
+type fakeUnmount struct {
+	busy  int
+	calls int
+	lazy  int
+}
+
+func (f *fakeUnmount) unmount(dir string) error {
+	f.calls++
+	if f.calls <= f.busy {
+		return fmt.Errorf("fusermount: %w", syscall.EBUSY)
+	}
+
+	return nil
+}
+
+func (f *fakeUnmount) unmountLazy(dir string) error {
+	f.lazy++
+	return nil
+}
+
+func TestUnmountWithRetry(t *testing.T) {
+	policy := BusyRetry{
+		Timeout:        time.Second,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     2 * time.Millisecond,
+	}
+
+	testCases := []struct {
+		name      string
+		busy      int
+		policy    BusyRetry
+		wantErr   bool
+		wantCalls int
+		wantLazy  int
+	}{
+		{"not busy", 0, policy, false, 1, 0},
+		{"busy then free", 3, policy, false, 4, 0},
+		{"no retries", 1, BusyRetry{}, true, 1, 0},
+		{"lazy fallback", 1000, BusyRetry{
+			Timeout:        20 * time.Millisecond,
+			InitialBackoff: time.Millisecond,
+			FallBackToLazy: true,
+		}, false, -1, 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &fakeUnmount{busy: tc.busy}
+			err := unmountWithRetry(
+				context.Background(),
+				"/mnt",
+				tc.policy,
+				f.unmount,
+				f.unmountLazy)
+
+			if (err != nil) != tc.wantErr {
+				t.Errorf("err: got %v, want error: %v", err, tc.wantErr)
+			}
+
+			if err != nil && !errors.Is(err, syscall.EBUSY) {
+				t.Errorf("err: got %v, want EBUSY", err)
+			}
+
+			if tc.wantCalls >= 0 && f.calls != tc.wantCalls {
+				t.Errorf("calls: got %d, want %d", f.calls, tc.wantCalls)
+			}
+
+			if f.lazy != tc.wantLazy {
+				t.Errorf("lazy calls: got %d, want %d", f.lazy, tc.wantLazy)
+			}
+		})
+	}
+}
+
+func TestUnmountWithRetry_OtherError(t *testing.T) {
+	calls := 0
+	want := errors.New("taco")
+	unmount := func(string) error {
+		calls++
+		return want
+	}
+
+	err := unmountWithRetry(
+		context.Background(),
+		"/mnt",
+		BusyRetry{Timeout: time.Second},
+		unmount,
+		nil)
+
+	if err != want || calls != 1 {
+		t.Errorf("got %v after %d calls; want %v after 1", err, calls, want)
+	}
+}
+
+func TestUnmountWithRetry_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	f := &fakeUnmount{busy: 1000}
+	err := unmountWithRetry(
+		ctx,
+		"/mnt",
+		BusyRetry{Timeout: time.Hour, FallBackToLazy: true},
+		f.unmount,
+		f.unmountLazy)
+
+	if !errors.Is(err, syscall.EBUSY) || f.calls != 1 || f.lazy != 0 {
+		t.Errorf("got %v after %d calls, %d lazy", err, f.calls, f.lazy)
+	}
+}
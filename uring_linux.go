@@ -0,0 +1,536 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/fuse/internal/iouring"
+	"golang.org/x/sys/unix"
+)
+
+const defaultIoUringQueueDepth = 8
+
+// The kernel's smallest payload buffer, FUSE_MIN_READ_BUFFER.
+const minUringPayloadSize = 8192
+
+// Switch to serving requests over io_uring, which the kernel has agreed to.
+// Until every queue is registered the kernel keeps sending requests on the
+// device, which the new transport still reads, so failures are only logged.
+func (c *Connection) startIoUring() {
+	dev, ok := c.transport.(*deviceTransport)
+	if !ok {
+		return
+	}
+
+	depth := c.cfg.IoUringQueueDepth
+	if depth <= 0 {
+		depth = defaultIoUringQueueDepth
+	}
+
+	// The kernel insists on buffers large enough for any request.
+	payloadSize := max(
+		minUringPayloadSize,
+		int(c.initResult.MaxWrite),
+		maxPages*os.Getpagesize())
+
+	t, err := newUringTransport(dev, depth, payloadSize, c.errorLogger)
+	if err != nil {
+		if c.errorLogger != nil {
+			c.errorLogger.Printf("Not serving requests over io_uring: %v", err)
+		}
+
+		return
+	}
+
+	c.transport = t
+}
+
+// A Transport that takes requests from the kernel's io_uring queues, one per
+// possible CPU, as well as from the fuse device, and replies by the same
+// route.
+type uringTransport struct {
+	dev         *deviceTransport
+	errorLogger *log.Logger
+	queues      []*uringQueue
+
+	// Messages read from the device, and buffers for reading them into once
+	// Read is done with them.
+	devReads chan devRead
+	devBufs  chan []byte
+
+	// Ring entries holding requests.
+	requests chan *uringEnt
+
+	// Closed by Close.
+	done chan struct{}
+
+	mu sync.Mutex
+
+	// Ring entries whose requests have been returned by Read, by unique ID.
+	//
+	// GUARDED_BY(mu)
+	pending map[uint64]*uringEnt
+}
+
+type devRead struct {
+	buf []byte
+	n   int
+	err error
+}
+
+// The queue of ring entries for one CPU, with its own io_uring.
+type uringQueue struct {
+	qid  uint16
+	fd   int
+	ring *iouring.Ring
+
+	// Headers, iovecs and payload buffers of the entries.
+	mem  []byte
+	ents []uringEnt
+
+	// Closed when run returns. Nil until it starts.
+	stopped chan struct{}
+
+	// Serializes submissions.
+	mu sync.Mutex
+}
+
+// A ring entry, which holds one request and then its reply.
+type uringEnt struct {
+	q       *uringQueue
+	index   int
+	header  *fusekernel.UringReqHeader
+	iov     *[2]unix.Iovec
+	payload []byte
+}
+
+// The user data of the completion that tells run to return.
+const uringWakeUp = ^uint64(0)
+
+func newUringTransport(
+	dev *deviceTransport,
+	depth int,
+	payloadSize int,
+	errorLogger *log.Logger) (*uringTransport, error) {
+	cpus, err := possibleCPUs()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &uringTransport{
+		dev:         dev,
+		errorLogger: errorLogger,
+		devReads:    make(chan devRead),
+		devBufs:     make(chan []byte, 1),
+		requests:    make(chan *uringEnt),
+		done:        make(chan struct{}),
+		pending:     make(map[uint64]*uringEnt),
+	}
+
+	for qid := 0; qid < cpus; qid++ {
+		q, err := newUringQueue(uint16(qid), int(dev.f.Fd()), depth, payloadSize)
+		if err != nil {
+			t.closeQueues()
+			return nil, fmt.Errorf("Queue %d: %v", qid, err)
+		}
+
+		t.queues = append(t.queues, q)
+	}
+
+	// Hand the entries to the kernel, which starts using them once every queue
+	// has at least one.
+	for _, q := range t.queues {
+		if err := q.register(); err != nil {
+			t.closeQueues()
+			return nil, fmt.Errorf("Queue %d: %v", q.qid, err)
+		}
+	}
+
+	for _, q := range t.queues {
+		q.stopped = make(chan struct{})
+		go q.run(t)
+	}
+
+	t.devBufs <- make([]byte, os.Getpagesize()+payloadSize)
+	go t.readDevice()
+
+	return t, nil
+}
+
+// The number of CPUs the kernel may have, and so the number of queues it
+// expects.
+func possibleCPUs() (int, error) {
+	b, err := os.ReadFile("/sys/devices/system/cpu/possible")
+	if err != nil {
+		return 0, err
+	}
+
+	return parseCPUList(strings.TrimSpace(string(b)))
+}
+
+// Return one more than the highest CPU in a list such as "0-3,8".
+func parseCPUList(s string) (int, error) {
+	n := 0
+	for _, r := range strings.Split(s, ",") {
+		_, last, _ := strings.Cut(r, "-")
+		if last == "" {
+			last = r
+		}
+
+		cpu, err := strconv.Atoi(last)
+		if err != nil {
+			return 0, fmt.Errorf("Malformed CPU list %q", s)
+		}
+
+		n = max(n, cpu+1)
+	}
+
+	return n, nil
+}
+
+func newUringQueue(
+	qid uint16,
+	fd int,
+	depth int,
+	payloadSize int) (*uringQueue, error) {
+	// Room for each entry's registration or commit, and a wake-up.
+	ring, err := iouring.New(uint32(depth + 1))
+	if err != nil {
+		return nil, err
+	}
+
+	// Each entry's header and iovecs go in a slot at the start, and its payload
+	// after them, page aligned. The kernel may write to them as long as the
+	// entries are registered, so they're mapped rather than on the Go heap, and
+	// unmapped only after the ring is closed.
+	const slotSize = 512
+	pageSize := os.Getpagesize()
+	headers := (depth*slotSize + pageSize - 1) &^ (pageSize - 1)
+
+	mem, err := unix.Mmap(
+		-1,
+		0,
+		headers+depth*payloadSize,
+		unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		ring.Close()
+		return nil, fmt.Errorf("Mmap: %v", err)
+	}
+
+	q := &uringQueue{
+		qid:  qid,
+		fd:   fd,
+		ring: ring,
+		mem:  mem,
+		ents: make([]uringEnt, depth),
+	}
+
+	for i := range q.ents {
+		slot := mem[i*slotSize:]
+		payload := mem[headers+i*payloadSize : headers+(i+1)*payloadSize]
+
+		e := &q.ents[i]
+		e.q = q
+		e.index = i
+		e.header = (*fusekernel.UringReqHeader)(unsafe.Pointer(&slot[0]))
+		e.iov = (*[2]unix.Iovec)(unsafe.Pointer(&slot[384]))
+		e.payload = payload
+
+		e.iov[0].Base = &slot[0]
+		e.iov[0].SetLen(int(unsafe.Sizeof(fusekernel.UringReqHeader{})))
+		e.iov[1].Base = &payload[0]
+		e.iov[1].SetLen(payloadSize)
+	}
+
+	return q, nil
+}
+
+// Return a submission for the supplied command on the supplied entry.
+func (q *uringQueue) sqe(cmd uint32, e *uringEnt) iouring.SQE {
+	s := iouring.SQE{
+		Opcode:   iouring.OpUringCmd,
+		Fd:       int32(q.fd),
+		CmdOp:    cmd,
+		UserData: uint64(e.index),
+	}
+
+	req := (*fusekernel.UringCmdReq)(unsafe.Pointer(&s.Cmd[0]))
+	req.Qid = q.qid
+
+	if cmd == fusekernel.UringCmdRegister {
+		s.Addr = uint64(uintptr(unsafe.Pointer(e.iov)))
+		s.Len = uint32(len(e.iov))
+	} else {
+		req.CommitID = e.header.RingEntInOut.CommitID
+	}
+
+	return s
+}
+
+// Hand all of the entries to the kernel.
+func (q *uringQueue) register() error {
+	var sqes []iouring.SQE
+	for i := range q.ents {
+		sqes = append(sqes, q.sqe(fusekernel.UringCmdRegister, &q.ents[i]))
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.ring.Submit(sqes...)
+}
+
+// Send the reply made up of the concatenation of bufs from the supplied
+// entry, and hand it back to the kernel for the next request.
+func (q *uringQueue) commit(e *uringEnt, bufs [][]byte) error {
+	n, err := gatherUringReply(e.header, e.payload, bufs)
+	if err != nil {
+		// Don't leave the kernel waiting.
+		out := (*fusekernel.OutHeader)(unsafe.Pointer(&e.header.InOut[0]))
+		out.Len = uint32(unsafe.Sizeof(fusekernel.OutHeader{}))
+		out.Error = -int32(syscall.EIO)
+		n = 0
+	}
+
+	e.header.RingEntInOut.PayloadSz = uint32(n)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if serr := q.ring.Submit(q.sqe(fusekernel.UringCmdCommitAndFetch, e)); serr != nil {
+		return serr
+	}
+
+	return err
+}
+
+// Split a reply into the OutHeader, which goes in the ring entry's header, and
+// the rest, which goes in its payload buffer. Return the length of the rest.
+func gatherUringReply(
+	header *fusekernel.UringReqHeader,
+	payload []byte,
+	bufs [][]byte) (int, error) {
+	outSize := int(unsafe.Sizeof(fusekernel.OutHeader{}))
+
+	h, n := 0, 0
+	for _, b := range bufs {
+		if h < outSize {
+			c := copy(header.InOut[h:outSize], b)
+			h += c
+			b = b[c:]
+		}
+
+		if len(b) > len(payload)-n {
+			return 0, fmt.Errorf("Reply too large for buffer of %d bytes", len(payload))
+		}
+
+		n += copy(payload[n:], b)
+	}
+
+	if h < outSize {
+		return 0, fmt.Errorf("Short reply: %d bytes", h)
+	}
+
+	return n, nil
+}
+
+// Copy the request in a ring entry into p, in the form it takes when read
+// from the device: the InHeader, then the first argument, then the rest.
+func scatterUringRequest(
+	p []byte,
+	header *fusekernel.UringReqHeader,
+	payload []byte) (int, error) {
+	in := (*fusekernel.InHeader)(unsafe.Pointer(&header.InOut[0]))
+	payloadLen := int(header.RingEntInOut.PayloadSz)
+	argLen := int(in.Len) - fusekernel.InHeaderSize - payloadLen
+
+	if argLen < 0 ||
+		argLen > len(header.OpIn) ||
+		payloadLen > len(payload) ||
+		int(in.Len) > len(p) {
+		return 0, fmt.Errorf(
+			"Malformed request: length %d, payload %d",
+			in.Len,
+			payloadLen)
+	}
+
+	n := copy(p, header.InOut[:fusekernel.InHeaderSize])
+	n += copy(p[n:], header.OpIn[:argLen])
+	n += copy(p[n:], payload[:payloadLen])
+
+	return n, nil
+}
+
+// Pass on entries as the kernel fills them with requests, until Close or
+// until the kernel has given up on all of them, as it does on unmount.
+func (q *uringQueue) run(t *uringTransport) {
+	defer close(q.stopped)
+
+	cqes := make([]iouring.CQE, len(q.ents)+1)
+	for live := len(q.ents); live > 0; {
+		n, err := q.ring.Wait(cqes)
+		if err != nil {
+			t.logError("Queue %d: %v", q.qid, err)
+			return
+		}
+
+		for _, cqe := range cqes[:n] {
+			if cqe.UserData == uringWakeUp {
+				return
+			}
+
+			// Anything but zero means the kernel is done with the entry.
+			if cqe.Res != 0 {
+				live--
+				switch errno := syscall.Errno(-cqe.Res); {
+				case cqe.Res > 0:
+					t.logError("Queue %d, entry %d: result %d", q.qid, cqe.UserData, cqe.Res)
+
+				case errno != syscall.ENOTCONN && errno != syscall.ECANCELED:
+					t.logError("Queue %d, entry %d: %v", q.qid, cqe.UserData, errno)
+				}
+
+				continue
+			}
+
+			select {
+			case t.requests <- &q.ents[cqe.UserData]:
+			case <-t.done:
+				return
+			}
+		}
+	}
+}
+
+func (t *uringTransport) logError(format string, v ...interface{}) {
+	if t.errorLogger != nil {
+		t.errorLogger.Printf(format, v...)
+	}
+}
+
+// Read the device until it fails, as it does on unmount, or Close.
+func (t *uringTransport) readDevice() {
+	for {
+		var buf []byte
+		select {
+		case buf = <-t.devBufs:
+		case <-t.done:
+			return
+		}
+
+		n, err := t.dev.Read(buf)
+		select {
+		case t.devReads <- devRead{buf, n, err}:
+		case <-t.done:
+			return
+		}
+
+		if pe, ok := err.(*os.PathError); err != nil && !(ok && pe.Err == syscall.EINTR) {
+			return
+		}
+	}
+}
+
+func (t *uringTransport) Read(p []byte) (int, error) {
+	for {
+		select {
+		case r := <-t.devReads:
+			n := copy(p, r.buf[:r.n])
+			t.devBufs <- r.buf
+			return n, r.err
+
+		case e := <-t.requests:
+			n, err := scatterUringRequest(p, e.header, e.payload)
+			unique := (*fusekernel.InHeader)(unsafe.Pointer(&e.header.InOut[0])).Unique
+			if err != nil {
+				t.logError("Queue %d: %v", e.q.qid, err)
+				if err := e.q.commit(e, nil); err != nil {
+					t.logError("Queue %d: %v", e.q.qid, err)
+				}
+
+				continue
+			}
+
+			t.mu.Lock()
+			t.pending[unique] = e
+			t.mu.Unlock()
+
+			return n, nil
+		}
+	}
+}
+
+func (t *uringTransport) Writev(bufs [][]byte) error {
+	if len(bufs) == 0 || len(bufs[0]) < int(unsafe.Sizeof(fusekernel.OutHeader{})) {
+		return fmt.Errorf("Short reply")
+	}
+
+	unique := (*fusekernel.OutHeader)(unsafe.Pointer(&bufs[0][0])).Unique
+
+	t.mu.Lock()
+	e := t.pending[unique]
+	delete(t.pending, unique)
+	t.mu.Unlock()
+
+	// Notifications, and replies to requests read from the device, go back
+	// that way.
+	if e == nil {
+		return t.dev.Writev(bufs)
+	}
+
+	return e.q.commit(e, bufs)
+}
+
+func (t *uringTransport) Close() error {
+	close(t.done)
+	t.closeQueues()
+	return t.dev.Close()
+}
+
+// Stop and release the queues. Closing a ring cancels its entries' commands,
+// after which the kernel no longer touches their buffers.
+func (t *uringTransport) closeQueues() {
+	for _, q := range t.queues {
+		if q.stopped != nil {
+			// Wake run up, if it's still waiting for completions.
+			q.mu.Lock()
+			err := q.ring.Submit(iouring.SQE{Opcode: iouring.OpNop, UserData: uringWakeUp})
+			q.mu.Unlock()
+
+			if err != nil {
+				// Leak the queue rather than pull its memory out from under run.
+				t.logError("Queue %d: %v", q.qid, err)
+				continue
+			}
+
+			<-q.stopped
+		}
+
+		q.ring.Close()
+		unix.Munmap(q.mem)
+	}
+
+	t.queues = nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestParseCPUList(t *testing.T) {
+	testCases := []struct {
+		s    string
+		want int
+	}{
+		{"0", 1},
+		{"0-3", 4},
+		{"0-3,8", 9},
+		{"0,2-5", 6},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseCPUList(tc.s)
+		if err != nil || got != tc.want {
+			t.Errorf("parseCPUList(%q) = %d, %v; want %d", tc.s, got, err, tc.want)
+		}
+	}
+
+	if _, err := parseCPUList("0-x"); err == nil {
+		t.Errorf("parseCPUList(\"0-x\") succeeded")
+	}
+}
+
+func TestScatterUringRequest(t *testing.T) {
+	// A write: the WriteIn goes in OpIn, the data in the payload.
+	var header fusekernel.UringReqHeader
+	arg := bytes.Repeat([]byte{'a'}, int(unsafe.Sizeof(fusekernel.WriteIn{})))
+	data := []byte("taco")
+
+	in := (*fusekernel.InHeader)(unsafe.Pointer(&header.InOut[0]))
+	in.Len = uint32(fusekernel.InHeaderSize + len(arg) + len(data))
+	in.Opcode = fusekernel.OpWrite
+	in.Unique = 17
+	copy(header.OpIn[:], arg)
+	header.RingEntInOut.PayloadSz = uint32(len(data))
+
+	payload := make([]byte, 4096)
+	copy(payload, data)
+
+	p := make([]byte, 8192)
+	n, err := scatterUringRequest(p, &header, payload)
+	if err != nil {
+		t.Fatalf("scatterUringRequest: %v", err)
+	}
+
+	want := append(append(append([]byte{}, header.InOut[:fusekernel.InHeaderSize]...), arg...), data...)
+	if !bytes.Equal(p[:n], want) {
+		t.Errorf("Got %q, want %q", p[:n], want)
+	}
+
+	// A length the pieces can't add up to.
+	in.Len = uint32(fusekernel.InHeaderSize + len(header.OpIn) + 1 + len(data))
+	if _, err := scatterUringRequest(p, &header, payload); err == nil {
+		t.Errorf("Malformed request accepted")
+	}
+}
+
+func TestGatherUringReply(t *testing.T) {
+	out := fusekernel.OutHeader{Len: 24, Unique: 17}
+	outBytes := (*[unsafe.Sizeof(fusekernel.OutHeader{})]byte)(unsafe.Pointer(&out))[:]
+
+	var header fusekernel.UringReqHeader
+	payload := make([]byte, 8)
+
+	// The header split across buffers, as by a read reply.
+	bufs := [][]byte{outBytes[:10], append(outBytes[10:], "taco"...), []byte("cola")}
+	n, err := gatherUringReply(&header, payload, bufs)
+	if err != nil {
+		t.Fatalf("gatherUringReply: %v", err)
+	}
+
+	if !bytes.Equal(header.InOut[:len(outBytes)], outBytes) {
+		t.Errorf("Got header %v, want %v", header.InOut[:len(outBytes)], outBytes)
+	}
+
+	if string(payload[:n]) != "tacocola" {
+		t.Errorf("Got payload %q", payload[:n])
+	}
+
+	// Too large for the payload buffer.
+	bufs = append(bufs, []byte("!"))
+	if _, err := gatherUringReply(&header, payload, bufs); err == nil {
+		t.Errorf("Oversized reply accepted")
+	}
+}
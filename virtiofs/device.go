@@ -0,0 +1,469 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package virtiofs exposes fuse file systems to virtual machines as virtio-fs
+// devices, by speaking the vhost-user protocol to a virtual machine monitor
+// such as QEMU. Any fuse.Server, such as one created with
+// fuseutil.NewFileSystemServer, can be served this way unchanged:
+//
+//	err := virtiofs.Serve("/tmp/vhostfs.sock", server, &fuse.MountConfig{})
+//
+// and then, for QEMU (whose guest memory must be shared, e.g. memfd-backed):
+//
+//	qemu-system-x86_64 \
+//	    -chardev socket,id=char0,path=/tmp/vhostfs.sock \
+//	    -device vhost-user-fs-pci,chardev=char0,tag=myfs \
+//	    -object memory-backend-memfd,id=mem,size=4G,share=on \
+//	    -numa node,memdev=mem ...
+//
+// after which the guest can mount the file system with
+// `mount -t virtiofs myfs /mnt`.
+//
+// Linux only. Notifications to the guest, such as
+// fuse.Connection.InvalidateInode, are not supported, and neither is DAX.
+package virtiofs
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// Serve listens on a unix domain socket at the supplied path for a virtual
+// machine monitor to connect, then serves the file system to its guest with
+// the supplied server until the guest unmounts it or the monitor disconnects.
+// The config is used as for fuse.Serve. The socket is removed when Serve
+// returns.
+func Serve(path string, server fuse.Server, config *fuse.MountConfig) error {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("ListenUnix: %v", err)
+	}
+
+	c, err := l.AcceptUnix()
+	l.Close()
+	if err != nil {
+		return fmt.Errorf("AcceptUnix: %v", err)
+	}
+
+	return fuse.Serve(NewDevice(c, 1), server, config)
+}
+
+// Device is a virtio-fs device served over a vhost-user connection, and a
+// fuse.Transport carrying the fuse requests of the guest's driver. The
+// frontend (the virtual machine monitor) gives it access to the guest's
+// memory and to its virtqueues, one high priority queue, for forgets, and
+// one or more request queues.
+//
+// Read returns io.EOF once the guest unmounts the file system or the frontend
+// disconnects. The guest can mount the file system once per Device.
+type Device struct {
+	conn *net.UnixConn
+
+	// The number of queues we offer: the high priority queue and the request
+	// queues.
+	numQueues int
+
+	// Requests popped from the queues, waiting for Read.
+	requests chan *request
+
+	// Closed by shutDown, after which Read returns io.EOF.
+	done     chan struct{}
+	shutDown func()
+
+	// Closed when serveFrontend returns.
+	frontendDone chan struct{}
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	protocolFeatures uint64
+
+	// The current guest memory, and those it replaced, which in-flight
+	// requests may still refer to. All are unmapped by Close.
+	//
+	// GUARDED_BY(mu)
+	mem    memoryTable
+	oldMem []memoryTable
+
+	// GUARDED_BY(mu)
+	queues []*virtqueue
+
+	pendingMu sync.Mutex
+
+	// Requests returned by Read that are awaiting replies, by unique ID.
+	//
+	// GUARDED_BY(pendingMu)
+	pending map[uint64]*request
+}
+
+var _ fuse.Transport = &Device{}
+
+// NewDevice returns a device with the supplied number of request queues,
+// serving the vhost-user protocol on c, a connection from the frontend.
+// The device takes ownership of c.
+func NewDevice(c *net.UnixConn, requestQueues int) *Device {
+	d := &Device{
+		conn:         c,
+		numQueues:    1 + requestQueues,
+		requests:     make(chan *request),
+		done:         make(chan struct{}),
+		frontendDone: make(chan struct{}),
+		pending:      make(map[uint64]*request),
+	}
+
+	var once sync.Once
+	d.shutDown = func() { once.Do(func() { close(d.done) }) }
+
+	for i := 0; i < d.numQueues; i++ {
+		d.queues = append(d.queues, &virtqueue{index: i, call: -1})
+	}
+
+	go d.serveFrontend()
+	return d
+}
+
+// Read returns the next request from the guest. See fuse.Transport.
+func (d *Device) Read(p []byte) (int, error) {
+	for {
+		var r *request
+		select {
+		case r = <-d.requests:
+		case <-d.done:
+			return 0, io.EOF
+		}
+
+		n, err := r.copyIn(p)
+		if err != nil || n < fusekernel.InHeaderSize {
+			// There's no telling what the driver wants, so give the buffers back.
+			r.q.complete(r.head, 0)
+			continue
+		}
+
+		hdr := (*fusekernel.InHeader)(unsafe.Pointer(&p[0]))
+		switch {
+		case len(r.out) == 0:
+			// No reply is expected, as for forgets.
+			r.q.complete(r.head, 0)
+
+		case hdr.Opcode == fusekernel.OpDestroy:
+			// The guest has unmounted the file system, which leaves nothing more
+			// to do once the server has finished with the ops in flight.
+			d.replyEmpty(r, hdr.Unique)
+			d.shutDown()
+			return 0, io.EOF
+
+		default:
+			d.pendingMu.Lock()
+			d.pending[hdr.Unique] = r
+			d.pendingMu.Unlock()
+		}
+
+		return n, nil
+	}
+}
+
+// Writev sends a reply to a request returned by Read. See fuse.Transport.
+func (d *Device) Writev(bufs [][]byte) error {
+	if len(bufs) == 0 || len(bufs[0]) < int(unsafe.Sizeof(fusekernel.OutHeader{})) {
+		return fmt.Errorf("Short reply")
+	}
+
+	hdr := (*fusekernel.OutHeader)(unsafe.Pointer(&bufs[0][0]))
+	if hdr.Unique == 0 {
+		// Notifications need a notification queue, which Linux guests don't
+		// support.
+		return syscall.ENOTSUP
+	}
+
+	d.pendingMu.Lock()
+	r := d.pending[hdr.Unique]
+	delete(d.pending, hdr.Unique)
+	d.pendingMu.Unlock()
+
+	if r == nil {
+		return fmt.Errorf("Reply to unknown request %d", hdr.Unique)
+	}
+
+	n, err := r.copyOut(bufs)
+	if err != nil {
+		// Tell the guest rather than leave it waiting.
+		d.replyError(r, hdr.Unique, syscall.EIO)
+		return err
+	}
+
+	r.q.complete(r.head, n)
+	return nil
+}
+
+// Reply to r with the supplied error.
+func (d *Device) replyError(r *request, unique uint64, errno syscall.Errno) {
+	h := fusekernel.OutHeader{
+		Len:    uint32(unsafe.Sizeof(fusekernel.OutHeader{})),
+		Error:  -int32(errno),
+		Unique: unique,
+	}
+
+	b := (*[unsafe.Sizeof(fusekernel.OutHeader{})]byte)(unsafe.Pointer(&h))[:]
+	n, _ := r.copyOut([][]byte{b})
+	r.q.complete(r.head, n)
+}
+
+// Reply to r with success and no body.
+func (d *Device) replyEmpty(r *request, unique uint64) {
+	d.replyError(r, unique, 0)
+}
+
+// Close stops the queues and releases the guest's memory and the connection
+// to the frontend. See fuse.Transport.
+func (d *Device) Close() error {
+	d.shutDown()
+	err := d.conn.Close()
+	<-d.frontendDone
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, q := range d.queues {
+		q.stop()
+	}
+
+	d.mem.unmap()
+	for _, t := range d.oldMem {
+		t.unmap()
+	}
+
+	d.mem = nil
+	d.oldMem = nil
+
+	return err
+}
+
+// Handle messages from the frontend until it hangs up or breaks the protocol,
+// then shut down.
+func (d *Device) serveFrontend() {
+	defer close(d.frontendDone)
+	defer d.shutDown()
+
+	for {
+		m, err := readMessage(d.conn)
+		if err != nil {
+			return
+		}
+
+		reply, err := d.handle(m)
+		if err == nil && reply == nil && m.hdr.Flags&flagNeedReply != 0 {
+			reply = u64(0)
+		}
+
+		if err != nil {
+			if m.hdr.Flags&flagNeedReply != 0 {
+				writeReply(d.conn, m, u64(1))
+			}
+
+			return
+		}
+
+		if reply != nil {
+			if err := writeReply(d.conn, m, reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Handle a message from the frontend, returning the payload of the reply if
+// it calls for one.
+//
+// LOCKS_EXCLUDED(d.mu)
+func (d *Device) handle(m *vhostMessage) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch m.hdr.Request {
+	case reqGetFeatures:
+		return u64(featureVersion1 | featureProtocolFeatures), nil
+
+	case reqSetFeatures, reqSetOwner, reqResetOwner:
+		return nil, nil
+
+	case reqGetProtocolFeatures:
+		return u64(protocolFeatureMQ | protocolFeatureReplyAck), nil
+
+	case reqSetProtocolFeatures:
+		v, err := payloadAs[uint64](m)
+		if err != nil {
+			return nil, err
+		}
+
+		d.protocolFeatures = *v
+		return nil, nil
+
+	case reqGetQueueNum:
+		return u64(uint64(d.numQueues)), nil
+
+	case reqSetMemTable:
+		t, err := mapMemory(m)
+		if err != nil {
+			return nil, err
+		}
+
+		if d.mem != nil {
+			d.oldMem = append(d.oldMem, d.mem)
+		}
+
+		d.mem = t
+		return nil, nil
+
+	case reqSetVringNum, reqSetVringBase, reqSetVringEnable:
+		s, err := payloadAs[vringState](m)
+		if err != nil {
+			return nil, err
+		}
+
+		q, err := d.queue(s.Index)
+		if err != nil {
+			return nil, err
+		}
+
+		switch m.hdr.Request {
+		case reqSetVringNum:
+			q.size = uint16(s.Num)
+
+		case reqSetVringBase:
+			q.base = uint16(s.Num)
+
+		case reqSetVringEnable:
+			q.enabled = s.Num == 1
+			return nil, d.maybeStart(q)
+		}
+
+		return nil, nil
+
+	case reqSetVringAddr:
+		a, err := payloadAs[vringAddr](m)
+		if err != nil {
+			return nil, err
+		}
+
+		q, err := d.queue(a.Index)
+		if err != nil {
+			return nil, err
+		}
+
+		q.addr = *a
+		return nil, nil
+
+	case reqGetVringBase:
+		s, err := payloadAs[vringState](m)
+		if err != nil {
+			return nil, err
+		}
+
+		q, err := d.queue(s.Index)
+		if err != nil {
+			return nil, err
+		}
+
+		reply := vringState{Index: s.Index, Num: uint32(q.stop())}
+		return (*[8]byte)(unsafe.Pointer(&reply))[:], nil
+
+	case reqSetVringKick, reqSetVringCall, reqSetVringErr:
+		v, err := payloadAs[uint64](m)
+		if err != nil {
+			closeFDs(m.fds)
+			return nil, err
+		}
+
+		if *v&vringNoFD != 0 || len(m.fds) != 1 {
+			// We don't support polling the rings.
+			closeFDs(m.fds)
+			return nil, fmt.Errorf("Request %d: no file descriptor", m.hdr.Request)
+		}
+
+		q, err := d.queue(uint32(*v & 0xff))
+		if err != nil {
+			closeFDs(m.fds)
+			return nil, err
+		}
+
+		fd := m.fds[0]
+		switch m.hdr.Request {
+		case reqSetVringKick:
+			return nil, d.setKick(q, fd)
+
+		case reqSetVringCall:
+			q.setCall(fd)
+
+		case reqSetVringErr:
+			// We never report errors this way.
+			unix.Close(fd)
+		}
+
+		return nil, nil
+
+	default:
+		closeFDs(m.fds)
+		return nil, fmt.Errorf("Unsupported request %d", m.hdr.Request)
+	}
+}
+
+// LOCKS_REQUIRED(d.mu)
+func (d *Device) queue(index uint32) (*virtqueue, error) {
+	if index >= uint32(len(d.queues)) {
+		return nil, fmt.Errorf("No queue %d", index)
+	}
+
+	return d.queues[index], nil
+}
+
+// Receiving the kick eventfd starts the queue, once it's enabled.
+//
+// LOCKS_REQUIRED(d.mu)
+func (d *Device) setKick(q *virtqueue, fd int) error {
+	if q.started() {
+		q.stop()
+	}
+
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("SetNonblock: %v", err)
+	}
+
+	q.kick = os.NewFile(uintptr(fd), fmt.Sprintf("kick%d", q.index))
+
+	// Without VHOST_USER_F_PROTOCOL_FEATURES, queues start out enabled.
+	if d.protocolFeatures == 0 {
+		q.enabled = true
+	}
+
+	return d.maybeStart(q)
+}
+
+// LOCKS_REQUIRED(d.mu)
+func (d *Device) maybeStart(q *virtqueue) error {
+	if q.started() || !q.enabled || q.kick == nil {
+		return nil
+	}
+
+	return q.start(d.mem, d.requests, d.done)
+}
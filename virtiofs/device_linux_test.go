@@ -0,0 +1,314 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package virtiofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// The layout of the fake guest's memory, which begins at guest address zero
+// and at userBase in the fake frontend's address space.
+const (
+	memSize   = 1 << 20
+	userBase  = 0x7f0000000000
+	queueSize = 8
+	descAddr  = 0x0
+	availAddr = 0x1000
+	usedAddr  = 0x2000
+	inAddr    = 0x10000
+	outAddr   = 0x20000
+	outSize   = 0x10000
+)
+
+// An in-process stand-in for a virtual machine monitor and the guest's
+// driver, using request queue 1 only.
+type fakeFrontend struct {
+	t    *testing.T
+	sock int
+	mem  []byte
+	kick int
+	call int
+
+	availIdx uint16
+	usedIdx  uint16
+}
+
+func wire(t *testing.T, v any) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+		t.Fatalf("binary.Write: %v", err)
+	}
+
+	return b.Bytes()
+}
+
+func eventfd(t *testing.T) int {
+	t.Helper()
+
+	fd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		t.Fatalf("Eventfd: %v", err)
+	}
+
+	return fd
+}
+
+// Send a message with the supplied payload and file descriptors.
+func (f *fakeFrontend) send(req uint32, flags uint32, payload []byte, fds ...int) {
+	f.t.Helper()
+
+	hdr := vhostHeader{Request: req, Flags: flagVersion | flags, Size: uint32(len(payload))}
+	msg := append(wire(f.t, hdr), payload...)
+
+	var oob []byte
+	if len(fds) > 0 {
+		oob = unix.UnixRights(fds...)
+	}
+
+	if err := unix.Sendmsg(f.sock, msg, oob, nil, 0); err != nil {
+		f.t.Fatalf("Sendmsg: %v", err)
+	}
+}
+
+// Read a reply to the supplied request, returning its payload.
+func (f *fakeFrontend) reply(req uint32) []byte {
+	f.t.Helper()
+
+	buf := make([]byte, vhostHeaderSize+maxPayload)
+	n, err := unix.Read(f.sock, buf)
+	if err != nil {
+		f.t.Fatalf("Read: %v", err)
+	}
+
+	if n < vhostHeaderSize {
+		f.t.Fatalf("Short reply: %d bytes", n)
+	}
+
+	hdr := (*vhostHeader)(unsafe.Pointer(&buf[0]))
+	if hdr.Request != req || hdr.Flags&flagReply == 0 {
+		f.t.Fatalf("Unexpected reply header: %+v", *hdr)
+	}
+
+	return buf[vhostHeaderSize:n]
+}
+
+// Set up the device as QEMU would for a vhost-user-fs-pci device.
+func (f *fakeFrontend) negotiate(memfd int) {
+	f.t.Helper()
+
+	f.send(reqGetFeatures, 0, nil)
+	features := binary.LittleEndian.Uint64(f.reply(reqGetFeatures))
+	if features&featureProtocolFeatures == 0 {
+		f.t.Fatalf("Protocol features not offered: %#x", features)
+	}
+
+	f.send(reqSetFeatures, 0, u64(featureVersion1|featureProtocolFeatures))
+
+	f.send(reqGetProtocolFeatures, 0, nil)
+	protocolFeatures := binary.LittleEndian.Uint64(f.reply(reqGetProtocolFeatures))
+	f.send(reqSetProtocolFeatures, 0, u64(protocolFeatures))
+
+	f.send(reqGetQueueNum, 0, nil)
+	if n := binary.LittleEndian.Uint64(f.reply(reqGetQueueNum)); n != 2 {
+		f.t.Fatalf("Got %d queues; expected 2", n)
+	}
+
+	f.send(reqSetOwner, 0, nil)
+
+	// Ask for an ack, so that we know the memory is mapped.
+	table := append(
+		wire(f.t, memoryHeader{Regions: 1}),
+		wire(f.t, memoryRegionDesc{Size: memSize, UserAddr: userBase})...)
+	f.send(reqSetMemTable, flagNeedReply, table, memfd)
+	if ack := binary.LittleEndian.Uint64(f.reply(reqSetMemTable)); ack != 0 {
+		f.t.Fatalf("SET_MEM_TABLE failed: %d", ack)
+	}
+
+	f.send(reqSetVringNum, 0, wire(f.t, vringState{Index: 1, Num: queueSize}))
+	f.send(reqSetVringBase, 0, wire(f.t, vringState{Index: 1}))
+	f.send(reqSetVringAddr, 0, wire(f.t, vringAddr{
+		Index: 1,
+		Desc:  userBase + descAddr,
+		Used:  userBase + usedAddr,
+		Avail: userBase + availAddr,
+	}))
+
+	f.send(reqSetVringCall, 0, u64(1), f.call)
+	f.send(reqSetVringKick, 0, u64(1), f.kick)
+
+	f.send(reqSetVringEnable, flagNeedReply, wire(f.t, vringState{Index: 1, Num: 1}))
+	if ack := binary.LittleEndian.Uint64(f.reply(reqSetVringEnable)); ack != 0 {
+		f.t.Fatalf("SET_VRING_ENABLE failed: %d", ack)
+	}
+}
+
+// Post a fuse request to the queue, wait for the device to finish with it,
+// and return what it wrote back.
+func (f *fakeFrontend) roundTrip(
+	opcode uint32,
+	unique uint64,
+	pieces ...[]byte) []byte {
+	f.t.Helper()
+
+	var body []byte
+	for _, p := range pieces {
+		body = append(body, p...)
+	}
+
+	hdr := fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + len(body)),
+		Opcode: opcode,
+		Unique: unique,
+		Nodeid: fuseops.RootInodeID,
+	}
+
+	msg := append(wire(f.t, hdr), body...)
+	copy(f.mem[inAddr:], msg)
+
+	desc := unsafe.Slice((*virtqDesc)(unsafe.Pointer(&f.mem[descAddr])), queueSize)
+	desc[0] = virtqDesc{Addr: inAddr, Len: uint32(len(msg)), Flags: descFlagNext, Next: 1}
+	desc[1] = virtqDesc{Addr: outAddr, Len: outSize, Flags: descFlagWrite}
+
+	availRing := unsafe.Slice((*uint16)(unsafe.Pointer(&f.mem[availAddr+4])), queueSize)
+	availRing[f.availIdx%queueSize] = 0
+	f.availIdx++
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&f.mem[availAddr])), uint32(f.availIdx)<<16)
+
+	if _, err := unix.Write(f.kick, u64(1)); err != nil {
+		f.t.Fatalf("Write: %v", err)
+	}
+
+	// Wait to be told about the used buffers.
+	buf := make([]byte, 8)
+	for {
+		idx := uint16(atomic.LoadUint32((*uint32)(unsafe.Pointer(&f.mem[usedAddr]))) >> 16)
+		if idx != f.usedIdx {
+			break
+		}
+
+		if _, err := unix.Read(f.call, buf); err != nil {
+			f.t.Fatalf("Read: %v", err)
+		}
+	}
+
+	used := (*usedElem)(unsafe.Pointer(&f.mem[usedAddr+4+8*uint32(f.usedIdx%queueSize)]))
+	f.usedIdx++
+
+	if used.ID != 0 {
+		f.t.Fatalf("Got used chain %d; expected 0", used.ID)
+	}
+
+	return f.mem[outAddr : outAddr+used.Len]
+}
+
+func TestDevice(t *testing.T) {
+	memfd, err := unix.MemfdCreate("guest", unix.MFD_CLOEXEC)
+	if err != nil {
+		t.Skipf("MemfdCreate: %v", err)
+	}
+
+	defer unix.Close(memfd)
+
+	if err := unix.Ftruncate(memfd, memSize); err != nil {
+		t.Fatalf("Ftruncate: %v", err)
+	}
+
+	mem, err := unix.Mmap(memfd, 0, memSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		t.Fatalf("Mmap: %v", err)
+	}
+
+	defer unix.Munmap(mem)
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	backend := os.NewFile(uintptr(fds[1]), "backend")
+	conn, err := net.FileConn(backend)
+	backend.Close()
+	if err != nil {
+		t.Fatalf("FileConn: %v", err)
+	}
+
+	f := &fakeFrontend{
+		t:    t,
+		sock: fds[0],
+		mem:  mem,
+		kick: eventfd(t),
+		call: eventfd(t),
+	}
+
+	defer unix.Close(f.kick)
+	defer unix.Close(f.call)
+
+	// Serve a file system that implements nothing.
+	server := fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{})
+	served := make(chan error, 1)
+	go func() {
+		served <- fuse.Serve(NewDevice(conn.(*net.UnixConn), 1), server, &fuse.MountConfig{})
+	}()
+
+	f.negotiate(memfd)
+
+	// INIT
+	reply := f.roundTrip(
+		fusekernel.OpInit,
+		1,
+		wire(t, fusekernel.InitIn{Major: 7, Minor: 31, MaxReadahead: 1 << 17}))
+
+	var outHdr fusekernel.OutHeader
+	var initOut fusekernel.InitOut
+	r := bytes.NewReader(reply)
+	binary.Read(r, binary.LittleEndian, &outHdr)
+	binary.Read(r, binary.LittleEndian, &initOut)
+
+	if outHdr.Unique != 1 || outHdr.Error != 0 || int(outHdr.Len) != len(reply) {
+		t.Fatalf("Unexpected INIT reply header: %+v (%d bytes)", outHdr, len(reply))
+	}
+
+	if initOut.Major != 7 || initOut.Minor != 31 {
+		t.Errorf("Got protocol %d.%d; expected 7.31", initOut.Major, initOut.Minor)
+	}
+
+	// GETATTR, which the file system doesn't implement.
+	reply = f.roundTrip(fusekernel.OpGetattr, 2, wire(t, fusekernel.GetattrIn{}))
+	binary.Read(bytes.NewReader(reply), binary.LittleEndian, &outHdr)
+	if outHdr.Unique != 2 || outHdr.Error != -int32(syscall.ENOSYS) {
+		t.Errorf("Unexpected GETATTR reply header: %+v", outHdr)
+	}
+
+	// Hanging up ends the session.
+	unix.Close(f.sock)
+	if err := <-served; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package virtiofs
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// A region of guest memory, shared with us by the frontend.
+type memoryRegion struct {
+	// Where the region is in guest physical memory and in the frontend's
+	// address space.
+	guestAddr uint64
+	userAddr  uint64
+
+	// The region, within mapping.
+	data []byte
+
+	// Our mapping of the file descriptor passed with the region.
+	mapping []byte
+}
+
+// The guest memory, as described by the latest reqSetMemTable.
+type memoryTable []memoryRegion
+
+// Map the regions described by a reqSetMemTable message, taking ownership of
+// its file descriptors.
+func mapMemory(m *vhostMessage) (memoryTable, error) {
+	defer closeFDs(m.fds)
+
+	hdr, err := payloadAs[memoryHeader](m)
+	if err != nil {
+		return nil, err
+	}
+
+	const descSize = 32
+	n := int(hdr.Regions)
+	if n != len(m.fds) || len(m.payload) < 8+n*descSize {
+		return nil, fmt.Errorf("Corrupt memory table: %d regions, %d fds", n, len(m.fds))
+	}
+
+	var t memoryTable
+	for i := 0; i < n; i++ {
+		sub := vhostMessage{hdr: m.hdr, payload: m.payload[8+i*descSize:]}
+		desc, _ := payloadAs[memoryRegionDesc](&sub)
+
+		mapping, err := unix.Mmap(
+			m.fds[i],
+			0,
+			int(desc.MmapOffset+desc.Size),
+			unix.PROT_READ|unix.PROT_WRITE,
+			unix.MAP_SHARED)
+		if err != nil {
+			t.unmap()
+			return nil, fmt.Errorf("Mmap: %v", err)
+		}
+
+		t = append(t, memoryRegion{
+			guestAddr: desc.GuestAddr,
+			userAddr:  desc.UserAddr,
+			data:      mapping[desc.MmapOffset:],
+			mapping:   mapping,
+		})
+	}
+
+	return t, nil
+}
+
+func (t memoryTable) unmap() {
+	for _, r := range t {
+		unix.Munmap(r.mapping)
+	}
+}
+
+// Return the n bytes of guest memory at the supplied guest physical address.
+func (t memoryTable) fromGuest(addr uint64, n uint64) ([]byte, error) {
+	for _, r := range t {
+		if addr >= r.guestAddr && addr-r.guestAddr < uint64(len(r.data)) {
+			off := addr - r.guestAddr
+			if n > uint64(len(r.data))-off {
+				break
+			}
+
+			return r.data[off : off+n : off+n], nil
+		}
+	}
+
+	return nil, fmt.Errorf("Guest address range %#x+%d is not mapped", addr, n)
+}
+
+// Like fromGuest, for an address in the frontend's address space.
+func (t memoryTable) fromUser(addr uint64, n uint64) ([]byte, error) {
+	for _, r := range t {
+		if addr >= r.userAddr && addr-r.userAddr < uint64(len(r.data)) {
+			off := addr - r.userAddr
+			if n > uint64(len(r.data))-off {
+				break
+			}
+
+			return r.data[off : off+n : off+n], nil
+		}
+	}
+
+	return nil, fmt.Errorf("Frontend address range %#x+%d is not mapped", addr, n)
+}
@@ -0,0 +1,206 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package virtiofs
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Requests sent by the frontend, from the vhost-user specification
+// (https://qemu-project.gitlab.io/qemu/interop/vhost-user.html).
+const (
+	reqGetFeatures         = 1
+	reqSetFeatures         = 2
+	reqSetOwner            = 3
+	reqResetOwner          = 4
+	reqSetMemTable         = 5
+	reqSetVringNum         = 8
+	reqSetVringAddr        = 9
+	reqSetVringBase        = 10
+	reqGetVringBase        = 11
+	reqSetVringKick        = 12
+	reqSetVringCall        = 13
+	reqSetVringErr         = 14
+	reqGetProtocolFeatures = 15
+	reqSetProtocolFeatures = 16
+	reqGetQueueNum         = 17
+	reqSetVringEnable      = 18
+)
+
+// Bits in vhostHeader.Flags.
+const (
+	flagVersion   = 0x1
+	flagReply     = 0x4
+	flagNeedReply = 0x8
+)
+
+// Feature bits offered to the frontend.
+const (
+	featureProtocolFeatures = 1 << 30 // VHOST_USER_F_PROTOCOL_FEATURES
+	featureVersion1         = 1 << 32 // VIRTIO_F_VERSION_1
+
+	protocolFeatureMQ       = 1 << 0 // VHOST_USER_PROTOCOL_F_MQ
+	protocolFeatureReplyAck = 1 << 3 // VHOST_USER_PROTOCOL_F_REPLY_ACK
+)
+
+// Set in the payload of reqSetVringKick and reqSetVringCall when no file
+// descriptor is passed, meaning that the ring is to be polled.
+const vringNoFD = 0x100
+
+// The most file descriptors sent with one message: one per memory region.
+const maxFDs = 8
+
+// The largest payload we accept, which is plenty for a memory table of maxFDs
+// regions.
+const maxPayload = 4096
+
+type vhostHeader struct {
+	Request uint32
+	Flags   uint32
+	Size    uint32
+}
+
+const vhostHeaderSize = int(unsafe.Sizeof(vhostHeader{}))
+
+// The payload of reqSetVringNum, reqSetVringBase, reqGetVringBase and
+// reqSetVringEnable.
+type vringState struct {
+	Index uint32
+	Num   uint32
+}
+
+// The payload of reqSetVringAddr. The addresses are in the frontend's address
+// space.
+type vringAddr struct {
+	Index uint32
+	Flags uint32
+	Desc  uint64
+	Used  uint64
+	Avail uint64
+	Log   uint64
+}
+
+// The payload of reqSetMemTable is a memoryHeader followed by the regions,
+// each with a file descriptor.
+type memoryHeader struct {
+	Regions uint32
+	padding uint32
+}
+
+type memoryRegionDesc struct {
+	GuestAddr  uint64
+	Size       uint64
+	UserAddr   uint64
+	MmapOffset uint64
+}
+
+// A message from the frontend.
+type vhostMessage struct {
+	hdr     vhostHeader
+	payload []byte
+	fds     []int
+}
+
+// Interpret the payload as a T, failing if it's too short.
+func payloadAs[T any](m *vhostMessage) (*T, error) {
+	var zero T
+	if len(m.payload) < int(unsafe.Sizeof(zero)) {
+		return nil, fmt.Errorf("Request %d: short payload", m.hdr.Request)
+	}
+
+	return (*T)(unsafe.Pointer(&m.payload[0])), nil
+}
+
+// Read the next message from the frontend, returning io.EOF if it has hung
+// up.
+func readMessage(c *net.UnixConn) (*vhostMessage, error) {
+	var m vhostMessage
+	buf := make([]byte, vhostHeaderSize)
+	oob := make([]byte, unix.CmsgSpace(maxFDs*4))
+
+	// Any file descriptors arrive along with the header.
+	n, oobn, _, _, err := c.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+
+	if n == 0 {
+		return nil, io.EOF
+	}
+
+	if oobn > 0 {
+		cmsgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return nil, fmt.Errorf("ParseSocketControlMessage: %v", err)
+		}
+
+		for i := range cmsgs {
+			fds, err := unix.ParseUnixRights(&cmsgs[i])
+			if err != nil {
+				return nil, fmt.Errorf("ParseUnixRights: %v", err)
+			}
+
+			m.fds = append(m.fds, fds...)
+		}
+	}
+
+	if _, err := io.ReadFull(c, buf[n:]); err != nil {
+		closeFDs(m.fds)
+		return nil, fmt.Errorf("Reading header: %v", err)
+	}
+
+	m.hdr = *(*vhostHeader)(unsafe.Pointer(&buf[0]))
+	if m.hdr.Size > maxPayload {
+		closeFDs(m.fds)
+		return nil, fmt.Errorf("Request %d: %d-byte payload", m.hdr.Request, m.hdr.Size)
+	}
+
+	m.payload = make([]byte, m.hdr.Size)
+	if _, err := io.ReadFull(c, m.payload); err != nil {
+		closeFDs(m.fds)
+		return nil, fmt.Errorf("Reading payload: %v", err)
+	}
+
+	return &m, nil
+}
+
+// Send a reply to the supplied request.
+func writeReply(c *net.UnixConn, req *vhostMessage, payload []byte) error {
+	hdr := vhostHeader{
+		Request: req.hdr.Request,
+		Flags:   flagVersion | flagReply,
+		Size:    uint32(len(payload)),
+	}
+
+	b := (*[vhostHeaderSize]byte)(unsafe.Pointer(&hdr))[:]
+	_, err := c.Write(append(b, payload...))
+	return err
+}
+
+// Encode a u64 payload.
+func u64(v uint64) []byte {
+	return (*[8]byte)(unsafe.Pointer(&v))[:]
+}
+
+func closeFDs(fds []int) {
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+}
@@ -0,0 +1,350 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package virtiofs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Split virtqueues, as described in section 2.7 of the virtio specification
+// (https://docs.oasis-open.org/virtio/virtio/v1.2/virtio-v1.2.html).
+// Everything is little endian, as is every host we run on.
+
+type virtqDesc struct {
+	Addr  uint64
+	Len   uint32
+	Flags uint16
+	Next  uint16
+}
+
+const (
+	descFlagNext     = 1
+	descFlagWrite    = 2
+	descFlagIndirect = 4
+)
+
+// Set in the avail ring's flags by a driver that doesn't want to be told about
+// used buffers.
+const availFlagNoInterrupt = 1
+
+// A chain of descriptors popped from a queue: a request from the driver,
+// followed by room for the reply.
+type request struct {
+	q    *virtqueue
+	head uint16
+
+	// The device-readable buffers, holding the request, and the
+	// device-writable ones, for the reply.
+	in  [][]byte
+	out [][]byte
+}
+
+// The part of the request in the readable buffers copied to p.
+func (r *request) copyIn(p []byte) (int, error) {
+	var n int
+	for _, b := range r.in {
+		if len(b) > len(p)-n {
+			return 0, fmt.Errorf("%d-byte request doesn't fit", n+len(b))
+		}
+
+		n += copy(p[n:], b)
+	}
+
+	return n, nil
+}
+
+// Copy the concatenation of bufs into the writable buffers, returning the
+// number of bytes written.
+func (r *request) copyOut(bufs [][]byte) (int, error) {
+	var total int
+	for _, b := range bufs {
+		total += len(b)
+	}
+
+	var room int
+	for _, b := range r.out {
+		room += len(b)
+	}
+
+	if total > room {
+		return 0, fmt.Errorf("%d-byte reply exceeds %d bytes of room", total, room)
+	}
+
+	var n int
+	out := r.out
+	for _, b := range bufs {
+		for len(b) > 0 {
+			c := copy(out[0], b)
+			b = b[c:]
+			out[0] = out[0][c:]
+			if len(out[0]) == 0 {
+				out = out[1:]
+			}
+
+			n += c
+		}
+	}
+
+	return n, nil
+}
+
+type virtqueue struct {
+	index int
+
+	/////////////////////////
+	// Set up by the frontend before the queue is started
+	/////////////////////////
+
+	size uint16
+	addr vringAddr
+	base uint16
+	kick *os.File // Non-blocking, so that closing it wakes run
+
+	enabled bool
+
+	/////////////////////////
+	// Set up by start
+	/////////////////////////
+
+	desc       []virtqDesc
+	availFlags *uint32 // flags and idx
+	availRing  []uint16
+	usedFlags  *uint32 // flags and idx
+	usedRing   []usedElem
+
+	// Closed by stop to tell run to return, and by run when it does.
+	quit    chan struct{}
+	stopped chan struct{}
+
+	// The index of the next entry of availRing to consume. Owned by run.
+	lastAvail uint16
+
+	mu sync.Mutex
+
+	// The eventfd with which to tell the driver about used buffers, or -1.
+	//
+	// GUARDED_BY(mu)
+	call int
+
+	// The index of the next entry of usedRing to fill in.
+	//
+	// GUARDED_BY(mu)
+	usedIdx uint16
+}
+
+type usedElem struct {
+	ID  uint32
+	Len uint32
+}
+
+// Is the queue running?
+func (q *virtqueue) started() bool {
+	return q.stopped != nil
+}
+
+// Locate the rings in the supplied memory and start popping requests from
+// the queue, sending them to reqs until done is closed.
+func (q *virtqueue) start(
+	mem memoryTable,
+	reqs chan<- *request,
+	done <-chan struct{}) error {
+	if q.size == 0 || q.size&(q.size-1) != 0 {
+		return fmt.Errorf("Queue %d: bad size %d", q.index, q.size)
+	}
+
+	n := uint64(q.size)
+	desc, err := mem.fromUser(q.addr.Desc, n*uint64(unsafe.Sizeof(virtqDesc{})))
+	if err != nil {
+		return fmt.Errorf("Queue %d: descriptors: %v", q.index, err)
+	}
+
+	avail, err := mem.fromUser(q.addr.Avail, 4+2*n)
+	if err != nil {
+		return fmt.Errorf("Queue %d: avail ring: %v", q.index, err)
+	}
+
+	used, err := mem.fromUser(q.addr.Used, 4+8*n)
+	if err != nil {
+		return fmt.Errorf("Queue %d: used ring: %v", q.index, err)
+	}
+
+	// We access the ring indices atomically, as the driver does.
+	if uintptr(unsafe.Pointer(&avail[0]))%4 != 0 || uintptr(unsafe.Pointer(&used[0]))%4 != 0 {
+		return fmt.Errorf("Queue %d: misaligned rings", q.index)
+	}
+
+	q.desc = unsafe.Slice((*virtqDesc)(unsafe.Pointer(&desc[0])), n)
+	q.availFlags = (*uint32)(unsafe.Pointer(&avail[0]))
+	q.availRing = unsafe.Slice((*uint16)(unsafe.Pointer(&avail[4])), n)
+	q.usedFlags = (*uint32)(unsafe.Pointer(&used[0]))
+	q.usedRing = unsafe.Slice((*usedElem)(unsafe.Pointer(&used[4])), n)
+
+	q.lastAvail = q.base
+	q.mu.Lock()
+	q.usedIdx = uint16(atomic.LoadUint32(q.usedFlags) >> 16)
+	q.mu.Unlock()
+
+	q.quit = make(chan struct{})
+	q.stopped = make(chan struct{})
+	go q.run(mem, reqs, done)
+
+	return nil
+}
+
+// Stop the queue, returning the index of the next request it would have
+// popped, for reqGetVringBase.
+func (q *virtqueue) stop() uint16 {
+	if q.started() {
+		close(q.quit)
+	}
+
+	if q.kick != nil {
+		// This wakes up run if it's waiting for a kick.
+		q.kick.Close()
+		q.kick = nil
+	}
+
+	if q.started() {
+		<-q.stopped
+		q.stopped = nil
+		q.base = q.lastAvail
+	}
+
+	q.setCall(-1)
+	return q.base
+}
+
+// Replace the call eventfd, closing the old one.
+//
+// LOCKS_EXCLUDED(q.mu)
+func (q *virtqueue) setCall(fd int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.call >= 0 {
+		unix.Close(q.call)
+	}
+
+	q.call = fd
+}
+
+// Pop requests until stopped or done is closed.
+func (q *virtqueue) run(
+	mem memoryTable,
+	reqs chan<- *request,
+	done <-chan struct{}) {
+	defer close(q.stopped)
+
+	buf := make([]byte, 8)
+	for {
+		for {
+			idx := uint16(atomic.LoadUint32(q.availFlags) >> 16)
+			if idx == q.lastAvail {
+				break
+			}
+
+			head := q.availRing[q.lastAvail%q.size]
+			r, err := q.chain(mem, head)
+			if err != nil {
+				// The driver has broken the protocol. Give the chain back with
+				// nothing written, so that it at least isn't leaked.
+				q.lastAvail++
+				q.complete(head, 0)
+				continue
+			}
+
+			// Consume the entry only once the request has been handed over, so
+			// that it isn't lost if we're stopped first.
+			select {
+			case reqs <- r:
+				q.lastAvail++
+
+			case <-q.quit:
+				return
+
+			case <-done:
+				return
+			}
+		}
+
+		// The driver kicks us when it adds to the avail ring. Kicks made since
+		// the check above are remembered in the eventfd.
+		if _, err := q.kick.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+// Collect the buffers of the chain of descriptors starting at head.
+func (q *virtqueue) chain(mem memoryTable, head uint16) (*request, error) {
+	r := &request{q: q, head: head}
+	i := head
+	for n := 0; ; n++ {
+		if n >= int(q.size) || i >= q.size {
+			return nil, errors.New("Corrupt descriptor chain")
+		}
+
+		d := q.desc[i]
+		if d.Flags&descFlagIndirect != 0 {
+			// We never offer VIRTIO_RING_F_INDIRECT_DESC.
+			return nil, errors.New("Unexpected indirect descriptor")
+		}
+
+		b, err := mem.fromGuest(d.Addr, uint64(d.Len))
+		if err != nil {
+			return nil, err
+		}
+
+		if d.Flags&descFlagWrite != 0 {
+			r.out = append(r.out, b)
+		} else if len(r.out) > 0 {
+			return nil, errors.New("Readable descriptor after writable one")
+		} else {
+			r.in = append(r.in, b)
+		}
+
+		if d.Flags&descFlagNext == 0 {
+			return r, nil
+		}
+
+		i = d.Next
+	}
+}
+
+// Return the chain starting at head to the driver, saying that n bytes were
+// written to it, and tell the driver if it wants to know.
+//
+// LOCKS_EXCLUDED(q.mu)
+func (q *virtqueue) complete(head uint16, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.usedRing[q.usedIdx%q.size] = usedElem{ID: uint32(head), Len: uint32(n)}
+	q.usedIdx++
+
+	// Publish the element by bumping the index, leaving the flags zero.
+	atomic.StoreUint32(q.usedFlags, uint32(q.usedIdx)<<16)
+
+	if q.call >= 0 && atomic.LoadUint32(q.availFlags)&availFlagNoInterrupt == 0 {
+		unix.Write(q.call, u64(1))
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"time"
+)
+
+// OpStall describes an op that has been in flight for longer than
+// MountConfig.StallThreshold.
+type OpStall struct {
+	Op     interface{}
+	Unique uint64
+	Inode  uint64
+
+	// How long the op had been in flight when the stall was noticed.
+	Age time.Duration
+
+	// The ID and stack of the goroutine serving the op, if
+	// MountConfig.TrackOpGoroutines is set and the server has called
+	// MarkOpStarted for it. Otherwise zero and empty.
+	Goroutine uint64
+	Stack     string
+}
+
+// Periodically report ops that have exceeded the stall threshold, until stop
+// is closed.
+func (c *Connection) watchStalls(stop <-chan struct{}) {
+	// Check often enough that a stall is noticed well within twice the
+	// threshold.
+	interval := c.cfg.StallThreshold / 4
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, s := range c.findStalls(now) {
+				c.reportStall(s)
+			}
+
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Return the ops that have newly exceeded the stall threshold as of now,
+// marking them as reported.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) findStalls(now time.Time) []OpStall {
+	var stalls []OpStall
+
+	c.mu.Lock()
+	for id, o := range c.inflight {
+		age := now.Sub(o.start)
+		if o.stallReported || o.aborted || age < c.cfg.StallThreshold {
+			continue
+		}
+
+		o.stallReported = true
+		stalls = append(stalls, OpStall{
+			Op:        o.op,
+			Unique:    id,
+			Inode:     o.inode,
+			Age:       age,
+			Goroutine: o.goroutine,
+		})
+	}
+	c.mu.Unlock()
+
+	// Capture stacks outside the lock, and only if there is one to find.
+	var stacks map[uint64]string
+	for i := range stalls {
+		if stalls[i].Goroutine == 0 {
+			continue
+		}
+
+		if stacks == nil {
+			stacks = goroutineStacks()
+		}
+
+		stalls[i].Stack = stacks[stalls[i].Goroutine]
+	}
+
+	return stalls
+}
+
+func (c *Connection) reportStall(s OpStall) {
+	if c.cfg.OnOpStall != nil {
+		c.cfg.OnOpStall(s)
+		return
+	}
+
+	if c.errorLogger == nil {
+		return
+	}
+
+	if s.Stack == "" {
+		c.errorLogger.Printf(
+			"%s (unique %d, inode %d) stalled for %v",
+			OpName(s.Op),
+			s.Unique,
+			s.Inode,
+			s.Age.Round(time.Millisecond))
+		return
+	}
+
+	c.errorLogger.Printf(
+		"%s (unique %d, inode %d) stalled for %v on goroutine %d:\n%s",
+		OpName(s.Op),
+		s.Unique,
+		s.Inode,
+		s.Age.Round(time.Millisecond),
+		s.Goroutine,
+		s.Stack)
+}